@@ -0,0 +1,231 @@
+// Package client is a Go client for the HTTP API of a smallifier.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/smallifier/smallifier"
+)
+
+// DefaultMaxRetries is how many times a Client made by New retries a request which failed with a retryable error.
+const DefaultMaxRetries = 3
+
+// DefaultBackoff is how long a Client made by New first waits to retry a request if the server doesn't say.
+const DefaultBackoff = 500 * time.Millisecond
+
+// DefaultMaxBackoff is the longest a Client made by New waits between retries if the server doesn't say.
+const DefaultMaxBackoff = 30 * time.Second
+
+// Client creates short links on a smallifier.
+type Client struct {
+	// Base is the URL the smallifier's endpoints are served under, e.g. https://example.com/.
+	Base string
+	// Secret is sent with requests which don't set their own.
+	Secret     string
+	HTTPClient *http.Client
+	// MaxRetries is how many times a request which failed with a retryable error is retried.
+	// Retries wait as long as the server's Retry-After header asks, or back off exponentially if it has none.
+	MaxRetries int
+	// Backoff is how long to wait before the first retry if the server doesn't say, doubling for each later retry.
+	Backoff time.Duration
+	// MaxBackoff caps how long to wait between retries if the server doesn't say; <= 0 means no cap.
+	MaxBackoff time.Duration
+}
+
+// New returns a Client for the smallifier served under base, authenticating with secret.
+func New(base, secret string) *Client {
+	return &Client{
+		Base:       base,
+		Secret:     secret,
+		HTTPClient: http.DefaultClient,
+		MaxRetries: DefaultMaxRetries,
+		Backoff:    DefaultBackoff,
+		MaxBackoff: DefaultMaxBackoff,
+	}
+}
+
+// Error is an error response from a smallifier.
+type Error struct {
+	StatusCode int
+	// ErrCode identifies the kind of error, if the response said, e.g. smallifier.ErrCodeNotFound.
+	ErrCode smallifier.ErrCode
+	Message string
+	// Retryable is whether the request may succeed if it is made again.
+	Retryable bool
+	// RetryAfter is how long the server asked clients to wait before retrying, or zero if it didn't say.
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("smallifier responded with status %d: %s", e.StatusCode, e.Message)
+}
+
+// Create shortens req.LongURL, retrying if the smallifier fails for a transient reason.
+// Every attempt carries the same idempotency key, so that retries don't create more than one link.
+func (c *Client) Create(ctx context.Context, req smallifier.CreateRequest) (*smallifier.Response, error) {
+	if req.Secret == "" {
+		req.Secret = c.Secret
+	}
+	key, err := newIdempotencyKey()
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{smallifier.IdempotencyKeyHeader: {key}}
+	var resp smallifier.Response
+	if err := c.post(ctx, "_create", header, req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// CreateBundle makes a short link to a page listing the URLs in req, retrying if the smallifier fails for a transient reason.
+func (c *Client) CreateBundle(ctx context.Context, req smallifier.BundleRequest) (*smallifier.Response, error) {
+	if req.Secret == "" {
+		req.Secret = c.Secret
+	}
+	var resp smallifier.Response
+	if err := c.post(ctx, "_bundle", nil, req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Expand expands the links on other shorteners in req, creating links to where they lead unless it is a dry run,
+// using the admin API. The outcome for each URL is reported in its ExpandedLink.
+func (c *Client) Expand(ctx context.Context, req smallifier.ExpandRequest) (*smallifier.ExpandResponse, error) {
+	var resp smallifier.ExpandResponse
+	if err := c.post(ctx, "_admin/expand", c.adminHeader(), req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Repoint changes the destination of every link matching req, unless it is a dry run, using the admin API.
+func (c *Client) Repoint(ctx context.Context, req smallifier.RepointRequest) (*smallifier.RepointResponse, error) {
+	var resp smallifier.RepointResponse
+	if err := c.post(ctx, "_admin/repoint", c.adminHeader(), req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// adminHeader returns the headers authenticating requests to the admin API with c.Secret.
+func (c *Client) adminHeader() http.Header {
+	return http.Header{"Authorization": {"Bearer " + c.Secret}}
+}
+
+// newIdempotencyKey returns a random key identifying a request across its retries.
+func newIdempotencyKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// post POSTs the JSON encoding of body to endpoint with header, decoding the response into v.
+// Requests which fail with a retryable Error are retried up to c.MaxRetries times.
+func (c *Client) post(ctx context.Context, endpoint string, header http.Header, body, v interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		err := c.postOnce(ctx, endpoint, header, b, v)
+		e, ok := err.(*Error)
+		if !ok || !e.Retryable || attempt >= c.MaxRetries {
+			return err
+		}
+		wait := e.RetryAfter
+		if wait == 0 {
+			wait = c.backoff(attempt)
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// backoff returns how long to wait before the retry after attempt if the server doesn't say.
+func (c *Client) backoff(attempt int) time.Duration {
+	wait := c.Backoff << uint(attempt)
+	if c.MaxBackoff > 0 && (wait > c.MaxBackoff || wait < c.Backoff) {
+		// The shift may overflow after many attempts.
+		wait = c.MaxBackoff
+	}
+	return wait
+}
+
+func (c *Client) postOnce(ctx context.Context, endpoint string, header http.Header, b []byte, v interface{}) error {
+	req, err := http.NewRequest("POST", strings.TrimSuffix(c.Base, "/")+"/"+endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 200 {
+		return json.NewDecoder(resp.Body).Decode(v)
+	}
+	return responseError(resp)
+}
+
+// responseError makes an Error from a non-200 response.
+func responseError(resp *http.Response) *Error {
+	e := &Error{StatusCode: resp.StatusCode}
+	b, _ := ioutil.ReadAll(resp.Body)
+	var body smallifier.ErrorResponse
+	if err := json.Unmarshal(b, &body); err == nil {
+		e.ErrCode = body.ErrCode
+		e.Message = body.Message
+		e.Retryable = body.Retryable
+	} else {
+		e.Message = strings.TrimSpace(string(b))
+	}
+	if h := resp.Header.Get("Retry-After"); h != "" {
+		e.RetryAfter = parseRetryAfter(h)
+		// A Retry-After header on a 429 or 503 is an invitation to retry, even from servers which don't send the flag.
+		if resp.StatusCode == 429 || resp.StatusCode == 503 {
+			e.Retryable = true
+		}
+	}
+	return e
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either a number of seconds or an HTTP date.
+func parseRetryAfter(h string) time.Duration {
+	if n, err := strconv.Atoi(h); err == nil && n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	if t, err := http.ParseTime(h); err == nil {
+		if d := t.Sub(time.Now()); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
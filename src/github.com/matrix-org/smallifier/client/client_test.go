@@ -0,0 +1,171 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/smallifier/smallifier"
+)
+
+// flakyServer responds to the first failures requests with a retryable 503, and to the rest with a short link.
+func flakyServer(failures int, retryAfter string) (*httptest.Server, *int) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		if requests <= failures {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(503)
+			io.WriteString(w, `{"errcode": "ORG.MATRIX.SMALLIFIER.UNAVAILABLE", "error": "could not store link", "retryable": true}`)
+			return
+		}
+		io.WriteString(w, `{"short_url": "https://example.com/abc"}`)
+	}))
+	return server, &requests
+}
+
+func TestCreateRetries(t *testing.T) {
+	server, requests := flakyServer(2, "0")
+	defer server.Close()
+
+	c := New(server.URL, "sekrit")
+	c.Backoff = time.Millisecond
+	resp, err := c.Create(context.Background(), smallifier.CreateRequest{LongURL: "https://lemurs.win"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ShortURL != "https://example.com/abc" {
+		t.Errorf("short url: want https://example.com/abc got %s", resp.ShortURL)
+	}
+	if *requests != 3 {
+		t.Errorf("requests: want 3 got %d", *requests)
+	}
+}
+
+func TestCreateGivesUp(t *testing.T) {
+	server, requests := flakyServer(10, "0")
+	defer server.Close()
+
+	c := New(server.URL, "sekrit")
+	c.MaxRetries = 1
+	c.Backoff = time.Millisecond
+	_, err := c.Create(context.Background(), smallifier.CreateRequest{LongURL: "https://lemurs.win"})
+	e, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("want *Error got %v", err)
+	}
+	if e.StatusCode != 503 || e.ErrCode != smallifier.ErrCodeUnavailable || !e.Retryable || e.Message != "could not store link" {
+		t.Errorf("error: got %+v", e)
+	}
+	if *requests != 2 {
+		t.Errorf("requests: want 2 got %d", *requests)
+	}
+}
+
+func TestCreateDoesNotRetryClientErrors(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		w.WriteHeader(401)
+		io.WriteString(w, `{"errcode": "M_UNAUTHORIZED", "error": "Must specify correct secret"}`)
+	}))
+	defer server.Close()
+
+	_, err := New(server.URL, "wrong").Create(context.Background(), smallifier.CreateRequest{LongURL: "https://lemurs.win"})
+	if e, ok := err.(*Error); !ok || e.StatusCode != 401 || e.ErrCode != smallifier.ErrCodeUnauthorized || e.Retryable {
+		t.Errorf("want non-retryable 401 got %v", err)
+	}
+	if requests != 1 {
+		t.Errorf("requests: want 1 got %d", requests)
+	}
+}
+
+func TestCreateRetryHonoursContext(t *testing.T) {
+	server, _ := flakyServer(10, "60")
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := New(server.URL, "sekrit").Create(ctx, smallifier.CreateRequest{LongURL: "https://lemurs.win"})
+	if err != context.DeadlineExceeded {
+		t.Errorf("want %v got %v", context.DeadlineExceeded, err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("retry ignored context: took %s", d)
+	}
+}
+
+func TestCreateRetriesRateLimitsWithOneIdempotencyKey(t *testing.T) {
+	var keys []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		keys = append(keys, req.Header.Get(smallifier.IdempotencyKeyHeader))
+		if len(keys) == 1 {
+			// No retryable flag: the Retry-After header alone invites a retry.
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(429)
+			io.WriteString(w, `{"errcode": "M_LIMIT_EXCEEDED", "error": "slow down"}`)
+			return
+		}
+		io.WriteString(w, `{"short_url": "https://example.com/abc"}`)
+	}))
+	defer server.Close()
+
+	c := New(server.URL, "sekrit")
+	c.Backoff = time.Millisecond
+	if _, err := c.Create(context.Background(), smallifier.CreateRequest{LongURL: "https://lemurs.win"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0] == "" || keys[0] != keys[1] {
+		t.Errorf("idempotency keys: want the same key on 2 attempts got %q", keys)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	c := &Client{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	for attempt, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second} {
+		if got := c.backoff(attempt); got != want {
+			t.Errorf("attempt %d: want %s got %s", attempt, want, got)
+		}
+	}
+	if got := c.backoff(100); got != 5*time.Second {
+		t.Errorf("many attempts: want 5s got %s", got)
+	}
+}
+
+func TestExpand(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/_admin/expand" || req.Header.Get("Authorization") != "Bearer sekrit" {
+			w.WriteHeader(401)
+			return
+		}
+		io.WriteString(w, `{"links": [{"status": 200, "url": "https://bit.ly/x", "short_url": "https://example.com/abc"}], "summary": {"succeeded": 1}}`)
+	}))
+	defer server.Close()
+
+	resp, err := New(server.URL, "sekrit").Expand(context.Background(), smallifier.ExpandRequest{URLs: []string{"https://bit.ly/x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Links) != 1 || resp.Links[0].ShortURL != "https://example.com/abc" {
+		t.Errorf("want a link to https://example.com/abc got %+v", resp.Links)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if got := parseRetryAfter("3"); got != 3*time.Second {
+		t.Errorf("seconds: want 3s got %s", got)
+	}
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(date); got <= 0 || got > time.Minute {
+		t.Errorf("date: want up to 1m got %s", got)
+	}
+	if got := parseRetryAfter("soon"); got != 0 {
+		t.Errorf("bad header: want 0 got %s", got)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// adminCommand implements the "admin" subcommand, which makes any request to the admin API of a running smallifier
+// and prints the response, so that every admin operation can be scripted. Requests which change anything, i.e. those
+// which aren't GETs, must be confirmed on the terminal unless -yes is given.
+func adminCommand(fs *flag.FlagSet) func() {
+	server := fs.String("server", "http://localhost:8000", "Base URL of the smallifier, including any path it is served under")
+	secret := fs.String("secret", "", "Secret of the smallifier")
+	yes := fs.Bool("yes", false, "Make requests which change anything without asking for confirmation, as scripts must")
+	return func() {
+		if *secret == "" || fs.NArg() < 2 || fs.NArg() > 3 {
+			fs.Usage()
+			fmt.Fprintf(os.Stderr, "\nFor example: %s admin -secret ... DELETE api-keys/3\n", os.Args[0])
+			fmt.Fprintf(os.Stderr, "The body is JSON, or - to read it from standard input.\n")
+			os.Exit(2)
+		}
+		method, endpoint := strings.ToUpper(fs.Arg(0)), strings.TrimPrefix(fs.Arg(1), "/")
+		var body io.Reader
+		if fs.NArg() == 3 {
+			if fs.Arg(2) == "-" {
+				body = os.Stdin
+			} else {
+				body = strings.NewReader(fs.Arg(2))
+			}
+		}
+		if method != "GET" && !confirm(method+" "+endpoint, *yes) {
+			os.Exit(1)
+		}
+		b, err := newAdminClient(*server, *secret).do(method, endpoint, body)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		// JSON responses are indented for reading; others, such as ZIPs of QR codes, are written as they are.
+		var indented bytes.Buffer
+		if json.Indent(&indented, b, "", "  ") == nil {
+			indented.WriteByte('\n')
+			b = indented.Bytes()
+		}
+		os.Stdout.Write(b)
+	}
+}
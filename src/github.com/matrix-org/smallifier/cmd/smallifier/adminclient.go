@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/smallifier/smallifier"
+)
+
+// adminClient calls the admin API of a running smallifier, for subcommands which operate on one.
+type adminClient struct {
+	// server is the base URL of the smallifier, including any path it is served under.
+	server string
+	secret string
+	client *http.Client
+}
+
+func newAdminClient(server, secret string) *adminClient {
+	return &adminClient{
+		server: strings.TrimSuffix(server, "/"),
+		secret: secret,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// call makes a request to the admin endpoint, sending the JSON encoding of body if it is non-nil,
+// and decodes the JSON response into v.
+func (c *adminClient) call(method, endpoint string, body, v interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	b, err := c.do(method, endpoint, r)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// do makes a request to the admin endpoint with body, which may be nil, returning the body of the response.
+func (c *adminClient) do(method, endpoint string, body io.Reader) ([]byte, error) {
+	return c.request(method, "_admin/"+endpoint, body)
+}
+
+// links lists a page of the links which haven't been deleted, starting after cursor, or from the start if it is empty.
+func (c *adminClient) links(cursor string) (smallifier.LinksPage, error) {
+	var page smallifier.LinksPage
+	b, err := c.request("GET", "_links?limit=1000&cursor="+url.QueryEscape(cursor), nil)
+	if err != nil {
+		return page, err
+	}
+	return page, json.Unmarshal(b, &page)
+}
+
+// request makes a request to path, relative to the base URL of the smallifier, with body, which may be nil,
+// returning the body of the response.
+func (c *adminClient) request(method, path string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequest(method, c.server+"/"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.secret)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("server responded with status %d: %s", resp.StatusCode, bytes.TrimSpace(b))
+	}
+	return b, err
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/matrix-org/smallifier/smallifier"
+)
+
+// archiveCommand implements the "archive" subcommand, which prints the follows selected from archives written by
+// -follow-archive-dir as NDJSON, so that they can be analysed with tools such as jq without restoring them.
+func archiveCommand(fs *flag.FlagSet) func() {
+	shortPath := fs.String("short-path", "", "Only print the follows of the link at this short path")
+	from := fs.String("from", "", "Only print follows at or after this time, e.g. 2026-01-02T15:04:05Z")
+	to := fs.String("to", "", "Only print follows before this time")
+	return func() {
+		if fs.NArg() == 0 {
+			fs.Usage()
+			fmt.Fprintf(os.Stderr, "\nFor example: %s archive -short-path abc123 archives/follows-*.ndjson.zst\n", os.Args[0])
+			os.Exit(2)
+		}
+		q := smallifier.FollowArchiveQuery{ShortPath: *shortPath, From: parseArchiveTime(*from), To: parseArchiveTime(*to)}
+		enc := json.NewEncoder(os.Stdout)
+		for _, path := range fs.Args() {
+			if err := smallifier.ReadFollowArchive(path, q, func(f smallifier.ArchivedFollow) error {
+				return enc.Encode(f)
+			}); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+	}
+}
+
+// parseArchiveTime returns the unix timestamp of the RFC 3339 time t, or 0 if it is empty, exiting if it is invalid.
+func parseArchiveTime(t string) int64 {
+	if t == "" {
+		return 0
+	}
+	parsed, err := time.Parse(time.RFC3339, t)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	return parsed.Unix()
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// subcommand is a subcommand of smallifier operating on a running one, or on smallifier itself.
+// Its usage, shell completions and man page are generated from it.
+type subcommand struct {
+	name string
+	// summary describes what it does, completing "smallifier <name> ...".
+	summary string
+	// args describes the arguments it takes after its flags, e.g. "[level]".
+	args string
+	// setup defines its flags on fs, returning the function which runs it once they have been parsed.
+	setup func(fs *flag.FlagSet) func()
+}
+
+// subcommands lists every subcommand, in the order they are documented.
+// It is filled in by init, as the completion and man subcommands refer to it.
+var subcommands []*subcommand
+
+func init() {
+	subcommands = []*subcommand{
+		{"tui", "shows a live view of activity", "", tuiCommand},
+		{"loglevel", "shows or changes the logging level", "[level]", logLevelCommand},
+		{"admin", "makes any request to the admin API", "method endpoint [body]", adminCommand},
+		{"archive", "prints follows from follow archives", "archive...", archiveCommand},
+		{"diff", "compares the links of two smallifiers or databases", "a b", diffCommand},
+		{"completion", "prints a shell completion script", "bash|zsh|fish", completionCommand},
+		{"man", "writes man pages", "", manCommand},
+	}
+}
+
+// findSubcommand returns the subcommand with the given name, or nil if there isn't one.
+func findSubcommand(name string) *subcommand {
+	for _, c := range subcommands {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// flags returns c's flags, and the function which runs it once they have been parsed.
+func (c *subcommand) flags() (*flag.FlagSet, func()) {
+	fs := flag.NewFlagSet(c.name, flag.ExitOnError)
+	run := c.setup(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s [flags] %s\n%s.\n", os.Args[0], c.name, c.args, capitalize(c.summary))
+		fs.PrintDefaults()
+	}
+	return fs, run
+}
+
+// execute parses args as c's flags and arguments, then runs it.
+func (c *subcommand) execute(args []string) {
+	fs, run := c.flags()
+	fs.Parse(args)
+	run()
+}
+
+// confirm asks on the terminal whether to go ahead with action, e.g. "DELETE api-keys/3", unless yes is set.
+// Without a terminal to ask on, it refuses, so that scripts must opt in with -yes.
+func confirm(action string, yes bool) bool {
+	if yes {
+		return true
+	}
+	if !stdinIsTerminal() {
+		fmt.Fprintf(os.Stderr, "Refusing to %s without confirmation; pass -yes to run non-interactively\n", action)
+		return false
+	}
+	fmt.Fprintf(os.Stderr, "%s? [y/N] ", capitalize(action))
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// stdinIsTerminal reports whether standard input looks like a terminal: a character device, other than /dev/null.
+func stdinIsTerminal() bool {
+	fi, err := os.Stdin.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	null, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(fi, null)
+}
+
+// capitalize upper-cases the first letter of s.
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
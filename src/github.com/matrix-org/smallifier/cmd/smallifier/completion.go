@@ -0,0 +1,137 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// completionCommand implements the "completion" subcommand, which prints a script completing smallifier's
+// subcommands and flags in the given shell, e.g. for bash: source <(smallifier completion bash)
+func completionCommand(fs *flag.FlagSet) func() {
+	return func() {
+		write, ok := map[string]func(io.Writer){
+			"bash": writeBashCompletion,
+			"zsh":  writeZshCompletion,
+			"fish": writeFishCompletion,
+		}[fs.Arg(0)]
+		if !ok || fs.NArg() != 1 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		write(os.Stdout)
+	}
+}
+
+// flagNames returns the names of the flags in fs, with their leading "-".
+func flagNames(fs *flag.FlagSet) []string {
+	var names []string
+	fs.VisitAll(func(f *flag.Flag) {
+		names = append(names, "-"+f.Name)
+	})
+	return names
+}
+
+// subcommandFlags returns the flags of c.
+func subcommandFlags(c *subcommand) *flag.FlagSet {
+	fs, _ := c.flags()
+	return fs
+}
+
+// summarize returns the first sentence of a flag's usage, which is short enough to show beside it when completing.
+func summarize(usage string) string {
+	if i := strings.Index(usage, ". "); i >= 0 {
+		usage = usage[:i]
+	}
+	return strings.TrimSuffix(usage, ".")
+}
+
+func writeBashCompletion(w io.Writer) {
+	var names []string
+	for _, c := range subcommands {
+		names = append(names, c.name)
+	}
+	fmt.Fprintf(w, `_smallifier() {
+	local cur=${COMP_WORDS[COMP_CWORD]}
+	if [ "$COMP_CWORD" -eq 1 ]; then
+		COMPREPLY=($(compgen -W %q -- "$cur"))
+		return
+	fi
+	case ${COMP_WORDS[1]} in
+`, strings.Join(append(names, flagNames(flag.CommandLine)...), " "))
+	for _, c := range subcommands {
+		words := flagNames(subcommandFlags(c))
+		if c.name == "completion" {
+			words = []string{"bash", "zsh", "fish"}
+		}
+		fmt.Fprintf(w, "\t%s) COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n", c.name, strings.Join(words, " "))
+	}
+	fmt.Fprintf(w, `	*) COMPREPLY=($(compgen -W %q -- "$cur")) ;;
+	esac
+}
+complete -o default -F _smallifier smallifier
+`, strings.Join(flagNames(flag.CommandLine), " "))
+}
+
+// zshEscape escapes s for zsh within single quotes, including the characters _describe and _arguments treat specially.
+func zshEscape(s string) string {
+	return strings.NewReplacer("'", `'\''`, ":", `\:`, "[", `\[`, "]", `\]`).Replace(s)
+}
+
+// zshFlagSpecs returns the _arguments specs of the flags in fs. Flags other than booleans take a value.
+func zshFlagSpecs(fs *flag.FlagSet) string {
+	var specs []string
+	fs.VisitAll(func(f *flag.Flag) {
+		spec := "'-" + f.Name + "[" + zshEscape(summarize(f.Usage)) + "]"
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); !ok || !b.IsBoolFlag() {
+			spec += ":" + f.Name + ":"
+		}
+		specs = append(specs, spec+"'")
+	})
+	return strings.Join(specs, " ")
+}
+
+func writeZshCompletion(w io.Writer) {
+	fmt.Fprintf(w, "#compdef smallifier\n\n_smallifier() {\n\tlocal -a subcommands\n\tsubcommands=(")
+	for i, c := range subcommands {
+		if i > 0 {
+			fmt.Fprintf(w, " ")
+		}
+		fmt.Fprintf(w, "'%s:%s'", c.name, zshEscape(c.summary))
+	}
+	fmt.Fprintf(w, ")\n\tif (( CURRENT == 2 )); then\n\t\t_describe -t commands 'smallifier subcommand' subcommands\n")
+	fmt.Fprintf(w, "\t\t_arguments %s\n\t\treturn\n\tfi\n\tcase $words[2] in\n", zshFlagSpecs(flag.CommandLine))
+	for _, c := range subcommands {
+		if c.name == "completion" {
+			fmt.Fprintf(w, "\tcompletion) _values shell bash zsh fish ;;\n")
+			continue
+		}
+		fmt.Fprintf(w, "\t%s) shift words; (( CURRENT-- )); _arguments %s ;;\n", c.name, zshFlagSpecs(subcommandFlags(c)))
+	}
+	fmt.Fprintf(w, "\t*) _arguments %s ;;\n\tesac\n}\n\n_smallifier \"$@\"\n", zshFlagSpecs(flag.CommandLine))
+}
+
+// fishQuote quotes s for fish within single quotes.
+func fishQuote(s string) string {
+	return "'" + strings.Replace(strings.Replace(s, `\`, `\\`, -1), "'", `\'`, -1) + "'"
+}
+
+func writeFishCompletion(w io.Writer) {
+	fmt.Fprintf(w, "complete -c smallifier -f\n")
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(w, "complete -c smallifier -n __fish_use_subcommand -o %s -r -d %s\n", f.Name, fishQuote(summarize(f.Usage)))
+	})
+	for _, c := range subcommands {
+		fmt.Fprintf(w, "complete -c smallifier -n __fish_use_subcommand -a %s -d %s\n", c.name, fishQuote(c.summary))
+		seen := fishQuote("__fish_seen_subcommand_from " + c.name)
+		if c.name == "completion" {
+			fmt.Fprintf(w, "complete -c smallifier -n %s -a 'bash zsh fish'\n", seen)
+			continue
+		}
+		subcommandFlags(c).VisitAll(func(f *flag.Flag) {
+			fmt.Fprintf(w, "complete -c smallifier -n %s -o %s -d %s\n", seen, f.Name, fishQuote(summarize(f.Usage)))
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/BurntSushi/toml"
+)
+
+// applyConfig sets each flag in fs which wasn't already set, on the command line or from the environment, from the file
+// at path, whose keys are flags' names. Values may be strings, numbers or booleans, or, for flags which may be given
+// more than once, arrays of them. The file is TOML, e.g.
+//
+//	base-url = "https://mtrx.to/"
+//	secret = ["...", "..."]
+func applyConfig(fs *flag.FlagSet, path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var config map[string]interface{}
+	if err := toml.Unmarshal(b, &config); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	for name, v := range config {
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("%s: unknown flag %q", path, name)
+		}
+		if given[name] {
+			continue
+		}
+		values, ok := v.([]interface{})
+		if !ok {
+			values = []interface{}{v}
+		}
+		for _, v := range values {
+			switch v.(type) {
+			case string, int64, float64, bool:
+			default:
+				return fmt.Errorf("%s: %s must be a string, number or boolean, or an array of them", path, name)
+			}
+			if err := fs.Set(name, fmt.Sprint(v)); err != nil {
+				return fmt.Errorf("%s: %s: %v", path, name, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testFlags are flags of each kind, as applyConfig sets them.
+type testFlags struct {
+	fs      *flag.FlagSet
+	base    *string
+	addr    *string
+	limit   *int
+	rate    *float64
+	debug   *bool
+	timeout *time.Duration
+	secrets stringList
+}
+
+func newTestFlags() *testFlags {
+	f := &testFlags{fs: flag.NewFlagSet("smallifier", flag.ContinueOnError)}
+	f.base = f.fs.String("base-url", "", "")
+	f.addr = f.fs.String("addr", ":8080", "")
+	f.limit = f.fs.Int("create-rate-limit", 0, "")
+	f.rate = f.fs.Float64("sample-rate", 1, "")
+	f.debug = f.fs.Bool("debug", false, "")
+	f.timeout = f.fs.Duration("resolve-timeout", time.Second, "")
+	f.fs.Var(&f.secrets, "secret", "")
+	return f
+}
+
+// writeConfig writes contents to a config file, returning its path and a function removing it.
+func writeConfig(t *testing.T, contents string) (string, func()) {
+	dir, err := ioutil.TempDir("", "smallifier-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "smallifier.toml")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestApplyConfig(t *testing.T) {
+	path, cleanup := writeConfig(t, `
+		base-url = "https://mtrx.to/"
+		addr = ":443"
+		create-rate-limit = 10
+		sample-rate = 0.5
+		debug = true
+		resolve-timeout = "3s"
+		secret = ["first", "second"]
+	`)
+	defer cleanup()
+	f := newTestFlags()
+	os.Setenv(envName("create-rate-limit"), "20")
+	defer os.Unsetenv(envName("create-rate-limit"))
+	if err := f.fs.Parse([]string{"-addr", ":8443"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyEnv(f.fs); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(f.fs, path); err != nil {
+		t.Fatal(err)
+	}
+	// The command line and the environment take precedence over the file.
+	if *f.addr != ":8443" {
+		t.Errorf("addr given on the command line: want :8443 got %s", *f.addr)
+	}
+	if *f.limit != 20 {
+		t.Errorf("create-rate-limit given in the environment: want 20 got %d", *f.limit)
+	}
+	if *f.base != "https://mtrx.to/" || *f.rate != 0.5 || !*f.debug || *f.timeout != 3*time.Second {
+		t.Errorf("want values from the file got base-url %s, sample-rate %v, debug %v, resolve-timeout %v",
+			*f.base, *f.rate, *f.debug, *f.timeout)
+	}
+	if want := (stringList{"first", "second"}); !reflect.DeepEqual(f.secrets, want) {
+		t.Errorf("secret: want %v got %v", want, f.secrets)
+	}
+}
+
+func TestApplyConfigErrors(t *testing.T) {
+	for _, tc := range []struct {
+		config, want string
+	}{
+		{`bass-url = "https://mtrx.to/"`, `unknown flag "bass-url"`},
+		{"[base-url]\nhost = \"mtrx.to\"", "base-url must be a string, number or boolean, or an array of them"},
+		{`secret = [["nested"]]`, "secret must be a string, number or boolean, or an array of them"},
+		{`create-rate-limit = "lots"`, "create-rate-limit: parse error"},
+		{`base-url = `, "toml:"},
+	} {
+		path, cleanup := writeConfig(t, tc.config)
+		err := applyConfig(newTestFlags().fs, path)
+		cleanup()
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: want error containing %q got %v", tc.config, tc.want, err)
+		}
+	}
+}
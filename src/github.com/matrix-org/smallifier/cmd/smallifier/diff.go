@@ -0,0 +1,154 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/matrix-org/smallifier/smallifier"
+)
+
+// diffCommand implements the "diff" subcommand, which compares the links of two running smallifiers, sqlite databases,
+// or one of each, to verify migrations and that replicas agree. It prints a line for each short path which is only in
+// a, "-", only in b, "+", or points to different destinations, "~", in order of short path, then a summary on standard
+// error. Like diff(1), it exits 0 if there are no differences, 1 if there are, and 2 if the links couldn't be read.
+func diffCommand(fs *flag.FlagSet) func() {
+	secret := fs.String("secret", "", "Secret of the smallifiers, if a or b is one")
+	secretB := fs.String("secret-b", "", "Secret of b, if it differs from a's")
+	return func() {
+		if fs.NArg() != 2 {
+			fs.Usage()
+			fmt.Fprintf(os.Stderr, "\nFor example: %s diff -secret ... old.db https://s.example.org\n", os.Args[0])
+			fmt.Fprintf(os.Stderr, "Arguments starting http:// or https:// are smallifiers; others are databases, which are opened read-only.\n")
+			os.Exit(2)
+		}
+		if *secretB == "" {
+			*secretB = *secret
+		}
+		a, err := readLinks(fs.Arg(0), *secret)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", fs.Arg(0), err)
+			os.Exit(2)
+		}
+		b, err := readLinks(fs.Arg(1), *secretB)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", fs.Arg(1), err)
+			os.Exit(2)
+		}
+		d := diffLinks(a, b)
+		for _, l := range d.lines {
+			fmt.Println(l)
+		}
+		fmt.Fprintf(os.Stderr, "%d links in a, %d in b: %d only in a, %d only in b, %d with different destinations\n",
+			len(a), len(b), d.removed, d.added, d.changed)
+		if len(d.lines) > 0 {
+			os.Exit(1)
+		}
+	}
+}
+
+// readLinks returns the destinations of the links which haven't been deleted from source, a smallifier's base URL or
+// a path to its database, by short path. Bundles have empty destinations.
+func readLinks(source, secret string) (map[string]string, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		if secret == "" {
+			return nil, fmt.Errorf("-secret is needed to list its links")
+		}
+		return listLinks(newAdminClient(source, secret))
+	}
+	return queryLinks(source)
+}
+
+// listLinks lists the links of the smallifier client calls, page by page. Links created or deleted while they are
+// listed may or may not be included.
+func listLinks(client *adminClient) (map[string]string, error) {
+	links := map[string]string{}
+	cursor := ""
+	for {
+		page, err := client.links(cursor)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range page.Links {
+			links[l.ShortPath] = l.LongURL
+		}
+		if page.NextCursor == "" {
+			return links, nil
+		}
+		cursor = page.NextCursor
+	}
+}
+
+// queryLinks reads the links from the database at path, which is opened read-only so that one in use can be compared.
+func queryLinks(path string) (map[string]string, error) {
+	// sqlite would otherwise create a database which doesn't exist, rather than failing to open it.
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open(smallifier.DriverName, "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rows, err := db.Query(`SELECT short_path, long_url FROM links WHERE deleted = 0`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	links := map[string]string{}
+	for rows.Next() {
+		var shortPath, longURL string
+		if err := rows.Scan(&shortPath, &longURL); err != nil {
+			return nil, err
+		}
+		links[shortPath] = longURL
+	}
+	return links, rows.Err()
+}
+
+// linksDiff describes the differences between two sets of links.
+type linksDiff struct {
+	// lines describe each difference, in order of short path.
+	lines                   []string
+	added, removed, changed int
+}
+
+// diffLinks compares the links a and b, by short path. Bundles, which have empty destinations, are shown as "(bundle)".
+func diffLinks(a, b map[string]string) linksDiff {
+	var shortPaths []string
+	for p := range a {
+		shortPaths = append(shortPaths, p)
+	}
+	for p := range b {
+		if _, ok := a[p]; !ok {
+			shortPaths = append(shortPaths, p)
+		}
+	}
+	sort.Strings(shortPaths)
+	var d linksDiff
+	for _, p := range shortPaths {
+		inA, okA := a[p]
+		inB, okB := b[p]
+		if inA == "" {
+			inA = "(bundle)"
+		}
+		if inB == "" {
+			inB = "(bundle)"
+		}
+		switch {
+		case !okB:
+			d.removed++
+			d.lines = append(d.lines, fmt.Sprintf("- %s %s", p, inA))
+		case !okA:
+			d.added++
+			d.lines = append(d.lines, fmt.Sprintf("+ %s %s", p, inB))
+		case inA != inB:
+			d.changed++
+			d.lines = append(d.lines, fmt.Sprintf("~ %s %s -> %s", p, inA, inB))
+		}
+	}
+	return d
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffLinks(t *testing.T) {
+	for _, tc := range []struct {
+		name                    string
+		a, b                    map[string]string
+		lines                   []string
+		added, removed, changed int
+	}{
+		{
+			name: "same",
+			a:    map[string]string{"abc": "https://lemurs.win", "bun": ""},
+			b:    map[string]string{"abc": "https://lemurs.win", "bun": ""},
+		},
+		{
+			name:  "added",
+			a:     map[string]string{"abc": "https://lemurs.win"},
+			b:     map[string]string{"abc": "https://lemurs.win", "def": "https://ring.tail"},
+			lines: []string{"+ def https://ring.tail"},
+			added: 1,
+		},
+		{
+			name:    "removed",
+			a:       map[string]string{"abc": "https://lemurs.win", "def": "https://ring.tail"},
+			b:       map[string]string{"def": "https://ring.tail"},
+			lines:   []string{"- abc https://lemurs.win"},
+			removed: 1,
+		},
+		{
+			name:    "changed",
+			a:       map[string]string{"abc": "https://lemurs.win"},
+			b:       map[string]string{"abc": "https://ring.tail"},
+			lines:   []string{"~ abc https://lemurs.win -> https://ring.tail"},
+			changed: 1,
+		},
+		{
+			name:    "bundles",
+			a:       map[string]string{"bun": "", "abc": "https://lemurs.win", "old": ""},
+			b:       map[string]string{"bun": "", "abc": "", "new": ""},
+			lines:   []string{"~ abc https://lemurs.win -> (bundle)", "+ new (bundle)", "- old (bundle)"},
+			added:   1,
+			removed: 1,
+			changed: 1,
+		},
+	} {
+		d := diffLinks(tc.a, tc.b)
+		if !reflect.DeepEqual(d.lines, tc.lines) {
+			t.Errorf("%s: want lines %q got %q", tc.name, tc.lines, d.lines)
+		}
+		if d.added != tc.added || d.removed != tc.removed || d.changed != tc.changed {
+			t.Errorf("%s: want %d added, %d removed and %d changed got %d, %d and %d",
+				tc.name, tc.added, tc.removed, tc.changed, d.added, d.removed, d.changed)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"os"
+
+	"github.com/matrix-org/smallifier/smallifier"
+)
+
+// loadEventWebhooks reads the webhooks to deliver events of every link to from the JSON file at path.
+func loadEventWebhooks(path string) ([]smallifier.EventWebhook, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return smallifier.ParseEventWebhooks(f)
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"os"
+
+	"github.com/matrix-org/smallifier/smallifier"
+)
+
+// loadFeeds reads the feeds to watch for new entries from the JSON file at path.
+func loadFeeds(path string) ([]smallifier.Feed, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return smallifier.ParseFeeds(f)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/matrix-org/smallifier/smallifier"
+)
+
+// logLevelCommand implements the "loglevel" subcommand, which shows or changes the logging level of a running smallifier.
+func logLevelCommand(fs *flag.FlagSet) func() {
+	server := fs.String("server", "http://localhost:8000", "Base URL of the smallifier, including any path it is served under")
+	secret := fs.String("secret", "", "Secret of the smallifier")
+	revertAfter := fs.Duration("revert-after", 0, "If set, restore the previous level after this long")
+	return func() {
+		if *secret == "" || fs.NArg() > 1 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		showLogLevel(newAdminClient(*server, *secret), fs.Arg(0), *revertAfter)
+	}
+}
+
+// showLogLevel prints the logging level, after changing it to level unless that is empty.
+func showLogLevel(client *adminClient, level string, revertAfter time.Duration) {
+	var resp smallifier.LogLevelResponse
+	var err error
+	if level == "" {
+		err = client.call("GET", "loglevel", nil, &resp)
+	} else {
+		req := smallifier.LogLevelRequest{Level: level}
+		if revertAfter > 0 {
+			req.RevertAfter = revertAfter.String()
+		}
+		err = client.call("PUT", "loglevel", req, &resp)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println(resp.Level)
+}
@@ -3,29 +3,159 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/smtp"
 	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
-	_ "github.com/mattn/go-sqlite3"
-
-	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/Sirupsen/logrus"
 
 	"github.com/matrix-org/smallifier/smallifier"
 )
 
+// version is reported in usage pings. Releases set it with -ldflags "-X main.version=...".
+var version = "dev"
+
 var (
-	base        = flag.String("base-url", "", "Base URL for links, e.g. https://mtrx.to/")
-	addr        = flag.String("addr", "", "Address to listen for matrix requests on")
-	secret      = flag.String("secret", "", "Secret which must be passed to create requests")
-	lengthLimit = flag.Int("length-limit", 256, "Length limit of URLs being shortened. <= 0 means no limit.")
-	sqliteDB    = flag.String("sqlite-db", "smallifier.db", "Path to sqlite3 database for persistent storage")
+	config        = flag.String("config", "", "Path to a TOML file of flags' values, keyed by their names, e.g. base-url = \"https://mtrx.to/\", so that secrets needn't be given on the command line. Flags given on the command line or in the environment take precedence.")
+	base          = flag.String("base-url", "", "Base URL for links, e.g. https://mtrx.to/; every endpoint is served under its path")
+	addr          = flag.String("addr", "", "Address to listen for matrix requests on")
+	secrets       = stringsFlag("secret", "Secret for the admin API, which may also be passed to create requests instead of an API key. May be given more than once, to accept each.")
+	secretsFile   = flag.String("secrets-file", "", "Path to a file of further secrets to accept, one per line. Reloaded on SIGHUP, so that secrets can be rotated without restarting.")
+	lengthLimit   = flag.Int("length-limit", 256, "Length limit of URLs being shortened. <= 0 means no limit.")
+	sqliteDB      = flag.String("sqlite-db", "smallifier.db", "Path to sqlite3 database for persistent storage")
+	opsAddr       = flag.String("ops-addr", "", "Address to serve health checks, metrics and reloads under /-/ on. Empty means they are served on addr, where reloads and metrics need the secret as a bearer token.")
+	autoMigrate   = flag.Bool("auto-migrate", false, "Migrate the database if it was created by an older version, rather than refusing to start")
+	maxTimeout    = flag.Duration("max-request-timeout", 30*time.Second, "Longest deadline clients may request with the "+smallifier.TimeoutHeader+" header. <= 0 means the header is ignored.")
+	maxCreateBody = flag.Int64("max-create-body-size", 64<<10, "Size, in bytes, of the largest create request body which is read. Larger bodies are refused with 413.")
+
+	shutdownDelay   = flag.Duration("shutdown-delay", 5*time.Second, "How long to keep serving, while reporting not ready, after being told to terminate")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 20*time.Second, "How long to wait for in-flight requests to finish when shutting down")
+	drainTimeout    = flag.Duration("drain-timeout", time.Minute, "How long to wait, once requests have finished, for queued follows to be written when shutting down")
+
+	tlsCert = flag.String("tls-cert", "", "Path to a PEM certificate chain, followed by any intermediates, to serve https with on addr, so that no reverse proxy is needed. Reloaded on SIGHUP, so that it can be renewed without restarting.")
+	tlsKey  = flag.String("tls-key", "", "Path to the PEM private key of tls-cert")
+
+	httpRedirectAddr = flag.String("http-redirect-addr", "", "Address, e.g. :80, on which to permanently redirect plain-http requests to base-url. Empty means none is listened on.")
+	hstsMaxAge       = flag.Duration("hsts-max-age", 0, "How long browsers should only use https for base-url's host, sent in Strict-Transport-Security headers. 0 means none are sent.")
+	hstsPreload      = flag.Bool("hsts-preload", false, "Extend Strict-Transport-Security headers to subdomains and ask for inclusion in browsers' preload lists. hsts-max-age must be at least a year.")
+
+	deterministicKey = flag.String("deterministic-key", "", "If set, short paths are derived from a hash of the long URL keyed with this, so shortening is idempotent")
+	dedupe           = flag.Bool("dedupe", false, "Return the existing link when a URL, or an equivalent one, is shortened again, rather than creating another. Clients can ask for this per request with \"dedupe\": true.")
+	allowedOrigins   = flag.String("allowed-origins", "", "Comma-separated origins (e.g. https://example.org) browsers may create links from. Empty means any origin.")
+	browserNonces    = flag.Bool("require-browser-nonces", false, "Require create requests from browsers to pass a single-use nonce from /_nonce")
+	openCreation     = flag.Bool("open-creation", false, "Let anyone create links without the secret or an API key, getting an edit token to change each of them")
+	allowedSchemes   = flag.String("allowed-schemes", "", "Comma-separated URI schemes, besides https, which links may point to. Any of: "+strings.Join(smallifier.KnownSchemes(), ", "))
+	adminGraphQL     = flag.Bool("admin-graphql", false, "Serve read-only GraphQL queries over links, follows, campaigns and tokens at /_admin/graphql, authenticated like the rest of the admin API")
+	intentKey        = flag.String("intent-key", "", "If set, destinations in intents signed with this key are redirected to from /_intent, without storing a link")
+	statsShareKey    = flag.String("stats-share-key", "", "If set, whoever may change a link can share its stats with a link signed with this key, which expires, rather than the secret")
+	ipv6Prefix       = flag.Int("ipv6-prefix", 64, "Prefix length, in bits, by which IPv6 clients are aggregated for analytics")
+	preconnectHints  = flag.String("preconnect-hints", "off", "Hint browsers to connect to destinations' origins early: \"off\", \"link\" to add Link: rel=preconnect headers to redirects, or \"early-hints\" to also send them in 103 Early Hints")
+	matrixToMode     = flag.Bool("matrix-to-mode", false, "Show a preview page for links to matrix.to, linking on with the fragment intact, instead of redirecting")
+	alwaysPreview    = flag.Bool("always-preview", false, "Show a page disclosing the destination of every link, with a button to continue there, instead of redirecting")
+	rewriteRules     = flag.String("rewrite-rules", "", "Path to a JSON file of rules rewriting destinations as links are followed, e.g. [{\"match\": \"^http://\", \"replace\": \"https://\"}]")
+	themeDir         = flag.String("theme-dir", "", "Directory of *.html files redefining the templates of HTML pages, e.g. to add a logo or footer. Reloaded on SIGHUP.")
+	destinationHosts = flag.String("destination-hosts", "", "Path to a JSON file of hosts links may point to and hosts they may not, e.g. {\"allow\": [\"matrix.org\"], \"block\": [\"evil.example\"]}. Reloaded on SIGHUP.")
+	namespaces       = flag.String("namespaces", "", "Path to a JSON file naming namespaces, e.g. teams, by the hosts their links point to, e.g. {\"matrix\": [\"matrix.org\"]}. Links created and followed are counted in metrics labelled by namespace.")
+	maintenanceMsg   = flag.String("maintenance-message", "", "Message shown during maintenance mode, which SIGUSR1 turns on and off, as does PUT /_admin/maintenance, e.g. \"Back by 14:00 UTC\"")
+	readOnly         = flag.String("read-only", "", "Start read-only, following links but refusing to create or change them with 503s until PUT /_admin/read-only turns it off, giving this reason, e.g. \"database migration\"")
+	linkLimit        = flag.Int64("link-limit", 0, "Most links which may be stored, not counting deleted ones, beyond which creating links fails with ORG.MATRIX.SMALLIFIER.LINK_LIMIT. 0 means no limit.")
+	namespaceLimits  = flag.String("namespace-link-limits", "", "Comma-separated most links which may be stored in each namespace, e.g. matrix=10000,other=1000, as for link-limit")
+	geoIPCSV         = flag.String("geoip-csv", "", "Path to a CSV file of network,country,asn rows used to locate clients for blocking by location")
+	hostCheck        = flag.String("host-check", "log", "What to do with requests whose Host header isn't base-url's host or one of allowed-hosts: \"log\", \"reject\" with 421, or \"off\"")
+	allowedHosts     = flag.String("allowed-hosts", "", "Comma-separated hosts, besides base-url's, which requests may be for, e.g. www.mtrx.to. A host without a port is allowed on any port.")
+	expiryDays       = flag.Int("expire-unfollowed-days", 0, "Remove links which haven't been followed within this many days of being created. 0 means they are kept.")
+	idleExpiryDays   = flag.Int("expire-idle-days", 0, "Remove links which haven't been followed in this many days. 0 means they are kept.")
+	followRetention  = flag.Int("follow-retention-days", 0, "Delete follows older than this many days. 0 means they are kept forever.")
+	followArchiveDir = flag.String("follow-archive-dir", "", "Directory to archive follows in, compressed and indexed by month, before follow-retention-days deletes them. Read them with the archive subcommand.")
+	usagePingURL     = flag.String("usage-ping-url", "", "URL to POST an anonymous usage ping to daily, reporting the version, database backend, link count rounded to a power of 10 and optional features in use, to help maintainers prioritize. Empty, the default, means none is sent.")
+	vanityMinLength  = flag.Int("vanity-min-length", 10, "Shortest length of vanity aliases which don't contain a hyphen. Must be greater than 8, the length of generated short paths.")
+	pathGrowth       = flag.Float64("path-growth-threshold", 0, "Fraction of generated short paths which may collide with existing links, or of the possible paths of their length which may be in use at startup, before they are made a character longer, e.g. 0.05. 0 means they only grow once 10 attempts in a row collide.")
+
+	digestSchedule     = flag.String("digest-schedule", "", "Cron-style schedule (e.g. \"0 9 * * 1\") on which to send digests of the preceding week. Empty means no digests are sent.")
+	digestMatrixHS     = flag.String("digest-matrix-homeserver", "", "Base URL of the homeserver used to post digests to Matrix")
+	digestMatrixToken  = flag.String("digest-matrix-token", "", "Access token of the Matrix user which posts digests")
+	digestMatrixRoom   = flag.String("digest-matrix-room", "", "ID of the Matrix room to post digests to")
+	digestSMTPAddr     = flag.String("digest-smtp-addr", "", "host:port of the SMTP server used to email digests")
+	digestSMTPUser     = flag.String("digest-smtp-user", "", "Username to authenticate to the SMTP server with, if any")
+	digestSMTPPassword = flag.String("digest-smtp-password", "", "Password to authenticate to the SMTP server with")
+	digestEmailFrom    = flag.String("digest-email-from", "", "Address digest emails are sent from")
+	digestEmailTo      = flag.String("digest-email-to", "", "Comma-separated addresses to email digests to")
+
+	notifyMatrixHS    = flag.String("notify-matrix-homeserver", "", "Base URL of the homeserver used to message link creators who ask to be notified of follows over Matrix. Empty means they can't.")
+	notifyMatrixToken = flag.String("notify-matrix-token", "", "Access token of the Matrix user which messages link creators")
+
+	matrixBotHS           = flag.String("matrix-bot-homeserver", "", "Base URL of the homeserver of a Matrix user which joins rooms it is invited to and answers \"!shorten <url>\" with a short link. Empty means there is no bot.")
+	matrixBotToken        = flag.String("matrix-bot-token", "", "Access token of the Matrix bot user")
+	matrixBotAllowedUsers = flag.String("matrix-bot-allowed-users", "", "Comma-separated Matrix user IDs, or server names after a colon, e.g. \":matrix.org\", which may invite the Matrix bot and have it shorten links. Empty means anyone may if -open-creation is set, and no-one otherwise.")
+
+	feeds        = flag.String("feeds", "", "Path to a JSON file of RSS or Atom feeds to create tagged links for new entries of, announcing them by webhook or in a Matrix room as the notify-matrix-token user, e.g. [{\"url\": \"https://matrix.org/blog/feed\", \"tags\": [\"blog\"], \"matrix_room_id\": \"!room:matrix.org\"}]")
+	feedInterval = flag.Duration("feed-interval", 15*time.Minute, "How often to poll feeds for new entries")
+
+	eventWebhooks = flag.String("event-webhooks", "", "Path to a JSON file of webhooks to POST signed batches of events to as links are created and followed, e.g. [{\"url\": \"https://abuse.example.org/smallifier\", \"secret\": \"...\", \"events\": [\"create\"]}]")
+
+	wellKnownMatrix = flag.String("well-known-matrix", "", "Path to a JSON file of documents to serve under /.well-known/matrix/, by name, so that the short domain can delegate to a Matrix homeserver, e.g. {\"server\": {\"m.server\": \"matrix.example.org:443\"}}")
+
+	createRateLimit = flag.Float64("create-rate-limit", 0, "Links each client may create a minute, on average. 0 means there is no limit.")
+	createBurst     = flag.Int("create-burst", 10, "Links each client may create in quick succession before create-rate-limit applies")
+	lookupRateLimit = flag.Float64("lookup-miss-rate-limit", 0, "Links which don't exist each client may look up a minute, on average, before all its lookups are refused. 0 means there is no limit.")
+	lookupBurst     = flag.Int("lookup-miss-burst", 30, "Links which don't exist each client may look up in quick succession before lookup-miss-rate-limit applies")
+	trustedProxies  = flag.String("trusted-proxies", "", "Comma-separated addresses or CIDR networks of reverse proxies whose X-Forwarded-For headers identify clients for rate limiting")
+
+	analytics         = flag.String("analytics", "db", "What to do with follows: \"db\" to record them, \"memory\" to only count them in memory until exit, or \"off\" to discard them, e.g. in development or staging")
+	followJournal     = flag.String("follow-journal", "", "Path to a file recording follows until they are written to the database, so that they're recovered if the process dies. Empty means they are lost.")
+	dropFollowHeaders = flag.Bool("drop-follow-headers", false, "Don't record the User-Agent and Referer headers of follows, for privacy")
+	followQueueSize   = flag.Int("follow-queue-size", 0, "How many follows may wait to be written to the database before more are dropped. 0 means 1048576, or 4096 with -small-footprint.")
+	smallFootprint    = flag.Bool("small-footprint", false, "Keep less in memory, for small machines such as a Raspberry Pi")
+	repeatWindow      = flag.Duration("repeat-window", 0, "Count follows of a link from the same client and user agent this soon after the first as repeats of it, rather than new follows. 0 counts every follow.")
+
+	lookupCacheSize = flag.Int("lookup-cache-size", 0, "How many recently followed links to keep in memory, so that following them again doesn't query the database. 0 means links aren't cached.")
+	lookupCacheTTL  = flag.Duration("lookup-cache-ttl", time.Minute, "Longest time a link is cached for. Changes made through this server take effect immediately; those made through others sharing the database within this long.")
+
+	shedFollowQueue = flag.Int64("shed-follow-queue", 0, "Shed load while more follows than this are waiting to be written: follows aren't recorded, only cached links are followed, and creating links is refused. 0 means this isn't checked.")
+	shedDBLatency   = flag.Duration("shed-db-latency", 0, "Shed load while a trivial database query takes longer than this. 0 means this isn't checked.")
+	shedGoroutines  = flag.Int("shed-goroutines", 0, "Shed load while there are more goroutines than this, e.g. because of requests in flight. 0 means this isn't checked.")
+
+	resolveRedirects = flag.Int("resolve-redirects", 0, "Follow up to this many redirects from destinations when links are created or changed, refusing destinations which lead back to short links. 0 means redirects aren't followed.")
+	resolveTimeout   = flag.Duration("resolve-timeout", 5*time.Second, "How long to wait for each destination to respond while following its redirects")
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		if c := findSubcommand(os.Args[1]); c != nil {
+			c.execute(os.Args[2:])
+			return
+		}
+	}
+
+	flag.Usage = usage
 	flag.Parse()
-	if *base == "" || *addr == "" || *secret == "" {
+	if err := applyEnv(flag.CommandLine); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *config != "" {
+		if err := applyConfig(flag.CommandLine, *config); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+	allSecrets, err := loadSecrets()
+	if err != nil {
+		panic(err)
+	}
+	if *base == "" || *addr == "" || len(allSecrets) == 0 {
 		panic("Must specify non-empty base-url, addr, and secret")
 	}
 	baseURL, err := url.Parse(*base)
@@ -33,41 +163,499 @@ func main() {
 		panic(err)
 	}
 
-	db, err := sql.Open("sqlite3", *sqliteDB)
+	db, err := sql.Open(smallifier.DriverName, *sqliteDB)
 	if err != nil {
 		panic(err)
 	}
 	defer db.Close()
 
+	if err := checkSchema(db); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	opts := []smallifier.Option{
+		smallifier.WithMaxRequestTimeout(*maxTimeout),
+		smallifier.WithMaxCreateBodySize(*maxCreateBody),
+		smallifier.WithVanityMinLength(*vanityMinLength),
+		smallifier.WithIPv6Prefix(*ipv6Prefix),
+	}
+	if *pathGrowth > 0 {
+		opts = append(opts, smallifier.WithPathGrowth(*pathGrowth))
+	}
+	if *allowedOrigins != "" {
+		opts = append(opts, smallifier.WithAllowedOrigins(strings.Split(*allowedOrigins, ",")))
+	}
+	if *browserNonces {
+		opts = append(opts, smallifier.WithBrowserNonces())
+	}
+	if *openCreation {
+		opts = append(opts, smallifier.WithOpenCreation())
+	}
+	if *allowedSchemes != "" {
+		schemes := strings.Split(*allowedSchemes, ",")
+		for _, scheme := range schemes {
+			if !contains(smallifier.KnownSchemes(), strings.ToLower(scheme)) {
+				fmt.Fprintf(os.Stderr, "Unknown scheme %q in -allowed-schemes: must be one of %s\n", scheme, strings.Join(smallifier.KnownSchemes(), ", "))
+				os.Exit(2)
+			}
+		}
+		opts = append(opts, smallifier.WithAllowedSchemes(schemes...))
+	}
+	if *rewriteRules != "" {
+		rules, err := loadRewriteRules(*rewriteRules)
+		if err != nil {
+			panic(err)
+		}
+		opts = append(opts, smallifier.WithRewriteRules(rules))
+	}
+	if *notifyMatrixHS != "" {
+		opts = append(opts, smallifier.WithMatrixNotifier(&smallifier.MatrixNotifier{
+			Homeserver:  *notifyMatrixHS,
+			AccessToken: *notifyMatrixToken,
+		}))
+	}
+	if *matrixBotHS != "" {
+		b := &smallifier.MatrixBot{
+			Homeserver:  *matrixBotHS,
+			AccessToken: *matrixBotToken,
+		}
+		if *matrixBotAllowedUsers != "" {
+			b.AllowedUsers = strings.Split(*matrixBotAllowedUsers, ",")
+		}
+		opts = append(opts, smallifier.WithMatrixBot(b))
+	}
+	if *feeds != "" {
+		f, err := loadFeeds(*feeds)
+		if err != nil {
+			panic(err)
+		}
+		opts = append(opts, smallifier.WithFeeds(*feedInterval, f))
+	}
+	if *wellKnownMatrix != "" {
+		docs, err := loadWellKnownMatrix(*wellKnownMatrix)
+		if err != nil {
+			panic(err)
+		}
+		opts = append(opts, smallifier.WithWellKnownMatrix(docs))
+	}
+	if *eventWebhooks != "" {
+		hooks, err := loadEventWebhooks(*eventWebhooks)
+		if err != nil {
+			panic(err)
+		}
+		opts = append(opts, smallifier.WithEventWebhooks(hooks))
+	}
+	if *createRateLimit > 0 {
+		opts = append(opts, smallifier.WithCreateRateLimit(*createRateLimit, *createBurst))
+	}
+	if *lookupRateLimit > 0 {
+		opts = append(opts, smallifier.WithLookupRateLimit(*lookupRateLimit, *lookupBurst))
+	}
+	a, err := smallifier.ParseAnalytics(*analytics)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if a != smallifier.AnalyticsDB && *expiryDays > 0 {
+		fmt.Fprintln(os.Stderr, "-expire-unfollowed-days needs -analytics db, or followed links would be expired")
+		os.Exit(2)
+	}
+	if a != smallifier.AnalyticsDB && *idleExpiryDays > 0 {
+		fmt.Fprintln(os.Stderr, "-expire-idle-days needs -analytics db, or followed links would be expired")
+		os.Exit(2)
+	}
+	if *followRetention > 0 && *expiryDays >= *followRetention {
+		fmt.Fprintln(os.Stderr, "-expire-unfollowed-days must be less than -follow-retention-days")
+		os.Exit(2)
+	}
+	if *followRetention > 0 && *idleExpiryDays > *followRetention {
+		fmt.Fprintln(os.Stderr, "-expire-idle-days must be at most -follow-retention-days")
+		os.Exit(2)
+	}
+	if *followArchiveDir != "" && *followRetention <= 0 {
+		fmt.Fprintln(os.Stderr, "-follow-archive-dir needs -follow-retention-days, as follows are archived as they are deleted")
+		os.Exit(2)
+	}
+	opts = append(opts, smallifier.WithAnalytics(a))
+	if *followQueueSize > 0 {
+		opts = append(opts, smallifier.WithFollowQueueSize(*followQueueSize))
+	}
+	if *smallFootprint {
+		opts = append(opts, smallifier.WithSmallFootprint())
+	}
+	if *dropFollowHeaders {
+		opts = append(opts, smallifier.WithoutFollowHeaders())
+	}
+	if *followJournal != "" {
+		opts = append(opts, smallifier.WithFollowJournal(*followJournal))
+	}
+	if *repeatWindow > 0 {
+		opts = append(opts, smallifier.WithRepeatWindow(*repeatWindow))
+	}
+	if *lookupCacheSize > 0 {
+		opts = append(opts, smallifier.WithLookupCache(*lookupCacheSize, *lookupCacheTTL))
+	}
+	if *shedFollowQueue > 0 || *shedDBLatency > 0 || *shedGoroutines > 0 {
+		opts = append(opts, smallifier.WithLoadShedding(smallifier.LoadThresholds{
+			FollowQueue: *shedFollowQueue,
+			DBLatency:   *shedDBLatency,
+			Goroutines:  *shedGoroutines,
+		}))
+	}
+	if *resolveRedirects > 0 {
+		opts = append(opts, smallifier.WithRedirectResolution(&http.Client{Timeout: *resolveTimeout}, *resolveRedirects))
+	}
+	if *trustedProxies != "" {
+		proxies, err := parseNetworks(strings.Split(*trustedProxies, ","))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		opts = append(opts, smallifier.WithTrustedProxies(proxies...))
+	}
+	if *expiryDays > 0 {
+		opts = append(opts, smallifier.WithUnfollowedExpiry(*expiryDays))
+	}
+	if *idleExpiryDays > 0 {
+		opts = append(opts, smallifier.WithIdleExpiry(*idleExpiryDays))
+	}
+	if *followRetention > 0 {
+		opts = append(opts, smallifier.WithFollowRetention(*followRetention))
+	}
+	if *followArchiveDir != "" {
+		opts = append(opts, smallifier.WithFollowArchive(*followArchiveDir))
+	}
+	if *usagePingURL != "" {
+		opts = append(opts, smallifier.WithUsagePing(smallifier.HTTPUsageReporter{URL: *usagePingURL}, version))
+	}
+	if *destinationHosts != "" {
+		h, err := loadDestinationHosts(*destinationHosts)
+		if err != nil {
+			panic(err)
+		}
+		opts = append(opts, smallifier.WithDestinationHosts(h))
+	}
+	if *namespaces != "" {
+		n, err := loadNamespaces(*namespaces)
+		if err != nil {
+			panic(err)
+		}
+		opts = append(opts, smallifier.WithNamespaces(n))
+	}
+	if *readOnly != "" {
+		opts = append(opts, smallifier.WithReadOnly(*readOnly))
+	}
+	if *linkLimit > 0 || *namespaceLimits != "" {
+		limits, err := parseNamespaceLinkLimits(*namespaceLimits)
+		if err != nil {
+			panic(err)
+		}
+		opts = append(opts, smallifier.WithLinkLimits(smallifier.LinkLimits{Total: *linkLimit, Namespaces: limits}))
+	}
+	if *themeDir != "" {
+		theme, err := smallifier.LoadTheme(*themeDir)
+		if err != nil {
+			panic(err)
+		}
+		opts = append(opts, smallifier.WithTheme(theme))
+	}
+	if *geoIPCSV != "" {
+		f, err := os.Open(*geoIPCSV)
+		if err != nil {
+			panic(err)
+		}
+		g, err := smallifier.ParseGeoIPCSV(f)
+		f.Close()
+		if err != nil {
+			panic(err)
+		}
+		opts = append(opts, smallifier.WithGeoIP(g))
+	}
+	switch *preconnectHints {
+	case "off":
+	case "link", "early-hints":
+		opts = append(opts, smallifier.WithPreconnectHints(*preconnectHints == "early-hints"))
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown -preconnect-hints %q: must be off, link or early-hints\n", *preconnectHints)
+		os.Exit(2)
+	}
+	if *matrixToMode {
+		opts = append(opts, smallifier.WithMatrixToInterstitial())
+	}
+	if *alwaysPreview {
+		opts = append(opts, smallifier.WithAlwaysPreview())
+	}
+	if *adminGraphQL {
+		opts = append(opts, smallifier.WithAdminGraphQL())
+	}
+	if *intentKey != "" {
+		opts = append(opts, smallifier.WithIntentKey([]byte(*intentKey)))
+	}
+	if *statsShareKey != "" {
+		opts = append(opts, smallifier.WithStatsShareKey([]byte(*statsShareKey)))
+	}
+	if *deterministicKey != "" {
+		opts = append(opts, smallifier.WithDeterministicKey([]byte(*deterministicKey)))
+	}
+	if *dedupe {
+		opts = append(opts, smallifier.WithDedupe())
+	}
+	if *hstsMaxAge > 0 {
+		if *hstsPreload && *hstsMaxAge < smallifier.MinHSTSPreloadMaxAge {
+			fmt.Fprintln(os.Stderr, "-hsts-preload needs -hsts-max-age of at least 8760h")
+			os.Exit(2)
+		}
+		opts = append(opts, smallifier.WithHSTS(*hstsMaxAge, *hstsPreload))
+	}
+	switch *hostCheck {
+	case "off":
+	case "log", "reject":
+		var hosts []string
+		if *allowedHosts != "" {
+			hosts = strings.Split(*allowedHosts, ",")
+		}
+		opts = append(opts, smallifier.WithHostCheck(*hostCheck == "reject", hosts...))
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown -host-check %q: must be log, reject or off\n", *hostCheck)
+		os.Exit(2)
+	}
+	if *digestSchedule != "" {
+		opts = append(opts, digestOption())
+	}
+	opts = append(opts, smallifier.WithAdditionalSecrets(allSecrets[1:]...), smallifier.WithMetrics(smallifier.DefaultRegisterer))
+	s, err := smallifier.New(context.Background(), *baseURL, db, allSecrets[0], *lengthLimit, opts...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", s.Handler())
+
+	o := &ops{db: db, s: s}
+	o.secrets.Store(allSecrets)
+	// checkSchema validated the schema before starting.
+	o.schema.Store(schemaCheck{})
+	servers := []*http.Server{{Addr: *addr, Handler: mux}}
+	if *tlsCert != "" || *tlsKey != "" {
+		if *tlsCert == "" || *tlsKey == "" {
+			fmt.Fprintln(os.Stderr, "-tls-cert and -tls-key must be given together")
+			os.Exit(2)
+		}
+		cert, err := loadCertificate()
+		if err != nil {
+			panic(err)
+		}
+		o.cert = cert
+		servers[0].TLSConfig = cert.tlsConfig()
+	}
+	if *httpRedirectAddr != "" {
+		servers = append(servers, &http.Server{Addr: *httpRedirectAddr, Handler: smallifier.HTTPSRedirectHandler(*baseURL)})
+	}
+	if *opsAddr != "" {
+		opsMux := http.NewServeMux()
+		o.register(opsMux, false)
+		servers = append(servers, &http.Server{Addr: *opsAddr, Handler: opsMux})
+	} else {
+		o.register(mux, true)
+	}
+	serve(servers, o, s)
+}
+
+// serve runs servers until the process is told to terminate, then shuts down gracefully:
+// readiness checks fail for the shutdown delay so load balancers stop sending requests,
+// in-flight requests are finished, and queued follows are written.
+// SIGHUP reloads configuration, and SIGUSR1 turns maintenance mode on or off.
+func serve(servers []*http.Server, o *ops, s smallifier.Smallifier) {
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			if srv.TLSConfig != nil {
+				errs <- srv.ListenAndServeTLS("", "")
+				return
+			}
+			errs <- srv.ListenAndServe()
+		}(srv)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR1)
+	for {
+		select {
+		case err := <-errs:
+			panic(err)
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				o.reloadConfig()
+				continue
+			}
+			if sig == syscall.SIGUSR1 {
+				s.SetMaintenance(smallifier.MaintenanceRequest{Maintenance: s.Maintenance() == 0, Message: *maintenanceMsg})
+				continue
+			}
+			log.WithField("signal", sig).Info("Shutting down")
+		}
+		break
+	}
+
+	atomic.StoreInt32(&o.stopping, 1)
+	time.Sleep(*shutdownDelay)
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.WithField("err", err).Error("Error waiting for requests to finish")
+		}
+	}
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), *drainTimeout)
+	defer cancelDrain()
+	if err := s.Shutdown(drainCtx); err != nil {
+		log.WithField("err", err).Error("Gave up writing queued follows")
+	}
+	log.Info("Shut down")
+}
+
+func loadRewriteRules(path string) ([]smallifier.RewriteRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return smallifier.ParseRewriteRules(f)
+}
+
+// stringList is a flag which may be given more than once, collecting each value.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// stringsFlag defines a flag which may be given more than once, returning its values.
+func stringsFlag(name, usage string) *stringList {
+	var l stringList
+	flag.Var(&l, name, usage)
+	return &l
+}
+
+// loadSecrets returns the secrets given by -secret, followed by those in -secrets-file.
+// Blank lines and lines starting with # in the file are ignored.
+func loadSecrets() ([]string, error) {
+	all := append([]string(nil), *secrets...)
+	if *secretsFile == "" {
+		return all, nil
+	}
+	b, err := ioutil.ReadFile(*secretsFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			all = append(all, line)
+		}
+	}
+	return all, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNetworks parses CIDR networks, treating a bare address as a network of just that address.
+func parseNetworks(specs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if ip := net.ParseIP(spec); ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(spec)
+		if err != nil {
+			return nil, fmt.Errorf("bad network %q: %v", spec, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func loadDestinationHosts(path string) (*smallifier.DestinationHosts, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return smallifier.ParseDestinationHosts(f)
+}
+
+// checkSchema sets up an empty database, and refuses to use one whose schema is out of date unless --auto-migrate is set.
+func checkSchema(db *sql.DB) error {
+	err := smallifier.ValidateSchema(db)
+	if err == nil {
+		return nil
+	}
+	schemaErr, ok := err.(*smallifier.SchemaError)
+	if !ok {
+		return err
+	}
+	if !schemaErr.Migratable() {
+		return schemaErr
+	}
+	if !schemaErr.Empty && !*autoMigrate {
+		return fmt.Errorf("%v\nRefusing to start; back up %s and restart with --auto-migrate to migrate it", schemaErr, *sqliteDB)
+	}
 	if err := smallifier.CreateTables(db); err != nil {
+		return err
+	}
+	return smallifier.ValidateSchema(db)
+}
+
+// digestOption returns the Option sending digests as the digest flags configure.
+func digestOption() smallifier.Option {
+	schedule, err := smallifier.ParseSchedule(*digestSchedule)
+	if err != nil {
 		panic(err)
 	}
 
-	s := smallifier.New(*baseURL, db, *secret, *lengthLimit)
-
-	prometheus.MustRegister(prometheus.NewCounterFunc(
-		prometheus.CounterOpts{
-			Name: "random_error_count",
-			Help: "Counts number of errors encountered when trying to generate secure random numbers",
-		},
-		s.RandomErrors))
-
-	prometheus.MustRegister(prometheus.NewCounterFunc(
-		prometheus.CounterOpts{
-			Name: "auth_error_count",
-			Help: "Counts number of errors encountered because of missing or incorrect secrets",
-		},
-		s.AuthErrors))
-
-	prometheus.MustRegister(prometheus.NewCounterFunc(
-		prometheus.CounterOpts{
-			Name: "db_update_error_count",
-			Help: "Counts number of errors encountered updating the database",
-		},
-		s.DBUpdateErrors))
-
-	http.HandleFunc("/_create", s.CreateHandler)
-	http.HandleFunc("/_delete", s.DeleteHandler)
-	http.HandleFunc("/", s.LookupHandler)
-	panic(http.ListenAndServe(*addr, nil))
+	var senders []smallifier.DigestSender
+	if *digestMatrixRoom != "" {
+		senders = append(senders, &smallifier.MatrixDigestSender{
+			Homeserver:  *digestMatrixHS,
+			AccessToken: *digestMatrixToken,
+			RoomID:      *digestMatrixRoom,
+		})
+	}
+	if *digestEmailTo != "" {
+		var auth smtp.Auth
+		if *digestSMTPUser != "" {
+			host := strings.Split(*digestSMTPAddr, ":")[0]
+			auth = smtp.PlainAuth("", *digestSMTPUser, *digestSMTPPassword, host)
+		}
+		senders = append(senders, &smallifier.EmailDigestSender{
+			Addr: *digestSMTPAddr,
+			Auth: auth,
+			From: *digestEmailFrom,
+			To:   strings.Split(*digestEmailTo, ","),
+		})
+	}
+	if len(senders) == 0 {
+		panic("Must specify a Matrix room or email address to send digests to")
+	}
+
+	return smallifier.WithDigests(schedule, 7*24*time.Hour, senders...)
 }
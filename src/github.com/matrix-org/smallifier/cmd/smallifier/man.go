@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// manCommand implements the "man" subcommand, which writes man pages for smallifier and each of its subcommands,
+// generated from their flags, e.g. for packaging.
+func manCommand(fs *flag.FlagSet) func() {
+	dir := fs.String("dir", ".", "Directory to write smallifier.1 and a smallifier-<subcommand>.1 for each subcommand to")
+	return func() {
+		pages := map[string]func(io.Writer){"smallifier.1": writeMainManPage}
+		for _, c := range subcommands {
+			c := c
+			pages["smallifier-"+c.name+".1"] = func(w io.Writer) { writeSubcommandManPage(w, c) }
+		}
+		for name, write := range pages {
+			var b bytes.Buffer
+			write(&b)
+			if err := ioutil.WriteFile(filepath.Join(*dir, name), b.Bytes(), 0644); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+	}
+}
+
+// roff escapes s for use as text in a man page.
+func roff(s string) string {
+	s = strings.NewReplacer(`\`, `\e`, "-", `\-`).Replace(s)
+	// Lines starting with a control character would be taken as requests.
+	if strings.HasPrefix(s, ".") || strings.HasPrefix(s, "'") {
+		s = `\&` + s
+	}
+	return s
+}
+
+// writeManOptions writes an entry for each flag in fs.
+func writeManOptions(w io.Writer, fs *flag.FlagSet) {
+	fs.VisitAll(func(f *flag.Flag) {
+		name, usage := flag.UnquoteUsage(f)
+		fmt.Fprintf(w, ".TP\n.B \\-%s", roff(f.Name))
+		if name != "" {
+			fmt.Fprintf(w, " \\fI%s\\fR", roff(name))
+		}
+		fmt.Fprintf(w, "\n%s", roff(usage))
+		if f.DefValue != "" && f.DefValue != "false" && f.DefValue != "0" && f.DefValue != "0s" {
+			fmt.Fprintf(w, " (default %s)", roff(f.DefValue))
+		}
+		fmt.Fprintf(w, "\n")
+	})
+}
+
+func writeMainManPage(w io.Writer) {
+	fmt.Fprintf(w, ".TH SMALLIFIER 1\n.SH NAME\nsmallifier \\- a link shortener\n")
+	fmt.Fprintf(w, ".SH SYNOPSIS\n.B smallifier\n[\\fIflags\\fR]\n.br\n.B smallifier\n\\fIsubcommand\\fR [\\fIflags\\fR] [\\fIarguments\\fR]\n")
+	fmt.Fprintf(w, ".SH DESCRIPTION\nServes short links under \\fB\\-base\\-url\\fR, with an API to create and manage them.\n")
+	fmt.Fprintf(w, ".SH OPTIONS\n")
+	writeManOptions(w, flag.CommandLine)
+	fmt.Fprintf(w, ".SH SUBCOMMANDS\n")
+	for _, c := range subcommands {
+		fmt.Fprintf(w, ".TP\n.B %s\n%s; see \\fBsmallifier\\-%s\\fR(1).\n", roff(c.name), roff(capitalize(c.summary)), roff(c.name))
+	}
+	fmt.Fprintf(w, ".SH ENVIRONMENT\nEvery flag may instead be set by an environment variable named after it, e.g. \\fB%s\\fR for \\fB\\-base\\-url\\fR, or in the \\fB\\-config\\fR file.\n", roff(envName("base-url")))
+}
+
+func writeSubcommandManPage(w io.Writer, c *subcommand) {
+	title := "smallifier-" + c.name
+	fmt.Fprintf(w, ".TH %s 1\n.SH NAME\n%s \\- %s\n", roff(strings.ToUpper(title)), roff(title), roff(c.summary))
+	fmt.Fprintf(w, ".SH SYNOPSIS\n.B smallifier %s\n[\\fIflags\\fR] %s\n", roff(c.name), roff(c.args))
+	fmt.Fprintf(w, ".SH OPTIONS\n")
+	writeManOptions(w, subcommandFlags(c))
+	fmt.Fprintf(w, ".SH SEE ALSO\n\\fBsmallifier\\fR(1)\n")
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/smallifier/smallifier"
+)
+
+// loadNamespaces reads the namespaces links are counted in from the JSON file at path.
+func loadNamespaces(path string) (smallifier.Namespaces, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return smallifier.ParseNamespaces(f)
+}
+
+// parseNamespaceLinkLimits parses the most links which may be stored in each namespace, e.g. "matrix=10000,other=1000".
+func parseNamespaceLinkLimits(s string) (map[string]int64, error) {
+	limits := map[string]int64{}
+	for _, l := range strings.Split(s, ",") {
+		if l == "" {
+			continue
+		}
+		parts := strings.SplitN(l, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("namespace link limit %q must be namespace=links", l)
+		}
+		n, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("namespace link limit %q must be a positive number of links", l)
+		}
+		limits[parts[0]] = n
+	}
+	return limits, nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/matrix-org/smallifier/smallifier"
+)
+
+// envPrefix prefixes the environment variables from which flags are read.
+// Each flag's variable is its name, upper-cased with "-" replaced by "_", after the prefix: -base-url is SMALLIFIER_BASE_URL.
+const envPrefix = "SMALLIFIER_"
+
+// envName returns the environment variable the named flag may be set with.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// applyEnv sets each flag in fs which wasn't given on the command line from its environment variable, if that is set.
+func applyEnv(fs *flag.FlagSet) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if v, ok := os.LookupEnv(envName(f.Name)); ok && !given[f.Name] && err == nil {
+			if setErr := fs.Set(f.Name, v); setErr != nil {
+				err = fmt.Errorf("%s: %v", envName(f.Name), setErr)
+			}
+		}
+	})
+	return err
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nEvery flag may instead be set by an environment variable named after it, e.g. %s for -base-url,\n", envName("base-url"))
+	fmt.Fprintf(os.Stderr, "or in the -config file.\n")
+	fmt.Fprintf(os.Stderr, "\nSubcommands, each of which has its own flags:\n")
+	for _, c := range subcommands {
+		fmt.Fprintf(os.Stderr, "  %s %-10s  %s\n", os.Args[0], c.name, c.summary)
+	}
+}
+
+// ops serves the endpoints used by orchestrators such as Kubernetes to manage the process:
+//
+//	GET  /-/healthy  responds 200 while the process is serving.
+//	GET  /-/ready    responds 200 if the database is reachable, had the current schema when last checked, and the
+//	                 process isn't shutting down. The schema is checked at startup and on each reload.
+//	POST /-/reload   re-reads the rewrite rules, destination hosts, theme, secrets and TLS certificate files.
+//	GET  /metrics    serves Prometheus metrics.
+//
+// Unless they are served on an ops-addr of their own, /-/reload and /metrics need the secret as a bearer token, as
+// they are then served to anyone who can reach addr.
+type ops struct {
+	db *sql.DB
+	s  smallifier.Smallifier
+	// secrets holds the []string of secrets accepted by the Smallifier, replaced as they are reloaded.
+	secrets atomic.Value
+	// schema holds the schemaCheck from the last time the database schema was validated.
+	schema atomic.Value
+	// cert is the TLS certificate served on addr, if tls-cert was given.
+	cert *certificate
+	// stopping is set to 1 once the process has begun shutting down.
+	stopping int32
+}
+
+// register adds the ops endpoints to mux. If public is set, mux is also serving the Smallifier to anyone, so the
+// endpoints which aren't only for health checks need the secret.
+func (o *ops) register(mux *http.ServeMux, public bool) {
+	mux.HandleFunc("/-/healthy", o.healthy)
+	mux.HandleFunc("/-/ready", o.ready)
+	if public {
+		mux.Handle("/-/reload", o.requireSecret(http.HandlerFunc(o.reload)))
+		mux.Handle("/metrics", o.requireSecret(prometheus.Handler()))
+		return
+	}
+	mux.HandleFunc("/-/reload", o.reload)
+	mux.Handle("/metrics", prometheus.Handler())
+}
+
+// requireSecret wraps next, refusing requests which don't carry one of o.secrets as a bearer token.
+// Every secret is compared in constant time, so that timing doesn't reveal how much of one was guessed.
+func (o *ops) requireSecret(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		secrets, _ := o.secrets.Load().([]string)
+		valid := 0
+		for _, secret := range secrets {
+			valid |= subtle.ConstantTimeCompare([]byte(token), []byte(secret))
+		}
+		if valid != 1 {
+			w.WriteHeader(401)
+			io.WriteString(w, "Must specify correct secret\n")
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func (o *ops) healthy(w http.ResponseWriter, req *http.Request) {
+	io.WriteString(w, "OK\n")
+}
+
+func (o *ops) ready(w http.ResponseWriter, req *http.Request) {
+	if atomic.LoadInt32(&o.stopping) != 0 {
+		w.WriteHeader(503)
+		io.WriteString(w, "Shutting down\n")
+		return
+	}
+	if err := o.checkDB(req.Context()); err != nil {
+		w.WriteHeader(503)
+		fmt.Fprintf(w, "%v\n", err)
+		return
+	}
+	io.WriteString(w, "OK\n")
+}
+
+// schemaCheck is the result of validating the database schema. It wraps the error because an atomic.Value can't hold
+// a nil interface.
+type schemaCheck struct {
+	err error
+}
+
+// validateSchema checks the database schema, keeping the result for checkDB.
+func (o *ops) validateSchema() error {
+	err := smallifier.ValidateSchema(o.db)
+	if err != nil {
+		log.WithField("err", err).Error("Database schema is invalid")
+	}
+	o.schema.Store(schemaCheck{err})
+	return err
+}
+
+// checkDB pings the database and returns the result of the last schema check, so that probes stay cheap.
+func (o *ops) checkDB(ctx context.Context) error {
+	if err := o.db.PingContext(ctx); err != nil {
+		return err
+	}
+	check, ok := o.schema.Load().(schemaCheck)
+	if !ok {
+		return errors.New("database schema not yet checked")
+	}
+	return check.err
+}
+
+func (o *ops) reload(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.WriteHeader(405)
+		io.WriteString(w, "Must POST\n")
+		return
+	}
+	if err := o.reloadConfig(); err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "%v\n", err)
+		return
+	}
+	io.WriteString(w, "OK\n")
+}
+
+// reloadConfig re-reads the configuration which can be changed without restarting.
+// On error, the previous configuration is left in place. The database schema is checked again too, so that /-/ready
+// reflects a migration run since startup.
+func (o *ops) reloadConfig() error {
+	if err := o.validateSchema(); err != nil {
+		return err
+	}
+	if *rewriteRules != "" {
+		rules, err := loadRewriteRules(*rewriteRules)
+		if err != nil {
+			log.WithField("err", err).Error("Error reloading rewrite rules")
+			return err
+		}
+		o.s.SetRewriteRules(rules)
+		log.WithField("rules", len(rules)).Info("Reloaded rewrite rules")
+	}
+	if *destinationHosts != "" {
+		h, err := loadDestinationHosts(*destinationHosts)
+		if err != nil {
+			log.WithField("err", err).Error("Error reloading destination hosts")
+			return err
+		}
+		o.s.SetDestinationHosts(h)
+		log.WithFields(log.Fields{
+			"allowed": len(h.Allow),
+			"blocked": len(h.Block),
+		}).Info("Reloaded destination hosts")
+	}
+	if *secretsFile != "" {
+		all, err := loadSecrets()
+		if err == nil && len(all) == 0 {
+			err = errors.New("no secrets given")
+		}
+		if err != nil {
+			log.WithField("err", err).Error("Error reloading secrets")
+			return err
+		}
+		o.s.SetSecrets(all)
+		o.secrets.Store(all)
+		log.WithField("secrets", len(all)).Info("Reloaded secrets")
+	}
+	if *themeDir != "" {
+		theme, err := smallifier.LoadTheme(*themeDir)
+		if err != nil {
+			log.WithField("err", err).Error("Error reloading theme")
+			return err
+		}
+		o.s.SetTheme(theme)
+		log.WithField("dir", *themeDir).Info("Reloaded theme")
+	}
+	if o.cert != nil {
+		if err := o.cert.reload(); err != nil {
+			log.WithField("err", err).Error("Error reloading TLS certificate")
+			return err
+		}
+		log.WithField("cert", *tlsCert).Info("Reloaded TLS certificate")
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/smallifier/smallifier"
+)
+
+func TestReadyUsesCheckedSchema(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smallifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := sql.Open(smallifier.DriverName, filepath.Join(dir, "smallifier.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := smallifier.CreateTables(db); err != nil {
+		t.Fatal(err)
+	}
+
+	o := &ops{db: db}
+	ready := func() int {
+		w := httptest.NewRecorder()
+		o.ready(w, httptest.NewRequest("GET", "/-/ready", nil))
+		return w.Code
+	}
+
+	if code := ready(); code != 503 {
+		t.Errorf("before the schema is checked: want 503 got %d", code)
+	}
+	if err := o.validateSchema(); err != nil {
+		t.Fatal(err)
+	}
+	if code := ready(); code != 200 {
+		t.Errorf("after the schema is checked: want 200 got %d", code)
+	}
+
+	if _, err := db.Exec(`DROP TABLE link_tags`); err != nil {
+		t.Fatal(err)
+	}
+	if code := ready(); code != 200 {
+		t.Errorf("before the schema is checked again: want 200 got %d", code)
+	}
+	if err := o.reloadConfig(); err == nil {
+		t.Error("reload with an invalid schema: want error got nil")
+	}
+	if code := ready(); code != 503 {
+		t.Errorf("after reload: want 503 got %d", code)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/tls"
+	"sync/atomic"
+)
+
+// certificate is the TLS certificate served on addr, which is replaced when it is reloaded, e.g. after being renewed.
+type certificate struct {
+	// current holds the *tls.Certificate being served.
+	current atomic.Value
+}
+
+// loadCertificate reads the certificate to serve from the tls-cert and tls-key files.
+func loadCertificate() (*certificate, error) {
+	c := &certificate{}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload re-reads the tls-cert and tls-key files. On error, the previous certificate goes on being served.
+func (c *certificate) reload() error {
+	cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+	if err != nil {
+		return err
+	}
+	c.current.Store(&cert)
+	return nil
+}
+
+func (c *certificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.current.Load().(*tls.Certificate), nil
+}
+
+// tlsConfig returns the configuration serving c.
+func (c *certificate) tlsConfig() *tls.Config {
+	return &tls.Config{GetCertificate: c.get}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/matrix-org/smallifier/smallifier"
+)
+
+const (
+	// tuiKeys describes the keys the tui responds to, shown at the bottom of each frame.
+	tuiKeys = "q quit  p pause  r refresh  +/- slower/faster  t top/recent links"
+	// minTUIInterval is the shortest that pressing - may make the refresh interval.
+	minTUIInterval = 250 * time.Millisecond
+)
+
+// tuiCommand implements the "tui" subcommand, which shows a live view of a running smallifier by polling its admin API.
+// Keys act as they are pressed, as the terminal is put in cbreak mode with stty, and each frame is drawn on the
+// alternate screen with ANSI escapes, so it works in any Unix terminal without extra dependencies.
+func tuiCommand(fs *flag.FlagSet) func() {
+	server := fs.String("server", "http://localhost:8000", "Base URL of the smallifier to watch, including any path it is served under")
+	secret := fs.String("secret", "", "Secret of the smallifier being watched")
+	interval := fs.Duration("interval", 2*time.Second, "How often to refresh")
+	return func() {
+		if *secret == "" {
+			fmt.Fprintln(os.Stderr, "Must specify non-empty secret")
+			os.Exit(2)
+		}
+		t := &tui{client: newAdminClient(*server, *secret), server: *server, interval: *interval}
+		if err := t.run(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// tui is the state of the live view.
+type tui struct {
+	client   *adminClient
+	server   string
+	interval time.Duration
+	// paused stops the overview being refreshed, other than by pressing r.
+	paused bool
+	// recent shows the most recently created links rather than the most followed.
+	recent bool
+	// prev and cur are the previous and latest overviews fetched, either of which may be nil, and err is the error
+	// fetching the latest, if there was one.
+	prev, cur *smallifier.Overview
+	err       error
+}
+
+// run shows the live view until q is pressed or the process is interrupted.
+func (t *tui) run() error {
+	restore, err := cbreak()
+	if err != nil {
+		return err
+	}
+	// Draw on the alternate screen, without a cursor, so that the terminal is left as it was on exit.
+	os.Stdout.WriteString("\x1b[?1049h\x1b[?25l")
+	defer func() {
+		os.Stdout.WriteString("\x1b[?25h\x1b[?1049l")
+		restore()
+	}()
+
+	keys := make(chan byte)
+	go readKeys(os.Stdin, keys)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	t.refresh()
+	timer := time.NewTimer(t.interval)
+	defer timer.Stop()
+	for {
+		var screen bytes.Buffer
+		t.render(&screen)
+		os.Stdout.Write(screen.Bytes())
+		select {
+		case <-signals:
+			return nil
+		case k, ok := <-keys:
+			if !ok {
+				return nil
+			}
+			switch k {
+			case 'q', 'Q':
+				return nil
+			case 'p', 'P', ' ':
+				t.paused = !t.paused
+			case 'r', 'R':
+				t.refresh()
+			case '+':
+				t.interval *= 2
+			case '-':
+				if t.interval/2 >= minTUIInterval {
+					t.interval /= 2
+				}
+			case 't', 'T':
+				t.recent = !t.recent
+			}
+		case <-timer.C:
+			if !t.paused {
+				t.refresh()
+			}
+			timer.Reset(t.interval)
+		}
+	}
+}
+
+// refresh fetches the latest overview. The previous one is kept as long as the latest is from the same second, so that
+// rates can still be computed after refreshing early.
+func (t *tui) refresh() {
+	o := new(smallifier.Overview)
+	if t.err = t.client.call("GET", "overview", nil, o); t.err != nil {
+		return
+	}
+	if t.cur != nil && o.TS > t.cur.TS {
+		t.prev = t.cur
+	}
+	t.cur = o
+}
+
+// render writes a frame showing the latest overview, with rates computed from the counters of the previous one.
+func (t *tui) render(w io.Writer) {
+	// Move the cursor home and clear the screen, so each frame replaces the last.
+	io.WriteString(w, "\x1b[H\x1b[2J")
+	state := fmt.Sprintf("every %s", t.interval)
+	if t.paused {
+		state = "\x1b[7mpaused\x1b[0m"
+	}
+	fmt.Fprintf(w, "\x1b[1msmallifier %s\x1b[0m  %s", t.server, state)
+	if t.cur != nil {
+		fmt.Fprintf(w, "  %s", time.Unix(t.cur.TS, 0).Format("15:04:05"))
+	}
+	io.WriteString(w, "\n\n")
+	if t.err != nil {
+		fmt.Fprintf(w, "\x1b[31mError fetching overview: %v\x1b[0m\n\n", t.err)
+	}
+	if o := t.cur; o != nil {
+		createRate, followRate := "-", "-"
+		// The counters restart from 0 with the smallifier, so rates across a restart are unknown.
+		if p := t.prev; p != nil && o.TS > p.TS && o.Creates >= p.Creates && o.Follows >= p.Follows {
+			secs := float64(o.TS - p.TS)
+			createRate = fmt.Sprintf("%.2f/s", float64(o.Creates-p.Creates)/secs)
+			followRate = fmt.Sprintf("%.2f/s", float64(o.Follows-p.Follows)/secs)
+		}
+		fmt.Fprintf(w, "Creates  %-10s  stored %d\n", createRate, o.LinksCreated)
+		fmt.Fprintf(w, "Follows  %-10s  recorded %d\n", followRate, o.FollowsRecorded)
+
+		queue := fmt.Sprintf("Follow queue  depth %d  spooled %d", o.FollowQueue.Depth, o.FollowQueue.Spooled)
+		if o.FollowQueue.OldestPendingTS != 0 {
+			queue += fmt.Sprintf("  oldest %ds ago", o.TS-o.FollowQueue.OldestPendingTS)
+		}
+		if o.FollowQueue.Depth > 0 || o.FollowQueue.Spooled > 0 {
+			// Highlight a backlog in yellow, so it stands out during incidents.
+			queue = "\x1b[33m" + queue + "\x1b[0m"
+		}
+		fmt.Fprintf(w, "%s\n\n", queue)
+
+		if len(o.PinnedLinks) > 0 {
+			fmt.Fprintf(w, "\x1b[1mPinned\x1b[0m\n")
+			for _, l := range o.PinnedLinks {
+				fmt.Fprintf(w, "  %s  %s\n", l.ShortURL, l.LongURL)
+			}
+			fmt.Fprintf(w, "\n")
+		}
+		if t.recent {
+			fmt.Fprintf(w, "\x1b[1mRecently created\x1b[0m\n")
+			for _, l := range o.RecentLinks {
+				fmt.Fprintf(w, "  %s  %s  %s\n", time.Unix(l.CreateTS, 0).Format("15:04:05"), l.ShortURL, l.LongURL)
+			}
+		} else {
+			fmt.Fprintf(w, "\x1b[1mTop links, last hour\x1b[0m\n")
+			for _, l := range o.TopLinks {
+				fmt.Fprintf(w, "  %6d  %s  %s\n", l.Follows, l.ShortURL, l.LongURL)
+			}
+		}
+	}
+	fmt.Fprintf(w, "\n\x1b[2m%s\x1b[0m\n", tuiKeys)
+}
+
+// cbreak puts the terminal on stdin in cbreak mode, in which keys are read as they are pressed, without being echoed,
+// returning a function which restores its previous mode.
+func cbreak() (func(), error) {
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, fmt.Errorf("tui must be run in a terminal: %v", err)
+	}
+	if _, err := stty("-icanon", "-echo", "min", "1"); err != nil {
+		return nil, fmt.Errorf("tui must be run in a terminal: %v", err)
+	}
+	return func() {
+		stty(strings.TrimSpace(saved))
+	}, nil
+}
+
+// stty runs stty on the terminal on stdin with args, returning what it prints.
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return string(out), err
+}
+
+// readKeys sends each byte read from r to keys, closing it when r can't be read any more.
+func readKeys(r io.Reader, keys chan<- byte) {
+	defer close(keys)
+	buf := make([]byte, 16)
+	for {
+		n, err := r.Read(buf)
+		for _, b := range buf[:n] {
+			keys <- b
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/smallifier/smallifier"
+)
+
+func TestTUIRenderRates(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		prev, cur  *smallifier.Overview
+		wantCreate string
+		wantFollow string
+	}{
+		{"first overview", nil, &smallifier.Overview{TS: 100, Creates: 4, Follows: 10}, "Creates  -", "Follows  -"},
+		{
+			// Follows which weren't recorded, e.g. with -analytics memory, are still counted.
+			"from counters",
+			&smallifier.Overview{TS: 100, Creates: 4, Follows: 10, FollowsRecorded: 7},
+			&smallifier.Overview{TS: 102, Creates: 5, Follows: 30, FollowsRecorded: 7},
+			"Creates  0.50/s", "Follows  10.00/s",
+		},
+		{
+			"across a restart",
+			&smallifier.Overview{TS: 100, Creates: 4, Follows: 10},
+			&smallifier.Overview{TS: 102, Creates: 1, Follows: 2},
+			"Creates  -", "Follows  -",
+		},
+	} {
+		var buf bytes.Buffer
+		(&tui{prev: tc.prev, cur: tc.cur}).render(&buf)
+		if !strings.Contains(buf.String(), tc.wantCreate) || !strings.Contains(buf.String(), tc.wantFollow) {
+			t.Errorf("%s: want %q and %q got %q", tc.name, tc.wantCreate, tc.wantFollow, buf.String())
+		}
+	}
+}
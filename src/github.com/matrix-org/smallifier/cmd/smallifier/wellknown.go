@@ -0,0 +1,18 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/matrix-org/smallifier/smallifier"
+)
+
+// loadWellKnownMatrix reads the documents to serve under /.well-known/matrix/ from the JSON file at path.
+func loadWellKnownMatrix(path string) (map[string]json.RawMessage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return smallifier.ParseWellKnownMatrix(f)
+}
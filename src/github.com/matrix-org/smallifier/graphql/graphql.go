@@ -0,0 +1,352 @@
+// Package graphql implements just enough of GraphQL (https://spec.graphql.org/) to serve read-only queries over a
+// data model of Go values: operations, aliases, arguments and variables. Fragments, directives, mutations and
+// introspection aren't supported, and are refused rather than ignored.
+//
+// Fields are read from the struct fields of objects, by their JSON names, or computed by objects which are Resolvers.
+//
+// So that one query can't tie up the database behind it, queries are refused if they nest too deeply, select too many
+// fields or root fields, or might resolve too many fields once lists are expanded.
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+const (
+	// maxDepth is how deeply selections, and values, may be nested in a query.
+	maxDepth = 8
+	// maxFields is the most fields, counting aliases of the same field separately, which a query may select.
+	maxFields = 100
+	// maxRootFields is the most fields which an operation may select from the root, each of which is a query.
+	maxRootFields = 10
+	// maxCost is the most fields an operation may resolve, as estimated by executor.cost.
+	maxCost = 10000
+)
+
+// Request is the JSON-encoded body of a GraphQL request.
+type Request struct {
+	Query string `json:"query"`
+	// OperationName picks the operation to run, if Query has more than one.
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+// Response is the JSON-encoded response to a Request.
+type Response struct {
+	// Data is the result of the query, in the shape of its selections. It is absent if the query couldn't be run.
+	Data   interface{} `json:"data,omitempty"`
+	Errors []Error     `json:"errors,omitempty"`
+}
+
+// Error describes why a query, or one of its fields, couldn't be resolved.
+type Error struct {
+	Message string `json:"message"`
+	// Path is the response keys, and list indices, leading to the field which couldn't be resolved, which is null.
+	Path []interface{} `json:"path,omitempty"`
+}
+
+// Resolver is a GraphQL object with fields which are computed, rather than read from its struct fields.
+// ok is false if the object has no such computed field.
+type Resolver interface {
+	ResolveField(ctx context.Context, name string, args map[string]interface{}) (v interface{}, ok bool, err error)
+}
+
+// object is a GraphQL object in a response, whose fields are encoded in the order they were selected.
+type object []field
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+func (o object) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(f.key)
+		buf.Write(k)
+		buf.WriteByte(':')
+		v, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Run runs the operation of r's query named by its OperationName, or its only operation, against root.
+// listSizes gives the sizes of lists returned by fields without a limit argument, by field name, for estimating its cost.
+// Errors which stop the query being run are returned; those resolving fields are included in the response.
+func Run(ctx context.Context, root interface{}, r Request, listSizes map[string]int64) (Response, error) {
+	ops, err := parse(r.Query)
+	if err != nil {
+		return Response{}, err
+	}
+	var op *operation
+	for i := range ops {
+		if r.OperationName == "" && len(ops) > 1 {
+			return Response{}, fmt.Errorf("operationName is required when the document has more than one operation")
+		}
+		if r.OperationName == "" || ops[i].name == r.OperationName {
+			op = &ops[i]
+			break
+		}
+	}
+	if op == nil {
+		return Response{}, fmt.Errorf("Unknown operation named %q", r.OperationName)
+	}
+	if len(op.selections) > maxRootFields {
+		return Response{}, fmt.Errorf("Queries may select at most %d root fields", maxRootFields)
+	}
+
+	vars := make(map[string]interface{})
+	for _, v := range op.variables {
+		value, ok := r.Variables[v.name]
+		if !ok {
+			value = v.defaultValue
+		}
+		if value == nil && v.nonNull {
+			return Response{}, fmt.Errorf("Variable $%s of non-null type must be given", v.name)
+		}
+		vars[v.name] = value
+	}
+
+	e := executor{ctx: ctx, vars: vars}
+	if e.cost(op.selections, listSizes) > maxCost {
+		return Response{}, fmt.Errorf("Query would resolve more than %d fields", maxCost)
+	}
+	data := e.selectFields(root, op.selections, nil)
+	return Response{Data: data, Errors: e.errors}, nil
+}
+
+// executor resolves the selections of an operation, collecting the errors resolving them.
+type executor struct {
+	ctx    context.Context
+	vars   map[string]interface{}
+	errors []Error
+}
+
+// cost estimates how many fields resolving selections would resolve. Each field counts once, and the fields selected
+// from a list count once for each item it may have: its limit argument, or if it has none, its size from listSizes.
+// Once the estimate is over maxCost, it stops being counted.
+func (e *executor) cost(selections []selection, listSizes map[string]int64) int64 {
+	var cost int64
+	for _, sel := range selections {
+		items := listSizes[sel.name]
+		if args, err := e.substitute(sel.args); err == nil {
+			if limit, err := IntArg(args.(map[string]interface{}), "limit", items); err == nil {
+				items = limit
+			}
+		}
+		if items < 1 {
+			items = 1
+		} else if items > maxCost {
+			items = maxCost
+		}
+		if cost += 1 + items*e.cost(sel.selections, listSizes); cost > maxCost {
+			return maxCost + 1
+		}
+	}
+	return cost
+}
+
+func (e *executor) fail(path []interface{}, err error) {
+	e.errors = append(e.errors, Error{Message: err.Error(), Path: append([]interface{}(nil), path...)})
+}
+
+// selectFields resolves each of selections from the object obj. Fields which can't be resolved are null.
+func (e *executor) selectFields(obj interface{}, selections []selection, path []interface{}) object {
+	result := make(object, 0, len(selections))
+	for _, sel := range selections {
+		fieldPath := append(path, sel.key())
+		v, err := e.resolve(obj, sel)
+		if err == nil {
+			v, err = e.complete(v, sel, fieldPath)
+		}
+		if err != nil {
+			e.fail(fieldPath, err)
+			v = nil
+		}
+		result = append(result, field{sel.key(), v})
+	}
+	return result
+}
+
+// resolve returns the value of the field sel selects from obj.
+func (e *executor) resolve(obj interface{}, sel selection) (interface{}, error) {
+	if sel.name == "__typename" {
+		return typeName(obj), nil
+	}
+	args, err := e.substitute(sel.args)
+	if err != nil {
+		return nil, err
+	}
+	if r, ok := obj.(Resolver); ok {
+		v, ok, err := r.ResolveField(e.ctx, sel.name, args.(map[string]interface{}))
+		if ok || err != nil {
+			return v, err
+		}
+	}
+	if f, ok := structField(reflect.ValueOf(obj), sel.name); ok {
+		if len(sel.args) > 0 {
+			return nil, fmt.Errorf("Field %q on type %q takes no arguments", sel.name, typeName(obj))
+		}
+		return f.Interface(), nil
+	}
+	return nil, fmt.Errorf("Cannot query field %q on type %q", sel.name, typeName(obj))
+}
+
+// substitute returns v with the variables it refers to replaced by their values.
+func (e *executor) substitute(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case variable:
+		value, ok := e.vars[string(v)]
+		if !ok {
+			return nil, fmt.Errorf("Variable $%s is not defined", v)
+		}
+		return value, nil
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i := range v {
+			var err error
+			if list[i], err = e.substitute(v[i]); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	case map[string]interface{}:
+		obj := make(map[string]interface{}, len(v))
+		for k := range v {
+			var err error
+			if obj[k], err = e.substitute(v[k]); err != nil {
+				return nil, err
+			}
+		}
+		return obj, nil
+	}
+	return v, nil
+}
+
+// complete makes the value v of the field sel selects into what is included in the response:
+// the selected fields of objects, the completed items of lists, and scalars as they are.
+func (e *executor) complete(v interface{}, sel selection, path []interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if _, ok := v.(json.Marshaler); ok {
+		return scalar(v, sel)
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return nil, nil
+		}
+		if _, ok := v.(Resolver); !ok {
+			return e.complete(rv.Elem().Interface(), sel, path)
+		}
+	case reflect.Slice:
+		list := make([]interface{}, rv.Len())
+		for i := range list {
+			item, err := e.complete(rv.Index(i).Interface(), sel, append(path, i))
+			if err != nil {
+				e.fail(append(path, i), err)
+			}
+			list[i] = item
+		}
+		return list, nil
+	case reflect.Struct:
+	default:
+		return scalar(v, sel)
+	}
+	if len(sel.selections) == 0 {
+		return nil, fmt.Errorf("Field %q of type %q must have a selection of subfields", sel.name, typeName(v))
+	}
+	return e.selectFields(v, sel.selections, path), nil
+}
+
+func scalar(v interface{}, sel selection) (interface{}, error) {
+	if len(sel.selections) > 0 {
+		return nil, fmt.Errorf("Field %q must not have a selection since it is a scalar", sel.name)
+	}
+	return v, nil
+}
+
+// structField returns the field of the struct v whose JSON name is name, looking in embedded structs too.
+func structField(v reflect.Value, name string) (reflect.Value, bool) {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return reflect.Value{}, false
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return reflect.Value{}, false
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("json"), ",")[0]
+		if f.Anonymous && tag == "" {
+			if field, ok := structField(v.Field(i), name); ok {
+				return field, true
+			}
+			continue
+		}
+		if tag == name && tag != "-" && f.PkgPath == "" {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// typeName returns the name of the GraphQL type of obj, which is the name of its Go type without any graphQL prefix,
+// so that a Go type can be named e.g. graphQLLink, keeping it apart from others, for the GraphQL type Link.
+func typeName(obj interface{}) string {
+	t := reflect.TypeOf(obj)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil {
+		return "Null"
+	}
+	return strings.TrimPrefix(t.Name(), "graphQL")
+}
+
+// IntArg returns the int argument name from args, or def if it wasn't given.
+// Values given as variables are decoded from JSON as floats, so whole floats are accepted.
+func IntArg(args map[string]interface{}, name string, def int64) (int64, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return def, nil
+	case int64:
+		return v, nil
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return int64(v), nil
+		}
+	}
+	return 0, fmt.Errorf("Argument %q must be an Int", name)
+}
+
+// StringArg returns the string argument name from args, or "" if it wasn't given.
+func StringArg(args map[string]interface{}, name string) (string, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	}
+	return "", fmt.Errorf("Argument %q must be a String", name)
+}
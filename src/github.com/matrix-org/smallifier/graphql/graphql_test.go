@@ -0,0 +1,152 @@
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// testRoot is a root object with a computed field taking arguments, and a plain struct field.
+type testRoot struct {
+	Name string `json:"name"`
+}
+
+func (r testRoot) ResolveField(ctx context.Context, name string, args map[string]interface{}) (interface{}, bool, error) {
+	switch name {
+	case "echo":
+		n, err := IntArg(args, "n", 1)
+		if err != nil {
+			return nil, true, err
+		}
+		s, err := StringArg(args, "s")
+		return strings.Repeat(s, int(n)), true, err
+	case "children":
+		return []testRoot{{Name: "a"}, {Name: "b"}}, true, nil
+	case "broken":
+		return nil, true, fmt.Errorf("broken")
+	}
+	return nil, false, nil
+}
+
+func runTest(t *testing.T, r Request) (string, error) {
+	resp, err := Run(context.Background(), testRoot{Name: "root"}, r, map[string]int64{"children": 2})
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b), nil
+}
+
+func TestQueries(t *testing.T) {
+	for _, tc := range []struct {
+		req  Request
+		want string
+	}{
+		{
+			Request{Query: `{ name, __typename }`},
+			`{"data":{"name":"root","__typename":"testRoot"}}`,
+		},
+		{
+			Request{Query: `# comment
+				query Echo($n: Int = 2, $s: String!) { twice: echo(n: $n, s: $s) once: echo(s: "\u00e9\n") }`,
+				Variables: map[string]interface{}{"s": "ab"}},
+			`{"data":{"twice":"abab","once":"é\n"}}`,
+		},
+		{
+			Request{Query: `{ children { name } }`},
+			`{"data":{"children":[{"name":"a"},{"name":"b"}]}}`,
+		},
+		{
+			Request{Query: `query A { name } query B { children { name } }`, OperationName: "A"},
+			`{"data":{"name":"root"}}`,
+		},
+		{
+			Request{Query: `{ name broken nope children }`},
+			`{"data":{"name":"root","broken":null,"nope":null,"children":[null,null]},"errors":[` +
+				`{"message":"broken","path":["broken"]},` +
+				`{"message":"Cannot query field \"nope\" on type \"testRoot\"","path":["nope"]},` +
+				`{"message":"Field \"children\" of type \"testRoot\" must have a selection of subfields","path":["children",0]},` +
+				`{"message":"Field \"children\" of type \"testRoot\" must have a selection of subfields","path":["children",1]}]}`,
+		},
+		{
+			Request{Query: `{ name { x } echo(n: 1.5) }`},
+			`{"data":{"name":null,"echo":null},"errors":[` +
+				`{"message":"Field \"name\" must not have a selection since it is a scalar","path":["name"]},` +
+				`{"message":"Argument \"n\" must be an Int","path":["echo"]}]}`,
+		},
+	} {
+		got, err := runTest(t, tc.req)
+		if err != nil {
+			t.Errorf("%s: %v", tc.req.Query, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s:\nwant %s\ngot  %s", tc.req.Query, tc.want, got)
+		}
+	}
+}
+
+func TestRefusesUnsupportedQueries(t *testing.T) {
+	for _, tc := range []struct {
+		req  Request
+		want string
+	}{
+		{Request{Query: `mutation { name }`}, "Only queries are supported, not mutations"},
+		{Request{Query: `{ ...F } fragment F on Query { name }`}, "Fragments are not supported"},
+		{Request{Query: `{ name @skip(if: true) }`}, "Directives are not supported"},
+		{Request{Query: `{ name `}, `Syntax Error: unexpected "<EOF>", at offset 7`},
+		{Request{Query: `{ name(x: "oops) }`}, "Syntax Error: unterminated string, at offset 10"},
+		{Request{Query: `query A { name } query B { name }`}, "operationName is required when the document has more than one operation"},
+		{Request{Query: `query A { name }`, OperationName: "B"}, `Unknown operation named "B"`},
+		{Request{Query: `query ($s: String!) { echo(s: $s) }`}, "Variable $s of non-null type must be given"},
+		{Request{Query: ``}, "Syntax Error: the document has no operations"},
+	} {
+		if _, err := runTest(t, tc.req); err == nil || err.Error() != tc.want {
+			t.Errorf("%s: want error %q got %v", tc.req.Query, tc.want, err)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	aliases := func(n int) string {
+		var b bytes.Buffer
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(&b, "a%d: name ", i)
+		}
+		return b.String()
+	}
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		{`{ children { children { children { children { children { children { children { children { name } } } } } } } } }`,
+			"Queries may be nested at most 8 deep"},
+		{`{ echo(s: [[[[[[[[["deep"]]]]]]]]]) }`, "Queries may be nested at most 8 deep"},
+		{`{ children { ` + aliases(maxFields) + `} }`, "Queries may select at most 100 fields"},
+		{`{ ` + aliases(maxRootFields+1) + `}`, "Queries may select at most 10 root fields"},
+		{`{ children(limit: 1000) { children(limit: 1000) { name } } }`, "Query would resolve more than 10000 fields"},
+		{`query ($n: Int) { children(limit: $n) { children(limit: $n) { name } } }`, "Query would resolve more than 10000 fields"},
+	} {
+		r := Request{Query: tc.query, Variables: map[string]interface{}{"n": 1000.0}}
+		if _, err := runTest(t, r); err == nil || err.Error() != tc.want {
+			t.Errorf("%.60s: want error %q got %v", tc.query, tc.want, err)
+		}
+	}
+
+	// Lists count as their default sizes, and limits below them make them cheaper.
+	for _, query := range []string{
+		`{ children { children { children { name } } } }`,
+		`{ ` + aliases(maxRootFields) + `}`,
+		`{ children(limit: 99) { children(limit: 99) { name } } }`,
+	} {
+		if _, err := runTest(t, Request{Query: query}); err != nil {
+			t.Errorf("%.60s: %v", query, err)
+		}
+	}
+}
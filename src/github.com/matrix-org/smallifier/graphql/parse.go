@@ -0,0 +1,451 @@
+package graphql
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// token is a lexical token of a GraphQL document. kind is one of the punctuators, '.' for "...", 'n' for a name,
+// 'i' for an int, 'f' for a float, 's' for a string or 0 at the end of the document.
+type token struct {
+	kind  byte
+	value string
+	pos   int
+}
+
+// lex splits src into tokens, dropping whitespace, commas and comments.
+func lex(src string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' || c == 0xef && strings.HasPrefix(src[i:], "\ufeff"):
+			if c == 0xef {
+				i += 3
+			} else {
+				i++
+			}
+		case c == '#':
+			for i < len(src) && src[i] != '\n' && src[i] != '\r' {
+				i++
+			}
+		case strings.IndexByte("!$&()[]{}:=@|", c) >= 0:
+			tokens = append(tokens, token{c, string(c), i})
+			i++
+		case strings.HasPrefix(src[i:], "..."):
+			tokens = append(tokens, token{'.', "...", i})
+			i += 3
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			start := i
+			for i < len(src) && (src[i] == '_' || src[i] >= 'a' && src[i] <= 'z' || src[i] >= 'A' && src[i] <= 'Z' || src[i] >= '0' && src[i] <= '9') {
+				i++
+			}
+			tokens = append(tokens, token{'n', src[start:i], start})
+		case c == '-' || c >= '0' && c <= '9':
+			start := i
+			kind := byte('i')
+			i++
+			for i < len(src) && (src[i] >= '0' && src[i] <= '9' || strings.IndexByte(".eE+-", src[i]) >= 0) {
+				if strings.IndexByte(".eE", src[i]) >= 0 {
+					kind = 'f'
+				}
+				i++
+			}
+			tokens = append(tokens, token{kind, src[start:i], start})
+		case c == '"':
+			if strings.HasPrefix(src[i:], `"""`) {
+				return nil, fmt.Errorf("Syntax Error: block strings are not supported, at offset %d", i)
+			}
+			s, n, err := lexString(src[i:])
+			if err != nil {
+				return nil, fmt.Errorf("Syntax Error: %v, at offset %d", err, i)
+			}
+			tokens = append(tokens, token{'s', s, i})
+			i += n
+		default:
+			r, _ := utf8.DecodeRuneInString(src[i:])
+			return nil, fmt.Errorf("Syntax Error: unexpected character %q, at offset %d", r, i)
+		}
+	}
+	return append(tokens, token{0, "<EOF>", len(src)}), nil
+}
+
+// lexString decodes the quoted string at the start of src, returning it and how many bytes it took up.
+func lexString(src string) (string, int, error) {
+	var b bytes.Buffer
+	for i := 1; i < len(src); i++ {
+		switch c := src[i]; c {
+		case '"':
+			return b.String(), i + 1, nil
+		case '\n', '\r':
+			return "", 0, fmt.Errorf("unterminated string")
+		case '\\':
+			if i+1 >= len(src) {
+				return "", 0, fmt.Errorf("unterminated string")
+			}
+			i++
+			switch e := src[i]; e {
+			case '"', '\\', '/':
+				b.WriteByte(e)
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'u':
+				if i+5 > len(src) {
+					return "", 0, fmt.Errorf("bad unicode escape")
+				}
+				r, err := strconv.ParseUint(src[i+1:i+5], 16, 16)
+				if err != nil {
+					return "", 0, fmt.Errorf("bad unicode escape")
+				}
+				b.WriteRune(rune(r))
+				i += 4
+			default:
+				return "", 0, fmt.Errorf("bad escape \\%c", e)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
+
+// operation is a query in a GraphQL document.
+type operation struct {
+	name       string
+	variables  []variableDefinition
+	selections []selection
+}
+
+type variableDefinition struct {
+	name         string
+	nonNull      bool
+	defaultValue interface{}
+}
+
+// selection is a field selected from an object, with the selections from its value if it is an object too.
+type selection struct {
+	alias, name string
+	args        map[string]interface{}
+	selections  []selection
+}
+
+// key is the name the selection's value is given in the response.
+func (s selection) key() string {
+	if s.alias != "" {
+		return s.alias
+	}
+	return s.name
+}
+
+// variable is a reference to a variable in a value, replaced by its value when the query is run.
+type variable string
+
+type parser struct {
+	tokens []token
+	i      int
+	// depth is how deeply the selection set or value being parsed is nested, and fields how many have been parsed.
+	depth, fields int
+}
+
+// nest notes that a selection set or value is being entered, refusing the query if it is nested too deeply.
+// unnest must be called when it is left.
+func (p *parser) nest() error {
+	if p.depth++; p.depth > maxDepth {
+		return fmt.Errorf("Queries may be nested at most %d deep", maxDepth)
+	}
+	return nil
+}
+
+func (p *parser) unnest() {
+	p.depth--
+}
+
+// parse parses the operations of a GraphQL document.
+func parse(src string) ([]operation, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := parser{tokens: tokens}
+	var ops []operation
+	for p.peek().kind != 0 {
+		op, err := p.operation()
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	if len(ops) == 0 {
+		return nil, fmt.Errorf("Syntax Error: the document has no operations")
+	}
+	return ops, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.i]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.i]
+	if t.kind != 0 {
+		p.i++
+	}
+	return t
+}
+
+func (p *parser) expect(kind byte) (token, error) {
+	t := p.next()
+	if t.kind != kind {
+		return t, unexpected(t)
+	}
+	return t, nil
+}
+
+func unexpected(t token) error {
+	return fmt.Errorf("Syntax Error: unexpected %q, at offset %d", t.value, t.pos)
+}
+
+func (p *parser) operation() (operation, error) {
+	var op operation
+	t := p.peek()
+	if t.kind == '{' {
+		var err error
+		op.selections, err = p.selectionSet()
+		return op, err
+	}
+	if t.kind != 'n' {
+		return op, unexpected(t)
+	}
+	switch t.value {
+	case "query":
+	case "mutation", "subscription":
+		return op, fmt.Errorf("Only queries are supported, not %ss", t.value)
+	case "fragment":
+		return op, fmt.Errorf("Fragments are not supported")
+	default:
+		return op, unexpected(t)
+	}
+	p.next()
+	if p.peek().kind == 'n' {
+		op.name = p.next().value
+	}
+	if p.peek().kind == '(' {
+		p.next()
+		for p.peek().kind != ')' {
+			v, err := p.variableDefinition()
+			if err != nil {
+				return op, err
+			}
+			op.variables = append(op.variables, v)
+		}
+		p.next()
+	}
+	if p.peek().kind == '@' {
+		return op, fmt.Errorf("Directives are not supported")
+	}
+	var err error
+	op.selections, err = p.selectionSet()
+	return op, err
+}
+
+func (p *parser) variableDefinition() (variableDefinition, error) {
+	var v variableDefinition
+	if _, err := p.expect('$'); err != nil {
+		return v, err
+	}
+	name, err := p.expect('n')
+	if err != nil {
+		return v, err
+	}
+	v.name = name.value
+	if _, err := p.expect(':'); err != nil {
+		return v, err
+	}
+	if v.nonNull, err = p.typeReference(); err != nil {
+		return v, err
+	}
+	if p.peek().kind == '=' {
+		p.next()
+		if v.defaultValue, err = p.value(true); err != nil {
+			return v, err
+		}
+	}
+	return v, nil
+}
+
+// typeReference skips over a type, e.g. [String!]!, reporting whether it is non-null.
+// Types aren't otherwise checked: arguments are checked as the fields they are given to are resolved.
+func (p *parser) typeReference() (nonNull bool, err error) {
+	if p.peek().kind == '[' {
+		p.next()
+		if _, err := p.typeReference(); err != nil {
+			return false, err
+		}
+		if _, err := p.expect(']'); err != nil {
+			return false, err
+		}
+	} else if _, err := p.expect('n'); err != nil {
+		return false, err
+	}
+	if p.peek().kind == '!' {
+		p.next()
+		return true, nil
+	}
+	return false, nil
+}
+
+func (p *parser) selectionSet() ([]selection, error) {
+	if _, err := p.expect('{'); err != nil {
+		return nil, err
+	}
+	if err := p.nest(); err != nil {
+		return nil, err
+	}
+	defer p.unnest()
+	var selections []selection
+	for p.peek().kind != '}' {
+		if p.peek().kind == '.' {
+			return nil, fmt.Errorf("Fragments are not supported")
+		}
+		sel, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, sel)
+	}
+	p.next()
+	if len(selections) == 0 {
+		return nil, fmt.Errorf("Syntax Error: empty selection set")
+	}
+	return selections, nil
+}
+
+func (p *parser) selection() (selection, error) {
+	var sel selection
+	name, err := p.expect('n')
+	if err != nil {
+		return sel, err
+	}
+	if p.fields++; p.fields > maxFields {
+		return sel, fmt.Errorf("Queries may select at most %d fields", maxFields)
+	}
+	sel.name = name.value
+	if p.peek().kind == ':' {
+		p.next()
+		if name, err = p.expect('n'); err != nil {
+			return sel, err
+		}
+		sel.alias, sel.name = sel.name, name.value
+	}
+	if p.peek().kind == '(' {
+		p.next()
+		sel.args = make(map[string]interface{})
+		for p.peek().kind != ')' {
+			name, err := p.expect('n')
+			if err != nil {
+				return sel, err
+			}
+			if _, err := p.expect(':'); err != nil {
+				return sel, err
+			}
+			if sel.args[name.value], err = p.value(false); err != nil {
+				return sel, err
+			}
+		}
+		p.next()
+	}
+	if p.peek().kind == '@' {
+		return sel, fmt.Errorf("Directives are not supported")
+	}
+	if p.peek().kind == '{' {
+		if sel.selections, err = p.selectionSet(); err != nil {
+			return sel, err
+		}
+	}
+	return sel, nil
+}
+
+// value parses a value, which must be constant, i.e. not refer to variables, if constant is set.
+// Enum values are parsed as strings.
+func (p *parser) value(constant bool) (interface{}, error) {
+	t := p.next()
+	switch t.kind {
+	case '$':
+		if constant {
+			return nil, unexpected(t)
+		}
+		name, err := p.expect('n')
+		return variable(name.value), err
+	case 'i':
+		n, err := strconv.ParseInt(t.value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Syntax Error: bad int %s, at offset %d", t.value, t.pos)
+		}
+		return n, nil
+	case 'f':
+		f, err := strconv.ParseFloat(t.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Syntax Error: bad float %s, at offset %d", t.value, t.pos)
+		}
+		return f, nil
+	case 's':
+		return t.value, nil
+	case 'n':
+		switch t.value {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		return t.value, nil
+	case '[':
+		if err := p.nest(); err != nil {
+			return nil, err
+		}
+		defer p.unnest()
+		list := []interface{}{}
+		for p.peek().kind != ']' {
+			v, err := p.value(constant)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		p.next()
+		return list, nil
+	case '{':
+		if err := p.nest(); err != nil {
+			return nil, err
+		}
+		defer p.unnest()
+		obj := make(map[string]interface{})
+		for p.peek().kind != '}' {
+			name, err := p.expect('n')
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.expect(':'); err != nil {
+				return nil, err
+			}
+			if obj[name.value], err = p.value(constant); err != nil {
+				return nil, err
+			}
+		}
+		p.next()
+		return obj, nil
+	}
+	return nil, unexpected(t)
+}
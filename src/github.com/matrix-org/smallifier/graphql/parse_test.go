@@ -0,0 +1,83 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+// fuzzSeeds are queries, valid and not, from which the fuzzers start.
+var fuzzSeeds = []string{
+	`{ name, __typename }`,
+	`# comment
+	query Echo($n: Int = 2, $s: String!) { twice: echo(n: $n, s: $s) once: echo(s: "é\n") }`,
+	`query A { name } query B { children(limit: 2) { name } }`,
+	`{ echo(s: [{a: 1.5e3, b: [true, null, ENUM]}]) }`,
+	`{ name(x: "oops) }`,
+	`{ ...F } fragment F on Query { name }`,
+	`{ name @skip(if: true) }`,
+	`mutation { name }`,
+	`{ echo(s: """block""") }`,
+	"\ufeff{ name }",
+	`{ echo(s: "\u12") }`,
+	`{ children { children { children { children { children { children { children { children { name } } } } } } } } }`,
+}
+
+// FuzzParse checks that parse neither panics nor accepts a query breaking its limits.
+func FuzzParse(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, src string) {
+		ops, err := parse(src)
+		if err != nil {
+			return
+		}
+		if len(ops) == 0 {
+			t.Fatalf("%q: parsed with no operations", src)
+		}
+		fields := 0
+		for _, op := range ops {
+			if len(op.selections) == 0 {
+				t.Fatalf("%q: operation %q parsed with no selections", src, op.name)
+			}
+			fields += checkSelections(t, src, op.selections, 1)
+		}
+		if fields > maxFields {
+			t.Fatalf("%q: parsed with %d fields", src, fields)
+		}
+	})
+}
+
+// checkSelections fails t if selections are nested more than maxDepth deep, taking them to be nested depth deep,
+// and returns how many fields they select.
+func checkSelections(t *testing.T, src string, selections []selection, depth int) int {
+	if depth > maxDepth {
+		t.Fatalf("%q: parsed with selections nested %d deep", src, depth)
+	}
+	fields := len(selections)
+	for _, sel := range selections {
+		if sel.name == "" {
+			t.Fatalf("%q: parsed a selection with no name", src)
+		}
+		fields += checkSelections(t, src, sel.selections, depth+1)
+	}
+	return fields
+}
+
+// FuzzRun checks that running a query never panics, and that its response can always be encoded.
+func FuzzRun(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, query string) {
+		r := Request{Query: query, Variables: map[string]interface{}{"n": 2.0, "s": "ab"}}
+		resp, err := Run(context.Background(), testRoot{Name: "root"}, r, map[string]int64{"children": 2})
+		if err != nil {
+			return
+		}
+		if _, err := json.Marshal(resp); err != nil {
+			t.Fatalf("%q: encoding response: %v", query, err)
+		}
+	})
+}
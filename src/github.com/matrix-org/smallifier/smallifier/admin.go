@@ -0,0 +1,537 @@
+package smallifier
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// adminPrefix is the path prefix under which the admin API is served.
+const adminPrefix = "/_admin/"
+
+// AdminHandler is an http.HandlerFunc serving the operator API.
+// Requests must carry the secret in an "Authorization: Bearer" header.
+//
+//	GET    /_admin/overview         returns an Overview of recent activity.
+//	GET    /_admin/follows          returns a FollowQueueStatus.
+//	POST   /_admin/follows/flush    waits for the follow queue to drain, retries the error spool and returns a FlushResponse.
+//	GET    /_admin/qr?tag=...       returns a ZIP of QR codes for the links with the tag, with a CSV manifest.
+//	POST   /_admin/repoint          changes the destination of links as described by a RepointRequest, returning a RepointResponse.
+//	GET    /_admin/loglevel         returns the current logging level as a LogLevelResponse.
+//	PUT    /_admin/loglevel         changes the logging level as described by a LogLevelRequest, returning a LogLevelResponse.
+//	GET    /_admin/read-only        returns a ReadOnlyStatus.
+//	PUT    /_admin/read-only        turns read-only mode, in which links can't be created or changed, on or off as
+//	                                described by a ReadOnlyRequest, returning a ReadOnlyStatus.
+//	GET    /_admin/maintenance      returns a MaintenanceStatus.
+//	PUT    /_admin/maintenance      turns maintenance mode, in which every other request gets a 503, on or off as
+//	                                described by a MaintenanceRequest, returning a MaintenanceStatus.
+//	POST   /_admin/read-tokens      issues a read token as described by a ReadTokenRequest, returning the ReadToken.
+//	GET    /_admin/read-tokens      lists the issued ReadTokens, without the tokens themselves.
+//	DELETE /_admin/read-tokens/<id> revokes a read token.
+//	POST   /_admin/api-keys         issues an API key as described by an APIKeyRequest, returning the APIKey.
+//	GET    /_admin/api-keys         lists the issued APIKeys, including revoked ones, without the keys themselves.
+//	DELETE /_admin/api-keys/<id>    revokes an API key.
+//	PUT    /_admin/geoblocks        replaces the blocks on a GeoBlock's link or tag with its own.
+//	GET    /_admin/geoblocks        lists the GeoBlocks of every link and tag with any.
+//	GET    /_admin/trends           returns a Digest comparing the last ?period=... (default 168h) with the one before,
+//	                                optionally restricted to links with ?tag=....
+//	GET    /_admin/heatmap          returns a Heatmap of follows of a link or tag; see heatmapQuery for its parameters.
+//	PUT    /_admin/pin              pins or unpins a link as described by a PinRequest.
+//	PUT    /_admin/blocked-hosts    immediately stops redirects to a host and its subdomains, showing a notice instead, as
+//	                                described by a BlockDestinationRequest, returning the BlockedDestination.
+//	GET    /_admin/blocked-hosts    lists the BlockedDestinations.
+//	DELETE /_admin/blocked-hosts/<host>
+//	                                lets redirects to a blocked host resume.
+//	PUT    /_admin/annotations      annotates a link as described by an AnnotateRequest, returning the AnnotatedLink.
+//	GET    /_admin/annotations      returns the AnnotatedLink at ?short_url=..., or searches for links annotated with
+//	                                ?key=..., optionally with ?value=..., returning up to ?limit=... (default 100), newest first.
+//	POST   /_admin/expand           expands links on other shorteners and creates links to where they lead, as described by
+//	                                an ExpandRequest, returning an ExpandResponse.
+//	POST   /_admin/expire           expires links never, or not recently, followed as described by an ExpireRequest,
+//	                                returning an ExpiryReport.
+//	GET    /_admin/audit            returns the AuditEntries for changes made through the admin API, newest first.
+//	                                May be filtered with ?short_url=..., and limited with ?limit=... (default 100).
+//	POST   /_admin/graphql          runs a graphql.Request, returning a graphql.Response, if WithAdminGraphQL was given.
+//	GET    /_admin/graphql          likewise, with the request in ?query=..., ?operationName=... and ?variables=....
+func (s *smallifier) AdminHandler(w http.ResponseWriter, req *http.Request) {
+	setHeaders(w)
+
+	ctx, cancel, ok := s.requestContext(w, req)
+	if !ok {
+		return
+	}
+	defer cancel()
+
+	if !s.checkBearer(req) {
+		atomic.AddUint64(&s.authErrorCount, 1)
+		log.WithField("path", req.URL.Path).Error("Refusing admin request with wrong secret")
+		writeError(w, 401, ErrCodeUnauthorized, "Must specify correct secret")
+		return
+	}
+
+	i := strings.Index(req.URL.Path, adminPrefix)
+	if i < 0 {
+		writeError(w, 404, ErrCodeUnrecognized, "unknown admin endpoint")
+		return
+	}
+
+	endpoint := req.URL.Path[i+len(adminPrefix):]
+	if req.Method != "GET" && changesStoredState(endpoint) {
+		if err := s.checkWritable(); err != nil {
+			writeErr(w, err)
+			return
+		}
+	}
+
+	switch {
+	case endpoint == "graphql" && s.adminGraphQL && (req.Method == "GET" || req.Method == "POST"):
+		s.serveGraphQL(ctx, w, req)
+	case endpoint == "overview" && req.Method == "GET":
+		overview, err := s.overview(ctx)
+		if err != nil {
+			log.WithField("err", err).Error("Error summarising recent activity")
+			writeError(w, 500, ErrCodeUnknown, "internal server error")
+			return
+		}
+		json.NewEncoder(w).Encode(overview)
+	case endpoint == "follows" && req.Method == "GET":
+		status, err := s.followQueueStatus(ctx)
+		if err != nil {
+			log.WithField("err", err).Error("Error counting spooled follows")
+			writeError(w, 500, ErrCodeUnknown, "internal server error")
+			return
+		}
+		json.NewEncoder(w).Encode(status)
+	case endpoint == "follows/flush" && req.Method == "POST":
+		resp, err := s.flushFollows(ctx)
+		if e := contextError(err); e != nil {
+			writeErr(w, e)
+			return
+		}
+		if err != nil {
+			log.WithField("err", err).Error("Error flushing follows")
+			writeError(w, 500, ErrCodeUnknown, "error flushing follows")
+			return
+		}
+		json.NewEncoder(w).Encode(resp)
+	case endpoint == "qr" && req.Method == "GET":
+		tag := req.URL.Query().Get("tag")
+		if tag == "" {
+			writeError(w, 400, ErrCodeMissingParam, "Must specify tag")
+			return
+		}
+		var buf bytes.Buffer
+		if err := s.writeQRExport(ctx, &buf, tag); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+				"tag": tag,
+			}).Error("Error exporting QR codes")
+			writeError(w, 500, ErrCodeUnknown, "error exporting QR codes")
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="qr-codes.zip"`)
+		w.Write(buf.Bytes())
+	case endpoint == "loglevel" && req.Method == "GET":
+		json.NewEncoder(w).Encode(LogLevelResponse{Level: log.GetLevel().String()})
+	case endpoint == "loglevel" && req.Method == "PUT":
+		var levelReq LogLevelRequest
+		if err := json.NewDecoder(req.Body).Decode(&levelReq); err != nil {
+			writeError(w, 400, ErrCodeNotJSON, "error decoding json")
+			return
+		}
+		resp, err := s.setLogLevel(levelReq)
+		if err != nil {
+			writeError(w, 400, ErrCodeInvalidParam, err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(resp)
+	case endpoint == "read-only" && req.Method == "GET":
+		json.NewEncoder(w).Encode(s.readOnlyStatus())
+	case endpoint == "read-only" && req.Method == "PUT":
+		var readOnlyReq ReadOnlyRequest
+		if err := json.NewDecoder(req.Body).Decode(&readOnlyReq); err != nil {
+			writeError(w, 400, ErrCodeNotJSON, "error decoding json")
+			return
+		}
+		json.NewEncoder(w).Encode(s.setReadOnly(readOnlyReq))
+	case endpoint == "maintenance" && req.Method == "GET":
+		json.NewEncoder(w).Encode(s.maintenanceStatus())
+	case endpoint == "maintenance" && req.Method == "PUT":
+		var maintenanceReq MaintenanceRequest
+		if err := json.NewDecoder(req.Body).Decode(&maintenanceReq); err != nil {
+			writeError(w, 400, ErrCodeNotJSON, "error decoding json")
+			return
+		}
+		json.NewEncoder(w).Encode(s.SetMaintenance(maintenanceReq))
+	case endpoint == "read-tokens" && req.Method == "POST":
+		var tokenReq ReadTokenRequest
+		if err := json.NewDecoder(req.Body).Decode(&tokenReq); err != nil {
+			writeError(w, 400, ErrCodeNotJSON, "error decoding json")
+			return
+		}
+		if len(tokenReq.Tags) == 0 {
+			writeError(w, 400, ErrCodeInvalidParam, "Read tokens must have at least one tag")
+			return
+		}
+		if err := checkTags(tokenReq.Tags); err != nil {
+			writeError(w, 400, ErrCodeInvalidParam, err.Error())
+			return
+		}
+		token, err := s.issueReadToken(ctx, tokenReq)
+		if err != nil {
+			log.WithField("err", err).Error("Error issuing read token")
+			writeError(w, 500, ErrCodeUnknown, "internal server error")
+			return
+		}
+		log.WithFields(log.Fields{
+			"id":          token.ID,
+			"tags":        token.Tags,
+			"description": token.Description,
+		}).Info("Issued read token")
+		json.NewEncoder(w).Encode(token)
+	case endpoint == "read-tokens" && req.Method == "GET":
+		tokens, err := s.readTokens(ctx)
+		if err != nil {
+			log.WithField("err", err).Error("Error listing read tokens")
+			writeError(w, 500, ErrCodeUnknown, "internal server error")
+			return
+		}
+		json.NewEncoder(w).Encode(tokens)
+	case strings.HasPrefix(endpoint, "read-tokens/") && req.Method == "DELETE":
+		id, err := strconv.ParseInt(endpoint[len("read-tokens/"):], 10, 64)
+		if err != nil {
+			writeError(w, 404, ErrCodeNotFound, "unknown read token")
+			return
+		}
+		found, err := s.revokeReadToken(ctx, id)
+		if err != nil {
+			log.WithField("err", err).Error("Error revoking read token")
+			writeError(w, 500, ErrCodeUnknown, "internal server error")
+			return
+		}
+		if !found {
+			writeError(w, 404, ErrCodeNotFound, "unknown read token")
+			return
+		}
+		log.WithField("id", id).Info("Revoked read token")
+		io.WriteString(w, `{}`)
+	case endpoint == "api-keys" && req.Method == "POST":
+		var keyReq APIKeyRequest
+		if err := json.NewDecoder(req.Body).Decode(&keyReq); err != nil {
+			writeError(w, 400, ErrCodeNotJSON, "error decoding json")
+			return
+		}
+		key, err := s.issueAPIKey(ctx, keyReq)
+		if err == errAPIKeyName {
+			writeError(w, 400, ErrCodeInvalidParam, err.Error())
+			return
+		}
+		if err != nil {
+			log.WithField("err", err).Error("Error issuing API key")
+			writeError(w, 500, ErrCodeUnknown, "internal server error")
+			return
+		}
+		log.WithFields(log.Fields{
+			"id":   key.ID,
+			"name": key.Name,
+		}).Info("Issued API key")
+		json.NewEncoder(w).Encode(key)
+	case endpoint == "api-keys" && req.Method == "GET":
+		keys, err := s.apiKeys(ctx)
+		if err != nil {
+			log.WithField("err", err).Error("Error listing API keys")
+			writeError(w, 500, ErrCodeUnknown, "internal server error")
+			return
+		}
+		json.NewEncoder(w).Encode(keys)
+	case strings.HasPrefix(endpoint, "api-keys/") && req.Method == "DELETE":
+		id, err := strconv.ParseInt(endpoint[len("api-keys/"):], 10, 64)
+		if err != nil {
+			writeError(w, 404, ErrCodeNotFound, "unknown API key")
+			return
+		}
+		found, err := s.revokeAPIKey(ctx, id)
+		if err != nil {
+			log.WithField("err", err).Error("Error revoking API key")
+			writeError(w, 500, ErrCodeUnknown, "internal server error")
+			return
+		}
+		if !found {
+			writeError(w, 404, ErrCodeNotFound, "unknown API key")
+			return
+		}
+		log.WithField("id", id).Info("Revoked API key")
+		io.WriteString(w, `{}`)
+	case endpoint == "geoblocks" && req.Method == "PUT":
+		var block GeoBlock
+		if err := json.NewDecoder(req.Body).Decode(&block); err != nil {
+			writeError(w, 400, ErrCodeNotJSON, "error decoding json")
+			return
+		}
+		if err := s.setGeoBlock(ctx, block); err != nil {
+			log.WithField("err", err).Error("Error setting geo block")
+			writeError(w, 400, ErrCodeInvalidParam, err.Error())
+			return
+		}
+		io.WriteString(w, `{}`)
+	case endpoint == "geoblocks" && req.Method == "GET":
+		blocks, err := s.geoBlocks(ctx)
+		if err != nil {
+			log.WithField("err", err).Error("Error listing geo blocks")
+			writeError(w, 500, ErrCodeUnknown, "internal server error")
+			return
+		}
+		json.NewEncoder(w).Encode(blocks)
+	case endpoint == "trends" && req.Method == "GET":
+		q := req.URL.Query()
+		period := 7 * 24 * time.Hour
+		if p := q.Get("period"); p != "" {
+			var err error
+			if period, err = time.ParseDuration(p); err != nil || period <= 0 {
+				writeError(w, 400, ErrCodeInvalidParam, "period must be a positive duration, e.g. 24h")
+				return
+			}
+		}
+		// The period ends after the current second, so that it includes the most recent follows.
+		end := s.clock.Now().Truncate(time.Second).Add(time.Second)
+		d, err := makeDigest(ctx, s.db, s.base.String(), q.Get("tag"), end.Add(-period), end)
+		if err != nil {
+			log.WithField("err", err).Error("Error comparing periods")
+			writeError(w, 500, ErrCodeUnknown, "internal server error")
+			return
+		}
+		json.NewEncoder(w).Encode(d)
+	case endpoint == "heatmap" && req.Method == "GET":
+		q, err := parseHeatmapQuery(req.URL.Query(), s.base.String(), s.clock.Now())
+		if err != nil {
+			writeError(w, 400, ErrCodeInvalidParam, err.Error())
+			return
+		}
+		s.writeHeatmap(ctx, w, q)
+	case endpoint == "repoint" && req.Method == "POST":
+		var repointReq RepointRequest
+		if err := json.NewDecoder(req.Body).Decode(&repointReq); err != nil {
+			writeError(w, 400, ErrCodeNotJSON, "error decoding json")
+			return
+		}
+		if !repointReq.DryRun {
+			if err := s.checkWritable(); err != nil {
+				writeErr(w, err)
+				return
+			}
+		}
+		resp, err := s.repoint(ctx, repointReq)
+		if err == nil {
+			log.WithFields(log.Fields{
+				"match":   repointReq.Match,
+				"replace": repointReq.Replace,
+				"changed": len(resp.Changes),
+				"dry_run": repointReq.DryRun,
+			}).Info("Repointed links")
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
+		if _, ok := err.(errRepointLimit); ok {
+			writeError(w, 409, ErrCodeTooLarge, err.Error())
+		} else {
+			writeError(w, 400, ErrCodeInvalidParam, err.Error())
+		}
+	case endpoint == "pin" && req.Method == "PUT":
+		var pinReq PinRequest
+		if err := json.NewDecoder(req.Body).Decode(&pinReq); err != nil {
+			writeError(w, 400, ErrCodeNotJSON, "error decoding json")
+			return
+		}
+		if !strings.HasPrefix(pinReq.ShortURL, s.base.String()) {
+			writeError(w, 404, ErrCodeNotFound, "link not found")
+			return
+		}
+		if err := s.setPinned(ctx, pinReq.ShortURL[len(s.base.String()):], pinReq.Pinned); err != nil {
+			writeLookupError(w, err)
+			return
+		}
+		io.WriteString(w, `{}`)
+	case endpoint == "blocked-hosts" && req.Method == "PUT":
+		var blockReq BlockDestinationRequest
+		if err := json.NewDecoder(req.Body).Decode(&blockReq); err != nil {
+			writeError(w, 400, ErrCodeNotJSON, "error decoding json")
+			return
+		}
+		host, err := normalizeBlockedHost(blockReq.Host)
+		if err != nil {
+			writeError(w, 400, ErrCodeInvalidParam, err.Error())
+			return
+		}
+		blockReq.Host = host
+		b, err := s.blockDestination(ctx, blockReq)
+		if err != nil {
+			writeLookupError(w, err)
+			return
+		}
+		log.WithFields(log.Fields{
+			"host":   b.Host,
+			"reason": b.Reason,
+		}).Warn("Blocked redirects to host")
+		json.NewEncoder(w).Encode(b)
+	case endpoint == "blocked-hosts" && req.Method == "GET":
+		blocked, err := s.listBlockedDestinations(ctx)
+		if err != nil {
+			writeLookupError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(blocked)
+	case strings.HasPrefix(endpoint, "blocked-hosts/") && req.Method == "DELETE":
+		host, err := normalizeBlockedHost(endpoint[len("blocked-hosts/"):])
+		if err == nil {
+			err = s.unblockDestination(ctx, host)
+		}
+		if err == sql.ErrNoRows || (err != nil && host == "") {
+			writeError(w, 404, ErrCodeNotFound, "host not blocked")
+			return
+		}
+		if err != nil {
+			writeLookupError(w, err)
+			return
+		}
+		log.WithField("host", host).Warn("Unblocked redirects to host")
+		io.WriteString(w, `{}`)
+	case endpoint == "annotations" && req.Method == "PUT":
+		var annotateReq AnnotateRequest
+		if err := json.NewDecoder(req.Body).Decode(&annotateReq); err != nil {
+			writeError(w, 400, ErrCodeNotJSON, "error decoding json")
+			return
+		}
+		if err := checkAnnotations(annotateReq.Annotations); err != nil {
+			writeError(w, 400, ErrCodeInvalidParam, err.Error())
+			return
+		}
+		if !strings.HasPrefix(annotateReq.ShortURL, s.base.String()) {
+			writeError(w, 404, ErrCodeNotFound, "link not found")
+			return
+		}
+		link, err := s.annotate(ctx, annotateReq.ShortURL[len(s.base.String()):], annotateReq.Annotations)
+		if err == errTooManyAnnotations {
+			writeError(w, 400, ErrCodeInvalidParam, err.Error())
+			return
+		}
+		if err != nil {
+			writeLookupError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(link)
+	case endpoint == "annotations" && req.Method == "GET":
+		q := req.URL.Query()
+		if shortURL := q.Get("short_url"); shortURL != "" {
+			if !strings.HasPrefix(shortURL, s.base.String()) {
+				writeError(w, 404, ErrCodeNotFound, "link not found")
+				return
+			}
+			link, err := s.annotatedLink(ctx, shortURL[len(s.base.String()):])
+			if err != nil {
+				writeLookupError(w, err)
+				return
+			}
+			json.NewEncoder(w).Encode(link)
+			return
+		}
+		if q.Get("key") == "" {
+			writeError(w, 400, ErrCodeMissingParam, "Must specify short_url or key")
+			return
+		}
+		limit := defaultAnnotationSearchLimit
+		if l := q.Get("limit"); l != "" {
+			n, err := strconv.Atoi(l)
+			if err != nil || n <= 0 {
+				writeError(w, 400, ErrCodeInvalidParam, "limit must be a positive integer")
+				return
+			}
+			limit = n
+		}
+		links, err := s.searchAnnotations(ctx, q.Get("key"), q.Get("value"), limit)
+		if err != nil {
+			log.WithField("err", err).Error("Error searching annotations")
+			writeError(w, 500, ErrCodeUnknown, "internal server error")
+			return
+		}
+		json.NewEncoder(w).Encode(links)
+	case endpoint == "expand" && req.Method == "POST":
+		var expandReq ExpandRequest
+		if err := json.NewDecoder(req.Body).Decode(&expandReq); err != nil {
+			writeError(w, 400, ErrCodeNotJSON, "error decoding json")
+			return
+		}
+		if err := checkExpandRequest(expandReq); err != nil {
+			writeError(w, 400, ErrCodeInvalidParam, err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(s.expand(ctx, expandReq))
+	case endpoint == "expire" && req.Method == "POST":
+		var expireReq ExpireRequest
+		if err := json.NewDecoder(req.Body).Decode(&expireReq); err != nil {
+			writeError(w, 400, ErrCodeNotJSON, "error decoding json")
+			return
+		}
+		if expireReq.Days <= 0 {
+			writeError(w, 400, ErrCodeInvalidParam, "days must be a positive integer")
+			return
+		}
+		if expireReq.Idle && s.followRetentionDays > 0 && expireReq.Days > s.followRetentionDays {
+			writeError(w, 400, ErrCodeInvalidParam, fmt.Sprintf("days must be at most the %d days follows are kept for", s.followRetentionDays))
+			return
+		}
+		if !expireReq.DryRun {
+			if err := s.checkWritable(); err != nil {
+				writeErr(w, err)
+				return
+			}
+		}
+		report, err := s.expire(ctx, expireReq)
+		if err != nil {
+			writeLookupError(w, err)
+			return
+		}
+		log.WithFields(log.Fields{
+			"days":    expireReq.Days,
+			"idle":    expireReq.Idle,
+			"expired": len(report.Expired),
+			"dry_run": expireReq.DryRun,
+		}).Info("Expired unfollowed links")
+		json.NewEncoder(w).Encode(report)
+	case endpoint == "audit" && req.Method == "GET":
+		q := req.URL.Query()
+		limit := defaultAuditLimit
+		if l := q.Get("limit"); l != "" {
+			n, err := strconv.Atoi(l)
+			if err != nil || n <= 0 {
+				writeError(w, 400, ErrCodeInvalidParam, "limit must be a positive integer")
+				return
+			}
+			limit = n
+		}
+		shortPath := strings.TrimPrefix(q.Get("short_url"), s.base.String())
+		entries, err := s.auditLog(ctx, shortPath, limit)
+		if err != nil {
+			log.WithField("err", err).Error("Error reading audit log")
+			writeError(w, 500, ErrCodeUnknown, "internal server error")
+			return
+		}
+		json.NewEncoder(w).Encode(entries)
+	default:
+		writeError(w, 404, ErrCodeUnrecognized, "unknown admin endpoint")
+	}
+}
+
+// checkBearer reports whether req carries a valid secret as a bearer token.
+func (s *smallifier) checkBearer(req *http.Request) bool {
+	return s.validSecret(bearerToken(req))
+}
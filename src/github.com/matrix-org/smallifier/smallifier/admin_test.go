@@ -0,0 +1,84 @@
+package smallifier
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAdminWrongSecret(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	resp := adminRequest(t, f, "GET", "follows", "wrong"+testSecret)
+	defer resp.Body.Close()
+	if resp.StatusCode != 401 {
+		t.Error("wrong secret: want status code 401 got", resp.StatusCode)
+	}
+	if got := f.smallifier.AuthErrors(); got != 1 {
+		t.Errorf("auth error count: want 1 got %f", got)
+	}
+}
+
+func TestFollowSpoolAndFlush(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	shortened := shorten(t, f.server.URL, f.server.URL+"/_stub")
+	shortPath := shortened[len(f.base):]
+
+	if _, err := f.db.Exec(`ALTER TABLE follows RENAME TO follows_unavailable`); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := insecureClient().Get(shortened)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	var status FollowQueueStatus
+	decodeAdminResponse(t, f, "POST", "follows/flush", &FlushResponse{})
+	decodeAdminResponse(t, f, "GET", "follows", &status)
+	if status.Spooled != 1 {
+		t.Errorf("spooled follows while table unavailable: want 1 got %d", status.Spooled)
+	}
+
+	if _, err := f.db.Exec(`ALTER TABLE follows_unavailable RENAME TO follows`); err != nil {
+		t.Fatal(err)
+	}
+	var flushed FlushResponse
+	decodeAdminResponse(t, f, "POST", "follows/flush", &flushed)
+	if flushed.Recovered != 1 || flushed.Spooled != 0 {
+		t.Errorf("flush: want 1 recovered and 0 spooled got %+v", flushed)
+	}
+	assertFollowCount(f, shortPath, 1, "after flush:")
+}
+
+func adminRequest(t *testing.T, f fixture, method, endpoint, secret string) *http.Response {
+	return adminBodyRequest(t, f, method, endpoint, secret, "")
+}
+
+func adminBodyRequest(t *testing.T, f fixture, method, endpoint, secret, body string) *http.Response {
+	req, err := http.NewRequest(method, f.server.URL+"/_admin/"+endpoint, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+secret)
+	resp, err := insecureClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func decodeAdminResponse(t *testing.T, f fixture, method, endpoint string, v interface{}) {
+	resp := adminRequest(t, f, method, endpoint, testSecret)
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("%s /_admin/%s: want status code 200 got %d", method, endpoint, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
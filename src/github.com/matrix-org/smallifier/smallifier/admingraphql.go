@@ -0,0 +1,303 @@
+package smallifier
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/smallifier/graphql"
+)
+
+const (
+	// defaultRecentFollows and maxRecentFollows are how many of a link's follows are listed by recent_follows
+	// if the query doesn't specify, and at most.
+	defaultRecentFollows = 10
+	maxRecentFollows     = 1000
+	// defaultCampaignPeriod is how long before end a campaign's stats start, if the query doesn't specify.
+	defaultCampaignPeriod = 7 * 24 * time.Hour
+)
+
+// WithAdminGraphQL serves GraphQL queries over the admin data model at /_admin/graphql, so that dashboards can fetch
+// exactly the fields they need in one request. Field names are those of the JSON responses of the REST API:
+//
+//	type Query {
+//	  overview: Overview
+//	  link(short_path: String!): Link
+//	  links(limit: Int = 100, cursor: String): LinksPage       # of Links
+//	  campaigns: [Campaign]                                     # every tag of a link
+//	  campaign(tag: String!): Campaign
+//	  api_keys: [APIKey]
+//	  read_tokens: [ReadToken]
+//	}
+//	type Link {
+//	  short_path, short_url, long_url, created_ts, follows, pinned, owner, deleted
+//	  tags: [String]
+//	  annotations: Object                                      # by key, as a JSON object
+//	  last_followed_ts: Int
+//	  recent_follows(limit: Int = 10): [Follow]               # newest first: ts, bundle_item, repeat_count,
+//	                                                            #   user_agent, referer
+//	}
+//	type Campaign {
+//	  tag, links
+//	  stats(start: Int, end: Int): TagStats                   # unix timestamps; the last week by default
+//	}
+//
+// Only queries are supported: fragments, directives, mutations and introspection aren't. Queries which are too deep,
+// too wide or too costly are refused, as described in the README.
+func WithAdminGraphQL() Option {
+	return func(s *smallifier) {
+		s.adminGraphQL = true
+	}
+}
+
+// serveGraphQL runs the graphql.Request in the body of req, or in its query string if it is a GET, writing a graphql.Response.
+// Requests which can't be run at all are refused with a 400, and errors resolving fields are included in the response.
+func (s *smallifier) serveGraphQL(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	var r graphql.Request
+	if req.Method == "GET" {
+		q := req.URL.Query()
+		r.Query, r.OperationName = q.Get("query"), q.Get("operationName")
+		if v := q.Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &r.Variables); err != nil {
+				writeGraphQLError(w, "error decoding variables")
+				return
+			}
+		}
+	} else if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		writeGraphQLError(w, "error decoding json")
+		return
+	}
+	resp, err := graphql.Run(ctx, graphQLQuery{s}, r, graphQLListSizes)
+	if err != nil {
+		writeGraphQLError(w, err.Error())
+		return
+	}
+	for _, e := range resp.Errors {
+		log.WithFields(log.Fields{
+			"err":  e.Message,
+			"path": e.Path,
+		}).Info("Error resolving GraphQL field")
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func writeGraphQLError(w http.ResponseWriter, message string) {
+	w.WriteHeader(400)
+	json.NewEncoder(w).Encode(graphql.Response{Errors: []graphql.Error{{Message: message}}})
+}
+
+// graphQLListSizes are the sizes of the lists admin GraphQL fields return if not given a limit, for estimating the cost
+// of queries. Campaigns aren't limited, so theirs is a guess.
+var graphQLListSizes = map[string]int64{
+	"links":          defaultLinksLimit,
+	"recent_follows": defaultRecentFollows,
+	"campaigns":      100,
+}
+
+// graphQLQuery is the root of admin GraphQL queries.
+type graphQLQuery struct {
+	s *smallifier
+}
+
+func (q graphQLQuery) ResolveField(ctx context.Context, name string, args map[string]interface{}) (interface{}, bool, error) {
+	s := q.s
+	switch name {
+	case "overview":
+		v, err := s.overview(ctx)
+		return v, true, err
+	case "link":
+		shortPath, err := graphql.StringArg(args, "short_path")
+		if err != nil || shortPath == "" {
+			return nil, true, fmt.Errorf("Argument \"short_path\" must be given")
+		}
+		v, err := s.graphQLLink(ctx, shortPath)
+		if err == sql.ErrNoRows {
+			return nil, true, nil
+		}
+		return v, true, err
+	case "links":
+		limit, err := graphql.IntArg(args, "limit", defaultLinksLimit)
+		if err != nil {
+			return nil, true, err
+		}
+		if limit <= 0 || limit > maxLinksLimit {
+			return nil, true, fmt.Errorf("Argument \"limit\" must be between 1 and %d", maxLinksLimit)
+		}
+		cursor, err := graphql.StringArg(args, "cursor")
+		if err != nil {
+			return nil, true, err
+		}
+		page, err := s.listLinks(ctx, cursor, int(limit))
+		if err != nil {
+			return nil, true, err
+		}
+		v := graphQLLinksPage{Links: []*graphQLLink{}, NextCursor: page.NextCursor}
+		for _, l := range page.Links {
+			v.Links = append(v.Links, &graphQLLink{s: s, ListedLink: l, ShortURL: s.base.String() + l.ShortPath})
+		}
+		return v, true, nil
+	case "campaigns":
+		v, err := s.graphQLCampaigns(ctx, "")
+		return v, true, err
+	case "campaign":
+		tag, err := graphql.StringArg(args, "tag")
+		if err != nil || tag == "" {
+			return nil, true, fmt.Errorf("Argument \"tag\" must be given")
+		}
+		v, err := s.graphQLCampaigns(ctx, tag)
+		if err != nil || len(v) == 0 {
+			return nil, true, err
+		}
+		return v[0], true, nil
+	case "api_keys":
+		v, err := s.apiKeys(ctx)
+		return v, true, err
+	case "read_tokens":
+		v, err := s.readTokens(ctx)
+		return v, true, err
+	}
+	return nil, false, nil
+}
+
+// graphQLLinksPage is a page of links, as listed by LinksHandler.
+type graphQLLinksPage struct {
+	Links      []*graphQLLink `json:"links"`
+	NextCursor string         `json:"next_cursor"`
+}
+
+// graphQLLink is a link, with fields which are only looked up if they are selected.
+type graphQLLink struct {
+	s *smallifier
+	ListedLink
+	ShortURL string `json:"short_url"`
+	Deleted  bool   `json:"deleted"`
+}
+
+// graphQLLink looks up the link at shortPath, even if it has been deleted.
+func (s *smallifier) graphQLLink(ctx context.Context, shortPath string) (*graphQLLink, error) {
+	l := &graphQLLink{s: s, ShortURL: s.base.String() + shortPath}
+	l.ShortPath = shortPath
+	err := s.db.QueryRowContext(ctx, `SELECT long_url, create_ts, pinned, COALESCE(owner, ''), deleted,
+		(SELECT COUNT(*) FROM follows WHERE follows.short_path = links.short_path) FROM links WHERE short_path = $1`,
+		shortPath).Scan(&l.LongURL, &l.CreatedTS, &l.Pinned, &l.Owner, &l.Deleted, &l.Follows)
+	return l, err
+}
+
+func (l *graphQLLink) ResolveField(ctx context.Context, name string, args map[string]interface{}) (interface{}, bool, error) {
+	switch name {
+	case "tags":
+		rows, err := l.s.db.QueryContext(ctx, `SELECT tag FROM link_tags WHERE short_path = $1 ORDER BY tag`, l.ShortPath)
+		if err != nil {
+			return nil, true, err
+		}
+		defer rows.Close()
+		tags := []string{}
+		for rows.Next() {
+			var tag string
+			if err := rows.Scan(&tag); err != nil {
+				return nil, true, err
+			}
+			tags = append(tags, tag)
+		}
+		return tags, true, rows.Err()
+	case "annotations":
+		v, err := linkAnnotations(ctx, l.s.db, l.ShortPath)
+		return v, true, err
+	case "last_followed_ts":
+		var ts sql.NullInt64
+		err := l.s.db.QueryRowContext(ctx, `SELECT MAX(ts) FROM follows WHERE short_path = $1`, l.ShortPath).Scan(&ts)
+		return ts.Int64, true, err
+	case "recent_follows":
+		limit, err := graphql.IntArg(args, "limit", defaultRecentFollows)
+		if err != nil {
+			return nil, true, err
+		}
+		if limit <= 0 || limit > maxRecentFollows {
+			return nil, true, fmt.Errorf("Argument \"limit\" must be between 1 and %d", maxRecentFollows)
+		}
+		v, err := l.s.recentFollows(ctx, l.ShortPath, int(limit))
+		return v, true, err
+	}
+	return nil, false, nil
+}
+
+// graphQLFollow is a recorded follow of a link.
+type graphQLFollow struct {
+	TS int64 `json:"ts"`
+	// BundleItem is the position of the item followed, for follows of items of bundles, or 0.
+	BundleItem  int64 `json:"bundle_item"`
+	RepeatCount int64 `json:"repeat_count"`
+	// UserAgent and Referer are the headers of the request, if they were recorded.
+	UserAgent string `json:"user_agent"`
+	Referer   string `json:"referer"`
+}
+
+// recentFollows returns the latest limit follows of the link at shortPath, newest first.
+func (s *smallifier) recentFollows(ctx context.Context, shortPath string, limit int) ([]graphQLFollow, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT ts, COALESCE(bundle_item, 0), repeat_count, COALESCE(user_agent, ''), COALESCE(referer, '') FROM follows WHERE short_path = $1
+		ORDER BY ts DESC, id DESC LIMIT $2`, shortPath, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	follows := []graphQLFollow{}
+	for rows.Next() {
+		var f graphQLFollow
+		if err := rows.Scan(&f.TS, &f.BundleItem, &f.RepeatCount, &f.UserAgent, &f.Referer); err != nil {
+			return nil, err
+		}
+		follows = append(follows, f)
+	}
+	return follows, rows.Err()
+}
+
+// graphQLCampaign is a tag attached to links, e.g. those belonging to the same campaign.
+type graphQLCampaign struct {
+	s   *smallifier
+	Tag string `json:"tag"`
+	// Links is the number of links with the tag which haven't been deleted.
+	Links int64 `json:"links"`
+}
+
+// graphQLCampaigns returns every tag attached to a link which hasn't been deleted, in order, or only tag if it is non-empty.
+func (s *smallifier) graphQLCampaigns(ctx context.Context, tag string) ([]*graphQLCampaign, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT link_tags.tag, COUNT(*) FROM link_tags JOIN links ON link_tags.short_path = links.short_path
+		WHERE links.deleted = 0 AND ($1 = '' OR link_tags.tag = $1) GROUP BY link_tags.tag ORDER BY link_tags.tag`, tag)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	campaigns := []*graphQLCampaign{}
+	for rows.Next() {
+		c := &graphQLCampaign{s: s}
+		if err := rows.Scan(&c.Tag, &c.Links); err != nil {
+			return nil, err
+		}
+		campaigns = append(campaigns, c)
+	}
+	return campaigns, rows.Err()
+}
+
+func (c *graphQLCampaign) ResolveField(ctx context.Context, name string, args map[string]interface{}) (interface{}, bool, error) {
+	if name != "stats" {
+		return nil, false, nil
+	}
+	// Stats cover [start, end), so by default end is the next second, for follows made this second to be counted.
+	end, err := graphql.IntArg(args, "end", c.s.clock.Now().Unix()+1)
+	if err != nil {
+		return nil, true, err
+	}
+	start, err := graphql.IntArg(args, "start", end-int64(defaultCampaignPeriod/time.Second))
+	if err != nil {
+		return nil, true, err
+	}
+	if start >= end {
+		return nil, true, fmt.Errorf("Argument \"start\" must be before \"end\"")
+	}
+	v, err := c.s.tagStats(ctx, c.Tag, time.Unix(start, 0), time.Unix(end, 0))
+	return v, true, err
+}
@@ -0,0 +1,113 @@
+package smallifier
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+
+	"github.com/matrix-org/smallifier/graphql"
+)
+
+func graphQLRequest(t *testing.T, f fixture, r graphql.Request, v interface{}) int {
+	b, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := adminBodyRequest(t, f, "POST", "graphql", testSecret, string(b))
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode
+}
+
+func TestAdminGraphQL(t *testing.T) {
+	f := serve(t, WithAdminGraphQL())
+	defer f.Close()
+
+	tagged := create(t, f, `{"long_url": "`+f.server.URL+`/_stub", "secret": "`+testSecret+`", "tags": ["fosdem", "talks"]}`)
+	create(t, f, `{"long_url": "`+f.server.URL+`/_stub?2", "secret": "`+testSecret+`", "tags": ["fosdem"]}`)
+	resp, err := insecureClient().Get(tagged.ShortURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	waitForFollows(f)
+
+	var got struct {
+		Data struct {
+			Link struct {
+				LongURL       string   `json:"long_url"`
+				Follows       int64    `json:"follows"`
+				Tags          []string `json:"tags"`
+				RecentFollows []struct {
+					TS int64 `json:"ts"`
+				} `json:"recent_follows"`
+			} `json:"link"`
+			Links struct {
+				Links []map[string]interface{} `json:"links"`
+			} `json:"links"`
+			Campaigns []struct {
+				Tag   string `json:"tag"`
+				Links int64  `json:"links"`
+				Stats struct {
+					Follows int64 `json:"follows"`
+				} `json:"stats"`
+			} `json:"campaigns"`
+			Missing interface{} `json:"missing"`
+		} `json:"data"`
+		Errors []graphql.Error `json:"errors"`
+	}
+	status := graphQLRequest(t, f, graphql.Request{
+		Query: `query Dashboard($path: String!) {
+			link(short_path: $path) { long_url follows tags recent_follows(limit: 5) { ts } }
+			links(limit: 1) { links { short_path } }
+			campaigns { tag links stats { follows } }
+			missing: link(short_path: "nope") { long_url }
+		}`,
+		Variables: map[string]interface{}{"path": tagged.ShortPath},
+	}, &got)
+	if status != 200 || len(got.Errors) > 0 {
+		t.Fatalf("want status 200 without errors got %d %+v", status, got.Errors)
+	}
+	link := got.Data.Link
+	if link.LongURL != f.server.URL+"/_stub" || link.Follows != 1 || len(link.Tags) != 2 || len(link.RecentFollows) != 1 {
+		t.Errorf("link: got %+v", link)
+	}
+	if links := got.Data.Links.Links; len(links) != 1 || len(links[0]) != 1 || links[0]["short_path"] == "" {
+		t.Errorf("links: want only the short path of one link got %+v", links)
+	}
+	campaigns := got.Data.Campaigns
+	if len(campaigns) != 2 || campaigns[0].Tag != "fosdem" || campaigns[0].Links != 2 || campaigns[0].Stats.Follows != 1 || campaigns[1].Tag != "talks" {
+		t.Errorf("campaigns: got %+v", campaigns)
+	}
+	if got.Data.Missing != nil {
+		t.Errorf("missing link: want null got %v", got.Data.Missing)
+	}
+
+	var bad graphql.Response
+	if status := graphQLRequest(t, f, graphql.Request{Query: `mutation { link }`}, &bad); status != 400 || len(bad.Errors) != 1 {
+		t.Errorf("mutation: want 400 with an error got %d %+v", status, bad)
+	}
+
+	var viaGet struct {
+		Data struct {
+			APIKeys []APIKey `json:"api_keys"`
+		} `json:"data"`
+	}
+	decodeAdminResponse(t, f, "GET", "graphql?"+url.Values{"query": {"{ api_keys { id name } }"}}.Encode(), &viaGet)
+	if viaGet.Data.APIKeys == nil || len(viaGet.Data.APIKeys) != 0 {
+		t.Errorf("api keys: want none got %+v", viaGet.Data.APIKeys)
+	}
+}
+
+func TestAdminGraphQLIsOptional(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	resp := adminBodyRequest(t, f, "POST", "graphql", testSecret, `{"query": "{ overview { ts } }"}`)
+	resp.Body.Close()
+	if resp.StatusCode != 404 {
+		t.Errorf("want status code 404 got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,72 @@
+package smallifier
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Analytics is what is done with follows of links.
+type Analytics int
+
+const (
+	// AnalyticsDB writes follows to the database, from where they are reported, sent to webhooks and notified. It is the default.
+	AnalyticsDB Analytics = iota
+	// AnalyticsMemory only counts follows in memory, for the stats endpoint to report until the process exits.
+	AnalyticsMemory
+	// AnalyticsOff discards follows.
+	AnalyticsOff
+)
+
+// ParseAnalytics parses "db", "memory" or "off" as the corresponding Analytics.
+func ParseAnalytics(s string) (Analytics, error) {
+	switch s {
+	case "db":
+		return AnalyticsDB, nil
+	case "memory":
+		return AnalyticsMemory, nil
+	case "off":
+		return AnalyticsOff, nil
+	}
+	return 0, fmt.Errorf("unknown analytics %q: must be db, memory or off", s)
+}
+
+// WithAnalytics sets what is done with follows, e.g. to avoid writing click data in development, CI or staging.
+// Unless follows are written to the database, click webhooks and notifications aren't sent, links can't be created with
+// notifications, and links would be expired by WithUnfollowedExpiry as if they had never been followed.
+func WithAnalytics(a Analytics) Option {
+	return func(s *smallifier) {
+		s.analytics = a
+	}
+}
+
+// memoryFollows counts follows of each link in memory, for AnalyticsMemory.
+type memoryFollows struct {
+	mu    sync.Mutex
+	links map[string]memoryFollowCount
+}
+
+type memoryFollowCount struct {
+	follows        int64
+	lastFollowedTS int64
+}
+
+// record counts a follow, at the unix timestamp ts, of the link at shortPath.
+func (m *memoryFollows) record(shortPath string, ts int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.links == nil {
+		m.links = make(map[string]memoryFollowCount)
+	}
+	c := m.links[shortPath]
+	c.follows++
+	c.lastFollowedTS = ts
+	m.links[shortPath] = c
+}
+
+// get returns how many times the link at shortPath has been followed, and when it last was.
+func (m *memoryFollows) get(shortPath string) (follows, lastFollowedTS int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := m.links[shortPath]
+	return c.follows, c.lastFollowedTS
+}
@@ -0,0 +1,52 @@
+package smallifier
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestAnalytics(t *testing.T) {
+	for _, tc := range []struct {
+		analytics   Analytics
+		wantStats   int64
+		wantRecords int64
+	}{
+		{AnalyticsDB, 2, 2},
+		{AnalyticsMemory, 2, 0},
+		{AnalyticsOff, 0, 0},
+	} {
+		f := serve(t, WithAnalytics(tc.analytics))
+		shortened := shorten(t, f.server.URL, f.server.URL+"/_stub")
+		shortPath := shortened[len(f.base):]
+		for i := 0; i < 2; i++ {
+			resp, err := insecureClient().Get(shortened)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		}
+		assertFollowCount(f, shortPath, tc.wantRecords, "recorded")
+
+		var stats LinkStats
+		resp := statsRequest(t, f, shortPath, testSecret)
+		if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if stats.Follows != tc.wantStats || (stats.LastFollowedTS != 0) != (tc.wantStats != 0) {
+			t.Errorf("analytics %d: want %d follows got %+v", tc.analytics, tc.wantStats, stats)
+		}
+		f.Close()
+	}
+}
+
+func TestParseAnalytics(t *testing.T) {
+	for s, want := range map[string]Analytics{"db": AnalyticsDB, "memory": AnalyticsMemory, "off": AnalyticsOff} {
+		if got, err := ParseAnalytics(s); err != nil || got != want {
+			t.Errorf("%s: want %d got %d, %v", s, want, got, err)
+		}
+	}
+	if _, err := ParseAnalytics("redis"); err == nil {
+		t.Error("want an error for unknown analytics")
+	}
+}
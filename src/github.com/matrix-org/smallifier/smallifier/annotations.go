@@ -0,0 +1,174 @@
+package smallifier
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+const (
+	// maxAnnotations is the most annotations a single link may have.
+	maxAnnotations = 20
+	// maxAnnotationKeyLength and maxAnnotationValueLength are the longest annotation keys and values may be, in bytes.
+	maxAnnotationKeyLength   = 64
+	maxAnnotationValueLength = 1024
+	// defaultAnnotationSearchLimit is how many links are returned by a search of annotations if it doesn't specify.
+	defaultAnnotationSearchLimit = 100
+)
+
+// AnnotateRequest is the JSON-encoded body of an admin request to annotate a link with references to external systems,
+// such as ticket or campaign IDs, e.g. {"short_url": "...", "annotations": {"jira": "OPS-123", "crm_campaign": "4471"}}.
+type AnnotateRequest struct {
+	ShortURL string `json:"short_url"`
+	// Annotations are set on the link by key, replacing any with the same key; an empty value removes the key's annotation.
+	// Annotations with other keys are left alone.
+	Annotations map[string]string `json:"annotations"`
+}
+
+// AnnotatedLink is a link and all of its annotations.
+type AnnotatedLink struct {
+	ShortURL    string            `json:"short_url"`
+	LongURL     string            `json:"long_url"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// checkAnnotations returns an error describing why annotations cannot be set on a link, or nil if they can.
+func checkAnnotations(annotations map[string]string) error {
+	if len(annotations) == 0 {
+		return errors.New("Must specify annotations")
+	}
+	for k, v := range annotations {
+		if k == "" || len(k) > maxAnnotationKeyLength {
+			return fmt.Errorf("Annotation keys must be between 1 and %d bytes long", maxAnnotationKeyLength)
+		}
+		if len(v) > maxAnnotationValueLength {
+			return fmt.Errorf("Annotation values must be at most %d bytes long", maxAnnotationValueLength)
+		}
+	}
+	return nil
+}
+
+// errTooManyAnnotations is returned when annotating a link would leave it with more than maxAnnotations.
+var errTooManyAnnotations = fmt.Errorf("Links may have at most %d annotations", maxAnnotations)
+
+// annotate sets annotations on the link at shortPath, recording each change in the audit log, and returns the link with
+// all of its annotations. It returns sql.ErrNoRows if there is no such link.
+func (s *smallifier) annotate(ctx context.Context, shortPath string, annotations map[string]string) (AnnotatedLink, error) {
+	l := AnnotatedLink{ShortURL: s.base.String() + shortPath}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return l, err
+	}
+	defer tx.Rollback()
+	if err := tx.QueryRowContext(ctx, `SELECT long_url FROM links WHERE short_path = $1 AND deleted = 0`, shortPath).Scan(&l.LongURL); err != nil {
+		return l, err
+	}
+	now := s.clock.Now().Unix()
+	for k, v := range annotations {
+		var old string
+		err := tx.QueryRowContext(ctx, `SELECT value FROM link_annotations WHERE short_path = $1 AND key = $2`, shortPath, k).Scan(&old)
+		if err != nil && err != sql.ErrNoRows {
+			return l, err
+		}
+		if old == v {
+			continue
+		}
+		if v == "" {
+			_, err = tx.ExecContext(ctx, `DELETE FROM link_annotations WHERE short_path = $1 AND key = $2`, shortPath, k)
+		} else {
+			_, err = tx.ExecContext(ctx, `INSERT OR REPLACE INTO link_annotations (short_path, key, value) VALUES ($1, $2, $3)`, shortPath, k, v)
+		}
+		if err != nil {
+			return l, err
+		}
+		if err := addAuditEntry(ctx, tx, now, "annotate", shortPath, annotationString(k, old), annotationString(k, v)); err != nil {
+			return l, err
+		}
+	}
+	if l.Annotations, err = linkAnnotations(ctx, tx, shortPath); err != nil {
+		return l, err
+	}
+	if len(l.Annotations) > maxAnnotations {
+		return l, errTooManyAnnotations
+	}
+	return l, tx.Commit()
+}
+
+// annotatedLink returns the link at shortPath, which may have been deleted, with its annotations.
+// It returns sql.ErrNoRows if there is no such link.
+func (s *smallifier) annotatedLink(ctx context.Context, shortPath string) (AnnotatedLink, error) {
+	l := AnnotatedLink{ShortURL: s.base.String() + shortPath}
+	if err := s.db.QueryRowContext(ctx, `SELECT long_url FROM links WHERE short_path = $1`, shortPath).Scan(&l.LongURL); err != nil {
+		return l, err
+	}
+	var err error
+	l.Annotations, err = linkAnnotations(ctx, s.db, shortPath)
+	return l, err
+}
+
+// annotationString describes the annotation k=v in the audit log, or is empty if there is no annotation.
+func annotationString(k, v string) string {
+	if v == "" {
+		return ""
+	}
+	return k + "=" + v
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// linkAnnotations returns the annotations of the link at shortPath, by key.
+func linkAnnotations(ctx context.Context, q queryer, shortPath string) (map[string]string, error) {
+	rows, err := q.QueryContext(ctx, `SELECT key, value FROM link_annotations WHERE short_path = $1`, shortPath)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	annotations := map[string]string{}
+	for rows.Next() {
+		var k, v string
+		if err := rows.Scan(&k, &v); err != nil {
+			return nil, err
+		}
+		annotations[k] = v
+	}
+	return annotations, rows.Err()
+}
+
+// searchAnnotations returns up to limit links which haven't been deleted with an annotation with key, and with value
+// unless it is empty, newest first.
+func (s *smallifier) searchAnnotations(ctx context.Context, key, value string, limit int) ([]AnnotatedLink, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT links.short_path, links.long_url FROM links
+		JOIN link_annotations ON links.short_path = link_annotations.short_path
+		WHERE link_annotations.key = $1 AND ($2 = '' OR link_annotations.value = $2) AND links.deleted = 0
+		ORDER BY links.id DESC LIMIT $3`, key, value, limit)
+	if err != nil {
+		return nil, err
+	}
+	links := []AnnotatedLink{}
+	var shortPaths []string
+	for rows.Next() {
+		var shortPath string
+		var l AnnotatedLink
+		if err := rows.Scan(&shortPath, &l.LongURL); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		l.ShortURL = s.base.String() + shortPath
+		links = append(links, l)
+		shortPaths = append(shortPaths, shortPath)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i, shortPath := range shortPaths {
+		if links[i].Annotations, err = linkAnnotations(ctx, s.db, shortPath); err != nil {
+			return nil, err
+		}
+	}
+	return links, nil
+}
@@ -0,0 +1,68 @@
+package smallifier
+
+import (
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAnnotations(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	ticket := shorten(t, f.server.URL, "https://lemurs.win/ticket")
+	other := shorten(t, f.server.URL, "https://lemurs.win/other")
+	annotate := func(shortURL, annotations string) (int, AnnotatedLink) {
+		resp := adminBodyRequest(t, f, "PUT", "annotations", testSecret, `{"short_url": "`+shortURL+`", "annotations": `+annotations+`}`)
+		defer resp.Body.Close()
+		var l AnnotatedLink
+		json.NewDecoder(resp.Body).Decode(&l)
+		return resp.StatusCode, l
+	}
+
+	if status, l := annotate(ticket, `{"jira": "OPS-123", "crm": "4471"}`); status != 200 || !reflect.DeepEqual(l.Annotations, map[string]string{"jira": "OPS-123", "crm": "4471"}) {
+		t.Errorf("annotate: want 200 and both annotations got %d %+v", status, l)
+	}
+	if status, l := annotate(ticket, `{"crm": ""}`); status != 200 || !reflect.DeepEqual(l.Annotations, map[string]string{"jira": "OPS-123"}) {
+		t.Errorf("remove annotation: want 200 and only jira got %d %+v", status, l)
+	}
+	annotate(other, `{"jira": "OPS-456"}`)
+	for _, tc := range []struct {
+		annotations string
+		status      int
+	}{
+		{`{}`, 400},
+		{`{"": "x"}`, 400},
+		{`{"jira": "` + strings.Repeat("x", maxAnnotationValueLength+1) + `"}`, 400},
+	} {
+		if status, _ := annotate(ticket, tc.annotations); status != tc.status {
+			t.Errorf("%.40s: want status %d got %d", tc.annotations, tc.status, status)
+		}
+	}
+	if status, _ := annotate(f.base+"nonexist", `{"jira": "OPS-1"}`); status != 404 {
+		t.Errorf("missing link: want status 404 got %d", status)
+	}
+
+	var found []AnnotatedLink
+	decodeAdminResponse(t, f, "GET", "annotations?key=jira&value=OPS-123", &found)
+	if len(found) != 1 || found[0].ShortURL != ticket || found[0].LongURL != "https://lemurs.win/ticket" {
+		t.Errorf("search by value: want %s got %+v", ticket, found)
+	}
+	decodeAdminResponse(t, f, "GET", "annotations?key=jira", &found)
+	if len(found) != 2 || found[0].ShortURL != other || found[1].ShortURL != ticket {
+		t.Errorf("search by key: want %s then %s got %+v", other, ticket, found)
+	}
+	var l AnnotatedLink
+	decodeAdminResponse(t, f, "GET", "annotations?short_url="+url.QueryEscape(other), &l)
+	if l.Annotations["jira"] != "OPS-456" {
+		t.Errorf("lookup: want jira OPS-456 got %+v", l)
+	}
+
+	var entries []AuditEntry
+	decodeAdminResponse(t, f, "GET", "audit?short_url="+url.QueryEscape(ticket), &entries)
+	if len(entries) != 3 || entries[0].Old != "crm=4471" || entries[0].New != "" {
+		t.Errorf("audit: want 3 entries, the newest removing crm=4471, got %+v", entries)
+	}
+}
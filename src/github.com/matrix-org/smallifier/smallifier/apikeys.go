@@ -0,0 +1,121 @@
+package smallifier
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+)
+
+// APIKeyRequest is the JSON-encoded body of an admin request to issue an API key.
+type APIKeyRequest struct {
+	// Name identifies the key's holder, and is recorded as the owner of each link created with it.
+	Name string `json:"name"`
+}
+
+// APIKey describes an issued API key.
+// API keys may be passed as the secret of create, bundle and delete requests,
+// so that each client can be given its own key, and keys can be rotated one client at a time.
+type APIKey struct {
+	ID       int64  `json:"id"`
+	Name     string `json:"name"`
+	CreateTS int64  `json:"create_ts"`
+	// RevokedTS is when the key was revoked, or 0 if it is still valid.
+	RevokedTS int64 `json:"revoked_ts,omitempty"`
+	// Key is only returned when the key is issued; only its hash is stored.
+	Key string `json:"key,omitempty"`
+}
+
+// WithOpenCreation lets anyone create links and bundles, without the secret or an API key.
+// Anonymous creators can't register webhooks or notifications, but can use the edit token returned with each link to change it.
+func WithOpenCreation() Option {
+	return func(s *smallifier) {
+		s.openCreation = true
+	}
+}
+
+// apiKeyName matches valid names of API keys.
+var apiKeyName = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,64}$`)
+
+// errAPIKeyName is returned when issuing an API key with a name which is invalid or already in use.
+var errAPIKeyName = errors.New("API key names must be unique, and 1 to 64 letters, digits, '.', '_' or '-'")
+
+// issueAPIKey stores a new API key with the request's name, returning it.
+func (s *smallifier) issueAPIKey(ctx context.Context, r APIKeyRequest) (APIKey, error) {
+	k := APIKey{Name: r.Name, CreateTS: s.clock.Now().Unix()}
+	if !apiKeyName.MatchString(k.Name) {
+		return k, errAPIKeyName
+	}
+	var err error
+	if k.Key, err = s.generateSecret(); err != nil {
+		return k, err
+	}
+	res, err := s.db.ExecContext(ctx, `INSERT INTO api_keys (name, key_hash, create_ts) VALUES ($1, $2, $3)`, k.Name, hashReadToken(k.Key), k.CreateTS)
+	if isUniqueViolation(err) {
+		return k, errAPIKeyName
+	}
+	if err != nil {
+		return k, err
+	}
+	k.ID, err = res.LastInsertId()
+	return k, err
+}
+
+// apiKeys lists the issued API keys, including revoked ones, without the keys themselves.
+func (s *smallifier) apiKeys(ctx context.Context) ([]APIKey, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, name, create_ts, COALESCE(revoked_ts, 0) FROM api_keys ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []APIKey{}
+	for rows.Next() {
+		var k APIKey
+		if err := rows.Scan(&k.ID, &k.Name, &k.CreateTS, &k.RevokedTS); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// revokeAPIKey revokes the API key with id, reporting whether there was such a key which hadn't been revoked.
+// Revoked keys are kept, so that the links created with them remain attributed.
+func (s *smallifier) revokeAPIKey(ctx context.Context, id int64) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `UPDATE api_keys SET revoked_ts = $1 WHERE id = $2 AND revoked_ts IS NULL`, s.clock.Now().Unix(), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// authenticateCreator reports whether secret is one of the server's secrets or a valid API key,
+// returning the name of the API key, or "" for the server's secret.
+// It doesn't take WithOpenCreation into account.
+func (s *smallifier) authenticateCreator(ctx context.Context, secret string) (owner string, ok bool, err error) {
+	if s.validSecret(secret) {
+		return "", true, nil
+	}
+	if secret == "" {
+		return "", false, nil
+	}
+	err = s.db.QueryRowContext(ctx, `SELECT name FROM api_keys WHERE key_hash = $1 AND revoked_ts IS NULL`, hashReadToken(secret)).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	return owner, err == nil, err
+}
+
+// setOwner records that the link at shortPath was created with the API key named owner.
+func (s *smallifier) setOwner(ctx context.Context, shortPath, owner string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE links SET owner = $1 WHERE short_path = $2`, owner, shortPath)
+	return err
+}
+
+// linkOwner returns the name of the API key the link at shortPath was created with, or "" if it was created with the server's secret.
+func (s *smallifier) linkOwner(ctx context.Context, shortPath string) (string, error) {
+	var owner sql.NullString
+	err := s.db.QueryRowContext(ctx, `SELECT owner FROM links WHERE short_path = $1`, shortPath).Scan(&owner)
+	return owner.String, err
+}
@@ -0,0 +1,78 @@
+package smallifier
+
+import (
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func issueAPIKey(t *testing.T, f fixture, name string) APIKey {
+	resp := adminBodyRequest(t, f, "POST", "api-keys", testSecret, `{"name": "`+name+`"}`)
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatal("issuing API key: want status code 200 got", resp.StatusCode)
+	}
+	var key APIKey
+	if err := json.NewDecoder(resp.Body).Decode(&key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func deleteWithKey(t *testing.T, f fixture, shortPath, key string) int {
+	body, _ := json.Marshal(DeleteRequest{ShortPath: shortPath, Secret: key})
+	resp, err := insecureClient().Post(f.server.URL+"/_delete", "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestAPIKeys(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	bot := issueAPIKey(t, f, "bot")
+	other := issueAPIKey(t, f, "other")
+	resp := adminBodyRequest(t, f, "POST", "api-keys", testSecret, `{"name": "bot"}`)
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Errorf("issuing duplicate API key: want status code 400 got %d", resp.StatusCode)
+	}
+
+	r := create(t, f, `{"long_url": "`+f.server.URL+`/_stub", "secret": "`+bot.Key+`"}`)
+	if r.Owner != "bot" {
+		t.Errorf("want owner bot got %q", r.Owner)
+	}
+	page, _ := listLinks(t, f, url.Values{})
+	if len(page.Links) != 1 || page.Links[0].Owner != "bot" {
+		t.Errorf("want one link owned by bot got %+v", page.Links)
+	}
+
+	if status := deleteWithKey(t, f, r.ShortPath, other.Key); status != 403 {
+		t.Errorf("deleting with another key: want status code 403 got %d", status)
+	}
+	resp = adminBodyRequest(t, f, "DELETE", "api-keys/"+strconv.FormatInt(bot.ID, 10), testSecret, "")
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatal("revoking API key: want status code 200 got", resp.StatusCode)
+	}
+	if status := deleteWithKey(t, f, r.ShortPath, bot.Key); status != 401 {
+		t.Errorf("deleting with revoked key: want status code 401 got %d", status)
+	}
+	if r := create(t, f, `{"long_url": "`+f.server.URL+`/_stub", "secret": "`+bot.Key+`"}`); r.ShortURL != "" {
+		t.Errorf("creating with revoked key: want no link got %s", r.ShortURL)
+	}
+	if status := deleteWithKey(t, f, r.ShortPath, testSecret); status != 200 {
+		t.Errorf("deleting with secret: want status code 200 got %d", status)
+	}
+
+	var keys []APIKey
+	decodeAdminResponse(t, f, "GET", "api-keys", &keys)
+	if len(keys) != 2 || keys[0].Name != "bot" || keys[0].RevokedTS == 0 || keys[1].RevokedTS != 0 || keys[0].Key != "" {
+		t.Errorf("want bot revoked and other not, without keys, got %+v", keys)
+	}
+}
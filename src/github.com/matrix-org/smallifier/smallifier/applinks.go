@@ -0,0 +1,59 @@
+package smallifier
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// AppSchemesHeader is the HTTP header with which clients following a link list the URI schemes, e.g. "matrix, intent",
+// which they can open in an app. If a link's app link uses one of them, the client is redirected to it instead of the long URL.
+// Clients which don't send it are only redirected to intent: app links, and only if their User-Agent is Android's, as
+// Android browsers open those in the app they name, or fall back to a URL they give; browsers asked to open other
+// schemes they have no app for show an error rather than the long URL.
+const AppSchemesHeader = "X-Smallifier-App-Schemes"
+
+// appLinkSchemes are the URI schemes app links may use.
+var appLinkSchemes = map[string]bool{
+	"matrix": true,
+	"intent": true,
+}
+
+// checkAppLink returns an error if appLink may not be stored as the app link for longURL.
+// App links are only accepted for Matrix content, i.e. long URLs on matrix.to.
+func checkAppLink(longURL, appLink string) error {
+	if u, err := url.Parse(longURL); err != nil || strings.ToLower(u.Host) != "matrix.to" {
+		return errors.New("App links may only be given for links to https://matrix.to/")
+	}
+	u, err := url.Parse(appLink)
+	if err != nil || !appLinkSchemes[strings.ToLower(u.Scheme)] {
+		return errors.New("App links must be matrix: or intent: URIs")
+	}
+	return nil
+}
+
+// addAppLink stores appLink as the app link for shortPath.
+func (s *smallifier) addAppLink(ctx context.Context, shortPath, appLink string) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO app_links (short_path, app_link) VALUES ($1, $2)`, shortPath, appLink)
+	return err
+}
+
+// clientOpens reports whether req indicates that the client can open appLink in an app, as described by AppSchemesHeader.
+func clientOpens(req *http.Request, appLink string) bool {
+	u, err := url.Parse(appLink)
+	if err != nil {
+		return false
+	}
+	schemes := req.Header.Get(AppSchemesHeader)
+	if schemes == "" {
+		return strings.EqualFold(u.Scheme, "intent") && strings.Contains(req.UserAgent(), "Android")
+	}
+	for _, scheme := range strings.Split(schemes, ",") {
+		if strings.EqualFold(strings.TrimSpace(scheme), u.Scheme) {
+			return true
+		}
+	}
+	return false
+}
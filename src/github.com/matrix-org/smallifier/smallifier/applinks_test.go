@@ -0,0 +1,177 @@
+package smallifier
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAppLink(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	resp, err := insecureClient().Post(f.server.URL+"/_create", "application/json", strings.NewReader(`{
+		"long_url": "https://matrix.to/#/#lemurs:matrix.org",
+		"app_link": "matrix:r/lemurs:matrix.org",
+		"secret": "`+testSecret+`"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatal("creating link with app link: want status code 200 got", resp.StatusCode)
+	}
+	var created Response
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+
+	client := insecureClient()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	for _, tc := range []struct {
+		schemes string
+		want    string
+	}{
+		{"", "https://matrix.to/#/#lemurs:matrix.org"},
+		{"intent", "https://matrix.to/#/#lemurs:matrix.org"},
+		{"intent, Matrix", "matrix:r/lemurs:matrix.org"},
+	} {
+		req, err := http.NewRequest("GET", created.ShortURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.schemes != "" {
+			req.Header.Set(AppSchemesHeader, tc.schemes)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("Location"); got != tc.want {
+			t.Errorf("app schemes %q: want redirect to %q got %q", tc.schemes, tc.want, got)
+		}
+	}
+}
+
+func TestIntentAppLinkOnAndroid(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	const longURL, appLink = "https://matrix.to/#/#lemurs:matrix.org", "intent://lemurs.win/#Intent;scheme=matrix;end"
+	resp, err := insecureClient().Post(f.server.URL+"/_create", "application/json", strings.NewReader(`{
+		"long_url": "`+longURL+`",
+		"app_link": "`+appLink+`",
+		"secret": "`+testSecret+`"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var created Response
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+
+	const android = "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0 Mobile Safari/537.36"
+	client := insecureClient()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	for _, tc := range []struct {
+		userAgent, schemes string
+		want               string
+	}{
+		{android, "", appLink},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0", "", longURL},
+		// Clients which list the schemes they can open are taken at their word.
+		{android, "matrix", longURL},
+	} {
+		req, err := http.NewRequest("GET", created.ShortURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("User-Agent", tc.userAgent)
+		if tc.schemes != "" {
+			req.Header.Set(AppSchemesHeader, tc.schemes)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("Location"); got != tc.want {
+			t.Errorf("%q with app schemes %q: want redirect to %q got %q", tc.userAgent, tc.schemes, tc.want, got)
+		}
+	}
+}
+
+func TestAppLinkRejected(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	for _, tc := range []struct {
+		longURL string
+		appLink string
+	}{
+		{f.server.URL + "/_stub", "matrix:r/lemurs:matrix.org"},
+		{"https://matrix.to/#/#lemurs:matrix.org", "javascript:alert(1)"},
+	} {
+		resp, err := insecureClient().Post(f.server.URL+"/_create", "application/json", strings.NewReader(`{
+			"long_url": "`+tc.longURL+`",
+			"app_link": "`+tc.appLink+`",
+			"secret": "`+testSecret+`"
+		}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 400 {
+			t.Errorf("app link %q for %q: want status code 400 got %d", tc.appLink, tc.longURL, resp.StatusCode)
+		}
+	}
+}
+
+func TestAppLinkToBlockedHost(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	resp, err := insecureClient().Post(f.server.URL+"/_create", "application/json", strings.NewReader(`{
+		"long_url": "https://matrix.to/#/#lemurs:matrix.org",
+		"app_link": "intent://evil.lemurs.win/#Intent;scheme=matrix;end",
+		"secret": "`+testSecret+`"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var created Response
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	f.smallifier.SetDestinationHosts(&DestinationHosts{Block: []string{"evil.lemurs.win"}})
+
+	client := insecureClient()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	for _, tc := range []struct {
+		schemes string
+		want    int
+	}{
+		{"", 302},
+		{"intent", 410},
+	} {
+		req, err := http.NewRequest("GET", created.ShortURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(AppSchemesHeader, tc.schemes)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("app schemes %q: want status code %d got %d", tc.schemes, tc.want, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package smallifier
+
+import (
+	"context"
+	"database/sql"
+)
+
+// defaultAuditLimit is how many audit entries are returned if the request doesn't specify.
+const defaultAuditLimit = 100
+
+// AuditEntry records a change made to a link through the admin API, or to the destinations links may redirect to,
+// in which case ShortURL is empty.
+type AuditEntry struct {
+	TS       int64  `json:"ts"`
+	Action   string `json:"action"`
+	ShortURL string `json:"short_url"`
+	Old      string `json:"old"`
+	New      string `json:"new"`
+}
+
+// addAuditEntry records that action changed shortPath from old to new at ts, as part of tx.
+func addAuditEntry(ctx context.Context, tx *sql.Tx, ts int64, action, shortPath, old, new string) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO audit_log (ts, action, short_path, old_value, new_value) VALUES ($1, $2, $3, $4, $5)`, ts, action, shortPath, old, new)
+	return err
+}
+
+// auditLog returns the most recent limit entries in the audit log, optionally only those for shortPath, newest first.
+func (s *smallifier) auditLog(ctx context.Context, shortPath string, limit int) ([]AuditEntry, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT ts, action, short_path, old_value, new_value FROM audit_log
+		WHERE $1 = '' OR short_path = $1 ORDER BY id DESC LIMIT $2`, shortPath, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.TS, &e.Action, &e.ShortURL, &e.Old, &e.New); err != nil {
+			return nil, err
+		}
+		if e.ShortURL != "" {
+			e.ShortURL = s.base.String() + e.ShortURL
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
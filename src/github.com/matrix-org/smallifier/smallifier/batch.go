@@ -0,0 +1,50 @@
+package smallifier
+
+// Error codes of BatchItems which failed, so that clients can tell which are worth retrying.
+const (
+	// BatchErrorInvalid items can never succeed as they were given.
+	BatchErrorInvalid = "invalid"
+	// BatchErrorUnreachable items depended on another server which couldn't be reached, or misbehaved.
+	// Retrying them may succeed.
+	BatchErrorUnreachable = "unreachable"
+	// BatchErrorInternal items failed because of a problem with smallifier itself. Retrying them may succeed.
+	BatchErrorInternal = "internal"
+	// BatchErrorLimited items would have taken the links stored past a limit given to WithLinkLimits.
+	// Retrying them will fail until links are deleted or the limit is raised.
+	BatchErrorLimited = "limited"
+)
+
+// BatchItem is the outcome of one item of an admin request acting on many, which succeeds or fails independently of
+// the others. It is embedded in the results of such requests, so that clients can retry only the items which failed.
+type BatchItem struct {
+	// Status is the HTTP status code the item would have been responded to with on its own: 200 if it succeeded.
+	Status int `json:"status"`
+	// ErrorCode is one of the BatchError codes, and Error explains it, if the item failed.
+	ErrorCode string `json:"error_code,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// BatchSummary counts the outcomes of the items of an admin request acting on many.
+type BatchSummary struct {
+	Total     int `json:"total"`
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+}
+
+// batchSuccess is the BatchItem of an item which succeeded.
+var batchSuccess = BatchItem{Status: 200}
+
+// batchFailure returns the BatchItem of an item which failed with err.
+func batchFailure(status int, code string, err error) BatchItem {
+	return BatchItem{Status: status, ErrorCode: code, Error: err.Error()}
+}
+
+// add counts item in the summary.
+func (s *BatchSummary) add(item BatchItem) {
+	s.Total++
+	if item.ErrorCode == "" {
+		s.Succeeded++
+	} else {
+		s.Failed++
+	}
+}
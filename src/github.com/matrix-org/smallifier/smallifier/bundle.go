@@ -0,0 +1,254 @@
+package smallifier
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// maxBundleItems is the most URLs a single bundle may list.
+const maxBundleItems = 100
+
+// BundleRequest is the JSON-encoded POST-body of an HTTP request to generate a short link to a list of URLs.
+type BundleRequest struct {
+	// Title is shown at the top of the bundle's page.
+	Title  string       `json:"title"`
+	Items  []BundleItem `json:"items"`
+	Secret string       `json:"secret"`
+	// Referrers optionally restricts the sites the bundle's items may be followed from.
+	Referrers *ReferrerPolicy `json:"referrers,omitempty"`
+	// Nonce is a value from the nonce endpoint, which browsers may be required to pass.
+	Nonce string `json:"nonce,omitempty"`
+}
+
+// BundleItem is a single destination listed on a bundle's page.
+type BundleItem struct {
+	// Title is the text of the link to URL. If empty, URL is shown instead.
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+// bundlePage is what the "bundle" page of a Theme is rendered with.
+type bundlePage struct {
+	Title string
+	Items []BundleItem
+}
+
+// CreateBundleHandler is an http.HandlerFunc which creates a shortlink to a page listing the URLs in a JSON-encoded BundleRequest,
+// and returns it as a JSON-encoded Response.
+// Each URL is linked from the page via its own short path, <short path>/<position>, so that follows of each item are recorded separately.
+func (s *smallifier) CreateBundleHandler(w http.ResponseWriter, req *http.Request) {
+	setHeaders(w)
+	if !s.checkMethod(w, req, "POST") {
+		return
+	}
+
+	ctx, cancel, ok := s.requestContext(w, req)
+	if !ok {
+		return
+	}
+	defer cancel()
+
+	if !s.refuseWhileShedding(w) || !s.checkCreateRateLimit(w, req) {
+		return
+	}
+
+	defer req.Body.Close()
+	dec := json.NewDecoder(req.Body)
+	var jsonReq BundleRequest
+	if err := dec.Decode(&jsonReq); err != nil {
+		log.Error("Got bad json: ", err)
+		writeError(w, 400, ErrCodeNotJSON, "error decoding json")
+		return
+	}
+
+	owner, ok, err := s.authenticateCreator(ctx, jsonReq.Secret)
+	if err != nil {
+		writeLookupError(w, err)
+		return
+	}
+	if !ok && !(jsonReq.Secret == "" && s.openCreation) {
+		atomic.AddUint64(&s.authErrorCount, 1)
+		log.WithField("bad_secret", jsonReq.Secret).Error("Refusing to create bundle with wrong secret")
+		writeError(w, 401, ErrCodeUnauthorized, "Must specify correct secret")
+		return
+	}
+
+	if !s.checkBrowserRequest(w, req, jsonReq.Nonce) {
+		return
+	}
+
+	if len(jsonReq.Items) == 0 || len(jsonReq.Items) > maxBundleItems {
+		writeError(w, 400, ErrCodeInvalidParam, "Bundles must contain between 1 and "+strconv.Itoa(maxBundleItems)+" items")
+		return
+	}
+	for _, item := range jsonReq.Items {
+		if !s.checkLongURL(ctx, w, item.URL, !ok) {
+			return
+		}
+	}
+	if jsonReq.Referrers != nil {
+		if err := checkReferrerPolicy(jsonReq.Referrers); err != nil {
+			writeError(w, 400, ErrCodeInvalidParam, err.Error())
+			return
+		}
+	}
+
+	if err := s.checkWritable(); err != nil {
+		writeErr(w, err)
+		return
+	}
+	if err := s.checkLinkLimits(""); err != nil {
+		writeErr(w, err)
+		return
+	}
+
+	// Bundles are stored as links with an empty long_url, which the lookup handler renders from bundle_items.
+	id, err := s.generateShortPath(ctx, "", remoteIP(req), req.Header.Get("X-Forwarded-For"))
+	if e := contextError(err); e != nil {
+		writeErr(w, e)
+		return
+	}
+	if _, ok := err.(transientError); ok {
+		writeTransientError(w, "could not store bundle")
+		return
+	}
+	if err != nil {
+		writeError(w, 500, ErrCodeUnknown, err.Error())
+		return
+	}
+
+	if owner != "" {
+		err = s.setOwner(ctx, id, owner)
+	}
+	if err == nil {
+		err = s.addBundleItems(ctx, id, jsonReq)
+	}
+	if err == nil && jsonReq.Referrers != nil {
+		err = s.addReferrerPolicy(ctx, id, jsonReq.Referrers)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":        err,
+			"short_path": id,
+		}).Error("Error saving bundle")
+		if err := s.discardLink(id); err != nil {
+			log.WithField("err", err).Error("Error deleting bundle without its items")
+			atomic.AddUint64(&s.dbUpdateErrorCount, 1)
+		}
+		writeTransientError(w, "error saving bundle")
+		return
+	}
+
+	var resp Response
+	if err := s.describeLink(ctx, id, &resp); err != nil {
+		writeLookupError(w, err)
+		return
+	}
+	if resp.EditToken, err = s.addEditToken(ctx, id); err != nil {
+		log.WithFields(log.Fields{
+			"err":        err,
+			"short_path": id,
+		}).Error("Error saving edit token")
+		atomic.AddUint64(&s.dbUpdateErrorCount, 1)
+		resp.EditToken = ""
+	}
+	s.countCreate("")
+	s.linkCreated(id, "")
+	enc := json.NewEncoder(w)
+	enc.Encode(resp)
+}
+
+func (s *smallifier) addBundleItems(ctx context.Context, shortPath string, bundle BundleRequest) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO bundles (short_path, title) VALUES ($1, $2)`, shortPath, bundle.Title); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for i, item := range bundle.Items {
+		// Positions start at 1, so that they read naturally in the item's short path.
+		if _, err := tx.ExecContext(ctx, `INSERT INTO bundle_items (short_path, position, title, url) VALUES ($1, $2, $3, $4)`, shortPath, i+1, item.Title, item.URL); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// renderBundle writes the HTML page listing the items of the bundle at shortPath.
+func (s *smallifier) renderBundle(ctx context.Context, w http.ResponseWriter, req *http.Request, shortPath string) {
+	var page bundlePage
+	if err := s.db.QueryRowContext(ctx, `SELECT title FROM bundles WHERE short_path = $1`, shortPath).Scan(&page.Title); err != nil {
+		writeLookupError(w, err)
+		return
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT position, title, url FROM bundle_items WHERE short_path = $1 ORDER BY position`, shortPath)
+	if err != nil {
+		writeLookupError(w, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var position int
+		var item BundleItem
+		if err := rows.Scan(&position, &item.Title, &item.URL); err != nil {
+			writeLookupError(w, err)
+			return
+		}
+		if item.Title == "" {
+			item.Title = item.URL
+		}
+		item.URL = s.base.String() + shortPath + "/" + strconv.Itoa(position)
+		page.Items = append(page.Items, item)
+	}
+	if err := rows.Err(); err != nil {
+		writeLookupError(w, err)
+		return
+	}
+
+	if s.render(w, 200, "bundle", page) != nil {
+		return
+	}
+	s.countFollow(req, "")
+	s.enqueueFollow(shortPath, 0, req)
+}
+
+// followBundleItem redirects to the item at position in the bundle at shortPath.
+// The follow is recorded against the bundle, with the item's position, as follows must reference a link, and so counts
+// towards the bundle's stats.
+func (s *smallifier) followBundleItem(ctx context.Context, w http.ResponseWriter, req *http.Request, shortPath, position string) {
+	n, err := strconv.Atoi(position)
+	if err != nil || strconv.Itoa(n) != position {
+		writeError(w, 404, ErrCodeNotFound, "link not found")
+		return
+	}
+	row := s.db.QueryRowContext(ctx, `SELECT bundle_items.url, links.deleted, COALESCE(link_referrers.hosts, ''),
+		COALESCE(link_referrers.interstitial, 0) FROM bundle_items JOIN links ON bundle_items.short_path = links.short_path
+		LEFT JOIN link_referrers ON links.short_path = link_referrers.short_path
+		WHERE links.short_path = $1 AND bundle_items.position = $2`, shortPath, position)
+	var link, referrerHosts string
+	var deleted, interstitial bool
+	if err := row.Scan(&link, &deleted, &referrerHosts, &interstitial); err != nil {
+		writeLookupError(w, err)
+		return
+	}
+	if deleted {
+		writeGone(w)
+		return
+	}
+	if s.destinationBlocked(link) {
+		s.writeDestinationBlocked(w, link)
+		return
+	}
+	// Items are followed as links are, under the bundle's referrer policy.
+	if s.checkReferrer(w, req, shortPath, link, parseReferrerPolicy(referrerHosts, interstitial)) {
+		s.redirect(w, req, shortPath, n, link, "")
+	}
+}
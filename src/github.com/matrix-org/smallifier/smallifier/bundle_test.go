@@ -0,0 +1,159 @@
+package smallifier
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBundle(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	resp, err := insecureClient().Post(f.server.URL+"/_bundle", "application/json", strings.NewReader(`{
+		"title": "Lemur resources",
+		"items": [
+			{"title": "Ringtails", "url": "https://lemurs.win/ringtails"},
+			{"title": "Stub", "url": "`+f.server.URL+`/_stub"}
+		],
+		"secret": "`+testSecret+`"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var created Response
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	shortPath := created.ShortURL[len(f.base):]
+
+	page, err := insecureClient().Get(created.ShortURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer page.Body.Close()
+	b, err := ioutil.ReadAll(page.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Lemur resources", "Ringtails", created.ShortURL + "/2"} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("bundle page: want %q in page got %s", want, b)
+		}
+	}
+
+	item, err := insecureClient().Get(created.ShortURL + "/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer item.Body.Close()
+	b, err = ioutil.ReadAll(item.Body)
+	if got := string(b); stubResponse != got {
+		t.Errorf("following bundle item: want %q got %q", stubResponse, got)
+	}
+
+	assertFollowCount(f, shortPath, 1, "bundle page:")
+	assertFollowCount(f, shortPath+"/2", 1, "bundle item:")
+	assertFollowCount(f, shortPath+"/1", 0, "unfollowed bundle item:")
+}
+
+func TestMissingBundleItem(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	resp, err := insecureClient().Post(f.server.URL+"/_bundle", "application/json", strings.NewReader(`{
+		"items": [{"url": "https://lemurs.win/ringtails"}],
+		"secret": "`+testSecret+`"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var created Response
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, item := range []string{"/2", "/01", "/x"} {
+		noFollow := &http.Client{
+			Transport:     insecureClient().Transport,
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		}
+		resp, err := noFollow.Get(created.ShortURL + item)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 404 {
+			t.Errorf("bundle item %s: want status code 404 got %d", item, resp.StatusCode)
+		}
+	}
+}
+
+func TestNonHTTPSBundleItem(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	resp, err := insecureClient().Post(f.server.URL+"/_bundle", "application/json", strings.NewReader(`{
+		"items": [{"url": "https://lemurs.win"}, {"url": "http://lemurs.win"}],
+		"secret": "`+testSecret+`"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Error("non-https bundle item: want status code 400 got", resp.StatusCode)
+	}
+}
+
+func TestBundleItemReferrerPolicy(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	resp, err := insecureClient().Post(f.server.URL+"/_bundle", "application/json", strings.NewReader(`{
+		"items": [{"url": "https://lemurs.win/ringtails"}],
+		"secret": "`+testSecret+`",
+		"referrers": {"hosts": ["matrix.org"]}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var created Response
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+
+	noFollow := &http.Client{
+		Transport:     insecureClient().Transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	for _, tc := range []struct {
+		name, target, referer string
+		status                int
+		want                  string
+	}{
+		{"allowed host", created.ShortURL + "/1", "https://matrix.org/", 302, ""},
+		{"other host", created.ShortURL + "/1", "https://example.com/", 403, ""},
+		{"preview", created.ShortURL + "/1?preview=1", "https://matrix.org/", 200, created.ShortURL + "/1"},
+	} {
+		req, err := http.NewRequest("GET", tc.target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Referer", tc.referer)
+		resp, err := noFollow.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status || !strings.Contains(string(b), tc.want) {
+			t.Errorf("%s: want %d with %q got %d with %s", tc.name, tc.status, tc.want, resp.StatusCode, b)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package smallifier
+
+import "time"
+
+// Clock tells the time, for timestamps such as those of links and follows, and for timing periodic work such as expiry.
+type Clock interface {
+	Now() time.Time
+	// After returns a channel on which the time is sent once d has passed.
+	After(d time.Duration) <-chan time.Time
+}
+
+// SystemClock is the Clock of the system, which is used unless WithClock gives another.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// WithClock sets the Clock used to tell the time, so that tests can control it rather than waiting for it to pass.
+func WithClock(c Clock) Option {
+	return func(s *smallifier) {
+		s.clock = c
+	}
+}
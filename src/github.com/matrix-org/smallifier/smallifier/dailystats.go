@@ -0,0 +1,126 @@
+package smallifier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxDailyStatsDays is the most days whose follows may be counted by a single stats request.
+const maxDailyStatsDays = 366
+
+// DailyFollows counts the follows of a link on one day.
+type DailyFollows struct {
+	// Date is the day, as YYYY-MM-DD, in the time zone the stats were requested in.
+	Date    string `json:"date"`
+	Follows int64  `json:"follows"`
+}
+
+// parseDailyQuery parses the parameters of a stats request for daily follows: ?days=..., how many days to count
+// follows on, up to and including today, and ?tz=..., the IANA name of the time zone whose days they are, by default UTC.
+// days is 0 if follows weren't asked to be counted by day.
+func parseDailyQuery(q url.Values) (days int, loc *time.Location, err error) {
+	loc = time.UTC
+	if v := q.Get("days"); v != "" {
+		if days, err = strconv.Atoi(v); err != nil || days <= 0 || days > maxDailyStatsDays {
+			return 0, nil, fmt.Errorf("days must be between 1 and %d", maxDailyStatsDays)
+		}
+	}
+	if tz := q.Get("tz"); tz != "" {
+		if days == 0 {
+			return 0, nil, errors.New("tz must be given with days")
+		}
+		if loc, err = time.LoadLocation(tz); err != nil {
+			return 0, nil, errors.New("Unknown time zone")
+		}
+	}
+	return days, loc, nil
+}
+
+// dailyFollows counts the follows of the link at shortPath on each of the last days days in loc, up to and including
+// today, oldest first.
+func (s *smallifier) dailyFollows(ctx context.Context, shortPath string, days int, loc *time.Location) ([]DailyFollows, error) {
+	y, m, d := s.clock.Now().In(loc).Date()
+	start := time.Date(y, m, d-days+1, 0, 0, 0, 0, loc)
+	end := time.Date(y, m, d+1, 0, 0, 0, 0, loc)
+
+	// Follows are bucketed by day in the database, by adding the offset of loc in effect at the time of each to its
+	// timestamp, and dividing by the length of a day.
+	offset, args := zoneOffsetSQL(start, end)
+	args = append(args, shortPath, start.Unix(), end.Unix())
+	last := len(args)
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(`SELECT (ts + %s) / 86400 AS day, COUNT(*) FROM follows
+		WHERE short_path = $%d AND ts >= $%d AND ts < $%d GROUP BY day`, offset, last-2, last-1, last), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	follows := map[string]int64{}
+	for rows.Next() {
+		var day, n int64
+		if err := rows.Scan(&day, &n); err != nil {
+			return nil, err
+		}
+		follows[time.Unix(day*86400, 0).UTC().Format("2006-01-02")] = n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	daily := make([]DailyFollows, days)
+	for i := range daily {
+		date := time.Date(y, m, d-days+1+i, 0, 0, 0, 0, loc).Format("2006-01-02")
+		daily[i] = DailyFollows{date, follows[date]}
+	}
+	return daily, nil
+}
+
+// zoneOffsetSQL returns an SQL expression for the offset from UTC, in seconds, of the time zone of start at the time of
+// a follow's ts between start and end, which changes at any daylight saving transitions in between, and the arguments
+// for its placeholders. Placeholders are bound in the order they first appear, so are numbered in that order from $1,
+// and the expression must come before any others in a query.
+func zoneOffsetSQL(start, end time.Time) (string, []interface{}) {
+	untils, offsets := zoneOffsets(start, end)
+	if len(untils) == 0 {
+		return "$1", []interface{}{offsets[0]}
+	}
+	var args []interface{}
+	cases := []string{"CASE"}
+	for i, until := range untils {
+		cases = append(cases, fmt.Sprintf("WHEN ts < $%d THEN $%d", len(args)+1, len(args)+2))
+		args = append(args, until, offsets[i])
+	}
+	cases = append(cases, fmt.Sprintf("ELSE $%d END", len(args)+1))
+	return strings.Join(cases, " "), append(args, offsets[len(offsets)-1])
+}
+
+// zoneOffsets returns the offsets from UTC, in seconds, of the time zone of start between start and end, and the unix
+// timestamps until which each but the last is in effect.
+func zoneOffsets(start, end time.Time) (untils []int64, offsets []int) {
+	_, offset := start.Zone()
+	for t := start; t.Before(end); t = t.Add(time.Hour) {
+		next := t.Add(time.Hour)
+		_, nextOffset := next.Zone()
+		if nextOffset == offset {
+			continue
+		}
+		// Find the first second of the new offset, as not every zone changes on the hour.
+		lo, hi := t.Unix(), next.Unix()
+		for hi-lo > 1 {
+			mid := (lo + hi) / 2
+			if _, o := time.Unix(mid, 0).In(start.Location()).Zone(); o == offset {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+		untils = append(untils, hi)
+		offsets = append(offsets, offset)
+		offset = nextOffset
+	}
+	return untils, append(offsets, offset)
+}
@@ -0,0 +1,79 @@
+package smallifier
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestDailyStats(t *testing.T) {
+	clock := newFakeClock()
+	f := serve(t, WithClock(clock))
+	defer f.Close()
+
+	shortPath := shorten(t, f.server.URL, f.server.URL+"/_stub")[len(f.base):]
+	// The clock reads 02:40 UTC on 2017-07-14.
+	for _, hoursAgo := range []int{1, 3, 5} {
+		if _, err := f.db.Exec(`INSERT INTO follows (short_path, ts, ip) VALUES ($1, $2, '127.0.0.1')`,
+			shortPath, clock.Now().Add(-time.Duration(hoursAgo)*time.Hour).Unix()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		query string
+		tz    string
+		days  int
+		want  map[string]int64
+	}{
+		{"?days=2", "UTC", 2, map[string]int64{"2017-07-13": 2, "2017-07-14": 1}},
+		{"?days=2&tz=America/New_York", "America/New_York", 2, map[string]int64{"2017-07-12": 0, "2017-07-13": 3}},
+		// The year before includes both of London's daylight saving transitions.
+		{"?days=366&tz=Europe/London", "Europe/London", 366, map[string]int64{"2016-07-14": 0, "2017-07-13": 1, "2017-07-14": 2}},
+	} {
+		resp := statsRequest(t, f, shortPath+tc.query, testSecret)
+		var stats LinkStats
+		if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if stats.TZ != tc.tz || len(stats.Daily) != tc.days {
+			t.Errorf("%s: want %d days in %s got %d in %s", tc.query, tc.days, tc.tz, len(stats.Daily), stats.TZ)
+			continue
+		}
+		got := map[string]int64{}
+		var total int64
+		for _, d := range stats.Daily {
+			got[d.Date] = d.Follows
+			total += d.Follows
+		}
+		for date, n := range tc.want {
+			if got[date] != n {
+				t.Errorf("%s: want %d follows on %s got %+v", tc.query, n, date, stats.Daily)
+			}
+		}
+		if total != 3 || stats.Daily[0].Date > stats.Daily[len(stats.Daily)-1].Date {
+			t.Errorf("%s: want 3 follows, oldest first, got %+v", tc.query, stats.Daily)
+		}
+	}
+
+	for _, query := range []string{"?days=0", "?days=367", "?tz=UTC", "?days=1&tz=Mars/Olympus_Mons"} {
+		resp := statsRequest(t, f, shortPath+query, testSecret)
+		resp.Body.Close()
+		if resp.StatusCode != 400 {
+			t.Errorf("%s: want status code 400 got %d", query, resp.StatusCode)
+		}
+	}
+}
+
+func TestZoneOffsets(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	untils, offsets := zoneOffsets(time.Date(2017, 3, 25, 0, 0, 0, 0, london), time.Date(2017, 3, 27, 0, 0, 0, 0, london))
+	// Clocks went forward at 01:00 UTC on 2017-03-26.
+	if len(untils) != 1 || untils[0] != 1490490000 || len(offsets) != 2 || offsets[0] != 0 || offsets[1] != 3600 {
+		t.Errorf("want change from offset 0 to 3600 at 1490490000 got %v until %v", offsets, untils)
+	}
+}
@@ -0,0 +1,80 @@
+package smallifier
+
+import (
+	"context"
+	"database/sql"
+)
+
+// WithDedupe makes every create request deduplicated, as if it set CreateRequest.Dedupe.
+func WithDedupe() Option {
+	return func(s *smallifier) {
+		s.dedupe = true
+	}
+}
+
+// normalizedURL returns the normalized form of link which is stored, to find links to it when deduplicating,
+// or link itself if it can't be normalized. Bundles, whose link is empty, are left empty.
+func normalizedURL(link string) string {
+	if link == "" {
+		return ""
+	}
+	normalized, err := normalizeURL(link)
+	if err != nil {
+		return link
+	}
+	return normalized
+}
+
+// dedupedShortPath returns the oldest link to link, or an equivalent URL, which hasn't been deleted, creating one if
+// there is none. created reports whether a new link was stored.
+// Links created at the same moment by concurrent requests aren't deduplicated against each other.
+func (s *smallifier) dedupedShortPath(ctx context.Context, link, ip, forwardedFor string) (shortPath string, created bool, err error) {
+	err = s.db.QueryRowContext(ctx, `SELECT short_path FROM links WHERE normalized_url = $1 AND deleted = 0 ORDER BY id LIMIT 1`, normalizedURL(link)).Scan(&shortPath)
+	if err == nil {
+		return shortPath, false, nil
+	}
+	if err != sql.ErrNoRows {
+		if ctx.Err() != nil {
+			return "", false, ctx.Err()
+		}
+		return "", false, databaseError(err)
+	}
+	shortPath, err = s.generateShortPath(ctx, link, ip, forwardedFor)
+	return shortPath, err == nil, err
+}
+
+// backfillNormalizedURLs sets the normalized_url of links created before it was recorded.
+func backfillNormalizedURLs(db *sql.DB) error {
+	rows, err := db.Query(`SELECT short_path, long_url FROM links WHERE normalized_url IS NULL AND long_url != ''`)
+	if err != nil {
+		return err
+	}
+	normalized := make(map[string]string)
+	for rows.Next() {
+		var shortPath, longURL string
+		if err := rows.Scan(&shortPath, &longURL); err != nil {
+			rows.Close()
+			return err
+		}
+		normalized[shortPath] = normalizedURL(longURL)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	if len(normalized) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for shortPath, n := range normalized {
+		if _, err := tx.Exec(`UPDATE links SET normalized_url = $1 WHERE short_path = $2`, n, shortPath); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,70 @@
+package smallifier
+
+import (
+	"testing"
+)
+
+func TestDedupeReturnsExistingLink(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	first := create(t, f, `{"long_url": "https://lemurs.win/ringtails", "secret": "`+testSecret+`"}`)
+	again := create(t, f, `{"long_url": "https://lemurs.win/ringtails", "secret": "`+testSecret+`"}`)
+	if again.ShortPath == first.ShortPath {
+		t.Errorf("without dedupe: want a new link got %s again", first.ShortPath)
+	}
+
+	deduped := create(t, f, `{"long_url": "https://LEMURS.win:443/ringtails", "secret": "`+testSecret+`", "dedupe": true}`)
+	if deduped.ShortPath != first.ShortPath {
+		t.Errorf("with dedupe: want oldest link %s got %s", first.ShortPath, deduped.ShortPath)
+	}
+	if deduped.EditToken != "" {
+		t.Error("with dedupe: want no edit token for the existing link")
+	}
+
+	if _, err := f.db.Exec(`UPDATE links SET deleted = 1 WHERE short_path IN ($1, $2)`, first.ShortPath, again.ShortPath); err != nil {
+		t.Fatal(err)
+	}
+	fresh := create(t, f, `{"long_url": "https://lemurs.win/ringtails", "secret": "`+testSecret+`", "dedupe": true}`)
+	if fresh.ShortPath == "" || fresh.ShortPath == first.ShortPath || fresh.ShortPath == again.ShortPath || fresh.EditToken == "" {
+		t.Errorf("after deleting: want a new link got %+v", fresh)
+	}
+}
+
+func TestDedupeOption(t *testing.T) {
+	f := serve(t, WithDedupe())
+	defer f.Close()
+
+	first := create(t, f, `{"long_url": "https://lemurs.win/ringtails", "secret": "`+testSecret+`"}`)
+	second := create(t, f, `{"long_url": "https://lemurs.win/ringtails", "secret": "`+testSecret+`"}`)
+	if first.ShortPath != second.ShortPath {
+		t.Errorf("want same link got %s and %s", first.ShortPath, second.ShortPath)
+	}
+	other := create(t, f, `{"long_url": "https://lemurs.win/Ringtails", "secret": "`+testSecret+`"}`)
+	if other.ShortPath == first.ShortPath {
+		t.Error("want paths to be compared case-sensitively")
+	}
+
+	// Changing a link's destination changes what it is deduplicated against.
+	if status := changeLink(t, f, "PUT", first.ShortPath, testSecret, `{"long_url": "https://lemurs.win/sifakas"}`); status != 200 {
+		t.Fatalf("updating link: want 200 got %d", status)
+	}
+	if r := create(t, f, `{"long_url": "https://lemurs.win/sifakas", "secret": "`+testSecret+`"}`); r.ShortPath != first.ShortPath {
+		t.Errorf("after update: want %s got %s", first.ShortPath, r.ShortPath)
+	}
+}
+
+func TestBackfillNormalizedURLs(t *testing.T) {
+	f := serve(t, WithDedupe())
+	defer f.Close()
+
+	if _, err := f.db.Exec(`INSERT INTO links (short_path, long_url, create_ts, create_ip) VALUES ('lemurs', 'HTTPS://Lemurs.win/ringtails', 0, '127.0.0.1')`); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateTables(f.db); err != nil {
+		t.Fatal(err)
+	}
+	if r := create(t, f, `{"long_url": "https://lemurs.win/ringtails", "secret": "`+testSecret+`"}`); r.ShortPath != "lemurs" {
+		t.Errorf("want link created before normalized URLs were recorded got %s", r.ShortPath)
+	}
+}
@@ -0,0 +1,97 @@
+package smallifier
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// DestinationHosts restricts the hosts which links may point to.
+// Each entry matches the host itself and any subdomain of it, so "matrix.org" matches "matrix.org" and "www.matrix.org".
+type DestinationHosts struct {
+	// Allow lists the only hosts links may point to. If empty, links may point to any host which isn't blocked.
+	// URIs without a host, such as matrix: URIs, aren't restricted by it.
+	Allow []string `json:"allow"`
+	// Block lists hosts which links may not point to, even if they are allowed.
+	// Existing links to blocked hosts stop being redirected.
+	Block []string `json:"block"`
+}
+
+// ParseDestinationHosts reads DestinationHosts from a JSON object, e.g.
+//
+//	{"allow": ["matrix.org", "matrix.to", "element.io"], "block": ["evil.matrix.org"]}
+func ParseDestinationHosts(r io.Reader) (*DestinationHosts, error) {
+	var h DestinationHosts
+	if err := json.NewDecoder(r).Decode(&h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// WithDestinationHosts restricts the hosts links may point to.
+func WithDestinationHosts(h *DestinationHosts) Option {
+	return func(s *smallifier) {
+		s.SetDestinationHosts(h)
+	}
+}
+
+func (s *smallifier) SetDestinationHosts(h *DestinationHosts) {
+	s.destinationHosts.Store(h)
+}
+
+// errHostNotAllowed and errHostBlocked explain why a link's host isn't allowed.
+var (
+	errHostNotAllowed = errors.New("Links may not point to that host")
+	errHostBlocked    = errors.New("Links to that host are blocked")
+)
+
+// checkDestinationHost returns an error if link may not point to its host.
+func (s *smallifier) checkDestinationHost(link string) error {
+	h, _ := s.destinationHosts.Load().(*DestinationHosts)
+	blocked, _ := s.blockedDestinations.Load().(map[string]BlockedDestination)
+	if h == nil && len(blocked) == 0 {
+		return nil
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return err
+	}
+	host := u.Hostname()
+	if host == "" {
+		return nil
+	}
+	if _, ok := s.blockedDestination(strings.ToLower(host)); ok {
+		return errHostBlocked
+	}
+	if h == nil {
+		return nil
+	}
+	if hostMatches(h.Block, host) {
+		return errHostBlocked
+	}
+	if len(h.Allow) > 0 && !hostMatches(h.Allow, host) {
+		return errHostNotAllowed
+	}
+	return nil
+}
+
+// destinationBlocked reports whether link points to a blocked host, including one blocked by blockDestination.
+func (s *smallifier) destinationBlocked(link string) bool {
+	return s.checkDestinationHost(link) == errHostBlocked
+}
+
+// hostMatches reports whether host is one of hosts, or a subdomain of one.
+// Hosts are compared case-insensitively, ignoring any trailing dot; IP addresses must match exactly.
+func hostMatches(hosts []string, host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, h := range hosts {
+		h = strings.TrimSuffix(strings.ToLower(h), ".")
+		if host == h || (net.ParseIP(h) == nil && strings.HasSuffix(host, "."+h)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package smallifier
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCheckDestinationHost(t *testing.T) {
+	h, err := ParseDestinationHosts(strings.NewReader(`{"allow": ["matrix.org", "matrix.to", "127.0.0.1"], "block": ["evil.matrix.org"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smallifier{}
+	for _, tc := range []struct {
+		link string
+		want error
+	}{
+		{"https://matrix.org/", nil},
+		{"https://WWW.Matrix.Org./blog", nil},
+		{"https://matrix.to:443/#/#matrix:matrix.org", nil},
+		{"https://127.0.0.1/", nil},
+		{"https://evil.matrix.org/", errHostBlocked},
+		{"https://a.evil.matrix.org/", errHostBlocked},
+		{"https://notmatrix.org/", errHostNotAllowed},
+		{"https://matrix.org.evil.example/", errHostNotAllowed},
+		{"https://1.127.0.0.1/", errHostNotAllowed},
+		{"matrix:r/matrix:matrix.org", nil},
+	} {
+		s.SetDestinationHosts(h)
+		if got := s.checkDestinationHost(tc.link); got != tc.want {
+			t.Errorf("%s: want %v got %v", tc.link, tc.want, got)
+		}
+		s.SetDestinationHosts(nil)
+		if got := s.checkDestinationHost(tc.link); got != nil {
+			t.Errorf("%s without restrictions: want nil got %v", tc.link, got)
+		}
+	}
+}
+
+func TestBlockExistingLinks(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	link := shorten(t, f.server.URL, f.server.URL+"/_stub")
+	u, _ := url.Parse(f.server.URL)
+	f.smallifier.SetDestinationHosts(&DestinationHosts{Block: []string{u.Hostname()}})
+	resp, err := insecureClient().Get(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 410 {
+		t.Errorf("following link to blocked host: want status code 410 got %d", resp.StatusCode)
+	}
+	if r := create(t, f, `{"long_url": "`+f.server.URL+`/_stub", "secret": "`+testSecret+`"}`); r.ShortURL != "" {
+		t.Errorf("shortening link to blocked host: want no link got %s", r.ShortURL)
+	}
+}
@@ -0,0 +1,85 @@
+package smallifier
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// WithDeterministicKey makes short paths a keyed hash of the normalized long URL, rather than random.
+// Shortening the same URL again returns the existing link, and instances sharing the key generate the same short paths,
+// even before they share a database.
+func WithDeterministicKey(key []byte) Option {
+	return func(s *smallifier) {
+		s.deterministicKey = key
+	}
+}
+
+// deterministicCandidate returns the attempt'th candidate short path for the normalized URL.
+// Later candidates are only used if earlier ones collide with links to different URLs.
+func (s *smallifier) deterministicCandidate(normalized string, attempt int) string {
+	mac := hmac.New(sha256.New, s.deterministicKey)
+	mac.Write([]byte(normalized))
+	if attempt > 0 {
+		mac.Write([]byte("\x00" + strconv.Itoa(attempt)))
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:6])
+}
+
+// deterministicShortPath finds or creates the link to link whose short path is derived from it using s.deterministicKey.
+// created reports whether a new link was stored.
+func (s *smallifier) deterministicShortPath(ctx context.Context, link, ip, forwardedFor string) (shortPath string, created bool, err error) {
+	normalized, err := normalizeURL(link)
+	if err != nil {
+		return "", false, err
+	}
+	var lastErr error
+	// i is only moved on to the next candidate once candidate i is known to hold a link to a different URL.
+	for attempts, i := 0, 0; attempts < 30; attempts++ {
+		if err := ctx.Err(); err != nil {
+			return "", false, err
+		}
+
+		shortPath := s.deterministicCandidate(normalized, i)
+
+		var existing string
+		var deleted int
+		err := s.db.QueryRowContext(ctx, "SELECT long_url, deleted FROM links WHERE short_path = $1", shortPath).Scan(&existing, &deleted)
+		if err == nil {
+			if existingNormalized, _ := normalizeURL(existing); deleted == 0 && existingNormalized == normalized {
+				return shortPath, false, nil
+			}
+			// Collision with a different or deleted link.
+			i++
+			continue
+		}
+		if err != sql.ErrNoRows {
+			log.WithField("error", err).Error("Error looking up link")
+			lastErr = err
+			continue
+		}
+
+		_, err = s.db.ExecContext(ctx, "INSERT INTO links (short_path, long_url, normalized_url, create_ts, create_ip, create_forwarded_for) VALUES ($1, $2, $3, $4, $5, $6)", shortPath, link, normalizedURL(link), s.clock.Now().Unix(), ip, forwardedFor)
+		if err == nil {
+			return shortPath, true, nil
+		}
+		if isUniqueViolation(err) {
+			// Another request stored a link at the candidate since it was looked up, which may be to this URL too,
+			// so look it up again.
+			continue
+		}
+		log.WithField("error", err).Error("Error saving link")
+		lastErr = err
+	}
+	if lastErr == nil {
+		// Every candidate collided with another link.
+		return "", false, errors.New("could not generate link")
+	}
+	return "", false, databaseError(lastErr)
+}
@@ -0,0 +1,73 @@
+package smallifier
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testDeterministicKey = []byte("Lemurs are strepsirrhine primates")
+
+func TestDeterministicIsIdempotent(t *testing.T) {
+	f := serve(t, WithDeterministicKey(testDeterministicKey))
+	defer f.Close()
+
+	first := shorten(t, f.server.URL, "https://lemurs.win/ringtails")
+	second := shorten(t, f.server.URL, "https://LEMURS.win:443/ringtails")
+	if first != second {
+		t.Errorf("shortening equivalent URLs: want same short URL got %s and %s", first, second)
+	}
+
+	other := serve(t, WithDeterministicKey(testDeterministicKey))
+	defer other.Close()
+	third := shorten(t, other.server.URL, "https://lemurs.win/ringtails")
+	if first[len(f.base):] != third[len(other.base):] {
+		t.Errorf("shortening on separate instances: want same short path got %s and %s", first, third)
+	}
+}
+
+func TestDeterministicCollision(t *testing.T) {
+	f := serve(t, WithDeterministicKey(testDeterministicKey))
+	defer f.Close()
+
+	s := f.smallifier.(*smallifier)
+	normalized, _ := normalizeURL("https://lemurs.win/ringtails")
+	taken := s.deterministicCandidate(normalized, 0)
+	if _, err := f.db.Exec("INSERT INTO links (short_path, long_url, create_ts, create_ip) VALUES ($1, $2, $3, $4)", taken, "https://lemurs.win/other", time.Now().Unix(), "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	shortened := shorten(t, f.server.URL, "https://lemurs.win/ringtails")
+	if want := f.base + s.deterministicCandidate(normalized, 1); shortened != want {
+		t.Errorf("after collision: want %s got %s", want, shortened)
+	}
+}
+
+func TestDeterministicConcurrentCreates(t *testing.T) {
+	f := serve(t, WithDeterministicKey(testDeterministicKey))
+	defer f.Close()
+
+	s := f.smallifier.(*smallifier)
+	normalized, _ := normalizeURL("https://lemurs.win/ringtails")
+	want := s.deterministicCandidate(normalized, 0)
+
+	var wg sync.WaitGroup
+	paths := make([]string, 8)
+	errs := make([]error, len(paths))
+	for i := range paths {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			paths[i], _, errs[i] = s.deterministicShortPath(context.Background(), "https://lemurs.win/ringtails", "127.0.0.1", "")
+		}(i)
+	}
+	wg.Wait()
+	for i, got := range paths {
+		if errs[i] != nil {
+			t.Errorf("create %d: %v", i, errs[i])
+		} else if got != want {
+			t.Errorf("create %d: want short path %s got %s", i, want, got)
+		}
+	}
+}
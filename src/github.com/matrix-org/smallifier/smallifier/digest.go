@@ -0,0 +1,335 @@
+package smallifier
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// digestTopLinks is how many of the most-followed links are included in a Digest.
+	digestTopLinks = 5
+	// digestAttempts is how many times a scheduled digest is tried, digestRetryInterval apart, before it is given up on.
+	digestAttempts      = 3
+	digestRetryInterval = 5 * time.Minute
+)
+
+// Digest summarises the activity of a smallifier over a period, compared with the preceding period of the same length.
+type Digest struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// Tag, if set, restricts the digest to links with the tag.
+	Tag string `json:"tag,omitempty"`
+	// NewLinks is the number of links created during the period.
+	NewLinks int64 `json:"new_links"`
+	// TotalFollows is the number of follows of any link during the period.
+	TotalFollows int64 `json:"total_follows"`
+	// UniqueClients is the number of distinct clients, with IPv6 clients aggregated by prefix, which followed any link.
+	UniqueClients int64 `json:"unique_clients"`
+	// TopLinks are the most followed links during the period, most followed first.
+	TopLinks []LinkFollows `json:"top_links"`
+
+	// PreviousNewLinks, PreviousFollows and PreviousUniqueClients are the same counts for the preceding period.
+	PreviousNewLinks      int64 `json:"previous_new_links"`
+	PreviousFollows       int64 `json:"previous_follows"`
+	PreviousUniqueClients int64 `json:"previous_unique_clients"`
+}
+
+// LinkFollows is the number of times a link was followed.
+type LinkFollows struct {
+	ShortURL string `json:"short_url"`
+	LongURL  string `json:"long_url"`
+	Follows  int64  `json:"follows"`
+	// PreviousFollows is the number of times the link was followed in the preceding period.
+	// It is only set where periods are compared, such as in a Digest.
+	PreviousFollows int64 `json:"previous_follows,omitempty"`
+}
+
+// DigestSender delivers digests somewhere people will read them.
+type DigestSender interface {
+	SendDigest(ctx context.Context, d Digest) error
+}
+
+// MakeDigest summarises the links in db, whose short links start with base, created or followed in [start, end).
+func MakeDigest(ctx context.Context, db *sql.DB, base string, start, end time.Time) (Digest, error) {
+	return makeDigest(ctx, db, base, "", start, end)
+}
+
+// makeDigest is MakeDigest restricted to links with tag, if it is non-empty.
+func makeDigest(ctx context.Context, db *sql.DB, base, tag string, start, end time.Time) (Digest, error) {
+	d := Digest{Start: start, End: end, Tag: tag}
+	prevStart := start.Add(-end.Sub(start))
+	var err error
+	if d.NewLinks, err = countNewLinks(ctx, db, tag, start, end); err != nil {
+		return d, err
+	}
+	if d.PreviousNewLinks, err = countNewLinks(ctx, db, tag, prevStart, start); err != nil {
+		return d, err
+	}
+	if d.TotalFollows, d.UniqueClients, err = countFollows(ctx, db, tag, "", start, end); err != nil {
+		return d, err
+	}
+	if d.PreviousFollows, d.PreviousUniqueClients, err = countFollows(ctx, db, tag, "", prevStart, start); err != nil {
+		return d, err
+	}
+	if d.TopLinks, err = topLinks(ctx, db, base, tag, start, end, digestTopLinks); err != nil {
+		return d, err
+	}
+	for i := range d.TopLinks {
+		shortPath := d.TopLinks[i].ShortURL[len(base):]
+		if d.TopLinks[i].PreviousFollows, _, err = countFollows(ctx, db, "", shortPath, prevStart, start); err != nil {
+			return d, err
+		}
+	}
+	return d, nil
+}
+
+// countNewLinks counts the links, with tag if it is non-empty, created in [start, end).
+func countNewLinks(ctx context.Context, db *sql.DB, tag string, start, end time.Time) (int64, error) {
+	var n int64
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM links WHERE create_ts >= $1 AND create_ts < $2
+		AND ($3 = '' OR short_path IN (SELECT short_path FROM link_tags WHERE tag = $3))`, start.Unix(), end.Unix(), tag).Scan(&n)
+	return n, err
+}
+
+// countFollows counts the follows, and distinct clients following, in [start, end),
+// of links with tag if it is non-empty, and of the link at shortPath if it is non-empty.
+func countFollows(ctx context.Context, db *sql.DB, tag, shortPath string, start, end time.Time) (follows, clients int64, err error) {
+	err = db.QueryRowContext(ctx, `SELECT COUNT(*), COUNT(DISTINCT client_key) FROM follows WHERE ts >= $1 AND ts < $2
+		AND ($3 = '' OR short_path IN (SELECT short_path FROM link_tags WHERE tag = $3))
+		AND ($4 = '' OR short_path = $4)`, start.Unix(), end.Unix(), tag, shortPath).Scan(&follows, &clients)
+	return
+}
+
+// trend describes the change from previous to current, e.g. " (+50% on previous period)", or "" if there was nothing previously.
+func trend(current, previous int64) string {
+	if previous == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (%+.0f%% on previous period)", 100*float64(current-previous)/float64(previous))
+}
+
+// topLinks returns the limit links in db, whose short links start with base, most followed in [start, end).
+// If tag is non-empty, only links with the tag are included.
+func topLinks(ctx context.Context, db *sql.DB, base, tag string, start, end time.Time, limit int) ([]LinkFollows, error) {
+	rows, err := db.QueryContext(ctx, `SELECT follows.short_path, COALESCE(links.long_url, ''), COUNT(*) AS n FROM follows
+		LEFT JOIN links ON follows.short_path = links.short_path
+		WHERE follows.ts >= $1 AND follows.ts < $2
+		AND ($4 = '' OR follows.short_path IN (SELECT short_path FROM link_tags WHERE tag = $4))
+		GROUP BY follows.short_path ORDER BY n DESC, follows.short_path LIMIT $3`, start.Unix(), end.Unix(), limit, tag)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var top []LinkFollows
+	for rows.Next() {
+		var lf LinkFollows
+		if err := rows.Scan(&lf.ShortURL, &lf.LongURL, &lf.Follows); err != nil {
+			return nil, err
+		}
+		lf.ShortURL = base + lf.ShortURL
+		top = append(top, lf)
+	}
+	return top, rows.Err()
+}
+
+// Text renders the digest as plain text.
+func (d Digest) Text() string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Smallifier digest for %s to %s\n", d.Start.Format("2006-01-02"), d.End.Format("2006-01-02"))
+	fmt.Fprintf(&b, "New links: %d%s\nTotal clicks: %d%s\nUnique clients: %d%s\n",
+		d.NewLinks, trend(d.NewLinks, d.PreviousNewLinks),
+		d.TotalFollows, trend(d.TotalFollows, d.PreviousFollows),
+		d.UniqueClients, trend(d.UniqueClients, d.PreviousUniqueClients))
+	if len(d.TopLinks) > 0 {
+		b.WriteString("Top links:\n")
+		for _, l := range d.TopLinks {
+			fmt.Fprintf(&b, "  %s (%s): %d%s\n", l.ShortURL, l.LongURL, l.Follows, trend(l.Follows, l.PreviousFollows))
+		}
+	}
+	return b.String()
+}
+
+// HTML renders the digest as an HTML fragment.
+func (d Digest) HTML() string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<h4>Smallifier digest for %s to %s</h4>", d.Start.Format("2006-01-02"), d.End.Format("2006-01-02"))
+	fmt.Fprintf(&b, "<p>New links: %d%s<br>Total clicks: %d%s<br>Unique clients: %d%s</p>",
+		d.NewLinks, trend(d.NewLinks, d.PreviousNewLinks),
+		d.TotalFollows, trend(d.TotalFollows, d.PreviousFollows),
+		d.UniqueClients, trend(d.UniqueClients, d.PreviousUniqueClients))
+	if len(d.TopLinks) > 0 {
+		b.WriteString("<p>Top links:</p><ol>")
+		for _, l := range d.TopLinks {
+			fmt.Fprintf(&b, `<li><a href="%s">%s</a> (%s): %d%s</li>`, html.EscapeString(l.ShortURL), html.EscapeString(l.ShortURL), html.EscapeString(l.LongURL), l.Follows, trend(l.Follows, l.PreviousFollows))
+		}
+		b.WriteString("</ol>")
+	}
+	return b.String()
+}
+
+// WithDigests sends a Digest covering the preceding period to each sender at every time matched by schedule.
+// If the digest can't be made, it is retried a few times before that period's is given up on.
+func WithDigests(schedule *Schedule, period time.Duration, senders ...DigestSender) Option {
+	return func(s *smallifier) {
+		s.digestSchedule = schedule
+		s.digestPeriod = period
+		s.digestSenders = senders
+	}
+}
+
+// sendDigests sends digests as configured by WithDigests, on s.clock, until s.stop is closed.
+func (s *smallifier) sendDigests() {
+	defer s.background.Done()
+	for {
+		next := s.digestSchedule.Next(s.clock.Now())
+		if next.IsZero() {
+			log.Error("Digest schedule never matches, not sending digests")
+			return
+		}
+		select {
+		case <-s.clock.After(next.Sub(s.clock.Now())):
+		case <-s.stop:
+			return
+		}
+		if !s.sendDigest(next.Add(-s.digestPeriod), next) {
+			return
+		}
+	}
+}
+
+// sendDigest makes the digest of [start, end) and sends it to each of s.digestSenders, making it up to digestAttempts
+// times, digestRetryInterval apart. It returns false if s.stop was closed while it waited to try again.
+func (s *smallifier) sendDigest(start, end time.Time) bool {
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(s.ctx, time.Minute)
+		d, err := makeDigest(ctx, s.db, s.base.String(), "", start, end)
+		if err == nil {
+			for _, sender := range s.digestSenders {
+				if err := sender.SendDigest(ctx, d); err != nil {
+					log.WithField("err", err).Error("Error sending digest")
+				}
+			}
+			cancel()
+			return true
+		}
+		cancel()
+		fields := log.Fields{
+			"err":     err,
+			"start":   start,
+			"end":     end,
+			"attempt": attempt,
+		}
+		if attempt == digestAttempts {
+			log.WithFields(fields).Error("Error making digest, giving up on the period's")
+			return true
+		}
+		log.WithFields(fields).Warn("Error making digest, trying again")
+		select {
+		case <-s.clock.After(digestRetryInterval):
+		case <-s.stop:
+			return false
+		}
+	}
+}
+
+// MatrixDigestSender posts digests to a Matrix room.
+type MatrixDigestSender struct {
+	// Homeserver is the base URL of the homeserver's client-server API, e.g. https://matrix.org.
+	Homeserver string
+	// AccessToken is the access token of a user which is joined to RoomID.
+	AccessToken string
+	RoomID      string
+	Client      *http.Client
+}
+
+// SendDigest posts d to the room as an m.notice.
+func (m *MatrixDigestSender) SendDigest(ctx context.Context, d Digest) error {
+	return m.sendMessage(ctx, MatrixMessage{
+		MsgType:       "m.notice",
+		Body:          d.Text(),
+		Format:        "org.matrix.custom.html",
+		FormattedBody: d.HTML(),
+	})
+}
+
+func (m *MatrixDigestSender) sendMessage(ctx context.Context, msg MatrixMessage) error {
+	return sendMatrixMessage(ctx, m.Client, m.Homeserver, m.AccessToken, m.RoomID, msg)
+}
+
+// sendMatrixMessage sends msg to roomID as the user whose access token is accessToken.
+func sendMatrixMessage(ctx context.Context, client *http.Client, homeserver, accessToken, roomID string, msg MatrixMessage) error {
+	txnID := "smallifier" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	u := strings.TrimSuffix(homeserver, "/") + "/_matrix/client/r0/rooms/" + url.PathEscape(roomID) + "/send/m.room.message/" + txnID
+	return matrixRequest(ctx, client, accessToken, "PUT", u, msg, nil)
+}
+
+// matrixRequest makes a request to u, on a homeserver's client-server API, as the user whose access token is accessToken.
+// body is sent JSON-encoded if it is non-nil, and the response is decoded into v if it is non-nil.
+func matrixRequest(ctx context.Context, client *http.Client, accessToken, method, u string, body, v interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, u, r)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("sending Matrix request: homeserver responded with status %d", resp.StatusCode)
+	}
+	if v != nil {
+		return json.NewDecoder(resp.Body).Decode(v)
+	}
+	return nil
+}
+
+// EmailDigestSender emails digests over SMTP.
+type EmailDigestSender struct {
+	// Addr is the host:port of the SMTP server.
+	Addr string
+	// Auth is used to authenticate to the SMTP server, if non-nil.
+	Auth smtp.Auth
+	From string
+	To   []string
+}
+
+// SendDigest emails d as plain text.
+func (e *EmailDigestSender) SendDigest(ctx context.Context, d Digest) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", e.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(e.To, ", "))
+	fmt.Fprintf(&msg, "Subject: Smallifier digest for %s to %s\r\n", d.Start.Format("2006-01-02"), d.End.Format("2006-01-02"))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(d.Text(), "\n", "\r\n", -1))
+	return smtp.SendMail(e.Addr, e.Auth, e.From, e.To, msg.Bytes())
+}
@@ -0,0 +1,138 @@
+package smallifier
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMakeDigest(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	popular := shorten(t, f.server.URL, f.server.URL+"/_stub")
+	shorten(t, f.server.URL, "https://lemurs.win")
+	for i := 0; i < 2; i++ {
+		resp, err := insecureClient().Get(popular)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	assertFollowCount(f, popular[len(f.base):], 2, "before digest:")
+
+	now := time.Now()
+	d, err := MakeDigest(context.Background(), f.db, f.base, now.Add(-time.Hour), now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.NewLinks != 2 || d.TotalFollows != 2 || d.UniqueClients != 1 {
+		t.Errorf("want 2 new links, 2 follows and 1 client got %d, %d and %d", d.NewLinks, d.TotalFollows, d.UniqueClients)
+	}
+	if len(d.TopLinks) != 1 || d.TopLinks[0].ShortURL != popular || d.TopLinks[0].Follows != 2 {
+		t.Errorf("top links: want %s followed twice got %+v", popular, d.TopLinks)
+	}
+}
+
+func TestTrends(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	link := shortenTagged(t, f, f.server.URL+"/_stub", "spring")
+	shorten(t, f.server.URL, "https://lemurs.win")
+	now := time.Now()
+	for _, ts := range []time.Time{now.Add(-30 * time.Hour), now.Add(-2 * time.Hour), now.Add(-time.Hour)} {
+		if _, err := f.db.Exec(`INSERT INTO follows (short_path, ts, ip, client_key) VALUES ($1, $2, '127.0.0.1', '127.0.0.1')`, link[len(f.base):], ts.Unix()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var d Digest
+	decodeAdminResponse(t, f, "GET", "trends?period=24h&tag=spring", &d)
+	if d.Tag != "spring" || d.NewLinks != 1 || d.TotalFollows != 2 || d.PreviousFollows != 1 {
+		t.Errorf("want 1 new link and 2 follows, up from 1, got %+v", d)
+	}
+	if len(d.TopLinks) != 1 || d.TopLinks[0].ShortURL != link || d.TopLinks[0].PreviousFollows != 1 {
+		t.Errorf("top links: want %s previously followed once got %+v", link, d.TopLinks)
+	}
+	if want := "Total clicks: 2 (+100% on previous period)"; !strings.Contains(d.Text(), want) {
+		t.Errorf("text: want %q in %q", want, d.Text())
+	}
+}
+
+func TestMatrixDigestSender(t *testing.T) {
+	var gotPath, gotAuth string
+	var gotMsg MatrixMessage
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotPath = req.URL.EscapedPath()
+		gotAuth = req.Header.Get("Authorization")
+		json.NewDecoder(req.Body).Decode(&gotMsg)
+		w.Write([]byte(`{"event_id": "$lemur"}`))
+	}))
+	defer hs.Close()
+
+	sender := &MatrixDigestSender{Homeserver: hs.URL, AccessToken: "token", RoomID: "!room:lemurs.win"}
+	if err := sender.SendDigest(context.Background(), Digest{NewLinks: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "/_matrix/client/r0/rooms/%21room:lemurs.win/send/m.room.message/"; !strings.HasPrefix(gotPath, want) {
+		t.Errorf("path: want prefix %q got %q", want, gotPath)
+	}
+	if gotAuth != "Bearer token" {
+		t.Errorf("authorization: want %q got %q", "Bearer token", gotAuth)
+	}
+	if !strings.Contains(gotMsg.Body, "New links: 3") {
+		t.Errorf("body: want new link count got %q", gotMsg.Body)
+	}
+}
+
+// chanDigestSender sends digests on a channel.
+type chanDigestSender chan Digest
+
+func (c chanDigestSender) SendDigest(ctx context.Context, d Digest) error {
+	c <- d
+	return nil
+}
+
+func TestScheduledDigestRetries(t *testing.T) {
+	clock := newFakeClock()
+	schedule, err := ParseSchedule("0 * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := make(chanDigestSender, 1)
+	f := serve(t, WithClock(clock), WithDigests(schedule, time.Hour, sent))
+	defer f.Close()
+
+	// The digest and scheduled updates both wait on the clock.
+	const loops = 2
+	clock.waitForWaiters(loops)
+	if _, err := f.db.Exec(`ALTER TABLE follows RENAME TO follows_unavailable`); err != nil {
+		t.Fatal(err)
+	}
+	end := schedule.Next(clock.Now())
+	clock.advance(end.Sub(clock.Now()))
+	// Making the digest fails, so it is tried again rather than the period's being lost.
+	clock.waitForWaiters(loops)
+	select {
+	case d := <-sent:
+		t.Fatalf("want no digest while follows can't be counted got %+v", d)
+	default:
+	}
+	if _, err := f.db.Exec(`ALTER TABLE follows_unavailable RENAME TO follows`); err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(digestRetryInterval)
+	select {
+	case d := <-sent:
+		if !d.End.Equal(end) || !d.Start.Equal(end.Add(-time.Hour)) {
+			t.Errorf("want digest of the hour to %s got %s to %s", end, d.Start, d.End)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("want digest sent on retry got none")
+	}
+}
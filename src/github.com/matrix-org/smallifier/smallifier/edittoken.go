@@ -0,0 +1,102 @@
+package smallifier
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// addEditToken generates a token with which the link at shortPath can be deleted without the secret.
+// Only a hash of the token is stored, so it can't be recovered from the database.
+func (s *smallifier) addEditToken(ctx context.Context, shortPath string) (string, error) {
+	token, err := s.generateSecret()
+	if err != nil {
+		return "", err
+	}
+	_, err = s.db.ExecContext(ctx, `UPDATE links SET edit_token_hash = $1 WHERE short_path = $2`, hashEditToken(token), shortPath)
+	return token, err
+}
+
+// authorizeChange reports whether the link at shortPath may be changed by a request carrying secret, which may be the
+// server's secret or an API key, or editToken. API keys may only change links created with them.
+// If it may not, it writes an error response explaining why.
+func (s *smallifier) authorizeChange(ctx context.Context, w http.ResponseWriter, shortPath, secret, editToken string) bool {
+	owner, ok, err := s.authenticateCreator(ctx, secret)
+	if err != nil {
+		writeLookupError(w, err)
+		return false
+	}
+	if ok && owner == "" {
+		return true
+	}
+	if ok {
+		linkOwner, err := s.linkOwner(ctx, shortPath)
+		if err != nil {
+			writeLookupError(w, err)
+			return false
+		}
+		if linkOwner == owner {
+			return true
+		}
+		atomic.AddUint64(&s.authErrorCount, 1)
+		log.WithFields(log.Fields{
+			"short_path": shortPath,
+			"owner":      owner,
+		}).Error("Refusing to change link created with another API key")
+		writeError(w, 403, ErrCodeForbidden, "Links can only be changed with the API key they were created with")
+		return false
+	}
+	if editToken != "" {
+		ok, err := s.checkEditToken(ctx, shortPath, editToken)
+		if err != nil {
+			writeLookupError(w, err)
+			return false
+		}
+		if ok {
+			return true
+		}
+	}
+	atomic.AddUint64(&s.authErrorCount, 1)
+	log.WithField("short_path", shortPath).Error("Refusing to change link with wrong secret or edit token")
+	writeError(w, 401, ErrCodeUnauthorized, "Must specify correct secret or edit token")
+	return false
+}
+
+// checkEditToken reports whether token is the edit token of the link at shortPath.
+func (s *smallifier) checkEditToken(ctx context.Context, shortPath, token string) (bool, error) {
+	var hash sql.NullString
+	err := s.db.QueryRowContext(ctx, `SELECT edit_token_hash FROM links WHERE short_path = $1`, shortPath).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil || !hash.Valid {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare([]byte(hash.String), []byte(hashEditToken(token))) == 1, nil
+}
+
+func hashEditToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// describeLink fills in the fields of resp which describe the link at shortPath.
+func (s *smallifier) describeLink(ctx context.Context, shortPath string, resp *Response) error {
+	resp.ShortPath = shortPath
+	resp.ShortURL = s.base.String() + shortPath
+	var owner sql.NullString
+	if err := s.db.QueryRowContext(ctx, `SELECT create_ts, owner FROM links WHERE short_path = $1`, shortPath).Scan(&resp.CreatedTS, &owner); err != nil {
+		return err
+	}
+	resp.Owner = owner.String
+	if s.expiryDays > 0 {
+		resp.ExpiresTS = resp.CreatedTS + int64(s.expiryDays)*24*60*60
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package smallifier
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func create(t *testing.T, f fixture, body string) Response {
+	resp, err := insecureClient().Post(f.server.URL+"/_create", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var r Response
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestCreateResponse(t *testing.T) {
+	f := serve(t, WithUnfollowedExpiry(30))
+	defer f.Close()
+
+	before := time.Now().Unix()
+	r := create(t, f, `{"long_url": "`+f.server.URL+`/_stub", "secret": "`+testSecret+`"}`)
+	if r.ShortURL != f.base+r.ShortPath || r.ShortPath == "" {
+		t.Errorf("want short URL %s%s got %s", f.base, r.ShortPath, r.ShortURL)
+	}
+	if r.CreatedTS < before || r.CreatedTS > time.Now().Unix() {
+		t.Errorf("want created_ts around %d got %d", before, r.CreatedTS)
+	}
+	if r.ExpiresTS != r.CreatedTS+30*24*60*60 {
+		t.Errorf("want expires_ts 30 days after %d got %d", r.CreatedTS, r.ExpiresTS)
+	}
+	if r.EditToken == "" {
+		t.Error("want an edit token")
+	}
+}
+
+func TestDeleteWithEditToken(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	first := create(t, f, `{"long_url": "`+f.server.URL+`/_stub", "secret": "`+testSecret+`"}`)
+	second := create(t, f, `{"long_url": "`+f.server.URL+`/_stub", "secret": "`+testSecret+`"}`)
+	for _, tc := range []struct {
+		shortPath, token string
+		want             int
+	}{
+		{first.ShortPath, second.EditToken, 401},
+		{first.ShortPath, "", 401},
+		{"missing1", first.EditToken, 401},
+		{first.ShortPath, first.EditToken, 200},
+	} {
+		body, _ := json.Marshal(DeleteRequest{ShortPath: tc.shortPath, EditToken: tc.token})
+		resp, err := insecureClient().Post(f.server.URL+"/_delete", "application/json", strings.NewReader(string(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("deleting %s with token %q: want status code %d got %d", tc.shortPath, tc.token, tc.want, resp.StatusCode)
+		}
+	}
+	resp, err := insecureClient().Get(first.ShortURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 410 {
+		t.Errorf("following deleted link: want status code 410 got %d", resp.StatusCode)
+	}
+}
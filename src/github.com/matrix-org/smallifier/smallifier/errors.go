@@ -0,0 +1,140 @@
+package smallifier
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// ErrCode identifies the kind of error an error response reports, so that clients can handle it without parsing its
+// message. Codes follow the Matrix client-server API: its own where one fits, and ones namespaced under
+// ORG.MATRIX.SMALLIFIER otherwise.
+type ErrCode string
+
+const (
+	// ErrCodeNotJSON is returned when the body of a request isn't valid JSON of the expected shape.
+	ErrCodeNotJSON ErrCode = "M_NOT_JSON"
+	// ErrCodeMissingParam is returned when a request doesn't specify something it must.
+	ErrCodeMissingParam ErrCode = "M_MISSING_PARAM"
+	// ErrCodeInvalidParam is returned when something a request specifies isn't acceptable, e.g. a long URL with a
+	// scheme which isn't allowed.
+	ErrCodeInvalidParam ErrCode = "M_INVALID_PARAM"
+	// ErrCodeUnauthorized is returned when a request doesn't carry a secret, API key or token which is accepted.
+	ErrCodeUnauthorized ErrCode = "M_UNAUTHORIZED"
+	// ErrCodeForbidden is returned when a request is authenticated, but not allowed to do what it asks.
+	ErrCodeForbidden ErrCode = "M_FORBIDDEN"
+	// ErrCodeNotFound is returned when a link, or whatever else a request names, doesn't exist.
+	ErrCodeNotFound ErrCode = "M_NOT_FOUND"
+	// ErrCodeUnrecognized is returned when a request is made to an endpoint which doesn't exist, or with a method it
+	// doesn't support.
+	ErrCodeUnrecognized ErrCode = "M_UNRECOGNIZED"
+	// ErrCodeTooLarge is returned when a request asks for more than may be done at once.
+	ErrCodeTooLarge ErrCode = "M_TOO_LARGE"
+	// ErrCodeLimitExceeded is returned when a client has made too many requests. Its responses say when to retry.
+	ErrCodeLimitExceeded ErrCode = "M_LIMIT_EXCEEDED"
+	// ErrCodeUnknown is returned when a request fails because of a problem with the server.
+	ErrCodeUnknown ErrCode = "M_UNKNOWN"
+	// ErrCodeInUse is returned when a short path asked for is, or has been, used by another link.
+	ErrCodeInUse ErrCode = "ORG.MATRIX.SMALLIFIER.IN_USE"
+	// ErrCodeGone is returned when a link has been deleted or disabled.
+	ErrCodeGone ErrCode = "ORG.MATRIX.SMALLIFIER.GONE"
+	// ErrCodeUnavailable is returned when a request fails for a transient reason, or something the server depends on
+	// couldn't be reached. Responses to requests which may be retried say when to.
+	ErrCodeUnavailable ErrCode = "ORG.MATRIX.SMALLIFIER.UNAVAILABLE"
+	// ErrCodeTimeout is returned when a request's deadline passes before it is handled.
+	ErrCodeTimeout ErrCode = "ORG.MATRIX.SMALLIFIER.TIMEOUT"
+	// ErrCodeCanceled is returned when the client goes away before its request is handled, so is only seen in logs.
+	ErrCodeCanceled ErrCode = "ORG.MATRIX.SMALLIFIER.CANCELED"
+	// ErrCodeLinkLimit is returned when a link isn't created because as many links are stored as WithLinkLimits allows,
+	// in all or in its namespace. Retrying won't help until links are deleted or the limit is raised.
+	ErrCodeLinkLimit ErrCode = "ORG.MATRIX.SMALLIFIER.LINK_LIMIT"
+	// ErrCodeReadOnly is returned when a link isn't created or changed because the server is read-only for a while,
+	// e.g. during a database migration. Its responses say when to retry.
+	ErrCodeReadOnly ErrCode = "ORG.MATRIX.SMALLIFIER.READ_ONLY"
+	// ErrCodeMaintenance is returned for every request but those to the admin API while the server is down for
+	// maintenance. Its responses say when to retry.
+	ErrCodeMaintenance ErrCode = "ORG.MATRIX.SMALLIFIER.MAINTENANCE"
+)
+
+// ErrorResponse is the JSON-encoded body of every error response, e.g. {"errcode": "M_NOT_FOUND", "error": "link not found"}.
+type ErrorResponse struct {
+	ErrCode ErrCode `json:"errcode"`
+	Message string  `json:"error"`
+	// Retryable is whether the request may succeed if it is made again.
+	Retryable bool `json:"retryable,omitempty"`
+	// Status is the HTTP status the error is responded with.
+	Status int `json:"-"`
+}
+
+func newErrorResponse(status int, code ErrCode, msg string) *ErrorResponse {
+	return &ErrorResponse{ErrCode: code, Message: msg, Status: status}
+}
+
+func (e *ErrorResponse) Error() string {
+	return string(e.ErrCode) + ": " + e.Message
+}
+
+// writeError responds to a request with status and an ErrorResponse with code and msg.
+func writeError(w http.ResponseWriter, status int, code ErrCode, msg string) {
+	writeErrorResponse(w, status, ErrorResponse{ErrCode: code, Message: msg})
+}
+
+func writeErrorResponse(w http.ResponseWriter, status int, e ErrorResponse) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(e)
+}
+
+// writeErr responds to a request with err, which is sent with its status if it is an *ErrorResponse, and as an
+// internal server error otherwise. Transient errors tell the client when to retry with a Retry-After header.
+func writeErr(w http.ResponseWriter, err error) {
+	e, ok := err.(*ErrorResponse)
+	if !ok {
+		e = newErrorResponse(500, ErrCodeUnknown, err.Error())
+	}
+	if e.Retryable && e.Status == 503 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)))
+	}
+	writeErrorResponse(w, e.Status, *e)
+}
+
+// lookupError returns the *ErrorResponse for err, returned by looking up a link, mapping sql.ErrNoRows to a 404.
+func lookupError(err error) *ErrorResponse {
+	if err == sql.ErrNoRows {
+		return newErrorResponse(404, ErrCodeNotFound, "link not found")
+	}
+	if e := contextError(err); e != nil {
+		return e
+	}
+	log.Error("Unknown DB error: ", err)
+	return newErrorResponse(500, ErrCodeUnknown, "internal server error")
+}
+
+// contextError returns the *ErrorResponse for err if it is from the request's context ending, or nil if it isn't:
+// a timeout if its deadline passed, or 499 if the client went away, which isn't logged as it is no fault of ours.
+func contextError(err error) *ErrorResponse {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return timeoutError()
+	case errors.Is(err, context.Canceled):
+		return newErrorResponse(499, ErrCodeCanceled, "request canceled")
+	}
+	return nil
+}
+
+// timeoutError is the *ErrorResponse for a request whose deadline passed before it could be handled.
+func timeoutError() *ErrorResponse {
+	return newErrorResponse(504, ErrCodeTimeout, "request timed out")
+}
+
+// transientErrorResponse is the *ErrorResponse for a request which failed for a transient reason, explained by msg.
+func transientErrorResponse(msg string) *ErrorResponse {
+	e := newErrorResponse(503, ErrCodeUnavailable, msg)
+	e.Retryable = true
+	return e
+}
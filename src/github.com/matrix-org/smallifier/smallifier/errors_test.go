@@ -0,0 +1,102 @@
+package smallifier
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestErrorResponses(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	post := func(path, body string) *http.Response {
+		resp, err := insecureClient().Post(f.server.URL+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	get := func(path string) *http.Response {
+		resp, err := insecureClient().Get(f.server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	taken := create(t, f, `{"long_url": "https://lemurs.win/", "short_path": "taken-alias", "secret": "`+testSecret+`"}`)
+	if taken.ShortURL == "" {
+		t.Fatal("want alias created got none")
+	}
+
+	for _, tt := range []struct {
+		name   string
+		resp   *http.Response
+		status int
+		code   ErrCode
+	}{
+		{"bad json", post("/_create", `{`), 400, ErrCodeNotJSON},
+		{"wrong secret", post("/_create", `{"long_url": "https://lemurs.win/", "secret": "wrong"}`), 401, ErrCodeUnauthorized},
+		{"bad scheme", post("/_create", `{"long_url": "ftp://lemurs.win/", "secret": "`+testSecret+`"}`), 400, ErrCodeInvalidParam},
+		{"alias taken", post("/_create", `{"long_url": "https://lemurs.win/", "short_path": "taken-alias", "secret": "`+testSecret+`"}`), 409, ErrCodeInUse},
+		{"unknown link", get("/AAAAAAAA"), 404, ErrCodeNotFound},
+		{"unknown admin endpoint", adminRequest(t, f, "GET", "nonsense", testSecret), 404, ErrCodeUnrecognized},
+	} {
+		var e ErrorResponse
+		if err := json.NewDecoder(tt.resp.Body).Decode(&e); err != nil {
+			t.Errorf("%s: decoding error response: %v", tt.name, err)
+		}
+		tt.resp.Body.Close()
+		if tt.resp.StatusCode != tt.status || e.ErrCode != tt.code || e.Message == "" {
+			t.Errorf("%s: want %d %s got %d %+v", tt.name, tt.status, tt.code, tt.resp.StatusCode, e)
+		}
+	}
+}
+
+func TestCreateBodySize(t *testing.T) {
+	f := serve(t, WithMaxCreateBodySize(100))
+	defer f.Close()
+
+	body := `{"long_url": "https://lemurs.win/` + strings.Repeat("a", 100) + `", "secret": "` + testSecret + `"}`
+	resp, err := insecureClient().Post(f.server.URL+"/_create", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var e ErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 413 || e.ErrCode != ErrCodeTooLarge {
+		t.Errorf("want 413 %s got %d %+v", ErrCodeTooLarge, resp.StatusCode, e)
+	}
+
+	if got := create(t, f, `{"long_url": "https://lemurs.win/", "secret": "`+testSecret+`"}`); got.ShortURL == "" {
+		t.Error("small body: want link created got none")
+	}
+}
+
+func TestContextError(t *testing.T) {
+	for _, tt := range []struct {
+		err    error
+		status int
+	}{
+		{context.DeadlineExceeded, 504},
+		{fmt.Errorf("querying: %w", context.DeadlineExceeded), 504},
+		{context.Canceled, 499},
+		{errors.New("disk I/O error"), 0},
+		{nil, 0},
+	} {
+		status := 0
+		if e := contextError(tt.err); e != nil {
+			status = e.Status
+		}
+		if status != tt.status {
+			t.Errorf("%v: want status %d got %d", tt.err, tt.status, status)
+		}
+	}
+}
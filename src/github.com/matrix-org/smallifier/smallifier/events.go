@@ -0,0 +1,213 @@
+package smallifier
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Types of Events.
+const (
+	EventCreate = "create"
+	EventFollow = "follow"
+)
+
+const (
+	// maxPendingEvents is the most events which may wait to be delivered to an event webhook before more are dropped.
+	maxPendingEvents = 10000
+	// maxEventsPerWebhook is the most events sent in a single event webhook request.
+	maxEventsPerWebhook = 100
+	// eventWebhookAttempts is how many times delivery of events is attempted before they are dropped, and
+	// eventRetryDelay how long is waited before the first retry, doubling before each after.
+	eventWebhookAttempts = 5
+	eventRetryDelay      = time.Second
+)
+
+// Event is something which happened to a link, as delivered to event webhooks.
+type Event struct {
+	// Type is EventCreate or EventFollow.
+	Type     string `json:"type"`
+	ShortURL string `json:"short_url"`
+	// LongURL is where the link led when it was created; it is only set for EventCreate.
+	LongURL string `json:"long_url,omitempty"`
+	TS      int64  `json:"ts"`
+}
+
+// EventBatch is the JSON-encoded body POSTed to an event webhook, signed like click webhooks.
+type EventBatch struct {
+	Events []Event `json:"events"`
+}
+
+// EventWebhook is a webhook to which events of every link are POSTed, for downstream systems, such as analytics or
+// abuse review, to react to.
+type EventWebhook struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+	// Events are the types of events delivered, by default all of them.
+	Events []string `json:"events,omitempty"`
+}
+
+// ParseEventWebhooks reads EventWebhooks from a JSON array, e.g.
+//
+//	[{"url": "https://abuse.example.org/smallifier", "secret": "...", "events": ["create"]}]
+func ParseEventWebhooks(r io.Reader) ([]EventWebhook, error) {
+	var hooks []EventWebhook
+	if err := json.NewDecoder(r).Decode(&hooks); err != nil {
+		return nil, err
+	}
+	for _, h := range hooks {
+		if !strings.HasPrefix(h.URL, "https://") {
+			return nil, errors.New("Event webhooks must have a url starting with https://")
+		}
+		if h.Secret == "" {
+			return nil, fmt.Errorf("%s: event webhooks must have a secret", h.URL)
+		}
+		for _, e := range h.Events {
+			if e != EventCreate && e != EventFollow {
+				return nil, fmt.Errorf("%s: unknown event %q", h.URL, e)
+			}
+		}
+	}
+	return hooks, nil
+}
+
+// WithEventWebhooks POSTs EventBatches to hooks as links are created and followed. Follows are only delivered once
+// they have been written to the database, so not with WithAnalytics(AnalyticsMemory) or AnalyticsNone.
+// Deliveries which fail are retried with exponential backoff, then logged and counted in WebhookErrors.
+func WithEventWebhooks(hooks []EventWebhook) Option {
+	return func(s *smallifier) {
+		for _, h := range hooks {
+			s.eventHooks = append(s.eventHooks, &eventHook{EventWebhook: h, ready: make(chan struct{}, 1)})
+		}
+	}
+}
+
+// eventHook holds the events waiting to be delivered to an EventWebhook.
+type eventHook struct {
+	EventWebhook
+	mu      sync.Mutex
+	pending []Event
+	// ready receives a value when an event is queued, to wake the goroutine delivering them.
+	ready chan struct{}
+}
+
+// wants reports whether events of type t are delivered to h.
+func (h *eventHook) wants(t string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
+
+// take removes up to maxEventsPerWebhook of the events queued first.
+func (h *eventHook) take() []Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := len(h.pending)
+	if n > maxEventsPerWebhook {
+		n = maxEventsPerWebhook
+	}
+	events := h.pending[:n:n]
+	h.pending = h.pending[n:]
+	if len(h.pending) == 0 {
+		h.pending = nil
+	}
+	return events
+}
+
+// queueEvent queues e for delivery to each event webhook which wants it, dropping it for those with too many waiting.
+func (s *smallifier) queueEvent(e Event) {
+	for _, h := range s.eventHooks {
+		if !h.wants(e.Type) {
+			continue
+		}
+		h.mu.Lock()
+		full := len(h.pending) >= maxPendingEvents
+		if !full {
+			h.pending = append(h.pending, e)
+		}
+		h.mu.Unlock()
+		if full {
+			log.WithFields(log.Fields{
+				"url":  h.URL,
+				"type": e.Type,
+			}).Error("Dropping event for event webhook with too many pending")
+			atomic.AddUint64(&s.webhookErrorCount, 1)
+			continue
+		}
+		select {
+		case h.ready <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// linkCreated counts the new link at shortPath to longURL against WithLinkLimits, and queues an EventCreate for it.
+func (s *smallifier) linkCreated(shortPath, longURL string) {
+	s.countLinkStored(longURL)
+	s.queueEvent(Event{Type: EventCreate, ShortURL: s.base.String() + shortPath, LongURL: longURL, TS: s.clock.Now().Unix()})
+}
+
+// deliverEvents delivers the events queued for h as they are queued, until s.stop is closed, after which it makes a
+// last attempt to deliver those still waiting.
+func (s *smallifier) deliverEvents(h *eventHook) {
+	defer s.background.Done()
+	for {
+		select {
+		case <-h.ready:
+			for events := h.take(); len(events) > 0; events = h.take() {
+				s.postEvents(h, events)
+			}
+		case <-s.stop:
+			for events := h.take(); len(events) > 0; events = h.take() {
+				s.postEvents(h, events)
+			}
+			return
+		}
+	}
+}
+
+// postEvents delivers events to h, retrying with exponential backoff until eventWebhookAttempts have been made.
+// Once s.stop has been closed, it retries at most once more, without waiting.
+func (s *smallifier) postEvents(h *eventHook, events []Event) {
+	delay := eventRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := s.postWebhook(context.Background(), h.URL, h.Secret, EventBatch{events})
+		if err == nil {
+			return
+		}
+		if attempt == eventWebhookAttempts {
+			log.WithFields(log.Fields{
+				"err":    err,
+				"url":    h.URL,
+				"events": len(events),
+			}).Error("Error delivering event webhook")
+			atomic.AddUint64(&s.webhookErrorCount, 1)
+			return
+		}
+		log.WithFields(log.Fields{
+			"err":     err,
+			"url":     h.URL,
+			"attempt": attempt,
+		}).Warn("Error delivering event webhook; retrying")
+		select {
+		case <-time.After(delay):
+		case <-s.stop:
+			attempt = eventWebhookAttempts - 1
+		}
+		delay *= 2
+	}
+}
@@ -0,0 +1,77 @@
+package smallifier
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEventWebhooks(t *testing.T) {
+	var requests int32
+	events := make(chan Event, 10)
+	hook := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// The first delivery fails, so is retried.
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(503)
+			return
+		}
+		b, _ := ioutil.ReadAll(req.Body)
+		if want := Sign("hunter2", b); !hmac.Equal([]byte(want), []byte(req.Header.Get(SignatureHeader))) {
+			t.Errorf("signature: want %q got %q", want, req.Header.Get(SignatureHeader))
+		}
+		var batch EventBatch
+		if err := json.Unmarshal(b, &batch); err != nil {
+			t.Error(err)
+		}
+		for _, e := range batch.Events {
+			events <- e
+		}
+	}))
+	defer hook.Close()
+
+	f := serve(t, WithWebhookClient(insecureClient()), WithEventWebhooks([]EventWebhook{{URL: hook.URL, Secret: "hunter2"}}))
+	defer f.Close()
+
+	shortened := shorten(t, f.server.URL, f.server.URL+"/_stub")
+	resp, err := insecureClient().Get(shortened)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	for _, want := range []Event{
+		{Type: EventCreate, ShortURL: shortened, LongURL: f.server.URL + "/_stub"},
+		{Type: EventFollow, ShortURL: shortened},
+	} {
+		select {
+		case e := <-events:
+			if e.Type != want.Type || e.ShortURL != want.ShortURL || e.LongURL != want.LongURL || e.TS == 0 {
+				t.Errorf("want %+v got %+v", want, e)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for %s event", want.Type)
+		}
+	}
+}
+
+func TestParseEventWebhooks(t *testing.T) {
+	hooks, err := ParseEventWebhooks(strings.NewReader(`[{"url": "https://example.org/hook", "secret": "s", "events": ["create"]}]`))
+	if err != nil || len(hooks) != 1 || hooks[0].URL != "https://example.org/hook" || len(hooks[0].Events) != 1 {
+		t.Errorf("want one webhook for create events got %+v (%v)", hooks, err)
+	}
+	for _, bad := range []string{
+		`[{"url": "http://example.org/hook", "secret": "s"}]`,
+		`[{"url": "https://example.org/hook"}]`,
+		`[{"url": "https://example.org/hook", "secret": "s", "events": ["delete"]}]`,
+	} {
+		if _, err := ParseEventWebhooks(strings.NewReader(bad)); err == nil {
+			t.Errorf("%s: want error got none", bad)
+		}
+	}
+}
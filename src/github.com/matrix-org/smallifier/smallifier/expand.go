@@ -0,0 +1,180 @@
+package smallifier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// maxExpandURLs is the most URLs a single ExpandRequest may expand.
+	maxExpandURLs = 100
+	// defaultExpandMaxHops is how many redirects are followed when expanding URLs, unless WithRedirectResolution was given.
+	defaultExpandMaxHops = 10
+	// expandedFromAnnotation is the key of the annotation recording the URL a link was expanded from.
+	expandedFromAnnotation = "expanded_from"
+)
+
+// ExpandRequest is the JSON-encoded body of an admin request to expand links on other shorteners, such as bit.ly or t.co,
+// and create links to where they lead, for moving content off third-party shorteners.
+type ExpandRequest struct {
+	URLs []string `json:"urls"`
+	// Tags are attached to each link created.
+	Tags []string `json:"tags,omitempty"`
+	// DryRun reports where each URL leads without creating any links.
+	DryRun bool `json:"dry_run"`
+}
+
+// ExpandResponse is the JSON-encoded response to an ExpandRequest, with an ExpandedLink for each of its URLs, in order.
+type ExpandResponse struct {
+	Links   []ExpandedLink `json:"links"`
+	Summary BatchSummary   `json:"summary"`
+	DryRun  bool           `json:"dry_run"`
+}
+
+// ExpandedLink is the result of expanding one URL. Links created record the URL in an "expanded_from" annotation.
+// Its BatchItem says why URL couldn't be expanded or a link to it created, if it couldn't.
+type ExpandedLink struct {
+	BatchItem
+	URL string `json:"url"`
+	// LongURL is where URL finally redirects to.
+	LongURL  string `json:"long_url,omitempty"`
+	ShortURL string `json:"short_url,omitempty"`
+}
+
+// checkExpandRequest returns an error describing why r can't be carried out, or nil if it can.
+func checkExpandRequest(r ExpandRequest) error {
+	if len(r.URLs) == 0 || len(r.URLs) > maxExpandURLs {
+		return fmt.Errorf("Must specify between 1 and %d urls", maxExpandURLs)
+	}
+	return checkTags(r.Tags)
+}
+
+// expand resolves each of r's URLs and, unless it is a dry run, creates a link to where it leads.
+// Failures to expand particular URLs are reported in their ExpandedLinks, and don't stop the others being expanded.
+func (s *smallifier) expand(ctx context.Context, r ExpandRequest) ExpandResponse {
+	resp := ExpandResponse{Links: []ExpandedLink{}, DryRun: r.DryRun}
+	for _, u := range r.URLs {
+		l := ExpandedLink{BatchItem: batchSuccess, URL: u}
+		var err error
+		if err = checkExpandURL(u); err != nil {
+			l.BatchItem = batchFailure(400, BatchErrorInvalid, err)
+		} else if l.LongURL, err = s.resolveRedirects(ctx, u); err != nil {
+			l.BatchItem = batchFailure(502, BatchErrorUnreachable, err)
+		} else if err = s.longURLError(l.LongURL); err != nil {
+			l.BatchItem = batchFailure(400, BatchErrorInvalid, err)
+		} else if !r.DryRun {
+			if l.ShortURL, err = s.createExpandedLink(ctx, u, l.LongURL, r.Tags); err != nil {
+				if e, ok := err.(*ErrorResponse); ok && e.ErrCode == ErrCodeLinkLimit {
+					l.BatchItem = batchFailure(e.Status, BatchErrorLimited, err)
+				} else {
+					l.BatchItem = batchFailure(500, BatchErrorInternal, err)
+				}
+			}
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+				"url": u,
+			}).Info("Couldn't expand link")
+		}
+		resp.Links = append(resp.Links, l)
+		resp.Summary.add(l.BatchItem)
+	}
+	return resp
+}
+
+// checkExpandURL returns an error describing why u can't be expanded, or nil if it can be tried.
+func checkExpandURL(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme != "https" && parsed.Scheme != "http" {
+		return errors.New("Only http and https URLs can be expanded")
+	}
+	return nil
+}
+
+// resolveRedirects follows the redirects from link, up to the limit given to WithRedirectResolution, or
+// defaultExpandMaxHops, returning where they end up.
+func (s *smallifier) resolveRedirects(ctx context.Context, link string) (string, error) {
+	client, maxHops := s.resolveClient, s.resolveMaxHops
+	if client == nil {
+		c := *s.webhookClient
+		c.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+		client, maxHops = &c, defaultExpandMaxHops
+	}
+	for i := 0; i <= maxHops; i++ {
+		if err := checkExpandURL(link); err != nil {
+			return "", err
+		}
+		req, err := http.NewRequest("GET", link, nil)
+		if err != nil {
+			return "", err
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 3 {
+			return link, nil
+		}
+		next, err := resp.Location()
+		if err != nil {
+			return "", err
+		}
+		link = next.String()
+	}
+	return "", fmt.Errorf("Redirects more than %d times", maxHops)
+}
+
+// createExpandedLink creates a link to longURL, tagged with tags, recording that it was expanded from u.
+// If WithDedupe was given, an existing link to longURL is annotated and returned instead.
+func (s *smallifier) createExpandedLink(ctx context.Context, u, longURL string, tags []string) (string, error) {
+	if err := s.checkWritable(); err != nil {
+		return "", err
+	}
+	if err := s.checkLinkLimits(longURL); err != nil {
+		return "", err
+	}
+	var shortPath string
+	created := true
+	var err error
+	if s.dedupe {
+		shortPath, created, err = s.dedupedShortPath(ctx, longURL, "", "")
+	} else {
+		shortPath, err = s.generateShortPath(ctx, longURL, "", "")
+	}
+	if err != nil {
+		return "", err
+	}
+	if err = s.addTags(ctx, shortPath, tags); err == nil {
+		_, err = s.db.ExecContext(ctx, `INSERT OR REPLACE INTO link_annotations (short_path, key, value) VALUES ($1, $2, $3)`,
+			shortPath, expandedFromAnnotation, u)
+	}
+	if err != nil {
+		if created {
+			if err := s.discardLink(shortPath); err != nil {
+				log.WithField("err", err).Error("Error discarding expanded link")
+			}
+		}
+		return "", err
+	}
+	if created {
+		s.countCreate(longURL)
+		s.linkCreated(shortPath, longURL)
+	}
+	log.WithFields(log.Fields{
+		"url":        u,
+		"short_path": shortPath,
+		"long_url":   longURL,
+		"created":    created,
+	}).Info("Expanded link")
+	return s.base.String() + shortPath, nil
+}
@@ -0,0 +1,76 @@
+package smallifier
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExpand(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/short", http.RedirectHandler("/middle", 301))
+	mux.Handle("/middle", http.RedirectHandler("/final?utm=1", 302))
+	mux.HandleFunc("/final", func(w http.ResponseWriter, req *http.Request) { io.WriteString(w, "final") })
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, req *http.Request) { http.Redirect(w, req, "/loop", 302) })
+	other := httptest.NewTLSServer(mux)
+	defer other.Close()
+
+	f := serve(t, WithWebhookClient(insecureClient()))
+	defer f.Close()
+	expand := func(body string) ExpandResponse {
+		resp := adminBodyRequest(t, f, "POST", "expand", testSecret, body)
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Fatalf("want status 200 got %d", resp.StatusCode)
+		}
+		var r ExpandResponse
+		if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	r := expand(`{"urls": ["` + other.URL + `/short", "` + other.URL + `/loop", "ftp://example.org/"], "dry_run": true}`)
+	if len(r.Links) != 3 || r.Links[0].LongURL != other.URL+"/final?utm=1" || r.Links[0].ShortURL != "" ||
+		r.Links[1].Error == "" || r.Links[2].Error == "" {
+		t.Errorf("dry run: want one expanded link and two errors got %+v", r.Links)
+	}
+	for i, want := range []BatchItem{
+		batchSuccess,
+		{Status: 502, ErrorCode: BatchErrorUnreachable},
+		{Status: 400, ErrorCode: BatchErrorInvalid},
+	} {
+		if got := r.Links[i].BatchItem; got.Status != want.Status || got.ErrorCode != want.ErrorCode {
+			t.Errorf("dry run %s: want status %d and error code %q got %+v", r.Links[i].URL, want.Status, want.ErrorCode, got)
+		}
+	}
+	if want := (BatchSummary{Total: 3, Succeeded: 1, Failed: 2}); r.Summary != want {
+		t.Errorf("dry run: want summary %+v got %+v", want, r.Summary)
+	}
+	var links int
+	if err := f.db.QueryRow(`SELECT COUNT(*) FROM links`).Scan(&links); err != nil || links != 0 {
+		t.Errorf("dry run: want no links created got %d (%v)", links, err)
+	}
+
+	r = expand(`{"urls": ["` + other.URL + `/short"], "tags": ["migrated"]}`)
+	if len(r.Links) != 1 || r.Links[0].Error != "" {
+		t.Fatalf("want expanded link got %+v", r.Links)
+	}
+	var l AnnotatedLink
+	decodeAdminResponse(t, f, "GET", "annotations?short_url="+r.Links[0].ShortURL, &l)
+	if l.LongURL != other.URL+"/final?utm=1" || l.Annotations[expandedFromAnnotation] != other.URL+"/short" {
+		t.Errorf("want link to final recording where it was expanded from got %+v", l)
+	}
+	var tag string
+	if err := f.db.QueryRow(`SELECT tag FROM link_tags WHERE short_path = $1`, r.Links[0].ShortURL[len(f.base):]).Scan(&tag); err != nil || tag != "migrated" {
+		t.Errorf("want tag migrated got %q (%v)", tag, err)
+	}
+
+	resp := adminBodyRequest(t, f, "POST", "expand", testSecret, `{"urls": []}`)
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Errorf("no urls: want status 400 got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,163 @@
+package smallifier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// expiryInterval is how often links are expired by WithUnfollowedExpiry.
+const expiryInterval = time.Hour
+
+// expiryStatements delete a link, given as $1, and the rows in tables without foreign keys which refer to it.
+var expiryStatements = []string{
+	`DELETE FROM click_webhooks WHERE short_path = $1`,
+	`DELETE FROM bundle_items WHERE short_path = $1`,
+	`DELETE FROM bundles WHERE short_path = $1`,
+	`DELETE FROM link_tags WHERE short_path = $1`,
+	`DELETE FROM link_annotations WHERE short_path = $1`,
+	`DELETE FROM geo_blocks WHERE scope_kind = 'link' AND scope = $1`,
+	`DELETE FROM links WHERE short_path = $1`,
+}
+
+// ExpireRequest is the JSON-encoded body of an admin request to expire links which have never been followed, or which
+// haven't been followed recently.
+type ExpireRequest struct {
+	// Days is how many days old a link must be, without ever having been followed, to be expired.
+	Days int `json:"days"`
+	// Idle expires links which haven't been followed in the last Days days instead, whether or not they ever were.
+	Idle bool `json:"idle"`
+	// DryRun reports what would be expired without expiring anything.
+	DryRun bool `json:"dry_run"`
+}
+
+// ExpiryReport lists the links which were, or in a dry run would be, expired.
+type ExpiryReport struct {
+	// Before is the unix timestamp before which links were created, and for idle links last followed, to be expired.
+	Before  int64         `json:"before"`
+	DryRun  bool          `json:"dry_run"`
+	Expired []ExpiredLink `json:"expired"`
+}
+
+// ExpiredLink is a link which was expired.
+type ExpiredLink struct {
+	ShortURL  string `json:"short_url"`
+	LongURL   string `json:"long_url"`
+	CreatedTS int64  `json:"created_ts"`
+}
+
+// WithUnfollowedExpiry expires links which haven't been followed within days of being created, checking hourly.
+// Pinned links are never expired.
+// Expired links are removed from the database, freeing their short paths for reuse.
+func WithUnfollowedExpiry(days int) Option {
+	return func(s *smallifier) {
+		s.expiryDays = days
+	}
+}
+
+// expireUnfollowedLinks expires links as configured by WithUnfollowedExpiry every expiryInterval, until s.stop is closed.
+func (s *smallifier) expireUnfollowedLinks() {
+	defer s.background.Done()
+	for {
+		select {
+		case <-s.clock.After(expiryInterval):
+		case <-s.stop:
+			return
+		}
+		if s.readOnlyStatus().ReadOnly {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(s.ctx, time.Minute)
+		report, err := s.expire(ctx, ExpireRequest{Days: s.expiryDays})
+		cancel()
+		if err != nil {
+			log.WithField("err", err).Error("Error expiring unfollowed links")
+			continue
+		}
+		if len(report.Expired) > 0 {
+			log.WithFields(log.Fields{
+				"before":  report.Before,
+				"expired": len(report.Expired),
+			}).Info("Expired unfollowed links")
+		}
+	}
+}
+
+// expire removes the links, other than deleted and pinned ones, created more than r.Days ago and never followed, or if
+// r.Idle not followed in that time, recording each in the audit log. Deleted links are kept, so that they go on being
+// reported as gone.
+func (s *smallifier) expire(ctx context.Context, r ExpireRequest) (ExpiryReport, error) {
+	if r.Days <= 0 {
+		return ExpiryReport{}, errors.New("days must be a positive integer")
+	}
+	if r.Idle && s.followRetentionDays > 0 && r.Days > s.followRetentionDays {
+		return ExpiryReport{}, fmt.Errorf("days must be at most the %d days follows are kept for", s.followRetentionDays)
+	}
+	now := s.clock.Now()
+	report := ExpiryReport{Before: now.AddDate(0, 0, -r.Days).Unix(), DryRun: r.DryRun, Expired: []ExpiredLink{}}
+	// Follows since followedSince count against expiring a link, and only links created since createdSince are
+	// considered: with WithFollowRetention, older links may have been followed by follows which have since been purged.
+	var followedSince, createdSince int64
+	if r.Idle {
+		followedSince = report.Before
+	} else if s.followRetentionDays > 0 {
+		createdSince = now.AddDate(0, 0, -s.followRetentionDays).Unix()
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return report, err
+	}
+	defer tx.Rollback()
+	// Follows which failed to be written are waiting in follow_errors, so count too.
+	rows, err := tx.QueryContext(ctx, `SELECT short_path, long_url, create_ts FROM links
+		WHERE create_ts < $1 AND create_ts >= $2 AND deleted = 0 AND pinned = 0
+		AND NOT EXISTS (SELECT 1 FROM follows WHERE follows.short_path = links.short_path AND follows.ts >= $3)
+		AND NOT EXISTS (SELECT 1 FROM follow_errors WHERE follow_errors.short_path = links.short_path)
+		ORDER BY id`, report.Before, createdSince, followedSince)
+	if err != nil {
+		return report, err
+	}
+	var shortPaths []string
+	for rows.Next() {
+		var l ExpiredLink
+		var shortPath string
+		if err := rows.Scan(&shortPath, &l.LongURL, &l.CreatedTS); err != nil {
+			rows.Close()
+			return report, err
+		}
+		l.ShortURL = s.base.String() + shortPath
+		report.Expired = append(report.Expired, l)
+		shortPaths = append(shortPaths, shortPath)
+	}
+	if err := rows.Err(); err != nil {
+		return report, err
+	}
+	rows.Close()
+	if r.DryRun || len(shortPaths) == 0 {
+		return report, nil
+	}
+
+	for i, shortPath := range shortPaths {
+		// Everything about the link goes with it, so that nothing is inherited by a link later created at the same path.
+		// Tables with foreign keys to links are cleared by the cascade.
+		for _, stmt := range expiryStatements {
+			if _, err := tx.ExecContext(ctx, stmt, shortPath); err != nil {
+				return report, err
+			}
+		}
+		if err := addAuditEntry(ctx, tx, now.Unix(), "expire", shortPath, report.Expired[i].LongURL, ""); err != nil {
+			return report, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return report, err
+	}
+	for _, shortPath := range shortPaths {
+		s.forgetLookup(shortPath)
+	}
+	return report, nil
+}
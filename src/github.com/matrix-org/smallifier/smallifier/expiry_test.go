@@ -0,0 +1,65 @@
+package smallifier
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestExpireUnfollowed(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	unfollowed := shortenTagged(t, f, f.server.URL+"/_stub", "lemurs")
+	followed := shorten(t, f.server.URL, f.server.URL+"/_stub")
+	recent := shorten(t, f.server.URL, f.server.URL+"/_stub")
+	old := time.Now().AddDate(0, 0, -40).Unix()
+	for _, link := range []string{unfollowed, followed} {
+		if _, err := f.db.Exec(`UPDATE links SET create_ts = $1 WHERE short_path = $2`, old, link[len(f.base):]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resp, err := insecureClient().Get(followed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	waitForFollows(f)
+
+	for _, dryRun := range []bool{true, false} {
+		body, _ := json.Marshal(ExpireRequest{Days: 30, DryRun: dryRun})
+		resp := adminBodyRequest(t, f, "POST", "expire", testSecret, string(body))
+		var report ExpiryReport
+		if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if len(report.Expired) != 1 || report.Expired[0].ShortURL != unfollowed || report.DryRun != dryRun {
+			t.Errorf("dry run %t: want %s expired got %+v", dryRun, unfollowed, report)
+		}
+	}
+
+	for link, want := range map[string]int{unfollowed: 404, followed: 200, recent: 200} {
+		resp, err := insecureClient().Get(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%s: want status code %d got %d", link, want, resp.StatusCode)
+		}
+	}
+	var tags int
+	if err := f.db.QueryRow(`SELECT COUNT(*) FROM link_tags WHERE short_path = $1`, unfollowed[len(f.base):]).Scan(&tags); err != nil {
+		t.Fatal(err)
+	}
+	if tags != 0 {
+		t.Errorf("tags of expired link: want 0 got %d", tags)
+	}
+
+	var entries []AuditEntry
+	decodeAdminResponse(t, f, "GET", "audit", &entries)
+	if len(entries) != 1 || entries[0].Action != "expire" || entries[0].ShortURL != unfollowed {
+		t.Errorf("audit log: want expiry of %s got %+v", unfollowed, entries)
+	}
+}
@@ -0,0 +1,299 @@
+package smallifier
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// maxFeedSize is the most bytes of a feed which are read.
+const maxFeedSize = 4 << 20
+
+// Feed is an RSS or Atom feed, new entries of which are shortened and announced by WithFeeds.
+type Feed struct {
+	URL string `json:"url"`
+	// Tags are attached to the links created for the feed's entries.
+	Tags []string `json:"tags,omitempty"`
+	// WebhookURL is an optional https URL to which a FeedEntry is POSTed for each new entry, signed with WebhookSecret.
+	WebhookURL    string `json:"webhook_url,omitempty"`
+	WebhookSecret string `json:"webhook_secret,omitempty"`
+	// MatrixRoomID is an optional Matrix room to announce new entries in, as the user given to WithMatrixNotifier.
+	MatrixRoomID string `json:"matrix_room_id,omitempty"`
+}
+
+// FeedEntry is the JSON-encoded body POSTed to a feed's webhook when a link is created for a new entry.
+type FeedEntry struct {
+	FeedURL  string `json:"feed_url"`
+	Title    string `json:"title"`
+	LongURL  string `json:"long_url"`
+	ShortURL string `json:"short_url"`
+}
+
+// ParseFeeds reads Feeds from a JSON array, e.g.
+//
+//	[{"url": "https://matrix.org/blog/feed", "tags": ["blog"], "matrix_room_id": "!announcements:matrix.org"}]
+func ParseFeeds(r io.Reader) ([]Feed, error) {
+	var feeds []Feed
+	if err := json.NewDecoder(r).Decode(&feeds); err != nil {
+		return nil, err
+	}
+	for _, f := range feeds {
+		if f.URL == "" {
+			return nil, errors.New("Feeds must have a url")
+		}
+		if f.WebhookURL != "" && !strings.HasPrefix(f.WebhookURL, "https://") {
+			return nil, fmt.Errorf("%s: webhooks must start with https://", f.URL)
+		}
+		if err := checkTags(f.Tags); err != nil {
+			return nil, fmt.Errorf("%s: %v", f.URL, err)
+		}
+	}
+	return feeds, nil
+}
+
+// WithFeeds polls feeds when the Smallifier is made and every interval after, creating a link for each entry added
+// since the last poll and announcing it by the feed's webhook and in its Matrix room. Entries already in a feed the
+// first time it is polled are only remembered, so that adding a feed doesn't announce its whole history.
+// Announcements which fail are logged and counted in WebhookErrors, but not retried.
+// New panics if a feed has a Matrix room but WithMatrixNotifier wasn't given.
+func WithFeeds(interval time.Duration, feeds []Feed) Option {
+	return func(s *smallifier) {
+		s.feedInterval = interval
+		s.feeds = feeds
+	}
+}
+
+// feedDocument is an RSS 2.0 or Atom feed; only the fields of whichever it is are set.
+type feedDocument struct {
+	Items []struct {
+		GUID  string `xml:"guid"`
+		Title string `xml:"title"`
+		Link  string `xml:"link"`
+	} `xml:"channel>item"`
+	Entries []struct {
+		ID    string `xml:"id"`
+		Title string `xml:"title"`
+		Links []struct {
+			Rel  string `xml:"rel,attr"`
+			Href string `xml:"href,attr"`
+		} `xml:"link"`
+	} `xml:"entry"`
+}
+
+// feedItem is an entry of a feed, identified by id.
+type feedItem struct {
+	id, title, link string
+}
+
+// parseFeed returns the entries of the RSS or Atom feed read from r, in the order they appear, usually newest first.
+// Entries without a link are skipped.
+func parseFeed(r io.Reader) ([]feedItem, error) {
+	var doc feedDocument
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	var items []feedItem
+	for _, i := range doc.Items {
+		item := feedItem{strings.TrimSpace(i.GUID), strings.TrimSpace(i.Title), strings.TrimSpace(i.Link)}
+		if item.id == "" {
+			item.id = item.link
+		}
+		if item.link != "" {
+			items = append(items, item)
+		}
+	}
+	for _, e := range doc.Entries {
+		item := feedItem{id: strings.TrimSpace(e.ID), title: strings.TrimSpace(e.Title)}
+		for _, l := range e.Links {
+			if l.Rel == "" || l.Rel == "alternate" {
+				item.link = strings.TrimSpace(l.Href)
+				break
+			}
+		}
+		if item.id == "" {
+			item.id = item.link
+		}
+		if item.link != "" {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+// watchFeeds polls s.feeds every s.feedInterval, until s.stop is closed.
+func (s *smallifier) watchFeeds() {
+	defer s.background.Done()
+	for {
+		// Feeds are polled once the Smallifier isn't read-only, so that their entries aren't skipped.
+		for _, f := range s.feeds {
+			if s.readOnlyStatus().ReadOnly {
+				break
+			}
+			ctx, cancel := context.WithTimeout(s.ctx, time.Minute)
+			err := s.pollFeed(ctx, f)
+			cancel()
+			if err != nil {
+				log.WithFields(log.Fields{
+					"err":  err,
+					"feed": f.URL,
+				}).Error("Error polling feed")
+			}
+		}
+		select {
+		case <-s.clock.After(s.feedInterval):
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// pollFeed fetches f, creating and announcing links for the entries which haven't been seen before, oldest first.
+func (s *smallifier) pollFeed(ctx context.Context, f Feed) error {
+	items, err := s.fetchFeed(ctx, f.URL)
+	if err != nil {
+		return err
+	}
+	var polled int
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM feeds WHERE url = $1`, f.URL).Scan(&polled); err != nil {
+		return err
+	}
+	if polled == 0 {
+		return s.rememberFeed(ctx, f, items)
+	}
+
+	for i := len(items) - 1; i >= 0; i-- {
+		item := items[i]
+		var seen int
+		if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM feed_entries WHERE feed_url = $1 AND entry_id = $2`, f.URL, item.id).Scan(&seen); err != nil {
+			return err
+		}
+		if seen > 0 {
+			continue
+		}
+		if err := s.longURLError(item.link); err != nil {
+			log.WithFields(log.Fields{
+				"err":  err,
+				"feed": f.URL,
+				"url":  item.link,
+			}).Error("Refusing to linkify feed entry")
+			if err := s.skipFeedEntry(ctx, f, item); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := s.checkLinkLimits(item.link); err != nil {
+			return err
+		}
+		shortPath, err := s.generateShortPath(ctx, item.link, "", "")
+		if err != nil {
+			return err
+		}
+		if err := s.addTags(ctx, shortPath, f.Tags); err == nil {
+			_, err = s.db.ExecContext(ctx, `INSERT INTO feed_entries (feed_url, entry_id, short_path) VALUES ($1, $2, $3)`, f.URL, item.id, shortPath)
+		}
+		if err != nil {
+			if err := s.discardLink(shortPath); err != nil {
+				log.WithField("err", err).Error("Error discarding link for feed entry")
+			}
+			return err
+		}
+		s.countCreate(item.link)
+		s.linkCreated(shortPath, item.link)
+		log.WithFields(log.Fields{
+			"feed":       f.URL,
+			"short_path": shortPath,
+			"long_url":   item.link,
+		}).Info("Created link for feed entry")
+		s.announceFeedEntry(ctx, f, FeedEntry{
+			FeedURL:  f.URL,
+			Title:    item.title,
+			LongURL:  item.link,
+			ShortURL: s.base.String() + shortPath,
+		})
+	}
+	return nil
+}
+
+// rememberFeed records that f has been polled, and that items were already in it, so that links aren't created for them.
+func (s *smallifier) rememberFeed(ctx context.Context, f Feed, items []feedItem) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `INSERT INTO feeds (url, first_poll_ts) VALUES ($1, $2)`, f.URL, s.clock.Now().Unix()); err != nil {
+		return err
+	}
+	for _, item := range items {
+		if _, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO feed_entries (feed_url, entry_id, short_path) VALUES ($1, $2, '')`, f.URL, item.id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// skipFeedEntry records that item has been seen in f without creating a link for it.
+func (s *smallifier) skipFeedEntry(ctx context.Context, f Feed, item feedItem) error {
+	_, err := s.db.ExecContext(ctx, `INSERT OR IGNORE INTO feed_entries (feed_url, entry_id, short_path) VALUES ($1, $2, '')`, f.URL, item.id)
+	return err
+}
+
+// fetchFeed fetches and parses the feed at u.
+func (s *smallifier) fetchFeed(ctx context.Context, u string) ([]feedItem, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	resp, err := s.webhookClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("feed responded with status %d", resp.StatusCode)
+	}
+	return parseFeed(io.LimitReader(resp.Body, maxFeedSize))
+}
+
+// announceFeedEntry posts e to f's webhook and Matrix room, if it has them.
+func (s *smallifier) announceFeedEntry(ctx context.Context, f Feed, e FeedEntry) {
+	if f.WebhookURL != "" {
+		if err := s.postWebhook(ctx, f.WebhookURL, f.WebhookSecret, e); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+				"url": f.WebhookURL,
+			}).Error("Error announcing feed entry by webhook")
+			atomic.AddUint64(&s.webhookErrorCount, 1)
+		}
+	}
+	if f.MatrixRoomID != "" {
+		title := e.Title
+		if title == "" {
+			title = e.LongURL
+		}
+		m := s.matrixNotifier
+		if err := sendMatrixMessage(ctx, m.Client, m.Homeserver, m.AccessToken, f.MatrixRoomID, MatrixMessage{
+			MsgType:       "m.notice",
+			Body:          title + ": " + e.ShortURL,
+			Format:        "org.matrix.custom.html",
+			FormattedBody: html.EscapeString(title) + `: <a href="` + html.EscapeString(e.ShortURL) + `">` + html.EscapeString(e.ShortURL) + `</a>`,
+		}); err != nil {
+			log.WithFields(log.Fields{
+				"err":     err,
+				"room_id": f.MatrixRoomID,
+			}).Error("Error announcing feed entry over Matrix")
+			atomic.AddUint64(&s.webhookErrorCount, 1)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package smallifier
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testFeedInterval = time.Minute
+
+func TestParseFeed(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		feed string
+		want []feedItem
+	}{
+		{
+			name: "rss",
+			feed: `<rss version="2.0"><channel><title>Blog</title>
+				<item><title>Second</title><link>https://example.org/2</link><guid>post-2</guid></item>
+				<item><title>First</title><link>https://example.org/1</link></item>
+				<item><title>No link</title></item>
+			</channel></rss>`,
+			want: []feedItem{
+				{"post-2", "Second", "https://example.org/2"},
+				{"https://example.org/1", "First", "https://example.org/1"},
+			},
+		},
+		{
+			name: "atom",
+			feed: `<feed xmlns="http://www.w3.org/2005/Atom"><title>Blog</title>
+				<entry><id>tag:example.org,2024:2</id><title>Second</title>
+					<link rel="self" href="https://example.org/2.atom"/><link rel="alternate" href="https://example.org/2"/></entry>
+				<entry><title>First</title><link href="https://example.org/1"/></entry>
+			</feed>`,
+			want: []feedItem{
+				{"tag:example.org,2024:2", "Second", "https://example.org/2"},
+				{"https://example.org/1", "First", "https://example.org/1"},
+			},
+		},
+	} {
+		got, err := parseFeed(strings.NewReader(tc.feed))
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: want %+v got %+v", tc.name, tc.want, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("%s: item %d: want %+v got %+v", tc.name, i, tc.want[i], got[i])
+			}
+		}
+	}
+}
+
+func TestParseFeeds(t *testing.T) {
+	for _, tc := range []struct {
+		config string
+		ok     bool
+	}{
+		{`[{"url": "https://example.org/feed", "tags": ["blog"], "webhook_url": "https://hooks.example.org/"}]`, true},
+		{`[{"tags": ["blog"]}]`, false},
+		{`[{"url": "https://example.org/feed", "webhook_url": "http://hooks.example.org/"}]`, false},
+		{`[{"url": "https://example.org/feed", "tags": [""]}]`, false},
+	} {
+		if _, err := ParseFeeds(strings.NewReader(tc.config)); (err == nil) != tc.ok {
+			t.Errorf("%s: want ok %v got error %v", tc.config, tc.ok, err)
+		}
+	}
+}
+
+func TestFeedCreatesAndAnnouncesNewEntries(t *testing.T) {
+	var mu sync.Mutex
+	items := `<item><title>Old</title><link>https://example.org/old</link></item>`
+	feed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		io.WriteString(w, `<rss version="2.0"><channel>`+items+`</channel></rss>`)
+	}))
+	defer feed.Close()
+
+	var hooked []FeedEntry
+	var signed bool
+	hook := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		var e FeedEntry
+		json.Unmarshal(b, &e)
+		mu.Lock()
+		hooked = append(hooked, e)
+		signed = hmac.Equal([]byte(Sign("hook secret", b)), []byte(req.Header.Get(SignatureHeader)))
+		mu.Unlock()
+	}))
+	defer hook.Close()
+
+	var messages []string
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var m MatrixMessage
+		json.NewDecoder(req.Body).Decode(&m)
+		mu.Lock()
+		if strings.Contains(req.URL.Path, "/rooms/!room:example.org/send/") {
+			messages = append(messages, m.Body)
+		}
+		mu.Unlock()
+		io.WriteString(w, `{}`)
+	}))
+	defer hs.Close()
+
+	clock := newFakeClock()
+	f := serve(t, WithClock(clock), WithWebhookClient(insecureClient()),
+		WithMatrixNotifier(&MatrixNotifier{Homeserver: hs.URL, AccessToken: "token"}),
+		WithFeeds(testFeedInterval, []Feed{{
+			URL:           feed.URL,
+			Tags:          []string{"blog"},
+			WebhookURL:    hook.URL,
+			WebhookSecret: "hook secret",
+			MatrixRoomID:  "!room:example.org",
+		}}))
+	defer f.Close()
+
+	// The feed and scheduled updates are each waited for once the feed has first been polled.
+	const loops = 2
+	clock.waitForWaiters(loops)
+	var links int
+	if err := f.db.QueryRow(`SELECT COUNT(*) FROM links`).Scan(&links); err != nil {
+		t.Fatal(err)
+	}
+	if links != 0 {
+		t.Errorf("want entries already in the feed to be skipped, got %d links", links)
+	}
+
+	mu.Lock()
+	items = `<item><title>New &amp; shiny</title><link>https://example.org/new</link></item>` + items
+	mu.Unlock()
+	clock.advance(testFeedInterval)
+	clock.waitForWaiters(loops)
+
+	var shortPath, longURL string
+	if err := f.db.QueryRow(`SELECT short_path, long_url FROM links`).Scan(&shortPath, &longURL); err != nil {
+		t.Fatal(err)
+	}
+	if longURL != "https://example.org/new" {
+		t.Errorf("want link to https://example.org/new got %s", longURL)
+	}
+	var tag string
+	if err := f.db.QueryRow(`SELECT tag FROM link_tags WHERE short_path = $1`, shortPath).Scan(&tag); err != nil || tag != "blog" {
+		t.Errorf("want tag blog got %q (%v)", tag, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := FeedEntry{FeedURL: feed.URL, Title: "New & shiny", LongURL: "https://example.org/new", ShortURL: f.base + shortPath}
+	if len(hooked) != 1 || hooked[0] != want {
+		t.Errorf("webhook: want %+v got %+v", want, hooked)
+	}
+	if !signed {
+		t.Error("webhook: bad signature")
+	}
+	if len(messages) != 1 || messages[0] != "New & shiny: "+f.base+shortPath {
+		t.Errorf("matrix: want one announcement of %s got %q", f.base+shortPath, messages)
+	}
+}
@@ -0,0 +1,308 @@
+package smallifier
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// followArchiveBlockSize is how many follows are compressed together in a block of a follow archive.
+	// Readers decompress whole blocks, so smaller blocks make queries of few links cheaper, and larger ones compress better.
+	followArchiveBlockSize = 10000
+	// followArchiveCompression is how blocks are compressed. Each is a Zstandard frame, so an archive as a whole is also
+	// a valid Zstandard file of NDJSON.
+	followArchiveCompression = "zstd"
+	// followArchiveIndexSuffix is added to the path of an archive, without its ".ndjson.zst", to name its index.
+	followArchiveIndexSuffix = ".index.json"
+)
+
+// WithFollowArchive writes follows to archives in dir before WithFollowRetention purges them, so that years of history
+// remain analysable with ReadFollowArchive, without bloating the database. Follows are archived in a file for each
+// month, follows-YYYY-MM.ndjson.zst, of compressed blocks of NDJSON ArchivedFollows, sorted by short path then time, and
+// indexed by follows-YYYY-MM.index.json, a FollowArchiveIndex. If archiving fails, follows aren't purged.
+func WithFollowArchive(dir string) Option {
+	return func(s *smallifier) {
+		s.followArchiveDir = dir
+	}
+}
+
+// ArchivedFollow is a follow as written to a follow archive, on a line of its own.
+type ArchivedFollow struct {
+	ShortPath    string `json:"short_path"`
+	BundleItem   int    `json:"bundle_item,omitempty"`
+	TS           int64  `json:"ts"`
+	IP           string `json:"ip"`
+	ForwardedFor string `json:"forwarded_for,omitempty"`
+	RepeatCount  int    `json:"repeat_count,omitempty"`
+	UserAgent    string `json:"user_agent,omitempty"`
+	Referer      string `json:"referer,omitempty"`
+}
+
+// FollowArchiveIndex describes the blocks of a follow archive, so that readers only decompress those they need.
+type FollowArchiveIndex struct {
+	// Compression is how each block is compressed: "zstd".
+	Compression string               `json:"compression"`
+	Blocks      []FollowArchiveBlock `json:"blocks"`
+}
+
+// FollowArchiveBlock describes a block of a follow archive.
+type FollowArchiveBlock struct {
+	// Offset and Length are where the block is in the archive, in bytes.
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+	// Follows counts the follows in the block.
+	Follows int `json:"follows"`
+	// FirstShortPath and LastShortPath are the first and last short paths followed in the block, in order.
+	FirstShortPath string `json:"first_short_path"`
+	LastShortPath  string `json:"last_short_path"`
+	// MinTS and MaxTS are the unix timestamps of the earliest and latest follows in the block.
+	MinTS int64 `json:"min_ts"`
+	MaxTS int64 `json:"max_ts"`
+}
+
+// FollowArchiveQuery selects follows from a follow archive. Its zero value selects every follow.
+type FollowArchiveQuery struct {
+	// ShortPath selects the follows of the link at it, if set.
+	ShortPath string
+	// From and To select the follows at or after, and before, their unix timestamps, if set.
+	From int64
+	To   int64
+}
+
+// matches reports whether q selects f.
+func (q FollowArchiveQuery) matches(f ArchivedFollow) bool {
+	return (q.ShortPath == "" || f.ShortPath == q.ShortPath) && (q.From == 0 || f.TS >= q.From) && (q.To == 0 || f.TS < q.To)
+}
+
+// mayMatch reports whether q may select any follows in b.
+func (q FollowArchiveQuery) mayMatch(b FollowArchiveBlock) bool {
+	if q.ShortPath != "" && (q.ShortPath < b.FirstShortPath || q.ShortPath > b.LastShortPath) {
+		return false
+	}
+	return (q.From == 0 || b.MaxTS >= q.From) && (q.To == 0 || b.MinTS < q.To)
+}
+
+// followArchiveIndexPath returns the path of the index of the archive at path.
+func followArchiveIndexPath(path string) string {
+	return strings.TrimSuffix(path, ".ndjson.zst") + followArchiveIndexSuffix
+}
+
+// readFollowArchiveIndex reads the index of the archive at path, which is empty if it doesn't exist yet.
+func readFollowArchiveIndex(path string) (FollowArchiveIndex, error) {
+	index := FollowArchiveIndex{Compression: followArchiveCompression}
+	b, err := ioutil.ReadFile(followArchiveIndexPath(path))
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return index, err
+	}
+	if err := json.Unmarshal(b, &index); err != nil {
+		return index, fmt.Errorf("%s: %v", followArchiveIndexPath(path), err)
+	}
+	if index.Compression != followArchiveCompression {
+		return index, fmt.Errorf("%s: unsupported compression %q", followArchiveIndexPath(path), index.Compression)
+	}
+	return index, nil
+}
+
+// archiveFollows appends the follows, including those waiting in follow_errors, from before the unix timestamp
+// before to the archive for the current month, returning how many were archived.
+func (s *smallifier) archiveFollows(ctx context.Context, before int64) (int, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT short_path, COALESCE(bundle_item, 0), ts, ip, COALESCE(forwarded_for, ''),
+		repeat_count, COALESCE(user_agent, ''), COALESCE(referer, '') FROM follows WHERE ts < $1
+		UNION ALL SELECT short_path, COALESCE(bundle_item, 0), ts, ip, COALESCE(forwarded_for, ''),
+		0, COALESCE(user_agent, ''), COALESCE(referer, '') FROM follow_errors WHERE ts < $1
+		ORDER BY 1, 3`, before)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	path := filepath.Join(s.followArchiveDir, s.clock.Now().UTC().Format("follows-2006-01")+".ndjson.zst")
+	index, err := readFollowArchiveIndex(path)
+	if err != nil {
+		return 0, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	// Anything after the last indexed block was written by an attempt which failed before updating the index, and
+	// whose follows weren't purged, so it is overwritten.
+	var offset int64
+	if n := len(index.Blocks); n > 0 {
+		offset = index.Blocks[n-1].Offset + index.Blocks[n-1].Length
+	}
+	if err := file.Truncate(offset); err != nil {
+		return 0, err
+	}
+
+	z, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return 0, err
+	}
+	defer z.Close()
+	archived := 0
+	var block []ArchivedFollow
+	flush := func() error {
+		if len(block) == 0 {
+			return nil
+		}
+		b, err := compressFollowBlock(z, block)
+		if err != nil {
+			return err
+		}
+		if _, err := file.WriteAt(b, offset); err != nil {
+			return err
+		}
+		desc := FollowArchiveBlock{
+			Offset:         offset,
+			Length:         int64(len(b)),
+			Follows:        len(block),
+			FirstShortPath: block[0].ShortPath,
+			LastShortPath:  block[len(block)-1].ShortPath,
+			MinTS:          block[0].TS,
+			MaxTS:          block[0].TS,
+		}
+		for _, f := range block {
+			if f.TS < desc.MinTS {
+				desc.MinTS = f.TS
+			}
+			if f.TS > desc.MaxTS {
+				desc.MaxTS = f.TS
+			}
+		}
+		index.Blocks = append(index.Blocks, desc)
+		offset += desc.Length
+		archived += len(block)
+		block = block[:0]
+		return nil
+	}
+	for rows.Next() {
+		var f ArchivedFollow
+		if err := rows.Scan(&f.ShortPath, &f.BundleItem, &f.TS, &f.IP, &f.ForwardedFor, &f.RepeatCount, &f.UserAgent, &f.Referer); err != nil {
+			return 0, err
+		}
+		if block = append(block, f); len(block) == followArchiveBlockSize {
+			if err := flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if err := flush(); err != nil {
+		return 0, err
+	}
+	if archived == 0 {
+		return 0, nil
+	}
+	if err := file.Sync(); err != nil {
+		return 0, err
+	}
+	return archived, writeFollowArchiveIndex(path, index)
+}
+
+// compressFollowBlock returns follows as a Zstandard frame of NDJSON, compressed by z.
+func compressFollowBlock(z *zstd.Encoder, follows []ArchivedFollow) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, f := range follows {
+		if err := enc.Encode(f); err != nil {
+			return nil, err
+		}
+	}
+	return z.EncodeAll(buf.Bytes(), nil), nil
+}
+
+// writeFollowArchiveIndex replaces the index of the archive at path with index, atomically, so that readers never see
+// blocks which were only partly written.
+func writeFollowArchiveIndex(path string, index FollowArchiveIndex) error {
+	b, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := followArchiveIndexPath(path) + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, followArchiveIndexPath(path))
+}
+
+// ReadFollowArchive calls fn with each follow q selects from the follow archive at path, written by WithFollowArchive,
+// in order of short path then time, stopping at the first error fn returns. Only the blocks its index says may hold
+// such follows are decompressed.
+func ReadFollowArchive(path string, q FollowArchiveQuery, fn func(ArchivedFollow) error) error {
+	index, err := readFollowArchiveIndex(path)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	z, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return err
+	}
+	defer z.Close()
+	for _, b := range index.Blocks {
+		if !q.mayMatch(b) {
+			continue
+		}
+		if err := z.Reset(io.NewSectionReader(file, b.Offset, b.Length)); err != nil {
+			return fmt.Errorf("%s: block at %d: %v", path, b.Offset, err)
+		}
+		dec := json.NewDecoder(z)
+		for {
+			var f ArchivedFollow
+			if err := dec.Decode(&f); err == io.EOF {
+				break
+			} else if err != nil {
+				return fmt.Errorf("%s: block at %d: %v", path, b.Offset, err)
+			}
+			if !q.matches(f) {
+				continue
+			}
+			if err := fn(f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// archiveAndPurgeFollows archives the follows from before the unix timestamp before, if WithFollowArchive was given,
+// then purges them, returning how many were purged. Follows aren't purged if archiving them failed.
+func (s *smallifier) archiveAndPurgeFollows(ctx context.Context, before int64) (int64, error) {
+	if s.followArchiveDir != "" {
+		start := time.Now()
+		archived, err := s.archiveFollows(ctx, before)
+		if err != nil {
+			return 0, fmt.Errorf("archiving follows: %v", err)
+		}
+		if archived > 0 {
+			log.WithFields(log.Fields{
+				"archived": archived,
+				"before":   before,
+				"took":     time.Since(start),
+			}).Info("Archived follows")
+		}
+	}
+	return s.purgeFollows(ctx, before)
+}
@@ -0,0 +1,132 @@
+package smallifier
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestFollowArchive(t *testing.T) {
+	clock := newFakeClock()
+	dir, err := ioutil.TempDir("", "smallifier-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := serve(t, WithClock(clock), WithFollowRetention(30), WithFollowArchive(dir))
+	defer f.Close()
+	s := f.smallifier.(*smallifier)
+	ctx := context.Background()
+
+	addFollow := func(shortPath string, ts int64) {
+		if _, err := f.db.Exec(`INSERT INTO follows (short_path, ts, ip, user_agent) VALUES ($1, $2, '127.0.0.1', 'lemur')`, shortPath, ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a := shorten(t, f.server.URL, f.server.URL+"/_stub")[len(f.base):]
+	b := shorten(t, f.server.URL, f.server.URL+"/_stub")[len(f.base):]
+	addFollow(b, 100)
+	addFollow(a, 200)
+	addFollow(a, 100)
+	addFollow(a, 5000)
+	if purged, err := s.archiveAndPurgeFollows(ctx, 1000); err != nil || purged != 3 {
+		t.Fatalf("first archive: want 3 follows purged got %d, %v", purged, err)
+	}
+
+	// Bytes left by an attempt which failed before updating the index are overwritten.
+	path := filepath.Join(dir, clock.Now().UTC().Format("follows-2006-01")+".ndjson.zst")
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString("partial")
+	file.Close()
+	addFollow(b, 3000)
+	if purged, err := s.archiveAndPurgeFollows(ctx, 4000); err != nil || purged != 1 {
+		t.Fatalf("second archive: want 1 follow purged got %d, %v", purged, err)
+	}
+
+	read := func(q FollowArchiveQuery) []ArchivedFollow {
+		var got []ArchivedFollow
+		if err := ReadFollowArchive(path, q, func(f ArchivedFollow) error {
+			got = append(got, f)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	follow := func(shortPath string, ts int64) ArchivedFollow {
+		return ArchivedFollow{ShortPath: shortPath, TS: ts, IP: "127.0.0.1", UserAgent: "lemur"}
+	}
+	// Each archive is sorted by short path, then time.
+	want := []ArchivedFollow{follow(a, 100), follow(a, 200), follow(b, 100), follow(b, 3000)}
+	if b < a {
+		want = []ArchivedFollow{follow(b, 100), follow(a, 100), follow(a, 200), follow(b, 3000)}
+	}
+	if got := read(FollowArchiveQuery{}); !reflect.DeepEqual(got, want) {
+		t.Errorf("every follow: want %+v got %+v", want, got)
+	}
+	if got, want := read(FollowArchiveQuery{ShortPath: a, From: 150}), []ArchivedFollow{follow(a, 200)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("follows of %s from 150: want %+v got %+v", a, want, got)
+	}
+	if got, want := read(FollowArchiveQuery{From: 1000}), []ArchivedFollow{follow(b, 3000)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("follows from 1000: want %+v got %+v", want, got)
+	}
+
+	// The archive as a whole is Zstandard-compressed NDJSON too.
+	file, err = os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	z, err := zstd.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer z.Close()
+	lines := 0
+	for scanner := bufio.NewScanner(z); scanner.Scan(); {
+		lines++
+	}
+	if lines != 4 {
+		t.Errorf("want 4 lines decompressing the whole archive got %d", lines)
+	}
+
+	index, err := readFollowArchiveIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Blocks) != 2 || index.Blocks[1].MinTS != 3000 {
+		t.Errorf("want a block for each archive got %+v", index.Blocks)
+	}
+	var left int
+	if err := f.db.QueryRow(`SELECT COUNT(*) FROM follows`).Scan(&left); err != nil || left != 1 {
+		t.Errorf("want the recent follow kept got %d, %v", left, err)
+	}
+}
+
+func TestFollowArchiveQueryMayMatch(t *testing.T) {
+	b := FollowArchiveBlock{FirstShortPath: "b", LastShortPath: "d", MinTS: 100, MaxTS: 200}
+	for q, want := range map[FollowArchiveQuery]bool{
+		{}:                         true,
+		{ShortPath: "c"}:           true,
+		{ShortPath: "a"}:           false,
+		{ShortPath: "e"}:           false,
+		{From: 200}:                true,
+		{From: 201}:                false,
+		{To: 100}:                  false,
+		{To: 101}:                  true,
+		{ShortPath: "d", From: 50}: true,
+	} {
+		if got := q.mayMatch(b); got != want {
+			t.Errorf("%+v: want %v got %v", q, want, got)
+		}
+	}
+}
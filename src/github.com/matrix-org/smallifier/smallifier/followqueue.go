@@ -0,0 +1,135 @@
+package smallifier
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultFollowQueueSize is how many follows may wait to be written to the database before more are dropped,
+	// unless WithFollowQueueSize or WithSmallFootprint is given.
+	defaultFollowQueueSize = 1024 * 1024
+	// smallFollowQueueSize and smallLookupCacheSize replace the defaults with WithSmallFootprint.
+	smallFollowQueueSize = 4096
+	smallLookupCacheSize = 1000
+)
+
+// WithFollowQueueSize sets how many follows may wait to be written to the database before more are dropped.
+// Memory for the queue is only allocated as follows wait in it, so a large limit costs nothing until it is reached.
+func WithFollowQueueSize(n int) Option {
+	return func(s *smallifier) {
+		s.followQueueSize = n
+	}
+}
+
+// WithSmallFootprint keeps less in memory, for deployments on small machines such as a Raspberry Pi: unless they are
+// set explicitly, the follow queue holds at most 4096 follows, and the lookup cache used to shed load 1000 links.
+func WithSmallFootprint() Option {
+	return func(s *smallifier) {
+		s.smallFootprint = true
+	}
+}
+
+// followQueue is a queue of follows waiting to be written to the database, holding at most max of them.
+// Unlike a buffered channel, its storage grows as follows are queued and is released when it empties.
+type followQueue struct {
+	// handled is how many of the follows popped have been dealt with by whatever popped them.
+	handled uint64
+
+	mu     sync.Mutex
+	items  []follow
+	max    int
+	closed bool
+	// pushed is how many follows have ever been queued.
+	pushed uint64
+	// ready receives a value when a follow is queued or the queue is closed, to wake whatever is waiting to pop.
+	ready chan struct{}
+}
+
+func newFollowQueue(max int) *followQueue {
+	return &followQueue{max: max, ready: make(chan struct{}, 1)}
+}
+
+// push queues f, reporting false if the queue is full or closed.
+func (q *followQueue) push(f follow) bool {
+	q.mu.Lock()
+	if q.closed || len(q.items) >= q.max {
+		q.mu.Unlock()
+		return false
+	}
+	q.items = append(q.items, f)
+	q.pushed++
+	q.mu.Unlock()
+	q.wake()
+	return true
+}
+
+// pop removes the follow queued first. If there is none, ok is false, and closed reports whether none ever will be;
+// otherwise, q.ready receives a value once there might be.
+func (q *followQueue) pop() (f follow, ok, closed bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) == 0 {
+		// Dropping the slice lets the memory it held be collected after a burst.
+		q.items = nil
+		return follow{}, false, q.closed
+	}
+	f = q.items[0]
+	q.items[0] = follow{}
+	q.items = q.items[1:]
+	return f, true, false
+}
+
+// oldestTS returns the timestamp of the follow queued first, or 0 if there is none.
+func (q *followQueue) oldestTS() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) == 0 {
+		return 0
+	}
+	return q.items[0].timestamp
+}
+
+// pushedCount returns how many follows have ever been queued.
+func (q *followQueue) pushedCount() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pushed
+}
+
+// done records that n more of the follows popped have been dealt with.
+func (q *followQueue) done(n int) {
+	atomic.AddUint64(&q.handled, uint64(n))
+}
+
+// waitDone waits until the first n follows queued have been dealt with, returning ctx's error if it is done first.
+// As follows are popped in the order they were queued, once n have been dealt with, so have the first n.
+func (q *followQueue) waitDone(ctx context.Context, n uint64) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for atomic.LoadUint64(&q.handled) < n {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// close stops more follows being queued. Those already queued may still be popped.
+func (q *followQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.wake()
+}
+
+func (q *followQueue) wake() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
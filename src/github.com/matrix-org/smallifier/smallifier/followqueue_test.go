@@ -0,0 +1,74 @@
+package smallifier
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFollowQueue(t *testing.T) {
+	q := newFollowQueue(2)
+	if _, ok, closed := q.pop(); ok || closed {
+		t.Errorf("empty queue: want nothing popped and not closed got %v, %v", ok, closed)
+	}
+	if ts := q.oldestTS(); ts != 0 {
+		t.Errorf("empty queue oldest: want 0 got %d", ts)
+	}
+	for i, p := range []string{"one", "two"} {
+		if !q.push(follow{shortPath: p, timestamp: int64(i + 1)}) {
+			t.Errorf("push %s: want queued", p)
+		}
+	}
+	if ts := q.oldestTS(); ts != 1 {
+		t.Errorf("oldest: want 1 got %d", ts)
+	}
+	if q.push(follow{shortPath: "three"}) {
+		t.Error("push to full queue: want dropped")
+	}
+	select {
+	case <-q.ready:
+	default:
+		t.Error("want ready after push")
+	}
+
+	q.close()
+	if q.push(follow{shortPath: "four"}) {
+		t.Error("push to closed queue: want dropped")
+	}
+	for _, want := range []string{"one", "two"} {
+		if f, ok, _ := q.pop(); !ok || f.shortPath != want {
+			t.Errorf("pop: want %s got %q, %v", want, f.shortPath, ok)
+		}
+	}
+	if _, ok, closed := q.pop(); ok || !closed {
+		t.Errorf("closed and empty queue: want nothing popped and closed got %v, %v", ok, closed)
+	}
+	if q.items != nil {
+		t.Error("want storage released once empty")
+	}
+}
+
+func TestFollowQueueWaitDone(t *testing.T) {
+	q := newFollowQueue(10)
+	q.push(follow{shortPath: "one"})
+	q.push(follow{shortPath: "two"})
+	n := q.pushedCount()
+	if n != 2 {
+		t.Fatalf("pushed: want 2 got %d", n)
+	}
+	q.pop()
+	q.done(1)
+	// Follows queued after the count was taken aren't waited for.
+	q.push(follow{shortPath: "three"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := q.waitDone(ctx, n); err != context.DeadlineExceeded {
+		t.Errorf("with one of two done: want %v got %v", context.DeadlineExceeded, err)
+	}
+	q.pop()
+	q.done(1)
+	if err := q.waitDone(context.Background(), n); err != nil {
+		t.Errorf("with both done: want nil got %v", err)
+	}
+}
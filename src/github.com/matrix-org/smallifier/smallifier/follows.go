@@ -0,0 +1,375 @@
+package smallifier
+
+import (
+	"context"
+	"database/sql"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// flushFollowsTimeout is the longest a request to flush follows waits for the follow queue to drain.
+	flushFollowsTimeout = 30 * time.Second
+	// followInsertAttempts is how many times we try to insert a follow before moving it to the error spool.
+	followInsertAttempts = 3
+	// followBatchSize is the most follows written in a transaction, which is much faster than writing each in its own
+	// once follows queue faster than they can be written one at a time.
+	followBatchSize = 100
+)
+
+// writeFollows records follows from s.follows into the database until the queue is closed and empty, or s.ctx is done.
+// The follows waiting are written together in a transaction, or if that fails, one at a time.
+func (s *smallifier) writeFollows() {
+	defer close(s.followsDone)
+	batch := make([]follow, 0, followBatchSize)
+	for {
+		f, ok, closed := s.follows.pop()
+		if closed {
+			return
+		}
+		if !ok {
+			select {
+			case <-s.follows.ready:
+			case <-s.ctx.Done():
+				s.stopWritingFollows()
+				return
+			}
+			continue
+		}
+		atomic.StoreInt64(&s.headFollowTS, f.timestamp)
+		batch = append(batch[:0], f)
+		for len(batch) < followBatchSize {
+			if f, ok, _ = s.follows.pop(); !ok {
+				break
+			}
+			batch = append(batch, f)
+		}
+		recorded, err := s.recordFollowBatch(batch)
+		if err != nil {
+			if s.ctx.Err() != nil {
+				s.stopWritingFollows()
+				return
+			}
+			log.WithFields(log.Fields{
+				"err":     err,
+				"follows": len(batch),
+			}).Warn("Error writing follows together, writing them one at a time")
+			recorded = recorded[:0]
+			for _, f := range batch {
+				if s.recordRepeat(f) {
+					recorded = append(recorded, false)
+					continue
+				}
+				if err := s.recordFollow(f); err != nil {
+					s.stopWritingFollows()
+					return
+				}
+				recorded = append(recorded, true)
+			}
+		}
+		// Follows of each link in the batch are counted towards its milestones together.
+		counts := make(map[string]int64)
+		latest := make(map[string]follow)
+		for i, f := range batch {
+			if recorded[i] {
+				s.queueClick(f)
+				s.queueEvent(Event{Type: EventFollow, ShortURL: s.base.String() + f.shortPath, TS: f.timestamp})
+				counts[f.shortPath]++
+				latest[f.shortPath] = f
+			}
+		}
+		for shortPath, n := range counts {
+			s.checkMilestones(latest[shortPath], n)
+		}
+		atomic.StoreInt64(&s.headFollowTS, 0)
+		for _, f := range batch {
+			s.followWritten(f)
+		}
+		s.follows.done(len(batch))
+	}
+}
+
+// recordFollowBatch records follows in a transaction, adding repeats to the repeat_count of the follows they repeat,
+// and returns whether each was recorded as a new follow rather than a repeat. If it returns an error, none were.
+func (s *smallifier) recordFollowBatch(follows []follow) ([]bool, error) {
+	tx, err := s.db.BeginTx(s.ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	insert := tx.StmtContext(s.ctx, s.stmts.insertFollow)
+	// s.repeats only learns of follows once they are committed, so repeats of follows earlier in the batch are found
+	// in batchRepeats.
+	batchRepeats := repeats{window: s.repeats.window, first: make(map[repeatKey]firstFollow)}
+	recorded := make([]bool, len(follows))
+	ids := make([]int64, len(follows))
+	for i, f := range follows {
+		id, ok := batchRepeats.of(f)
+		if !ok {
+			id, ok = s.repeats.of(f)
+		}
+		if ok {
+			_, err = tx.ExecContext(s.ctx, `UPDATE follows SET repeat_count = repeat_count + 1 WHERE id = $1`, id)
+		} else if ids[i], err = s.insertFollow(s.ctx, insert, f); err == nil {
+			recorded[i] = true
+			batchRepeats.add(f, ids[i])
+		}
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	for i, f := range follows {
+		if recorded[i] {
+			s.repeats.add(f, ids[i])
+		}
+	}
+	return recorded, nil
+}
+
+func (s *smallifier) stopWritingFollows() {
+	log.WithFields(log.Fields{
+		"err":     s.ctx.Err(),
+		"pending": atomic.LoadInt64(&s.pendingFollows),
+	}).Warn("Stopped writing follows")
+}
+
+// followWritten removes f from the queue, and from the journal if there is one, which is emptied once the queue is.
+func (s *smallifier) followWritten(f follow) {
+	if s.journal == nil {
+		atomic.AddInt64(&s.pendingFollows, -1)
+		return
+	}
+	if err := s.journal.written(f.seq); err != nil {
+		log.WithField("err", err).Error("Error checkpointing follow journal")
+	}
+	// Follows are pending from before they are journaled, and are journaled and queued with the lock held, so if none
+	// are pending none can be part way through being journaled or queued.
+	s.journal.mu.Lock()
+	defer s.journal.mu.Unlock()
+	if atomic.AddInt64(&s.pendingFollows, -1) == 0 {
+		if err := s.journal.empty(); err != nil {
+			log.WithField("err", err).Error("Error emptying follow journal")
+		}
+	}
+}
+
+// recoverFollows opens the journal at s.journalPath, recording the follows in it which were never written to the database.
+func (s *smallifier) recoverFollows() error {
+	j, pending, err := openFollowJournal(s.journalPath)
+	if err != nil {
+		return err
+	}
+	for _, f := range pending {
+		if s.recordRepeat(f) {
+			continue
+		}
+		if err := s.recordFollow(f); err != nil {
+			j.close()
+			return err
+		}
+		if err := j.written(f.seq); err != nil {
+			j.close()
+			return err
+		}
+	}
+	if err := j.empty(); err != nil {
+		j.close()
+		return err
+	}
+	if len(pending) > 0 {
+		log.WithField("recovered", len(pending)).Info("Recovered follows from journal")
+	}
+	s.journal = j
+	return nil
+}
+
+// FollowQueueDepth gets the number of follows waiting to be written to the database.
+func (s *smallifier) FollowQueueDepth() float64 {
+	return float64(atomic.LoadInt64(&s.pendingFollows))
+}
+
+// DroppedFollows gets a count of follows which weren't recorded because the follow queue was full.
+func (s *smallifier) DroppedFollows() float64 {
+	return float64(atomic.LoadUint64(&s.droppedFollowCount))
+}
+
+// recordFollow inserts f into the follows table, backing off between attempts.
+// Follows which repeatedly fail to insert are persisted in the follow_errors table so that they can be recovered later.
+// If s.ctx is done before f is either, its error is returned.
+func (s *smallifier) recordFollow(f follow) error {
+	var err error
+	for i := 0; i < followInsertAttempts; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(time.Duration(50<<uint(i-1)) * time.Millisecond):
+			case <-s.ctx.Done():
+				return s.ctx.Err()
+			}
+		}
+		var id int64
+		if id, err = s.insertFollow(s.ctx, s.stmts.insertFollow, f); err == nil {
+			s.repeats.add(f, id)
+			return nil
+		}
+		if s.ctx.Err() != nil {
+			return s.ctx.Err()
+		}
+		log.WithField("err", err).Error("Error inserting follow")
+		atomic.AddUint64(&s.dbUpdateErrorCount, 1)
+	}
+
+	if _, spoolErr := s.db.ExecContext(s.ctx, `INSERT INTO follow_errors (short_path, ts, ip, forwarded_for, error, bundle_item, user_agent, referer) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`, f.shortPath, f.timestamp, f.ip, f.forwardedFor, err.Error(), nullIfZero(f.bundleItem), s.userAgent(f), nullIfEmpty(f.referer)); spoolErr != nil {
+		if s.ctx.Err() != nil {
+			return s.ctx.Err()
+		}
+		log.WithFields(log.Fields{
+			"err":        spoolErr,
+			"short_path": f.shortPath,
+			"ts":         f.timestamp,
+		}).Error("Error spooling follow, it has been lost")
+		atomic.AddUint64(&s.dbUpdateErrorCount, 1)
+	}
+	return nil
+}
+
+// FollowQueueStatus is the JSON-encoded response describing the state of the follow queue.
+type FollowQueueStatus struct {
+	// Depth is the number of follows waiting to be written to the database.
+	Depth int64 `json:"depth"`
+	// OldestPendingTS is the unix timestamp of the oldest follow waiting to be written, or 0 if there are none.
+	OldestPendingTS int64 `json:"oldest_pending_ts"`
+	// Spooled is the number of follows which failed to insert and are waiting in the error spool.
+	Spooled int64 `json:"spooled"`
+}
+
+// FlushResponse is the JSON-encoded response to a request to flush the follow queue.
+type FlushResponse struct {
+	// Recovered is the number of follows moved from the error spool into the follows table.
+	Recovered int64 `json:"recovered"`
+	// Spooled is the number of follows still left in the error spool.
+	Spooled int64 `json:"spooled"`
+}
+
+func (s *smallifier) followQueueStatus(ctx context.Context) (FollowQueueStatus, error) {
+	status := FollowQueueStatus{
+		Depth:           atomic.LoadInt64(&s.pendingFollows),
+		OldestPendingTS: atomic.LoadInt64(&s.headFollowTS),
+	}
+	// Between batches, none is being written, so the oldest is the one waiting at the head of the queue, or if that is
+	// empty, of those waiting to be journaled.
+	if status.OldestPendingTS == 0 {
+		status.OldestPendingTS = s.follows.oldestTS()
+	}
+	if status.OldestPendingTS == 0 && s.unjournaled != nil {
+		status.OldestPendingTS = s.unjournaled.oldestTS()
+	}
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM follow_errors`).Scan(&status.Spooled)
+	return status, err
+}
+
+// flushFollows waits, for at most flushFollowsTimeout, for the follows queued before it was called to be written, then
+// retries inserting every follow in the error spool. Follows queued since aren't waited for, so that it returns even
+// while links are being followed steadily.
+func (s *smallifier) flushFollows(ctx context.Context) (FlushResponse, error) {
+	var resp FlushResponse
+
+	drainCtx, cancel := context.WithTimeout(ctx, flushFollowsTimeout)
+	defer cancel()
+	// Follows waiting to be journaled are only queued to be written once they have been.
+	if s.journal != nil {
+		if err := s.unjournaled.waitDone(drainCtx, s.unjournaled.pushedCount()); err != nil {
+			return resp, err
+		}
+	}
+	if err := s.follows.waitDone(drainCtx, s.follows.pushedCount()); err != nil {
+		return resp, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT id, short_path, ts, ip, forwarded_for, COALESCE(bundle_item, 0), COALESCE(user_agent, ''), COALESCE(referer, '') FROM follow_errors ORDER BY id`)
+	if err != nil {
+		return resp, err
+	}
+	type spooled struct {
+		id int64
+		f  follow
+	}
+	var toRetry []spooled
+	for rows.Next() {
+		var sp spooled
+		var forwardedFor *string
+		if err := rows.Scan(&sp.id, &sp.f.shortPath, &sp.f.timestamp, &sp.f.ip, &forwardedFor, &sp.f.bundleItem, &sp.f.userAgent, &sp.f.referer); err != nil {
+			rows.Close()
+			return resp, err
+		}
+		if forwardedFor != nil {
+			sp.f.forwardedFor = *forwardedFor
+		}
+		toRetry = append(toRetry, sp)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return resp, err
+	}
+
+	for _, sp := range toRetry {
+		if err := s.unspoolFollow(ctx, sp.id, sp.f); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+				"id":  sp.id,
+			}).Error("Error recovering spooled follow")
+			atomic.AddUint64(&s.dbUpdateErrorCount, 1)
+			resp.Spooled++
+			continue
+		}
+		resp.Recovered++
+	}
+	return resp, nil
+}
+
+// unspoolFollow atomically moves the spooled follow with the given id into the follows table.
+func (s *smallifier) unspoolFollow(ctx context.Context, id int64, f follow) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO follows (short_path, ts, ip, forwarded_for, client_key, bundle_item, user_agent, referer) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`, f.shortPath, f.timestamp, f.ip, f.forwardedFor, s.clientKey(f.ip), nullIfZero(f.bundleItem), s.userAgent(f), nullIfEmpty(f.referer)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM follow_errors WHERE id = $1`, id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// nullIfZero converts n to a value to store in a nullable column, where 0 means NULL.
+func nullIfZero(n int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(n), Valid: n != 0}
+}
+
+// nullIfEmpty converts s to a value to store in a nullable column, where "" means NULL.
+func nullIfEmpty(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// WithoutFollowHeaders stops the User-Agent and Referer headers of requests following links being recorded with their
+// follows, for privacy. User-Agents are still used to tell repeated follows apart, but aren't stored in the database.
+func WithoutFollowHeaders() Option {
+	return func(s *smallifier) {
+		s.dropFollowHeaders = true
+	}
+}
+
+// userAgent returns the User-Agent of f to store in the database, which is NULL if WithoutFollowHeaders was given.
+func (s *smallifier) userAgent(f follow) sql.NullString {
+	if s.dropFollowHeaders {
+		return sql.NullString{}
+	}
+	return nullIfEmpty(f.userAgent)
+}
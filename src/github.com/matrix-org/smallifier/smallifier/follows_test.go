@@ -0,0 +1,48 @@
+package smallifier
+
+import (
+	"database/sql"
+	"net/http"
+	"testing"
+)
+
+func followWithHeaders(t *testing.T, f fixture, shortened string) (userAgent, referer sql.NullString) {
+	client := insecureClient()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	req, err := http.NewRequest("GET", shortened, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("User-Agent", "Synapse (bot; +https://github.com/matrix-org/synapse)")
+	req.Header.Set("Referer", "https://lemurs.win/blog")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	waitForFollows(f)
+	if err := f.db.QueryRow(`SELECT user_agent, referer FROM follows WHERE short_path = $1`, shortened[len(f.base):]).Scan(&userAgent, &referer); err != nil {
+		t.Fatal(err)
+	}
+	return userAgent, referer
+}
+
+func TestFollowHeaders(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	userAgent, referer := followWithHeaders(t, f, shorten(t, f.server.URL, "https://lemurs.win/"))
+	if userAgent.String != "Synapse (bot; +https://github.com/matrix-org/synapse)" || referer.String != "https://lemurs.win/blog" {
+		t.Errorf("want user agent and referer recorded got %q, %q", userAgent.String, referer.String)
+	}
+}
+
+func TestWithoutFollowHeaders(t *testing.T) {
+	f := serve(t, WithoutFollowHeaders())
+	defer f.Close()
+
+	userAgent, referer := followWithHeaders(t, f, shorten(t, f.server.URL, "https://lemurs.win/"))
+	if userAgent.Valid || referer.Valid {
+		t.Errorf("want neither recorded got %q, %q", userAgent.String, referer.String)
+	}
+}
@@ -0,0 +1,125 @@
+package smallifier
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// GeoBlock lists the countries and autonomous systems whose clients may not follow a link, or any link with a tag.
+// Exactly one of ShortURL and Tag is set.
+type GeoBlock struct {
+	ShortURL  string   `json:"short_url,omitempty"`
+	Tag       string   `json:"tag,omitempty"`
+	Countries []string `json:"countries"`
+	ASNs      []uint32 `json:"asns"`
+}
+
+// setGeoBlock replaces the blocks on b's link or tag with b's.
+func (s *smallifier) setGeoBlock(ctx context.Context, b GeoBlock) error {
+	scopeKind, scope := "tag", b.Tag
+	if b.ShortURL != "" {
+		if b.Tag != "" || !strings.HasPrefix(b.ShortURL, s.base.String()) {
+			return errors.New("Must specify one of a short_url of this smallifier or a tag")
+		}
+		scopeKind, scope = "link", b.ShortURL[len(s.base.String()):]
+	} else if b.Tag == "" {
+		return errors.New("Must specify one of a short_url of this smallifier or a tag")
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM geo_blocks WHERE scope_kind = $1 AND scope = $2`, scopeKind, scope); err != nil {
+		tx.Rollback()
+		return err
+	}
+	insert := func(kind, value string) error {
+		_, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO geo_blocks (scope_kind, scope, kind, value) VALUES ($1, $2, $3, $4)`, scopeKind, scope, kind, value)
+		return err
+	}
+	for _, country := range b.Countries {
+		if err := insert("country", strings.ToUpper(country)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for _, asn := range b.ASNs {
+		if err := insert("asn", strconv.FormatUint(uint64(asn), 10)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// geoBlocks lists every link and tag with blocks.
+func (s *smallifier) geoBlocks(ctx context.Context) ([]GeoBlock, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT scope_kind, scope, kind, value FROM geo_blocks ORDER BY scope_kind, scope, kind, value`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	blocks := []GeoBlock{}
+	for rows.Next() {
+		var scopeKind, scope, kind, value string
+		if err := rows.Scan(&scopeKind, &scope, &kind, &value); err != nil {
+			return nil, err
+		}
+		b := GeoBlock{Tag: scope}
+		if scopeKind == "link" {
+			b = GeoBlock{ShortURL: s.base.String() + scope}
+		}
+		if n := len(blocks); n == 0 || blocks[n-1].ShortURL != b.ShortURL || blocks[n-1].Tag != b.Tag {
+			blocks = append(blocks, b)
+		}
+		last := &blocks[len(blocks)-1]
+		if kind == "country" {
+			last.Countries = append(last.Countries, value)
+		} else if asn, err := strconv.ParseUint(value, 10, 32); err == nil {
+			last.ASNs = append(last.ASNs, uint32(asn))
+		}
+	}
+	return blocks, rows.Err()
+}
+
+// geoBlocked reports whether the client making req is blocked from following the link at shortPath,
+// by a block on the link or any of its tags.
+func (s *smallifier) geoBlocked(ctx context.Context, req *http.Request, shortPath string) (bool, error) {
+	ip := net.ParseIP(remoteIP(req))
+	if ip == nil {
+		return false, nil
+	}
+	info, ok := s.geoIP.Lookup(ip)
+	if !ok {
+		return false, nil
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT 1 FROM geo_blocks
+		WHERE ((scope_kind = 'link' AND scope = $1) OR (scope_kind = 'tag' AND scope IN (SELECT tag FROM link_tags WHERE short_path = $1)))
+		AND ((kind = 'country' AND value = $2) OR (kind = 'asn' AND value = $3)) LIMIT 1`,
+		shortPath, info.Country, strconv.FormatUint(uint64(info.ASN), 10))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	blocked := rows.Next()
+	if blocked {
+		log.WithFields(log.Fields{
+			"short_path": shortPath,
+			"country":    info.Country,
+			"asn":        info.ASN,
+		}).Info("Blocked follow by location")
+	}
+	return blocked, rows.Err()
+}
+
+// writeGeoBlocked responds to a client which may not follow a link from its location.
+func (s *smallifier) writeGeoBlocked(w http.ResponseWriter) {
+	s.render(w, 451, "geoblocked", nil)
+}
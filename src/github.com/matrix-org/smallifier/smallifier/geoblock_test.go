@@ -0,0 +1,50 @@
+package smallifier
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestGeoBlock(t *testing.T) {
+	g, err := ParseGeoIPCSV(strings.NewReader("127.0.0.0/8,ZZ,64512\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := serve(t, WithGeoIP(g))
+	defer f.Close()
+
+	byCountry := shorten(t, f.server.URL, f.server.URL+"/_stub?country")
+	byASN := shortenTagged(t, f, f.server.URL+"/_stub?asn", "restricted")
+	unblocked := shorten(t, f.server.URL, f.server.URL+"/_stub?unblocked")
+
+	for _, body := range []string{
+		`{"short_url": "` + byCountry + `", "countries": ["zz"]}`,
+		`{"tag": "restricted", "asns": [64512]}`,
+	} {
+		resp := adminBodyRequest(t, f, "PUT", "geoblocks", testSecret, body)
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Fatalf("%s: want status code 200 got %d", body, resp.StatusCode)
+		}
+	}
+	var blocks []GeoBlock
+	decodeAdminResponse(t, f, "GET", "geoblocks", &blocks)
+	if len(blocks) != 2 {
+		t.Errorf("listing blocks: want 2 got %+v", blocks)
+	}
+
+	client := insecureClient()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	for link, want := range map[string]int{byCountry: 451, byASN: 451, unblocked: 302} {
+		resp, err := client.Get(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%s: want status code %d got %d", link, want, resp.StatusCode)
+		}
+	}
+	assertFollowCount(f, byCountry[len(f.base):], 0, "blocked follow:")
+}
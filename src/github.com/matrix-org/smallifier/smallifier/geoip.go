@@ -0,0 +1,187 @@
+package smallifier
+
+import (
+	"encoding/binary"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// GeoInfo is what is known about where a client is.
+type GeoInfo struct {
+	// Country is the client's ISO 3166-1 alpha-2 country code, e.g. "GB", or "" if unknown.
+	Country string
+	// ASN is the number of the autonomous system announcing the client's address, or 0 if unknown.
+	ASN uint32
+}
+
+// GeoIP looks up where clients are.
+type GeoIP interface {
+	// Lookup returns what is known about ip, and whether anything is.
+	Lookup(ip net.IP) (GeoInfo, bool)
+}
+
+// WithGeoIP sets the database used to locate clients, e.g. for geographic blocking.
+func WithGeoIP(g GeoIP) Option {
+	return func(s *smallifier) {
+		s.geoIP = g
+	}
+}
+
+// csvGeoIP is a GeoIP backed by disjoint ranges of addresses, in order, each with what is known about the most
+// specific network containing it, so that lookups are a binary search.
+type csvGeoIP []csvGeoIPRange
+
+type csvGeoIPRange struct {
+	first, last ipKey
+	info        GeoInfo
+}
+
+type csvGeoIPNetwork struct {
+	first, last ipKey
+	info        GeoInfo
+}
+
+// ipKey is an IPv6 address, or an IPv4 address mapped into IPv6, as a number.
+type ipKey struct {
+	hi, lo uint64
+}
+
+func newIPKey(ip net.IP) ipKey {
+	ip = ip.To16()
+	return ipKey{binary.BigEndian.Uint64(ip[:8]), binary.BigEndian.Uint64(ip[8:])}
+}
+
+func (k ipKey) less(o ipKey) bool {
+	return k.hi < o.hi || (k.hi == o.hi && k.lo < o.lo)
+}
+
+// next returns the address after k, which mustn't be the last.
+func (k ipKey) next() ipKey {
+	if k.lo++; k.lo == 0 {
+		k.hi++
+	}
+	return k
+}
+
+// prev returns the address before k, which mustn't be the first.
+func (k ipKey) prev() ipKey {
+	if k.lo--; k.lo == ^uint64(0) {
+		k.hi--
+	}
+	return k
+}
+
+// ParseGeoIPCSV reads a GeoIP database from CSV rows of the form "network,country,asn", e.g. "192.0.2.0/24,GB,64500".
+// The country or ASN may be empty if unknown. Lines starting with "#" are ignored.
+// Where networks overlap, the most specific wins.
+func ParseGeoIPCSV(r io.Reader) (GeoIP, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = 3
+	var networks []csvGeoIPNetwork
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		_, network, err := net.ParseCIDR(strings.TrimSpace(record[0]))
+		if err != nil {
+			return nil, err
+		}
+		mask := network.Mask
+		if len(mask) == net.IPv4len {
+			mask = append(net.CIDRMask(96, 128)[:12], mask...)
+		}
+		last := make(net.IP, net.IPv6len)
+		for i, b := range network.IP.To16() {
+			last[i] = b | ^mask[i]
+		}
+		n := csvGeoIPNetwork{
+			first: newIPKey(network.IP),
+			last:  newIPKey(last),
+			info:  GeoInfo{Country: strings.ToUpper(strings.TrimSpace(record[1]))},
+		}
+		if asn := strings.TrimSpace(record[2]); asn != "" {
+			v, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(asn), "AS"), 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("network %s: bad ASN %q", record[0], asn)
+			}
+			n.info.ASN = uint32(v)
+		}
+		networks = append(networks, n)
+	}
+	return flattenGeoIPNetworks(networks), nil
+}
+
+// flattenGeoIPNetworks returns the ranges of addresses in networks, each with the info of the most specific network
+// containing it, or of the first listed of identical networks. Networks either contain one another or are disjoint,
+// so after sorting them by first address, then by size, each is contained by those still open before it.
+func flattenGeoIPNetworks(networks []csvGeoIPNetwork) csvGeoIP {
+	sort.SliceStable(networks, func(i, j int) bool {
+		if networks[i].first != networks[j].first {
+			return networks[i].first.less(networks[j].first)
+		}
+		return networks[j].last.less(networks[i].last)
+	})
+	var g csvGeoIP
+	// next is the first address not yet in a range, unless done, when every address is.
+	var next ipKey
+	done := false
+	emit := func(first, last ipKey, info GeoInfo) {
+		if done || last.less(first) {
+			return
+		}
+		g = append(g, csvGeoIPRange{first, last, info})
+		if last == (ipKey{^uint64(0), ^uint64(0)}) {
+			done = true
+		} else {
+			next = last.next()
+		}
+	}
+	var open []csvGeoIPNetwork
+	closeNetwork := func() {
+		n := open[len(open)-1]
+		open = open[:len(open)-1]
+		emit(next, n.last, n.info)
+	}
+	for _, n := range networks {
+		for len(open) > 0 && open[len(open)-1].last.less(n.first) {
+			closeNetwork()
+		}
+		if len(open) > 0 {
+			outer := open[len(open)-1]
+			if outer.first == n.first && outer.last == n.last {
+				continue
+			}
+			if next.less(n.first) {
+				emit(next, n.first.prev(), outer.info)
+			}
+		}
+		next = n.first
+		open = append(open, n)
+	}
+	for len(open) > 0 {
+		closeNetwork()
+	}
+	return g
+}
+
+func (g csvGeoIP) Lookup(ip net.IP) (GeoInfo, bool) {
+	if ip.To16() == nil {
+		return GeoInfo{}, false
+	}
+	k := newIPKey(ip)
+	i := sort.Search(len(g), func(i int) bool { return !g[i].last.less(k) })
+	if i == len(g) || k.less(g[i].first) {
+		return GeoInfo{}, false
+	}
+	return g[i].info, true
+}
@@ -0,0 +1,49 @@
+package smallifier
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseGeoIPCSV(t *testing.T) {
+	g, err := ParseGeoIPCSV(strings.NewReader(`# network,country,asn
+192.0.2.0/24,gb,AS64500
+192.0.2.128/25,FR,
+192.0.2.160/27,DE,
+192.0.2.128/25,NL,
+10.0.0.0/8,,64502
+2001:db8::/32,,64501
+ffff::/16,,64503
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		ip   string
+		want GeoInfo
+		ok   bool
+	}{
+		{"192.0.2.1", GeoInfo{"GB", 64500}, true},
+		{"192.0.2.127", GeoInfo{"GB", 64500}, true},
+		{"192.0.2.128", GeoInfo{"FR", 0}, true},
+		{"192.0.2.170", GeoInfo{"DE", 0}, true},
+		{"192.0.2.191", GeoInfo{"DE", 0}, true},
+		{"192.0.2.200", GeoInfo{"FR", 0}, true},
+		{"192.0.2.255", GeoInfo{"FR", 0}, true},
+		{"10.255.255.255", GeoInfo{"", 64502}, true},
+		{"2001:db8::1", GeoInfo{"", 64501}, true},
+		{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", GeoInfo{"", 64503}, true},
+		{"192.0.3.0", GeoInfo{}, false},
+		{"198.51.100.1", GeoInfo{}, false},
+	} {
+		got, ok := g.Lookup(net.ParseIP(tc.ip))
+		if ok != tc.ok || got != tc.want {
+			t.Errorf("%s: want %+v, %t got %+v, %t", tc.ip, tc.want, tc.ok, got, ok)
+		}
+	}
+
+	if _, err := ParseGeoIPCSV(strings.NewReader("192.0.2.0/24,GB,lemur\n")); err == nil {
+		t.Error("bad ASN: want error got nil")
+	}
+}
@@ -0,0 +1,121 @@
+package smallifier
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Heatmap is the JSON-encoded response counting the follows of a link, or links with a tag, by when they happened.
+type Heatmap struct {
+	ShortURL string `json:"short_url,omitempty"`
+	Tag      string `json:"tag,omitempty"`
+	Start    int64  `json:"start"`
+	End      int64  `json:"end"`
+	// TZ is the name of the time zone in which days and hours are counted.
+	TZ string `json:"tz"`
+	// Follows counts follows by day of week, starting with Sunday, then hour of day, in TZ.
+	Follows [7][24]int64 `json:"follows"`
+}
+
+// heatmapQuery is the parsed query of a request for a Heatmap:
+//
+//	short_url or tag   the link, or links with the tag, to count follows of.
+//	start, end         unix timestamps bounding the follows counted, by default the last 28 days.
+//	tz                 IANA time zone name, e.g. Europe/London, by default UTC.
+type heatmapQuery struct {
+	shortPath, tag string
+	start, end     time.Time
+	loc            *time.Location
+}
+
+// parseHeatmapQuery parses q, with short_url relative to base, defaulting to the 28 days up to now.
+func parseHeatmapQuery(q url.Values, base string, now time.Time) (heatmapQuery, error) {
+	h := heatmapQuery{tag: q.Get("tag"), end: now.Truncate(time.Hour).Add(time.Hour), loc: time.UTC}
+	h.start = h.end.AddDate(0, 0, -28)
+	if shortURL := q.Get("short_url"); shortURL != "" {
+		if h.tag != "" || !strings.HasPrefix(shortURL, base) {
+			return h, errors.New("Must specify one of a short_url of this smallifier or a tag")
+		}
+		h.shortPath = shortURL[len(base):]
+	} else if h.tag == "" {
+		return h, errors.New("Must specify one of a short_url of this smallifier or a tag")
+	}
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"start", &h.start}, {"end", &h.end}} {
+		if v := q.Get(p.name); v != "" {
+			ts, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return h, errors.New(p.name + " must be a unix timestamp")
+			}
+			*p.t = time.Unix(ts, 0)
+		}
+	}
+	if tz := q.Get("tz"); tz != "" {
+		var err error
+		if h.loc, err = time.LoadLocation(tz); err != nil {
+			return h, errors.New("Unknown time zone")
+		}
+	}
+	return h, nil
+}
+
+// heatmap counts follows as described by h.
+func (s *smallifier) heatmap(ctx context.Context, h heatmapQuery) (Heatmap, error) {
+	m := Heatmap{Tag: h.tag, Start: h.start.Unix(), End: h.end.Unix(), TZ: h.loc.String()}
+	if h.shortPath != "" {
+		m.ShortURL = s.base.String() + h.shortPath
+	}
+	// Follows are grouped by local hour in the database, by adding the offset of loc in effect at the time of each to
+	// its timestamp, so that only one row per hour is read however many follows there were. No follows are from before
+	// the epoch or the future, so offsets are only needed in between, however long the period asked for.
+	from, to := h.start, h.end
+	if from.Unix() < 0 {
+		from = time.Unix(0, 0)
+	}
+	if now := s.clock.Now(); to.After(now) {
+		to = now
+	}
+	offset, args := zoneOffsetSQL(from.In(h.loc), to)
+	args = append(args, m.Start, m.End, h.tag, h.shortPath)
+	last := len(args)
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(`SELECT (ts + %s) / 3600 AS hour, COUNT(*) FROM follows
+		WHERE ts >= $%d AND ts < $%d
+		AND ($%d = '' OR short_path IN (SELECT short_path FROM link_tags WHERE tag = $%d))
+		AND ($%d = '' OR short_path = $%d)
+		GROUP BY hour`, offset, last-3, last-2, last-1, last-1, last, last), args...)
+	if err != nil {
+		return m, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hour, n int64
+		if err := rows.Scan(&hour, &n); err != nil {
+			return m, err
+		}
+		// hour counts local hours since the epoch, so its wall clock is that of the same time in UTC.
+		t := time.Unix(hour*3600, 0).UTC()
+		m.Follows[t.Weekday()][t.Hour()] += n
+	}
+	return m, rows.Err()
+}
+
+func (s *smallifier) writeHeatmap(ctx context.Context, w http.ResponseWriter, q heatmapQuery) {
+	m, err := s.heatmap(ctx, q)
+	if err != nil {
+		log.WithField("err", err).Error("Error counting follows for heatmap")
+		writeError(w, 500, ErrCodeUnknown, "internal server error")
+		return
+	}
+	json.NewEncoder(w).Encode(m)
+}
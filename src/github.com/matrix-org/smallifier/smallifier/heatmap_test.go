@@ -0,0 +1,47 @@
+package smallifier
+
+import (
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHeatmap(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	link := shortenTagged(t, f, f.server.URL+"/_stub", "spring")
+	other := shorten(t, f.server.URL, "https://lemurs.win")
+	// Wednesday 1 January 2025, 23:30 UTC, which is Thursday 08:30 in Tokyo.
+	ts := time.Date(2025, 1, 1, 23, 30, 0, 0, time.UTC).Unix()
+	for _, shortURL := range []string{link, link, other} {
+		if _, err := f.db.Exec(`INSERT INTO follows (short_path, ts, ip) VALUES ($1, $2, '127.0.0.1')`, shortURL[len(f.base):], ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start, end := strconv.FormatInt(ts-3600, 10), strconv.FormatInt(ts+3600, 10)
+	var m Heatmap
+	decodeAdminResponse(t, f, "GET", "heatmap?tag=spring&start="+start+"&end="+end, &m)
+	if m.Follows[time.Wednesday][23] != 2 {
+		t.Errorf("UTC: want 2 follows on Wednesday at 23:00 got %v", m.Follows)
+	}
+
+	decodeAdminResponse(t, f, "GET", "heatmap?short_url="+url.QueryEscape(other)+"&tz=Asia/Tokyo&start="+start+"&end="+end, &m)
+	if m.Follows[time.Thursday][8] != 1 || m.TZ != "Asia/Tokyo" {
+		t.Errorf("Tokyo: want 1 follow on Thursday at 08:00 got %v in %s", m.Follows, m.TZ)
+	}
+
+	// India is offset from UTC by five and a half hours, so the follow is at 05:00 there, not in the UTC hour's 04:30.
+	decodeAdminResponse(t, f, "GET", "heatmap?short_url="+url.QueryEscape(other)+"&tz=Asia/Kolkata&start="+start+"&end="+end, &m)
+	if m.Follows[time.Thursday][5] != 1 {
+		t.Errorf("Kolkata: want 1 follow on Thursday at 05:00 got %v", m.Follows)
+	}
+
+	resp := adminRequest(t, f, "GET", "heatmap?tz=Asia/Tokyo", testSecret)
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Error("no link or tag: want status code 400 got", resp.StatusCode)
+	}
+}
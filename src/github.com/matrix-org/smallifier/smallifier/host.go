@@ -0,0 +1,88 @@
+package smallifier
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// badHostWarnInterval is the least time between warnings about requests for unexpected hosts. Those in between are
+// logged at debug level, so that misrouted traffic, which may be every request, doesn't flood the logs.
+const badHostWarnInterval = time.Minute
+
+// WithHostCheck makes Handler check the Host header of each request against the host of the base URL and hosts,
+// logging requests for any other host, warning of them at most once a minute, and refusing them with 421 Misdirected
+// Request if reject is set.
+// This catches traffic misrouted by a reverse proxy, and stops responses for other hosts being cached as ours.
+// A host without a port matches requests for it on any port.
+func WithHostCheck(reject bool, hosts ...string) Option {
+	return func(s *smallifier) {
+		s.hostCheck = true
+		s.rejectBadHosts = reject
+		s.allowedHosts = hosts
+	}
+}
+
+// hostAllowed reports whether host, the value of a Host header, is one of the hosts links are served on.
+func (s *smallifier) hostAllowed(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	for _, allowed := range append([]string{s.base.Host}, s.allowedHosts...) {
+		allowed = strings.TrimSuffix(strings.ToLower(allowed), ".")
+		if host == allowed {
+			return true
+		}
+		if _, _, err := net.SplitHostPort(allowed); err != nil && hostname == strings.Trim(allowed, "[]") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHost wraps next, logging or refusing requests for hosts not allowed by WithHostCheck.
+func (s *smallifier) checkHost(next http.Handler) http.Handler {
+	if !s.hostCheck {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if s.hostAllowed(req.Host) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		atomic.AddUint64(&s.badHostCount, 1)
+		entry := log.WithFields(log.Fields{
+			"host":   req.Host,
+			"path":   req.URL.Path,
+			"reject": s.rejectBadHosts,
+		})
+		if s.warnOfBadHost() {
+			entry.WithField("since_last_warning", atomic.SwapUint64(&s.badHostCount, 0)).Warn("Request for unexpected host")
+		} else {
+			entry.Debug("Request for unexpected host")
+		}
+		if !s.rejectBadHosts {
+			next.ServeHTTP(w, req)
+			return
+		}
+		setHeaders(w)
+		writeError(w, 421, ErrCodeUnrecognized, "unknown host")
+	})
+}
+
+// warnOfBadHost reports whether a request for an unexpected host should be warned of, as none has been for
+// badHostWarnInterval.
+func (s *smallifier) warnOfBadHost() bool {
+	now := s.clock.Now().UnixNano()
+	last := atomic.LoadInt64(&s.badHostWarnTS)
+	if last != 0 && now-last < int64(badHostWarnInterval) {
+		return false
+	}
+	return atomic.CompareAndSwapInt64(&s.badHostWarnTS, last, now)
+}
@@ -0,0 +1,77 @@
+package smallifier
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestHostAllowed(t *testing.T) {
+	u, _ := url.Parse("https://mtrx.to/")
+	s := &smallifier{base: *u, allowedHosts: []string{"www.mtrx.to", "localhost:8008"}}
+	for _, tc := range []struct {
+		host string
+		want bool
+	}{
+		{"mtrx.to", true},
+		{"MTRX.to.", true},
+		{"mtrx.to:443", true},
+		{"www.mtrx.to", true},
+		{"localhost:8008", true},
+		{"localhost:8009", false},
+		{"localhost", false},
+		{"evil.example", false},
+		{"mtrx.to.evil.example", false},
+		{"", false},
+	} {
+		if got := s.hostAllowed(tc.host); got != tc.want {
+			t.Errorf("%q: want %t got %t", tc.host, tc.want, got)
+		}
+	}
+}
+
+func TestCheckHost(t *testing.T) {
+	u, _ := url.Parse("https://mtrx.to/")
+	ok := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	for _, tc := range []struct {
+		reject bool
+		host   string
+		want   int
+	}{
+		{true, "mtrx.to", 200},
+		{true, "evil.example", 421},
+		{false, "evil.example", 200},
+	} {
+		s := &smallifier{base: *u, clock: SystemClock}
+		WithHostCheck(tc.reject)(s)
+		req := httptest.NewRequest("GET", "/tj2TEXT7", nil)
+		req.Host = tc.host
+		w := httptest.NewRecorder()
+		s.checkHost(ok).ServeHTTP(w, req)
+		if w.Code != tc.want {
+			t.Errorf("reject %t, host %q: want status code %d got %d", tc.reject, tc.host, tc.want, w.Code)
+		}
+	}
+}
+
+func TestWarnOfBadHost(t *testing.T) {
+	clock := newFakeClock()
+	s := &smallifier{clock: clock}
+	for _, tc := range []struct {
+		advance time.Duration
+		want    bool
+	}{
+		{0, true},
+		{time.Second, false},
+		{badHostWarnInterval - 2*time.Second, false},
+		{time.Second, true},
+		{0, false},
+	} {
+		clock.advance(tc.advance)
+		if got := s.warnOfBadHost(); got != tc.want {
+			t.Errorf("after %v: want warning %t got %t", tc.advance, tc.want, got)
+		}
+	}
+}
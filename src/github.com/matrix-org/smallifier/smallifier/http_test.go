@@ -1,9 +1,12 @@
 package smallifier
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -12,13 +15,14 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
-
-	_ "github.com/mattn/go-sqlite3"
 )
 
 var (
@@ -44,7 +48,7 @@ func TestRoundtrip(t *testing.T) {
 	}
 }
 
-func shorten(t *testing.T, serverBaseURL, toShorten string) string {
+func shorten(t testing.TB, serverBaseURL, toShorten string) string {
 	resp, err := insecureClient().Post(serverBaseURL+"/_create", "application/json", strings.NewReader(`{
 		"long_url": "`+toShorten+`",
 		"secret": "`+testSecret+`"
@@ -64,6 +68,68 @@ func shorten(t *testing.T, serverBaseURL, toShorten string) string {
 	return r.ShortURL
 }
 
+func TestRoundtripIsByteExact(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	client := insecureClient()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	for _, link := range []string{
+		"https://matrix.to/#/#room:lemurs.win",
+		"https://matrix.to/#/%23room:lemurs.win/$event?via=lemurs.win",
+		"https://Lemurs.win/a%2Fb%2f/../c?q=%E2%9C%93&r=a+b&r=%26#Frag%20ment",
+		"https://lemurs.win/search?q=" + strings.Repeat("ringtail%20", 20),
+	} {
+		b, err := json.Marshal(CreateRequest{LongURL: link, Secret: testSecret})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Post(f.server.URL+"/_create", "application/json", bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var created Response
+		err = json.NewDecoder(resp.Body).Decode(&created)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err = client.Get(created.ShortURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("Location"); got != link {
+			t.Errorf("want redirect to %q got %q", link, got)
+		}
+	}
+}
+
+func TestUnfaithfulURL(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	for _, link := range []string{
+		"https://lemurs.win/ring tail",
+		"https://lemurs.win/\r\nX-Lemur: 1",
+		"https://lemurs.win/✓",
+	} {
+		b, err := json.Marshal(CreateRequest{LongURL: link, Secret: testSecret})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := insecureClient().Post(f.server.URL+"/_create", "application/json", bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 400 {
+			t.Errorf("%q: want status code 400 got %d", link, resp.StatusCode)
+		}
+	}
+}
+
 func TestNonHTTPS(t *testing.T) {
 	f := serve(t)
 	defer f.Close()
@@ -139,7 +205,7 @@ func TestRecordsStats(t *testing.T) {
 	f := serve(t)
 	defer f.Close()
 
-	shortened := shorten(t, f.server.URL, f.base+"/_stub")
+	shortened := shorten(t, f.server.URL, f.server.URL+"/_stub")
 	shortPath := shortened[len(f.base):]
 
 	r := f.db.QueryRow(`SELECT create_ts FROM links WHERE short_path = $1`, shortPath)
@@ -168,6 +234,36 @@ func TestRecordsStats(t *testing.T) {
 
 }
 
+func TestHeadIsNotAFollow(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	shortened := shorten(t, f.server.URL, f.server.URL+"/_stub")
+	client := insecureClient()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	for _, tc := range []struct {
+		url  string
+		want int
+	}{
+		{shortened, 302},
+		{f.base + "tj2TEXT7", 404},
+	} {
+		resp, err := client.Head(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.want || len(b) != 0 {
+			t.Errorf("HEAD %s: want status code %d and no body got %d and %q", tc.url, tc.want, resp.StatusCode, b)
+		}
+		if tc.want == 302 && resp.Header.Get("Location") != f.server.URL+"/_stub" {
+			t.Errorf("HEAD %s: want Location %s got %q", tc.url, f.server.URL+"/_stub", resp.Header.Get("Location"))
+		}
+	}
+	assertFollowCount(f, shortened[len(f.base):], 0, "after HEAD:")
+}
+
 func TestDelete(t *testing.T) {
 	f := serve(t)
 	defer f.Close()
@@ -181,8 +277,175 @@ func TestDelete(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != 404 {
-		t.Errorf("after delete want 404 got %d", resp.StatusCode)
+	if resp.StatusCode != 410 {
+		t.Errorf("after delete want 410 got %d", resp.StatusCode)
+	}
+}
+
+func TestDeleteByShortPath(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	shortened := shorten(t, f.server.URL, f.server.URL+"/_stub")
+	resp, err := insecureClient().Post(f.server.URL+"/_delete", "application/json", strings.NewReader(`{
+		"short_path": "`+shortened[len(f.base):]+`",
+		"secret": "`+testSecret+`"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatal("delete by short path: want status code 200 got", resp.StatusCode)
+	}
+
+	resp, err = insecureClient().Get(shortened)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 410 {
+		t.Errorf("after delete want 410 got %d", resp.StatusCode)
+	}
+}
+
+func TestFollowsDeletedWithLink(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	shortened := shorten(t, f.server.URL, f.server.URL+"/_stub")
+	shortPath := shortened[len(f.base):]
+	resp, err := insecureClient().Get(shortened)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assertFollowCount(f, shortPath, 1, "before deleting link:")
+
+	if _, err := f.db.Exec(`DELETE FROM links WHERE short_path = $1`, shortPath); err != nil {
+		t.Fatal(err)
+	}
+	assertFollowCount(f, shortPath, 0, "after deleting link:")
+}
+
+func TestMigrateFollowsForeignKey(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	for _, stmt := range []string{
+		`CREATE TABLE links(short_path TEXT NOT NULL PRIMARY KEY, long_url TEXT NOT NULL, create_ts BIGINT NOT NULL, create_ip TEXT NOT NULL, create_forwarded_for TEXT, deleted INTEGER NOT NULL DEFAULT 0)`,
+		`CREATE TABLE follows(id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, short_path TEXT NOT NULL, ts BIGINT NOT NULL, ip TEXT NOT NULL, forwarded_for TEXT)`,
+		`INSERT INTO links (short_path, long_url, create_ts, create_ip) VALUES ('lemurs', 'https://lemurs.example/', 0, '127.0.0.1'), ('bundle', '', 0, '127.0.0.1')`,
+		`INSERT INTO follows (short_path, ts, ip) VALUES ('lemurs', 1, '127.0.0.1'), ('bundle/3', 2, '127.0.0.1'), ('gone', 3, '127.0.0.1')`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := CreateTables(db); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := db.Query(`SELECT short_path, COALESCE(bundle_item, 0) FROM follows ORDER BY ts`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got []string
+	for rows.Next() {
+		var shortPath string
+		var item int
+		if err := rows.Scan(&shortPath, &item); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%s:%d", shortPath, item))
+	}
+	if want := []string{"lemurs:0", "bundle:3"}; !reflect.DeepEqual(want, got) {
+		t.Errorf("migrated follows: want %v got %v", want, got)
+	}
+
+	if _, err := db.Exec(`DELETE FROM links WHERE short_path = 'lemurs'`); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM follows WHERE short_path = 'lemurs'`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("follows of deleted link after migration: want 0 got %d", n)
+	}
+}
+
+func TestCloseWritesQueuedFollows(t *testing.T) {
+	f := serve(t)
+	defer os.RemoveAll(f.dir)
+	defer f.db.Close()
+
+	shortened := shorten(t, f.server.URL, f.server.URL+"/_stub")
+	shortPath := shortened[len(f.base):]
+	client := insecureClient()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	for i := 0; i < 10; i++ {
+		resp, err := client.Get(shortened)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	f.server.Close()
+	f.smallifier.Close()
+
+	var got int
+	if err := f.db.QueryRow(`SELECT COUNT(*) FROM follows WHERE short_path = $1`, shortPath).Scan(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got != 10 {
+		t.Errorf("follows written by Close: want 10 got %d", got)
+	}
+}
+
+func TestShutdownGivesUp(t *testing.T) {
+	f := serve(t)
+	defer os.RemoveAll(f.dir)
+	defer f.db.Close()
+	f.server.Close()
+
+	// A notification still being sent holds up shutting down.
+	s := f.smallifier.(*smallifier)
+	s.notifications.Add(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := f.smallifier.Shutdown(ctx); err == nil || !strings.Contains(err.Error(), "deadline exceeded") {
+		t.Errorf("want a deadline exceeded error got %v", err)
+	}
+	s.notifications.Done()
+	if err := f.smallifier.Shutdown(context.Background()); err != nil {
+		t.Errorf("shutting down again: want finished got %v", err)
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	f := serve(t)
+	defer os.RemoveAll(f.dir)
+	defer f.db.Close()
+	f.server.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f.smallifier.Close()
+		}()
+	}
+	wg.Wait()
+	if err := f.smallifier.Shutdown(context.Background()); err != nil {
+		t.Errorf("shutting down after closing: want nil got %v", err)
+	}
+	_, err := f.smallifier.Shorten(context.Background(), CreateRequest{LongURL: "https://lemurs.win/"})
+	if e, ok := err.(*ErrorResponse); !ok || e.ErrCode != ErrCodeUnavailable {
+		t.Errorf("shortening after closing: want %s got %v", ErrCodeUnavailable, err)
 	}
 }
 
@@ -223,6 +486,48 @@ func TestDeleteMissingLink(t *testing.T) {
 	}
 }
 
+func TestBadTimeoutHeader(t *testing.T) {
+	f := serve(t, WithMaxRequestTimeout(time.Second))
+	defer f.Close()
+
+	req, err := http.NewRequest("GET", f.server.URL+"/boohoo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(TimeoutHeader, "soon")
+	resp, err := insecureClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Error("bad timeout header: want status code 400 got", resp.StatusCode)
+	}
+}
+
+func TestTimeoutHeaderIsCapped(t *testing.T) {
+	f := serve(t, WithMaxRequestTimeout(time.Second))
+	defer f.Close()
+
+	// The second would overflow a time.Duration if it were converted before being capped.
+	for _, h := range []string{"3600000", "9223372036854775807"} {
+		req := httptest.NewRequest("GET", "/boohoo", nil)
+		req.Header.Set(TimeoutHeader, h)
+		ctx, cancel, ok := f.smallifier.(*smallifier).requestContext(httptest.NewRecorder(), req)
+		if !ok {
+			t.Fatalf("%s: valid timeout header was rejected", h)
+		}
+		deadline, ok := ctx.Deadline()
+		cancel()
+		if !ok {
+			t.Fatalf("%s: want deadline got none", h)
+		}
+		if remaining := deadline.Sub(time.Now()); remaining > time.Second || remaining < time.Second/2 {
+			t.Errorf("%s: deadline: want about 1s got %v", h, remaining)
+		}
+	}
+}
+
 func deleteShortLink(t *testing.T, serverBaseURL, toDelete string) {
 	resp, err := insecureClient().Post(serverBaseURL+"/_delete", "application/json", strings.NewReader(`{
 		"short_url": "`+toDelete+`",
@@ -238,12 +543,18 @@ func deleteShortLink(t *testing.T, serverBaseURL, toDelete string) {
 	}
 }
 
+// assertFollowCount checks how many follows of shortPath were recorded, which may be <short path>/<position> for an item
+// of a bundle. As follows must reference a link, those of items are recorded against the bundle, with their position.
 func assertFollowCount(f fixture, shortPath string, want int64, msg string) {
-	for atomic.LoadInt64(&f.smallifier.(*smallifier).pendingFollows) > 0 {
-		runtime.Gosched()
-	}
+	waitForFollows(f)
 
-	r := f.db.QueryRow(`SELECT COUNT(*) FROM follows WHERE short_path = $1`, shortPath)
+	position := 0
+	if i := strings.LastIndexByte(shortPath, '/'); i >= 0 {
+		if n, err := strconv.Atoi(shortPath[i+1:]); err == nil && n > 0 {
+			shortPath, position = shortPath[:i], n
+		}
+	}
+	r := f.db.QueryRow(`SELECT COUNT(*) FROM follows WHERE short_path = $1 AND COALESCE(bundle_item, 0) = $2`, shortPath, position)
 	var got int64
 	if err := r.Scan(&got); err != nil {
 		f.t.Fatal(msg, err)
@@ -253,8 +564,15 @@ func assertFollowCount(f fixture, shortPath string, want int64, msg string) {
 	}
 }
 
+// waitForFollows waits until all queued follows have been written to the database.
+func waitForFollows(f fixture) {
+	for atomic.LoadInt64(&f.smallifier.(*smallifier).pendingFollows) > 0 {
+		runtime.Gosched()
+	}
+}
+
 type fixture struct {
-	t          *testing.T
+	t          testing.TB
 	server     *httptest.Server
 	smallifier Smallifier
 	base       string
@@ -264,16 +582,17 @@ type fixture struct {
 
 func (f *fixture) Close() {
 	f.server.Close()
+	f.smallifier.Close()
 	f.db.Close()
 	os.RemoveAll(f.dir)
 }
 
-func serve(t *testing.T) fixture {
+func serve(t testing.TB, opts ...Option) fixture {
 	dir, err := ioutil.TempDir("", "smallifier")
 	if err != nil {
 		t.Fatal(err)
 	}
-	db, err := sql.Open("sqlite3", filepath.Join(dir, "smallifier.db"))
+	db, err := sql.Open(DriverName, filepath.Join(dir, "smallifier.db"))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -285,7 +604,10 @@ func serve(t *testing.T) fixture {
 	server := httptest.NewTLSServer(m)
 	u, _ := url.Parse(server.URL + "/")
 
-	smallifier := New(*u, db, testSecret, 256)
+	smallifier, err := New(context.Background(), *u, db, testSecret, 256, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
 	m.s = smallifier
 	return fixture{
 		t,
@@ -305,11 +627,43 @@ func (m *mux) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	switch req.URL.Path {
 	case "/_create":
 		m.s.CreateHandler(w, req)
+	case "/_bundle":
+		m.s.CreateBundleHandler(w, req)
 	case "/_delete":
 		m.s.DeleteHandler(w, req)
+	case "/_nonce":
+		m.s.NonceHandler(w, req)
+	case "/_links":
+		m.s.LinksHandler(w, req)
+	case "/_intent":
+		m.s.IntentHandler(w, req)
 	case "/_stub":
 		io.WriteString(w, stubResponse)
 	default:
+		if strings.HasPrefix(req.URL.Path, "/_admin/") {
+			m.s.AdminHandler(w, req)
+			return
+		}
+		if strings.HasPrefix(req.URL.Path, "/_read/") {
+			m.s.ReadHandler(w, req)
+			return
+		}
+		if strings.HasPrefix(req.URL.Path, "/_links/") {
+			m.s.LinkHandler(w, req)
+			return
+		}
+		if strings.HasPrefix(req.URL.Path, "/_audit/") {
+			m.s.AuditHandler(w, req)
+			return
+		}
+		if strings.HasPrefix(req.URL.Path, "/_stats/") {
+			m.s.StatsHandler(w, req)
+			return
+		}
+		if strings.HasPrefix(req.URL.Path, "/_qr/") {
+			m.s.QRHandler(w, req)
+			return
+		}
 		m.s.LookupHandler(w, req)
 	}
 }
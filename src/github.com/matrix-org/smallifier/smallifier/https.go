@@ -0,0 +1,52 @@
+package smallifier
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// MinHSTSPreloadMaxAge is the shortest max-age with which browsers' preload lists accept a Strict-Transport-Security header.
+const MinHSTSPreloadMaxAge = 365 * 24 * time.Hour
+
+// WithHSTS makes Handler send a Strict-Transport-Security header telling browsers to only use https for maxAge.
+// If preload is set, the header also covers subdomains and asks to be included in browsers' preload lists,
+// for which maxAge must be at least MinHSTSPreloadMaxAge.
+func WithHSTS(maxAge time.Duration, preload bool) Option {
+	return func(s *smallifier) {
+		if preload && maxAge < MinHSTSPreloadMaxAge {
+			panic("HSTS preloading needs a max-age of at least a year")
+		}
+		s.hsts = "max-age=" + strconv.FormatInt(int64(maxAge/time.Second), 10)
+		if preload {
+			s.hsts += "; includeSubDomains; preload"
+		}
+	}
+}
+
+// setHSTS wraps next, adding the Strict-Transport-Security header configured by WithHSTS to responses.
+func (s *smallifier) setHSTS(next http.Handler) http.Handler {
+	if s.hsts == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Strict-Transport-Security", s.hsts)
+		next.ServeHTTP(w, req)
+	})
+}
+
+// HTTPSRedirectHandler returns an http.Handler for plain-http requests, such as of links typed in from print,
+// which permanently redirects them to the same path and query on the https host of base.
+// GETs and HEADs are redirected with 301; other methods with 308, so that clients repeat them with the same body.
+func HTTPSRedirectHandler(base url.URL) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		u := url.URL{Scheme: "https", Host: base.Host, Path: req.URL.Path, RawPath: req.URL.RawPath, RawQuery: req.URL.RawQuery}
+		status := 301
+		if req.Method != "GET" && req.Method != "HEAD" {
+			status = 308
+		}
+		w.Header().Set("Location", u.String())
+		w.WriteHeader(status)
+	})
+}
@@ -0,0 +1,61 @@
+package smallifier
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestHTTPSRedirect(t *testing.T) {
+	u, _ := url.Parse("https://mtrx.to/s/")
+	h := HTTPSRedirectHandler(*u)
+	for _, tc := range []struct {
+		method   string
+		target   string
+		status   int
+		location string
+	}{
+		{"GET", "http://mtrx.to/s/tj2TEXT7", 301, "https://mtrx.to/s/tj2TEXT7"},
+		{"HEAD", "http://www.mtrx.to/s/fosdem2024?utm_source=poster", 301, "https://mtrx.to/s/fosdem2024?utm_source=poster"},
+		{"POST", "http://mtrx.to/s/_create", 308, "https://mtrx.to/s/_create"},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(tc.method, tc.target, nil))
+		if w.Code != tc.status || w.Header().Get("Location") != tc.location {
+			t.Errorf("%s %s: want %d to %s got %d to %s", tc.method, tc.target, tc.status, tc.location, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
+
+func TestHSTS(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	for _, tc := range []struct {
+		opts []Option
+		want string
+	}{
+		{nil, ""},
+		{[]Option{WithHSTS(time.Hour, false)}, "max-age=3600"},
+		{[]Option{WithHSTS(2*365*24*time.Hour, true)}, "max-age=63072000; includeSubDomains; preload"},
+	} {
+		s := &smallifier{}
+		for _, opt := range tc.opts {
+			opt(s)
+		}
+		w := httptest.NewRecorder()
+		s.setHSTS(ok).ServeHTTP(w, httptest.NewRequest("GET", "/tj2TEXT7", nil))
+		if got := w.Header().Get("Strict-Transport-Security"); got != tc.want {
+			t.Errorf("want Strict-Transport-Security %q got %q", tc.want, got)
+		}
+	}
+}
+
+func TestHSTSPreloadNeedsAYear(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("want panic preloading with a max-age under a year")
+		}
+	}()
+	WithHSTS(30*24*time.Hour, true)(&smallifier{})
+}
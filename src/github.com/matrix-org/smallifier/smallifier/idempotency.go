@@ -0,0 +1,140 @@
+package smallifier
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IdempotencyKeyHeader is the HTTP header clients may set on create requests so that retrying them doesn't create
+// another link: a request with the same key and body as one which succeeded gets the same response.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+const (
+	// idempotencyKeyLifetime is how long the response to a request with an idempotency key is remembered.
+	idempotencyKeyLifetime = 24 * time.Hour
+	// maxIdempotencyKeyLength is the length of the longest idempotency key which is accepted.
+	maxIdempotencyKeyLength = 255
+	// maxIdempotencyKeys is the most requests with idempotency keys which are remembered at once. Once it is reached,
+	// the oldest responses are forgotten early to make room.
+	maxIdempotencyKeys = 100000
+)
+
+// idempotentCreate is a create request with an idempotency key, which is either being handled or succeeded.
+type idempotentCreate struct {
+	key [sha256.Size]byte
+	// sum is the SHA-256 hash of the JSON encoding of the request, so that a key can't be reused for another one.
+	sum [sha256.Size]byte
+	// done is closed once the request has been handled, after which ok and resp are set if it succeeded.
+	done    chan struct{}
+	ok      bool
+	resp    Response
+	expires time.Time
+}
+
+// idempotencyKeys tracks the create requests with each idempotency key, scoped to the client which gave it.
+type idempotencyKeys struct {
+	mu      sync.Mutex
+	creates map[[sha256.Size]byte]*idempotentCreate
+	// finished holds the *idempotentCreates which succeeded, in the order they expire.
+	finished *list.List
+}
+
+// idempotencyKey returns the key under which a request with the idempotency key is remembered for client, so that
+// clients can't see the responses to each other's requests.
+func idempotencyKey(client, key string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(client + "\x00" + key))
+}
+
+// claim returns the create request with key, reporting whether it is new, in which case the caller must handle it and
+// call finish. Otherwise it is being, or was, handled by another call.
+func (k *idempotencyKeys) claim(key, sum [sha256.Size]byte, now time.Time) (c *idempotentCreate, isNew bool, err error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.creates == nil {
+		k.creates = make(map[[sha256.Size]byte]*idempotentCreate)
+		k.finished = list.New()
+	}
+	// Responses expire in the order they were finished, so only the oldest need be looked at.
+	for e := k.finished.Front(); e != nil; e = k.finished.Front() {
+		old := e.Value.(*idempotentCreate)
+		if !now.After(old.expires) && len(k.creates) < maxIdempotencyKeys {
+			break
+		}
+		delete(k.creates, old.key)
+		k.finished.Remove(e)
+	}
+	if c, ok := k.creates[key]; ok {
+		if c.sum != sum {
+			return nil, false, newErrorResponse(422, ErrCodeInvalidParam, "idempotency key was used for another request")
+		}
+		return c, false, nil
+	}
+	if len(k.creates) >= maxIdempotencyKeys {
+		// Every remembered request is still being handled.
+		return nil, false, transientErrorResponse("too many requests with idempotency keys")
+	}
+	c = &idempotentCreate{key: key, sum: sum, done: make(chan struct{})}
+	k.creates[key] = c
+	return c, true, nil
+}
+
+// finish records the response to c, or forgets it if it failed, so that it may be retried.
+func (k *idempotencyKeys) finish(c *idempotentCreate, resp Response, err error, now time.Time) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err == nil {
+		c.ok, c.resp, c.expires = true, resp, now.Add(idempotencyKeyLifetime)
+		k.finished.PushBack(c)
+	} else {
+		delete(k.creates, c.key)
+	}
+	close(c.done)
+}
+
+// createIdempotently calls create to handle r, unless a request from the same client with the same key and body already
+// succeeded, in which case its response is returned. Clients are told apart by the secret or API key in r, or if it has
+// none, by the client IP address. Requests with a key which is being handled wait for it. An empty key means the
+// request isn't deduplicated.
+func (s *smallifier) createIdempotently(ctx context.Context, req *http.Request, r CreateRequest, create func() (Response, error)) (Response, error) {
+	key := req.Header.Get(IdempotencyKeyHeader)
+	if key == "" {
+		return create()
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		return Response{}, newErrorResponse(400, ErrCodeInvalidParam, "idempotency key is too long")
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return Response{}, err
+	}
+	sum := sha256.Sum256(b)
+	client := "ip:" + s.clientIP(req)
+	if r.Secret != "" {
+		client = "secret:" + r.Secret
+	}
+	scoped := idempotencyKey(client, key)
+	for {
+		c, isNew, err := s.idempotency.claim(scoped, sum, s.clock.Now())
+		if err != nil {
+			return Response{}, err
+		}
+		if isNew {
+			resp, err := create()
+			s.idempotency.finish(c, resp, err, s.clock.Now())
+			return resp, err
+		}
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return Response{}, timeoutError()
+		}
+		if c.ok {
+			return c.resp, nil
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package smallifier
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	post := func(key, body string) (*http.Response, Response) {
+		req, err := http.NewRequest("POST", f.server.URL+"/_create", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(IdempotencyKeyHeader, key)
+		resp, err := insecureClient().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var r Response
+		json.NewDecoder(resp.Body).Decode(&r)
+		return resp, r
+	}
+	body := `{"long_url": "https://lemurs.win/", "secret": "` + testSecret + `"}`
+
+	_, first := post("key-1", body)
+	_, again := post("key-1", body)
+	if first.ShortURL == "" || again.ShortURL != first.ShortURL || again.EditToken != first.EditToken {
+		t.Errorf("same key: want %+v got %+v", first, again)
+	}
+	if _, other := post("key-2", body); other.ShortURL == first.ShortURL {
+		t.Errorf("another key: want a new link got %s", other.ShortURL)
+	}
+	if resp, _ := post("key-1", `{"long_url": "https://lemurs.win/other", "secret": "`+testSecret+`"}`); resp.StatusCode != 422 {
+		t.Errorf("key reused for another request: want 422 got %d", resp.StatusCode)
+	}
+
+	// Requests which fail aren't remembered, so they may be retried.
+	if resp, _ := post("key-3", `{"long_url": "https://lemurs.win/", "secret": "wrong"}`); resp.StatusCode != 401 {
+		t.Errorf("wrong secret: want 401 got %d", resp.StatusCode)
+	}
+	if resp, _ := post("key-3", `{"long_url": "https://lemurs.win/", "secret": "wrong"}`); resp.StatusCode != 401 {
+		t.Errorf("retrying failed request: want 401 got %d", resp.StatusCode)
+	}
+}
+
+func TestIdempotencyKeysScopedAndForgotten(t *testing.T) {
+	var k idempotencyKeys
+	now := time.Now()
+	sum := sha256.Sum256([]byte("request"))
+
+	c, isNew, err := k.claim(idempotencyKey("ip:10.0.0.1", "key"), sum, now)
+	if err != nil || !isNew {
+		t.Fatalf("first claim: want new got %v %v", isNew, err)
+	}
+	k.finish(c, Response{ShortURL: "https://lemurs.win/a"}, nil, now)
+	if _, isNew, _ := k.claim(idempotencyKey("ip:10.0.0.1", "key"), sum, now); isNew {
+		t.Error("same client: want remembered request got new")
+	}
+	if c, isNew, _ := k.claim(idempotencyKey("ip:10.0.0.2", "key"), sum, now); !isNew {
+		t.Error("another client: want new request got remembered")
+	} else {
+		k.finish(c, Response{}, errors.New("failed"), now)
+	}
+	if _, isNew, _ := k.claim(idempotencyKey("ip:10.0.0.1", "key"), sum, now.Add(idempotencyKeyLifetime+time.Second)); !isNew {
+		t.Error("after lifetime: want new request got remembered")
+	}
+
+	var other idempotencyKeys
+	for i := 0; i < maxIdempotencyKeys+1; i++ {
+		c, _, err := other.claim(idempotencyKey("ip:10.0.0.1", strconv.Itoa(i)), sum, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other.finish(c, Response{}, nil, now)
+	}
+	if len(other.creates) > maxIdempotencyKeys {
+		t.Errorf("want at most %d remembered requests got %d", maxIdempotencyKeys, len(other.creates))
+	}
+	if _, isNew, _ := other.claim(idempotencyKey("ip:10.0.0.1", "0"), sum, now); !isNew {
+		t.Error("oldest request once full: want forgotten got remembered")
+	}
+}
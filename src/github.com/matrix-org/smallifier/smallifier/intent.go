@@ -0,0 +1,79 @@
+package smallifier
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// intentPath is the path, under the base URL, at which signed intents are redirected.
+const intentPath = "_intent"
+
+// WithIntentKey enables redirects to destinations given in signed intents, at <base URL>_intent?url=...&exp=...&sig=...,
+// so that trusted services can link through the shortener without storing a link first.
+// Intents must be signed with key by SignIntent; without a valid signature, nothing is redirected.
+func WithIntentKey(key []byte) Option {
+	return func(s *smallifier) {
+		s.intentKey = key
+	}
+}
+
+// SignIntent returns the query string of an intent redirecting to link until expires, signed with key.
+func SignIntent(key []byte, link string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return url.Values{
+		"url": {link},
+		"exp": {exp},
+		"sig": {intentSignature(key, link, exp)},
+	}.Encode()
+}
+
+func intentSignature(key []byte, link, exp string) string {
+	mac := hmac.New(sha256.New, key)
+	io.WriteString(mac, link+"\n"+exp)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// IntentHandler is an http.HandlerFunc which redirects to the destination of an intent signed by SignIntent,
+// if the signature is valid, it hasn't expired, and the destination could have been shortened.
+// Intents may not lead back to the shortener, so that one redirect can't be used to launder another.
+func (s *smallifier) IntentHandler(w http.ResponseWriter, req *http.Request) {
+	setHeaders(w)
+
+	if s.intentKey == nil {
+		writeError(w, 404, ErrCodeNotFound, "intents are not enabled")
+		return
+	}
+
+	q := req.URL.Query()
+	link, exp, sig := q.Get("url"), q.Get("exp"), q.Get("sig")
+	if !hmac.Equal([]byte(sig), []byte(intentSignature(s.intentKey, link, exp))) {
+		atomic.AddUint64(&s.authErrorCount, 1)
+		log.WithField("url", link).Error("Refusing intent with bad signature")
+		writeError(w, 403, ErrCodeForbidden, "bad intent signature")
+		return
+	}
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || s.clock.Now().Unix() > expires {
+		writeError(w, 410, ErrCodeGone, "intent expired")
+		return
+	}
+	if err := s.longURLError(link); err != nil {
+		writeError(w, 400, ErrCodeInvalidParam, err.Error())
+		return
+	}
+	if u, err := url.Parse(link); err == nil && strings.EqualFold(u.Host, s.base.Host) {
+		writeError(w, 400, ErrCodeInvalidParam, "Intents may not redirect to the shortener itself")
+		return
+	}
+	s.redirectTo(w, s.rewrite(link))
+}
@@ -0,0 +1,80 @@
+package smallifier
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestIntent(t *testing.T) {
+	key := []byte("intent key")
+	f := serve(t, WithIntentKey(key))
+	defer f.Close()
+
+	client := insecureClient()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	dest := "https://example.org/"
+	for _, tc := range []struct {
+		name  string
+		query string
+		want  int
+	}{
+		{"signed", SignIntent(key, dest, time.Now().Add(time.Hour)), 302},
+		{"wrong key", SignIntent([]byte("other key"), dest, time.Now().Add(time.Hour)), 403},
+		{"unsigned", "url=" + dest, 403},
+		{"expired", SignIntent(key, dest, time.Now().Add(-time.Hour)), 410},
+		{"insecure", SignIntent(key, "http://example.org/", time.Now().Add(time.Hour)), 400},
+		{"to the shortener", SignIntent(key, f.server.URL+"/_stub", time.Now().Add(time.Hour)), 400},
+	} {
+		resp, err := client.Get(f.server.URL + "/_intent?" + tc.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s: want status code %d got %d", tc.name, tc.want, resp.StatusCode)
+		}
+		if tc.want == 302 && resp.Header.Get("Location") != dest {
+			t.Errorf("%s: want redirect to %s got %q", tc.name, dest, resp.Header.Get("Location"))
+		}
+	}
+}
+
+func TestOpenRedirectAudit(t *testing.T) {
+	for _, tc := range []struct {
+		opts []Option
+		want bool
+	}{
+		{[]Option{WithIntentKey([]byte("intent key"))}, true},
+		{[]Option{WithOpenCreation()}, false},
+	} {
+		f := serve(t, tc.opts...)
+		req, err := http.NewRequest("GET", f.server.URL+"/_audit/open-redirect", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+testSecret)
+		resp, err := insecureClient().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var report OpenRedirectReport
+		err = json.NewDecoder(resp.Body).Decode(&report)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Passed != tc.want || len(report.Checks) == 0 {
+			t.Errorf("want passed %t got %+v", tc.want, report)
+		}
+		var links int
+		if err := f.db.QueryRow(`SELECT COUNT(*) FROM links`).Scan(&links); err != nil {
+			t.Fatal(err)
+		}
+		if links != 0 {
+			t.Errorf("audit created %d links", links)
+		}
+		f.Close()
+	}
+}
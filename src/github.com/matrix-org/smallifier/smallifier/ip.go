@@ -0,0 +1,42 @@
+package smallifier
+
+import (
+	"net"
+	"net/http"
+)
+
+// defaultIPv6Prefix is the default number of leading bits by which IPv6 clients are aggregated.
+// A /64 is typically assigned to a single subscriber, who may use any address within it.
+const defaultIPv6Prefix = 64
+
+// WithIPv6Prefix sets the prefix length, in bits, by which IPv6 clients are aggregated for analytics.
+func WithIPv6Prefix(bits int) Option {
+	return func(s *smallifier) {
+		s.ipv6Prefix = bits
+	}
+}
+
+// remoteIP returns the address of the client which made req, without its port, in canonical form.
+// IPv4-mapped IPv6 addresses are returned as IPv4. If RemoteAddr cannot be parsed it is returned unchanged.
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return req.RemoteAddr
+	}
+	return ip.String()
+}
+
+// clientKey returns the key under which the client at the canonical address ip is aggregated.
+// IPv4 addresses are their own key; IPv6 addresses are truncated to s.ipv6Prefix bits, in CIDR notation.
+func (s *smallifier) clientKey(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || parsed.To4() != nil {
+		return ip
+	}
+	mask := net.CIDRMask(s.ipv6Prefix, 128)
+	return (&net.IPNet{IP: parsed.Mask(mask), Mask: mask}).String()
+}
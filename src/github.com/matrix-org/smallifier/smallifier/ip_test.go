@@ -0,0 +1,37 @@
+package smallifier
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRemoteIP(t *testing.T) {
+	for _, tc := range []struct {
+		remoteAddr, want string
+	}{
+		{"192.0.2.1:1234", "192.0.2.1"},
+		{"[2001:DB8:0:0::1]:443", "2001:db8::1"},
+		{"[::ffff:192.0.2.1]:80", "192.0.2.1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"@", "@"},
+	} {
+		if got := remoteIP(&http.Request{RemoteAddr: tc.remoteAddr}); got != tc.want {
+			t.Errorf("%q: want %q got %q", tc.remoteAddr, tc.want, got)
+		}
+	}
+}
+
+func TestClientKey(t *testing.T) {
+	s := &smallifier{ipv6Prefix: defaultIPv6Prefix}
+	for _, tc := range []struct {
+		ip, want string
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{"2001:db8:1:2:3:4:5:6", "2001:db8:1:2::/64"},
+		{"2001:db8:1:2::ffff", "2001:db8:1:2::/64"},
+	} {
+		if got := s.clientKey(tc.ip); got != tc.want {
+			t.Errorf("%q: want %q got %q", tc.ip, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package smallifier
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// WithFollowJournal appends each follow to the file at path before it is queued to be written, so that follows still waiting to be
+// written to the database when the process dies are recovered the next time it starts. The number of the last follow
+// written is kept in path+".checkpoint", so that recovered follows aren't recorded twice.
+// The journal is emptied whenever the queue drains. Writes aren't synced, so follows may still be lost if the machine crashes.
+func WithFollowJournal(path string) Option {
+	return func(s *smallifier) {
+		s.journalPath = path
+	}
+}
+
+// journalEntry is a line of the follow journal.
+type journalEntry struct {
+	Seq          uint64 `json:"seq"`
+	ShortPath    string `json:"short_path"`
+	BundleItem   int    `json:"bundle_item,omitempty"`
+	TS           int64  `json:"ts"`
+	IP           string `json:"ip"`
+	ForwardedFor string `json:"forwarded_for,omitempty"`
+	UserAgent    string `json:"user_agent,omitempty"`
+	Referer      string `json:"referer,omitempty"`
+}
+
+// followJournal is an append-only file of queued follows, and a checkpoint file holding the sequence number of the last written.
+type followJournal struct {
+	// mu guards appending to, and emptying, file, and seq, the sequence number of the last follow appended.
+	mu   sync.Mutex
+	file *os.File
+	seq  uint64
+
+	checkpoint *os.File
+}
+
+// checkpointWidth is the width the checkpoint is padded to, so that each overwrites the last entirely.
+const checkpointWidth = 20
+
+// openFollowJournal opens the journal at path, creating it if necessary, and returns the follows in it which were never written.
+func openFollowJournal(path string) (*followJournal, []follow, error) {
+	checkpoint, err := os.OpenFile(path+".checkpoint", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	var written uint64
+	b := make([]byte, checkpointWidth)
+	if n, err := checkpoint.ReadAt(b, 0); err != nil && err != io.EOF {
+		checkpoint.Close()
+		return nil, nil, err
+	} else if n > 0 {
+		if written, err = strconv.ParseUint(strings.TrimSpace(string(b[:n])), 10, 64); err != nil {
+			checkpoint.Close()
+			return nil, nil, fmt.Errorf("%s.checkpoint: %v", path, err)
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		checkpoint.Close()
+		return nil, nil, err
+	}
+	j := &followJournal{file: file, seq: written, checkpoint: checkpoint}
+	var pending []follow
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var e journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// The last line may have been cut short as the process died.
+			log.WithFields(log.Fields{
+				"err":  err,
+				"path": path,
+			}).Warn("Skipping unreadable follow journal entry")
+			continue
+		}
+		if e.Seq > j.seq {
+			j.seq = e.Seq
+		}
+		if e.Seq > written {
+			pending = append(pending, follow{
+				seq:          e.Seq,
+				shortPath:    e.ShortPath,
+				bundleItem:   e.BundleItem,
+				timestamp:    e.TS,
+				ip:           e.IP,
+				forwardedFor: e.ForwardedFor,
+				userAgent:    e.UserAgent,
+				referer:      e.Referer,
+			})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		j.close()
+		return nil, nil, err
+	}
+	return j, pending, nil
+}
+
+// append numbers follows and appends them to the journal in a single write. It must be called with j.mu held.
+func (j *followJournal) append(follows []follow) error {
+	var b []byte
+	for i := range follows {
+		f := &follows[i]
+		j.seq++
+		f.seq = j.seq
+		line, err := json.Marshal(journalEntry{
+			Seq:          f.seq,
+			ShortPath:    f.shortPath,
+			BundleItem:   f.bundleItem,
+			TS:           f.timestamp,
+			IP:           f.ip,
+			ForwardedFor: f.forwardedFor,
+			UserAgent:    f.userAgent,
+			Referer:      f.referer,
+		})
+		if err != nil {
+			return err
+		}
+		b = append(append(b, line...), '\n')
+	}
+	_, err := j.file.Write(b)
+	return err
+}
+
+// written records that the follow numbered seq, and every one before it, has been written to the database.
+func (j *followJournal) written(seq uint64) error {
+	_, err := j.checkpoint.WriteAt([]byte(fmt.Sprintf("%*d", checkpointWidth, seq)), 0)
+	return err
+}
+
+// empty removes every follow from the journal. It must be called with j.mu held, once every follow in it has been written.
+func (j *followJournal) empty() error {
+	return j.file.Truncate(0)
+}
+
+func (j *followJournal) close() {
+	j.file.Close()
+	j.checkpoint.Close()
+}
+
+// journalFollows appends follows from s.unjournaled to the journal, then queues them to be written to the database,
+// until s.unjournaled is closed and empty. Appending happens here rather than as links are followed, so that
+// redirects don't wait for the file, and the follows waiting are appended together.
+func (s *smallifier) journalFollows() {
+	defer close(s.journalDone)
+	batch := make([]follow, 0, followBatchSize)
+	for {
+		f, ok, closed := s.unjournaled.pop()
+		if closed {
+			return
+		}
+		if !ok {
+			<-s.unjournaled.ready
+			continue
+		}
+		batch = append(batch[:0], f)
+		for len(batch) < followBatchSize {
+			if f, ok, _ = s.unjournaled.pop(); !ok {
+				break
+			}
+			batch = append(batch, f)
+		}
+		// The lock is held until the batch is queued, so that the journal isn't emptied while it is only in the journal.
+		s.journal.mu.Lock()
+		if err := s.journal.append(batch); err != nil {
+			log.WithField("err", err).Error("Error appending follows to journal")
+		}
+		for _, f := range batch {
+			if !s.follows.push(f) {
+				atomic.AddInt64(&s.pendingFollows, -1)
+				atomic.AddUint64(&s.droppedFollowCount, 1)
+			}
+		}
+		s.journal.mu.Unlock()
+		s.unjournaled.done(len(batch))
+	}
+}
@@ -0,0 +1,136 @@
+package smallifier
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFollowJournalRecovers(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	link := shorten(t, f.server.URL, f.server.URL+"/_stub")
+	shortPath := link[len(f.base):]
+	path := filepath.Join(f.dir, "follows.journal")
+	entry := `{"short_path": "` + shortPath + `", "ts": 1500000000, "ip": "192.0.2.1", "seq": `
+	journal := entry + "1}\n" + entry + "2}\n" + entry + "3}\n" + `{"seq": 4, "short_pa`
+	if err := ioutil.WriteFile(path, []byte(journal), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path+".checkpoint", []byte("1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := f.smallifier.(*smallifier)
+	s.journalPath = path
+	if err := s.recoverFollows(); err != nil {
+		t.Fatal(err)
+	}
+	// New only journals follows if it recovered the journal itself.
+	go s.journalFollows()
+	assertFollowCount(f, shortPath, 2, "recovered")
+	assertFileContents(t, path, "")
+	assertFileContents(t, path+".checkpoint", "3")
+
+	resp, err := insecureClient().Get(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assertFollowCount(f, shortPath, 3, "after following")
+	assertFileContents(t, path, "")
+	assertFileContents(t, path+".checkpoint", "4")
+}
+
+func assertFileContents(t *testing.T, path, want string) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(b)); got != want {
+		t.Errorf("%s: want %q got %q", filepath.Base(path), want, got)
+	}
+}
+
+func TestFollowJournalMissing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smallifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	j, pending, err := openFollowJournal(filepath.Join(dir, "follows.journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.close()
+	if len(pending) != 0 {
+		t.Errorf("want no pending follows got %d", len(pending))
+	}
+}
+
+func TestFullFollowQueueDrops(t *testing.T) {
+	s := &smallifier{follows: newFollowQueue(0), clock: SystemClock}
+	s.enqueueFollow("tj2TEXT7", 0, httptest.NewRequest("GET", "/tj2TEXT7", nil))
+	if got := s.DroppedFollows(); got != 1 {
+		t.Errorf("want 1 dropped follow got %v", got)
+	}
+	if got := s.FollowQueueDepth(); got != 0 {
+		t.Errorf("want empty queue got %v", got)
+	}
+}
+
+func TestCancelledContextLeavesFollowsInJournal(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+	if err := CreateTables(db); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "smallifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "follows.journal")
+	u, _ := url.Parse("https://example.com/")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	made, err := New(ctx, *u, db, testSecret, 256, WithFollowJournal(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := made.(*smallifier)
+	shortPath, err := s.generateShortPath(ctx, "https://lemurs.win", "192.0.2.1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	<-s.followsDone
+	s.enqueueFollow(shortPath, 0, httptest.NewRequest("GET", "/"+shortPath, nil))
+	s.Close()
+	assertFollows(t, db, shortPath, 0)
+
+	made, err = New(context.Background(), *u, db, testSecret, 256, WithFollowJournal(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	made.Close()
+	assertFollows(t, db, shortPath, 1)
+}
+
+func assertFollows(t *testing.T, db *sql.DB, shortPath string, want int) {
+	var got int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM follows WHERE short_path = $1`, shortPath).Scan(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("%s: want %d follows got %d", shortPath, want, got)
+	}
+}
@@ -0,0 +1,159 @@
+package smallifier
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// BlockDestinationRequest is the JSON-encoded body of an admin request to stop, immediately, redirects to a host and
+// its subdomains, such as when it has been compromised.
+type BlockDestinationRequest struct {
+	Host string `json:"host"`
+	// Reason is shown to people following links to the host.
+	Reason string `json:"reason,omitempty"`
+}
+
+// BlockedDestination is a host to which redirects have been stopped.
+type BlockedDestination struct {
+	Host      string `json:"host"`
+	Reason    string `json:"reason,omitempty"`
+	CreatedTS int64  `json:"created_ts"`
+}
+
+// blockedDestinationPage is what the "destinationblocked" page of a Theme is rendered with.
+type blockedDestinationPage struct {
+	Host   string
+	Reason string
+}
+
+// normalizeBlockedHost returns host as it is stored and matched, or an error if it isn't a host.
+func normalizeBlockedHost(host string) (string, error) {
+	host = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+	if u, err := url.Parse("https://" + host + "/"); host == "" || err != nil || u.Host != host || u.Port() != "" {
+		return "", errors.New("Must specify a host, without a scheme or port")
+	}
+	return host, nil
+}
+
+// loadBlockedDestinations reads the blocked destinations from the database into memory, where lookups check them.
+func (s *smallifier) loadBlockedDestinations(ctx context.Context) error {
+	blocked, err := s.listBlockedDestinations(ctx)
+	if err != nil {
+		return err
+	}
+	m := make(map[string]BlockedDestination, len(blocked))
+	for _, b := range blocked {
+		m[b.Host] = b
+	}
+	s.blockedDestinations.Store(m)
+	return nil
+}
+
+// listBlockedDestinations returns the blocked destinations in the database, by host.
+func (s *smallifier) listBlockedDestinations(ctx context.Context) ([]BlockedDestination, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT host, reason, create_ts FROM blocked_destinations ORDER BY host`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	blocked := []BlockedDestination{}
+	for rows.Next() {
+		var b BlockedDestination
+		if err := rows.Scan(&b.Host, &b.Reason, &b.CreatedTS); err != nil {
+			return nil, err
+		}
+		blocked = append(blocked, b)
+	}
+	return blocked, rows.Err()
+}
+
+// blockDestination stops redirects to host and its subdomains, recording it in the audit log.
+func (s *smallifier) blockDestination(ctx context.Context, r BlockDestinationRequest) (BlockedDestination, error) {
+	b := BlockedDestination{Host: r.Host, Reason: r.Reason, CreatedTS: s.clock.Now().Unix()}
+	s.blockedDestinationsMu.Lock()
+	defer s.blockedDestinationsMu.Unlock()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return b, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `INSERT OR REPLACE INTO blocked_destinations (host, reason, create_ts) VALUES ($1, $2, $3)`, b.Host, b.Reason, b.CreatedTS); err != nil {
+		return b, err
+	}
+	if err := addAuditEntry(ctx, tx, b.CreatedTS, "block_destination", "", "", b.Host); err != nil {
+		return b, err
+	}
+	if err := tx.Commit(); err != nil {
+		return b, err
+	}
+	return b, s.loadBlockedDestinations(ctx)
+}
+
+// unblockDestination lets redirects to host resume, recording it in the audit log.
+// It returns sql.ErrNoRows if host isn't blocked.
+func (s *smallifier) unblockDestination(ctx context.Context, host string) error {
+	s.blockedDestinationsMu.Lock()
+	defer s.blockedDestinationsMu.Unlock()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	r, err := tx.ExecContext(ctx, `DELETE FROM blocked_destinations WHERE host = $1`, host)
+	if err != nil {
+		return err
+	}
+	if n, err := r.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	if err := addAuditEntry(ctx, tx, s.clock.Now().Unix(), "unblock_destination", "", host, ""); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return s.loadBlockedDestinations(ctx)
+}
+
+// blockedDestination returns the blocked destination matching host, which must be lower case, if there is one.
+// Only a lookup per label of host is made, so that checking it on every redirect is cheap however many are blocked.
+func (s *smallifier) blockedDestination(host string) (BlockedDestination, bool) {
+	blocked, _ := s.blockedDestinations.Load().(map[string]BlockedDestination)
+	if len(blocked) == 0 {
+		return BlockedDestination{}, false
+	}
+	host = strings.TrimSuffix(host, ".")
+	if net.ParseIP(host) != nil {
+		b, ok := blocked[host]
+		return b, ok
+	}
+	for {
+		if b, ok := blocked[host]; ok {
+			return b, true
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return BlockedDestination{}, false
+		}
+		host = host[i+1:]
+	}
+}
+
+// writeDestinationBlocked responds to a lookup of link, whose host is blocked, with a notice if it was blocked by
+// blockDestination.
+func (s *smallifier) writeDestinationBlocked(w http.ResponseWriter, link string) {
+	if u, err := url.Parse(link); err == nil {
+		if b, ok := s.blockedDestination(strings.ToLower(u.Hostname())); ok {
+			s.render(w, 410, "destinationblocked", blockedDestinationPage{b.Host, b.Reason})
+			return
+		}
+	}
+	writeError(w, 410, ErrCodeGone, "link disabled")
+}
@@ -0,0 +1,90 @@
+package smallifier
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBlockDestination(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	compromised := shorten(t, f.server.URL, "https://www.evil.example/download")
+	other := shorten(t, f.server.URL, "https://notevil.example/")
+
+	client := insecureClient()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	assertStatuses := func(when string, want map[string]int) {
+		for link, status := range want {
+			resp, err := client.Get(link)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != status {
+				t.Errorf("%s: %s: want status code %d got %d", when, link, status, resp.StatusCode)
+			}
+			if status == 410 && !strings.Contains(string(b), "Account takeover") {
+				t.Errorf("%s: %s: want notice giving reason got %s", when, link, b)
+			}
+		}
+	}
+	assertStatuses("before blocking", map[string]int{compromised: 302, other: 302})
+
+	resp := adminBodyRequest(t, f, "PUT", "blocked-hosts", testSecret, `{"host": "Evil.Example.", "reason": "Account takeover"}`)
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("blocking: want status code 200 got %d", resp.StatusCode)
+	}
+	assertStatuses("blocked", map[string]int{compromised: 410, other: 302})
+	var blocked []BlockedDestination
+	decodeAdminResponse(t, f, "GET", "blocked-hosts", &blocked)
+	if len(blocked) != 1 || blocked[0].Host != "evil.example" || blocked[0].Reason != "Account takeover" {
+		t.Errorf("want evil.example blocked got %+v", blocked)
+	}
+	createResp, err := insecureClient().Post(f.server.URL+"/_create", "application/json", strings.NewReader(`{"long_url": "https://evil.example/"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	createResp.Body.Close()
+	if createResp.StatusCode == 200 {
+		t.Error("want creating link to blocked host refused")
+	}
+
+	resp = adminRequest(t, f, "DELETE", "blocked-hosts/evil.example", testSecret)
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("unblocking: want status code 200 got %d", resp.StatusCode)
+	}
+	assertStatuses("unblocked", map[string]int{compromised: 302, other: 302})
+	resp = adminRequest(t, f, "DELETE", "blocked-hosts/evil.example", testSecret)
+	resp.Body.Close()
+	if resp.StatusCode != 404 {
+		t.Errorf("unblocking again: want status code 404 got %d", resp.StatusCode)
+	}
+
+	var entries []AuditEntry
+	decodeAdminResponse(t, f, "GET", "audit", &entries)
+	if len(entries) != 2 || entries[0].Action != "unblock_destination" || entries[1].New != "evil.example" || entries[1].ShortURL != "" {
+		t.Errorf("audit log: want blocking and unblocking evil.example got %+v", entries)
+	}
+}
+
+func TestNormalizeBlockedHost(t *testing.T) {
+	for host, want := range map[string]string{
+		"Evil.Example.": "evil.example",
+		"192.0.2.1":     "192.0.2.1",
+		"":              "",
+		"https://evil":  "",
+		"evil:443":      "",
+		"evil/path":     "",
+	} {
+		got, err := normalizeBlockedHost(host)
+		if got != want || (err == nil) != (want != "") {
+			t.Errorf("%q: want %q got %q (%v)", host, want, got, err)
+		}
+	}
+}
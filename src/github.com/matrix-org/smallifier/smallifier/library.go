@@ -0,0 +1,71 @@
+package smallifier
+
+import (
+	"context"
+	"database/sql"
+	"sync/atomic"
+)
+
+// Link is a link, as returned by Resolve.
+type Link struct {
+	ShortURL  string `json:"short_url"`
+	ShortPath string `json:"short_path"`
+	LongURL   string `json:"long_url"`
+	CreatedTS int64  `json:"created_ts"`
+	// Owner is the name of the API key the link was created with, if it was.
+	Owner string `json:"owner,omitempty"`
+}
+
+// errClosed is returned by Shorten, Resolve and Delete once Close or Shutdown has been called.
+var errClosed = newErrorResponse(503, ErrCodeUnavailable, "smallifier is closed")
+
+// checkOpen returns errClosed if Close or Shutdown has been called.
+func (s *smallifier) checkOpen() error {
+	if atomic.LoadInt32(&s.closed) != 0 {
+		return errClosed
+	}
+	return nil
+}
+
+// Shorten creates a link as req asks, trusting the caller as CreateHandler trusts holders of the secret.
+// Unlike requests to CreateHandler, it isn't rate limited, nor refused while shedding load.
+func (s *smallifier) Shorten(ctx context.Context, req CreateRequest) (Response, error) {
+	if err := s.checkOpen(); err != nil {
+		return Response{}, err
+	}
+	return s.shorten(ctx, req, "", "", true)
+}
+
+// Resolve returns the link at shortPath.
+func (s *smallifier) Resolve(ctx context.Context, shortPath string) (Link, error) {
+	if err := s.checkOpen(); err != nil {
+		return Link{}, err
+	}
+	l := Link{ShortURL: s.base.String() + shortPath, ShortPath: shortPath}
+	var owner sql.NullString
+	var deleted bool
+	err := s.db.QueryRowContext(ctx, `SELECT long_url, create_ts, owner, deleted FROM links WHERE short_path = $1`, shortPath).Scan(
+		&l.LongURL, &l.CreatedTS, &owner, &deleted)
+	if err != nil {
+		return Link{}, lookupError(err)
+	}
+	if deleted {
+		return Link{}, newErrorResponse(410, ErrCodeGone, "link deleted")
+	}
+	if s.checkDestinationHost(l.LongURL) != nil {
+		return Link{}, newErrorResponse(410, ErrCodeGone, "link disabled")
+	}
+	l.Owner = owner.String
+	return l, nil
+}
+
+// Delete marks the link at shortPath deleted.
+func (s *smallifier) Delete(ctx context.Context, shortPath string) error {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+	return s.delete(ctx, shortPath)
+}
@@ -0,0 +1,54 @@
+package smallifier
+
+import (
+	"context"
+	"testing"
+)
+
+func TestLibrary(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+	ctx := context.Background()
+
+	resp, err := f.smallifier.Shorten(ctx, CreateRequest{LongURL: "https://lemurs.win/", Tags: []string{"bridge"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ShortURL != f.base+resp.ShortPath || resp.EditToken == "" {
+		t.Errorf("shortening: want short URL under %s with edit token got %+v", f.base, resp)
+	}
+	l, err := f.smallifier.Resolve(ctx, resp.ShortPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.LongURL != "https://lemurs.win/" || l.ShortURL != resp.ShortURL || l.CreatedTS != resp.CreatedTS {
+		t.Errorf("resolving: want link to https://lemurs.win/ got %+v", l)
+	}
+
+	for _, tt := range []struct {
+		name string
+		req  CreateRequest
+		code ErrCode
+	}{
+		{"bad scheme", CreateRequest{LongURL: "ftp://lemurs.win/"}, ErrCodeInvalidParam},
+		{"wrong secret", CreateRequest{LongURL: "https://lemurs.win/", Secret: "wrong"}, ErrCodeUnauthorized},
+	} {
+		_, err := f.smallifier.Shorten(ctx, tt.req)
+		if e, ok := err.(*ErrorResponse); !ok || e.ErrCode != tt.code {
+			t.Errorf("%s: want %s got %v", tt.name, tt.code, err)
+		}
+	}
+
+	if err := f.smallifier.Delete(ctx, resp.ShortPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.smallifier.Resolve(ctx, resp.ShortPath); err == nil || err.(*ErrorResponse).ErrCode != ErrCodeGone {
+		t.Errorf("resolving deleted link: want %s got %v", ErrCodeGone, err)
+	}
+	if _, err := f.smallifier.Resolve(ctx, "AAAAAAAA"); err == nil || err.(*ErrorResponse).ErrCode != ErrCodeNotFound {
+		t.Errorf("resolving missing link: want %s got %v", ErrCodeNotFound, err)
+	}
+	if err := f.smallifier.Delete(ctx, "AAAAAAAA"); err == nil || err.(*ErrorResponse).Status != 404 {
+		t.Errorf("deleting missing link: want 404 got %v", err)
+	}
+}
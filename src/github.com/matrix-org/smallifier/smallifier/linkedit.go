@@ -0,0 +1,155 @@
+package smallifier
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// linkPrefix is the path prefix under which individual links can be changed.
+const linkPrefix = "/_links/"
+
+// UpdateRequest is the JSON-encoded body of a request to change the destination of a link.
+type UpdateRequest struct {
+	LongURL string `json:"long_url"`
+	// ApplyTS, if in the future, is the unix timestamp after which to change the destination, rather than changing it now.
+	ApplyTS int64 `json:"apply_ts,omitempty"`
+}
+
+// errBundleUpdate is returned when trying to change the destination of a bundle, which has none.
+var errBundleUpdate = errors.New("Bundles have no destination to update")
+
+// LinkHandler is an http.HandlerFunc which changes the link at /_links/<short path>.
+// Requests must carry the link's edit token, an API key it was created with, or the secret, in an "Authorization: Bearer" header.
+//
+//	PUT    /_links/<short path>    changes the link's destination as described by an UpdateRequest,
+//	                               or schedules the change, responding with a ScheduledUpdate.
+//	DELETE /_links/<short path>    deletes the link, after which lookups of it respond 410 Gone.
+func (s *smallifier) LinkHandler(w http.ResponseWriter, req *http.Request) {
+	setHeaders(w)
+
+	ctx, cancel, ok := s.requestContext(w, req)
+	if !ok {
+		return
+	}
+	defer cancel()
+
+	i := strings.Index(req.URL.Path, linkPrefix)
+	if i < 0 || req.URL.Path[i+len(linkPrefix):] == "" {
+		writeError(w, 404, ErrCodeNotFound, "link not found")
+		return
+	}
+	shortPath := req.URL.Path[i+len(linkPrefix):]
+
+	if req.Method != "PUT" && req.Method != "DELETE" {
+		writeError(w, 405, ErrCodeUnrecognized, "Must PUT or DELETE")
+		return
+	}
+
+	token := bearerToken(req)
+	if !s.authorizeChange(ctx, w, shortPath, token, token) {
+		return
+	}
+
+	if req.Method == "DELETE" {
+		s.deleteLink(ctx, w, shortPath)
+		return
+	}
+	if err := s.checkWritable(); err != nil {
+		writeErr(w, err)
+		return
+	}
+
+	defer req.Body.Close()
+	var update UpdateRequest
+	if err := json.NewDecoder(req.Body).Decode(&update); err != nil {
+		writeError(w, 400, ErrCodeNotJSON, "error decoding json")
+		return
+	}
+	if !s.checkLongURL(ctx, w, update.LongURL, false) {
+		return
+	}
+	var scheduled ScheduledUpdate
+	var err error
+	if update.ApplyTS > s.clock.Now().Unix() {
+		scheduled, err = s.scheduleUpdate(ctx, shortPath, update.LongURL, update.ApplyTS)
+	} else {
+		err = s.updateLink(ctx, shortPath, update.LongURL)
+	}
+	if err == errBundleUpdate {
+		writeError(w, 400, ErrCodeInvalidParam, err.Error())
+		return
+	}
+	if err == errLinkDeleted {
+		writeGone(w)
+		return
+	}
+	if err != nil {
+		writeLookupError(w, err)
+		return
+	}
+	if scheduled.ID != 0 {
+		log.WithFields(log.Fields{
+			"short_path": shortPath,
+			"long_url":   update.LongURL,
+			"apply_ts":   update.ApplyTS,
+		}).Info("Scheduled link update")
+		json.NewEncoder(w).Encode(scheduled)
+		return
+	}
+	log.WithFields(log.Fields{
+		"short_path": shortPath,
+		"long_url":   update.LongURL,
+	}).Info("Updated link")
+	io.WriteString(w, `{}`)
+}
+
+// errLinkDeleted is returned when trying to change a link which has been deleted.
+var errLinkDeleted = errors.New("link deleted")
+
+// updateLink changes the long URL of the link at shortPath, recording the change in the audit log.
+// It returns sql.ErrNoRows if there is no such link.
+func (s *smallifier) updateLink(ctx context.Context, shortPath, longURL string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var old string
+	var deleted bool
+	if err := tx.QueryRowContext(ctx, `SELECT long_url, deleted FROM links WHERE short_path = $1`, shortPath).Scan(&old, &deleted); err != nil {
+		return err
+	}
+	if deleted {
+		return errLinkDeleted
+	}
+	if old == "" {
+		return errBundleUpdate
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE links SET long_url = $1, normalized_url = $2 WHERE short_path = $3`, longURL, normalizedURL(longURL), shortPath); err != nil {
+		return err
+	}
+	if err := addAuditEntry(ctx, tx, s.clock.Now().Unix(), "update", shortPath, old, longURL); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.forgetLookup(shortPath)
+	return nil
+}
+
+// bearerToken returns the token in req's "Authorization: Bearer" header, or "" if it has none.
+func bearerToken(req *http.Request) string {
+	const prefix = "Bearer "
+	h := req.Header.Get("Authorization")
+	if !strings.HasPrefix(h, prefix) {
+		return ""
+	}
+	return h[len(prefix):]
+}
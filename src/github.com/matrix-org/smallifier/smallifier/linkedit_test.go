@@ -0,0 +1,69 @@
+package smallifier
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func changeLink(t *testing.T, f fixture, method, shortPath, token, body string) int {
+	req, err := http.NewRequest(method, f.server.URL+"/_links/"+shortPath, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := insecureClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestOpenCreation(t *testing.T) {
+	f := serve(t, WithOpenCreation())
+	defer f.Close()
+
+	r := create(t, f, `{"long_url": "`+f.server.URL+`/_stub"}`)
+	if r.ShortURL == "" || r.EditToken == "" {
+		t.Fatalf("creating anonymously: want a link and edit token got %+v", r)
+	}
+	if r := create(t, f, `{"long_url": "`+f.server.URL+`/_stub", "secret": "wrong"}`); r.ShortURL != "" {
+		t.Errorf("creating with wrong secret: want no link got %s", r.ShortURL)
+	}
+	if r := create(t, f, `{"long_url": "`+f.server.URL+`/_stub", "click_webhook_url": "https://example.org/"}`); r.ShortURL != "" {
+		t.Errorf("registering webhook anonymously: want no link got %s", r.ShortURL)
+	}
+}
+
+func TestChangeLink(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	r := create(t, f, `{"long_url": "`+f.server.URL+`/_stub", "secret": "`+testSecret+`"}`)
+	other := create(t, f, `{"long_url": "`+f.server.URL+`/_stub", "secret": "`+testSecret+`"}`)
+	update := `{"long_url": "` + f.server.URL + `/_stub?updated"}`
+	for _, tc := range []struct {
+		method, token, body string
+		want                int
+	}{
+		{"PUT", "", update, 401},
+		{"PUT", other.EditToken, update, 401},
+		{"PUT", r.EditToken, `{"long_url": "http://insecure.example"}`, 400},
+		{"PUT", r.EditToken, update, 200},
+		{"DELETE", r.EditToken, "", 200},
+		{"PUT", testSecret, update, 410},
+	} {
+		if got := changeLink(t, f, tc.method, r.ShortPath, tc.token, tc.body); got != tc.want {
+			t.Errorf("%s %s with token %q: want status code %d got %d", tc.method, tc.body, tc.token, tc.want, got)
+		}
+	}
+
+	var entries []AuditEntry
+	decodeAdminResponse(t, f, "GET", "audit?short_url="+r.ShortURL, &entries)
+	if len(entries) != 1 || entries[0].Action != "update" || entries[0].New != f.server.URL+"/_stub?updated" {
+		t.Errorf("audit log for %s: want one update got %+v", r.ShortURL, entries)
+	}
+}
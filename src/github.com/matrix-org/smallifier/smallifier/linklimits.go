@@ -0,0 +1,220 @@
+package smallifier
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// linkLimitRefreshInterval is how often links are counted again for WithLinkLimits, so that links deleted since
+	// stop counting against their limits.
+	linkLimitRefreshInterval = 10 * time.Minute
+	// linkLimitWarnFill is the fraction of a limit which, once used, warnings are logged about.
+	linkLimitWarnFill = 0.9
+	// totalLinkLimit is what LinkLimitUsage calls the limit on all links.
+	totalLinkLimit = "total"
+)
+
+// LinkLimits caps how many links may be stored, so that a runaway integration can't silently fill the database.
+// Links which have been deleted don't count against them. Bundles count as links in the "other" namespace.
+type LinkLimits struct {
+	// Total is the most links which may be stored in all, or 0 for no limit.
+	Total int64
+	// Namespaces is the most links which may be stored in each of the namespaces given to WithNamespaces, including
+	// "other", by name. Namespaces which aren't listed aren't limited.
+	Namespaces map[string]int64
+}
+
+// LinkLimitUsage is how much of a limit given to WithLinkLimits is used.
+type LinkLimitUsage struct {
+	// Limit is "total", or the namespace limited.
+	Limit string
+	Links float64
+	Max   float64
+}
+
+// WithLinkLimits refuses to create links beyond limits, with ErrCodeLinkLimit, logging warnings once 90% of a limit is
+// used. Links are counted when the Smallifier is made and every 10 minutes, and as they are created in between, so
+// limits are soft: concurrent creates may overshoot them slightly, and deleting links frees room only once they are
+// counted again. New panics if a namespace is limited which wasn't given to WithNamespaces.
+func WithLinkLimits(limits LinkLimits) Option {
+	return func(s *smallifier) {
+		s.linkLimits = &linkLimits{LinkLimits: limits}
+	}
+}
+
+type linkLimits struct {
+	LinkLimits
+	// mu guards total and namespaces, the links counted in all and in each namespace.
+	mu           sync.Mutex
+	total        int64
+	namespaces   map[string]int64
+	refusedCount uint64
+}
+
+// nearLinkLimit reports whether links is enough of max, which is 0 for no limit, to warn about.
+func nearLinkLimit(links, max int64) bool {
+	return max > 0 && float64(links) >= linkLimitWarnFill*float64(max)
+}
+
+// warnNearLinkLimit logs a warning that links of the limit called name, of max, are used.
+func warnNearLinkLimit(name string, links, max int64) {
+	log.WithFields(log.Fields{
+		"limit": name,
+		"links": links,
+		"max":   max,
+	}).Warn("Links are nearing their limit")
+}
+
+// checkLinkLimitNamespaces panics if a namespace is limited which wasn't given to WithNamespaces.
+func (s *smallifier) checkLinkLimitNamespaces() {
+	for name := range s.linkLimits.Namespaces {
+		if _, ok := s.namespaceCounts[name]; !ok {
+			panic(fmt.Sprintf("links in namespace %s are limited, but it wasn't given to WithNamespaces", name))
+		}
+	}
+}
+
+// countLinks counts the links stored, in all and in each namespace if any are limited, for WithLinkLimits.
+func (s *smallifier) countLinks(ctx context.Context) error {
+	l := s.linkLimits
+	var total int64
+	namespaces := map[string]int64{}
+	if len(l.Namespaces) == 0 {
+		if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM links WHERE deleted = 0`).Scan(&total); err != nil {
+			return err
+		}
+	} else {
+		rows, err := s.db.QueryContext(ctx, `SELECT long_url FROM links WHERE deleted = 0`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var link string
+			if err := rows.Scan(&link); err != nil {
+				return err
+			}
+			total++
+			namespaces[s.namespaceOf(link)]++
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	l.mu.Lock()
+	l.total, l.namespaces = total, namespaces
+	l.mu.Unlock()
+	if nearLinkLimit(total, l.Total) {
+		warnNearLinkLimit(totalLinkLimit, total, l.Total)
+	}
+	for name, max := range l.Namespaces {
+		if nearLinkLimit(namespaces[name], max) {
+			warnNearLinkLimit(name, namespaces[name], max)
+		}
+	}
+	return nil
+}
+
+// recountLinks counts links again every linkLimitRefreshInterval, until s.stop is closed.
+func (s *smallifier) recountLinks() {
+	defer s.background.Done()
+	for {
+		select {
+		case <-s.clock.After(linkLimitRefreshInterval):
+		case <-s.stop:
+			return
+		}
+		ctx, cancel := context.WithTimeout(s.ctx, time.Minute)
+		err := s.countLinks(ctx)
+		cancel()
+		if err != nil {
+			log.WithField("err", err).Error("Error counting links for their limits")
+		}
+	}
+}
+
+// checkLinkLimits returns an *ErrorResponse with ErrCodeLinkLimit if a link to link may not be created because
+// WithLinkLimits' limit on all links, or on those in its namespace, has been reached.
+func (s *smallifier) checkLinkLimits(link string) error {
+	l := s.linkLimits
+	if l == nil {
+		return nil
+	}
+	ns := s.namespaceOf(link)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var msg string
+	if l.Total > 0 && l.total >= l.Total {
+		msg = fmt.Sprintf("The limit of %d links has been reached; delete some, or ask an administrator to raise it", l.Total)
+	} else if max := l.Namespaces[ns]; max > 0 && l.namespaces[ns] >= max {
+		msg = fmt.Sprintf("The limit of %d links in namespace %s has been reached; delete some, or ask an administrator to raise it", max, ns)
+	} else {
+		return nil
+	}
+	atomic.AddUint64(&l.refusedCount, 1)
+	log.WithFields(log.Fields{
+		"namespace": ns,
+		"url":       link,
+	}).Warn("Refusing to create link beyond limit")
+	return newErrorResponse(507, ErrCodeLinkLimit, msg)
+}
+
+// countLinkStored counts a link to link, which has just been stored, against WithLinkLimits, warning if it takes a
+// limit past linkLimitWarnFill.
+func (s *smallifier) countLinkStored(link string) {
+	l := s.linkLimits
+	if l == nil {
+		return
+	}
+	ns := s.namespaceOf(link)
+	l.mu.Lock()
+	l.total++
+	l.namespaces[ns]++
+	total, inNamespace := l.total, l.namespaces[ns]
+	l.mu.Unlock()
+	if nearLinkLimit(total, l.Total) && !nearLinkLimit(total-1, l.Total) {
+		warnNearLinkLimit(totalLinkLimit, total, l.Total)
+	}
+	if max := l.Namespaces[ns]; nearLinkLimit(inNamespace, max) && !nearLinkLimit(inNamespace-1, max) {
+		warnNearLinkLimit(ns, inNamespace, max)
+	}
+}
+
+// LinkLimitUsage gets how much of each limit given to WithLinkLimits is used, the total first then namespaces in
+// alphabetical order, or nil if none were.
+func (s *smallifier) LinkLimitUsage() []LinkLimitUsage {
+	l := s.linkLimits
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var usage []LinkLimitUsage
+	if l.Total > 0 {
+		usage = append(usage, LinkLimitUsage{totalLinkLimit, float64(l.total), float64(l.Total)})
+	}
+	for name, max := range l.Namespaces {
+		if max > 0 {
+			usage = append(usage, LinkLimitUsage{name, float64(l.namespaces[name]), float64(max)})
+		}
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		return usage[j].Limit != totalLinkLimit && (usage[i].Limit == totalLinkLimit || usage[i].Limit < usage[j].Limit)
+	})
+	return usage
+}
+
+// LinkLimitRefusals gets the number of links not created because of WithLinkLimits.
+func (s *smallifier) LinkLimitRefusals() float64 {
+	if s.linkLimits == nil {
+		return 0
+	}
+	return float64(atomic.LoadUint64(&s.linkLimits.refusedCount))
+}
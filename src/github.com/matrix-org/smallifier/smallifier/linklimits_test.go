@@ -0,0 +1,81 @@
+package smallifier
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLinkLimits(t *testing.T) {
+	f := serve(t, WithNamespaces(Namespaces{"local": {"127.0.0.1"}}),
+		WithLinkLimits(LinkLimits{Total: 3, Namespaces: map[string]int64{"local": 2}}))
+	defer f.Close()
+	s := f.smallifier.(*smallifier)
+
+	createStatus := func(link string) (int, ErrorResponse) {
+		resp, err := insecureClient().Post(f.server.URL+"/_create", "application/json",
+			strings.NewReader(`{"long_url": "`+link+`", "secret": "`+testSecret+`"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var e ErrorResponse
+		json.NewDecoder(resp.Body).Decode(&e)
+		return resp.StatusCode, e
+	}
+	local := f.server.URL + "/_stub"
+	for i := 0; i < 2; i++ {
+		if status, _ := createStatus(local); status != 200 {
+			t.Fatalf("local link %d: want 200 got %d", i, status)
+		}
+	}
+	if status, e := createStatus(local); status != 507 || e.ErrCode != ErrCodeLinkLimit || !strings.Contains(e.Message, "namespace local") {
+		t.Errorf("local link beyond its namespace's limit: want 507 %s got %d %+v", ErrCodeLinkLimit, status, e)
+	}
+	if status, _ := createStatus("https://lemurs.win/"); status != 200 {
+		t.Errorf("other link: want 200 got %d", status)
+	}
+	if status, e := createStatus("https://lemurs.win/"); status != 507 || e.ErrCode != ErrCodeLinkLimit || !strings.Contains(e.Message, "3 links") {
+		t.Errorf("link beyond total limit: want 507 %s got %d %+v", ErrCodeLinkLimit, status, e)
+	}
+
+	want := []LinkLimitUsage{{"total", 3, 3}, {"local", 2, 2}}
+	if got := s.LinkLimitUsage(); !reflect.DeepEqual(got, want) {
+		t.Errorf("usage: want %+v got %+v", want, got)
+	}
+	if s.LinkLimitRefusals() != 2 {
+		t.Errorf("refusals: want 2 got %v", s.LinkLimitRefusals())
+	}
+
+	// Deleted links stop counting once links are counted again.
+	if _, err := f.db.Exec(`UPDATE links SET deleted = 1 WHERE long_url = $1`, local); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.countLinks(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := createStatus(local); status != 200 {
+		t.Errorf("after deleting links: want 200 got %d", status)
+	}
+}
+
+func TestLinkLimitsNeedNamespaces(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("want panic limiting a namespace which wasn't given")
+		}
+	}()
+	serve(t, WithLinkLimits(LinkLimits{Namespaces: map[string]int64{"local": 2}}))
+}
+
+func TestNoLinkLimits(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	shorten(t, f.server.URL, f.server.URL+"/_stub")
+	if got := f.smallifier.LinkLimitUsage(); got != nil {
+		t.Errorf("want no usage got %+v", got)
+	}
+}
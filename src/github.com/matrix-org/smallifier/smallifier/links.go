@@ -0,0 +1,146 @@
+package smallifier
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// defaultLinksLimit and maxLinksLimit are how many links are listed per page if the request doesn't specify, and at most.
+const (
+	defaultLinksLimit = 100
+	maxLinksLimit     = 1000
+)
+
+// ListedLink is a link as listed by LinksHandler.
+type ListedLink struct {
+	ShortPath string `json:"short_path"`
+	// LongURL is empty for bundles.
+	LongURL   string `json:"long_url"`
+	CreatedTS int64  `json:"created_ts"`
+	Follows   int64  `json:"follows"`
+	Pinned    bool   `json:"pinned,omitempty"`
+	// Owner is the name of the API key the link was created with, if it wasn't created with the server's secret.
+	Owner string `json:"owner,omitempty"`
+}
+
+// LinksPage is the JSON-encoded response listing a page of links.
+type LinksPage struct {
+	Links []ListedLink `json:"links"`
+	// NextCursor is passed as ?cursor=... to get the next page. It is empty on the last page.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// errBadCursor is returned when listing links from a cursor which wasn't returned by a previous listing.
+var errBadCursor = errors.New("bad cursor")
+
+// LinksHandler is an http.HandlerFunc which lists the links which haven't been deleted, as a LinksPage.
+// Pinned links are listed first, then the rest, newest first.
+// Up to ?limit=... links (default 100, at most 1000) are listed, starting after ?cursor=..., if given.
+// Requests must carry the secret in an "Authorization: Bearer" header.
+func (s *smallifier) LinksHandler(w http.ResponseWriter, req *http.Request) {
+	setHeaders(w)
+
+	ctx, cancel, ok := s.requestContext(w, req)
+	if !ok {
+		return
+	}
+	defer cancel()
+
+	if !s.checkBearer(req) {
+		atomic.AddUint64(&s.authErrorCount, 1)
+		log.WithField("path", req.URL.Path).Error("Refusing to list links with wrong secret")
+		writeError(w, 401, ErrCodeUnauthorized, "Must specify correct secret")
+		return
+	}
+
+	q := req.URL.Query()
+	limit := defaultLinksLimit
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 || n > maxLinksLimit {
+			writeError(w, 400, ErrCodeInvalidParam, "limit must be between 1 and "+strconv.Itoa(maxLinksLimit))
+			return
+		}
+		limit = n
+	}
+
+	page, err := s.listLinks(ctx, q.Get("cursor"), limit)
+	if err == errBadCursor {
+		writeError(w, 400, ErrCodeInvalidParam, "bad cursor")
+		return
+	}
+	if err != nil {
+		writeLookupError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(page)
+}
+
+// listLinks returns up to limit links, pinned ones first and otherwise newest first,
+// after the one cursor points to, or from the start if it is empty.
+// Cursors encode the position of the last link listed, so pages are stable as links are created.
+func (s *smallifier) listLinks(ctx context.Context, cursor string, limit int) (LinksPage, error) {
+	var after linksCursor
+	if cursor != "" {
+		var err error
+		if after, err = parseLinksCursor(cursor); err != nil {
+			return LinksPage{}, err
+		}
+	}
+	// One more link than asked for is fetched to find out whether there is another page.
+	rows, err := s.db.QueryContext(ctx, `SELECT id, pinned, short_path, long_url, create_ts, COALESCE(owner, ''),
+		(SELECT COUNT(*) FROM follows WHERE follows.short_path = links.short_path) FROM links
+		WHERE deleted = 0 AND ($1 = 0 OR pinned < $2 OR (pinned = $2 AND id < $1))
+		ORDER BY pinned DESC, id DESC LIMIT $3`, after.id, after.pinned, limit+1)
+	if err != nil {
+		return LinksPage{}, err
+	}
+	defer rows.Close()
+	page := LinksPage{Links: []ListedLink{}}
+	var last linksCursor
+	for rows.Next() {
+		var l ListedLink
+		var c linksCursor
+		if err := rows.Scan(&c.id, &c.pinned, &l.ShortPath, &l.LongURL, &l.CreatedTS, &l.Owner, &l.Follows); err != nil {
+			return LinksPage{}, err
+		}
+		if len(page.Links) == limit {
+			page.NextCursor = last.String()
+			break
+		}
+		l.Pinned = c.pinned == 1
+		page.Links = append(page.Links, l)
+		last = c
+	}
+	return page, rows.Err()
+}
+
+// linksCursor is the position of a link in the order links are listed.
+type linksCursor struct {
+	pinned int
+	id     int64
+}
+
+func (c linksCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", c.pinned, c.id)))
+}
+
+func parseLinksCursor(cursor string) (linksCursor, error) {
+	var c linksCursor
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return c, errBadCursor
+	}
+	if _, err := fmt.Sscanf(string(b), "%d:%d", &c.pinned, &c.id); err != nil || c.id <= 0 {
+		return c, errBadCursor
+	}
+	return c, nil
+}
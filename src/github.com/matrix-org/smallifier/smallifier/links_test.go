@@ -0,0 +1,89 @@
+package smallifier
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func listLinks(t *testing.T, f fixture, query url.Values) (LinksPage, int) {
+	req, err := http.NewRequest("GET", f.server.URL+"/_links?"+query.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testSecret)
+	resp, err := insecureClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var page LinksPage
+	if resp.StatusCode == 200 {
+		if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return page, resp.StatusCode
+}
+
+func TestListLinks(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	var created []string
+	for i := 0; i < 5; i++ {
+		created = append(created, shorten(t, f.server.URL, f.server.URL+"/_stub")[len(f.base):])
+	}
+	deleteShortLink(t, f.server.URL, f.base+created[2])
+	resp, err := insecureClient().Get(f.base + created[4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	waitForFollows(f)
+
+	var listed []ListedLink
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 2 {
+			t.Fatal("too many pages")
+		}
+		page, status := listLinks(t, f, url.Values{"limit": {"2"}, "cursor": {cursor}})
+		if status != 200 {
+			t.Fatal("listing links: want status code 200 got", status)
+		}
+		listed = append(listed, page.Links...)
+		if cursor = page.NextCursor; cursor == "" {
+			break
+		}
+	}
+
+	want := []string{created[4], created[3], created[1], created[0]}
+	if len(listed) != len(want) {
+		t.Fatalf("want %d links got %+v", len(want), listed)
+	}
+	for i, l := range listed {
+		if l.ShortPath != want[i] {
+			t.Errorf("link %d: want %s got %s", i, want[i], l.ShortPath)
+		}
+	}
+	if listed[0].Follows != 1 || listed[1].Follows != 0 {
+		t.Errorf("follows: want 1 then 0 got %d then %d", listed[0].Follows, listed[1].Follows)
+	}
+}
+
+func TestListLinksBadRequests(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	for _, q := range []url.Values{
+		{"limit": {"0"}},
+		{"limit": {"1001"}},
+		{"cursor": {"not a cursor"}},
+	} {
+		if _, status := listLinks(t, f, q); status != 400 {
+			t.Errorf("%s: want status code 400 got %d", q.Encode(), status)
+		}
+	}
+}
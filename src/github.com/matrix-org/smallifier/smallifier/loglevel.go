@@ -0,0 +1,58 @@
+package smallifier
+
+import (
+	"errors"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// LogLevelRequest is the JSON-encoded body of an admin request to change the logging level.
+type LogLevelRequest struct {
+	// Level is the new level, e.g. "debug" or "info".
+	Level string `json:"level"`
+	// RevertAfter optionally restores the previous level after a duration such as "10m",
+	// so that debug logging turned on during an incident doesn't stay on.
+	RevertAfter string `json:"revert_after,omitempty"`
+}
+
+// LogLevelResponse is the JSON-encoded response describing the current logging level.
+type LogLevelResponse struct {
+	Level string `json:"level"`
+}
+
+// setLogLevel changes the process's logging level as described by r.
+// Any pending revert from an earlier request is cancelled.
+func (s *smallifier) setLogLevel(r LogLevelRequest) (LogLevelResponse, error) {
+	level, err := log.ParseLevel(r.Level)
+	if err != nil {
+		return LogLevelResponse{}, err
+	}
+	var revertAfter time.Duration
+	if r.RevertAfter != "" {
+		if revertAfter, err = time.ParseDuration(r.RevertAfter); err != nil || revertAfter <= 0 {
+			return LogLevelResponse{}, errors.New("revert_after must be a positive duration")
+		}
+	}
+
+	s.logLevelMu.Lock()
+	defer s.logLevelMu.Unlock()
+	if s.logLevelRevert != nil {
+		s.logLevelRevert.Stop()
+		s.logLevelRevert = nil
+	}
+	previous := log.GetLevel()
+	log.SetLevel(level)
+	log.WithFields(log.Fields{
+		"level":        level,
+		"previous":     previous,
+		"revert_after": r.RevertAfter,
+	}).Warn("Changed log level")
+	if revertAfter > 0 {
+		s.logLevelRevert = time.AfterFunc(revertAfter, func() {
+			log.SetLevel(previous)
+			log.WithField("level", previous).Warn("Reverted log level")
+		})
+	}
+	return LogLevelResponse{Level: level.String()}, nil
+}
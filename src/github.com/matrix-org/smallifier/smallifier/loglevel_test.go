@@ -0,0 +1,40 @@
+package smallifier
+
+import (
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func TestLogLevel(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+	defer log.SetLevel(log.GetLevel())
+	log.SetLevel(log.InfoLevel)
+
+	resp := adminBodyRequest(t, f, "PUT", "loglevel", testSecret, `{"level": "lemur"}`)
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Error("unknown level: want status code 400 got", resp.StatusCode)
+	}
+
+	resp = adminBodyRequest(t, f, "PUT", "loglevel", testSecret, `{"level": "debug", "revert_after": "50ms"}`)
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatal("setting level: want status code 200 got", resp.StatusCode)
+	}
+	var level LogLevelResponse
+	decodeAdminResponse(t, f, "GET", "loglevel", &level)
+	if level.Level != "debug" {
+		t.Errorf("after setting level: want debug got %s", level.Level)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for log.GetLevel() != log.InfoLevel && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := log.GetLevel(); got != log.InfoLevel {
+		t.Errorf("after revert_after: want info got %s", got)
+	}
+}
@@ -0,0 +1,171 @@
+package smallifier
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultLookupCacheSize and defaultLookupCacheTTL configure the cache used by WithLoadShedding if WithLookupCache isn't given.
+	defaultLookupCacheSize = 10000
+	defaultLookupCacheTTL  = 5 * time.Minute
+
+	// lookupCacheGenerations is how many generation counters a lookupCache spreads its links over.
+	lookupCacheGenerations = 256
+)
+
+// WithLookupCache keeps the destinations of up to size recently followed links in memory, so that following them again
+// doesn't query the database. Links are removed from the cache when they are changed or deleted, and kept for at most ttl,
+// which bounds how stale they can be if they are changed by another server sharing the database.
+func WithLookupCache(size int, ttl time.Duration) Option {
+	return func(s *smallifier) {
+		s.lookupCache = newLookupCache(size, ttl)
+		s.cacheLookups = true
+	}
+}
+
+// cachedLookup returns the cached link at shortPath, if links are cached and it is.
+func (s *smallifier) cachedLookup(shortPath string) (cachedLink, bool) {
+	if !s.cacheLookups {
+		return cachedLink{}, false
+	}
+	c, ok := s.lookupCache.get(shortPath, s.clock.Now())
+	if ok {
+		atomic.AddUint64(&s.lookupCacheHitCount, 1)
+	} else {
+		atomic.AddUint64(&s.lookupCacheMissCount, 1)
+	}
+	return c, ok
+}
+
+// lookupGeneration returns the generation of shortPath in the cache, to be read before looking it up in the database
+// and passed to cacheLookup.
+func (s *smallifier) lookupGeneration(shortPath string) uint64 {
+	if s.lookupCache == nil {
+		return 0
+	}
+	return s.lookupCache.generation(shortPath)
+}
+
+// cacheLookup caches the link at shortPath, whose long URL is link, if there is a cache. generation is what
+// lookupGeneration returned before the link was read, so that the link isn't cached if it has been forgotten since.
+func (s *smallifier) cacheLookup(shortPath string, generation uint64, link, appLink string, referrers *ReferrerPolicy) {
+	if s.lookupCache != nil {
+		s.lookupCache.add(cachedLink{shortPath: shortPath, link: link, appLink: appLink, referrers: referrers, added: s.clock.Now()}, generation)
+	}
+}
+
+// forgetLookup removes the link at shortPath from the cache, once it has changed.
+func (s *smallifier) forgetLookup(shortPath string) {
+	if s.lookupCache != nil {
+		s.lookupCache.remove(shortPath)
+	}
+}
+
+// LookupCacheHits gets a count of lookups served from the cache.
+func (s *smallifier) LookupCacheHits() float64 {
+	return float64(atomic.LoadUint64(&s.lookupCacheHitCount))
+}
+
+// LookupCacheMisses gets a count of lookups of links which weren't cached.
+func (s *smallifier) LookupCacheMisses() float64 {
+	return float64(atomic.LoadUint64(&s.lookupCacheMissCount))
+}
+
+type cachedLink struct {
+	shortPath string
+	link      string
+	appLink   string
+	referrers *ReferrerPolicy
+	added     time.Time
+}
+
+// lookupCache holds the most recently followed links, evicting the least recently followed once it's full.
+type lookupCache struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// order holds the cachedLinks, most recently followed first.
+	order *list.List
+	// generations counts the links removed, by the hash of their short path. A link read from the database is only
+	// added if its count hasn't changed since, so that a lookup racing a change can't cache what it replaced.
+	// The counts are shared between links, rather than kept for each, so that they take a fixed amount of memory;
+	// a link whose count is bumped by another's change just isn't cached that time.
+	generations [lookupCacheGenerations]uint64
+}
+
+func newLookupCache(size int, ttl time.Duration) *lookupCache {
+	return &lookupCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// get returns the cached link at shortPath, if it was cached no more than c.ttl before now.
+func (c *lookupCache) get(shortPath string, now time.Time) (cachedLink, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[shortPath]
+	if !ok {
+		return cachedLink{}, false
+	}
+	l := e.Value.(cachedLink)
+	if now.Sub(l.added) > c.ttl {
+		c.order.Remove(e)
+		delete(c.entries, shortPath)
+		return cachedLink{}, false
+	}
+	c.order.MoveToFront(e)
+	return l, true
+}
+
+// generation returns the count of removals for shortPath, to be passed to add.
+func (c *lookupCache) generation(shortPath string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generations[generationIndex(shortPath)]
+}
+
+// add caches l, unless a link sharing its generation count has been removed since generation was read.
+func (c *lookupCache) add(l cachedLink, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generations[generationIndex(l.shortPath)] != generation {
+		return
+	}
+	if e, ok := c.entries[l.shortPath]; ok {
+		e.Value = l
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[l.shortPath] = c.order.PushFront(l)
+	if c.order.Len() > c.size {
+		last := c.order.Back()
+		c.order.Remove(last)
+		delete(c.entries, last.Value.(cachedLink).shortPath)
+	}
+}
+
+func (c *lookupCache) remove(shortPath string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generations[generationIndex(shortPath)]++
+	if e, ok := c.entries[shortPath]; ok {
+		c.order.Remove(e)
+		delete(c.entries, shortPath)
+	}
+}
+
+// generationIndex returns the index of shortPath's count in lookupCache.generations.
+func generationIndex(shortPath string) int {
+	h := fnv.New32a()
+	h.Write([]byte(shortPath))
+	return int(h.Sum32() % lookupCacheGenerations)
+}
@@ -0,0 +1,80 @@
+package smallifier
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLookupCacheEvicts(t *testing.T) {
+	c := newLookupCache(2, time.Minute)
+	now := time.Now()
+	c.add(cachedLink{shortPath: "a", link: "https://a.example", added: now}, c.generation("a"))
+	c.add(cachedLink{shortPath: "b", link: "https://b.example", added: now}, c.generation("b"))
+	c.get("a", now)
+	c.add(cachedLink{shortPath: "c", link: "https://c.example", added: now}, c.generation("c"))
+	if _, ok := c.get("b", now); ok {
+		t.Error("least recently followed link wasn't evicted")
+	}
+	if _, ok := c.get("a", now); !ok {
+		t.Error("recently followed link was evicted")
+	}
+	if _, ok := c.get("c", now.Add(time.Minute+time.Second)); ok {
+		t.Error("stale link was served")
+	}
+}
+
+func TestLookupCacheSkipsRemovedLinks(t *testing.T) {
+	c := newLookupCache(2, time.Minute)
+	now := time.Now()
+	// A lookup reads the generation before querying the database, then the link is changed and removed from the cache
+	// before the lookup adds what it read.
+	generation := c.generation("a")
+	c.remove("a")
+	c.add(cachedLink{shortPath: "a", link: "https://old.example", added: now}, generation)
+	if l, ok := c.get("a", now); ok {
+		t.Errorf("link removed during its lookup was cached as %q", l.link)
+	}
+	c.add(cachedLink{shortPath: "a", link: "https://new.example", added: now}, c.generation("a"))
+	if _, ok := c.get("a", now); !ok {
+		t.Error("link looked up after it was removed wasn't cached")
+	}
+}
+
+func TestLookupCache(t *testing.T) {
+	f := serve(t, WithLookupCache(10, time.Minute))
+	defer f.Close()
+
+	link := shorten(t, f.server.URL, f.server.URL+"/_stub")
+	shortPath := link[len(f.base):]
+	client := insecureClient()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	follow := func(wantStatus int, wantLocation string) {
+		resp, err := client.Get(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != wantStatus || resp.Header.Get("Location") != wantLocation {
+			t.Errorf("want %d to %q got %d to %q", wantStatus, wantLocation, resp.StatusCode, resp.Header.Get("Location"))
+		}
+	}
+
+	follow(302, f.server.URL+"/_stub")
+	follow(302, f.server.URL+"/_stub")
+	if got := f.smallifier.LookupCacheHits(); got != 1 {
+		t.Errorf("want 1 cache hit got %v", got)
+	}
+	if got := f.smallifier.LookupCacheMisses(); got != 1 {
+		t.Errorf("want 1 cache miss got %v", got)
+	}
+	assertFollowCount(f, shortPath, 2, "cached link")
+
+	if got := changeLink(t, f, "PUT", shortPath, testSecret, `{"long_url": "`+f.server.URL+`/_stub?v=2"}`); got != 200 {
+		t.Fatalf("updating: want status code 200 got %d", got)
+	}
+	follow(302, f.server.URL+"/_stub?v=2")
+
+	deleteShortLink(t, f.server.URL, link)
+	follow(410, "")
+}
@@ -0,0 +1,91 @@
+package smallifier
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// maintenanceRetryAfter is how long clients are told to wait before retrying requests refused during maintenance,
+// which usually lasts longer than the transient failures retryAfter is for.
+const maintenanceRetryAfter = time.Minute
+
+// MaintenanceRequest is the JSON-encoded body of an admin request to turn maintenance mode on or off.
+type MaintenanceRequest struct {
+	Maintenance bool `json:"maintenance"`
+	// Message is shown to clients while maintenance mode is on, e.g. "Back by 14:00 UTC".
+	Message string `json:"message,omitempty"`
+}
+
+// MaintenanceStatus is the JSON-encoded response describing whether the Smallifier is in maintenance mode.
+type MaintenanceStatus struct {
+	Maintenance bool   `json:"maintenance"`
+	Message     string `json:"message,omitempty"`
+	// SinceTS is the unix timestamp at which maintenance mode was turned on, if it is.
+	SinceTS int64 `json:"since_ts,omitempty"`
+}
+
+// maintenancePage is what the "maintenance" page of a Theme is rendered with.
+type maintenancePage struct {
+	Message string
+}
+
+// maintenanceStatus returns whether the Smallifier is in maintenance mode.
+func (s *smallifier) maintenanceStatus() MaintenanceStatus {
+	status, _ := s.maintenance.Load().(MaintenanceStatus)
+	return status
+}
+
+// SetMaintenance turns maintenance mode on or off as described by r. Turning it on while it already is only changes
+// the message.
+func (s *smallifier) SetMaintenance(r MaintenanceRequest) MaintenanceStatus {
+	status := MaintenanceStatus{}
+	if r.Maintenance {
+		status = MaintenanceStatus{Maintenance: true, Message: r.Message, SinceTS: s.clock.Now().Unix()}
+		if previous := s.maintenanceStatus(); previous.Maintenance {
+			status.SinceTS = previous.SinceTS
+		}
+	}
+	s.maintenance.Store(status)
+	log.WithFields(log.Fields{
+		"maintenance": status.Maintenance,
+		"message":     status.Message,
+	}).Warn("Changed maintenance mode")
+	return status
+}
+
+// Maintenance gets 1 while the Smallifier is in maintenance mode, or otherwise 0.
+func (s *smallifier) Maintenance() float64 {
+	if s.maintenanceStatus().Maintenance {
+		return 1
+	}
+	return 0
+}
+
+// checkMaintenance wraps next, responding to requests with 503s while the Smallifier is in maintenance mode, except
+// those to the admin API, through which it is turned off. Browsers are shown the "maintenance" page of the theme, and
+// other clients an ErrorResponse with ErrCodeMaintenance. Follows already queued are still written meanwhile.
+func (s *smallifier) checkMaintenance(next http.Handler) http.Handler {
+	admin := s.base.Path + adminPrefix[1:]
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		status := s.maintenanceStatus()
+		if !status.Maintenance || strings.HasPrefix(req.URL.Path, admin) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		setHeaders(w)
+		w.Header().Set("Retry-After", strconv.Itoa(int(maintenanceRetryAfter/time.Second)))
+		if strings.Contains(req.Header.Get("Accept"), "text/html") {
+			s.render(w, 503, "maintenance", maintenancePage{status.Message})
+			return
+		}
+		msg := status.Message
+		if msg == "" {
+			msg = "down for maintenance"
+		}
+		writeErrorResponse(w, 503, ErrorResponse{ErrCode: ErrCodeMaintenance, Message: msg, Retryable: true})
+	})
+}
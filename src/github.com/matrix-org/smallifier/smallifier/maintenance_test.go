@@ -0,0 +1,70 @@
+package smallifier
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMaintenance(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+	// Maintenance mode is enforced by Handler, rather than the handlers for each endpoint the fixture serves.
+	f.server.Config.Handler = f.smallifier.Handler()
+	client := insecureClient()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+
+	shortened := shorten(t, f.server.URL, "https://lemurs.win/")
+	resp := adminBodyRequest(t, f, "PUT", "maintenance", testSecret, `{"maintenance": true, "message": "Back by 14:00 UTC"}`)
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("turning maintenance mode on: want 200 got %d", resp.StatusCode)
+	}
+	if got := f.smallifier.Maintenance(); got != 1 {
+		t.Errorf("want maintenance 1 got %v", got)
+	}
+
+	// Browsers are shown a page, and other clients an error.
+	req, err := http.NewRequest("GET", shortened, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 503 || !strings.Contains(string(b), "Back by 14:00 UTC") || resp.Header.Get("Retry-After") != "60" {
+		t.Errorf("follow from a browser: want 503 page with the message got %d %s", resp.StatusCode, b)
+	}
+	resp, err = client.Post(f.server.URL+"/_create", "application/json",
+		strings.NewReader(`{"long_url": "https://lemurs.win/", "secret": "`+testSecret+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e ErrorResponse
+	json.NewDecoder(resp.Body).Decode(&e)
+	resp.Body.Close()
+	if resp.StatusCode != 503 || e.ErrCode != ErrCodeMaintenance || e.Message != "Back by 14:00 UTC" || !e.Retryable {
+		t.Errorf("create: want 503 %s got %d %+v", ErrCodeMaintenance, resp.StatusCode, e)
+	}
+
+	var status MaintenanceStatus
+	decodeAdminResponse(t, f, "GET", "maintenance", &status)
+	if !status.Maintenance || status.SinceTS == 0 {
+		t.Errorf("want maintenance mode on got %+v", status)
+	}
+	f.smallifier.SetMaintenance(MaintenanceRequest{})
+	resp, err = client.Get(shortened)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 302 {
+		t.Errorf("follow after maintenance: want 302 got %d", resp.StatusCode)
+	}
+}
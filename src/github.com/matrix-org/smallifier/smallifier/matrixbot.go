@@ -0,0 +1,223 @@
+package smallifier
+
+import (
+	"context"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// matrixBotCommand starts messages asking the Matrix bot to shorten the URL which follows it.
+	matrixBotCommand = "!shorten "
+	// matrixSyncTimeout is how long, in milliseconds, the homeserver is asked to wait for new events before answering a sync.
+	matrixSyncTimeout = 30000
+	// matrixBotRetryDelay is how long the Matrix bot waits before trying again after failing to talk to its homeserver.
+	matrixBotRetryDelay = 5 * time.Second
+)
+
+// MatrixBot is a Matrix user which joins the rooms it is invited to and answers "!shorten <url>" with a short link to url.
+type MatrixBot struct {
+	// Homeserver is the base URL of the homeserver's client-server API, e.g. https://matrix.org.
+	Homeserver  string
+	AccessToken string
+	// AllowedUsers may invite the bot to rooms and have it shorten URLs. Each is a user ID, e.g. @alice:matrix.org, or a
+	// server name after a colon, e.g. :matrix.org, allowing every user on that server. If there are none, anyone may,
+	// but only if WithOpenCreation was given, just as anyone may create links without the secret.
+	AllowedUsers []string
+	// Client must not time out requests in less than the 30 seconds the homeserver is asked to wait for new events.
+	Client *http.Client
+}
+
+// WithMatrixBot runs b, shortening URLs sent to it in Matrix rooms, until Close is called.
+// Links it creates are checked just like those created through the API.
+func WithMatrixBot(b *MatrixBot) Option {
+	return func(s *smallifier) {
+		s.matrixBot = b
+	}
+}
+
+// allows returns whether userID may invite the bot and have it shorten URLs.
+func (b *MatrixBot) allows(userID string, openCreation bool) bool {
+	if len(b.AllowedUsers) == 0 {
+		return openCreation
+	}
+	for _, u := range b.AllowedUsers {
+		if u == userID || (strings.HasPrefix(u, ":") && strings.HasSuffix(userID, u)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *MatrixBot) url(path string) string {
+	return strings.TrimSuffix(b.Homeserver, "/") + "/_matrix/client/r0" + path
+}
+
+// matrixSync is the part of the response to a sync which the bot reads.
+type matrixSync struct {
+	NextBatch string `json:"next_batch"`
+	Rooms     struct {
+		Join map[string]struct {
+			Timeline struct {
+				Events []matrixEvent `json:"events"`
+			} `json:"timeline"`
+		} `json:"join"`
+		Invite map[string]struct {
+			InviteState struct {
+				Events []matrixEvent `json:"events"`
+			} `json:"invite_state"`
+		} `json:"invite"`
+	} `json:"rooms"`
+}
+
+type matrixEvent struct {
+	Type     string  `json:"type"`
+	Sender   string  `json:"sender"`
+	StateKey *string `json:"state_key"`
+	Content  struct {
+		MsgType    string `json:"msgtype"`
+		Body       string `json:"body"`
+		Membership string `json:"membership"`
+	} `json:"content"`
+}
+
+// runMatrixBot syncs with the Matrix bot's homeserver, joining rooms and answering commands, until s.stop is closed.
+// Messages sent before it starts are ignored, so that commands aren't answered again whenever it restarts.
+func (s *smallifier) runMatrixBot() {
+	defer s.background.Done()
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	b := s.matrixBot
+	var userID, since string
+	for ctx.Err() == nil {
+		var err error
+		if userID == "" {
+			var resp struct {
+				UserID string `json:"user_id"`
+			}
+			err = matrixRequest(ctx, b.Client, b.AccessToken, "GET", b.url("/account/whoami"), nil, &resp)
+			userID = resp.UserID
+		} else {
+			since, err = s.syncMatrixBot(ctx, userID, since)
+		}
+		if err != nil && ctx.Err() == nil {
+			log.WithField("err", err).Error("Error syncing Matrix bot")
+			select {
+			case <-s.clock.After(matrixBotRetryDelay):
+			case <-ctx.Done():
+			}
+		}
+	}
+}
+
+// syncMatrixBot waits for events after since, handling them as userID, and returns the token to sync from next.
+// If since is empty, only invites are handled.
+func (s *smallifier) syncMatrixBot(ctx context.Context, userID, since string) (string, error) {
+	b := s.matrixBot
+	q := url.Values{}
+	if since == "" {
+		q.Set("filter", `{"room": {"timeline": {"limit": 0}}}`)
+	} else {
+		q.Set("since", since)
+		q.Set("timeout", strconv.Itoa(matrixSyncTimeout))
+	}
+	var resp matrixSync
+	if err := matrixRequest(ctx, b.Client, b.AccessToken, "GET", b.url("/sync?"+q.Encode()), nil, &resp); err != nil {
+		return since, err
+	}
+	for roomID, room := range resp.Rooms.Invite {
+		for _, e := range room.InviteState.Events {
+			if e.Type == "m.room.member" && e.StateKey != nil && *e.StateKey == userID && e.Content.Membership == "invite" {
+				s.answerMatrixInvite(ctx, roomID, e.Sender)
+			}
+		}
+	}
+	if since != "" {
+		for roomID, room := range resp.Rooms.Join {
+			for _, e := range room.Timeline.Events {
+				if e.Type == "m.room.message" && e.Sender != userID && e.Content.MsgType == "m.text" &&
+					strings.HasPrefix(e.Content.Body, matrixBotCommand) {
+					s.answerMatrixCommand(ctx, roomID, e.Sender, strings.TrimSpace(e.Content.Body[len(matrixBotCommand):]))
+				}
+			}
+		}
+	}
+	return resp.NextBatch, nil
+}
+
+// answerMatrixInvite joins roomID if inviter may use the bot, and rejects the invite otherwise.
+func (s *smallifier) answerMatrixInvite(ctx context.Context, roomID, inviter string) {
+	b := s.matrixBot
+	action := "join"
+	if !b.allows(inviter, s.openCreation) {
+		action = "leave"
+	}
+	err := matrixRequest(ctx, b.Client, b.AccessToken, "POST", b.url("/rooms/"+url.PathEscape(roomID)+"/"+action), struct{}{}, nil)
+	fields := log.Fields{
+		"room_id": roomID,
+		"inviter": inviter,
+		"action":  action,
+	}
+	if err != nil {
+		fields["err"] = err
+		log.WithFields(fields).Error("Error answering Matrix invite")
+		return
+	}
+	log.WithFields(fields).Info("Answered Matrix invite")
+}
+
+// answerMatrixCommand creates a link to link for sender, and replies in roomID with its short URL, or why it couldn't.
+func (s *smallifier) answerMatrixCommand(ctx context.Context, roomID, sender, link string) {
+	var reply string
+	var shortURL string
+	// Unless the bot only answers AllowedUsers, links are created as anonymous creators' would be.
+	trusted := len(s.matrixBot.AllowedUsers) > 0
+	if !s.matrixBot.allows(sender, s.openCreation) {
+		atomic.AddUint64(&s.authErrorCount, 1)
+		reply = "Sorry, you aren't allowed to shorten links."
+	} else if resp, err := s.shorten(ctx, CreateRequest{LongURL: link}, "", "", trusted); err != nil {
+		if e, ok := err.(*ErrorResponse); ok && e.Status != 500 {
+			reply = "Couldn't shorten " + link + ": " + e.Message
+		} else {
+			log.WithFields(log.Fields{
+				"err":    err,
+				"sender": sender,
+				"url":    link,
+			}).Error("Error creating link for Matrix bot")
+			reply = "Sorry, something went wrong shortening that link."
+		}
+	} else {
+		shortURL = resp.ShortURL
+		log.WithFields(log.Fields{
+			"short_url": shortURL,
+			"long_url":  link,
+			"sender":    sender,
+		}).Info("Created link for Matrix bot")
+	}
+	msg := MatrixMessage{MsgType: "m.notice", Body: reply}
+	if shortURL != "" {
+		msg.Body = shortURL
+		msg.Format = "org.matrix.custom.html"
+		msg.FormattedBody = `<a href="` + html.EscapeString(shortURL) + `">` + html.EscapeString(shortURL) + `</a>`
+	}
+	if err := sendMatrixMessage(ctx, s.matrixBot.Client, s.matrixBot.Homeserver, s.matrixBot.AccessToken, roomID, msg); err != nil {
+		log.WithFields(log.Fields{
+			"err":     err,
+			"room_id": roomID,
+		}).Error("Error replying to Matrix command")
+	}
+}
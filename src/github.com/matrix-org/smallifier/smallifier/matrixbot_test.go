@@ -0,0 +1,138 @@
+package smallifier
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMatrixBot(t *testing.T) {
+	var mu sync.Mutex
+	var actions []string
+	var replies []MatrixMessage
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.HasSuffix(req.URL.Path, "/account/whoami"):
+			w.Write([]byte(`{"user_id": "@bot:lemurs.win"}`))
+		case strings.HasSuffix(req.URL.Path, "/sync") && req.URL.Query().Get("since") == "":
+			// Commands in the initial sync were sent before the bot started, so mustn't be answered.
+			w.Write([]byte(`{"next_batch": "1", "rooms": {
+				"invite": {
+					"!friends:lemurs.win": {"invite_state": {"events": [
+						{"type": "m.room.member", "sender": "@alice:lemurs.win", "state_key": "@bot:lemurs.win", "content": {"membership": "invite"}}
+					]}},
+					"!spam:evil.example": {"invite_state": {"events": [
+						{"type": "m.room.member", "sender": "@mallory:evil.example", "state_key": "@bot:lemurs.win", "content": {"membership": "invite"}}
+					]}}
+				},
+				"join": {"!friends:lemurs.win": {"timeline": {"events": [
+					{"type": "m.room.message", "sender": "@alice:lemurs.win", "content": {"msgtype": "m.text", "body": "!shorten https://lemurs.win/old"}}
+				]}}}
+			}}`))
+		case strings.HasSuffix(req.URL.Path, "/sync") && req.URL.Query().Get("since") == "1":
+			w.Write([]byte(`{"next_batch": "2", "rooms": {"join": {"!friends:lemurs.win": {"timeline": {"events": [
+				{"type": "m.room.message", "sender": "@alice:lemurs.win", "content": {"msgtype": "m.text", "body": "!shorten https://lemurs.win/new"}},
+				{"type": "m.room.message", "sender": "@alice:lemurs.win", "content": {"msgtype": "m.text", "body": "not a command"}},
+				{"type": "m.room.message", "sender": "@mallory:evil.example", "content": {"msgtype": "m.text", "body": "!shorten https://evil.example/"}},
+				{"type": "m.room.message", "sender": "@bob:lemurs.win", "content": {"msgtype": "m.text", "body": "!shorten ftp://lemurs.win/"}}
+			]}}}}}`))
+		case strings.HasSuffix(req.URL.Path, "/sync"):
+			mu.Unlock()
+			select {
+			case <-req.Context().Done():
+			case <-time.After(50 * time.Millisecond):
+			}
+			mu.Lock()
+			w.Write([]byte(`{"next_batch": "2"}`))
+		case strings.Contains(req.URL.Path, "/send/m.room.message/"):
+			var msg MatrixMessage
+			json.NewDecoder(req.Body).Decode(&msg)
+			replies = append(replies, msg)
+			w.Write([]byte(`{"event_id": "$reply"}`))
+		default:
+			actions = append(actions, req.Method+" "+req.URL.Path)
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer hs.Close()
+
+	f := serve(t, WithMatrixBot(&MatrixBot{
+		Homeserver:   hs.URL,
+		AccessToken:  "bot_token",
+		AllowedUsers: []string{":lemurs.win"},
+	}))
+	defer f.Close()
+
+	for i := 0; ; i++ {
+		mu.Lock()
+		n := len(replies)
+		mu.Unlock()
+		if n >= 3 {
+			break
+		}
+		if i == 500 {
+			t.Fatalf("replies: want 3 got %d", n)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(actions) != 2 || !strings.Contains(strings.Join(actions, " "), "/rooms/!friends:lemurs.win/join") ||
+		!strings.Contains(strings.Join(actions, " "), "/rooms/!spam:evil.example/leave") {
+		t.Errorf("invites: want join of !friends and leave of !spam got %v", actions)
+	}
+	if len(replies) != 3 {
+		t.Fatalf("replies: want 3 got %+v", replies)
+	}
+	if !strings.HasPrefix(replies[0].Body, f.base) || replies[0].MsgType != "m.notice" {
+		t.Errorf("reply to command: want notice of short URL got %+v", replies[0])
+	}
+	var longURL string
+	if err := f.db.QueryRow(`SELECT long_url FROM links WHERE short_path = $1`, strings.TrimPrefix(replies[0].Body, f.base)).Scan(&longURL); err != nil {
+		t.Fatal(err)
+	}
+	if longURL != "https://lemurs.win/new" {
+		t.Errorf("long url: want https://lemurs.win/new got %s", longURL)
+	}
+	if !strings.Contains(replies[1].Body, "aren't allowed") {
+		t.Errorf("reply to disallowed user: want refusal got %+v", replies[1])
+	}
+	if !strings.HasPrefix(replies[2].Body, "Couldn't shorten ftp://lemurs.win/") {
+		t.Errorf("reply to bad URL: want error got %+v", replies[2])
+	}
+	var links int
+	if err := f.db.QueryRow(`SELECT COUNT(*) FROM links`).Scan(&links); err != nil {
+		t.Fatal(err)
+	}
+	if links != 1 {
+		t.Errorf("links: want 1 got %d", links)
+	}
+}
+
+func TestMatrixBotAllows(t *testing.T) {
+	b := &MatrixBot{AllowedUsers: []string{"@alice:lemurs.win", ":matrix.org"}}
+	for _, tt := range []struct {
+		userID string
+		want   bool
+	}{
+		{"@alice:lemurs.win", true},
+		{"@bob:lemurs.win", false},
+		{"@bob:matrix.org", true},
+		{"@bob:notmatrix.org", false},
+	} {
+		if got := b.allows(tt.userID, false); got != tt.want {
+			t.Errorf("allows(%s): want %v got %v", tt.userID, tt.want, got)
+		}
+	}
+	open := &MatrixBot{}
+	if open.allows("@anyone:example.org", false) || !open.allows("@anyone:example.org", true) {
+		t.Error("with no allowed users: want only open creation to allow")
+	}
+}
@@ -0,0 +1,82 @@
+package smallifier
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// WithMatrixToInterstitial makes links to matrix.to show a page previewing the room, user or event they point to,
+// with a link onwards, rather than redirecting straight there.
+// Some clients drop or re-encode the fragment when following a redirect, which is where matrix.to keeps everything
+// it needs; the page links to the long URL exactly as it was shortened.
+func WithMatrixToInterstitial() Option {
+	return func(s *smallifier) {
+		s.matrixToInterstitial = true
+	}
+}
+
+// matrixToLink is what a matrix.to URL, of the form https://matrix.to/#/<identifier>[/<event ID>][?via=<server>...], points to.
+type matrixToLink struct {
+	// Kind describes the identifier, e.g. "Room" or "User".
+	Kind       string
+	Identifier string
+	EventID    string
+	Via        []string
+}
+
+// matrixToKinds maps the sigil of a Matrix identifier to what it identifies.
+var matrixToKinds = map[byte]string{
+	'#': "Room",
+	'!': "Room",
+	'@': "User",
+	'+': "Community",
+}
+
+// parseMatrixTo parses link as a matrix.to URL, reporting whether it is one.
+// Only https://matrix.to/ URLs are, as the interstitial page links to them without html/template checking the scheme.
+func parseMatrixTo(link string) (matrixToLink, bool) {
+	var m matrixToLink
+	if _, err := url.Parse(link); err != nil || !strings.HasPrefix(strings.ToLower(link), "https://matrix.to/") {
+		return m, false
+	}
+	// The raw fragment is used, as identifiers may themselves contain '#' and may be percent-encoded.
+	i := strings.IndexByte(link, '#')
+	if i < 0 || !strings.HasPrefix(link[i+1:], "/") {
+		return m, false
+	}
+	fragment := link[i+2:]
+
+	if j := strings.IndexByte(fragment, '?'); j >= 0 {
+		if q, err := url.ParseQuery(fragment[j+1:]); err == nil {
+			m.Via = q["via"]
+		}
+		fragment = fragment[:j]
+	}
+	parts := strings.SplitN(fragment, "/", 2)
+	var err error
+	if m.Identifier, err = url.PathUnescape(parts[0]); err != nil || m.Identifier == "" {
+		return m, false
+	}
+	if m.Kind = matrixToKinds[m.Identifier[0]]; m.Kind == "" {
+		return m, false
+	}
+	if len(parts) == 2 {
+		if m.EventID, err = url.PathUnescape(parts[1]); err != nil {
+			return m, false
+		}
+	}
+	return m, true
+}
+
+// matrixToPage is what the "matrixto" page of a Theme is rendered with.
+type matrixToPage struct {
+	matrixToLink
+	URL template.URL
+}
+
+// renderMatrixTo writes the interstitial page for the matrix.to link.
+func (s *smallifier) renderMatrixTo(w http.ResponseWriter, link string, m matrixToLink) error {
+	return s.render(w, 200, "matrixto", matrixToPage{m, template.URL(link)})
+}
@@ -0,0 +1,75 @@
+package smallifier
+
+import (
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMatrixTo(t *testing.T) {
+	for _, tc := range []struct {
+		link string
+		want matrixToLink
+		ok   bool
+	}{
+		{"https://matrix.to/#/#room:lemurs.win", matrixToLink{Kind: "Room", Identifier: "#room:lemurs.win"}, true},
+		{"https://matrix.to/#/%23room:lemurs.win", matrixToLink{Kind: "Room", Identifier: "#room:lemurs.win"}, true},
+		{"https://matrix.to/#/@ring:lemurs.win", matrixToLink{Kind: "User", Identifier: "@ring:lemurs.win"}, true},
+		{"https://matrix.to/#/!abc:lemurs.win/$event?via=lemurs.win&via=example.org", matrixToLink{Kind: "Room", Identifier: "!abc:lemurs.win", EventID: "$event", Via: []string{"lemurs.win", "example.org"}}, true},
+		{"https://matrix.to/", matrixToLink{}, false},
+		{"https://matrix.to/#/lemurs", matrixToLink{}, false},
+		{"https://lemurs.win/#/#room:lemurs.win", matrixToLink{}, false},
+		{"http://matrix.to/#/#room:lemurs.win", matrixToLink{}, false},
+		{"javascript://matrix.to/%0aalert(1)//#/#room:lemurs.win", matrixToLink{}, false},
+		{"https://matrix.to.lemurs.win/#/#room:lemurs.win", matrixToLink{}, false},
+		{"HTTPS://Matrix.To/#/#room:lemurs.win", matrixToLink{Kind: "Room", Identifier: "#room:lemurs.win"}, true},
+	} {
+		got, ok := parseMatrixTo(tc.link)
+		if ok != tc.ok || (ok && !reflect.DeepEqual(tc.want, got)) {
+			t.Errorf("parseMatrixTo(%q): want %+v, %t got %+v, %t", tc.link, tc.want, tc.ok, got, ok)
+		}
+	}
+}
+
+func TestMatrixToInterstitial(t *testing.T) {
+	f := serve(t, WithMatrixToInterstitial())
+	defer f.Close()
+
+	const link = "https://matrix.to/#/#lemurs:matrix.org?via=matrix.org"
+	shortened := shorten(t, f.server.URL, link)
+	resp, err := insecureClient().Get(shortened)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Room #lemurs:matrix.org", "Via matrix.org", `href="` + link + `"`} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("interstitial: want %q in page got %s", want, b)
+		}
+	}
+	assertFollowCount(f, shortened[len(f.base):], 1, "after viewing interstitial:")
+}
+
+func TestMatrixToFragmentPreserved(t *testing.T) {
+	f := serve(t, WithDeterministicKey([]byte("lemurs")))
+	defer f.Close()
+
+	const link = "https://matrix.to/#/%23Lemurs:matrix.org/$Event?via=matrix.org"
+	shortened := shorten(t, f.server.URL, link)
+	client := insecureClient()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.Get(shortened)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("Location"); got != link {
+		t.Errorf("want redirect to %q got %q", link, got)
+	}
+}
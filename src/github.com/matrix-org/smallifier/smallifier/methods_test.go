@@ -0,0 +1,47 @@
+package smallifier
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMethods(t *testing.T) {
+	f := serve(t, WithAllowedOrigins([]string{"https://lemurs.win"}))
+	defer f.Close()
+
+	do := func(method, path, origin string) *http.Response {
+		req, err := http.NewRequest(method, f.server.URL+path, strings.NewReader(`{"long_url": "https://lemurs.win/", "secret": "`+testSecret+`"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+			req.Header.Set("Access-Control-Request-Method", "POST")
+		}
+		resp, err := insecureClient().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	for _, path := range []string{"/_create", "/_delete", "/_bundle"} {
+		for _, method := range []string{"GET", "PUT", "DELETE"} {
+			resp := do(method, path, "")
+			if resp.StatusCode != 405 || resp.Header.Get("Allow") != "POST, OPTIONS" {
+				t.Errorf("%s %s: want 405 allowing POST, OPTIONS got %d allowing %q", method, path, resp.StatusCode, resp.Header.Get("Allow"))
+			}
+		}
+
+		resp := do("OPTIONS", path, "https://lemurs.win")
+		if resp.StatusCode != 204 || resp.Header.Get("Access-Control-Allow-Methods") != "POST, OPTIONS" ||
+			resp.Header.Get("Access-Control-Allow-Origin") == "" || resp.Header.Get("Access-Control-Max-Age") == "" {
+			t.Errorf("preflight %s: want 204 allowing POST got %d with %v", path, resp.StatusCode, resp.Header)
+		}
+		if resp := do("OPTIONS", path, "https://evil.example"); resp.StatusCode != 403 {
+			t.Errorf("preflight %s from disallowed origin: want 403 got %d", path, resp.StatusCode)
+		}
+	}
+}
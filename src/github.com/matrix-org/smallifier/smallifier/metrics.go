@@ -0,0 +1,213 @@
+package smallifier
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Registerer is what WithMetrics registers metrics with.
+type Registerer interface {
+	Register(prometheus.Collector) error
+}
+
+type defaultRegisterer struct{}
+
+func (defaultRegisterer) Register(c prometheus.Collector) error {
+	return prometheus.Register(c)
+}
+
+// DefaultRegisterer registers metrics with the default Prometheus registry, which prometheus.Handler serves.
+var DefaultRegisterer Registerer = defaultRegisterer{}
+
+// WithMetrics registers the Smallifier's metrics with r when it is made: counts of links created and looked up,
+// of errors and of load shed, the state of the follow queue and lookup cache, and how long Handler took to serve
+// requests to each endpoint. New panics if they can't be registered, e.g. because another Smallifier's already are.
+func WithMetrics(r Registerer) Option {
+	return func(s *smallifier) {
+		s.registerer = r
+	}
+}
+
+var (
+	namespaceCreatesDesc = prometheus.NewDesc("namespace_create_count", "Counts number of links created, by the namespace of their destination", []string{"namespace"}, nil)
+	namespaceFollowsDesc = prometheus.NewDesc("namespace_follow_count", "Counts number of links followed, by the namespace of their destination", []string{"namespace"}, nil)
+)
+
+// namespaceCollector exports the counts of links created and followed in each namespace, labelled by namespace.
+type namespaceCollector struct {
+	s *smallifier
+}
+
+func (c namespaceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- namespaceCreatesDesc
+	ch <- namespaceFollowsDesc
+}
+
+func (c namespaceCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, n := range c.s.NamespaceCounts() {
+		ch <- prometheus.MustNewConstMetric(namespaceCreatesDesc, prometheus.CounterValue, n.Creates, n.Namespace)
+		ch <- prometheus.MustNewConstMetric(namespaceFollowsDesc, prometheus.CounterValue, n.Follows, n.Namespace)
+	}
+}
+
+var (
+	linkLimitLinksDesc = prometheus.NewDesc("link_limit_links", "Number of links counted against each limit on links stored", []string{"limit"}, nil)
+	linkLimitFillDesc  = prometheus.NewDesc("link_limit_fill_ratio", "Fraction of each limit on links stored which is used", []string{"limit"}, nil)
+)
+
+// linkLimitCollector exports how much of each limit on links stored is used, labelled by "total" or the namespace limited.
+type linkLimitCollector struct {
+	s *smallifier
+}
+
+func (c linkLimitCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- linkLimitLinksDesc
+	ch <- linkLimitFillDesc
+}
+
+func (c linkLimitCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, u := range c.s.LinkLimitUsage() {
+		ch <- prometheus.MustNewConstMetric(linkLimitLinksDesc, prometheus.GaugeValue, u.Links, u.Limit)
+		ch <- prometheus.MustNewConstMetric(linkLimitFillDesc, prometheus.GaugeValue, u.Links/u.Max, u.Limit)
+	}
+}
+
+// registerMetrics registers every metric with s.registerer.
+func (s *smallifier) registerMetrics() error {
+	counter := func(count *uint64) func() float64 {
+		return func() float64 {
+			return float64(atomic.LoadUint64(count))
+		}
+	}
+	s.requestDurations = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "request_duration_seconds",
+		Help: "How long requests took to serve, by the endpoint requested",
+	}, []string{"handler"})
+	for _, c := range []prometheus.Collector{
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "create_count",
+			Help: "Counts number of links and bundles created",
+		}, counter(&s.createCount)),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "lookup_count",
+			Help: "Counts number of lookups of links",
+		}, counter(&s.lookupCount)),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "follow_count",
+			Help: "Counts number of links and bundles followed, whether or not the follows are recorded",
+		}, counter(&s.followCount)),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "random_error_count",
+			Help: "Counts number of errors encountered when trying to generate secure random numbers",
+		}, s.RandomErrors),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "random_fallback_count",
+			Help: "Counts number of times fallback entropy was used because secure random numbers couldn't be generated",
+		}, s.RandomFallbacks),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "random_breaker_open",
+			Help: "1 while generating secure random numbers isn't tried because it kept failing, otherwise 0",
+		}, s.RandomBreakerOpen),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "read_only",
+			Help: "1 while links can't be created or changed because read-only mode is on, otherwise 0",
+		}, s.ReadOnly),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "maintenance",
+			Help: "1 while every request but those to the admin API gets a 503 because maintenance mode is on, otherwise 0",
+		}, s.Maintenance),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "auth_error_count",
+			Help: "Counts number of errors encountered because of missing or incorrect secrets",
+		}, s.AuthErrors),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "db_update_error_count",
+			Help: "Counts number of errors encountered updating the database",
+		}, s.DBUpdateErrors),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "webhook_error_count",
+			Help: "Counts number of webhook deliveries which failed",
+		}, s.WebhookErrors),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "lookup_miss_count",
+			Help: "Counts number of lookups of links which don't exist",
+		}, s.LookupMisses),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "rate_limited_lookup_count",
+			Help: "Counts number of lookups refused because the client looked up too many links which don't exist",
+		}, s.RateLimitedLookups),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "follow_queue_depth",
+			Help: "Number of follows waiting to be written to the database",
+		}, s.FollowQueueDepth),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "dropped_follow_count",
+			Help: "Counts number of follows not recorded because the follow queue was full",
+		}, s.DroppedFollows),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "load_shedding",
+			Help: "1 while load is being shed, otherwise 0",
+		}, s.LoadShedding),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "load_shedding_transition_count",
+			Help: "Counts number of times load shedding started or stopped",
+		}, s.LoadSheddingTransitions),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "shed_request_count",
+			Help: "Counts number of requests refused, and follows not recorded, while shedding load",
+		}, s.ShedRequests),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "lookup_cache_hit_count",
+			Help: "Counts number of lookups served from the lookup cache",
+		}, s.LookupCacheHits),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "lookup_cache_miss_count",
+			Help: "Counts number of lookups of links which weren't in the lookup cache",
+		}, s.LookupCacheMisses),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "path_collision_count",
+			Help: "Counts number of attempts to store generated short paths which collided with existing links",
+		}, s.PathCollisions),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "path_collision_rate",
+			Help: "Fraction of the last 1000 attempts to store generated short paths which collided with existing links",
+		}, s.PathCollisionRate),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "path_space_fill_ratio",
+			Help: "Fraction of the possible generated short paths of the current length which are in use",
+		}, s.PathSpaceFill),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "path_bytes",
+			Help: "Number of random bytes short paths are generated from",
+		}, s.PathBytes),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "link_limit_refused_count",
+			Help: "Counts number of links not created because a limit on links stored was reached",
+		}, s.LinkLimitRefusals),
+		namespaceCollector{s},
+		linkLimitCollector{s},
+		s.requestDurations,
+	} {
+		if err := s.registerer.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// timed wraps h to observe how long it takes to serve requests in the request_duration_seconds histogram, labelled with
+// the name of the endpoint, if WithMetrics was given.
+func (s *smallifier) timed(name string, h http.HandlerFunc) http.HandlerFunc {
+	if s.requestDurations == nil {
+		return h
+	}
+	observer := s.requestDurations.WithLabelValues(name)
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		h(w, req)
+		observer.Observe(time.Since(start).Seconds())
+	}
+}
@@ -0,0 +1,83 @@
+package smallifier
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// testRegisterer keeps the collectors registered with it, so that their metrics can be read back.
+type testRegisterer struct {
+	collectors []prometheus.Collector
+}
+
+func (r *testRegisterer) Register(c prometheus.Collector) error {
+	r.collectors = append(r.collectors, c)
+	return nil
+}
+
+// metric returns the metric named name with the given label values, if any, failing the test if there isn't one.
+func (r *testRegisterer) metric(t *testing.T, name string, labelValues ...string) *dto.Metric {
+	for _, c := range r.collectors {
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+		for m := range ch {
+			if !strings.Contains(m.Desc().String(), `fqName: "`+name+`"`) {
+				continue
+			}
+			var pb dto.Metric
+			if err := m.Write(&pb); err != nil {
+				t.Fatal(err)
+			}
+			if labelsMatch(pb.GetLabel(), labelValues) {
+				return &pb
+			}
+		}
+	}
+	t.Fatalf("no metric %s %v", name, labelValues)
+	return nil
+}
+
+func labelsMatch(labels []*dto.LabelPair, values []string) bool {
+	if len(labels) != len(values) {
+		return false
+	}
+	for i, l := range labels {
+		if l.GetValue() != values[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMetrics(t *testing.T) {
+	r := &testRegisterer{}
+	f := serve(t, WithMetrics(r))
+	defer f.Close()
+
+	h := f.smallifier.Handler()
+	shortened := shorten(t, f.server.URL, "https://lemurs.win")
+	for _, u := range []string{shortened, f.base + "tj2TEXT7"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", u, nil))
+	}
+
+	for _, tc := range []struct {
+		name string
+		want float64
+	}{
+		{"create_count", 1},
+		{"lookup_count", 2},
+		{"lookup_miss_count", 1},
+	} {
+		if got := r.metric(t, tc.name).GetCounter().GetValue(); got != tc.want {
+			t.Errorf("%s: want %v got %v", tc.name, tc.want, got)
+		}
+	}
+	if got := r.metric(t, "request_duration_seconds", "lookup").GetHistogram().GetSampleCount(); got != 2 {
+		t.Errorf("want 2 lookups timed got %d", got)
+	}
+}
@@ -0,0 +1,31 @@
+package smallifier
+
+import "net/http"
+
+// Handler returns an http.Handler serving every endpoint under the path of s.base.
+// Requests for paths outside it are 404ed, and a request for the path without its trailing slash is redirected to it.
+// Documents given to WithWellKnownMatrix are the exception, being served at the root of the host.
+// Requests' Host headers are checked if WithHostCheck was given, and responses carry HSTS headers if WithHSTS was.
+// In maintenance mode, every request but those to the admin API gets a 503.
+// How long requests to each endpoint take is observed if WithMetrics was given.
+func (s *smallifier) Handler() http.Handler {
+	p := s.base.Path
+	mux := http.NewServeMux()
+	mux.HandleFunc(p+"_create", s.timed("create", s.CreateHandler))
+	mux.HandleFunc(p+"_bundle", s.timed("bundle", s.CreateBundleHandler))
+	mux.HandleFunc(p+"_delete", s.timed("delete", s.DeleteHandler))
+	mux.HandleFunc(p+"_nonce", s.timed("nonce", s.NonceHandler))
+	mux.HandleFunc(p+"_links", s.timed("links", s.LinksHandler))
+	mux.HandleFunc(p+linkPrefix[1:], s.timed("link", s.LinkHandler))
+	mux.HandleFunc(p+adminPrefix[1:], s.timed("admin", s.AdminHandler))
+	mux.HandleFunc(p+readPrefix[1:], s.timed("read", s.ReadHandler))
+	mux.HandleFunc(p+statsPrefix[1:], s.timed("stats", s.StatsHandler))
+	mux.HandleFunc(p+intentPath, s.timed("intent", s.IntentHandler))
+	mux.HandleFunc(p+auditPrefix[1:], s.timed("audit", s.AuditHandler))
+	mux.HandleFunc(p+qrPrefix[1:], s.timed("qr", s.QRHandler))
+	mux.HandleFunc(p, s.timed("lookup", s.LookupHandler))
+	if len(s.wellKnownMatrix) > 0 {
+		mux.HandleFunc(wellKnownMatrixPrefix, s.timed("well-known", s.serveWellKnownMatrix))
+	}
+	return s.checkHost(s.setHSTS(s.checkMaintenance(mux)))
+}
@@ -0,0 +1,76 @@
+package smallifier
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHandlerUnderBasePath(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+	if err := CreateTables(db); err != nil {
+		t.Fatal(err)
+	}
+
+	var h http.Handler
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		h.ServeHTTP(w, req)
+	}))
+	defer server.Close()
+	// The missing trailing slash should be added, rather than producing short links like https://host/sabc.
+	u, _ := url.Parse(server.URL + "/s")
+	s, err := New(context.Background(), *u, db, testSecret, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	h = s.Handler()
+
+	shortened := shorten(t, server.URL+"/s", "https://lemurs.win")
+	if !strings.HasPrefix(shortened, server.URL+"/s/") {
+		t.Fatalf("short url: want prefix %s/s/ got %s", server.URL, shortened)
+	}
+
+	client := insecureClient()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	for _, tc := range []struct {
+		path     string
+		status   int
+		location string
+	}{
+		{shortened[len(server.URL):], 302, "https://lemurs.win"},
+		{"/s", 301, "/s/"},
+		{"/_create", 404, ""},
+		{"/" + shortened[len(server.URL+"/s/"):], 404, ""},
+	} {
+		resp, err := client.Get(server.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("GET %s: want status code %d got %d", tc.path, tc.status, resp.StatusCode)
+		}
+		if got := resp.Header.Get("Location"); got != tc.location {
+			t.Errorf("GET %s: want location %q got %q", tc.path, tc.location, got)
+		}
+	}
+
+	req, err := http.NewRequest("GET", server.URL+"/s/_admin/overview", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testSecret)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Error("admin overview under base path: want status code 200 got", resp.StatusCode)
+	}
+}
@@ -0,0 +1,108 @@
+package smallifier
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync/atomic"
+)
+
+// otherNamespace is the namespace of links whose destinations aren't in any configured namespace.
+const otherNamespace = "other"
+
+// Namespaces maps the name of each namespace, e.g. a team, to the hosts of the destinations of its links.
+// As for DestinationHosts, each host matches its subdomains too.
+type Namespaces map[string][]string
+
+// ParseNamespaces reads Namespaces from a JSON object, e.g.
+//
+//	{"matrix": ["matrix.org", "matrix.to"], "element": ["element.io"]}
+func ParseNamespaces(r io.Reader) (Namespaces, error) {
+	var n Namespaces
+	if err := json.NewDecoder(r).Decode(&n); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// NamespaceCount counts the links created and followed in a namespace.
+type NamespaceCount struct {
+	Namespace string
+	Creates   float64
+	Follows   float64
+}
+
+// WithNamespaces counts the links created and followed in each of namespaces, for NamespaceCounts.
+// Links which point elsewhere are counted in the "other" namespace, as are bundles, though follows of their items are
+// counted in the items' namespaces.
+func WithNamespaces(namespaces Namespaces) Option {
+	return func(s *smallifier) {
+		s.namespaces = namespaces
+		s.namespaceNames = nil
+		s.namespaceCounts = map[string]*namespaceCounts{otherNamespace: {}}
+		for name := range namespaces {
+			s.namespaceNames = append(s.namespaceNames, name)
+			s.namespaceCounts[name] = &namespaceCounts{}
+		}
+		sort.Strings(s.namespaceNames)
+	}
+}
+
+type namespaceCounts struct {
+	creates uint64
+	follows uint64
+}
+
+// namespaceOf returns the namespace of the link to link, or "" if links aren't counted by namespace.
+// If more than one namespace includes link's host, the first in alphabetical order is used.
+func (s *smallifier) namespaceOf(link string) string {
+	if s.namespaceCounts == nil {
+		return ""
+	}
+	u, err := url.Parse(link)
+	if err != nil || u.Hostname() == "" {
+		return otherNamespace
+	}
+	for _, name := range s.namespaceNames {
+		if hostMatches(s.namespaces[name], u.Hostname()) {
+			return name
+		}
+	}
+	return otherNamespace
+}
+
+// countCreate counts the creation of a link to link, and counts it in its namespace.
+func (s *smallifier) countCreate(link string) {
+	atomic.AddUint64(&s.createCount, 1)
+	if ns := s.namespaceOf(link); ns != "" {
+		atomic.AddUint64(&s.namespaceCounts[ns].creates, 1)
+	}
+}
+
+// countFollow counts req following a link to link in its namespace, unless it only checks the link.
+func (s *smallifier) countFollow(req *http.Request, link string) {
+	if checksOnly(req) {
+		return
+	}
+	atomic.AddUint64(&s.followCount, 1)
+	if ns := s.namespaceOf(link); ns != "" {
+		atomic.AddUint64(&s.namespaceCounts[ns].follows, 1)
+	}
+}
+
+// NamespaceCounts gets the counts of links created and followed in each namespace given to WithNamespaces,
+// in alphabetical order, or nil if none were.
+func (s *smallifier) NamespaceCounts() []NamespaceCount {
+	var counts []NamespaceCount
+	for name, c := range s.namespaceCounts {
+		counts = append(counts, NamespaceCount{
+			Namespace: name,
+			Creates:   float64(atomic.LoadUint64(&c.creates)),
+			Follows:   float64(atomic.LoadUint64(&c.follows)),
+		})
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i].Namespace < counts[j].Namespace })
+	return counts
+}
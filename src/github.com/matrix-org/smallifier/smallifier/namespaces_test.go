@@ -0,0 +1,59 @@
+package smallifier
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNamespaceOf(t *testing.T) {
+	n, err := ParseNamespaces(strings.NewReader(`{"matrix": ["matrix.org", "matrix.to"], "element": ["element.io"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smallifier{}
+	WithNamespaces(n)(s)
+	for link, want := range map[string]string{
+		"https://matrix.org/blog":               "matrix",
+		"https://www.matrix.org/":               "matrix",
+		"https://matrix.to/#/#room:example.org": "matrix",
+		"https://app.element.io/":               "element",
+		"https://example.org/":                  "other",
+		"matrix:r/room:example.org":             "other",
+	} {
+		if got := s.namespaceOf(link); got != want {
+			t.Errorf("%s: want %q got %q", link, want, got)
+		}
+	}
+}
+
+func TestNamespaceCounts(t *testing.T) {
+	f := serve(t, WithNamespaces(Namespaces{"local": {"127.0.0.1"}}))
+	defer f.Close()
+
+	link := shorten(t, f.server.URL, f.server.URL+"/_stub")
+	shorten(t, f.server.URL, f.server.URL+"/_stub")
+	resp, err := insecureClient().Get(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	want := []NamespaceCount{
+		{Namespace: "local", Creates: 2, Follows: 1},
+		{Namespace: "other"},
+	}
+	if got := f.smallifier.NamespaceCounts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("want %+v got %+v", want, got)
+	}
+}
+
+func TestNoNamespaceCounts(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	shorten(t, f.server.URL, f.server.URL+"/_stub")
+	if got := f.smallifier.NamespaceCounts(); got != nil {
+		t.Errorf("want no counts got %+v", got)
+	}
+}
@@ -0,0 +1,165 @@
+package smallifier
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// nonceLifetime is how long a nonce issued to a browser remains valid.
+const nonceLifetime = 10 * time.Minute
+
+// NonceResponse is the JSON-encoded response to a request for a nonce.
+type NonceResponse struct {
+	// Nonce must be passed in the next create request made by the browser. It can only be used once.
+	Nonce     string `json:"nonce"`
+	ExpiresTS int64  `json:"expires_ts"`
+}
+
+// WithAllowedOrigins restricts browser-originated create requests, identified by their Origin header,
+// to those from the given origins, e.g. "https://example.org".
+// Requests without an Origin header, such as those from API clients, are unaffected.
+func WithAllowedOrigins(origins []string) Option {
+	return func(s *smallifier) {
+		s.allowedOrigins = make(map[string]bool, len(origins))
+		for _, o := range origins {
+			s.allowedOrigins[o] = true
+		}
+	}
+}
+
+// WithBrowserNonces requires browser-originated create requests to include a single-use nonce obtained from NonceHandler,
+// so that captured requests cannot be replayed.
+func WithBrowserNonces() Option {
+	return func(s *smallifier) {
+		s.requireNonces = true
+	}
+}
+
+// maxUsedNonces is how many used nonces are remembered, so that they can't be used again, until they expire.
+// Beyond it, browser create requests are refused rather than letting a flood of them use unbounded memory.
+const maxUsedNonces = 100000
+
+// nonces issues nonces signed with key, so that issuing them needs no state, and tracks those which have been used
+// but not yet expired, so that they can't be used again.
+type nonces struct {
+	key []byte
+	mu  sync.Mutex
+	// used maps the nonces used to when they expire. It is pruned of expired ones at most every nonceLifetime.
+	used     map[string]time.Time
+	prunedAt time.Time
+}
+
+// newNonces returns nonces signed with a key derived from secret, so that they needn't be stored when issued.
+func newNonces(secret string) nonces {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("smallifier nonces"))
+	return nonces{key: mac.Sum(nil)}
+}
+
+// sign returns the signature of a nonce made of random, which expires at the unix timestamp expires.
+func (n *nonces) sign(random string, expires int64) string {
+	mac := hmac.New(sha256.New, n.key)
+	fmt.Fprintf(mac, "%s.%d", random, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// issue returns a nonce made of random, which expires at expires.
+func (n *nonces) issue(random string, expires time.Time) string {
+	return fmt.Sprintf("%s.%d.%s", random, expires.Unix(), n.sign(random, expires.Unix()))
+}
+
+// use reports whether nonce was issued, has not expired by now and hasn't been used before, and prevents it from being
+// used again.
+func (n *nonces) use(nonce string, now time.Time) bool {
+	parts := strings.Split(nonce, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	expiresTS, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || !hmac.Equal([]byte(parts[2]), []byte(n.sign(parts[0], expiresTS))) {
+		return false
+	}
+	expires := time.Unix(expiresTS, 0)
+	if !now.Before(expires) {
+		return false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if now.Sub(n.prunedAt) >= nonceLifetime {
+		for k, e := range n.used {
+			if !now.Before(e) {
+				delete(n.used, k)
+			}
+		}
+		n.prunedAt = now
+	}
+	if _, ok := n.used[nonce]; ok {
+		return false
+	}
+	if len(n.used) >= maxUsedNonces {
+		log.WithField("used", len(n.used)).Warn("Too many nonces in use, refusing browser request")
+		return false
+	}
+	if n.used == nil {
+		n.used = make(map[string]time.Time)
+	}
+	n.used[nonce] = expires
+	return true
+}
+
+// NonceHandler is an http.HandlerFunc which issues a nonce for a browser to use in its next create request,
+// returned as a JSON-encoded NonceResponse. Nonces are signed rather than stored, so issuing them costs no memory.
+func (s *smallifier) NonceHandler(w http.ResponseWriter, req *http.Request) {
+	setHeaders(w)
+
+	if !s.checkOrigin(w, req) {
+		return
+	}
+
+	random, err := s.generateSecret()
+	if err != nil {
+		writeError(w, 500, ErrCodeUnknown, "random error")
+		return
+	}
+	expires := s.clock.Now().Add(nonceLifetime)
+	json.NewEncoder(w).Encode(NonceResponse{s.nonces.issue(random, expires), expires.Unix()})
+}
+
+// checkOrigin reports whether req comes from an allowed origin, writing an error response if it doesn't.
+func (s *smallifier) checkOrigin(w http.ResponseWriter, req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" || s.allowedOrigins == nil || s.allowedOrigins[origin] {
+		return true
+	}
+	log.WithField("origin", origin).Error("Refusing request from disallowed origin")
+	writeError(w, 403, ErrCodeForbidden, "Origin not allowed")
+	return false
+}
+
+// checkBrowserRequest reports whether a create request may proceed given its origin and nonce.
+// Requests without an Origin header are treated as API requests, and are not checked.
+func (s *smallifier) checkBrowserRequest(w http.ResponseWriter, req *http.Request, nonce string) bool {
+	if req.Header.Get("Origin") == "" {
+		return true
+	}
+	if !s.checkOrigin(w, req) {
+		return false
+	}
+	if s.requireNonces && !s.nonces.use(nonce, s.clock.Now()) {
+		log.WithField("origin", req.Header.Get("Origin")).Error("Refusing browser request with missing or reused nonce")
+		writeError(w, 403, ErrCodeForbidden, "Must specify a fresh nonce from /_nonce")
+		return false
+	}
+	return true
+}
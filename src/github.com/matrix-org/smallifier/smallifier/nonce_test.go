@@ -0,0 +1,101 @@
+package smallifier
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDisallowedOrigin(t *testing.T) {
+	f := serve(t, WithAllowedOrigins([]string{"https://lemurs.win"}))
+	defer f.Close()
+
+	if got := browserCreate(t, f, "https://evil.example", ""); got != 403 {
+		t.Error("disallowed origin: want status code 403 got", got)
+	}
+	if got := browserCreate(t, f, "https://lemurs.win", ""); got != 200 {
+		t.Error("allowed origin: want status code 200 got", got)
+	}
+}
+
+func TestBrowserNonces(t *testing.T) {
+	f := serve(t, WithBrowserNonces())
+	defer f.Close()
+
+	if got := browserCreate(t, f, "https://lemurs.win", ""); got != 403 {
+		t.Error("browser without nonce: want status code 403 got", got)
+	}
+
+	req, err := http.NewRequest("GET", f.server.URL+"/_nonce", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Origin", "https://lemurs.win")
+	resp, err := insecureClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var n NonceResponse
+	if err := json.NewDecoder(resp.Body).Decode(&n); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := browserCreate(t, f, "https://lemurs.win", n.Nonce); got != 200 {
+		t.Error("browser with fresh nonce: want status code 200 got", got)
+	}
+	if got := browserCreate(t, f, "https://lemurs.win", n.Nonce); got != 403 {
+		t.Error("browser replaying nonce: want status code 403 got", got)
+	}
+
+	// API clients don't send an Origin, and don't need a nonce.
+	shorten(t, f.server.URL, "https://lemurs.win")
+}
+
+func browserCreate(t *testing.T, f fixture, origin, nonce string) int {
+	req, err := http.NewRequest("POST", f.server.URL+"/_create", strings.NewReader(`{
+		"long_url": "https://lemurs.win",
+		"secret": "`+testSecret+`",
+		"nonce": "`+nonce+`"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Origin", origin)
+	resp, err := insecureClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestNonces(t *testing.T) {
+	n := newNonces(testSecret)
+	now := time.Unix(1000, 0)
+	nonce := n.issue("abc", now.Add(nonceLifetime))
+	for _, tc := range []struct {
+		nonce string
+		at    time.Time
+		want  bool
+	}{
+		{"abc.1600.forged", now, false},
+		{strings.Replace(nonce, ".1600.", ".9999.", 1), now, false},
+		{nonce, now.Add(nonceLifetime), false},
+		{nonce, now, true},
+		{nonce, now, false},
+	} {
+		if got := n.use(tc.nonce, tc.at); got != tc.want {
+			t.Errorf("%s at %d: want %v got %v", tc.nonce, tc.at.Unix(), tc.want, got)
+		}
+	}
+
+	// Used nonces are forgotten once they expire.
+	n.use(n.issue("def", now.Add(nonceLifetime)), now)
+	n.use(n.issue("ghi", now.Add(2*nonceLifetime)), now.Add(nonceLifetime))
+	if len(n.used) != 1 {
+		t.Errorf("want only the unexpired nonce remembered got %v", n.used)
+	}
+}
@@ -0,0 +1,76 @@
+package smallifier
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// defaultPorts maps URL schemes to the port which is implied when a URL of that scheme has none.
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// normalizeURL returns a canonical form of link, so that equivalent URLs can be recognised.
+// The scheme and host are lower-cased, default ports are removed and an empty path becomes "/".
+// Everything after the host is left byte-for-byte as it was, since servers may treat it case-sensitively
+// and clients such as matrix.to rely on the exact form of the fragment.
+func normalizeURL(link string) (string, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", err
+	}
+	scheme := strings.ToLower(u.Scheme)
+	rest := link[len(u.Scheme)+1:]
+	if !strings.HasPrefix(rest, "//") {
+		return scheme + ":" + rest, nil
+	}
+
+	rest = rest[2:]
+	end := strings.IndexAny(rest, "/?#")
+	if end < 0 {
+		end = len(rest)
+	}
+	authority, rest := rest[:end], rest[end:]
+	if !strings.HasPrefix(rest, "/") {
+		rest = "/" + rest
+	}
+
+	userinfo := ""
+	if i := strings.LastIndex(authority, "@"); i >= 0 {
+		userinfo, authority = authority[:i+1], authority[i+1:]
+	}
+	host := strings.ToLower(authority)
+	if h, port, err := net.SplitHostPort(host); err == nil && port == defaultPorts[scheme] {
+		host = h
+		if strings.Contains(h, ":") {
+			host = "[" + h + "]"
+		}
+	}
+	return scheme + "://" + userinfo + host + rest, nil
+}
+
+// checkFaithful returns an error if link cannot be stored and sent back in a Location header byte-for-byte.
+// Header values must be ASCII, and clients strip or fold whitespace and control characters,
+// so those must be percent-encoded by whoever shortens the link. Malformed percent-encoding is rejected,
+// as clients disagree about how to repair it.
+func checkFaithful(link string) error {
+	for i := 0; i < len(link); i++ {
+		if c := link[i]; c <= ' ' || c >= 0x7f {
+			return fmt.Errorf("Links must not contain whitespace, control or non-ASCII characters; percent-encode the byte at offset %d", i)
+		}
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return errors.New("Links must be valid URLs")
+	}
+	// url.Parse leaves the query as it is, so its percent-encoding is checked separately. url.ParseQuery would also
+	// refuse queries separated by semicolons, which are valid URLs, so the query is only unescaped as a whole.
+	if _, err := url.QueryUnescape(u.RawQuery); err != nil {
+		return errors.New("Links must be valid URLs; the query has malformed percent-encoding")
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package smallifier
+
+import "testing"
+
+func TestNormalizeURL(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"HTTPS://Lemurs.WIN", "https://lemurs.win/"},
+		{"https://lemurs.win:443/Ring?Tail=1#Stripes", "https://lemurs.win/Ring?Tail=1#Stripes"},
+		{"https://lemurs.win:8443/", "https://lemurs.win:8443/"},
+		{"https://[::1]:443/", "https://[::1]/"},
+		{"https://matrix.to/#/#room:lemurs.win", "https://matrix.to/#/#room:lemurs.win"},
+	} {
+		got, err := normalizeURL(tc.in)
+		if err != nil {
+			t.Errorf("%q: %v", tc.in, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%q: want %q got %q", tc.in, tc.want, got)
+		}
+	}
+}
+
+func TestCheckFaithful(t *testing.T) {
+	for _, tc := range []struct {
+		link string
+		ok   bool
+	}{
+		{"https://matrix.to/#/%23room:lemurs.win?via=lemurs.win", true},
+		{"https://lemurs.win/a%2Fb?q=%E2%9C%93&r=a+b#frag/ment?x", true},
+		{"https://lemurs.win/ring tail", false},
+		{"https://lemurs.win/\r\nSet-Cookie: x", false},
+		{"https://lemurs.win/✓", false},
+		{"https://lemurs.win/%zz", false},
+		{"https://lemurs.win/?q=%zz", false},
+		{"https://lemurs.win/?q=100%", false},
+		{"https://lemurs.win/?a=1;b=2", true},
+		{"https://lemurs.win/#%zz", false},
+	} {
+		if err := checkFaithful(tc.link); (err == nil) != tc.ok {
+			t.Errorf("%q: want ok %t got %v", tc.link, tc.ok, err)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package smallifier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// maxMilestones is the most follow counts a link's creator may ask to be notified at.
+const maxMilestones = 10
+
+// NotifyRequest asks for a link's creator to be notified the first time it is followed,
+// and when it has been followed a number of times. It is refused unless WithAnalytics writes follows to the database.
+type NotifyRequest struct {
+	// WebhookURL is an optional https URL to which a Milestone is POSTed, signed like click webhooks.
+	WebhookURL string `json:"webhook_url,omitempty"`
+	// MatrixUserID is an optional Matrix user, e.g. @alice:example.org, to send a direct message to.
+	// The server must have been configured with WithMatrixNotifier.
+	MatrixUserID string `json:"matrix_user_id,omitempty"`
+	// Milestones are numbers of follows, besides the first, to notify at, e.g. [100, 1000].
+	Milestones []int64 `json:"milestones,omitempty"`
+}
+
+// Milestone is the JSON-encoded body POSTed to a link's notification webhook when it reaches a number of follows.
+type Milestone struct {
+	ShortURL string `json:"short_url"`
+	// Follows is the milestone reached: 1 the first time the link is followed.
+	Follows int64 `json:"follows"`
+	// TS is the unix timestamp of the follow which reached the milestone.
+	TS int64 `json:"ts"`
+}
+
+// MatrixNotifier sends direct messages to the creators of links from a Matrix account.
+type MatrixNotifier struct {
+	// Homeserver is the base URL of the homeserver's client-server API, e.g. https://matrix.org.
+	Homeserver  string
+	AccessToken string
+	Client      *http.Client
+}
+
+// WithMatrixNotifier lets creators ask to be notified of milestones by direct message, sent by m.
+func WithMatrixNotifier(m *MatrixNotifier) Option {
+	return func(s *smallifier) {
+		s.matrixNotifier = m
+	}
+}
+
+// createDM creates a direct message room with userID, returning its ID.
+func (m *MatrixNotifier) createDM(ctx context.Context, userID string) (string, error) {
+	var resp struct {
+		RoomID string `json:"room_id"`
+	}
+	u := strings.TrimSuffix(m.Homeserver, "/") + "/_matrix/client/r0/createRoom"
+	err := matrixRequest(ctx, m.Client, m.AccessToken, "POST", u, map[string]interface{}{
+		"invite":    []string{userID},
+		"is_direct": true,
+		"preset":    "trusted_private_chat",
+	}, &resp)
+	if err == nil && resp.RoomID == "" {
+		err = errors.New("homeserver did not return a room ID")
+	}
+	return resp.RoomID, err
+}
+
+// checkNotifyRequest returns an error describing why n can't be honoured, or nil if it can.
+func (s *smallifier) checkNotifyRequest(n *NotifyRequest) error {
+	if s.analytics != AnalyticsDB {
+		return errors.New("This server doesn't record follows, so can't notify of them")
+	}
+	if n.WebhookURL == "" && n.MatrixUserID == "" {
+		return errors.New("Notifications need a webhook_url or matrix_user_id")
+	}
+	if n.WebhookURL != "" && !strings.HasPrefix(n.WebhookURL, "https://") {
+		return errors.New("Notification webhooks must start with https://")
+	}
+	if n.MatrixUserID != "" {
+		if s.matrixNotifier == nil {
+			return errors.New("This server can't send notifications over Matrix")
+		}
+		if !strings.HasPrefix(n.MatrixUserID, "@") || !strings.Contains(n.MatrixUserID, ":") {
+			return errors.New("matrix_user_id must be a Matrix user ID, e.g. @alice:example.org")
+		}
+	}
+	if len(n.Milestones) > maxMilestones {
+		return fmt.Errorf("At most %d milestones may be given", maxMilestones)
+	}
+	for _, m := range n.Milestones {
+		if m < 1 {
+			return errors.New("Milestones must be positive")
+		}
+	}
+	return nil
+}
+
+// addNotifications records that shortPath's creator should be notified as described by n,
+// returning the key with which requests to its webhook will be signed, if it has one.
+func (s *smallifier) addNotifications(ctx context.Context, shortPath string, n *NotifyRequest) (string, error) {
+	var secret string
+	if n.WebhookURL != "" {
+		var err error
+		if secret, err = s.generateSecret(); err != nil {
+			return "", err
+		}
+	}
+	milestones := append([]int64{1}, n.Milestones...)
+	sort.Slice(milestones, func(i, j int) bool { return milestones[i] < milestones[j] })
+	encoded := make([]string, len(milestones))
+	for i, m := range milestones {
+		encoded[i] = strconv.FormatInt(m, 10)
+	}
+	_, err := s.db.ExecContext(ctx, `INSERT INTO link_notifications (short_path, webhook_url, secret, matrix_user_id, milestones) VALUES ($1, $2, $3, $4, $5)`,
+		shortPath, n.WebhookURL, secret, n.MatrixUserID, strings.Join(encoded, ","))
+	return secret, err
+}
+
+// linkNotifications is how the creator of a link is to be notified.
+type linkNotifications struct {
+	shortPath    string
+	webhookURL   string
+	secret       string
+	matrixUserID string
+	matrixRoomID string
+}
+
+// checkMilestones counts count follows, the latest of which is f, of a link towards its milestones, and notifies its
+// creator if they brought it to one. Notifications are sent in the background.
+func (s *smallifier) checkMilestones(f follow, count int64) {
+	// Links without notifications have no row to update, so aren't looked up any further.
+	res, err := s.db.ExecContext(s.ctx, `UPDATE link_notifications SET follows = follows + $1 WHERE short_path = $2`, count, f.shortPath)
+	var updated int64
+	if err == nil {
+		updated, err = res.RowsAffected()
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":        err,
+			"short_path": f.shortPath,
+		}).Error("Error counting follows for notifications")
+		atomic.AddUint64(&s.dbUpdateErrorCount, 1)
+		return
+	}
+	if updated == 0 {
+		return
+	}
+	n := linkNotifications{shortPath: f.shortPath}
+	var milestones string
+	var notified, follows int64
+	err = s.db.QueryRowContext(s.ctx, `SELECT webhook_url, secret, matrix_user_id, matrix_room_id, milestones, notified, follows FROM link_notifications WHERE short_path = $1`, f.shortPath).
+		Scan(&n.webhookURL, &n.secret, &n.matrixUserID, &n.matrixRoomID, &milestones, &notified, &follows)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":        err,
+			"short_path": f.shortPath,
+		}).Error("Error looking up link notifications")
+		return
+	}
+	// Only the highest milestone reached is notified, should several be passed at once.
+	var reached int64
+	for _, m := range strings.Split(milestones, ",") {
+		if v, _ := strconv.ParseInt(m, 10, 64); v > notified && v <= follows {
+			reached = v
+		}
+	}
+	if reached == 0 {
+		return
+	}
+	if _, err := s.db.ExecContext(s.ctx, `UPDATE link_notifications SET notified = $1 WHERE short_path = $2`, reached, f.shortPath); err != nil {
+		log.WithField("err", err).Error("Error recording notification")
+		atomic.AddUint64(&s.dbUpdateErrorCount, 1)
+		return
+	}
+	s.notifications.Add(1)
+	go func() {
+		defer s.notifications.Done()
+		s.notify(n, Milestone{ShortURL: s.base.String() + f.shortPath, Follows: reached, TS: f.timestamp})
+	}()
+}
+
+// notify tells the creator of a link that it reached m.
+func (s *smallifier) notify(n linkNotifications, m Milestone) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if n.webhookURL != "" {
+		if err := s.postWebhook(ctx, n.webhookURL, n.secret, m); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+				"url": n.webhookURL,
+			}).Error("Error delivering notification webhook")
+			atomic.AddUint64(&s.webhookErrorCount, 1)
+		}
+	}
+	if n.matrixUserID != "" && s.matrixNotifier != nil {
+		if err := s.notifyMatrix(ctx, n, m); err != nil {
+			log.WithFields(log.Fields{
+				"err":     err,
+				"user_id": n.matrixUserID,
+			}).Error("Error sending notification over Matrix")
+			atomic.AddUint64(&s.webhookErrorCount, 1)
+		}
+	}
+}
+
+// notifyMatrix sends a direct message about m to the creator of a link, creating a room with them the first time.
+func (s *smallifier) notifyMatrix(ctx context.Context, n linkNotifications, m Milestone) error {
+	// Rooms are created and recorded one at a time, so that a creator isn't invited to several.
+	s.matrixNotifyMu.Lock()
+	defer s.matrixNotifyMu.Unlock()
+	roomID := n.matrixRoomID
+	if roomID == "" {
+		// Another milestone may already have created the room.
+		if err := s.db.QueryRowContext(ctx, `SELECT matrix_room_id FROM link_notifications WHERE short_path = $1`, n.shortPath).Scan(&roomID); err != nil {
+			return err
+		}
+	}
+	if roomID == "" {
+		var err error
+		if roomID, err = s.matrixNotifier.createDM(ctx, n.matrixUserID); err != nil {
+			return err
+		}
+		if _, err := s.db.ExecContext(ctx, `UPDATE link_notifications SET matrix_room_id = $1 WHERE short_path = $2`, roomID, n.shortPath); err != nil {
+			log.WithField("err", err).Error("Error recording notification room")
+			atomic.AddUint64(&s.dbUpdateErrorCount, 1)
+		}
+	}
+	text := fmt.Sprintf("%s has been followed %d times.", m.ShortURL, m.Follows)
+	if m.Follows == 1 {
+		text = fmt.Sprintf("%s has been followed for the first time.", m.ShortURL)
+	}
+	return sendMatrixMessage(ctx, s.matrixNotifier.Client, s.matrixNotifier.Homeserver, s.matrixNotifier.AccessToken, roomID, MatrixMessage{
+		MsgType:       "m.notice",
+		Body:          text,
+		Format:        "org.matrix.custom.html",
+		FormattedBody: html.EscapeString(text),
+	})
+}
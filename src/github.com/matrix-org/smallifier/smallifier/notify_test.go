@@ -0,0 +1,168 @@
+package smallifier
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestNotifyWebhook(t *testing.T) {
+	var mu sync.Mutex
+	var got []Milestone
+	var signatures []bool
+	var secret string
+	hook := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		var m Milestone
+		json.Unmarshal(b, &m)
+		mu.Lock()
+		got = append(got, m)
+		signatures = append(signatures, hmac.Equal([]byte(Sign(secret, b)), []byte(req.Header.Get(SignatureHeader))))
+		mu.Unlock()
+	}))
+	defer hook.Close()
+
+	f := serve(t, WithWebhookClient(insecureClient()))
+	resp, err := insecureClient().Post(f.server.URL+"/_create", "application/json", strings.NewReader(`{
+		"long_url": "`+f.server.URL+`/_stub",
+		"secret": "`+testSecret+`",
+		"notify": {"webhook_url": "`+hook.URL+`", "milestones": [3]}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created Response
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if created.NotifyWebhookSecret == "" {
+		t.Fatal("want notify webhook secret got none")
+	}
+	secret = created.NotifyWebhookSecret
+
+	for i := 0; i < 4; i++ {
+		resp, err := insecureClient().Get(created.ShortURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		waitForFollows(f)
+	}
+	// Closing waits for notifications to be sent, which may arrive in any order.
+	f.Close()
+	sort.Slice(got, func(i, j int) bool { return got[i].Follows < got[j].Follows })
+
+	if len(got) != 2 || got[0].Follows != 1 || got[1].Follows != 3 || got[0].ShortURL != created.ShortURL {
+		t.Errorf("milestones: want 1 and 3 of %s got %+v", created.ShortURL, got)
+	}
+	for i, ok := range signatures {
+		if !ok {
+			t.Errorf("milestone %d: bad signature", i)
+		}
+	}
+}
+
+func TestNotifyMatrix(t *testing.T) {
+	var mu sync.Mutex
+	var created, sent int
+	var body string
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.HasSuffix(req.URL.Path, "/createRoom") {
+			created++
+			w.Write([]byte(`{"room_id": "!dm:lemurs.win"}`))
+			return
+		}
+		if strings.Contains(req.URL.EscapedPath(), "/rooms/%21dm:lemurs.win/send/") {
+			sent++
+			var msg MatrixMessage
+			json.NewDecoder(req.Body).Decode(&msg)
+			body = msg.Body
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer hs.Close()
+
+	f := serve(t, WithMatrixNotifier(&MatrixNotifier{Homeserver: hs.URL, AccessToken: "token"}))
+	resp, err := insecureClient().Post(f.server.URL+"/_create", "application/json", strings.NewReader(`{
+		"long_url": "`+f.server.URL+`/_stub",
+		"secret": "`+testSecret+`",
+		"notify": {"matrix_user_id": "@lemur:lemurs.win", "milestones": [2]}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var link Response
+	if err := json.NewDecoder(resp.Body).Decode(&link); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	for i := 0; i < 2; i++ {
+		resp, err := insecureClient().Get(link.ShortURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		waitForFollows(f)
+	}
+	f.Close()
+
+	if created != 1 || sent != 2 {
+		t.Errorf("want 1 room created and 2 messages sent got %d and %d", created, sent)
+	}
+	if want := link.ShortURL + " has been followed 2 times."; body != want {
+		t.Errorf("message: want %q got %q", want, body)
+	}
+}
+
+func TestNotifyRejected(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	for _, notify := range []string{
+		`{}`,
+		`{"webhook_url": "http://lemurs.win/hook"}`,
+		`{"matrix_user_id": "@lemur:lemurs.win"}`,
+		`{"webhook_url": "https://lemurs.win/hook", "milestones": [0]}`,
+	} {
+		resp, err := insecureClient().Post(f.server.URL+"/_create", "application/json", strings.NewReader(`{
+			"long_url": "https://lemurs.win",
+			"secret": "`+testSecret+`",
+			"notify": `+notify+`
+		}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 400 {
+			t.Errorf("notify %s: want status code 400 got %d", notify, resp.StatusCode)
+		}
+	}
+}
+
+func TestNotifyRejectedWithoutDBAnalytics(t *testing.T) {
+	f := serve(t, WithAnalytics(AnalyticsMemory))
+	defer f.Close()
+
+	resp, err := insecureClient().Post(f.server.URL+"/_create", "application/json", strings.NewReader(`{
+		"long_url": "https://lemurs.win",
+		"secret": "`+testSecret+`",
+		"notify": {"webhook_url": "https://lemurs.win/hook"}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Errorf("want status code 400 got %d", resp.StatusCode)
+	}
+}
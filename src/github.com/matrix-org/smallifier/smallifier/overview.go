@@ -0,0 +1,81 @@
+package smallifier
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// overviewRecentLinks is how many of the most recently created links are included in an Overview.
+	overviewRecentLinks = 10
+	// overviewTopLinks is how many of the most followed links are included in an Overview.
+	overviewTopLinks = 10
+	// overviewPeriod is the period over which an Overview's top links are counted.
+	overviewPeriod = time.Hour
+)
+
+// Overview is the JSON-encoded response summarising recent activity, for operators watching a running smallifier.
+type Overview struct {
+	// TS is the unix timestamp at which the overview was made.
+	TS int64 `json:"ts"`
+	// LinksCreated and FollowsRecorded count every link and follow ever stored. Follows repeated within
+	// WithRepeatWindow, or unless WithAnalytics stores follows in the database, aren't recorded.
+	LinksCreated    int64 `json:"links_created"`
+	FollowsRecorded int64 `json:"follows_recorded"`
+	// Creates and Follows count the links created and followed since the smallifier started, whether or not the follows
+	// were recorded. They only increase while it runs, so clients can compute rates from the difference between
+	// successive overviews.
+	Creates     uint64            `json:"creates"`
+	Follows     uint64            `json:"follows"`
+	FollowQueue FollowQueueStatus `json:"follow_queue"`
+	// PinnedLinks are the links which have been pinned, newest first.
+	PinnedLinks []RecentLink `json:"pinned_links"`
+	// RecentLinks are the most recently created links, newest first.
+	RecentLinks []RecentLink `json:"recent_links"`
+	// TopLinks are the most followed links over the last hour, most followed first.
+	TopLinks []LinkFollows `json:"top_links"`
+}
+
+// RecentLink is a link included in an Overview because it was recently created.
+type RecentLink struct {
+	ShortURL string `json:"short_url"`
+	LongURL  string `json:"long_url"`
+	CreateTS int64  `json:"create_ts"`
+}
+
+func (s *smallifier) overview(ctx context.Context) (Overview, error) {
+	now := s.clock.Now()
+	o := Overview{
+		TS:      now.Unix(),
+		Creates: atomic.LoadUint64(&s.createCount),
+		Follows: atomic.LoadUint64(&s.followCount),
+	}
+
+	// Both tables are AUTOINCREMENT, so their largest id counts every row ever inserted, even those since deleted.
+	if err := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(id), 0) FROM links`).Scan(&o.LinksCreated); err != nil {
+		return o, err
+	}
+	if err := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(id), 0) FROM follows`).Scan(&o.FollowsRecorded); err != nil {
+		return o, err
+	}
+
+	var err error
+	if o.FollowQueue, err = s.followQueueStatus(ctx); err != nil {
+		return o, err
+	}
+
+	if o.PinnedLinks, err = s.pinnedLinks(ctx); err != nil {
+		return o, err
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT short_path, long_url, create_ts FROM links WHERE deleted = 0 ORDER BY id DESC LIMIT $1`, overviewRecentLinks)
+	if err != nil {
+		return o, err
+	}
+	if o.RecentLinks, err = s.scanRecentLinks(rows); err != nil {
+		return o, err
+	}
+
+	o.TopLinks, err = topLinks(ctx, s.db, s.base.String(), "", now.Add(-overviewPeriod), now.Add(time.Second), overviewTopLinks)
+	return o, err
+}
@@ -0,0 +1,36 @@
+package smallifier
+
+import (
+	"testing"
+)
+
+func TestOverview(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	first := shorten(t, f.server.URL, f.server.URL+"/_stub")
+	second := shorten(t, f.server.URL, f.server.URL+"/_stub?again")
+	for i := 0; i < 2; i++ {
+		resp, err := insecureClient().Get(second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	waitForFollows(f)
+
+	var o Overview
+	decodeAdminResponse(t, f, "GET", "overview", &o)
+	if o.LinksCreated != 2 || o.FollowsRecorded != 2 {
+		t.Errorf("totals: want 2 links and 2 follows got %d and %d", o.LinksCreated, o.FollowsRecorded)
+	}
+	if o.Creates != 2 || o.Follows != 2 {
+		t.Errorf("counters: want 2 creates and 2 follows got %d and %d", o.Creates, o.Follows)
+	}
+	if len(o.RecentLinks) != 2 || o.RecentLinks[0].ShortURL != second || o.RecentLinks[1].ShortURL != first {
+		t.Errorf("recent links: want %s then %s got %+v", second, first, o.RecentLinks)
+	}
+	if len(o.TopLinks) != 1 || o.TopLinks[0].ShortURL != second || o.TopLinks[0].Follows != 2 {
+		t.Errorf("top links: want %s followed twice got %+v", second, o.TopLinks)
+	}
+}
@@ -0,0 +1,93 @@
+package smallifier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// machinePathLength is the length of generated short paths, machinePathBytes base64-encoded, until they grow.
+const machinePathLength = 8
+
+// defaultVanityMinLength is the default shortest length of a vanity alias which doesn't contain a hyphen.
+const defaultVanityMinLength = 10
+
+// pathKind classifies short paths into disjoint namespaces.
+type pathKind int
+
+const (
+	// pathInvalid paths can never name a link.
+	pathInvalid pathKind = iota
+	// pathMachine paths are between machinePathLength characters and the length generated paths have grown to,
+	// and are generated by the server.
+	pathMachine
+	// pathVanity paths are chosen by the creator. They are at least the vanity minimum length, or contain a hyphen,
+	// and are never as long as generated paths, so they cannot collide with them.
+	pathVanity
+)
+
+// WithVanityMinLength sets the shortest length of vanity aliases without a hyphen.
+// It must be greater than the length of generated short paths.
+func WithVanityMinLength(n int) Option {
+	return func(s *smallifier) {
+		s.vanityMinLength = n
+	}
+}
+
+// classifyPath determines which namespace the short path p belongs to, without consulting the database.
+func (s *smallifier) classifyPath(p string) pathKind {
+	hyphen := false
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '_':
+		case c == '-':
+			hyphen = true
+		default:
+			return pathInvalid
+		}
+	}
+	switch {
+	case len(p) >= machinePathLength && len(p) <= s.paths.maxPathLength():
+		return pathMachine
+	case len(p) >= s.vanityMinLength || (hyphen && len(p) > 1):
+		return pathVanity
+	}
+	return pathInvalid
+}
+
+// reservedPathPrefix starts the paths of endpoints, such as /_create, so aliases may not start with it.
+const reservedPathPrefix = "_"
+
+// errPathTaken is returned when creating a link at a short path which is already in use, or has been.
+var errPathTaken = errors.New("short path is already in use")
+
+// checkVanityPath returns an error describing why p may not be used as a vanity alias, or nil if it may.
+func (s *smallifier) checkVanityPath(p string) error {
+	if s.classifyPath(p) != pathVanity {
+		return fmt.Errorf("Aliases must consist of letters, digits, '-' and '_', must not be %d characters long, and must be at least %d characters long or contain a hyphen", machinePathLength, s.vanityMinLength)
+	}
+	if strings.HasPrefix(p, reservedPathPrefix) {
+		return fmt.Errorf("Aliases must not start with '%s', which is reserved", reservedPathPrefix)
+	}
+	return nil
+}
+
+// addVanityLink stores a link to link at the alias shortPath, returning errPathTaken if the alias has ever been used.
+func (s *smallifier) addVanityLink(ctx context.Context, shortPath, link, ip, forwardedFor string) error {
+	_, err := s.db.ExecContext(ctx, "INSERT INTO links (short_path, long_url, normalized_url, create_ts, create_ip, create_forwarded_for) VALUES ($1, $2, $3, $4, $5, $6)", shortPath, link, normalizedURL(link), s.clock.Now().Unix(), ip, forwardedFor)
+	if err == nil {
+		return nil
+	}
+	if isUniqueViolation(err) {
+		return errPathTaken
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	log.WithField("error", err).Error("Error saving link")
+	return databaseError(err)
+}
@@ -0,0 +1,101 @@
+package smallifier
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestClassifyPath(t *testing.T) {
+	s := &smallifier{vanityMinLength: defaultVanityMinLength}
+	for _, tc := range []struct {
+		path string
+		want pathKind
+	}{
+		{"tj2TEXT7", pathMachine},
+		{"a-_Zz09-", pathMachine},
+		{"fosdem2024", pathVanity},
+		{"agm-24", pathVanity},
+		{"f-o", pathVanity},
+		{"fosdem", pathInvalid},
+		{"-", pathInvalid},
+		{"", pathInvalid},
+		{"lemurs.win", pathInvalid},
+		{"_create", pathInvalid},
+		{"ringtailed%20", pathInvalid},
+	} {
+		if got := s.classifyPath(tc.path); got != tc.want {
+			t.Errorf("%q: want %d got %d", tc.path, tc.want, got)
+		}
+	}
+}
+
+func TestLookupInvalidPath(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	resp, err := insecureClient().Get(f.server.URL + "/lemurs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 404 {
+		t.Error("invalid path: want status code 404 got", resp.StatusCode)
+	}
+}
+
+func TestVanityPath(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	create := func(shortPath string) *http.Response {
+		resp, err := insecureClient().Post(f.server.URL+"/_create", "application/json", strings.NewReader(`{
+			"long_url": "https://fosdem.org/2024/",
+			"short_path": "`+shortPath+`",
+			"secret": "`+testSecret+`"
+		}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := create("fosdem2024")
+	var created Response
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 || created.ShortURL != f.base+"fosdem2024" {
+		t.Fatalf("vanity alias: want 200 and %sfosdem2024 got %d and %q", f.base, resp.StatusCode, created.ShortURL)
+	}
+
+	client := insecureClient()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.Get(created.ShortURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("Location"); got != "https://fosdem.org/2024/" {
+		t.Errorf("following vanity alias: want redirect to https://fosdem.org/2024/ got %q", got)
+	}
+
+	for _, tc := range []struct {
+		shortPath string
+		status    int
+	}{
+		{"fosdem2024", 409},
+		{"fosdem", 400},
+		{"tj2TEXT7", 400},
+		{"fosdem/2024", 400},
+		{"_create-link", 400},
+	} {
+		resp := create(tc.shortPath)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("alias %q: want status code %d got %d", tc.shortPath, tc.status, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package smallifier
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"math"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// machinePathBytes is how many random bytes generated short paths are made of, until they grow.
+	machinePathBytes = 6
+	// maxMachinePathBytes is the most random bytes generated short paths grow to.
+	maxMachinePathBytes = 12
+	// collisionWindow is how many attempts to store a generated short path each collision rate is measured over.
+	collisionWindow = 1000
+	// collisionWarnRate is the collision rate, and fill ratio, above which warnings are logged.
+	collisionWarnRate = 0.01
+	// consecutiveCollisionLimit is how many times in a row attempts to store a link at a generated short path may
+	// collide before generated paths grow, whether or not WithPathGrowth was given, rather than the link not being made.
+	consecutiveCollisionLimit = 10
+)
+
+// WithPathGrowth makes generated short paths a byte longer whenever more than threshold of the attempts to store one
+// collide with an existing link, measured over each 1000 attempts, or, when the Smallifier is made, when more than
+// threshold of the possible paths of their length are already in use, e.g. 0.05. Links keep the paths they were made with.
+// Once generated paths have grown to a length, vanity aliases of that length may no longer be created.
+// Without it, generated paths only grow when attempts to store a link collide 10 times in a row, as the space of paths
+// of their length is nearly full. Either way, they keep their length when the Smallifier is made again.
+func WithPathGrowth(threshold float64) Option {
+	return func(s *smallifier) {
+		s.paths.growthThreshold = threshold
+	}
+}
+
+// pathSpace tracks how full the space of generated short paths is, growing them if WithPathGrowth was given.
+type pathSpace struct {
+	growthThreshold float64
+	// bytes is how many random bytes short paths are generated from, or 0 until checkPathSpace has been called.
+	bytes int32
+	// collisionCount counts attempts to store generated short paths which collided with existing links.
+	collisionCount uint64
+
+	// mu guards used, the number of links with paths of the current length, the attempts and collisions in the
+	// current window, and the collision rate over the last complete one.
+	mu            sync.Mutex
+	used          int64
+	attempts      int
+	collisions    int
+	collisionRate float64
+}
+
+// length returns how many random bytes short paths are generated from.
+func (p *pathSpace) length() int {
+	if n := atomic.LoadInt32(&p.bytes); n > 0 {
+		return int(n)
+	}
+	return machinePathBytes
+}
+
+// maxPathLength returns the length, in characters, of the longest paths which have been generated.
+func (p *pathSpace) maxPathLength() int {
+	return base64.RawURLEncoding.EncodedLen(p.length())
+}
+
+// fill returns the fraction of the possible short paths of the current length which are in use.
+func (p *pathSpace) fill() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return pathSpaceFill(p.used, p.length())
+}
+
+// pathSpaceFill returns the fraction of the possible short paths generated from n random bytes which used links occupy.
+func pathSpaceFill(used int64, n int) float64 {
+	return float64(used) / math.Pow(2, float64(8*n))
+}
+
+// checkPathSpace restores the length generated short paths had grown to, then measures how full the space of them
+// is, logging a warning if it is filling up, and growing them until it isn't if WithPathGrowth was given.
+// Links are counted by the length of their paths, so vanity aliases of generated lengths are counted too.
+func (s *smallifier) checkPathSpace(ctx context.Context) error {
+	p := &s.paths
+	n := machinePathBytes
+	if err := s.db.QueryRowContext(ctx, `SELECT bytes FROM path_space`).Scan(&n); err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	grown := false
+	for {
+		var used int64
+		if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM links WHERE length(short_path) = $1`,
+			base64.RawURLEncoding.EncodedLen(n)).Scan(&used); err != nil {
+			return err
+		}
+		fill := pathSpaceFill(used, n)
+		if p.growthThreshold > 0 && fill > p.growthThreshold && n < maxMachinePathBytes {
+			log.WithFields(log.Fields{
+				"bytes": n,
+				"fill":  fill,
+			}).Warn("Space of generated short paths is too full, growing them")
+			n++
+			grown = true
+			continue
+		}
+		if fill > collisionWarnRate {
+			log.WithFields(log.Fields{
+				"bytes": n,
+				"fill":  fill,
+			}).Warn("Space of generated short paths is filling up")
+		}
+		p.mu.Lock()
+		p.used = used
+		p.mu.Unlock()
+		atomic.StoreInt32(&p.bytes, int32(n))
+		if grown {
+			return s.savePathBytes(ctx, n)
+		}
+		return nil
+	}
+}
+
+// savePathBytes records that short paths are generated from n random bytes, so that they keep their length when the
+// Smallifier is made again, and paths which have been generated are never taken for vanity aliases.
+func (s *smallifier) savePathBytes(ctx context.Context, n int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM path_space`); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO path_space (bytes) VALUES ($1)`, n); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// growPaths makes generated short paths a byte longer than n, unless they already have been, explaining why with msg.
+func (s *smallifier) growPaths(n int, msg string, fields log.Fields) {
+	p := &s.paths
+	p.mu.Lock()
+	if n != p.length() || n >= maxMachinePathBytes {
+		p.mu.Unlock()
+		return
+	}
+	// Few links can have paths of the new length, as it was only open to vanity aliases.
+	p.used, p.attempts, p.collisions = 0, 0, 0
+	atomic.StoreInt32(&p.bytes, int32(n+1))
+	p.mu.Unlock()
+	log.WithFields(fields).Warn(msg)
+	if err := s.savePathBytes(s.ctx, n+1); err != nil {
+		log.WithField("err", err).Error("Error saving length of generated short paths")
+		atomic.AddUint64(&s.dbUpdateErrorCount, 1)
+	}
+}
+
+// pathGenerated records an attempt to store a link at a short path generated from n random bytes, and whether it
+// collided with an existing link. At the end of each window, it warns if collisions were frequent, and grows
+// generated paths if they were more frequent than WithPathGrowth allows.
+func (s *smallifier) pathGenerated(n int, collided bool) {
+	p := &s.paths
+	if collided {
+		atomic.AddUint64(&p.collisionCount, 1)
+	}
+	p.mu.Lock()
+	if n != p.length() {
+		// The path was generated before they grew.
+		p.mu.Unlock()
+		return
+	}
+	p.attempts++
+	if collided {
+		p.collisions++
+	} else {
+		p.used++
+	}
+	if p.attempts < collisionWindow {
+		p.mu.Unlock()
+		return
+	}
+	rate := float64(p.collisions) / float64(p.attempts)
+	p.attempts, p.collisions, p.collisionRate = 0, 0, rate
+	fields := log.Fields{
+		"bytes":          n,
+		"collision_rate": rate,
+		"fill":           pathSpaceFill(p.used, n),
+	}
+	p.mu.Unlock()
+	if p.growthThreshold > 0 && rate > p.growthThreshold && n < maxMachinePathBytes {
+		s.growPaths(n, "Generated short paths collide too often, growing them", fields)
+	} else if rate > collisionWarnRate {
+		log.WithFields(fields).Warn("Generated short paths are colliding often")
+	}
+}
+
+// PathCollisions gets a count of attempts to store generated short paths which collided with existing links.
+func (s *smallifier) PathCollisions() float64 {
+	return float64(atomic.LoadUint64(&s.paths.collisionCount))
+}
+
+// PathCollisionRate gets the fraction of the attempts to store generated short paths which collided with existing
+// links, over the last 1000 attempts at their current length to complete.
+func (s *smallifier) PathCollisionRate() float64 {
+	s.paths.mu.Lock()
+	defer s.paths.mu.Unlock()
+	return s.paths.collisionRate
+}
+
+// PathSpaceFill gets the fraction of the possible generated short paths of the current length which are in use.
+func (s *smallifier) PathSpaceFill() float64 {
+	return s.paths.fill()
+}
+
+// PathBytes gets how many random bytes short paths are generated from.
+func (s *smallifier) PathBytes() float64 {
+	return float64(s.paths.length())
+}
@@ -0,0 +1,135 @@
+package smallifier
+
+import (
+	"context"
+	"encoding/binary"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// zeros is a source of random bytes which are always 0, so that every short path generated collides with the first.
+type zeros struct{}
+
+func (zeros) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+// everyOther is a source of random bytes which are 0 on every other read, and distinct on the rest, so that about
+// half of the attempts to store generated short paths collide, but never two in a row.
+type everyOther struct {
+	reads uint32
+}
+
+func (r *everyOther) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	if r.reads++; r.reads%2 == 0 {
+		binary.BigEndian.PutUint32(b[len(b)-4:], r.reads)
+	}
+	return len(b), nil
+}
+
+func TestPathGrowth(t *testing.T) {
+	f := serve(t, WithRandom(&everyOther{}), WithPathGrowth(0.4), WithVanityMinLength(12))
+	defer f.Close()
+	s := f.smallifier.(*smallifier)
+	ctx := context.Background()
+
+	if err := s.checkVanityPath("abc-defghi"); err != nil {
+		t.Errorf("before growth: want 10 character alias allowed got %v", err)
+	}
+	shortPath, err := s.generateShortPath(ctx, "https://lemurs.win/0", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shortPath != "AAAAAAAA" {
+		t.Fatalf("first path: want AAAAAAAA got %s", shortPath)
+	}
+	for i := 0; len(shortPath) <= machinePathLength; i++ {
+		if i > collisionWindow {
+			t.Fatalf("want paths to grow after %d attempts got %v collisions", collisionWindow, s.PathCollisions())
+		}
+		if shortPath, err = s.generateShortPath(ctx, "https://lemurs.win/1", "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(shortPath) != 10 || s.PathBytes() != 7 {
+		t.Errorf("grown path: want 10 characters from 7 bytes got %s from %v", shortPath, s.PathBytes())
+	}
+	if rate := s.PathCollisionRate(); rate < 0.45 || rate > 0.55 {
+		t.Errorf("collision rate: want about half got %v", rate)
+	}
+	if err := s.checkVanityPath("abc-defghi"); err == nil {
+		t.Error("after growth: want 10 character alias refused got allowed")
+	}
+}
+
+func TestPathGrowthOnConsecutiveCollisions(t *testing.T) {
+	f := serve(t, WithRandom(zeros{}), WithVanityMinLength(12))
+	defer f.Close()
+	s := f.smallifier.(*smallifier)
+	ctx := context.Background()
+
+	if _, err := s.generateShortPath(ctx, "https://lemurs.win/0", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	shortPath, err := s.generateShortPath(ctx, "https://lemurs.win/1", "", "")
+	if err != nil {
+		t.Fatalf("want paths to grow rather than giving up got %v", err)
+	}
+	if shortPath != "AAAAAAAAAA" || s.PathBytes() != 7 {
+		t.Errorf("grown path: want AAAAAAAAAA from 7 bytes got %s from %v", shortPath, s.PathBytes())
+	}
+	if s.PathCollisions() != consecutiveCollisionLimit {
+		t.Errorf("collisions: want %d got %v", consecutiveCollisionLimit, s.PathCollisions())
+	}
+	if err := s.checkVanityPath("abc-defghi"); err == nil {
+		t.Error("after growth: want 10 character alias refused got allowed")
+	}
+
+	client := insecureClient()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	for _, p := range []string{"AAAAAAAA", shortPath} {
+		resp, err := client.Get(f.base + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 3 {
+			t.Errorf("following %s: want redirect got %d", p, resp.StatusCode)
+		}
+	}
+
+	// Paths keep their length when the Smallifier is made again.
+	u, _ := url.Parse(f.base)
+	made, err := New(ctx, *u, f.db, testSecret, 256, WithRandom(zeros{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	again := made.(*smallifier)
+	defer again.Shutdown(ctx)
+	if again.PathBytes() != 7 {
+		t.Errorf("made again: want 7 bytes got %v", again.PathBytes())
+	}
+}
+
+func TestPathSpaceFill(t *testing.T) {
+	if got := pathSpaceFill(1<<47, 6); got != 0.5 {
+		t.Errorf("half of 6 bytes: want 0.5 got %v", got)
+	}
+	if got := pathSpaceFill(64, 1); got != 0.25 {
+		t.Errorf("64 of 1 byte: want 0.25 got %v", got)
+	}
+
+	f := serve(t, WithPathGrowth(0.5))
+	defer f.Close()
+	s := f.smallifier.(*smallifier)
+	if s.PathBytes() != machinePathBytes || s.PathSpaceFill() != 0 {
+		t.Errorf("empty database: want %d bytes and no fill got %v and %v", machinePathBytes, s.PathBytes(), s.PathSpaceFill())
+	}
+}
@@ -0,0 +1,66 @@
+package smallifier
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+)
+
+// PinRequest is the JSON-encoded body of an admin request to pin or unpin a link.
+// Pinned links are never expired, and are listed before others.
+type PinRequest struct {
+	ShortURL string `json:"short_url"`
+	Pinned   bool   `json:"pinned"`
+}
+
+// setPinned pins or unpins the link at shortPath, recording any change in the audit log.
+// It returns sql.ErrNoRows if there is no such link.
+func (s *smallifier) setPinned(ctx context.Context, shortPath string, pinned bool) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var was bool
+	if err := tx.QueryRowContext(ctx, `SELECT pinned FROM links WHERE short_path = $1 AND deleted = 0`, shortPath).Scan(&was); err != nil {
+		return err
+	}
+	if was == pinned {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE links SET pinned = $1 WHERE short_path = $2`, pinned, shortPath); err != nil {
+		return err
+	}
+	action := "pin"
+	if !pinned {
+		action = "unpin"
+	}
+	if err := addAuditEntry(ctx, tx, s.clock.Now().Unix(), action, shortPath, strconv.FormatBool(was), strconv.FormatBool(pinned)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// pinnedLinks returns the pinned links, newest first.
+func (s *smallifier) pinnedLinks(ctx context.Context) ([]RecentLink, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT short_path, long_url, create_ts FROM links WHERE deleted = 0 AND pinned = 1 ORDER BY id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	return s.scanRecentLinks(rows)
+}
+
+// scanRecentLinks reads the short path, long URL and creation timestamp of links from rows, and closes it.
+func (s *smallifier) scanRecentLinks(rows *sql.Rows) ([]RecentLink, error) {
+	defer rows.Close()
+	var links []RecentLink
+	for rows.Next() {
+		var l RecentLink
+		if err := rows.Scan(&l.ShortURL, &l.LongURL, &l.CreateTS); err != nil {
+			return nil, err
+		}
+		l.ShortURL = s.base.String() + l.ShortURL
+		links = append(links, l)
+	}
+	return links, rows.Err()
+}
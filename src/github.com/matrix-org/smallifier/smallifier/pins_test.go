@@ -0,0 +1,89 @@
+package smallifier
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func pin(t *testing.T, f fixture, shortURL string, pinned bool) int {
+	body, _ := json.Marshal(PinRequest{ShortURL: shortURL, Pinned: pinned})
+	resp := adminBodyRequest(t, f, "PUT", "pin", testSecret, string(body))
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestPin(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	var created []string
+	for i := 0; i < 4; i++ {
+		created = append(created, shorten(t, f.server.URL, f.server.URL+"/_stub"))
+	}
+	old := time.Now().AddDate(0, 0, -40).Unix()
+	if _, err := f.db.Exec(`UPDATE links SET create_ts = $1`, old); err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range []string{created[1], created[0]} {
+		if status := pin(t, f, link, true); status != 200 {
+			t.Fatalf("pinning %s: want status code 200 got %d", link, status)
+		}
+	}
+	if status := pin(t, f, f.base+"missing", true); status != 404 {
+		t.Errorf("pinning missing link: want status code 404 got %d", status)
+	}
+
+	var listed []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("too many pages")
+		}
+		page, status := listLinks(t, f, url.Values{"limit": {"1"}, "cursor": {cursor}})
+		if status != 200 {
+			t.Fatal("listing links: want status code 200 got", status)
+		}
+		for _, l := range page.Links {
+			listed = append(listed, f.base+l.ShortPath)
+		}
+		if cursor = page.NextCursor; cursor == "" {
+			break
+		}
+	}
+	want := []string{created[1], created[0], created[3], created[2]}
+	if len(listed) != len(want) {
+		t.Fatalf("listed links: want %v got %v", want, listed)
+	}
+	for i := range want {
+		if listed[i] != want[i] {
+			t.Fatalf("listed links: want %v got %v", want, listed)
+		}
+	}
+
+	if status := pin(t, f, created[1], false); status != 200 {
+		t.Fatalf("unpinning %s: want status code 200 got %d", created[1], status)
+	}
+	body, _ := json.Marshal(ExpireRequest{Days: 30})
+	resp := adminBodyRequest(t, f, "POST", "expire", testSecret, string(body))
+	var report ExpiryReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(report.Expired) != 3 {
+		t.Errorf("want 3 links expired got %+v", report.Expired)
+	}
+	for _, l := range report.Expired {
+		if l.ShortURL == created[0] {
+			t.Errorf("pinned link %s was expired", created[0])
+		}
+	}
+
+	var entries []AuditEntry
+	decodeAdminResponse(t, f, "GET", "audit?short_url="+created[1], &entries)
+	if len(entries) != 3 || entries[0].Action != "expire" || entries[1].Action != "unpin" || entries[2].Action != "pin" {
+		t.Errorf("audit log for %s: want pin, unpin and expire got %+v", created[1], entries)
+	}
+}
@@ -0,0 +1,42 @@
+package smallifier
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// WithPreconnectHints adds a "Link: rel=preconnect" header pointing at the destination's origin to redirects and
+// matrix.to preview pages, so that browsers can start connecting to it sooner.
+// If earlyHints is set, the header is also sent in a 103 Early Hints response ahead of the redirect or page,
+// which browsers act on before the rest of the response arrives. net/http only sends 1xx responses from Go 1.19;
+// before it, the hint would be sent as the final response.
+func WithPreconnectHints(earlyHints bool) Option {
+	return func(s *smallifier) {
+		s.preconnectHints = true
+		s.earlyHints = earlyHints
+	}
+}
+
+// hintPreconnect adds a preconnect hint for link's origin to w, if hints are enabled and link is a web URL.
+func (s *smallifier) hintPreconnect(w http.ResponseWriter, link string) {
+	if !s.preconnectHints {
+		return
+	}
+	origin := webOrigin(link)
+	if origin == "" {
+		return
+	}
+	w.Header().Add("Link", "<"+origin+">; rel=preconnect")
+	if s.earlyHints {
+		w.WriteHeader(http.StatusEarlyHints)
+	}
+}
+
+// webOrigin returns the origin, e.g. https://example.org, of the http or https URL link, or "" if it isn't one.
+func webOrigin(link string) string {
+	u, err := url.Parse(link)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
@@ -0,0 +1,78 @@
+package smallifier
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"testing"
+)
+
+func TestPreconnectHints(t *testing.T) {
+	f := serve(t, WithPreconnectHints(true))
+	defer f.Close()
+
+	link := shorten(t, f.server.URL, f.server.URL+"/_stub")
+	want := "<" + f.server.URL + ">; rel=preconnect"
+
+	var hints []string
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code == http.StatusEarlyHints {
+				hints = append(hints, header.Get("Link"))
+			}
+			return nil
+		},
+	}
+	req, err := http.NewRequest("GET", link, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(httptrace.WithClientTrace(context.Background(), trace))
+	client := insecureClient()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 302 {
+		t.Errorf("want status code 302 got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Link"); got != want {
+		t.Errorf("want Link %q got %q", want, got)
+	}
+	if len(hints) != 1 || hints[0] != want {
+		t.Errorf("want one early hint of %q got %q", want, hints)
+	}
+}
+
+func TestNoPreconnectHintsByDefault(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	link := shorten(t, f.server.URL, f.server.URL+"/_stub")
+	client := insecureClient()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.Get(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("Link"); got != "" {
+		t.Errorf("want no Link header got %q", got)
+	}
+}
+
+func TestWebOrigin(t *testing.T) {
+	for link, want := range map[string]string{
+		"https://example.org/path?q=1#frag": "https://example.org",
+		"http://example.org:8080/":          "http://example.org:8080",
+		"mailto:someone@example.org":        "",
+		"matrix:r/room:example.org":         "",
+	} {
+		if got := webOrigin(link); got != want {
+			t.Errorf("%s: want %q got %q", link, want, got)
+		}
+	}
+}
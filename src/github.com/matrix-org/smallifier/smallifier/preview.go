@@ -0,0 +1,42 @@
+package smallifier
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// previewSuffix, appended to a short link, shows its preview page rather than redirecting.
+const previewSuffix = "+"
+
+// WithAlwaysPreview shows the preview page of every link rather than redirecting, for deployments which must
+// disclose destinations before they are visited. Viewing the page counts as following the link.
+// Without it, the preview page is only shown for /<short path>+ or ?preview=1, and viewing it isn't a follow.
+func WithAlwaysPreview() Option {
+	return func(s *smallifier) {
+		s.alwaysPreview = true
+	}
+}
+
+// previewRequested returns whether req asks for the preview page of a link rather than to be redirected.
+func previewRequested(req *http.Request) bool {
+	return strings.HasSuffix(req.URL.Path, previewSuffix) || req.URL.Query().Get("preview") == "1"
+}
+
+// previewPage is what the "preview" page of a Theme is rendered with.
+type previewPage struct {
+	ShortURL string
+	// Host is the host of the destination, shown prominently, as it is what decides whether to trust it.
+	Host string
+	URL  template.URL
+}
+
+// renderPreview writes the preview page for the link at shortPath, whose long URL is link.
+func (s *smallifier) renderPreview(w http.ResponseWriter, shortPath, link string) error {
+	var host string
+	if u, err := url.Parse(link); err == nil {
+		host = u.Hostname()
+	}
+	return s.render(w, 200, "preview", previewPage{s.base.String() + shortPath, host, template.URL(link)})
+}
@@ -0,0 +1,50 @@
+package smallifier
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestPreview(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	const link = "https://lemurs.win/ring-tailed?a=1&b=2"
+	shortened := shorten(t, f.server.URL, link)
+	shortPath := shortened[len(f.base):]
+	for _, u := range []string{shortened + "+", shortened + "?preview=1"} {
+		resp, err := insecureClient().Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Errorf("%s: want status 200 got %d", u, resp.StatusCode)
+		}
+		for _, want := range []string{"This link goes to lemurs.win", `href="https://lemurs.win/ring-tailed?a=1&amp;b=2"`} {
+			if !strings.Contains(string(b), want) {
+				t.Errorf("%s: want %q in page got %s", u, want, b)
+			}
+		}
+	}
+	assertFollowCount(f, shortPath, 0, "after previewing:")
+}
+
+func TestAlwaysPreview(t *testing.T) {
+	f := serve(t, WithAlwaysPreview())
+	defer f.Close()
+
+	shortened := shorten(t, f.server.URL, "https://lemurs.win/")
+	resp, err := insecureClient().Get(shortened)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || !strings.Contains(string(b), "Continue to lemurs.win") {
+		t.Errorf("want preview page got %d %s", resp.StatusCode, b)
+	}
+	assertFollowCount(f, shortened[len(f.base):], 1, "after viewing preview:")
+}
@@ -0,0 +1,99 @@
+package smallifier
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const (
+	// qrPrefix is the path prefix under which QR codes of short links are served.
+	qrPrefix = "/_qr/"
+	// minQRImageSize and maxQRImageSize bound the sizes of PNG QR codes which may be requested.
+	minQRImageSize = 64
+	maxQRImageSize = 4096
+)
+
+// QRHandler is an http.HandlerFunc which returns a QR code encoding the short URL of the link at /_qr/<short path>,
+// as a PNG, or as an SVG if the query string has format=svg. PNGs are 512 pixels square unless size is given.
+// Links which don't exist are 404ed and deleted ones 410ed, so that stale posters aren't printed.
+func (s *smallifier) QRHandler(w http.ResponseWriter, req *http.Request) {
+	setHeaders(w)
+
+	ctx, cancel, ok := s.requestContext(w, req)
+	if !ok {
+		return
+	}
+	defer cancel()
+
+	i := strings.Index(req.URL.Path, qrPrefix)
+	if i < 0 || (req.Method != "GET" && req.Method != "HEAD") {
+		writeError(w, 404, ErrCodeNotFound, "link not found")
+		return
+	}
+	shortPath := req.URL.Path[i+len(qrPrefix):]
+	format := req.URL.Query().Get("format")
+	if format != "" && format != "png" && format != "svg" {
+		writeError(w, 400, ErrCodeInvalidParam, "format must be png or svg")
+		return
+	}
+	size := qrImageSize
+	if v := req.URL.Query().Get("size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < minQRImageSize || n > maxQRImageSize {
+			writeError(w, 400, ErrCodeInvalidParam, fmt.Sprintf("size must be between %d and %d", minQRImageSize, maxQRImageSize))
+			return
+		}
+		size = n
+	}
+
+	var deleted bool
+	if err := s.db.QueryRowContext(ctx, `SELECT deleted FROM links WHERE short_path = $1`, shortPath).Scan(&deleted); err != nil {
+		writeLookupError(w, err)
+		return
+	}
+	if deleted {
+		writeGone(w)
+		return
+	}
+
+	q, err := qrcode.New(s.base.String()+shortPath, qrcode.Medium)
+	if err != nil {
+		writeError(w, 500, ErrCodeUnknown, "internal server error")
+		return
+	}
+	var b []byte
+	if format == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		b = qrSVG(q.Bitmap())
+	} else {
+		w.Header().Set("Content-Type", "image/png")
+		if b, err = q.PNG(size); err != nil {
+			writeError(w, 500, ErrCodeUnknown, "internal server error")
+			return
+		}
+	}
+	// Short links can be repointed, but the URL they encode never changes.
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(b)
+}
+
+// qrSVG draws the modules of a QR code, including its quiet zone, as an SVG scaled to whatever size it is printed at.
+func qrSVG(bitmap [][]bool) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, len(bitmap), len(bitmap))
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, len(bitmap), len(bitmap))
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&buf, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+	return buf.Bytes()
+}
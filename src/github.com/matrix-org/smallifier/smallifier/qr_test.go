@@ -0,0 +1,74 @@
+package smallifier
+
+import (
+	"bytes"
+	"image/png"
+	"io/ioutil"
+	"testing"
+)
+
+func TestQRCode(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	shortened := shorten(t, f.server.URL, "https://lemurs.win/poster")
+	shortPath := shortened[len(f.base):]
+
+	for _, tc := range []struct {
+		query       string
+		contentType string
+		check       func([]byte) bool
+	}{
+		{"", "image/png", func(b []byte) bool {
+			img, err := png.Decode(bytes.NewReader(b))
+			return err == nil && img.Bounds().Dx() == qrImageSize
+		}},
+		{"?size=128", "image/png", func(b []byte) bool {
+			img, err := png.Decode(bytes.NewReader(b))
+			return err == nil && img.Bounds().Dx() == 128
+		}},
+		{"?format=svg", "image/svg+xml", func(b []byte) bool {
+			return bytes.HasPrefix(b, []byte("<svg ")) && bytes.Contains(b, []byte("h1v1h-1z"))
+		}},
+	} {
+		resp, err := insecureClient().Get(f.server.URL + "/_qr/" + shortPath + tc.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != tc.contentType || !tc.check(b) {
+			t.Errorf("%q: want 200 %s got %d %s", tc.query, tc.contentType, resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+	}
+
+	for _, tc := range []struct {
+		path   string
+		status int
+	}{
+		{shortPath + "?size=1", 400},
+		{shortPath + "?format=gif", 400},
+		{"nonexist", 404},
+	} {
+		resp, err := insecureClient().Get(f.server.URL + "/_qr/" + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: want status %d got %d", tc.path, tc.status, resp.StatusCode)
+		}
+	}
+
+	if status := changeLink(t, f, "DELETE", shortPath, testSecret, ""); status != 200 {
+		t.Fatalf("delete: want 200 got %d", status)
+	}
+	resp, err := insecureClient().Get(f.server.URL + "/_qr/" + shortPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 410 {
+		t.Errorf("deleted: want status 410 got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,63 @@
+package smallifier
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/csv"
+	"io"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// qrImageSize is the width and height, in pixels, of generated QR code images.
+const qrImageSize = 512
+
+// writeQRExport writes a ZIP archive to w containing a PNG QR code for each live link tagged with tag,
+// named after the link's short path, and a manifest.csv listing each image's short and long URLs.
+func (s *smallifier) writeQRExport(ctx context.Context, w io.Writer, tag string) error {
+	rows, err := s.db.QueryContext(ctx, `SELECT links.short_path, links.long_url FROM links
+		JOIN link_tags ON links.short_path = link_tags.short_path
+		WHERE link_tags.tag = $1 AND links.deleted = 0 ORDER BY links.id`, tag)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	z := zip.NewWriter(w)
+	var manifest [][]string
+	for rows.Next() {
+		var shortPath, longURL string
+		if err := rows.Scan(&shortPath, &longURL); err != nil {
+			return err
+		}
+		shortURL := s.base.String() + shortPath
+		png, err := qrcode.Encode(shortURL, qrcode.Medium, qrImageSize)
+		if err != nil {
+			return err
+		}
+		name := shortPath + ".png"
+		f, err := z.Create(name)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(png); err != nil {
+			return err
+		}
+		manifest = append(manifest, []string{name, shortURL, longURL})
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	f, err := z.Create("manifest.csv")
+	if err != nil {
+		return err
+	}
+	c := csv.NewWriter(f)
+	c.Write([]string{"file", "short_url", "long_url"})
+	c.WriteAll(manifest)
+	if err := c.Error(); err != nil {
+		return err
+	}
+	return z.Close()
+}
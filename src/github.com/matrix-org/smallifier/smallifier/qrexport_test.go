@@ -0,0 +1,71 @@
+package smallifier
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestQRExport(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	tagged := shortenTagged(t, f, "https://lemurs.win/one", "fosdem")
+	shortenTagged(t, f, "https://lemurs.win/two", "other")
+
+	resp := adminRequest(t, f, "GET", "qr?tag=fosdem", testSecret)
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("want status code 200 got %d", resp.StatusCode)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string][]byte{}
+	for _, zf := range z.File {
+		r, err := zf.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[zf.Name], _ = ioutil.ReadAll(r)
+		r.Close()
+	}
+	image := tagged[len(f.base):] + ".png"
+	if len(files) != 2 || !bytes.HasPrefix(files[image], []byte("\x89PNG")) {
+		t.Errorf("want manifest and PNG %s got files %v", image, len(files))
+	}
+	records, err := csv.NewReader(bytes.NewReader(files["manifest.csv"])).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[1][0] != image || records[1][1] != tagged || records[1][2] != "https://lemurs.win/one" {
+		t.Errorf("manifest: want header and one row for %s got %v", tagged, records)
+	}
+}
+
+func shortenTagged(t *testing.T, f fixture, toShorten, tag string) string {
+	resp, err := insecureClient().Post(f.server.URL+"/_create", "application/json", strings.NewReader(`{
+		"long_url": "`+toShorten+`",
+		"secret": "`+testSecret+`",
+		"tags": ["`+tag+`"]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var r Response
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	return r.ShortURL
+}
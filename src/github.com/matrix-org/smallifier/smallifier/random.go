@@ -0,0 +1,159 @@
+package smallifier
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// randomAttempts is how many times reading random bytes is tried, backing off exponentially from randomBackoff,
+	// before falling back to fallback entropy.
+	randomAttempts = 3
+	randomBackoff  = 10 * time.Millisecond
+	// randomBreakerThreshold is how many reads in a row may fail before the source of random bytes stops being tried
+	// for randomBreakerCooldown, so that requests don't all wait on its retries while it is broken.
+	randomBreakerThreshold = 5
+	randomBreakerCooldown  = 30 * time.Second
+)
+
+// WithRandom sets the source of the random bytes short paths are generated from, which is crypto/rand.Reader by default.
+// It lets tests generate predictable short paths, e.g. to make them collide. Secrets and tokens are always generated by
+// crypto/rand.
+func WithRandom(r io.Reader) Option {
+	return func(s *smallifier) {
+		s.random = r
+	}
+}
+
+// randomState is the state of the retries and circuit breaker around the source of random bytes.
+type randomState struct {
+	// fallback is the entropy read once the source fails, or nil if it couldn't be seeded.
+	fallback *fallbackEntropy
+	// mu guards failures, the reads in a row which failed, and openUntil, when the source will be tried again.
+	mu            sync.Mutex
+	failures      int
+	openUntil     time.Time
+	fallbackCount uint64
+}
+
+// fallbackEntropy generates random bytes as HMAC-SHA256 of a counter, keyed with a seed read from crypto/rand while
+// it worked, so that they are as unpredictable as the seed.
+type fallbackEntropy struct {
+	mu      sync.Mutex
+	key     []byte
+	counter uint64
+}
+
+// newFallbackEntropy returns fallback entropy seeded from crypto/rand, or nil if it can't be.
+func newFallbackEntropy() *fallbackEntropy {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		log.WithField("err", err).Error("Could not seed fallback entropy")
+		return nil
+	}
+	return &fallbackEntropy{key: key}
+}
+
+func (f *fallbackEntropy) Read(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var counter [8]byte
+	for i := 0; i < len(b); {
+		f.counter++
+		binary.BigEndian.PutUint64(counter[:], f.counter)
+		mac := hmac.New(sha256.New, f.key)
+		mac.Write(counter[:])
+		i += copy(b[i:], mac.Sum(nil))
+	}
+	return len(b), nil
+}
+
+// readRandom fills buf from s.random, retrying with exponential backoff if it fails. If it keeps failing, buf is
+// filled with fallback entropy instead, and if randomBreakerThreshold reads in a row fail, s.random isn't tried again
+// for randomBreakerCooldown. An error is only returned if there is no fallback entropy, or ctx is done.
+func (s *smallifier) readRandom(ctx context.Context, buf []byte) error {
+	var err error
+	if s.randomBreakerClosed() {
+		for attempt := 0; attempt < randomAttempts; attempt++ {
+			if attempt > 0 {
+				select {
+				case <-time.After(randomBackoff << uint(attempt-1)):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			if _, err = io.ReadFull(s.random, buf); err == nil {
+				s.randomRead(nil)
+				return nil
+			}
+			atomic.AddUint64(&s.randomErrorCount, 1)
+		}
+		log.WithField("err", err).Error("Could not generate random numbers")
+		s.randomRead(err)
+	}
+	if s.randomness.fallback == nil {
+		if err == nil {
+			err = errRandomBroken
+		}
+		return err
+	}
+	atomic.AddUint64(&s.randomness.fallbackCount, 1)
+	_, err = s.randomness.fallback.Read(buf)
+	return err
+}
+
+// errRandomBroken is returned by readRandom when s.random isn't being tried, and there is no fallback entropy.
+var errRandomBroken = errors.New("source of randomness is failing")
+
+// randomBreakerClosed reports whether s.random should be tried: it hasn't failed too often, or it has, but for long
+// enough ago to try it again.
+func (s *smallifier) randomBreakerClosed() bool {
+	r := &s.randomness
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !s.clock.Now().Before(r.openUntil)
+}
+
+// randomRead records whether reading from s.random failed with err, opening the circuit breaker if it has failed
+// randomBreakerThreshold times in a row.
+func (s *smallifier) randomRead(err error) {
+	r := &s.randomness
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil {
+		r.failures = 0
+		return
+	}
+	r.failures++
+	if r.failures >= randomBreakerThreshold {
+		r.openUntil = s.clock.Now().Add(randomBreakerCooldown)
+		log.WithFields(log.Fields{
+			"err":      err,
+			"failures": r.failures,
+			"cooldown": randomBreakerCooldown,
+		}).Warn("Source of randomness keeps failing, not trying it for a while")
+	}
+}
+
+// RandomFallbacks gets a count of the times fallback entropy was used because the source of randomness failed.
+func (s *smallifier) RandomFallbacks() float64 {
+	return float64(atomic.LoadUint64(&s.randomness.fallbackCount))
+}
+
+// RandomBreakerOpen gets 1 while the source of randomness isn't being tried because it kept failing, or otherwise 0.
+func (s *smallifier) RandomBreakerOpen() float64 {
+	if s.randomBreakerClosed() {
+		return 0
+	}
+	return 1
+}
@@ -0,0 +1,88 @@
+package smallifier
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRandomShortPaths(t *testing.T) {
+	first := []byte("aaaaaa")
+	second := []byte("bbbbbb")
+	// The second link's first candidate collides with the first link, so it is retried with the next bytes.
+	f := serve(t, WithRandom(bytes.NewReader(bytes.Join([][]byte{first, first, second}, nil))))
+	defer f.Close()
+
+	for i, want := range [][]byte{first, second} {
+		got := shorten(t, f.server.URL, f.server.URL+"/_stub")
+		if want := f.base + base64.RawURLEncoding.EncodeToString(want); got != want {
+			t.Errorf("link %d: want %s got %s", i, want, got)
+		}
+	}
+}
+
+// brokenRandom is a source of random bytes which always fails, counting how often it is read.
+type brokenRandom struct {
+	reads int32
+}
+
+func (r *brokenRandom) Read([]byte) (int, error) {
+	atomic.AddInt32(&r.reads, 1)
+	return 0, errors.New("no entropy")
+}
+
+func TestRandomFallback(t *testing.T) {
+	clock := newFakeClock()
+	r := &brokenRandom{}
+	f := serve(t, WithRandom(r), WithClock(clock))
+	defer f.Close()
+	s := f.smallifier.(*smallifier)
+
+	seen := map[string]bool{}
+	for i := 0; i < randomBreakerThreshold+1; i++ {
+		link := shorten(t, f.server.URL, f.server.URL+"/_stub")
+		if link == "" || seen[link] {
+			t.Fatalf("link %d: want a new link from fallback entropy got %q", i, link)
+		}
+		seen[link] = true
+	}
+	if got := atomic.LoadInt32(&r.reads); got != randomBreakerThreshold*randomAttempts {
+		t.Errorf("want the source tried %d times before the breaker opened got %d", randomBreakerThreshold*randomAttempts, got)
+	}
+	if s.RandomFallbacks() != randomBreakerThreshold+1 || s.RandomBreakerOpen() != 1 {
+		t.Errorf("want %d fallbacks with the breaker open got %v and %v", randomBreakerThreshold+1, s.RandomFallbacks(), s.RandomBreakerOpen())
+	}
+
+	clock.advance(randomBreakerCooldown)
+	if s.RandomBreakerOpen() != 0 {
+		t.Error("after cooldown: want the breaker closed")
+	}
+	shorten(t, f.server.URL, f.server.URL+"/_stub")
+	if got := atomic.LoadInt32(&r.reads); got != (randomBreakerThreshold+1)*randomAttempts {
+		t.Errorf("after cooldown: want the source tried again got %d reads", got)
+	}
+}
+
+func TestRandomUnavailable(t *testing.T) {
+	f := serve(t, WithRandom(&brokenRandom{}))
+	defer f.Close()
+	f.smallifier.(*smallifier).randomness.fallback = nil
+
+	resp, err := insecureClient().Post(f.server.URL+"/_create", "application/json",
+		strings.NewReader(`{"long_url": "`+f.server.URL+`/_stub", "secret": "`+testSecret+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var e ErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 503 || e.ErrCode != ErrCodeUnavailable || !e.Retryable {
+		t.Errorf("want retryable 503 %s got %d %+v", ErrCodeUnavailable, resp.StatusCode, e)
+	}
+}
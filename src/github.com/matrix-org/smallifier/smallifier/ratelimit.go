@@ -0,0 +1,210 @@
+package smallifier
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// WithCreateRateLimit limits each client to creating perMinute links a minute, in bursts of up to burst.
+// Clients are identified by address, aggregated as for analytics, taking X-Forwarded-For into account
+// for requests from proxies given to WithTrustedProxies.
+func WithCreateRateLimit(perMinute float64, burst int) Option {
+	return func(s *smallifier) {
+		s.createLimiter = &rateLimiter{
+			rate:    perMinute / 60,
+			burst:   float64(burst),
+			buckets: make(map[string]*tokenBucket),
+		}
+	}
+}
+
+// WithLookupRateLimit limits each client to following perMinute links which don't exist a minute, in bursts of up to burst,
+// so that the space of short paths can't be enumerated. Clients which exceed it can't follow any links until they may again.
+// Clients are identified as for WithCreateRateLimit.
+func WithLookupRateLimit(perMinute float64, burst int) Option {
+	return func(s *smallifier) {
+		s.lookupLimiter = &rateLimiter{
+			rate:    perMinute / 60,
+			burst:   float64(burst),
+			buckets: make(map[string]*tokenBucket),
+		}
+	}
+}
+
+// WithTrustedProxies sets the networks of the reverse proxies in front of the server,
+// whose X-Forwarded-For headers are trusted to identify clients for rate limiting.
+func WithTrustedProxies(proxies ...*net.IPNet) Option {
+	return func(s *smallifier) {
+		s.trustedProxies = proxies
+	}
+}
+
+// rateLimiter is a token bucket for each client, each filling at rate tokens a second up to burst.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// take takes a token from key's bucket, returning 0 if there was one,
+// or otherwise how long it will be until there is.
+func (l *rateLimiter) take(key string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.refill(key, now)
+	if b.tokens < 1 {
+		return l.untilToken(b)
+	}
+	b.tokens--
+	return 0
+}
+
+// wait returns how long it will be until key's bucket has a token, without taking it.
+func (l *rateLimiter) wait(key string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		return 0
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+	b.updated = now
+	if b.tokens < 1 {
+		return l.untilToken(b)
+	}
+	return 0
+}
+
+func (l *rateLimiter) untilToken(b *tokenBucket) time.Duration {
+	return time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// refill returns key's bucket, topped up with the tokens added since it was last used. l.mu must be held.
+func (l *rateLimiter) refill(key string, now time.Time) *tokenBucket {
+	// Buckets which have filled up are indistinguishable from new ones, so are forgotten to bound memory use.
+	if now.Sub(l.lastPrune) > time.Minute {
+		for k, b := range l.buckets {
+			if b.tokens+now.Sub(b.updated).Seconds()*l.rate >= l.burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastPrune = now
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+	b.updated = now
+	return b
+}
+
+// checkCreateRateLimit returns whether the client which made req may create a link,
+// and otherwise responds with 429 and a Retry-After header.
+func (s *smallifier) checkCreateRateLimit(w http.ResponseWriter, req *http.Request) bool {
+	if s.createLimiter == nil {
+		return true
+	}
+	client := s.clientKey(s.clientIP(req))
+	wait := s.createLimiter.take(client, s.clock.Now())
+	if wait == 0 {
+		return true
+	}
+	log.WithField("client", client).Warn("Rate limiting link creation")
+	writeRateLimited(w, wait, "too many links created, try again later")
+	return false
+}
+
+// checkLookupRateLimit returns whether the client which made req may follow a link,
+// and otherwise responds with 429 and a Retry-After header.
+func (s *smallifier) checkLookupRateLimit(w http.ResponseWriter, req *http.Request) bool {
+	if s.lookupLimiter == nil {
+		return true
+	}
+	wait := s.lookupLimiter.wait(s.clientKey(s.clientIP(req)), s.clock.Now())
+	if wait == 0 {
+		return true
+	}
+	atomic.AddUint64(&s.rateLimitedLookupCount, 1)
+	writeRateLimited(w, wait, "too many links not found, try again later")
+	return false
+}
+
+// lookupMissed records that the client which made req asked for a link which doesn't exist.
+func (s *smallifier) lookupMissed(req *http.Request) {
+	atomic.AddUint64(&s.lookupMissCount, 1)
+	if s.lookupLimiter == nil {
+		return
+	}
+	client := s.clientKey(s.clientIP(req))
+	if s.lookupLimiter.take(client, s.clock.Now()) > 0 {
+		return
+	}
+	// Only the miss which runs the client out of tokens is logged, so that a storm of misses doesn't flood the log.
+	if s.lookupLimiter.wait(client, s.clock.Now()) > 0 {
+		log.WithField("client", client).Warn("Rate limiting lookups from client following links which don't exist")
+	}
+}
+
+// writeRateLimited responds to a request which was refused because its client made too many, explained by msg,
+// telling it to retry after wait.
+func writeRateLimited(w http.ResponseWriter, wait time.Duration, msg string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeErrorResponse(w, 429, ErrorResponse{ErrCode: ErrCodeLimitExceeded, Message: msg, Retryable: true})
+}
+
+// statusRecorder records the status code written to a ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// clientIP returns the address of the client which made req, in canonical form.
+// Addresses in X-Forwarded-For are used, from the last, for as long as they were added by a trusted proxy.
+func (s *smallifier) clientIP(req *http.Request) string {
+	ip := remoteIP(req)
+	forwarded := strings.Split(strings.Join(req.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && s.trustedProxy(ip); i-- {
+		next := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if next == nil {
+			break
+		}
+		ip = next.String()
+	}
+	return ip
+}
+
+func (s *smallifier) trustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range s.trustedProxies {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
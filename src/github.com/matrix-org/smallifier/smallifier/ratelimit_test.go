@@ -0,0 +1,116 @@
+package smallifier
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := &rateLimiter{rate: 1, burst: 2, buckets: make(map[string]*tokenBucket)}
+	now := time.Now()
+	for i, want := range []time.Duration{0, 0, time.Second} {
+		if got := l.take("a", now); got != want {
+			t.Errorf("take %d: want wait %s got %s", i, want, got)
+		}
+	}
+	if got := l.take("b", now); got != 0 {
+		t.Errorf("other client: want no wait got %s", got)
+	}
+	if got := l.take("a", now.Add(500*time.Millisecond)); got != 500*time.Millisecond {
+		t.Errorf("half a second later: want wait 500ms got %s", got)
+	}
+	if got := l.take("a", now.Add(time.Second)); got != 0 {
+		t.Errorf("a second later: want no wait got %s", got)
+	}
+	l.take("b", now.Add(time.Hour))
+	if _, ok := l.buckets["a"]; ok {
+		t.Error("full bucket wasn't pruned")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	s := &smallifier{trustedProxies: []*net.IPNet{proxies}}
+	for _, tc := range []struct {
+		remote       string
+		forwardedFor string
+		want         string
+	}{
+		{"192.0.2.1:1234", "", "192.0.2.1"},
+		{"192.0.2.1:1234", "198.51.100.1", "192.0.2.1"},
+		{"10.0.0.1:1234", "198.51.100.1", "198.51.100.1"},
+		{"10.0.0.1:1234", "198.51.100.1, 10.0.0.2", "198.51.100.1"},
+		{"10.0.0.1:1234", "203.0.113.1, 198.51.100.1", "198.51.100.1"},
+		{"10.0.0.1:1234", "bogus", "10.0.0.1"},
+	} {
+		req := httptest.NewRequest("POST", "/_create", nil)
+		req.RemoteAddr = tc.remote
+		if tc.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", tc.forwardedFor)
+		}
+		if got := s.clientIP(req); got != tc.want {
+			t.Errorf("%s forwarding for %q: want %s got %s", tc.remote, tc.forwardedFor, tc.want, got)
+		}
+	}
+}
+
+func TestCreateRateLimit(t *testing.T) {
+	f := serve(t, WithCreateRateLimit(1, 2))
+	defer f.Close()
+
+	for i := 0; i < 2; i++ {
+		if shorten(t, f.server.URL, f.server.URL+"/_stub") == "" {
+			t.Fatalf("create %d: want a link", i)
+		}
+	}
+	resp, err := insecureClient().Post(f.server.URL+"/_create", "application/json", strings.NewReader(`{
+		"long_url": "`+f.server.URL+`/_stub",
+		"secret": "`+testSecret+`"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 429 {
+		t.Errorf("want status code 429 got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "60" {
+		t.Errorf("want Retry-After 60 got %q", got)
+	}
+}
+
+func TestLookupRateLimit(t *testing.T) {
+	f := serve(t, WithLookupRateLimit(1, 2))
+	defer f.Close()
+
+	link := shorten(t, f.server.URL, f.server.URL+"/_stub")
+	for i, tc := range []struct {
+		url  string
+		want int
+	}{
+		{link, 200},
+		{f.base + "missing1", 404},
+		{link, 200},
+		{f.base + "missing2", 404},
+		{link, 429},
+		{f.base + "missing3", 429},
+	} {
+		resp, err := insecureClient().Get(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("lookup %d of %s: want status code %d got %d", i, tc.url, tc.want, resp.StatusCode)
+		}
+	}
+	if got := f.smallifier.LookupMisses(); got != 2 {
+		t.Errorf("want 2 lookup misses got %v", got)
+	}
+	if got := f.smallifier.RateLimitedLookups(); got != 2 {
+		t.Errorf("want 2 rate limited lookups got %v", got)
+	}
+}
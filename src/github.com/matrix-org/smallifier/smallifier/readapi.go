@@ -0,0 +1,294 @@
+package smallifier
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// readPrefix is the path prefix under which the read API is served.
+const readPrefix = "/_read/"
+
+// ReadTokenRequest is the JSON-encoded body of an admin request to issue a read token.
+type ReadTokenRequest struct {
+	// Tags are the tags whose links the token may read. There must be at least one.
+	Tags []string `json:"tags"`
+	// Description says who the token was issued to, for operators listing tokens.
+	Description string `json:"description"`
+}
+
+// ReadToken describes an issued read token.
+type ReadToken struct {
+	ID          int64    `json:"id"`
+	Tags        []string `json:"tags"`
+	Description string   `json:"description"`
+	CreateTS    int64    `json:"create_ts"`
+	// Token is only returned when the token is issued; only its hash is stored.
+	Token string `json:"token,omitempty"`
+}
+
+// ReadLink is the JSON-encoded response to a read API request resolving a link.
+type ReadLink struct {
+	ShortURL string `json:"short_url"`
+	LongURL  string `json:"long_url"`
+	// Tags lists those of the link's tags which the token may read.
+	Tags []string `json:"tags"`
+	// Follows is the number of times the link has been followed.
+	Follows int64 `json:"follows"`
+}
+
+// TagStats is the JSON-encoded response to a read API request for the statistics of the links with a tag.
+type TagStats struct {
+	Tag   string `json:"tag"`
+	Start int64  `json:"start"`
+	End   int64  `json:"end"`
+	// Links is the number of links with the tag.
+	Links int64 `json:"links"`
+	// Follows and UniqueClients count follows of the links in [Start, End).
+	Follows       int64         `json:"follows"`
+	UniqueClients int64         `json:"unique_clients"`
+	TopLinks      []LinkFollows `json:"top_links"`
+}
+
+// hashReadToken returns the form in which token is stored.
+func hashReadToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// issueReadToken stores a new read token for the request's tags, returning it.
+func (s *smallifier) issueReadToken(ctx context.Context, r ReadTokenRequest) (ReadToken, error) {
+	t := ReadToken{Tags: r.Tags, Description: r.Description, CreateTS: s.clock.Now().Unix()}
+	var err error
+	if t.Token, err = s.generateSecret(); err != nil {
+		return t, err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return t, err
+	}
+	res, err := tx.ExecContext(ctx, `INSERT INTO read_tokens (token_hash, description, create_ts) VALUES ($1, $2, $3)`, hashReadToken(t.Token), t.Description, t.CreateTS)
+	if err == nil {
+		t.ID, err = res.LastInsertId()
+	}
+	for _, tag := range t.Tags {
+		if err != nil {
+			break
+		}
+		_, err = tx.ExecContext(ctx, `INSERT OR IGNORE INTO read_token_tags (token_id, tag) VALUES ($1, $2)`, t.ID, tag)
+	}
+	if err != nil {
+		tx.Rollback()
+		return t, err
+	}
+	return t, tx.Commit()
+}
+
+// readTokens lists the issued read tokens, without the tokens themselves.
+func (s *smallifier) readTokens(ctx context.Context) ([]ReadToken, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT read_tokens.id, read_tokens.description, read_tokens.create_ts, read_token_tags.tag
+		FROM read_tokens JOIN read_token_tags ON read_tokens.id = read_token_tags.token_id ORDER BY read_tokens.id, read_token_tags.tag`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := []ReadToken{}
+	for rows.Next() {
+		var t ReadToken
+		var tag string
+		if err := rows.Scan(&t.ID, &t.Description, &t.CreateTS, &tag); err != nil {
+			return nil, err
+		}
+		if n := len(tokens); n > 0 && tokens[n-1].ID == t.ID {
+			tokens[n-1].Tags = append(tokens[n-1].Tags, tag)
+			continue
+		}
+		t.Tags = []string{tag}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// revokeReadToken deletes the read token with id, reporting whether it existed.
+func (s *smallifier) revokeReadToken(ctx context.Context, id int64) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM read_tokens WHERE id = $1`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// readTokenTags returns the tags which the bearer token of req may read, or nil if it isn't a valid read token.
+func (s *smallifier) readTokenTags(ctx context.Context, req *http.Request) (map[string]bool, error) {
+	const prefix = "Bearer "
+	h := req.Header.Get("Authorization")
+	if !strings.HasPrefix(h, prefix) {
+		return nil, nil
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT read_token_tags.tag FROM read_tokens
+		JOIN read_token_tags ON read_tokens.id = read_token_tags.token_id WHERE read_tokens.token_hash = $1`, hashReadToken(h[len(prefix):]))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tags map[string]bool
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		if tags == nil {
+			tags = make(map[string]bool)
+		}
+		tags[tag] = true
+	}
+	return tags, rows.Err()
+}
+
+// ReadHandler is an http.HandlerFunc serving the read-only API, for holders of read tokens issued through the admin API.
+// Requests must carry a read token in an "Authorization: Bearer" header, and can only see links with one of the token's tags.
+//
+//	GET /_read/links/<short path>           returns a ReadLink.
+//	GET /_read/stats?tag=...&start=&end=    returns the TagStats for the tag between unix timestamps start (default 0) and end (default the present).
+//	GET /_read/heatmap?tag=...              returns a Heatmap of follows of links with the tag; see heatmapQuery for its parameters.
+func (s *smallifier) ReadHandler(w http.ResponseWriter, req *http.Request) {
+	setHeaders(w)
+
+	ctx, cancel, ok := s.requestContext(w, req)
+	if !ok {
+		return
+	}
+	defer cancel()
+
+	if req.Method != "GET" {
+		writeError(w, 405, ErrCodeUnrecognized, "Must GET")
+		return
+	}
+
+	scope, err := s.readTokenTags(ctx, req)
+	if err != nil {
+		log.WithField("err", err).Error("Error looking up read token")
+		writeError(w, 500, ErrCodeUnknown, "internal server error")
+		return
+	}
+	if scope == nil {
+		atomic.AddUint64(&s.authErrorCount, 1)
+		log.WithField("path", req.URL.Path).Error("Refusing read request with wrong token")
+		writeError(w, 401, ErrCodeUnauthorized, "Must specify a valid read token")
+		return
+	}
+
+	i := strings.Index(req.URL.Path, readPrefix)
+	if i < 0 {
+		writeError(w, 404, ErrCodeUnrecognized, "unknown read endpoint")
+		return
+	}
+	switch endpoint := req.URL.Path[i+len(readPrefix):]; {
+	case strings.HasPrefix(endpoint, "links/"):
+		link, err := s.readLink(ctx, endpoint[len("links/"):], scope)
+		if err != nil {
+			// Links outside the token's scope are indistinguishable from missing ones.
+			writeLookupError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(link)
+	case endpoint == "stats":
+		q := req.URL.Query()
+		tag := q.Get("tag")
+		if !scope[tag] {
+			writeError(w, 403, ErrCodeForbidden, "Token may not read that tag")
+			return
+		}
+		// end is exclusive, so the default includes follows during the current second.
+		start, end := int64(0), s.clock.Now().Unix()+1
+		for _, p := range []struct {
+			name string
+			v    *int64
+		}{{"start", &start}, {"end", &end}} {
+			if v := q.Get(p.name); v != "" {
+				if *p.v, err = strconv.ParseInt(v, 10, 64); err != nil {
+					writeError(w, 400, ErrCodeInvalidParam, p.name+" must be a unix timestamp")
+					return
+				}
+			}
+		}
+		stats, err := s.tagStats(ctx, tag, time.Unix(start, 0), time.Unix(end, 0))
+		if err != nil {
+			log.WithField("err", err).Error("Error reading tag stats")
+			writeError(w, 500, ErrCodeUnknown, "internal server error")
+			return
+		}
+		json.NewEncoder(w).Encode(stats)
+	case endpoint == "heatmap":
+		q, err := parseHeatmapQuery(req.URL.Query(), s.base.String(), s.clock.Now())
+		if err != nil {
+			writeError(w, 400, ErrCodeInvalidParam, err.Error())
+			return
+		}
+		if !scope[q.tag] {
+			writeError(w, 403, ErrCodeForbidden, "Token may not read that tag")
+			return
+		}
+		s.writeHeatmap(ctx, w, q)
+	default:
+		writeError(w, 404, ErrCodeUnrecognized, "unknown read endpoint")
+	}
+}
+
+// readLink looks up the link at shortPath, returning sql.ErrNoRows if it has none of the tags in scope.
+// Only its tags in scope are listed, so that tokens don't reveal tags they may not read.
+func (s *smallifier) readLink(ctx context.Context, shortPath string, scope map[string]bool) (ReadLink, error) {
+	link := ReadLink{ShortURL: s.base.String() + shortPath}
+	if err := s.db.QueryRowContext(ctx, `SELECT long_url FROM links WHERE short_path = $1 AND deleted = 0`, shortPath).Scan(&link.LongURL); err != nil {
+		return link, err
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT tag FROM link_tags WHERE short_path = $1 ORDER BY tag`, shortPath)
+	if err != nil {
+		return link, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return link, err
+		}
+		if scope[tag] {
+			link.Tags = append(link.Tags, tag)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return link, err
+	}
+	if len(link.Tags) == 0 {
+		return link, sql.ErrNoRows
+	}
+	err = s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM follows WHERE short_path = $1`, shortPath).Scan(&link.Follows)
+	return link, err
+}
+
+// tagStats summarises the links with tag, and their follows in [start, end).
+func (s *smallifier) tagStats(ctx context.Context, tag string, start, end time.Time) (TagStats, error) {
+	stats := TagStats{Tag: tag, Start: start.Unix(), End: end.Unix()}
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM link_tags JOIN links ON link_tags.short_path = links.short_path
+		WHERE link_tags.tag = $1 AND links.deleted = 0`, tag).Scan(&stats.Links); err != nil {
+		return stats, err
+	}
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*), COUNT(DISTINCT follows.client_key) FROM follows
+		JOIN link_tags ON follows.short_path = link_tags.short_path
+		WHERE link_tags.tag = $1 AND follows.ts >= $2 AND follows.ts < $3`, tag, stats.Start, stats.End).Scan(&stats.Follows, &stats.UniqueClients); err != nil {
+		return stats, err
+	}
+	var err error
+	stats.TopLinks, err = topLinks(ctx, s.db, s.base.String(), tag, start, end, digestTopLinks)
+	return stats, err
+}
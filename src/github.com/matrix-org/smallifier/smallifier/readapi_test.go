@@ -0,0 +1,117 @@
+package smallifier
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func readRequest(t *testing.T, f fixture, endpoint, token string) *http.Response {
+	req, err := http.NewRequest("GET", f.server.URL+"/_read/"+endpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := insecureClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func issueReadToken(t *testing.T, f fixture, body string) ReadToken {
+	resp := adminBodyRequest(t, f, "POST", "read-tokens", testSecret, body)
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatal("issuing read token: want status code 200 got", resp.StatusCode)
+	}
+	var token ReadToken
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestReadAPIScope(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	inScope := shortenTagged(t, f, f.server.URL+"/_stub?spring", "spring")
+	outOfScope := shortenTagged(t, f, f.server.URL+"/_stub?autumn", "autumn")
+	if _, err := f.db.Exec(`INSERT INTO link_tags (short_path, tag) VALUES ($1, 'autumn')`, inScope[len(f.base):]); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := insecureClient().Get(inScope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	waitForFollows(f)
+
+	token := issueReadToken(t, f, `{"tags": ["spring"], "description": "contractor"}`)
+
+	resp = readRequest(t, f, "links/"+inScope[len(f.base):], token.Token)
+	var link ReadLink
+	err = json.NewDecoder(resp.Body).Decode(&link)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.LongURL != f.server.URL+"/_stub?spring" || link.Follows != 1 {
+		t.Errorf("in scope link: want %s followed once got %+v", f.server.URL+"/_stub?spring", link)
+	}
+	if len(link.Tags) != 1 || link.Tags[0] != "spring" {
+		t.Errorf("in scope link: want only the tag in scope got %v", link.Tags)
+	}
+
+	for endpoint, want := range map[string]int{
+		"links/" + outOfScope[len(f.base):]: 404,
+		"stats?tag=autumn":                  403,
+	} {
+		resp := readRequest(t, f, endpoint, token.Token)
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%s: want status code %d got %d", endpoint, want, resp.StatusCode)
+		}
+	}
+
+	resp = readRequest(t, f, "stats?tag=spring", token.Token)
+	var stats TagStats
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Links != 1 || stats.Follows != 1 || len(stats.TopLinks) != 1 || stats.TopLinks[0].ShortURL != inScope {
+		t.Errorf("stats: want 1 link followed once got %+v", stats)
+	}
+}
+
+func TestReadTokenRevoked(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	token := issueReadToken(t, f, `{"tags": ["spring"]}`)
+	var tokens []ReadToken
+	decodeAdminResponse(t, f, "GET", "read-tokens", &tokens)
+	if len(tokens) != 1 || tokens[0].ID != token.ID || tokens[0].Token != "" {
+		t.Errorf("listing tokens: want token %d without its secret got %+v", token.ID, tokens)
+	}
+
+	resp := adminBodyRequest(t, f, "DELETE", "read-tokens/"+strconv.FormatInt(token.ID, 10), testSecret, "")
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatal("revoking: want status code 200 got", resp.StatusCode)
+	}
+	resp = readRequest(t, f, "stats?tag=spring", token.Token)
+	resp.Body.Close()
+	if resp.StatusCode != 401 {
+		t.Error("revoked token: want status code 401 got", resp.StatusCode)
+	}
+	resp = readRequest(t, f, "stats?tag=spring", testSecret)
+	resp.Body.Close()
+	if resp.StatusCode != 401 {
+		t.Error("admin secret: want status code 401 got", resp.StatusCode)
+	}
+}
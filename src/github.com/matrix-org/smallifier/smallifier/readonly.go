@@ -0,0 +1,94 @@
+package smallifier
+
+import (
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// ReadOnlyRequest is the JSON-encoded body of an admin request to turn read-only mode on or off.
+type ReadOnlyRequest struct {
+	ReadOnly bool `json:"read_only"`
+	// Reason is told to clients refused while read-only mode is on, e.g. "database migration".
+	Reason string `json:"reason,omitempty"`
+}
+
+// ReadOnlyStatus is the JSON-encoded response describing whether the Smallifier is read-only.
+type ReadOnlyStatus struct {
+	ReadOnly bool   `json:"read_only"`
+	Reason   string `json:"reason,omitempty"`
+	// SinceTS is the unix timestamp at which read-only mode was turned on, if it is.
+	SinceTS int64 `json:"since_ts,omitempty"`
+}
+
+// WithReadOnly starts the Smallifier in read-only mode, in which links are followed as usual, but requests to create
+// or change them fail with 503s until it is turned off through the admin API, e.g. during database migrations, or
+// while abuse is investigated.
+func WithReadOnly(reason string) Option {
+	return func(s *smallifier) {
+		s.readOnly.Store(ReadOnlyStatus{ReadOnly: true, Reason: reason, SinceTS: s.clock.Now().Unix()})
+	}
+}
+
+// readOnlyStatus returns whether the Smallifier is read-only.
+func (s *smallifier) readOnlyStatus() ReadOnlyStatus {
+	status, _ := s.readOnly.Load().(ReadOnlyStatus)
+	return status
+}
+
+// setReadOnly turns read-only mode on or off as described by r. Turning it on while it already is only changes the
+// reason.
+func (s *smallifier) setReadOnly(r ReadOnlyRequest) ReadOnlyStatus {
+	status := ReadOnlyStatus{}
+	if r.ReadOnly {
+		status = ReadOnlyStatus{ReadOnly: true, Reason: r.Reason, SinceTS: s.clock.Now().Unix()}
+		if previous := s.readOnlyStatus(); previous.ReadOnly {
+			status.SinceTS = previous.SinceTS
+		}
+	}
+	s.readOnly.Store(status)
+	log.WithFields(log.Fields{
+		"read_only": status.ReadOnly,
+		"reason":    status.Reason,
+	}).Warn("Changed read-only mode")
+	return status
+}
+
+// checkWritable returns a retryable *ErrorResponse with ErrCodeReadOnly if links may not be created or changed
+// because the Smallifier is read-only.
+func (s *smallifier) checkWritable() error {
+	status := s.readOnlyStatus()
+	if !status.ReadOnly {
+		return nil
+	}
+	msg := "Links can't be created or changed at the moment"
+	if status.Reason != "" {
+		msg += ": " + status.Reason
+	}
+	e := newErrorResponse(503, ErrCodeReadOnly, msg)
+	e.Retryable = true
+	return e
+}
+
+// readOnlyAdminEndpoints lists the admin endpoints at which requests other than GETs change what is stored, so are
+// refused while the Smallifier is read-only. Those with dry runs, repoint and expire, are checked once their requests
+// are read.
+var readOnlyAdminEndpoints = []string{"pin", "annotations", "api-keys", "geoblocks", "blocked-hosts", "read-tokens"}
+
+// changesStoredState reports whether requests other than GETs to the admin endpoint change what is stored.
+func changesStoredState(endpoint string) bool {
+	for _, e := range readOnlyAdminEndpoints {
+		if endpoint == e || strings.HasPrefix(endpoint, e+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadOnly gets 1 while the Smallifier is read-only, or otherwise 0.
+func (s *smallifier) ReadOnly() float64 {
+	if s.readOnlyStatus().ReadOnly {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,140 @@
+package smallifier
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadOnly(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	// Links created before read-only mode was turned on are still followed.
+	shortened := shorten(t, f.server.URL, f.server.URL+"/_stub")
+	resp := adminBodyRequest(t, f, "PUT", "read-only", testSecret, `{"read_only": true, "reason": "migrating"}`)
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("turning read-only mode on: want 200 got %d", resp.StatusCode)
+	}
+
+	resp, err := insecureClient().Post(f.server.URL+"/_create", "application/json",
+		strings.NewReader(`{"long_url": "https://lemurs.win/", "secret": "`+testSecret+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e ErrorResponse
+	json.NewDecoder(resp.Body).Decode(&e)
+	resp.Body.Close()
+	if resp.StatusCode != 503 || e.ErrCode != ErrCodeReadOnly || !strings.HasSuffix(e.Message, ": migrating") || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("create: want 503 %s with Retry-After got %d %+v", ErrCodeReadOnly, resp.StatusCode, e)
+	}
+	resp, err = insecureClient().Post(f.server.URL+"/_delete", "application/json",
+		strings.NewReader(`{"short_url": "`+shortened+`", "secret": "`+testSecret+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 503 {
+		t.Errorf("delete: want 503 got %d", resp.StatusCode)
+	}
+	resp, err = insecureClient().Get(shortened)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("follow: want 200 from the stub got %d", resp.StatusCode)
+	}
+	for _, tc := range []struct {
+		method, endpoint, body string
+		want                   int
+	}{
+		{"PUT", "pin", `{"short_url": "` + shortened + `", "pinned": true}`, 503},
+		{"PUT", "annotations", `{"short_url": "` + shortened + `", "annotations": {"team": "lemurs"}}`, 503},
+		{"POST", "api-keys", `{"name": "lemurs"}`, 503},
+		{"PUT", "blocked-hosts", `{"host": "lemurs.win"}`, 503},
+		{"DELETE", "blocked-hosts/lemurs.win", "", 503},
+		{"POST", "expire", `{"days": 1}`, 503},
+		{"POST", "expire", `{"days": 1, "dry_run": true}`, 200},
+		{"GET", "blocked-hosts", "", 200},
+	} {
+		resp := adminBodyRequest(t, f, tc.method, tc.endpoint, testSecret, tc.body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s %s %s: want %d got %d", tc.method, tc.endpoint, tc.body, tc.want, resp.StatusCode)
+		}
+	}
+	if err := f.smallifier.(*smallifier).Delete(context.Background(), shortened[len(f.base):]); err == nil {
+		t.Error("library delete: want error got nil")
+	}
+	if got := f.smallifier.ReadOnly(); got != 1 {
+		t.Errorf("want read_only 1 got %v", got)
+	}
+
+	resp = adminBodyRequest(t, f, "PUT", "read-only", testSecret, `{"read_only": false}`)
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("turning read-only mode off: want 200 got %d", resp.StatusCode)
+	}
+	var status ReadOnlyStatus
+	decodeAdminResponse(t, f, "GET", "read-only", &status)
+	if status.ReadOnly {
+		t.Errorf("want read-only mode off got %+v", status)
+	}
+	shorten(t, f.server.URL, "https://lemurs.win/")
+}
+
+func TestReadOnlyKeepsSince(t *testing.T) {
+	clock := newFakeClock()
+	f := serve(t, WithClock(clock), WithReadOnly(""))
+	defer f.Close()
+	s := f.smallifier.(*smallifier)
+
+	first := s.readOnlyStatus()
+	if !first.ReadOnly {
+		t.Fatal("want WithReadOnly to start read-only")
+	}
+	clock.advance(time.Hour)
+	if got := s.setReadOnly(ReadOnlyRequest{ReadOnly: true, Reason: "still migrating"}); got.SinceTS != first.SinceTS || got.Reason != "still migrating" {
+		t.Errorf("want read-only since %d for the new reason got %+v", first.SinceTS, got)
+	}
+	if err := s.checkWritable(); err == nil || err.(*ErrorResponse).Status != http.StatusServiceUnavailable {
+		t.Errorf("want 503 got %v", err)
+	}
+}
+
+func TestReadOnlyPausesBackgroundChanges(t *testing.T) {
+	clock := newFakeClock()
+	f := serve(t, WithClock(clock), WithUnfollowedExpiry(1))
+	defer f.Close()
+	s := f.smallifier.(*smallifier)
+
+	// Expiry and scheduled updates are both checked for on the clock.
+	const loops = 2
+	r := create(t, f, `{"long_url": "`+f.server.URL+`/_stub", "secret": "`+testSecret+`"}`)
+	body := `{"long_url": "` + f.server.URL + `/_stub?1", "apply_ts": ` + strconv.FormatInt(clock.Now().Add(time.Hour).Unix(), 10) + `}`
+	if got := changeLink(t, f, "PUT", r.ShortPath, r.EditToken, body); got != 200 {
+		t.Fatalf("scheduling update: want status code 200 got %d", got)
+	}
+	s.setReadOnly(ReadOnlyRequest{ReadOnly: true})
+
+	clock.waitForWaiters(loops)
+	clock.advance(48 * time.Hour)
+	clock.waitForWaiters(loops)
+	assertLinkCount(t, f, r.ShortPath, 1)
+	assertLongURL(t, f, r.ShortPath, f.server.URL+"/_stub")
+
+	// Once it isn't, the update is applied within a minute, and the link then expired within the hour.
+	s.setReadOnly(ReadOnlyRequest{})
+	clock.advance(scheduledUpdateInterval)
+	clock.waitForWaiters(loops)
+	assertLongURL(t, f, r.ShortPath, f.server.URL+"/_stub?1")
+	clock.advance(expiryInterval)
+	clock.waitForWaiters(loops)
+	assertLinkCount(t, f, r.ShortPath, 0)
+}
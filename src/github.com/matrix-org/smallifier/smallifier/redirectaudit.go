@@ -0,0 +1,127 @@
+package smallifier
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// auditPrefix is the path prefix under which security self-tests are served.
+const auditPrefix = "/_audit/"
+
+// auditDestination is the destination which the open redirect self-test tries to be redirected to.
+const auditDestination = "https://open-redirect.invalid/"
+
+// OpenRedirectReport is the JSON-encoded result of the open redirect self-test.
+type OpenRedirectReport struct {
+	// Passed is true if no check managed to be redirected to Destination.
+	Passed      bool            `json:"passed"`
+	Destination string          `json:"destination"`
+	TS          int64           `json:"ts"`
+	Checks      []RedirectCheck `json:"checks"`
+}
+
+// RedirectCheck is the result of one attempt to be redirected to an arbitrary destination without authenticating.
+type RedirectCheck struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	// Status is the status code the attempt was responded to with, or 0 if it wasn't made.
+	Status int `json:"status,omitempty"`
+	// Location is the Location header of the response, if any.
+	Location string `json:"location,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+// redirectProbe is an unauthenticated request which must not lead to auditDestination.
+type redirectProbe struct {
+	name   string
+	method string
+	// path is relative to the base URL.
+	path string
+	body string
+}
+
+// AuditHandler is an http.HandlerFunc serving security self-tests.
+// Requests must carry the secret in an "Authorization: Bearer" header.
+//
+//	GET /_audit/open-redirect    tries to mint redirects to an arbitrary destination without authenticating, returning an OpenRedirectReport.
+func (s *smallifier) AuditHandler(w http.ResponseWriter, req *http.Request) {
+	setHeaders(w)
+
+	if !s.checkBearer(req) {
+		atomic.AddUint64(&s.authErrorCount, 1)
+		log.WithField("path", req.URL.Path).Error("Refusing audit request with wrong secret")
+		writeError(w, 401, ErrCodeUnauthorized, "Must specify correct secret")
+		return
+	}
+	i := strings.Index(req.URL.Path, auditPrefix)
+	if i < 0 || req.URL.Path[i+len(auditPrefix):] != "open-redirect" || req.Method != "GET" {
+		writeError(w, 404, ErrCodeUnrecognized, "unknown audit endpoint")
+		return
+	}
+	json.NewEncoder(w).Encode(s.auditOpenRedirects())
+}
+
+// auditOpenRedirects makes each redirectProbe against the server's own handlers, reporting whether any was redirected to auditDestination.
+// Probes which would create a link are skipped, and reported as failures, if creation is open, so that the test doesn't store anything.
+func (s *smallifier) auditOpenRedirects() OpenRedirectReport {
+	dest := auditDestination
+	expired := s.clock.Now().Add(-time.Minute)
+	probes := []redirectProbe{
+		{"create without secret", "POST", "_create", `{"long_url": "` + dest + `"}`},
+		{"create with wrong secret", "POST", "_create", `{"long_url": "` + dest + `", "secret": "open-redirect-audit"}`},
+		{"bundle without secret", "POST", "_bundle", `{"items": [{"url": "` + dest + `"}]}`},
+		{"destination in query", "GET", "x?url=" + url.QueryEscape(dest), ""},
+		{"destination as path", "GET", "/" + strings.TrimPrefix(dest, "https://"), ""},
+		{"destination as path with scheme", "GET", dest, ""},
+		{"intent without signature", "GET", intentPath + "?" + url.Values{"url": {dest}, "exp": {"9999999999"}}.Encode(), ""},
+		{"intent signed with wrong key", "GET", intentPath + "?" + SignIntent([]byte("open-redirect-audit"), dest, s.clock.Now().Add(time.Hour)), ""},
+	}
+	if s.intentKey != nil {
+		probes = append(probes, redirectProbe{"expired intent", "GET", intentPath + "?" + SignIntent(s.intentKey, dest, expired), ""})
+	}
+
+	report := OpenRedirectReport{Passed: true, Destination: dest, TS: s.clock.Now().Unix()}
+	h := s.Handler()
+	for _, p := range probes {
+		c := RedirectCheck{Name: p.name}
+		if s.openCreation && p.method == "POST" {
+			c.Detail = "creation is open, so anyone can create links to any destination"
+		} else {
+			req := httptest.NewRequest(p.method, s.base.String()+p.path, strings.NewReader(p.body))
+			// The probes must appear to come from elsewhere, rather than from a proxy which might be trusted.
+			req.RemoteAddr = "192.0.2.1:1234"
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			c.Status = rec.Code
+			c.Location = rec.Header().Get("Location")
+			var created Response
+			json.Unmarshal(rec.Body.Bytes(), &created)
+			c.Passed = !redirectsTo(req.URL, c.Location, dest) && created.ShortURL == ""
+		}
+		report.Passed = report.Passed && c.Passed
+		report.Checks = append(report.Checks, c)
+	}
+	return report
+}
+
+// redirectsTo reports whether a response to a request for from with the given Location header would lead clients to the host of dest.
+// Locations are resolved relative to from, as browsers would.
+func redirectsTo(from *url.URL, location, dest string) bool {
+	if location == "" {
+		return false
+	}
+	l, err := from.Parse(location)
+	if err != nil {
+		// Clients differ in how they repair malformed locations, so assume the worst.
+		return true
+	}
+	d, _ := url.Parse(dest)
+	return strings.EqualFold(l.Host, d.Host)
+}
@@ -0,0 +1,102 @@
+package smallifier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// maxReferrerHosts is the most hosts a ReferrerPolicy may allow.
+const maxReferrerHosts = 20
+
+// ReferrerPolicy restricts the sites a link may be followed from, as identified by the Referer header of follows,
+// e.g. for links to resources which should only be reached from official sites.
+// Follows without a Referer header, or from other sites, are refused with a page saying where to follow it from.
+// The Referer header is easily forged, so this deters casual sharing rather than securing anything.
+type ReferrerPolicy struct {
+	// Hosts are the hosts, and their subdomains, the link may be followed from, e.g. "matrix.org".
+	Hosts []string `json:"hosts"`
+	// Interstitial lets follows from other sites continue to the link from the page they are shown, rather than
+	// refusing them with 403.
+	Interstitial bool `json:"interstitial,omitempty"`
+}
+
+// referrerRefusedPage is what the "referrerrefused" page of a Theme is rendered with.
+type referrerRefusedPage struct {
+	Hosts []string
+	// URL is where the link leads, if the follow may continue anyway.
+	URL template.URL
+}
+
+// checkReferrerPolicy returns an error if p may not be stored, normalizing its hosts to lower case.
+func checkReferrerPolicy(p *ReferrerPolicy) error {
+	if len(p.Hosts) == 0 || len(p.Hosts) > maxReferrerHosts {
+		return fmt.Errorf("Must specify between 1 and %d referrer hosts", maxReferrerHosts)
+	}
+	for i, h := range p.Hosts {
+		h = strings.ToLower(strings.TrimSuffix(h, "."))
+		if h == "" || strings.ContainsAny(h, "/:@ ") {
+			return errors.New("Referrer hosts must be host names, e.g. matrix.org")
+		}
+		p.Hosts[i] = h
+	}
+	return nil
+}
+
+// addReferrerPolicy stores p as the referrer policy of the link at shortPath.
+func (s *smallifier) addReferrerPolicy(ctx context.Context, shortPath string, p *ReferrerPolicy) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO link_referrers (short_path, hosts, interstitial) VALUES ($1, $2, $3)`,
+		shortPath, strings.Join(p.Hosts, " "), p.Interstitial)
+	return err
+}
+
+// parseReferrerPolicy returns the referrer policy stored as hosts and interstitial, or nil if hosts is empty, as it
+// is for links without one.
+func parseReferrerPolicy(hosts string, interstitial bool) *ReferrerPolicy {
+	if hosts == "" {
+		return nil
+	}
+	return &ReferrerPolicy{Hosts: strings.Fields(hosts), Interstitial: interstitial}
+}
+
+// allows reports whether p lets req follow its link. A nil policy allows every follow.
+func (p *ReferrerPolicy) allows(req *http.Request) bool {
+	if p == nil {
+		return true
+	}
+	u, err := url.Parse(req.Referer())
+	if err != nil || u.Host == "" {
+		return false
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	for _, h := range p.Hosts {
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkReferrer reports whether req may follow the link at shortPath, whose long URL is link, under its referrer
+// policy p. If it may not, it is shown the "referrerrefused" page, which lets it continue if p is an interstitial.
+func (s *smallifier) checkReferrer(w http.ResponseWriter, req *http.Request, shortPath, link string, p *ReferrerPolicy) bool {
+	if p.allows(req) {
+		return true
+	}
+	log.WithFields(log.Fields{
+		"short_path": shortPath,
+		"referer":    req.Referer(),
+	}).Info("Refused follow from disallowed referrer")
+	if p.Interstitial {
+		s.render(w, 200, "referrerrefused", referrerRefusedPage{p.Hosts, template.URL(s.rewrite(link))})
+	} else {
+		s.render(w, 403, "referrerrefused", referrerRefusedPage{Hosts: p.Hosts})
+	}
+	return false
+}
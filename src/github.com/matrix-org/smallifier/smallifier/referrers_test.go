@@ -0,0 +1,68 @@
+package smallifier
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestReferrerPolicy(t *testing.T) {
+	f := serve(t, WithLookupCache(10, defaultLookupCacheTTL))
+	defer f.Close()
+
+	strict := create(t, f, `{"long_url": "https://lemurs.win/strict", "secret": "`+testSecret+`", "referrers": {"hosts": ["Matrix.org"]}}`)
+	lenient := create(t, f, `{"long_url": "https://lemurs.win/lenient", "secret": "`+testSecret+`", "referrers": {"hosts": ["matrix.org"], "interstitial": true}}`)
+
+	client := insecureClient()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	follow := func(shortURL, referer string) (int, string) {
+		req, err := http.NewRequest("GET", shortURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if referer != "" {
+			req.Header.Set("Referer", referer)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	// Each is followed twice, so that cached links are checked too.
+	for i := 0; i < 2; i++ {
+		for _, tt := range []struct {
+			name, shortURL, referer string
+			status                  int
+		}{
+			{"allowed host", strict.ShortURL, "https://matrix.org/blog", 302},
+			{"allowed subdomain", strict.ShortURL, "https://element.matrix.org/", 302},
+			{"other host", strict.ShortURL, "https://notmatrix.org/", 403},
+			{"no referrer", strict.ShortURL, "", 403},
+			{"interstitial", lenient.ShortURL, "https://example.com/", 200},
+		} {
+			if status, _ := follow(tt.shortURL, tt.referer); status != tt.status {
+				t.Errorf("%s: want %d got %d", tt.name, tt.status, status)
+			}
+		}
+	}
+	if _, body := follow(lenient.ShortURL, ""); !strings.Contains(body, "https://lemurs.win/lenient") || !strings.Contains(body, "matrix.org") {
+		t.Errorf("interstitial: want a page continuing to https://lemurs.win/lenient got %s", body)
+	}
+	if _, body := follow(strict.ShortURL, ""); strings.Contains(body, "https://lemurs.win/strict") {
+		t.Errorf("refusal: want destination hidden got %s", body)
+	}
+
+	resp, err := client.Post(f.server.URL+"/_create", "application/json", strings.NewReader(`{"long_url": "https://lemurs.win/", "secret": "`+testSecret+`", "referrers": {"hosts": ["https://matrix.org/"]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Errorf("URL as referrer host: want 400 got %d", resp.StatusCode)
+	}
+}
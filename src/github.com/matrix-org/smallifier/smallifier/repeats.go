@@ -0,0 +1,97 @@
+package smallifier
+
+import (
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// WithRepeatWindow counts follows of a link from the same IP address and user agent within window of the first as that
+// follow, adding to its repeat_count rather than recording a new one, so that double-clicks and retrying clients don't
+// inflate stats. Repeats aren't sent to click webhooks and don't count towards milestones.
+// The window is in whole seconds, since follows are timestamped to the second; 0 counts every follow.
+func WithRepeatWindow(window time.Duration) Option {
+	return func(s *smallifier) {
+		s.repeats = repeats{
+			window: int64(window / time.Second),
+			first:  make(map[repeatKey]firstFollow),
+		}
+	}
+}
+
+// repeatKey identifies the follows counted together by WithRepeatWindow.
+type repeatKey struct {
+	shortPath  string
+	bundleItem int
+	ip         string
+	userAgent  string
+}
+
+// firstFollow is the row, and timestamp, of the follow which repeats within the window are counted as.
+type firstFollow struct {
+	id int64
+	ts int64
+}
+
+// repeats remembers the follows which are still within the repeat window.
+// It is only used from the goroutine writing follows, so isn't guarded.
+type repeats struct {
+	// window is how many seconds after a follow repeats of it are counted as it, or 0 if they aren't.
+	window int64
+	first  map[repeatKey]firstFollow
+	// prunedAt is the timestamp of the follow at which first was last pruned of follows outside the window.
+	prunedAt int64
+}
+
+func keyOf(f follow) repeatKey {
+	return repeatKey{f.shortPath, f.bundleItem, f.ip, f.userAgent}
+}
+
+// of returns the id of the follow f repeats, if any.
+func (r *repeats) of(f follow) (int64, bool) {
+	if r.window <= 0 {
+		return 0, false
+	}
+	first, ok := r.first[keyOf(f)]
+	if !ok || f.timestamp-first.ts >= r.window {
+		return 0, false
+	}
+	return first.id, true
+}
+
+// add remembers that f was recorded as the follow with the given id, pruning follows which have left the window.
+func (r *repeats) add(f follow, id int64) {
+	if r.window <= 0 {
+		return
+	}
+	if f.timestamp-r.prunedAt >= r.window {
+		for k, first := range r.first {
+			if f.timestamp-first.ts >= r.window {
+				delete(r.first, k)
+			}
+		}
+		r.prunedAt = f.timestamp
+	}
+	r.first[keyOf(f)] = firstFollow{id, f.timestamp}
+}
+
+// recordRepeat adds to the repeat_count of the follow f repeats, if any, returning whether it did.
+// Follows are recorded as new ones if their repeat can't be.
+func (s *smallifier) recordRepeat(f follow) bool {
+	id, ok := s.repeats.of(f)
+	if !ok {
+		return false
+	}
+	if _, err := s.db.ExecContext(s.ctx, `UPDATE follows SET repeat_count = repeat_count + 1 WHERE id = $1`, id); err != nil {
+		if s.ctx.Err() == nil {
+			log.WithFields(log.Fields{
+				"err":        err,
+				"short_path": f.shortPath,
+			}).Error("Error recording repeated follow")
+			atomic.AddUint64(&s.dbUpdateErrorCount, 1)
+		}
+		return false
+	}
+	return true
+}
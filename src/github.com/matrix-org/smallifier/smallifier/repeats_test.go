@@ -0,0 +1,51 @@
+package smallifier
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRepeatedFollowsCountOnce(t *testing.T) {
+	clock := newFakeClock()
+	f := serve(t, WithClock(clock), WithRepeatWindow(30*time.Second))
+	defer f.Close()
+
+	shortened := shorten(t, f.server.URL, f.server.URL+"/_stub")
+	shortPath := shortened[len(f.base):]
+	for _, tc := range []struct {
+		after     time.Duration
+		userAgent string
+	}{
+		{0, "Lemur/1.0"},
+		{time.Second, "Lemur/1.0"},
+		{29 * time.Second, "Lemur/1.0"},
+		{0, "Sifaka/2.0"},
+		{time.Second, "Lemur/1.0"},
+	} {
+		clock.advance(tc.after)
+		req, err := http.NewRequest("GET", shortened, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("User-Agent", tc.userAgent)
+		resp, err := insecureClient().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	waitForFollows(f)
+
+	resp := statsRequest(t, f, shortPath, testSecret)
+	defer resp.Body.Close()
+	var stats LinkStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	// The third follow is 30 seconds after the first, so is counted, and the last repeats it.
+	if stats.Follows != 3 || stats.Repeats != 2 {
+		t.Errorf("want 3 follows and 2 repeats got %d and %d", stats.Follows, stats.Repeats)
+	}
+}
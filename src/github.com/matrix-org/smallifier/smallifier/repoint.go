@@ -0,0 +1,137 @@
+package smallifier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// defaultRepointLimit is the most links a RepointRequest may change if it doesn't specify a limit.
+const defaultRepointLimit = 100
+
+// RepointRequest is the JSON-encoded body of an admin request to change the destination of every link matching a pattern.
+type RepointRequest struct {
+	// Match is a regular expression matched against each link's long URL.
+	Match string `json:"match"`
+	// Replace replaces every match, and may refer to submatches as in regexp.Regexp.ReplaceAllString, e.g. "${1}".
+	Replace string `json:"replace"`
+	// DryRun reports what would change without changing anything.
+	DryRun bool `json:"dry_run"`
+	// Limit is the most links which may be changed. If more match, nothing is changed.
+	// If 0, the limit is 100.
+	Limit int `json:"limit"`
+}
+
+// RepointResponse is the JSON-encoded response to a RepointRequest.
+type RepointResponse struct {
+	// Changes lists each link which was, or in a dry run would be, repointed.
+	// Links which changed between being matched and being repointed are left alone, and aren't listed.
+	Changes []Repoint `json:"changes"`
+	DryRun  bool      `json:"dry_run"`
+}
+
+// Repoint is a change of one link's destination.
+type Repoint struct {
+	ShortURL string `json:"short_url"`
+	Old      string `json:"old"`
+	New      string `json:"new"`
+}
+
+// errRepointLimit is returned by repoint if more links match than the request's limit allows.
+type errRepointLimit struct {
+	matched, limit int
+}
+
+func (e errRepointLimit) Error() string {
+	return fmt.Sprintf("%d links match, more than the limit of %d", e.matched, e.limit)
+}
+
+// repoint changes the long URLs of links as described by r, recording each change in the audit log.
+func (s *smallifier) repoint(ctx context.Context, r RepointRequest) (RepointResponse, error) {
+	resp := RepointResponse{DryRun: r.DryRun}
+	if r.Match == "" {
+		return resp, errors.New("Must specify match")
+	}
+	re, err := regexp.Compile(r.Match)
+	if err != nil {
+		return resp, fmt.Errorf("Bad match: %v", err)
+	}
+	limit := r.Limit
+	if limit <= 0 {
+		limit = defaultRepointLimit
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT short_path, long_url FROM links WHERE deleted = 0 AND long_url != '' ORDER BY id`)
+	if err != nil {
+		return resp, err
+	}
+	defer rows.Close()
+	var shortPaths []string
+	for rows.Next() {
+		var shortPath, link string
+		if err := rows.Scan(&shortPath, &link); err != nil {
+			return resp, err
+		}
+		if !re.MatchString(link) {
+			continue
+		}
+		c := Repoint{ShortURL: s.base.String() + shortPath, Old: link, New: re.ReplaceAllString(link, r.Replace)}
+		if c.New == c.Old {
+			continue
+		}
+		if err := s.longURLError(c.New); err != nil {
+			return resp, fmt.Errorf("%s would be repointed to %s: %v", c.ShortURL, c.New, err)
+		}
+		resp.Changes = append(resp.Changes, c)
+		shortPaths = append(shortPaths, shortPath)
+	}
+	if err := rows.Err(); err != nil {
+		return resp, err
+	}
+	rows.Close()
+
+	if len(resp.Changes) > limit {
+		return resp, errRepointLimit{len(resp.Changes), limit}
+	}
+	if r.DryRun || len(resp.Changes) == 0 {
+		return resp, nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return resp, err
+	}
+	now := s.clock.Now().Unix()
+	var applied []Repoint
+	var appliedPaths []string
+	for i, c := range resp.Changes {
+		// The old URL is checked again, so that links changed or deleted since they were read are left alone,
+		// and left out of the response.
+		res, err := tx.ExecContext(ctx, `UPDATE links SET long_url = $1, normalized_url = $2 WHERE short_path = $3 AND long_url = $4 AND deleted = 0`, c.New, normalizedURL(c.New), shortPaths[i], c.Old)
+		if err != nil {
+			tx.Rollback()
+			return resp, err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			tx.Rollback()
+			return resp, err
+		} else if n == 0 {
+			continue
+		}
+		if err := addAuditEntry(ctx, tx, now, "repoint", shortPaths[i], c.Old, c.New); err != nil {
+			tx.Rollback()
+			return resp, err
+		}
+		applied = append(applied, c)
+		appliedPaths = append(appliedPaths, shortPaths[i])
+	}
+	if err := tx.Commit(); err != nil {
+		return resp, err
+	}
+	resp.Changes = applied
+	for _, shortPath := range appliedPaths {
+		s.forgetLookup(shortPath)
+	}
+	return resp, nil
+}
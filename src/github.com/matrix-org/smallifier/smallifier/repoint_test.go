@@ -0,0 +1,74 @@
+package smallifier
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestRepoint(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	first := shorten(t, f.server.URL, "https://old.lemurs.win/ringtail")
+	second := shorten(t, f.server.URL, "https://old.lemurs.win/sifaka")
+	shorten(t, f.server.URL, "https://lemurs.win/old.lemurs.win")
+	const body = `{"match": "^https://old\\.lemurs\\.win/", "replace": "https://new.lemurs.win/"`
+
+	resp := adminBodyRequest(t, f, "POST", "repoint", testSecret, body+`, "limit": 1}`)
+	resp.Body.Close()
+	if resp.StatusCode != 409 {
+		t.Error("over limit: want status code 409 got", resp.StatusCode)
+	}
+
+	for _, dryRun := range []bool{true, false} {
+		resp := adminBodyRequest(t, f, "POST", "repoint", testSecret, fmt.Sprintf(`%s, "dry_run": %t}`, body, dryRun))
+		var repointed RepointResponse
+		err := json.NewDecoder(resp.Body).Decode(&repointed)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []Repoint{
+			{first, "https://old.lemurs.win/ringtail", "https://new.lemurs.win/ringtail"},
+			{second, "https://old.lemurs.win/sifaka", "https://new.lemurs.win/sifaka"},
+		}
+		if len(repointed.Changes) != 2 || repointed.Changes[0] != want[0] || repointed.Changes[1] != want[1] {
+			t.Errorf("dry run %t: want changes %+v got %+v", dryRun, want, repointed.Changes)
+		}
+
+		var n int
+		if err := f.db.QueryRow(`SELECT COUNT(*) FROM links WHERE long_url LIKE 'https://new.lemurs.win/%'`).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		wantN := 2
+		if dryRun {
+			wantN = 0
+		}
+		if n != wantN {
+			t.Errorf("dry run %t: want %d links repointed got %d", dryRun, wantN, n)
+		}
+	}
+
+	var entries []AuditEntry
+	decodeAdminResponse(t, f, "GET", "audit?short_url="+first, &entries)
+	if len(entries) != 1 || entries[0].Action != "repoint" || entries[0].New != "https://new.lemurs.win/ringtail" {
+		t.Errorf("audit log for %s: want one repoint got %+v", first, entries)
+	}
+	decodeAdminResponse(t, f, "GET", "audit", &entries)
+	if len(entries) != 2 {
+		t.Errorf("audit log: want 2 entries got %+v", entries)
+	}
+}
+
+func TestRepointToInvalidURL(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	shorten(t, f.server.URL, "https://lemurs.win/ringtail")
+	resp := adminBodyRequest(t, f, "POST", "repoint", testSecret, `{"match": "^https", "replace": "http"}`)
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Error("repointing to http: want status code 400 got", resp.StatusCode)
+	}
+}
@@ -0,0 +1,98 @@
+package smallifier
+
+import (
+	"context"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// retentionInterval is how often follows are purged by WithFollowRetention, and links expired by WithIdleExpiry.
+	retentionInterval = time.Hour
+	// purgeBatchSize is how many follows are deleted at a time, so that purging a large backlog doesn't hold the
+	// database's lock for long enough to hold up writing new follows.
+	purgeBatchSize = 10000
+)
+
+// WithFollowRetention deletes follows more than days old, checking hourly, so that the follows table doesn't grow
+// without bound. Statistics only count the follows which are kept.
+// Links followed before then may be expired by WithUnfollowedExpiry as if they never were, so it must be given fewer days.
+func WithFollowRetention(days int) Option {
+	return func(s *smallifier) {
+		s.followRetentionDays = days
+	}
+}
+
+// WithIdleExpiry expires links which haven't been followed in days, checking hourly. Pinned links are never expired.
+// With WithFollowRetention, it must be given at most as many days, or links would be expired as soon as their follows
+// were purged.
+func WithIdleExpiry(days int) Option {
+	return func(s *smallifier) {
+		s.idleExpiryDays = days
+	}
+}
+
+// enforceRetention purges follows as configured by WithFollowRetention, and expires links as configured by
+// WithIdleExpiry, every retentionInterval, until s.stop is closed.
+func (s *smallifier) enforceRetention() {
+	defer s.background.Done()
+	for {
+		select {
+		case <-s.clock.After(retentionInterval):
+		case <-s.stop:
+			return
+		}
+		if s.followRetentionDays > 0 {
+			before := s.clock.Now().AddDate(0, 0, -s.followRetentionDays).Unix()
+			ctx, cancel := context.WithTimeout(s.ctx, time.Minute)
+			purged, err := s.archiveAndPurgeFollows(ctx, before)
+			cancel()
+			if err != nil {
+				log.WithField("err", err).Error("Error purging follows")
+			} else if purged > 0 {
+				log.WithFields(log.Fields{
+					"before": before,
+					"purged": purged,
+				}).Info("Purged follows")
+			}
+		}
+		// Follows are still recorded while the Smallifier is read-only, so go on being purged, but links aren't expired.
+		if s.idleExpiryDays > 0 && !s.readOnlyStatus().ReadOnly {
+			ctx, cancel := context.WithTimeout(s.ctx, time.Minute)
+			report, err := s.expire(ctx, ExpireRequest{Days: s.idleExpiryDays, Idle: true})
+			cancel()
+			if err != nil {
+				log.WithField("err", err).Error("Error expiring idle links")
+			} else if len(report.Expired) > 0 {
+				log.WithFields(log.Fields{
+					"before":  report.Before,
+					"expired": len(report.Expired),
+				}).Info("Expired idle links")
+			}
+		}
+	}
+}
+
+// purgeFollows deletes follows, including those waiting in follow_errors, from before the unix timestamp before,
+// purgeBatchSize at a time, and returns how many were deleted.
+func (s *smallifier) purgeFollows(ctx context.Context, before int64) (int64, error) {
+	var purged int64
+	for _, table := range []string{"follows", "follow_errors"} {
+		for {
+			r, err := s.db.ExecContext(ctx, `DELETE FROM `+table+` WHERE id IN (SELECT id FROM `+table+` WHERE ts < $1 LIMIT $2)`, before, purgeBatchSize)
+			if err != nil {
+				return purged, err
+			}
+			n, err := r.RowsAffected()
+			if err != nil {
+				return purged, err
+			}
+			purged += n
+			if n < purgeBatchSize {
+				break
+			}
+		}
+	}
+	return purged, nil
+}
@@ -0,0 +1,70 @@
+package smallifier
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetention(t *testing.T) {
+	clock := newFakeClock()
+	f := serve(t, WithClock(clock), WithFollowRetention(30), WithIdleExpiry(20))
+	defer f.Close()
+
+	followed := shorten(t, f.server.URL, f.server.URL+"/_stub")
+	idle := shorten(t, f.server.URL, f.server.URL+"/_stub")
+	unfollowed := shorten(t, f.server.URL, f.server.URL+"/_stub")
+	now := clock.Now()
+	daysAgo := func(days int) int64 { return now.AddDate(0, 0, -days).Unix() }
+	for _, link := range []string{followed, idle, unfollowed} {
+		if _, err := f.db.Exec(`UPDATE links SET create_ts = $1 WHERE short_path = $2`, daysAgo(40), link[len(f.base):]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, follow := range []struct {
+		link string
+		days int
+	}{
+		{followed, 1},
+		{followed, 35},
+		{idle, 25},
+	} {
+		if _, err := f.db.Exec(`INSERT INTO follows (short_path, ts, ip) VALUES ($1, $2, '127.0.0.1')`, follow.link[len(f.base):], daysAgo(follow.days)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := f.db.Exec(`INSERT INTO follow_errors (short_path, ts, ip, error) VALUES ($1, $2, '127.0.0.1', 'database is locked')`, followed[len(f.base):], daysAgo(35)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both the scheduled update and retention loops wait on the clock.
+	clock.waitForWaiters(2)
+	clock.advance(retentionInterval)
+	clock.waitForWaiters(2)
+
+	for link, want := range map[string]int{followed: 200, idle: 404, unfollowed: 404} {
+		resp, err := insecureClient().Get(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%s: want status code %d got %d", link, want, resp.StatusCode)
+		}
+	}
+	var follows, followErrors int
+	if err := f.db.QueryRow(`SELECT COUNT(*) FROM follows WHERE ts < $1`, now.Add(-time.Hour).Unix()).Scan(&follows); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.db.QueryRow(`SELECT COUNT(*) FROM follow_errors`).Scan(&followErrors); err != nil {
+		t.Fatal(err)
+	}
+	if follows != 1 || followErrors != 0 {
+		t.Errorf("want 1 follow and 0 follow errors left got %d and %d", follows, followErrors)
+	}
+
+	resp := adminBodyRequest(t, f, "POST", "expire", testSecret, `{"days": 31, "idle": true}`)
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Errorf("expiring links idle for longer than follows are kept: want status code 400 got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,34 @@
+package smallifier
+
+import (
+	"net/http"
+	"time"
+)
+
+// retryAfter is how long clients are told to wait before retrying a request which failed for a transient reason.
+const retryAfter = 2 * time.Second
+
+// transientError wraps an error after which the request which caused it may succeed if retried,
+// such as the database being locked.
+type transientError struct {
+	err error
+}
+
+func (e transientError) Error() string {
+	return e.err.Error()
+}
+
+// databaseError returns err, from the database, as a transientError if it may not recur, as when the database is busy.
+// Other errors, such as from a missing table, would recur if the request were retried, so are returned as they are.
+func databaseError(err error) error {
+	if isBusy(err) {
+		return transientError{err}
+	}
+	return err
+}
+
+// writeTransientError responds to a request which failed for a transient reason, explained by msg,
+// telling the client when to retry with a Retry-After header and marking the error as retryable.
+func writeTransientError(w http.ResponseWriter, msg string) {
+	writeErr(w, transientErrorResponse(msg))
+}
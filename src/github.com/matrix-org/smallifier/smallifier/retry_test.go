@@ -0,0 +1,42 @@
+package smallifier
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestCreateWithDatabaseErrorIsNotRetryable(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	// A missing table won't reappear if the client retries, so shouldn't be reported as retryable.
+	if _, err := f.db.Exec(`ALTER TABLE links RENAME TO links_elsewhere`); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := insecureClient().Post(f.server.URL+"/_create", "application/json", strings.NewReader(`{
+		"long_url": "https://lemurs.win",
+		"secret": "`+testSecret+`"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 500 {
+		t.Fatal("database error: want status code 500 got", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "" {
+		t.Errorf("Retry-After: want none got %q", got)
+	}
+	var body struct {
+		Error     string `json:"error"`
+		Retryable bool   `json:"retryable"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Retryable {
+		t.Error("database error: want not retryable")
+	}
+}
@@ -0,0 +1,73 @@
+package smallifier
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// RewriteRule rewrites the destinations of links as they are followed, without changing what is stored.
+type RewriteRule struct {
+	// Match is matched against the destination.
+	Match *regexp.Regexp
+	// Replace replaces every match, and may refer to submatches as in regexp.Regexp.ReplaceAllString, e.g. "${1}".
+	Replace string
+}
+
+// ParseRewriteRules reads rewrite rules from a JSON array of objects with "match" and "replace" keys, e.g.
+//
+//	[{"match": "^http://", "replace": "https://"},
+//	 {"match": "^https://old\\.example\\.org/", "replace": "https://new.example.org/"}]
+func ParseRewriteRules(r io.Reader) ([]RewriteRule, error) {
+	var specs []struct {
+		Match   string `json:"match"`
+		Replace string `json:"replace"`
+	}
+	if err := json.NewDecoder(r).Decode(&specs); err != nil {
+		return nil, err
+	}
+	rules := make([]RewriteRule, len(specs))
+	for i, spec := range specs {
+		re, err := regexp.Compile(spec.Match)
+		if err != nil {
+			return nil, fmt.Errorf("rewrite rule %d: %v", i+1, err)
+		}
+		rules[i] = RewriteRule{re, spec.Replace}
+	}
+	return rules, nil
+}
+
+// WithRewriteRules sets rules which are applied, in order, to destinations when links are followed.
+func WithRewriteRules(rules []RewriteRule) Option {
+	return func(s *smallifier) {
+		s.SetRewriteRules(rules)
+	}
+}
+
+func (s *smallifier) SetRewriteRules(rules []RewriteRule) {
+	s.rewriteRules.Store(rules)
+}
+
+// rewrite applies the rewrite rules to link.
+// If the result could not have been shortened itself, link is returned unchanged, so a bad rule can't break redirects.
+func (s *smallifier) rewrite(link string) string {
+	rules, _ := s.rewriteRules.Load().([]RewriteRule)
+	rewritten := link
+	for _, rule := range rules {
+		rewritten = rule.Match.ReplaceAllString(rewritten, rule.Replace)
+	}
+	if rewritten == link {
+		return link
+	}
+	if s.checkScheme(rewritten) != nil || s.checkDestinationHost(rewritten) != nil || checkFaithful(rewritten) != nil {
+		log.WithFields(log.Fields{
+			"url":       link,
+			"rewritten": rewritten,
+		}).Error("Ignoring rewrite to invalid URL")
+		return link
+	}
+	return rewritten
+}
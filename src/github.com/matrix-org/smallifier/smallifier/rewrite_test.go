@@ -0,0 +1,45 @@
+package smallifier
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseRewriteRules(t *testing.T) {
+	if _, err := ParseRewriteRules(strings.NewReader(`[{"match": "(", "replace": ""}]`)); err == nil {
+		t.Error("invalid regexp: want error got nil")
+	}
+}
+
+func TestRewriteRules(t *testing.T) {
+	rules, err := ParseRewriteRules(strings.NewReader(`[
+		{"match": "^https://old\\.lemurs\\.win/", "replace": "https://new.lemurs.win/"},
+		{"match": "^https://new\\.lemurs\\.win/(\\w+)$", "replace": "https://new.lemurs.win/${1}/"},
+		{"match": "^https://broken\\.lemurs\\.win/", "replace": "http://broken.lemurs.win/"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := serve(t, WithRewriteRules(rules))
+	defer f.Close()
+
+	client := insecureClient()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	for _, tc := range []struct {
+		link, want string
+	}{
+		{"https://old.lemurs.win/ringtail", "https://new.lemurs.win/ringtail/"},
+		{"https://other.lemurs.win/", "https://other.lemurs.win/"},
+		{"https://broken.lemurs.win/", "https://broken.lemurs.win/"},
+	} {
+		resp, err := client.Get(shorten(t, f.server.URL, tc.link))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("Location"); got != tc.want {
+			t.Errorf("%s: want redirect to %q got %q", tc.link, tc.want, got)
+		}
+	}
+}
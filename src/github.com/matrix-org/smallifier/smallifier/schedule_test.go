@@ -0,0 +1,53 @@
+package smallifier
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleNext(t *testing.T) {
+	// 2016-10-05 was a Wednesday.
+	from := time.Date(2016, 10, 5, 12, 30, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2016, 10, 5, 12, 31, 0, 0, time.UTC)},
+		{"0 9 * * 1", time.Date(2016, 10, 10, 9, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2016, 10, 5, 12, 45, 0, 0, time.UTC)},
+		{"0 0 1 1 *", time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"30 12 * * 3", time.Date(2016, 10, 12, 12, 30, 0, 0, time.UTC)},
+		{"0 8 1,15 * 7", time.Date(2016, 10, 9, 8, 0, 0, 0, time.UTC)},
+		{"0 9-17/4 * 10 1-5", time.Date(2016, 10, 5, 13, 0, 0, 0, time.UTC)},
+	} {
+		s, err := ParseSchedule(tc.spec)
+		if err != nil {
+			t.Errorf("%q: %v", tc.spec, err)
+			continue
+		}
+		if got := s.Next(from); !got.Equal(tc.want) {
+			t.Errorf("%q: want next %v got %v", tc.spec, tc.want, got)
+		}
+	}
+}
+
+func TestScheduleNextInHalfHourZone(t *testing.T) {
+	ist := time.FixedZone("IST", 5*60*60+30*60)
+	s, err := ParseSchedule("0 9 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2016, 10, 5, 12, 30, 0, 0, ist)
+	want := time.Date(2016, 10, 6, 9, 0, 0, 0, ist)
+	if got := s.Next(from); !got.Equal(want) {
+		t.Errorf("want next %v got %v", want, got)
+	}
+}
+
+func TestBadSchedule(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := ParseSchedule(spec); err == nil {
+			t.Errorf("%q: want error got none", spec)
+		}
+	}
+}
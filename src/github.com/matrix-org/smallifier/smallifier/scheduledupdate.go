@@ -0,0 +1,109 @@
+package smallifier
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// scheduledUpdateInterval is how often scheduled changes to links' destinations are checked for ones which are due.
+const scheduledUpdateInterval = time.Minute
+
+// ScheduledUpdate is the JSON-encoded response to a request to change the destination of a link in the future.
+type ScheduledUpdate struct {
+	ID      int64  `json:"id"`
+	LongURL string `json:"long_url"`
+	// ApplyTS is the unix timestamp after which the link's destination is changed.
+	ApplyTS int64 `json:"apply_ts"`
+}
+
+// scheduleUpdate records that the destination of the link at shortPath is to be changed to longURL after applyTS.
+// It returns sql.ErrNoRows if there is no such link.
+func (s *smallifier) scheduleUpdate(ctx context.Context, shortPath, longURL string, applyTS int64) (ScheduledUpdate, error) {
+	u := ScheduledUpdate{LongURL: longURL, ApplyTS: applyTS}
+	var old string
+	var deleted bool
+	if err := s.db.QueryRowContext(ctx, `SELECT long_url, deleted FROM links WHERE short_path = $1`, shortPath).Scan(&old, &deleted); err != nil {
+		return u, err
+	}
+	if deleted {
+		return u, errLinkDeleted
+	}
+	if old == "" {
+		return u, errBundleUpdate
+	}
+	r, err := s.db.ExecContext(ctx, `INSERT INTO scheduled_updates (short_path, long_url, apply_ts) VALUES ($1, $2, $3)`, shortPath, longURL, applyTS)
+	if err != nil {
+		return u, err
+	}
+	u.ID, err = r.LastInsertId()
+	return u, err
+}
+
+// applyScheduledUpdates applies scheduled changes to links' destinations every scheduledUpdateInterval, until s.stop is closed.
+func (s *smallifier) applyScheduledUpdates() {
+	defer s.background.Done()
+	for {
+		select {
+		case <-s.clock.After(scheduledUpdateInterval):
+		case <-s.stop:
+			return
+		}
+		ctx, cancel := context.WithTimeout(s.ctx, time.Minute)
+		err := s.applyDueUpdates(ctx)
+		cancel()
+		if err != nil {
+			log.WithField("err", err).Error("Error applying scheduled link updates")
+		}
+	}
+}
+
+// applyDueUpdates changes the destinations of links whose scheduled changes are due, earliest first, so that the latest
+// due is the one left in place. Changes to links which have since been deleted are dropped.
+// While the Smallifier is read-only, due changes are left to be applied once it isn't.
+func (s *smallifier) applyDueUpdates(ctx context.Context) error {
+	if s.readOnlyStatus().ReadOnly {
+		return nil
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT id, short_path, long_url FROM scheduled_updates WHERE apply_ts <= $1 ORDER BY apply_ts, id`, s.clock.Now().Unix())
+	if err != nil {
+		return err
+	}
+	type due struct {
+		id                 int64
+		shortPath, longURL string
+	}
+	var updates []due
+	for rows.Next() {
+		var u due
+		if err := rows.Scan(&u.id, &u.shortPath, &u.longURL); err != nil {
+			rows.Close()
+			return err
+		}
+		updates = append(updates, u)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	for _, u := range updates {
+		err := s.updateLink(ctx, u.shortPath, u.longURL)
+		if err == errLinkDeleted || err == sql.ErrNoRows {
+			log.WithField("short_path", u.shortPath).Info("Dropping scheduled update of deleted link")
+		} else if err != nil {
+			return err
+		} else {
+			log.WithFields(log.Fields{
+				"short_path": u.shortPath,
+				"long_url":   u.longURL,
+			}).Info("Applied scheduled link update")
+		}
+		if _, err := s.db.ExecContext(ctx, `DELETE FROM scheduled_updates WHERE id = $1`, u.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
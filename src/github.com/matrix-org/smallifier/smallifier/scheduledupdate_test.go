@@ -0,0 +1,56 @@
+package smallifier
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestScheduledUpdates(t *testing.T) {
+	clock := newFakeClock()
+	f := serve(t, WithClock(clock))
+	defer f.Close()
+
+	r := create(t, f, `{"long_url": "`+f.server.URL+`/_stub", "secret": "`+testSecret+`"}`)
+	now := clock.Now().Unix()
+	for _, tc := range []struct {
+		dest  string
+		after time.Duration
+	}{
+		{"/_stub?2", 2 * time.Hour},
+		{"/_stub?1", time.Hour},
+	} {
+		body := `{"long_url": "` + f.server.URL + tc.dest + `", "apply_ts": ` + strconv.FormatInt(now+int64(tc.after/time.Second), 10) + `}`
+		if got := changeLink(t, f, "PUT", r.ShortPath, r.EditToken, body); got != 200 {
+			t.Fatalf("scheduling %s: want status code 200 got %d", tc.dest, got)
+		}
+	}
+	assertLongURL(t, f, r.ShortPath, f.server.URL+"/_stub")
+
+	clock.waitForWaiters(1)
+	clock.advance(time.Hour)
+	clock.waitForWaiters(1)
+	assertLongURL(t, f, r.ShortPath, f.server.URL+"/_stub?1")
+
+	clock.advance(3 * time.Hour)
+	clock.waitForWaiters(1)
+	assertLongURL(t, f, r.ShortPath, f.server.URL+"/_stub?2")
+
+	var pending int
+	if err := f.db.QueryRow(`SELECT COUNT(*) FROM scheduled_updates`).Scan(&pending); err != nil {
+		t.Fatal(err)
+	}
+	if pending != 0 {
+		t.Errorf("want no pending updates got %d", pending)
+	}
+}
+
+func assertLongURL(t *testing.T, f fixture, shortPath, want string) {
+	var got string
+	if err := f.db.QueryRow(`SELECT long_url FROM links WHERE short_path = $1`, shortPath).Scan(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("%s: want long URL %s got %s", shortPath, want, got)
+	}
+}
@@ -0,0 +1,137 @@
+package smallifier
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// SchemaVersion is the version of the database schema created by CreateTables, which records it in the database's user_version.
+// It must be incremented, and schemaColumns updated, whenever CreateTables changes the schema.
+const SchemaVersion = 19
+
+// schemaColumns lists the columns of each table in the current schema.
+var schemaColumns = map[string][]string{
+	"links":                {"id", "short_path", "long_url", "create_ts", "create_ip", "create_forwarded_for", "deleted", "pinned", "edit_token_hash", "owner", "normalized_url"},
+	"follows":              {"id", "short_path", "ts", "ip", "forwarded_for", "client_key", "bundle_item", "repeat_count", "user_agent", "referer"},
+	"follow_errors":        {"id", "short_path", "ts", "ip", "forwarded_for", "error", "bundle_item", "user_agent", "referer"},
+	"click_webhooks":       {"short_path", "url", "secret"},
+	"bundles":              {"short_path", "title"},
+	"bundle_items":         {"short_path", "position", "title", "url"},
+	"link_tags":            {"short_path", "tag"},
+	"app_links":            {"short_path", "app_link"},
+	"audit_log":            {"id", "ts", "action", "short_path", "old_value", "new_value"},
+	"read_tokens":          {"id", "token_hash", "description", "create_ts"},
+	"read_token_tags":      {"token_id", "tag"},
+	"geo_blocks":           {"scope_kind", "scope", "kind", "value"},
+	"link_notifications":   {"short_path", "webhook_url", "secret", "matrix_user_id", "matrix_room_id", "milestones", "notified", "follows"},
+	"api_keys":             {"id", "name", "key_hash", "create_ts", "revoked_ts"},
+	"scheduled_updates":    {"id", "short_path", "long_url", "apply_ts"},
+	"feeds":                {"url", "first_poll_ts"},
+	"feed_entries":         {"feed_url", "entry_id", "short_path"},
+	"link_annotations":     {"short_path", "key", "value"},
+	"blocked_destinations": {"host", "reason", "create_ts"},
+	"link_referrers":       {"short_path", "hosts", "interstitial"},
+	"path_space":           {"bytes"},
+}
+
+// schemaTables is the tables of schemaColumns in the order they are checked, so that reports are stable.
+var schemaTables = []string{"links", "follows", "follow_errors", "click_webhooks", "bundles", "bundle_items", "link_tags", "app_links", "audit_log", "read_tokens", "read_token_tags", "geo_blocks", "link_notifications", "api_keys", "scheduled_updates", "feeds", "feed_entries", "link_annotations", "blocked_destinations", "link_referrers", "path_space"}
+
+// SchemaError describes how a database's schema differs from the one this version of smallifier expects.
+type SchemaError struct {
+	// Version is the schema version recorded in the database.
+	Version int
+	// Empty is true if the database contains none of smallifier's tables, so can be set up without migrating any data.
+	Empty bool
+	// Problems describes each difference from the expected schema.
+	Problems []string
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("database schema version %d does not match expected version %d:\n  %s", e.Version, SchemaVersion, strings.Join(e.Problems, "\n  "))
+}
+
+// Migratable reports whether CreateTables can bring the schema up to date.
+// A database written by a newer version of smallifier cannot be migrated.
+func (e *SchemaError) Migratable() bool {
+	return e.Version <= SchemaVersion
+}
+
+// ValidateSchema checks that db has the schema created by CreateTables, returning a *SchemaError describing any differences.
+func ValidateSchema(db *sql.DB) error {
+	var e SchemaError
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&e.Version); err != nil {
+		return err
+	}
+	if e.Version > SchemaVersion {
+		e.Problems = append(e.Problems, fmt.Sprintf("database was written by a newer version of smallifier (schema version %d)", e.Version))
+	} else if e.Version < SchemaVersion {
+		e.Problems = append(e.Problems, fmt.Sprintf("schema version %d is out of date", e.Version))
+	}
+
+	missingTables := 0
+	for _, table := range schemaTables {
+		columns, err := tableColumns(db, table)
+		if err != nil {
+			return err
+		}
+		if len(columns) == 0 {
+			missingTables++
+			e.Problems = append(e.Problems, fmt.Sprintf("table %s is missing", table))
+			continue
+		}
+		for _, column := range schemaColumns[table] {
+			if !columns[column] {
+				e.Problems = append(e.Problems, fmt.Sprintf("table %s is missing column %s", table, column))
+			}
+		}
+	}
+	e.Empty = missingTables == len(schemaTables)
+
+	if !e.Empty {
+		hasForeignKey, err := hasRows(db, `PRAGMA foreign_key_list(follows)`)
+		if err != nil {
+			return err
+		}
+		if !hasForeignKey {
+			e.Problems = append(e.Problems, "table follows has no foreign key to links")
+		}
+	}
+
+	if len(e.Problems) > 0 {
+		return &e
+	}
+	return nil
+}
+
+// tableColumns returns the set of columns in table, which is empty if the table does not exist.
+func tableColumns(db *sql.DB, table string) (map[string]bool, error) {
+	rows, err := db.Query(`PRAGMA table_info(` + table + `)`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, typ string
+		var dflt interface{}
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
+
+// hasRows reports whether query returns any rows.
+func hasRows(db *sql.DB, query string) (bool, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	found := rows.Next()
+	return found, rows.Err()
+}
@@ -0,0 +1,90 @@
+package smallifier
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func openTestDB(t *testing.T) (*sql.DB, func()) {
+	dir, err := ioutil.TempDir("", "smallifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open(DriverName, filepath.Join(dir, "smallifier.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestValidateSchema(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	err, ok := ValidateSchema(db).(*SchemaError)
+	if !ok || !err.Empty || !err.Migratable() {
+		t.Fatalf("empty database: want empty, migratable *SchemaError got %#v", err)
+	}
+
+	if err := CreateTables(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateSchema(db); err != nil {
+		t.Errorf("after CreateTables: want nil got %v", err)
+	}
+}
+
+func TestValidateSchemaReportsDrift(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	if err := CreateTables(db); err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		`DROP TABLE link_tags`,
+		`ALTER TABLE bundles RENAME TO old_bundles`,
+		`CREATE TABLE bundles(short_path TEXT NOT NULL PRIMARY KEY)`,
+		`PRAGMA user_version = 0`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err, ok := ValidateSchema(db).(*SchemaError)
+	if !ok {
+		t.Fatalf("want *SchemaError got %#v", err)
+	}
+	want := []string{
+		"schema version 0 is out of date",
+		"table bundles is missing column title",
+		"table link_tags is missing",
+	}
+	if err.Empty || !reflect.DeepEqual(want, err.Problems) {
+		t.Errorf("want non-empty with problems %q got %#v", want, err)
+	}
+}
+
+func TestValidateSchemaFromNewerVersion(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	if err := CreateTables(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`PRAGMA user_version = 1000`); err != nil {
+		t.Fatal(err)
+	}
+	err, ok := ValidateSchema(db).(*SchemaError)
+	if !ok || err.Migratable() {
+		t.Errorf("want non-migratable *SchemaError got %#v", err)
+	}
+}
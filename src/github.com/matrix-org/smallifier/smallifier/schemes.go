@@ -0,0 +1,119 @@
+package smallifier
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// schemeValidators check the URLs of schemes which WithAllowedSchemes may allow besides https.
+var schemeValidators = map[string]func(u *url.URL) error{
+	"http":   checkHTTPURL,
+	"matrix": checkMatrixURI,
+	"mailto": checkMailtoURI,
+	"geo":    checkGeoURI,
+	"tel":    checkTelURI,
+}
+
+// KnownSchemes returns the schemes which may be passed to WithAllowedSchemes, in order.
+func KnownSchemes() []string {
+	var schemes []string
+	for scheme := range schemeValidators {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// WithAllowedSchemes allows links to URLs of the given schemes, e.g. "matrix" or "mailto", as well as https.
+// Each must be one of KnownSchemes, so that its URLs can be checked to be well-formed.
+func WithAllowedSchemes(schemes ...string) Option {
+	return func(s *smallifier) {
+		s.allowedSchemes = make(map[string]bool, len(schemes))
+		for _, scheme := range schemes {
+			scheme = strings.ToLower(scheme)
+			if schemeValidators[scheme] == nil {
+				panic(fmt.Sprintf("unknown scheme %q: must be one of %s", scheme, strings.Join(KnownSchemes(), ", ")))
+			}
+			s.allowedSchemes[scheme] = true
+		}
+	}
+}
+
+// checkScheme returns an error if links to link's scheme aren't allowed, or if link isn't a well-formed URL of its scheme.
+func (s *smallifier) checkScheme(link string) error {
+	if strings.HasPrefix(link, "https://") {
+		return nil
+	}
+	u, err := url.Parse(link)
+	if err != nil || !s.allowedSchemes[strings.ToLower(u.Scheme)] {
+		if len(s.allowedSchemes) == 0 {
+			return errors.New("Links must start with https://")
+		}
+		var allowed []string
+		for scheme := range s.allowedSchemes {
+			allowed = append(allowed, scheme+":")
+		}
+		sort.Strings(allowed)
+		return fmt.Errorf("Links must start with https:// or be %s URIs", strings.Join(allowed, ", "))
+	}
+	return schemeValidators[strings.ToLower(u.Scheme)](u)
+}
+
+func checkHTTPURL(u *url.URL) error {
+	if u.Host == "" {
+		return errors.New("http links must have a host")
+	}
+	return nil
+}
+
+// matrixURIPath matches the paths of matrix: URIs, as in MSC2312, e.g. r/room:example.org or roomid/abc:example.org/e/event.
+var matrixURIPath = regexp.MustCompile(`^(u|r|roomid)/[^/:]+:[^/]+(/e/[^/]+)?$`)
+
+func checkMatrixURI(u *url.URL) error {
+	if u.Opaque == "" || !matrixURIPath.MatchString(u.Opaque) {
+		return errors.New("matrix: links must be of the form matrix:r/alias:server, matrix:u/user:server or matrix:roomid/id:server")
+	}
+	return nil
+}
+
+func checkMailtoURI(u *url.URL) error {
+	addrs, err := url.PathUnescape(u.Opaque)
+	if err == nil && addrs != "" {
+		_, err = mail.ParseAddressList(addrs)
+	}
+	if err != nil || addrs == "" {
+		return errors.New("mailto: links must have valid addresses")
+	}
+	return nil
+}
+
+func checkGeoURI(u *url.URL) error {
+	coords := strings.SplitN(u.Opaque, ";", 2)[0]
+	parts := strings.Split(coords, ",")
+	if len(parts) < 2 || len(parts) > 3 {
+		return errors.New("geo: links must have a latitude and longitude")
+	}
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(p, 64)
+		if err != nil || (i == 0 && (v < -90 || v > 90)) || (i == 1 && (v < -180 || v > 180)) {
+			return errors.New("geo: links must have a latitude between -90 and 90 and a longitude between -180 and 180")
+		}
+	}
+	return nil
+}
+
+// telNumber matches global telephone numbers, with optional visual separators, as in RFC 3966.
+var telNumber = regexp.MustCompile(`^\+[0-9][0-9().-]*$`)
+
+func checkTelURI(u *url.URL) error {
+	if !telNumber.MatchString(strings.SplitN(u.Opaque, ";", 2)[0]) {
+		return errors.New("tel: links must have a global number, starting with +")
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package smallifier
+
+import "testing"
+
+func TestCheckScheme(t *testing.T) {
+	s := &smallifier{}
+	WithAllowedSchemes("matrix", "MAILTO", "geo", "tel")(s)
+	for _, tc := range []struct {
+		link string
+		ok   bool
+	}{
+		{"https://matrix.org/", true},
+		{"http://matrix.org/", false},
+		{"matrix:r/matrix:matrix.org", true},
+		{"matrix:roomid/abc:matrix.org/e/def?action=join", true},
+		{"matrix:u/alice", false},
+		{"matrix://matrix.org/", false},
+		{"mailto:alice@example.org", true},
+		{"mailto:alice@example.org,bob@example.org?subject=hi", true},
+		{"mailto:", false},
+		{"mailto:alice", false},
+		{"geo:51.5,-0.12", true},
+		{"geo:51.5,-0.12,10;u=35", true},
+		{"geo:91,0", false},
+		{"geo:nowhere", false},
+		{"tel:+44-20-7946-0000", true},
+		{"tel:0207946", false},
+		{"javascript:alert(1)", false},
+	} {
+		if err := s.checkScheme(tc.link); (err == nil) != tc.ok {
+			t.Errorf("%s: want ok %t got error %v", tc.link, tc.ok, err)
+		}
+	}
+
+	if err := (&smallifier{}).checkScheme("matrix:r/matrix:matrix.org"); err == nil {
+		t.Error("matrix: link allowed without WithAllowedSchemes")
+	}
+}
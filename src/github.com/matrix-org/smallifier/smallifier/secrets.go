@@ -0,0 +1,33 @@
+package smallifier
+
+import "crypto/subtle"
+
+// WithAdditionalSecrets accepts each of secrets as well as the one given to New.
+// This lets clients be moved to a new secret one at a time before the old one is retired.
+func WithAdditionalSecrets(secrets ...string) Option {
+	return func(s *smallifier) {
+		s.additionalSecrets = secrets
+	}
+}
+
+// SetSecrets replaces the secrets which are accepted. Empty secrets are ignored.
+func (s *smallifier) SetSecrets(secrets []string) {
+	var valid []string
+	for _, secret := range secrets {
+		if secret != "" {
+			valid = append(valid, secret)
+		}
+	}
+	s.secrets.Store(valid)
+}
+
+// validSecret reports whether secret is one of the accepted secrets.
+// Every secret is compared in constant time, so that timing doesn't reveal how much of one was guessed.
+func (s *smallifier) validSecret(secret string) bool {
+	secrets, _ := s.secrets.Load().([]string)
+	valid := 0
+	for _, candidate := range secrets {
+		valid |= subtle.ConstantTimeCompare([]byte(secret), []byte(candidate))
+	}
+	return valid == 1
+}
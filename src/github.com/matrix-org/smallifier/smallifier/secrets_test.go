@@ -0,0 +1,27 @@
+package smallifier
+
+import "testing"
+
+func TestRotateSecrets(t *testing.T) {
+	f := serve(t, WithAdditionalSecrets("new secret"))
+	defer f.Close()
+
+	for _, secret := range []string{testSecret, "new secret"} {
+		if r := create(t, f, `{"long_url": "`+f.server.URL+`/_stub", "secret": "`+secret+`"}`); r.ShortURL == "" {
+			t.Errorf("creating with %q: want a link", secret)
+		}
+	}
+
+	f.smallifier.SetSecrets([]string{"new secret", ""})
+	for secret, want := range map[string]bool{testSecret: false, "new secret": true, "": false} {
+		r := create(t, f, `{"long_url": "`+f.server.URL+`/_stub", "secret": "`+secret+`"}`)
+		if got := r.ShortURL != ""; got != want {
+			t.Errorf("after retiring old secret, creating with %q: want link %t got %t", secret, want, got)
+		}
+	}
+	resp := adminRequest(t, f, "GET", "overview", testSecret)
+	resp.Body.Close()
+	if resp.StatusCode != 401 {
+		t.Errorf("admin request with retired secret: want status code 401 got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,88 @@
+package smallifier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// errSelfReference is returned for destinations which are, or redirect to, links on this shortener,
+// which could form loops or be used to hide where a chain of shorteners ends up.
+var errSelfReference = errors.New("Links may not point at other short links")
+
+// WithRedirectResolution follows redirects from destinations, with HEAD requests made by client, when links are created
+// or changed, refusing destinations which redirect to links on this shortener, or redirect more than maxHops times.
+// Destinations which can't be reached are allowed, since they may only be reachable from the people following them.
+// Redirects aren't followed for links created anonymously, with WithOpenCreation, or by a MatrixBot anyone may use.
+func WithRedirectResolution(client *http.Client, maxHops int) Option {
+	return func(s *smallifier) {
+		c := *client
+		c.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+		s.resolveClient = &c
+		s.resolveMaxHops = maxHops
+	}
+}
+
+// selfReference reports whether link points at something on this shortener which redirects:
+// a link, an item of a bundle, or an intent.
+func (s *smallifier) selfReference(link string) bool {
+	normalized, err := normalizeURL(link)
+	if err != nil {
+		return false
+	}
+	u, err := url.Parse(normalized)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || !s.hostAllowed(u.Host) {
+		return false
+	}
+	if !strings.HasPrefix(u.Path, s.base.Path) {
+		return false
+	}
+	p := u.Path[len(s.base.Path):]
+	if i := strings.IndexByte(p, '/'); i >= 0 {
+		p = p[:i]
+	}
+	if p == intentPath {
+		return true
+	}
+	return !strings.HasPrefix(p, reservedPathPrefix) && s.classifyPath(p) != pathInvalid
+}
+
+// redirectError follows the redirects from link as configured by WithRedirectResolution,
+// returning an error if they lead to a link on this shortener or go on for too long.
+func (s *smallifier) redirectError(ctx context.Context, link string) error {
+	if s.resolveClient == nil {
+		return nil
+	}
+	for i := 0; i < s.resolveMaxHops; i++ {
+		req, err := http.NewRequest("HEAD", link, nil)
+		if err != nil || (req.URL.Scheme != "https" && req.URL.Scheme != "http") {
+			return nil
+		}
+		resp, err := s.resolveClient.Do(req.WithContext(ctx))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+				"url": link,
+			}).Info("Couldn't resolve redirects of destination")
+			return nil
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 3 {
+			return nil
+		}
+		next, err := resp.Location()
+		if err != nil {
+			return nil
+		}
+		link = next.String()
+		if s.selfReference(link) {
+			return errSelfReference
+		}
+	}
+	return fmt.Errorf("Links may not redirect more than %d times", s.resolveMaxHops)
+}
@@ -0,0 +1,138 @@
+package smallifier
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSelfReference(t *testing.T) {
+	base, _ := url.Parse("https://mtrx.to/s/")
+	s := &smallifier{base: *base, vanityMinLength: defaultVanityMinLength, allowedHosts: []string{"www.mtrx.to"}}
+	for link, want := range map[string]bool{
+		"https://mtrx.to/s/tj2TEXT7":             true,
+		"HTTPS://MTRX.TO:443/s/tj2TEXT7":         true,
+		"http://mtrx.to/s/tj2TEXT7":              true,
+		"https://www.mtrx.to/s/fosdem2024":       true,
+		"https://mtrx.to/s/tj2TEXT7/2":           true,
+		"https://mtrx.to/s/_intent?url=x":        true,
+		"https://mtrx.to/s/_create":              false,
+		"https://mtrx.to/tj2TEXT7":               false,
+		"https://mtrx.to.example.org/s/tj2TEXT7": false,
+		"https://example.org/s/tj2TEXT7":         false,
+		"https://matrix.to/#/#room:example.org":  false,
+		"matrix:r/room:example.org":              false,
+	} {
+		if got := s.selfReference(link); got != want {
+			t.Errorf("%s: want %v got %v", link, want, got)
+		}
+	}
+}
+
+func TestRefusesSelfReference(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	link := shorten(t, f.server.URL, f.server.URL+"/_stub")
+	resp, err := insecureClient().Post(f.server.URL+"/_create", "application/json", strings.NewReader(`{
+		"long_url": "`+link+`",
+		"secret": "`+testSecret+`"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Errorf("want status code 400 got %d", resp.StatusCode)
+	}
+}
+
+func TestRedirectResolution(t *testing.T) {
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	f := serve(t, WithRedirectResolution(client, 3))
+	defer f.Close()
+
+	link := shorten(t, f.server.URL, f.server.URL+"/_stub")
+	redirector := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/to-link":
+			http.Redirect(w, req, "/hop", 302)
+		case "/hop":
+			http.Redirect(w, req, link, 301)
+		case "/to-stub":
+			http.Redirect(w, req, f.server.URL+"/_stub", 302)
+		case "/loop":
+			http.Redirect(w, req, "/loop", 302)
+		default:
+			w.WriteHeader(200)
+		}
+	}))
+	defer redirector.Close()
+
+	for _, tc := range []struct {
+		path      string
+		want      int
+		wantError string
+	}{
+		{"/to-link", 400, errSelfReference.Error()},
+		{"/to-stub", 200, ""},
+		{"/loop", 400, "Links may not redirect more than 3 times"},
+		{"/page", 200, ""},
+	} {
+		resp, err := insecureClient().Post(f.server.URL+"/_create", "application/json", strings.NewReader(`{
+			"long_url": "`+redirector.URL+tc.path+`",
+			"secret": "`+testSecret+`"
+		}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.want || body.Error != tc.wantError {
+			t.Errorf("%s: want %d %q got %d %q", tc.path, tc.want, tc.wantError, resp.StatusCode, body.Error)
+		}
+	}
+}
+
+func TestRedirectResolutionSkippedForAnonymousCreators(t *testing.T) {
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	f := serve(t, WithRedirectResolution(client, 3), WithOpenCreation())
+	defer f.Close()
+
+	var probed int32
+	internal := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&probed, 1)
+		http.Redirect(w, req, "/loop", 302)
+	}))
+	defer internal.Close()
+
+	for _, tc := range []struct {
+		secret     string
+		want       int
+		wantProbed bool
+	}{
+		{"", 200, false},
+		{testSecret, 400, true},
+	} {
+		atomic.StoreInt32(&probed, 0)
+		resp, err := insecureClient().Post(f.server.URL+"/_create", "application/json", strings.NewReader(`{
+			"long_url": "`+internal.URL+`/loop",
+			"secret": "`+tc.secret+`"
+		}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if n := atomic.LoadInt32(&probed); resp.StatusCode != tc.want || (n > 0) != tc.wantProbed {
+			t.Errorf("secret %q: want %d, probed %v got %d, %d requests", tc.secret, tc.want, tc.wantProbed, resp.StatusCode, n)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package smallifier
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// loadCheckInterval is how often load is measured by WithLoadShedding.
+	loadCheckInterval = time.Second
+	// sheddingCooldown is how long load must stay under every threshold before shedding stops, so that it doesn't flap.
+	sheddingCooldown = 30 * time.Second
+)
+
+// LoadThresholds are the measures of load beyond which WithLoadShedding sheds it. Zero thresholds aren't checked.
+type LoadThresholds struct {
+	// FollowQueue is the number of follows waiting to be written to the database.
+	FollowQueue int64
+	// DBLatency is how long a trivial query takes.
+	DBLatency time.Duration
+	// Goroutines is the number of goroutines, which grows with the number of requests in flight.
+	Goroutines int
+}
+
+// load is a measurement of the load on the server.
+type load struct {
+	followQueue int64
+	dbLatency   time.Duration
+	goroutines  int
+}
+
+func (l load) exceeds(t LoadThresholds) bool {
+	return (t.FollowQueue > 0 && l.followQueue > t.FollowQueue) ||
+		(t.DBLatency > 0 && l.dbLatency > t.DBLatency) ||
+		(t.Goroutines > 0 && l.goroutines > t.Goroutines)
+}
+
+// WithLoadShedding measures load every second, and sheds it while any measure exceeds its threshold in t:
+// follows aren't recorded, links are only followed if they were recently enough to be cached,
+// and requests to create links are refused with 503s.
+// Shedding stops once load has been under every threshold for 30 seconds.
+// Unless WithLookupCache was given, a cache of 10000 links for up to 5 minutes is used.
+// Cached links aren't followed if clients are located for geo-blocking, since whether they are blocked depends on the client.
+func WithLoadShedding(t LoadThresholds) Option {
+	return func(s *smallifier) {
+		s.loadThresholds = &t
+	}
+}
+
+// shedLoad measures load every loadCheckInterval, starting or stopping shedding as it changes, until s.stop is closed.
+func (s *smallifier) shedLoad() {
+	defer s.background.Done()
+	for {
+		select {
+		case <-s.clock.After(loadCheckInterval):
+		case <-s.stop:
+			return
+		}
+		s.updateShedding(s.measureLoad(), s.clock.Now())
+	}
+}
+
+// measureLoad measures the current load. The database's latency is capped at the timeout of its query.
+func (s *smallifier) measureLoad() load {
+	ctx, cancel := context.WithTimeout(s.ctx, 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	var one int
+	if err := s.db.QueryRowContext(ctx, `SELECT 1 FROM links LIMIT 1`).Scan(&one); err != nil && err != sql.ErrNoRows && ctx.Err() == nil {
+		log.WithField("err", err).Error("Error measuring database latency")
+	}
+	return load{
+		followQueue: atomic.LoadInt64(&s.pendingFollows),
+		dbLatency:   time.Since(start),
+		goroutines:  runtime.NumGoroutine(),
+	}
+}
+
+// updateShedding starts shedding load if l exceeds the thresholds, and stops once it hasn't for sheddingCooldown.
+func (s *smallifier) updateShedding(l load, now time.Time) {
+	s.sheddingMu.Lock()
+	defer s.sheddingMu.Unlock()
+	fields := log.Fields{
+		"follow_queue": l.followQueue,
+		"db_latency":   l.dbLatency,
+		"goroutines":   l.goroutines,
+	}
+	if l.exceeds(*s.loadThresholds) {
+		s.overloadedAt = now
+		if atomic.CompareAndSwapInt32(&s.shedding, 0, 1) {
+			atomic.AddUint64(&s.sheddingTransitionCount, 1)
+			log.WithFields(fields).Warn("Shedding load")
+		}
+		return
+	}
+	if now.Sub(s.overloadedAt) >= sheddingCooldown && atomic.CompareAndSwapInt32(&s.shedding, 1, 0) {
+		atomic.AddUint64(&s.sheddingTransitionCount, 1)
+		log.WithFields(fields).Info("Stopped shedding load")
+	}
+}
+
+// sheddingLoad returns whether load is being shed.
+func (s *smallifier) sheddingLoad() bool {
+	return atomic.LoadInt32(&s.shedding) == 1
+}
+
+// refuseWhileShedding responds with a 503 and returns false if load is being shed, or otherwise returns true.
+func (s *smallifier) refuseWhileShedding(w http.ResponseWriter) bool {
+	if !s.sheddingLoad() {
+		return true
+	}
+	atomic.AddUint64(&s.shedRequestCount, 1)
+	writeTransientError(w, "server overloaded")
+	return false
+}
+
+// lookupCached follows the link at shortPath if it is cached, and otherwise refuses the lookup with a 503.
+func (s *smallifier) lookupCached(w http.ResponseWriter, req *http.Request, shortPath string) {
+	c, ok := s.lookupCache.get(shortPath, s.clock.Now())
+	if !ok || s.geoIP != nil {
+		atomic.AddUint64(&s.shedRequestCount, 1)
+		writeTransientError(w, "server overloaded")
+		return
+	}
+	if s.destinationBlocked(c.link) {
+		s.writeDestinationBlocked(w, c.link)
+		return
+	}
+	if s.checkReferrer(w, req, shortPath, c.link, c.referrers) {
+		s.redirect(w, req, shortPath, 0, c.link, c.appLink)
+	}
+}
+
+// LoadShedding gets 1 if load is being shed, or otherwise 0.
+func (s *smallifier) LoadShedding() float64 {
+	return float64(atomic.LoadInt32(&s.shedding))
+}
+
+// LoadSheddingTransitions gets a count of the times load shedding started or stopped.
+func (s *smallifier) LoadSheddingTransitions() float64 {
+	return float64(atomic.LoadUint64(&s.sheddingTransitionCount))
+}
+
+// ShedRequests gets a count of requests refused, and follows not recorded, while shedding load.
+func (s *smallifier) ShedRequests() float64 {
+	return float64(atomic.LoadUint64(&s.shedRequestCount))
+}
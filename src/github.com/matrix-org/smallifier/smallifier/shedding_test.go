@@ -0,0 +1,90 @@
+package smallifier
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadSheddingTransitions(t *testing.T) {
+	f := serve(t, WithLoadShedding(LoadThresholds{FollowQueue: 100}))
+	defer f.Close()
+	s := f.smallifier.(*smallifier)
+
+	now := time.Now()
+	for i, tc := range []struct {
+		load load
+		at   time.Duration
+		want float64
+	}{
+		{load{followQueue: 50}, 0, 0},
+		{load{followQueue: 200}, 0, 1},
+		{load{followQueue: 50}, sheddingCooldown - time.Second, 1},
+		{load{followQueue: 50}, sheddingCooldown, 0},
+	} {
+		s.updateShedding(tc.load, now.Add(tc.at))
+		if got := f.smallifier.LoadShedding(); got != tc.want {
+			t.Errorf("check %d: want shedding %v got %v", i, tc.want, got)
+		}
+	}
+	if got := f.smallifier.LoadSheddingTransitions(); got != 2 {
+		t.Errorf("want 2 transitions got %v", got)
+	}
+}
+
+func TestLoadSheddingRefusesCreates(t *testing.T) {
+	f := serve(t, WithLoadShedding(LoadThresholds{Goroutines: 1 << 20}))
+	defer f.Close()
+	f.smallifier.(*smallifier).updateShedding(load{goroutines: 1 << 21}, time.Now())
+
+	resp, err := insecureClient().Post(f.server.URL+"/_create", "application/json", strings.NewReader(`{
+		"long_url": "`+f.server.URL+`/_stub",
+		"secret": "`+testSecret+`"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 503 {
+		t.Errorf("want status code 503 got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("want a Retry-After header")
+	}
+}
+
+func TestLoadSheddingServesCachedLookups(t *testing.T) {
+	f := serve(t, WithLoadShedding(LoadThresholds{DBLatency: time.Hour}))
+	defer f.Close()
+
+	cached := shorten(t, f.server.URL, f.server.URL+"/_stub")
+	uncached := shorten(t, f.server.URL, f.server.URL+"/_stub")
+	resp, err := insecureClient().Get(cached)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	waitForFollows(f)
+
+	f.smallifier.(*smallifier).updateShedding(load{dbLatency: 2 * time.Hour}, time.Now())
+	for _, tc := range []struct {
+		url  string
+		want int
+	}{
+		{cached, 200},
+		{uncached, 503},
+	} {
+		resp, err := insecureClient().Get(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("lookup of %s: want status code %d got %d", tc.url, tc.want, resp.StatusCode)
+		}
+	}
+	assertFollowCount(f, cached[len(f.base):], 1, "cached link")
+	if got := f.smallifier.ShedRequests(); got != 2 {
+		t.Errorf("want 2 shed requests got %v", got)
+	}
+}
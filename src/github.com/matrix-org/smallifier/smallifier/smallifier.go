@@ -3,19 +3,25 @@
 package smallifier
 
 import (
+	"context"
 	"crypto/rand"
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // CreateRequest is the JSON-encoded POST-body of an HTTP request to generate a short link.
@@ -23,19 +29,58 @@ type CreateRequest struct {
 	// LongURL is the link to be shortened.
 	LongURL string `json:"long_url"`
 	Secret  string `json:"secret"`
+	// ClickWebhookURL is an optional https URL to which batches of follows of the link are POSTed as a ClickBatch.
+	ClickWebhookURL string `json:"click_webhook_url,omitempty"`
+	// Title optionally describes the link. If set, the Response includes Snippets using it as the link text.
+	Title string `json:"title,omitempty"`
+	// Tags group the link with others, e.g. those belonging to the same campaign.
+	Tags []string `json:"tags,omitempty"`
+	// Nonce is a value from the nonce endpoint, which browsers may be required to pass.
+	Nonce string `json:"nonce,omitempty"`
+	// AppLink is an optional matrix: or intent: URI for a link to Matrix content,
+	// to which clients which can open it, as described by AppSchemesHeader, are redirected instead of LongURL.
+	AppLink string `json:"app_link,omitempty"`
+	// ShortPath optionally requests a vanity alias, e.g. fosdem2024, instead of a generated short path.
+	ShortPath string `json:"short_path,omitempty"`
+	// Dedupe asks for the existing link to be returned if LongURL, or an equivalent URL, has already been shortened,
+	// rather than creating another. The existing link's edit token isn't returned.
+	Dedupe bool `json:"dedupe,omitempty"`
+	// Notify optionally asks for the creator to be notified when the link is first followed, and at milestones.
+	Notify *NotifyRequest `json:"notify,omitempty"`
+	// Referrers optionally restricts the sites the link may be followed from.
+	Referrers *ReferrerPolicy `json:"referrers,omitempty"`
 }
 
 // DeleteRequest is the JSON-encoded POST-body of an HTTP request to delete a short link.
 type DeleteRequest struct {
 	// ShortURL is the link to be deleted.
 	ShortURL string `json:"short_url"`
-	Secret   string `json:"secret"`
+	// ShortPath identifies the link to be deleted by its path alone, instead of ShortURL.
+	ShortPath string `json:"short_path,omitempty"`
+	Secret    string `json:"secret"`
+	// EditToken is the link's edit token from its Response, which may be passed instead of Secret.
+	EditToken string `json:"edit_token,omitempty"`
 }
 
 // Response is the JSON-encoded POST-body of the response to a request to generate a short link.
 type Response struct {
 	// ShortURL is the generated short-link.
 	ShortURL string `json:"short_url"`
+	// ShortPath is the path of ShortURL under the base URL, e.g. tj2TEXT7.
+	ShortPath string `json:"short_path"`
+	CreatedTS int64  `json:"created_ts"`
+	// ExpiresTS is when the link will be removed if it hasn't been followed by then, if unfollowed links expire.
+	ExpiresTS int64 `json:"expires_ts,omitempty"`
+	// EditToken may be passed instead of the secret to update or delete the link. It is only returned when the link is created.
+	EditToken string `json:"edit_token,omitempty"`
+	// Owner is the name of the API key the link was created with, if it wasn't created with the server's secret.
+	Owner string `json:"owner,omitempty"`
+	// ClickWebhookSecret is the key with which requests to the click webhook are signed, if one was requested.
+	ClickWebhookSecret string `json:"click_webhook_secret,omitempty"`
+	// Snippets are ready-to-paste links to ShortURL, included if a title was given.
+	Snippets *Snippets `json:"snippets,omitempty"`
+	// NotifyWebhookSecret is the key with which requests to the notification webhook are signed, if one was requested.
+	NotifyWebhookSecret string `json:"notify_webhook_secret,omitempty"`
 }
 
 // Smallifier implements a basic link shortener.
@@ -44,190 +89,1125 @@ type Smallifier interface {
 	CreateHandler(w http.ResponseWriter, req *http.Request)
 	// HTTP handler which redirects to the long URL for the requested path.
 	LookupHandler(w http.ResponseWriter, req *http.Request)
+	// HTTP handler which accepts a JSON object containing a list of titled URLs and secret, and returns a JSON object with a short_url
+	// pointing to a page which lists them.
+	CreateBundleHandler(w http.ResponseWriter, req *http.Request)
 	// HTTP handler which accepts a JSON object containing a short_url and secret, and removes the short_url.
 	DeleteHandler(w http.ResponseWriter, req *http.Request)
+	// HTTP handler which issues single-use nonces for browsers to pass in create requests.
+	NonceHandler(w http.ResponseWriter, req *http.Request)
+	// HTTP handler for the operator API under /_admin/, authenticated by passing the secret as a bearer token.
+	AdminHandler(w http.ResponseWriter, req *http.Request)
+	// HTTP handler for the read-only API under /_read/, authenticated by passing a read token, scoped to tags, as a bearer token.
+	ReadHandler(w http.ResponseWriter, req *http.Request)
+	// HTTP handler which returns the follow count and timestamps of the link at /_stats/<short path>,
+	// authenticated by passing the secret as a bearer token.
+	StatsHandler(w http.ResponseWriter, req *http.Request)
+	// HTTP handler which lists pages of links, authenticated by passing the secret as a bearer token.
+	LinksHandler(w http.ResponseWriter, req *http.Request)
+	// HTTP handler which updates or deletes the link at /_links/<short path>,
+	// authenticated by passing its edit token, the API key it was created with, or the secret as a bearer token.
+	LinkHandler(w http.ResponseWriter, req *http.Request)
+	// HTTP handler which redirects to the destinations of intents signed by SignIntent, if WithIntentKey was given.
+	IntentHandler(w http.ResponseWriter, req *http.Request)
+	// HTTP handler for security self-tests under /_audit/, authenticated by passing the secret as a bearer token.
+	AuditHandler(w http.ResponseWriter, req *http.Request)
+	// HTTP handler which returns a QR code of the short URL of the link at /_qr/<short path>, as a PNG or SVG.
+	QRHandler(w http.ResponseWriter, req *http.Request)
+	// Handler serves all of the above under the path of the base URL, e.g. creating links at https://example.org/s/_create
+	// if the base URL is https://example.org/s/.
+	Handler() http.Handler
+
+	// Shorten creates a link as CreateHandler would, for programs embedding the Smallifier, without going through HTTP.
+	// req needn't give a secret, but may give an API key to own the link. Errors are *ErrorResponses.
+	Shorten(ctx context.Context, req CreateRequest) (Response, error)
+	// Resolve returns the link at shortPath, without counting a follow. Errors are *ErrorResponses, with ErrCodeNotFound
+	// if there is no such link, and ErrCodeGone if it has been deleted or its destination may no longer be followed.
+	Resolve(ctx context.Context, shortPath string) (Link, error)
+	// Delete marks the link at shortPath deleted. Errors are *ErrorResponses, with ErrCodeNotFound if there is no such link.
+	Delete(ctx context.Context, shortPath string) error
 
 	// RandomErrors gets a count of the number of times that we were unable to generate a random number.
 	// In normal operating conditions, this should always return 0.
 	// This being non-zero likely indicates the OS is having trouble generating randomness, which is really bad.
 	RandomErrors() float64
+	// RandomFallbacks gets a count of the times fallback entropy was used because the source of randomness failed.
+	RandomFallbacks() float64
+	// RandomBreakerOpen gets 1 while the source of randomness isn't tried because it kept failing, or otherwise 0.
+	RandomBreakerOpen() float64
+	// ReadOnly gets 1 while the Smallifier is read-only, or otherwise 0.
+	ReadOnly() float64
+	// Maintenance gets 1 while the Smallifier is in maintenance mode, or otherwise 0.
+	Maintenance() float64
 	// AuthErrors gets a count of attempts made to create links without proper auth.
 	AuthErrors() float64
 	// DBUpdateErrors gets a count of attempts made to update the database which failed.
 	DBUpdateErrors() float64
+	// WebhookErrors gets a count of webhook deliveries which failed.
+	WebhookErrors() float64
+	// LookupMisses gets a count of lookups of links which don't exist.
+	// A sustained high rate suggests someone is trying to enumerate links.
+	LookupMisses() float64
+	// RateLimitedLookups gets a count of lookups refused because their client had looked up too many links which don't exist.
+	RateLimitedLookups() float64
+	// LoadShedding gets 1 while load is being shed, or otherwise 0.
+	LoadShedding() float64
+	// LoadSheddingTransitions gets a count of the times load shedding started or stopped.
+	LoadSheddingTransitions() float64
+	// ShedRequests gets a count of requests refused, and follows not recorded, while shedding load.
+	ShedRequests() float64
+	// NamespaceCounts gets the counts of links created and followed in each namespace given to WithNamespaces, or nil if none were.
+	NamespaceCounts() []NamespaceCount
+	// LinkLimitUsage gets how much of each limit given to WithLinkLimits is used, or nil if none were.
+	LinkLimitUsage() []LinkLimitUsage
+	// LinkLimitRefusals gets a count of links not created because of WithLinkLimits.
+	LinkLimitRefusals() float64
+	// LookupCacheHits gets a count of lookups served from the cache given by WithLookupCache.
+	LookupCacheHits() float64
+	// LookupCacheMisses gets a count of lookups of links which weren't in the cache given by WithLookupCache.
+	LookupCacheMisses() float64
+	// FollowQueueDepth gets the number of follows waiting to be written to the database.
+	FollowQueueDepth() float64
+	// DroppedFollows gets a count of follows which weren't recorded because the follow queue was full.
+	DroppedFollows() float64
+	// PathCollisions gets a count of attempts to store generated short paths which collided with existing links.
+	PathCollisions() float64
+	// PathSpaceFill gets the fraction of the possible generated short paths of the current length which are in use.
+	PathSpaceFill() float64
+	// PathCollisionRate gets the fraction of attempts to store generated short paths which collided, over the last window.
+	PathCollisionRate() float64
+	// PathBytes gets how many random bytes short paths are generated from, which grows as they collide.
+	PathBytes() float64
+
+	// SetRewriteRules replaces the rules applied to destinations as links are followed.
+	SetRewriteRules(rules []RewriteRule)
+	// SetTheme replaces the theme HTML pages are rendered with.
+	SetTheme(t *Theme)
+	// SetDestinationHosts replaces the restrictions on the hosts links may point to. nil removes them.
+	SetDestinationHosts(h *DestinationHosts)
+	// SetSecrets replaces the secrets which are accepted, e.g. to retire an old one once every client has the new one.
+	SetSecrets(secrets []string)
+	// SetMaintenance turns maintenance mode, in which every request Handler serves but those to the admin API gets a 503,
+	// on or off.
+	SetMaintenance(r MaintenanceRequest) MaintenanceStatus
+	// Close waits for queued follows to be written and delivers pending click webhooks and notifications, then stops background work,
+	// after which the database is no longer used, and may be closed.
+	// The handlers must not be called once Close has been, so the HTTP server should be shut down first.
+	// Shorten, Resolve and Delete return errors with ErrCodeUnavailable once it has been.
+	Close()
+	// Shutdown is Close, but gives up waiting once ctx is done, returning an error saying how many follows were left unwritten.
+	// Close and Shutdown may be called any number of times, concurrently: every call waits for the same work to finish.
+	Shutdown(ctx context.Context) error
+}
+
+// TimeoutHeader is the HTTP header clients may set to request a deadline, in milliseconds, for their request.
+// The requested deadline is capped at the server's configured maximum.
+const TimeoutHeader = "X-Smallifier-Timeout-Ms"
+
+// Option configures optional behaviour of a Smallifier.
+type Option func(*smallifier)
+
+// WithMaxRequestTimeout sets the longest deadline a client may request using TimeoutHeader.
+// Requests asking for longer are given max. <= 0 means the header is ignored.
+func WithMaxRequestTimeout(max time.Duration) Option {
+	return func(s *smallifier) {
+		s.maxRequestTimeout = max
+	}
+}
+
+// defaultMaxCreateBodySize is the default size, in bytes, of the largest create request body which is read.
+const defaultMaxCreateBodySize = 64 << 10
+
+// WithMaxCreateBodySize sets the size, in bytes, of the largest create request body which is read.
+// Larger bodies are refused with 413 Request Entity Too Large.
+func WithMaxCreateBodySize(n int64) Option {
+	return func(s *smallifier) {
+		s.maxCreateBodySize = n
+	}
 }
 
 // New makes a new Smallifier.
+// Short links are base followed by the short path; if base's path doesn't end in a slash, one is added.
 // Links must be at most lengthLimit runes long; <= 0 means no limit.
-func New(base url.URL, db *sql.DB, secret string, lengthLimit int) Smallifier {
+// Background database work is done with ctx. Once it is done, follows stop being written: those still queued are lost,
+// unless WithFollowJournal was given, in which case they are recovered by the next Smallifier to use the journal.
+// Close must still be called.
+// It returns an error if the database can't be read, or the follow journal can't be recovered. Options which contradict
+// each other are programming errors, so panic.
+func New(ctx context.Context, base url.URL, db *sql.DB, secret string, lengthLimit int, opts ...Option) (Smallifier, error) {
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+		base.RawPath = ""
+	}
 	s := &smallifier{
+		ctx:         ctx,
 		base:        base,
 		db:          db,
-		secret:      secret,
 		lengthLimit: lengthLimit,
-		follows:     make(chan follow, 1024*1024),
+		random:      rand.Reader,
+		randomness:  randomState{fallback: newFallbackEntropy()},
+		clock:       SystemClock,
+
+		vanityMinLength:   defaultVanityMinLength,
+		ipv6Prefix:        defaultIPv6Prefix,
+		maxCreateBodySize: defaultMaxCreateBodySize,
+
+		webhookInterval: 10 * time.Second,
+		webhookClient:   &http.Client{Timeout: 10 * time.Second},
+		usageReporter:   NopUsageReporter{},
+
+		followsDone:  make(chan struct{}),
+		journalDone:  make(chan struct{}),
+		stop:         make(chan struct{}),
+		clicksDone:   make(chan struct{}),
+		shutdownDone: make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.SetSecrets(append([]string{secret}, s.additionalSecrets...))
+	s.nonces = newNonces(secret)
+	if s.followQueueSize <= 0 {
+		s.followQueueSize = defaultFollowQueueSize
+		if s.smallFootprint {
+			s.followQueueSize = smallFollowQueueSize
+		}
+	}
+	s.follows = newFollowQueue(s.followQueueSize)
+	s.unjournaled = newFollowQueue(s.followQueueSize)
+	if s.maxCreateBodySize <= 0 {
+		panic("the largest create request body must be at least a byte")
+	}
+	if s.vanityMinLength <= machinePathLength {
+		panic(fmt.Sprintf("vanity aliases must be longer than %d characters", machinePathLength))
+	}
+	if s.followRetentionDays > 0 && s.expiryDays >= s.followRetentionDays {
+		panic("unfollowed links must be expired in fewer days than follows are kept for")
+	}
+	if s.followRetentionDays > 0 && s.idleExpiryDays > s.followRetentionDays {
+		panic("idle links must be expired in at most as many days as follows are kept for")
+	}
+	if s.followArchiveDir != "" && s.followRetentionDays <= 0 {
+		panic("follows are only archived as they are purged, so must be kept for a number of days")
 	}
 
-	go func() {
-		for f := range s.follows {
-			if _, err := s.db.Exec(`INSERT INTO follows (short_path, ts, ip, forwarded_for) VALUES ($1, $2, $3, $4)`, f.shortPath, f.timestamp, f.ip, f.forwardedFor); err != nil {
-				log.WithField("err", err).Error("Error inserting follow")
-				atomic.AddUint64(&s.dbUpdateErrorCount, 1)
+	if s.linkLimits != nil {
+		s.checkLinkLimitNamespaces()
+	}
+
+	for _, f := range s.feeds {
+		if f.MatrixRoomID != "" && s.matrixNotifier == nil {
+			panic(fmt.Sprintf("feed %s has a Matrix room, but no Matrix notifier was given", f.URL))
+		}
+	}
+
+	if err := s.prepareStatements(ctx); err != nil {
+		return nil, fmt.Errorf("preparing statements: %v", err)
+	}
+	if err := s.loadBlockedDestinations(ctx); err != nil {
+		return nil, fmt.Errorf("loading blocked destinations: %v", err)
+	}
+	if err := s.checkPathSpace(ctx); err != nil {
+		return nil, fmt.Errorf("checking space of generated short paths: %v", err)
+	}
+	if s.linkLimits != nil {
+		if err := s.countLinks(ctx); err != nil {
+			return nil, fmt.Errorf("counting links for their limits: %v", err)
+		}
+	}
+	if s.journalPath != "" {
+		if err := s.recoverFollows(); err != nil {
+			return nil, fmt.Errorf("recovering follows from journal: %v", err)
+		}
+	}
+	// Metrics are registered last, so that none are left registered if the Smallifier can't be made.
+	if s.registerer != nil {
+		if err := s.registerMetrics(); err != nil {
+			if s.journal != nil {
+				s.journal.close()
+			}
+			return nil, fmt.Errorf("registering metrics: %v", err)
+		}
+	}
+	if s.journal != nil {
+		go s.journalFollows()
+	}
+	go s.writeFollows()
+	go s.deliverClicks()
+	s.background.Add(1)
+	go s.applyScheduledUpdates()
+	if len(s.feeds) > 0 {
+		s.background.Add(1)
+		go s.watchFeeds()
+	}
+	if s.expiryDays > 0 {
+		s.background.Add(1)
+		go s.expireUnfollowedLinks()
+	}
+	if s.followRetentionDays > 0 || s.idleExpiryDays > 0 {
+		s.background.Add(1)
+		go s.enforceRetention()
+	}
+	if s.matrixBot != nil {
+		s.background.Add(1)
+		go s.runMatrixBot()
+	}
+	if s.linkLimits != nil {
+		s.background.Add(1)
+		go s.recountLinks()
+	}
+	if s.digestSchedule != nil {
+		s.background.Add(1)
+		go s.sendDigests()
+	}
+	if _, ok := s.usageReporter.(NopUsageReporter); !ok {
+		s.background.Add(1)
+		go s.pingUsage()
+	}
+	for _, h := range s.eventHooks {
+		s.background.Add(1)
+		go s.deliverEvents(h)
+	}
+	if s.loadThresholds != nil {
+		if s.lookupCache == nil {
+			size := defaultLookupCacheSize
+			if s.smallFootprint {
+				size = smallLookupCacheSize
 			}
-			atomic.AddInt64(&s.pendingFollows, -1)
+			s.lookupCache = newLookupCache(size, defaultLookupCacheTTL)
 		}
-	}()
+		s.background.Add(1)
+		go s.shedLoad()
+	}
 
-	return s
+	return s, nil
+}
+
+func (s *smallifier) Close() {
+	s.Shutdown(context.Background())
+}
+
+func (s *smallifier) Shutdown(ctx context.Context) error {
+	s.shutdownOnce.Do(func() {
+		atomic.StoreInt32(&s.closed, 1)
+		go func() {
+			defer close(s.shutdownDone)
+			// Follows waiting to be journaled are passed on to be written before the queue of those is closed.
+			if s.journal != nil {
+				s.unjournaled.close()
+				<-s.journalDone
+			}
+			s.follows.close()
+			<-s.followsDone
+			if s.journal != nil {
+				s.journal.close()
+			}
+			s.notifications.Wait()
+			close(s.stop)
+			<-s.clicksDone
+			s.background.Wait()
+		}()
+	})
+	select {
+	case <-s.shutdownDone:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%v with %d follows still to be written", ctx.Err(), atomic.LoadInt64(&s.pendingFollows))
+	}
 }
 
 type smallifier struct {
+	// ctx is the context background database work is done with.
+	ctx         context.Context
 	base        url.URL
 	db          *sql.DB
-	secret      string
+	stmts       statements
 	lengthLimit int
 
-	follows        chan follow
+	// secrets holds the []string of secrets which are accepted, which may be replaced while requests are being served.
+	secrets           atomic.Value
+	additionalSecrets []string
+
+	maxRequestTimeout time.Duration
+	maxCreateBodySize int64
+	deterministicKey  []byte
+	// dedupe returns existing links to URLs which are shortened again, as if every CreateRequest set Dedupe.
+	dedupe          bool
+	vanityMinLength int
+	ipv6Prefix      int
+	// random is the source of the random bytes short paths are generated from.
+	random     io.Reader
+	randomness randomState
+	// paths tracks how full the space of generated short paths is.
+	paths pathSpace
+	clock Clock
+
+	hostCheck      bool
+	rejectBadHosts bool
+	allowedHosts   []string
+	// badHostCount is the number of requests for unexpected hosts since the last was warned of, at badHostWarnTS,
+	// in unix nanoseconds.
+	badHostCount  uint64
+	badHostWarnTS int64
+	// hsts is the value of the Strict-Transport-Security header, or "" to not send one.
+	hsts string
+
+	matrixToInterstitial bool
+	// dropFollowHeaders stops the User-Agent and Referer headers of follows being recorded.
+	dropFollowHeaders bool
+	// alwaysPreview shows every link's preview page rather than redirecting.
+	alwaysPreview bool
+	// wellKnownMatrix are the documents served under /.well-known/matrix/, by name.
+	wellKnownMatrix map[string]json.RawMessage
+	// adminGraphQL serves GraphQL queries under the admin API.
+	adminGraphQL bool
+	// statsShareKey signs links sharing links' stats, if WithStatsShareKey was given.
+	statsShareKey  []byte
+	geoIP          GeoIP
+	matrixNotifier *MatrixNotifier
+	// matrixBot shortens URLs sent to it in Matrix rooms, if WithMatrixBot was given.
+	matrixBot *MatrixBot
+	// rewriteRules holds a []RewriteRule, which may be replaced while links are being followed.
+	rewriteRules atomic.Value
+	// theme holds the *Theme HTML pages are rendered with, which may be replaced while they are being served.
+	theme atomic.Value
+	// destinationHosts holds the *DestinationHosts restricting where links may point, which may be replaced while links are being followed.
+	destinationHosts atomic.Value
+	// blockedDestinations holds the map[string]BlockedDestination of hosts redirects to which have been stopped through
+	// the admin API, by host, replaced under blockedDestinationsMu whenever it changes.
+	blockedDestinations   atomic.Value
+	blockedDestinationsMu sync.Mutex
+	// readOnly holds the ReadOnlyStatus, which is replaced when read-only mode is turned on or off.
+	readOnly atomic.Value
+	// maintenance holds the MaintenanceStatus, which is replaced when maintenance mode is turned on or off.
+	maintenance atomic.Value
+
+	allowedOrigins map[string]bool
+	requireNonces  bool
+	nonces         nonces
+	// idempotency remembers the responses to create requests with idempotency keys.
+	idempotency idempotencyKeys
+	// openCreation lets links be created without the secret or an API key.
+	openCreation bool
+	// allowedSchemes are the schemes, besides https, of URLs which may be linked to.
+	allowedSchemes map[string]bool
+	// intentKey signs intents, if they are enabled.
+	intentKey []byte
+	// namespaces are the namespaces links are counted in, by the host of their destinations, if set.
+	namespaces      Namespaces
+	namespaceNames  []string
+	namespaceCounts map[string]*namespaceCounts
+	// linkLimits caps how many links may be stored, if set.
+	linkLimits *linkLimits
+	// resolveClient follows the redirects of destinations, up to resolveMaxHops of them, if set.
+	resolveClient  *http.Client
+	resolveMaxHops int
+	// preconnectHints adds preconnect hints for destinations to redirects, also sent as 103 Early Hints if earlyHints is set.
+	preconnectHints bool
+	earlyHints      bool
+
+	// createLimiter limits how quickly each client may create links, if set.
+	createLimiter  *rateLimiter
+	trustedProxies []*net.IPNet
+	// lookupLimiter limits how many links which don't exist each client may look up, if set.
+	lookupLimiter *rateLimiter
+
+	// loadThresholds are the measures of load beyond which it is shed, if set.
+	loadThresholds *LoadThresholds
+	// lookupCache holds recently followed links, to be followed while shedding load, or always if cacheLookups is set.
+	lookupCache  *lookupCache
+	cacheLookups bool
+	// sheddingMu guards overloadedAt, when load last exceeded the thresholds.
+	sheddingMu   sync.Mutex
+	overloadedAt time.Time
+	// shedding is 1 while load is being shed.
+	shedding int32
+
+	// follows queues follows to be written to the database, holding at most followQueueSize of them.
+	follows         *followQueue
+	followQueueSize int
+	// smallFootprint shrinks the defaults of what is kept in memory.
+	smallFootprint bool
 	pendingFollows int64
+	// headFollowTS is the timestamp of the follow currently being written, or 0 if none is.
+	headFollowTS int64
+	// followsDone is closed once every follow has been written after follows is closed, or once ctx is done.
+	followsDone chan struct{}
+	// analytics is what is done with follows, and memoryFollows counts them if they are only counted in memory.
+	analytics     Analytics
+	memoryFollows memoryFollows
+	// journal records queued follows, so that they can be recovered if the process dies, if journalPath is set.
+	journalPath string
+	journal     *followJournal
+	// unjournaled queues follows to be appended to the journal before they are passed on to follows, and journalDone
+	// is closed once every one has been after unjournaled is closed.
+	unjournaled *followQueue
+	journalDone chan struct{}
+	// repeats are the recent follows which repeated follows are counted as, if WithRepeatWindow was given.
+	repeats repeats
+
+	// stop is closed to stop delivering click webhooks, and clicksDone is closed once the last have been delivered.
+	stop       chan struct{}
+	clicksDone chan struct{}
+
+	// feeds are polled every feedInterval for new entries to create links for, if WithFeeds was given.
+	feeds        []Feed
+	feedInterval time.Duration
+
+	// expiryDays is how old unfollowed links must be to be expired, or 0 if they aren't.
+	expiryDays int
+	// followRetentionDays is how old follows must be to be purged, and idleExpiryDays how long links must go without
+	// being followed to be expired, or 0 if they aren't.
+	followRetentionDays int
+	idleExpiryDays      int
+	// followArchiveDir is the directory follows are archived in before they are purged, if set.
+	followArchiveDir string
+	// digestSchedule, if set, is when digests of the preceding digestPeriod are sent to digestSenders.
+	digestSchedule *Schedule
+	digestPeriod   time.Duration
+	digestSenders  []DigestSender
+
+	// background counts goroutines, other than those writing follows and delivering click webhooks, which stop when stop is closed.
+	background sync.WaitGroup
+	// closed is set to 1 once Close or Shutdown has been called, and shutdownDone is closed once the work they wait for is
+	// finished. shutdownOnce starts it.
+	closed       int32
+	shutdownOnce sync.Once
+	shutdownDone chan struct{}
+
+	// notifications counts milestone notifications being sent.
+	notifications  sync.WaitGroup
+	matrixNotifyMu sync.Mutex
+
+	clicks          clickBatcher
+	webhookInterval time.Duration
+	webhookClient   *http.Client
+	// eventHooks are the webhooks given to WithEventWebhooks, each delivered to by its own goroutine.
+	eventHooks []*eventHook
+	// usageReporter is sent usage pings about the Smallifier, running version, unless it is a NopUsageReporter.
+	usageReporter UsageReporter
+	version       string
+
+	// logLevelMu guards logLevelRevert, the timer which will restore the log level, if one is pending.
+	logLevelMu     sync.Mutex
+	logLevelRevert *time.Timer
+
+	// registerer is what metrics are registered with, and requestDurations times each endpoint, if WithMetrics was given.
+	registerer       Registerer
+	requestDurations *prometheus.HistogramVec
+
+	createCount uint64
+	lookupCount uint64
+	followCount uint64
 
 	randomErrorCount   uint64
 	authErrorCount     uint64
 	dbUpdateErrorCount uint64
+	webhookErrorCount  uint64
+
+	lookupMissCount        uint64
+	rateLimitedLookupCount uint64
+
+	sheddingTransitionCount uint64
+	shedRequestCount        uint64
+
+	lookupCacheHitCount  uint64
+	lookupCacheMissCount uint64
+	droppedFollowCount   uint64
 }
 
 type follow struct {
-	shortPath    string
+	// seq numbers the follow in the journal, if there is one.
+	seq       uint64
+	shortPath string
+	// bundleItem is the position of the item followed within the bundle at shortPath, or 0 if a link or bundle page was followed.
+	bundleItem   int
 	timestamp    int64
 	ip           string
 	forwardedFor string
+	userAgent    string
+	// referer is the Referer header of the request, if WithoutFollowHeaders wasn't given.
+	referer string
 }
 
 // LookupHandler is an http.HandlerFunc which looks up a short link and either 302s to it, or 404s.
+// Lookups of links which don't exist count towards the client's lookup rate limit, if there is one.
+// HEAD requests get the same status and headers, without a body, and aren't counted as follows.
 func (s *smallifier) LookupHandler(w http.ResponseWriter, req *http.Request) {
 	setHeaders(w)
 
+	atomic.AddUint64(&s.lookupCount, 1)
+	if !s.checkLookupRateLimit(w, req) {
+		return
+	}
+	rec := &statusRecorder{ResponseWriter: w, status: 200}
+	s.lookup(rec, req)
+	if rec.status == 404 {
+		s.lookupMissed(req)
+	}
+}
+
+func (s *smallifier) lookup(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel, ok := s.requestContext(w, req)
+	if !ok {
+		return
+	}
+	defer cancel()
+
 	if !strings.HasPrefix(req.URL.Path, s.base.Path) {
 		w.WriteHeader(404)
 		return
 	}
-	shortPath := req.URL.Path[len(s.base.Path):]
-	row := s.db.QueryRow("SELECT long_url FROM links WHERE short_path = $1 AND deleted = 0", shortPath)
-	var link string
-	err := row.Scan(&link)
-	if err == nil {
-		w.Header().Set("Location", link)
-		w.WriteHeader(302)
+	shortPath := strings.TrimSuffix(req.URL.Path[len(s.base.Path):], previewSuffix)
+	linkPath := shortPath
+	if i := strings.IndexByte(shortPath, '/'); i >= 0 {
+		linkPath = shortPath[:i]
+	}
+	// Paths outside both the generated and vanity namespaces can be rejected without a database lookup.
+	if s.classifyPath(linkPath) == pathInvalid {
+		writeError(w, 404, ErrCodeNotFound, "link not found")
+		return
+	}
+	// While shedding load, links are only followed if they are cached, without touching the database.
+	if s.sheddingLoad() {
+		s.lookupCached(w, req, shortPath)
+		return
+	}
+	if s.geoIP != nil {
+		blocked, err := s.geoBlocked(ctx, req, linkPath)
+		if err != nil {
+			writeLookupError(w, err)
+			return
+		}
+		if blocked {
+			s.writeGeoBlocked(w)
+			return
+		}
+	}
+	if linkPath != shortPath {
+		s.followBundleItem(ctx, w, req, linkPath, shortPath[len(linkPath)+1:])
+		return
+	}
+	if c, ok := s.cachedLookup(shortPath); ok {
+		if s.destinationBlocked(c.link) {
+			s.writeDestinationBlocked(w, c.link)
+			return
+		}
+		if s.checkReferrer(w, req, shortPath, c.link, c.referrers) {
+			s.redirect(w, req, shortPath, 0, c.link, c.appLink)
+		}
+		return
+	}
+	generation := s.lookupGeneration(shortPath)
+	row := s.stmts.lookup.QueryRowContext(ctx, shortPath)
+	var link, appLink, referrerHosts string
+	var deleted, interstitial bool
+	if err := row.Scan(&link, &deleted, &appLink, &referrerHosts, &interstitial); err != nil {
+		writeLookupError(w, err)
+		return
+	}
+	if deleted {
+		writeGone(w)
+		return
+	}
+	if link == "" {
+		s.renderBundle(ctx, w, req, shortPath)
+		return
+	}
+	if s.destinationBlocked(link) {
+		s.writeDestinationBlocked(w, link)
+		return
+	}
+	referrers := parseReferrerPolicy(referrerHosts, interstitial)
+	s.cacheLookup(shortPath, generation, link, appLink, referrers)
+	if s.checkReferrer(w, req, shortPath, link, referrers) {
+		s.redirect(w, req, shortPath, 0, link, appLink)
+	}
+}
 
-		atomic.AddInt64(&s.pendingFollows, 1)
-		s.follows <- follow{
-			shortPath:    shortPath,
-			timestamp:    time.Now().Unix(),
-			ip:           req.RemoteAddr,
-			forwardedFor: req.Header.Get("X-Forwarded-For"),
+// redirect responds to a lookup of the link at shortPath, or the given item within the bundle at shortPath,
+// whose long URL is link, by redirecting to it.
+// Requests for its preview page are shown it instead, without counting as a follow.
+func (s *smallifier) redirect(w http.ResponseWriter, req *http.Request, shortPath string, bundleItem int, link, appLink string) {
+	// Preview pages show the path which was followed, which for a bundle item includes its position.
+	previewPath := shortPath
+	if bundleItem != 0 {
+		previewPath += "/" + strconv.Itoa(bundleItem)
+	}
+	if previewRequested(req) {
+		s.renderPreview(w, previewPath, s.rewrite(link))
+		return
+	}
+	s.countFollow(req, link)
+	link = s.rewrite(link)
+	if appLink != "" {
+		w.Header().Set("Vary", AppSchemesHeader+", User-Agent")
+		if clientOpens(req, appLink) {
+			link = appLink
 		}
+	}
+	// Check the destination which will be shown or redirected to, as it may have been rewritten or be an app link.
+	if s.destinationBlocked(link) {
+		s.writeDestinationBlocked(w, link)
+		return
+	}
+	s.hintPreconnect(w, link)
+	if m, ok := parseMatrixTo(link); ok && s.matrixToInterstitial {
+		if s.renderMatrixTo(w, link, m) == nil {
+			s.enqueueFollow(shortPath, bundleItem, req)
+		}
+		return
+	}
+	if s.alwaysPreview {
+		if s.renderPreview(w, previewPath, link) == nil {
+			s.enqueueFollow(shortPath, bundleItem, req)
+		}
+		return
+	}
+
+	w.Header().Set("Location", link)
+	w.WriteHeader(302)
+	s.enqueueFollow(shortPath, bundleItem, req)
+}
+
+// redirectTo redirects to link, unless its host is blocked, returning whether it did.
+// Destinations are checked again as they are redirected to, as they may have been rewritten since they were looked up.
+func (s *smallifier) redirectTo(w http.ResponseWriter, link string) bool {
+	if s.destinationBlocked(link) {
+		s.writeDestinationBlocked(w, link)
+		return false
+	}
+	s.hintPreconnect(w, link)
+	w.Header().Set("Location", link)
+	w.WriteHeader(302)
+	return true
+}
 
+// checksOnly returns whether req only checks that a link exists, as link checkers' HEAD requests do, so isn't a follow.
+func checksOnly(req *http.Request) bool {
+	return req.Method == "HEAD"
+}
+
+// enqueueFollow queues a record of req following shortPath, or the given item within the bundle at shortPath,
+// to be written to the database. Requests which only check the link aren't recorded.
+func (s *smallifier) enqueueFollow(shortPath string, bundleItem int, req *http.Request) {
+	if checksOnly(req) {
 		return
 	}
-	if err == sql.ErrNoRows {
-		w.WriteHeader(404)
-		io.WriteString(w, `{"error": "link not found"}`)
+	if s.sheddingLoad() {
+		atomic.AddUint64(&s.shedRequestCount, 1)
 		return
 	}
-	log.Error("Unknown DB error: ", err)
-	w.WriteHeader(500)
-	io.WriteString(w, `{"error": "internal server error"}`)
+	f := follow{
+		shortPath:    shortPath,
+		bundleItem:   bundleItem,
+		timestamp:    s.clock.Now().Unix(),
+		ip:           remoteIP(req),
+		forwardedFor: req.Header.Get("X-Forwarded-For"),
+		userAgent:    req.UserAgent(),
+	}
+	if !s.dropFollowHeaders {
+		f.referer = req.Referer()
+	}
+	switch s.analytics {
+	case AnalyticsOff:
+		return
+	case AnalyticsMemory:
+		s.memoryFollows.record(f.shortPath, f.timestamp)
+		return
+	}
+	// Following a link mustn't wait for the database, or for the journal to be written, so follows are dropped rather
+	// than waiting for room in the queue.
+	queue := s.follows
+	if s.journal != nil {
+		queue = s.unjournaled
+	}
+	atomic.AddInt64(&s.pendingFollows, 1)
+	if !queue.push(f) {
+		atomic.AddInt64(&s.pendingFollows, -1)
+		atomic.AddUint64(&s.droppedFollowCount, 1)
+	}
+}
+
+// writeLookupError responds to a request for a link which could not be looked up because of err.
+func writeLookupError(w http.ResponseWriter, err error) {
+	writeErr(w, lookupError(err))
+}
+
+// writeGone responds to a lookup of a link which has been deleted.
+func writeGone(w http.ResponseWriter) {
+	writeError(w, 410, ErrCodeGone, "link deleted")
 }
 
 // CreateHandler is an http.HandlerFunc which creates a shortlink as a JSON-encoded CreateRequest in the request body and returns it as a JSON-encoded Response.
+// Requests retried with the same IdempotencyKeyHeader get the response to the first which succeeded.
 func (s *smallifier) CreateHandler(w http.ResponseWriter, req *http.Request) {
 	setHeaders(w)
+	if !s.checkMethod(w, req, "POST") {
+		return
+	}
+
+	ctx, cancel, ok := s.requestContext(w, req)
+	if !ok {
+		return
+	}
+	defer cancel()
+
+	if !s.refuseWhileShedding(w) || !s.checkCreateRateLimit(w, req) {
+		return
+	}
 
 	defer req.Body.Close()
-	dec := json.NewDecoder(req.Body)
+	dec := json.NewDecoder(http.MaxBytesReader(w, req.Body, s.maxCreateBodySize))
 	var jsonReq CreateRequest
 	if err := dec.Decode(&jsonReq); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			log.WithField("limit", tooLarge.Limit).Warn("Refusing create request with too large a body")
+			writeError(w, 413, ErrCodeTooLarge, fmt.Sprintf("request body must be at most %d bytes", tooLarge.Limit))
+			return
+		}
 		log.Error("Got bad json: ", err)
-		w.WriteHeader(400)
-		io.WriteString(w, `{"error": "error decoding json"}`)
+		writeError(w, 400, ErrCodeNotJSON, "error decoding json")
 		return
 	}
 
-	if jsonReq.Secret != s.secret {
-		atomic.AddUint64(&s.authErrorCount, 1)
-		log.WithField("bad_secret", jsonReq.Secret).Error("Refusing to linkify with wrong secret")
-		w.WriteHeader(401)
-		io.WriteString(w, `{"error": "Must specify correct secret"}`)
+	if !s.checkBrowserRequest(w, req, jsonReq.Nonce) {
 		return
 	}
 
-	if s.lengthLimit > 0 && len(jsonReq.LongURL) > s.lengthLimit {
-		log.WithField("url", jsonReq.LongURL).Error("Refusing to linkify long link")
-		w.WriteHeader(400)
-		io.WriteString(w, fmt.Sprintf(`{"error": "Links must be shorted than %d bytes"}`, s.lengthLimit))
+	resp, err := s.createIdempotently(ctx, req, jsonReq, func() (Response, error) {
+		return s.shorten(ctx, jsonReq, remoteIP(req), req.Header.Get("X-Forwarded-For"), false)
+	})
+	if err != nil {
+		writeErr(w, err)
 		return
 	}
+	json.NewEncoder(w).Encode(resp)
+}
 
-	if !strings.HasPrefix(jsonReq.LongURL, "https://") {
-		log.WithField("url", jsonReq.LongURL).Error("Refusing to linkify non-https link")
-		w.WriteHeader(400)
-		io.WriteString(w, `{"error": "Links must start with https://"}`)
-		return
+// shorten creates a link as r asks, for a client at ip, behind proxies which set X-Forwarded-For to forwardedFor.
+// r is authenticated by its secret unless trusted is set. Errors are *ErrorResponses.
+func (s *smallifier) shorten(ctx context.Context, r CreateRequest, ip, forwardedFor string, trusted bool) (Response, error) {
+	owner, ok, err := s.authenticateCreator(ctx, r.Secret)
+	if err != nil {
+		return Response{}, lookupError(err)
+	}
+	// Trusted callers needn't give a secret, but may give an API key to own the link.
+	trusted = trusted && (ok || r.Secret == "")
+	anonymous := !ok && !trusted && r.Secret == "" && s.openCreation
+	if !ok && !anonymous && !trusted {
+		atomic.AddUint64(&s.authErrorCount, 1)
+		log.WithField("bad_secret", r.Secret).Error("Refusing to linkify with wrong secret")
+		return Response{}, newErrorResponse(401, ErrCodeUnauthorized, "Must specify correct secret")
+	}
+	// Webhooks are refused so that anonymous creators can't have the server make requests wherever they like.
+	if anonymous && (r.ClickWebhookURL != "" || r.Notify != nil) {
+		return Response{}, newErrorResponse(403, ErrCodeForbidden, "Must specify a secret to register webhooks or notifications")
+	}
+
+	if err := s.destinationError(ctx, r.LongURL, anonymous); err != nil {
+		return Response{}, newErrorResponse(400, ErrCodeInvalidParam, err.Error())
+	}
+
+	if err := checkTags(r.Tags); err != nil {
+		return Response{}, newErrorResponse(400, ErrCodeInvalidParam, err.Error())
+	}
+
+	if r.AppLink != "" {
+		if err := checkAppLink(r.LongURL, r.AppLink); err != nil {
+			return Response{}, newErrorResponse(400, ErrCodeInvalidParam, err.Error())
+		}
+	}
+
+	if r.Notify != nil {
+		if err := s.checkNotifyRequest(r.Notify); err != nil {
+			return Response{}, newErrorResponse(400, ErrCodeInvalidParam, err.Error())
+		}
+	}
+
+	if r.Referrers != nil {
+		if err := checkReferrerPolicy(r.Referrers); err != nil {
+			return Response{}, newErrorResponse(400, ErrCodeInvalidParam, err.Error())
+		}
+	}
+
+	if r.ShortPath != "" {
+		if err := s.checkVanityPath(r.ShortPath); err != nil {
+			return Response{}, newErrorResponse(400, ErrCodeInvalidParam, err.Error())
+		}
+	}
+
+	if r.ClickWebhookURL != "" && !strings.HasPrefix(r.ClickWebhookURL, "https://") {
+		log.WithField("url", r.ClickWebhookURL).Error("Refusing non-https click webhook")
+		return Response{}, newErrorResponse(400, ErrCodeInvalidParam, "Click webhooks must start with https://")
+	}
+
+	if err := s.checkWritable(); err != nil {
+		return Response{}, err
+	}
+	if err := s.checkLinkLimits(r.LongURL); err != nil {
+		return Response{}, err
+	}
+
+	var id string
+	created := true
+	if r.ShortPath != "" {
+		id = r.ShortPath
+		err = s.addVanityLink(ctx, id, r.LongURL, ip, forwardedFor)
+	} else if s.deterministicKey != nil {
+		id, created, err = s.deterministicShortPath(ctx, r.LongURL, ip, forwardedFor)
+	} else if s.dedupe || r.Dedupe {
+		id, created, err = s.dedupedShortPath(ctx, r.LongURL, ip, forwardedFor)
+	} else {
+		id, err = s.generateShortPath(ctx, r.LongURL, ip, forwardedFor)
+	}
+	if e := contextError(err); e != nil {
+		return Response{}, e
+	}
+	if _, ok := err.(transientError); ok {
+		return Response{}, transientErrorResponse("could not store link")
+	}
+	if err == errPathTaken {
+		return Response{}, newErrorResponse(409, ErrCodeInUse, "Short path is already in use")
+	}
+	if err != nil {
+		return Response{}, newErrorResponse(500, ErrCodeUnknown, err.Error())
+	}
+	if !created && r.ClickWebhookURL != "" {
+		return Response{}, newErrorResponse(409, ErrCodeInUse, "Link already exists; click webhooks can only be registered on new links")
+	}
+	if !created && r.AppLink != "" {
+		return Response{}, newErrorResponse(409, ErrCodeInUse, "Link already exists; app links can only be given for new links")
+	}
+	if !created && r.Notify != nil {
+		return Response{}, newErrorResponse(409, ErrCodeInUse, "Link already exists; notifications can only be requested for new links")
+	}
+	if !created && r.Referrers != nil {
+		return Response{}, newErrorResponse(409, ErrCodeInUse, "Link already exists; referrer policies can only be given for new links")
+	}
+
+	if created && owner != "" {
+		if err := s.setOwner(ctx, id, owner); err != nil {
+			log.WithFields(log.Fields{
+				"err":        err,
+				"short_path": id,
+			}).Error("Error recording owner of link")
+			if err := s.discardLink(id); err != nil {
+				log.WithField("err", err).Error("Error deleting link without its owner")
+				atomic.AddUint64(&s.dbUpdateErrorCount, 1)
+			}
+			return Response{}, newErrorResponse(500, ErrCodeUnknown, "error recording owner")
+		}
+	}
+
+	if err := s.addTags(ctx, id, r.Tags); err != nil {
+		log.WithFields(log.Fields{
+			"err":        err,
+			"short_path": id,
+		}).Error("Error tagging link")
+		atomic.AddUint64(&s.dbUpdateErrorCount, 1)
+	}
+
+	if r.AppLink != "" {
+		if err := s.addAppLink(ctx, id, r.AppLink); err != nil {
+			log.WithFields(log.Fields{
+				"err":        err,
+				"short_path": id,
+			}).Error("Error saving app link")
+			if err := s.discardLink(id); err != nil {
+				log.WithField("err", err).Error("Error deleting link without its app link")
+				atomic.AddUint64(&s.dbUpdateErrorCount, 1)
+			}
+			return Response{}, newErrorResponse(500, ErrCodeUnknown, "error saving app link")
+		}
+	}
+
+	if r.Referrers != nil {
+		if err := s.addReferrerPolicy(ctx, id, r.Referrers); err != nil {
+			log.WithFields(log.Fields{
+				"err":        err,
+				"short_path": id,
+			}).Error("Error saving referrer policy")
+			if err := s.discardLink(id); err != nil {
+				log.WithField("err", err).Error("Error deleting link without its referrer policy")
+				atomic.AddUint64(&s.dbUpdateErrorCount, 1)
+			}
+			return Response{}, newErrorResponse(500, ErrCodeUnknown, "error saving referrer policy")
+		}
+	}
+
+	var resp Response
+	if err := s.describeLink(ctx, id, &resp); err != nil {
+		return Response{}, lookupError(err)
+	}
+	if created {
+		if resp.EditToken, err = s.addEditToken(ctx, id); err != nil {
+			log.WithFields(log.Fields{
+				"err":        err,
+				"short_path": id,
+			}).Error("Error saving edit token")
+			atomic.AddUint64(&s.dbUpdateErrorCount, 1)
+			resp.EditToken = ""
+		}
+	}
+	if r.Title != "" {
+		resp.Snippets = newSnippets(resp.ShortURL, r.Title)
+	}
+	if r.ClickWebhookURL != "" {
+		if resp.ClickWebhookSecret, err = s.addClickWebhook(ctx, id, r.ClickWebhookURL); err != nil {
+			log.WithFields(log.Fields{
+				"err":        err,
+				"short_path": id,
+			}).Error("Error registering click webhook")
+			if err := s.discardLink(id); err != nil {
+				log.WithField("err", err).Error("Error deleting link without its click webhook")
+				atomic.AddUint64(&s.dbUpdateErrorCount, 1)
+			}
+			return Response{}, newErrorResponse(500, ErrCodeUnknown, "error registering click webhook")
+		}
+	}
+	if r.Notify != nil {
+		if resp.NotifyWebhookSecret, err = s.addNotifications(ctx, id, r.Notify); err != nil {
+			log.WithFields(log.Fields{
+				"err":        err,
+				"short_path": id,
+			}).Error("Error registering notifications")
+			if err := s.discardLink(id); err != nil {
+				log.WithField("err", err).Error("Error deleting link without its notifications")
+				atomic.AddUint64(&s.dbUpdateErrorCount, 1)
+			}
+			return Response{}, newErrorResponse(500, ErrCodeUnknown, "error registering notifications")
+		}
 	}
 
-	id, err := s.generateShortPath(jsonReq.LongURL, req.RemoteAddr, req.Header.Get("X-Forwarded-For"))
+	s.countCreate(r.LongURL)
+	if created {
+		s.linkCreated(id, r.LongURL)
+	}
+	return resp, nil
+}
+
+// checkLongURL reports whether link may be shortened, following its redirects if WithRedirectResolution was given
+// and the creator isn't anonymous. If it may not, it writes an error response explaining why.
+func (s *smallifier) checkLongURL(ctx context.Context, w http.ResponseWriter, link string, anonymous bool) bool {
+	if err := s.destinationError(ctx, link, anonymous); err != nil {
+		writeError(w, 400, ErrCodeInvalidParam, err.Error())
+		return false
+	}
+	return true
+}
+
+// destinationError returns an error explaining why link may not be the destination of a link, including because of
+// where it redirects to, or nil if it may. Redirects aren't followed for anonymous creators, so that they can't have
+// the server probe addresses only it can reach, such as those on its own network, and learn from the errors.
+func (s *smallifier) destinationError(ctx context.Context, link string, anonymous bool) error {
+	err := s.longURLError(link)
+	if err == nil && !anonymous {
+		err = s.redirectError(ctx, link)
+	}
 	if err != nil {
-		w.WriteHeader(500)
-		io.WriteString(w, err.Error())
-		return
+		log.WithFields(log.Fields{
+			"err": err,
+			"url": link,
+		}).Error("Refusing to linkify link")
 	}
+	return err
+}
 
-	enc := json.NewEncoder(w)
-	enc.Encode(Response{s.base.String() + id})
+// longURLError returns an error explaining why link may not be the destination of a link, or nil if it may.
+func (s *smallifier) longURLError(link string) error {
+	if s.lengthLimit > 0 && len(link) > s.lengthLimit {
+		return fmt.Errorf("Links must be shorted than %d bytes", s.lengthLimit)
+	}
+	if err := s.checkScheme(link); err != nil {
+		return err
+	}
+	if err := s.checkDestinationHost(link); err != nil {
+		return err
+	}
+	if s.selfReference(link) {
+		return errSelfReference
+	}
+	return checkFaithful(link)
 }
 
 // DeleteHandler is an http.HandlerFunc which prevents a shortlink (passed in a JSON-encoded DeleteRequest) from being used.
+// Lookups of the link then respond 410 Gone.
 func (s *smallifier) DeleteHandler(w http.ResponseWriter, req *http.Request) {
 	setHeaders(w)
+	if !s.checkMethod(w, req, "POST") {
+		return
+	}
+
+	ctx, cancel, ok := s.requestContext(w, req)
+	if !ok {
+		return
+	}
+	defer cancel()
 
 	defer req.Body.Close()
 	dec := json.NewDecoder(req.Body)
 	var jsonReq DeleteRequest
 	if err := dec.Decode(&jsonReq); err != nil {
 		log.Error("Got bad json: ", err)
-		w.WriteHeader(400)
-		io.WriteString(w, `{"error": "error decoding json"}`)
+		writeError(w, 400, ErrCodeNotJSON, "error decoding json")
 		return
 	}
 
-	if jsonReq.Secret != s.secret {
-		atomic.AddUint64(&s.authErrorCount, 1)
-		log.WithField("bad_secret", jsonReq.Secret).Error("Refusing to delete link with wrong secret")
-		w.WriteHeader(401)
-		io.WriteString(w, `{"error": "Must specify correct secret"}`)
+	shortPath := jsonReq.ShortPath
+	if shortPath == "" {
+		if !strings.HasPrefix(jsonReq.ShortURL, s.base.String()) {
+			writeError(w, 404, ErrCodeNotFound, "deleting unknown link")
+			return
+		}
+		shortPath = jsonReq.ShortURL[len(s.base.String()):]
+	}
+
+	if !s.authorizeChange(ctx, w, shortPath, jsonReq.Secret, jsonReq.EditToken) {
 		return
 	}
+	s.deleteLink(ctx, w, shortPath)
+}
 
-	if !strings.HasPrefix(jsonReq.ShortURL, s.base.String()) {
-		w.WriteHeader(404)
-		io.WriteString(w, `{"error": "deleting unknown link"}`)
+// deleteLink marks the link at shortPath deleted, and responds to the request to delete it.
+func (s *smallifier) deleteLink(ctx context.Context, w http.ResponseWriter, shortPath string) {
+	if err := s.checkWritable(); err != nil {
+		writeErr(w, err)
+		return
+	}
+	if err := s.delete(ctx, shortPath); err != nil {
+		writeErr(w, err)
 		return
 	}
+	io.WriteString(w, `{}`)
+}
 
-	shortPath := jsonReq.ShortURL[len(s.base.String()):]
-	r, err := s.db.Exec("UPDATE links SET deleted = 1 WHERE short_path = $1", shortPath)
+// delete marks the link at shortPath deleted. Errors are *ErrorResponses.
+func (s *smallifier) delete(ctx context.Context, shortPath string) error {
+	r, err := s.db.ExecContext(ctx, "UPDATE links SET deleted = 1 WHERE short_path = $1", shortPath)
+	if e := contextError(err); e != nil {
+		return e
+	}
 	if err != nil {
 		log.WithField("error", err).Error("Error deleting link")
-		w.WriteHeader(400)
-		io.WriteString(w, `{"error": "error deleting link"}`)
-		return
+		return newErrorResponse(400, ErrCodeInvalidParam, "error deleting link")
 	}
 	if ra, _ := r.RowsAffected(); ra == 0 {
 		log.WithField("short_path", shortPath).Error("Didn't find link being deleted")
-		w.WriteHeader(404)
-		io.WriteString(w, `{"error": "deleting unknown link"}`)
-		return
+		return newErrorResponse(404, ErrCodeNotFound, "deleting unknown link")
 	}
-	io.WriteString(w, `{}`)
+	s.forgetLookup(shortPath)
+	return nil
+}
+
+// discardLink marks the link at shortPath deleted, after failing to save something which belongs with it.
+// It is done with s.ctx rather than the request's context, so that the link isn't left behind if the client went away.
+func (s *smallifier) discardLink(shortPath string) error {
+	ctx, cancel := context.WithTimeout(s.ctx, time.Minute)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, "UPDATE links SET deleted = 1 WHERE short_path = $1", shortPath)
+	return err
 }
 
 // RandomErrors gets a count of the number of times that we were unable to generate a random number.
@@ -247,24 +1227,90 @@ func (s *smallifier) DBUpdateErrors() float64 {
 	return float64(atomic.LoadUint64(&s.dbUpdateErrorCount))
 }
 
-func (s *smallifier) generateShortPath(link, ip, forwardedFor string) (string, error) {
-	for i := 0; i < 30; i++ {
-		buf := make([]byte, 6)
-		if _, err := rand.Read(buf); err != nil {
-			atomic.AddUint64(&s.randomErrorCount, 1)
-			log.Fatal("Could not generate random numbers", err)
-			return "", fmt.Errorf(`{"error": "random error"}`)
+// WebhookErrors gets a count of webhook deliveries which failed.
+func (s *smallifier) WebhookErrors() float64 {
+	return float64(atomic.LoadUint64(&s.webhookErrorCount))
+}
+
+// LookupMisses gets a count of lookups of links which don't exist.
+func (s *smallifier) LookupMisses() float64 {
+	return float64(atomic.LoadUint64(&s.lookupMissCount))
+}
+
+// RateLimitedLookups gets a count of lookups refused by the lookup rate limit.
+func (s *smallifier) RateLimitedLookups() float64 {
+	return float64(atomic.LoadUint64(&s.rateLimitedLookupCount))
+}
+
+func (s *smallifier) generateShortPath(ctx context.Context, link, ip, forwardedFor string) (string, error) {
+	var lastErr error
+	// collisions counts the attempts in a row which collided with existing links at the current length.
+	collisions := 0
+	for failures := 0; failures < 30; {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+
+		n := s.paths.length()
+		buf := make([]byte, n)
+		if err := s.readRandom(ctx, buf); err != nil {
+			if err == ctx.Err() {
+				return "", err
+			}
+			return "", transientError{fmt.Errorf("random error: %v", err)}
 		}
 
 		shortPath := base64.RawURLEncoding.EncodeToString(buf)
 
-		_, err := s.db.Exec("INSERT INTO links (short_path, long_url, create_ts, create_ip, create_forwarded_for) VALUES ($1, $2, $3, $4, $5)", shortPath, link, time.Now().Unix(), ip, forwardedFor)
+		_, err := s.db.ExecContext(ctx, "INSERT INTO links (short_path, long_url, normalized_url, create_ts, create_ip, create_forwarded_for) VALUES ($1, $2, $3, $4, $5, $6)", shortPath, link, normalizedURL(link), s.clock.Now().Unix(), ip, forwardedFor)
 		if err == nil {
+			s.pathGenerated(n, false)
 			return shortPath, nil
 		}
+		if isUniqueViolation(err) {
+			s.pathGenerated(n, true)
+			// Rather than giving up as the space of paths fills, make them longer.
+			if n < maxMachinePathBytes {
+				if collisions++; collisions >= consecutiveCollisionLimit {
+					s.growPaths(n, "Generated short paths keep colliding, growing them", log.Fields{"bytes": n})
+					collisions = 0
+				}
+				continue
+			}
+		}
 		log.WithField("error", err).Error("Error saving link")
+		lastErr = err
+		failures++
+	}
+	return "", databaseError(lastErr)
+}
+
+// requestContext derives the context for handling req, applying any deadline requested with TimeoutHeader.
+// If the header is malformed, it writes an error response and returns ok == false.
+func (s *smallifier) requestContext(w http.ResponseWriter, req *http.Request) (ctx context.Context, cancel context.CancelFunc, ok bool) {
+	h := req.Header.Get(TimeoutHeader)
+	if h == "" || s.maxRequestTimeout <= 0 {
+		ctx, cancel = context.WithCancel(req.Context())
+		return ctx, cancel, true
+	}
+	ms, err := strconv.ParseInt(h, 10, 64)
+	if err != nil || ms <= 0 {
+		log.WithField("timeout", h).Error("Got bad timeout header")
+		writeError(w, 400, ErrCodeInvalidParam, TimeoutHeader+" must be a positive integer")
+		return nil, nil, false
 	}
-	return "", fmt.Errorf(`{"error": "could not generate link"}`)
+	// Capping ms before converting it stops a huge value overflowing into a negative, or short, timeout.
+	timeout := s.maxRequestTimeout
+	if ms < int64(s.maxRequestTimeout/time.Millisecond) {
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+	ctx, cancel = context.WithTimeout(req.Context(), timeout)
+	return ctx, cancel, true
+}
+
+// writeTimeout responds to a request whose deadline passed before it could be handled.
+func writeTimeout(w http.ResponseWriter) {
+	writeErr(w, timeoutError())
 }
 
 // setHeaders sets the "Content-Type" to "application/json" and sets CORS
@@ -273,10 +1319,100 @@ func setHeaders(w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept")
+	w.Header().Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept, Authorization, "+TimeoutHeader+", "+IdempotencyKeyHeader)
+}
+
+// preflightMaxAge is how long browsers may cache the answers to CORS preflight requests.
+const preflightMaxAge = 10 * time.Minute
+
+// checkMethod reports whether req may be handled by a handler which only accepts method. Otherwise, it answers req
+// itself: CORS preflight OPTIONS requests from allowed origins with 204 No Content, and other methods with
+// 405 Method Not Allowed, each with an Allow header.
+func (s *smallifier) checkMethod(w http.ResponseWriter, req *http.Request, method string) bool {
+	if req.Method == method {
+		return true
+	}
+	allow := method + ", OPTIONS"
+	w.Header().Set("Allow", allow)
+	if req.Method != "OPTIONS" {
+		writeError(w, 405, ErrCodeUnrecognized, "Must "+method)
+		return false
+	}
+	if !s.checkOrigin(w, req) {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Methods", allow)
+	w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(preflightMaxAge/time.Second)))
+	w.WriteHeader(204)
+	return false
+}
+
+// addColumnIfMissing adds a column to table, which was created without it by an older version, using the given declaration.
+func addColumnIfMissing(db *sql.DB, table, column, decl string) error {
+	columns, err := tableColumns(db, table)
+	if err != nil {
+		return err
+	}
+	if columns[column] {
+		return nil
+	}
+	_, err = db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + decl)
+	return err
+}
+
+// followsTable is the definition of the follows table, formatted with the table's name.
+// Follows of a link are deleted with it; foreign key enforcement must be enabled on each connection
+// with "PRAGMA foreign_keys = ON" for this to happen.
+const followsTable = `CREATE TABLE IF NOT EXISTS %s(
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	short_path TEXT NOT NULL REFERENCES links(short_path) ON DELETE CASCADE,
+	ts BIGINT NOT NULL,
+	ip TEXT NOT NULL,
+	forwarded_for TEXT,
+	client_key TEXT,
+	bundle_item INTEGER,
+	repeat_count INTEGER NOT NULL DEFAULT 0,
+	user_agent TEXT,
+	referer TEXT
+)`
+
+// addFollowsForeignKey rebuilds a follows table created by an older version without a foreign key to links.
+// Follows of bundle items, which older versions recorded against "<short path>/<position>", are moved to the bundle's
+// short path and bundle_item. Follows of links which no longer exist are discarded.
+func addFollowsForeignKey(db *sql.DB) error {
+	hasForeignKey, err := hasRows(db, `PRAGMA foreign_key_list(follows)`)
+	if err != nil {
+		return err
+	}
+	if hasForeignKey {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, stmt := range []string{
+		`UPDATE follows SET bundle_item = CAST(substr(short_path, instr(short_path, '/') + 1) AS INTEGER),
+			short_path = substr(short_path, 1, instr(short_path, '/') - 1)
+			WHERE instr(short_path, '/') > 0`,
+		fmt.Sprintf(followsTable, "follows_new"),
+		`INSERT INTO follows_new (id, short_path, ts, ip, forwarded_for, client_key, bundle_item, repeat_count, user_agent, referer)
+			SELECT id, short_path, ts, ip, forwarded_for, client_key, bundle_item, repeat_count, user_agent, referer FROM follows
+			WHERE short_path IN (SELECT short_path FROM links)`,
+		`DROP TABLE follows`,
+		`ALTER TABLE follows_new RENAME TO follows`,
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
-// CreateTables creates the necessary database tables in db if they are absent.
+// CreateTables creates the necessary database tables in db if they are absent,
+// migrating tables created by older versions to the current SchemaVersion.
 func CreateTables(db *sql.DB) error {
 	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS links(
 		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
@@ -285,28 +1421,319 @@ func CreateTables(db *sql.DB) error {
 		create_ts BIGINT NOT NULL,
 		create_ip TEXT NOT NULL,
 		create_forwarded_for TEXT,
-		deleted INTEGER DEFAULT 0
+		deleted INTEGER DEFAULT 0,
+		pinned INTEGER NOT NULL DEFAULT 0,
+		edit_token_hash TEXT,
+		owner TEXT,
+		normalized_url TEXT
 	)`)
 	if err != nil {
 		return err
 	}
+	if err := addColumnIfMissing(db, "links", "pinned", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "links", "edit_token_hash", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "links", "owner", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "links", "normalized_url", "TEXT"); err != nil {
+		return err
+	}
+	if err := backfillNormalizedURLs(db); err != nil {
+		return err
+	}
 
 	_, err = db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS links_short_path on links(short_path)`)
 	if err != nil {
 		return err
 	}
 
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS links_normalized_url on links(normalized_url)`)
+	if err != nil {
+		return err
+	}
+
 	_, err = db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS links_short_path_deleted on links(short_path, deleted)`)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS follows(
+	_, err = db.Exec(fmt.Sprintf(followsTable, "follows"))
+	if err != nil {
+		return err
+	}
+
+	if err := addColumnIfMissing(db, "follows", "client_key", "TEXT"); err != nil {
+		return err
+	}
+
+	if err := addColumnIfMissing(db, "follows", "bundle_item", "INTEGER"); err != nil {
+		return err
+	}
+
+	if err := addColumnIfMissing(db, "follows", "repeat_count", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+
+	if err := addColumnIfMissing(db, "follows", "user_agent", "TEXT"); err != nil {
+		return err
+	}
+
+	if err := addColumnIfMissing(db, "follows", "referer", "TEXT"); err != nil {
+		return err
+	}
+
+	if err := addFollowsForeignKey(db); err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS follows_short_path_ts on follows(short_path, ts)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS follow_errors(
 		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
 		short_path TEXT NOT NULL,
 		ts BIGINT NOT NULL,
 		ip TEXT NOT NULL,
-		forwarded_for TEXT
+		forwarded_for TEXT,
+		error TEXT NOT NULL,
+		bundle_item INTEGER,
+		user_agent TEXT,
+		referer TEXT
+	)`)
+	if err != nil {
+		return err
+	}
+
+	if err := addColumnIfMissing(db, "follow_errors", "bundle_item", "INTEGER"); err != nil {
+		return err
+	}
+
+	if err := addColumnIfMissing(db, "follow_errors", "user_agent", "TEXT"); err != nil {
+		return err
+	}
+
+	if err := addColumnIfMissing(db, "follow_errors", "referer", "TEXT"); err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS click_webhooks(
+		short_path TEXT NOT NULL PRIMARY KEY,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS bundles(
+		short_path TEXT NOT NULL PRIMARY KEY,
+		title TEXT NOT NULL
 	)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS bundle_items(
+		short_path TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		title TEXT NOT NULL,
+		url TEXT NOT NULL,
+		PRIMARY KEY (short_path, position)
+	)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS link_tags(
+		short_path TEXT NOT NULL,
+		tag TEXT NOT NULL,
+		PRIMARY KEY (short_path, tag)
+	)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS link_tags_tag on link_tags(tag)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS app_links(
+		short_path TEXT NOT NULL PRIMARY KEY REFERENCES links(short_path) ON DELETE CASCADE,
+		app_link TEXT NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS audit_log(
+		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		ts BIGINT NOT NULL,
+		action TEXT NOT NULL,
+		short_path TEXT NOT NULL,
+		old_value TEXT NOT NULL,
+		new_value TEXT NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS audit_log_short_path on audit_log(short_path)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS read_tokens(
+		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		token_hash TEXT NOT NULL UNIQUE,
+		description TEXT NOT NULL,
+		create_ts BIGINT NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS read_token_tags(
+		token_id INTEGER NOT NULL REFERENCES read_tokens(id) ON DELETE CASCADE,
+		tag TEXT NOT NULL,
+		PRIMARY KEY (token_id, tag)
+	)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS geo_blocks(
+		scope_kind TEXT NOT NULL,
+		scope TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (scope_kind, scope, kind, value)
+	)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS link_notifications(
+		short_path TEXT NOT NULL PRIMARY KEY REFERENCES links(short_path) ON DELETE CASCADE,
+		webhook_url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		matrix_user_id TEXT NOT NULL,
+		matrix_room_id TEXT NOT NULL DEFAULT '',
+		milestones TEXT NOT NULL,
+		notified BIGINT NOT NULL DEFAULT 0,
+		follows BIGINT NOT NULL DEFAULT 0
+	)`)
+	if err != nil {
+		return err
+	}
+
+	// Follows of links with notifications are counted as they are recorded, rather than counting them all each time,
+	// starting from those recorded before older versions had the column.
+	notificationColumns, err := tableColumns(db, "link_notifications")
+	if err != nil {
+		return err
+	}
+	if !notificationColumns["follows"] {
+		if err := addColumnIfMissing(db, "link_notifications", "follows", "BIGINT NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+		_, err = db.Exec(`UPDATE link_notifications SET follows = (SELECT COUNT(*) FROM follows WHERE follows.short_path = link_notifications.short_path)`)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS scheduled_updates(
+		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		short_path TEXT NOT NULL REFERENCES links(short_path) ON DELETE CASCADE,
+		long_url TEXT NOT NULL,
+		apply_ts BIGINT NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS scheduled_updates_apply_ts on scheduled_updates(apply_ts)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS feeds(
+		url TEXT NOT NULL PRIMARY KEY,
+		first_poll_ts BIGINT NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	// Entries aren't removed with their links, so that deleting a link doesn't get it recreated.
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS feed_entries(
+		feed_url TEXT NOT NULL REFERENCES feeds(url) ON DELETE CASCADE,
+		entry_id TEXT NOT NULL,
+		short_path TEXT NOT NULL,
+		PRIMARY KEY (feed_url, entry_id)
+	)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS link_annotations(
+		short_path TEXT NOT NULL,
+		key TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (short_path, key)
+	)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS link_annotations_key_value on link_annotations(key, value)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS api_keys(
+		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		key_hash TEXT NOT NULL UNIQUE,
+		create_ts BIGINT NOT NULL,
+		revoked_ts BIGINT
+	)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS blocked_destinations(
+		host TEXT NOT NULL PRIMARY KEY,
+		reason TEXT NOT NULL,
+		create_ts BIGINT NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS link_referrers(
+		short_path TEXT NOT NULL PRIMARY KEY REFERENCES links(short_path) ON DELETE CASCADE,
+		hosts TEXT NOT NULL,
+		interstitial INTEGER NOT NULL DEFAULT 0
+	)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS path_space(
+		bytes INTEGER NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, SchemaVersion))
 	return err
 }
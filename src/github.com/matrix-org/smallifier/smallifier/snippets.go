@@ -0,0 +1,41 @@
+package smallifier
+
+import (
+	"html"
+	"strings"
+)
+
+// Snippets holds ready-to-paste representations of a short link.
+type Snippets struct {
+	// Markdown is a Markdown inline link, e.g. [title](short_url).
+	Markdown string `json:"markdown"`
+	// HTML is an HTML anchor element.
+	HTML string `json:"html"`
+	// Matrix is the content of an m.room.message event linking to the short link.
+	Matrix MatrixMessage `json:"matrix"`
+}
+
+// MatrixMessage is the content of an m.text Matrix message with an HTML formatted body.
+type MatrixMessage struct {
+	MsgType       string `json:"msgtype"`
+	Body          string `json:"body"`
+	Format        string `json:"format"`
+	FormattedBody string `json:"formatted_body"`
+}
+
+var markdownEscaper = strings.NewReplacer(`\`, `\\`, `[`, `\[`, `]`, `\]`)
+
+// newSnippets makes the Snippets for a link to shortURL with the given title.
+func newSnippets(shortURL, title string) *Snippets {
+	anchor := `<a href="` + html.EscapeString(shortURL) + `">` + html.EscapeString(title) + `</a>`
+	return &Snippets{
+		Markdown: "[" + markdownEscaper.Replace(title) + "](" + shortURL + ")",
+		HTML:     anchor,
+		Matrix: MatrixMessage{
+			MsgType:       "m.text",
+			Body:          title + ": " + shortURL,
+			Format:        "org.matrix.custom.html",
+			FormattedBody: anchor,
+		},
+	}
+}
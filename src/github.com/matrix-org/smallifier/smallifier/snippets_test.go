@@ -0,0 +1,56 @@
+package smallifier
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSnippets(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	resp, err := insecureClient().Post(f.server.URL+"/_create", "application/json", strings.NewReader(`{
+		"long_url": "https://lemurs.win",
+		"secret": "`+testSecret+`",
+		"title": "Lemurs [<win>]"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var r Response
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Snippets == nil {
+		t.Fatal("want snippets got none")
+	}
+	if want := `[Lemurs \[<win>\]](` + r.ShortURL + `)`; r.Snippets.Markdown != want {
+		t.Errorf("markdown: want %q got %q", want, r.Snippets.Markdown)
+	}
+	if want := `<a href="` + r.ShortURL + `">Lemurs [&lt;win&gt;]</a>`; r.Snippets.HTML != want || r.Snippets.Matrix.FormattedBody != want {
+		t.Errorf("html: want %q got %q and %q", want, r.Snippets.HTML, r.Snippets.Matrix.FormattedBody)
+	}
+}
+
+func TestNoSnippetsWithoutTitle(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	resp, err := insecureClient().Post(f.server.URL+"/_create", "application/json", strings.NewReader(`{
+		"long_url": "https://lemurs.win",
+		"secret": "`+testSecret+`"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var r Response
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Snippets != nil {
+		t.Errorf("want no snippets got %+v", r.Snippets)
+	}
+}
@@ -0,0 +1,8 @@
+package smallifier
+
+// DriverName is the database/sql driver which should be used to open smallifier's sqlite3 database.
+// It enables foreign key enforcement on each connection, so that deleting a link also deletes its follows.
+//
+// By default it is backed by github.com/mattn/go-sqlite3, which needs cgo. Building with the purego tag backs it
+// with modernc.org/sqlite instead, which doesn't, for cross-compiling to ARM or for images built FROM scratch.
+const DriverName = "sqlite3_smallifier"
@@ -0,0 +1,34 @@
+//go:build !purego
+// +build !purego
+
+package smallifier
+
+import (
+	"database/sql"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// sqliteBackend names the sqlite implementation DriverName is backed by, for usage pings.
+const sqliteBackend = "go-sqlite3"
+
+// isUniqueViolation reports whether err is from inserting a row which conflicts with an existing one.
+func isUniqueViolation(err error) bool {
+	e, ok := err.(sqlite3.Error)
+	return ok && (e.ExtendedCode == sqlite3.ErrConstraintUnique || e.ExtendedCode == sqlite3.ErrConstraintPrimaryKey)
+}
+
+// isBusy reports whether err is from the database being busy or locked by another connection, which may soon stop.
+func isBusy(err error) bool {
+	e, ok := err.(sqlite3.Error)
+	return ok && (e.Code == sqlite3.ErrBusy || e.Code == sqlite3.ErrLocked)
+}
+
+func init() {
+	sql.Register(DriverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			_, err := conn.Exec("PRAGMA foreign_keys = ON", nil)
+			return err
+		},
+	})
+}
@@ -0,0 +1,29 @@
+//go:build !purego
+// +build !purego
+
+package smallifier
+
+import (
+	"errors"
+	"testing"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+func TestDatabaseError(t *testing.T) {
+	for _, tc := range []struct {
+		err       error
+		transient bool
+	}{
+		{sqlite3.Error{Code: sqlite3.ErrBusy}, true},
+		{sqlite3.Error{Code: sqlite3.ErrLocked}, true},
+		{sqlite3.Error{Code: sqlite3.ErrError}, false},
+		{sqlite3.Error{Code: sqlite3.ErrCorrupt}, false},
+		{errors.New("no such table: links"), false},
+	} {
+		_, transient := databaseError(tc.err).(transientError)
+		if transient != tc.transient {
+			t.Errorf("%v: want transient %v got %v", tc.err, tc.transient, transient)
+		}
+	}
+}
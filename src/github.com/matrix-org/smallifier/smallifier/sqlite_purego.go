@@ -0,0 +1,47 @@
+//go:build purego
+// +build purego
+
+package smallifier
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// sqliteBackend names the sqlite implementation DriverName is backed by, for usage pings.
+const sqliteBackend = "modernc"
+
+// isUniqueViolation reports whether err is from inserting a row which conflicts with an existing one.
+func isUniqueViolation(err error) bool {
+	e, ok := err.(*sqlite.Error)
+	return ok && (e.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE || e.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY)
+}
+
+// isBusy reports whether err is from the database being busy or locked by another connection, which may soon stop.
+// Code is the extended result code, whose low byte is the primary one.
+func isBusy(err error) bool {
+	e, ok := err.(*sqlite.Error)
+	return ok && (e.Code()&0xff == sqlite3.SQLITE_BUSY || e.Code()&0xff == sqlite3.SQLITE_LOCKED)
+}
+
+// pureGoDriver opens connections with modernc.org/sqlite, enabling foreign key enforcement on each. Like go-sqlite3,
+// each waits up to 5 seconds for a lock held by another, rather than failing at once.
+type pureGoDriver struct {
+	sqlite.Driver
+}
+
+func (d *pureGoDriver) Open(name string) (driver.Conn, error) {
+	sep := "?"
+	if strings.Contains(name, "?") {
+		sep = "&"
+	}
+	return d.Driver.Open(name + sep + "_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
+}
+
+func init() {
+	sql.Register(DriverName, &pureGoDriver{})
+}
@@ -0,0 +1,40 @@
+package smallifier
+
+import (
+	"context"
+	"database/sql"
+)
+
+// statements are the queries run for every follow, prepared once so that sqlite doesn't compile them each time.
+// They are closed with the database.
+type statements struct {
+	// lookup gets the long URL, whether it was deleted, the app link and the referrer policy of the link at $1.
+	lookup *sql.Stmt
+	// insertFollow records a follow, returning its id.
+	insertFollow *sql.Stmt
+}
+
+// prepareStatements prepares s.stmts.
+func (s *smallifier) prepareStatements(ctx context.Context) error {
+	var err error
+	s.stmts.lookup, err = s.db.PrepareContext(ctx, `SELECT links.long_url, links.deleted, COALESCE(app_links.app_link, ''),
+		COALESCE(link_referrers.hosts, ''), COALESCE(link_referrers.interstitial, 0) FROM links
+		LEFT JOIN app_links ON links.short_path = app_links.short_path
+		LEFT JOIN link_referrers ON links.short_path = link_referrers.short_path
+		WHERE links.short_path = $1`)
+	if err != nil {
+		return err
+	}
+	s.stmts.insertFollow, err = s.db.PrepareContext(ctx, `INSERT INTO follows (short_path, ts, ip, forwarded_for, client_key, bundle_item, user_agent, referer) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`)
+	return err
+}
+
+// insertFollow inserts f into the follows table with stmt, which is s.stmts.insertFollow or it within a transaction,
+// returning its id.
+func (s *smallifier) insertFollow(ctx context.Context, stmt *sql.Stmt, f follow) (int64, error) {
+	r, err := stmt.ExecContext(ctx, f.shortPath, f.timestamp, f.ip, f.forwardedFor, s.clientKey(f.ip), nullIfZero(f.bundleItem), s.userAgent(f), nullIfEmpty(f.referer))
+	if err != nil {
+		return 0, err
+	}
+	return r.LastInsertId()
+}
@@ -0,0 +1,87 @@
+package smallifier
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRecordFollowBatch(t *testing.T) {
+	clock := newFakeClock()
+	f := serve(t, WithClock(clock), WithRepeatWindow(30*time.Second))
+	defer f.Close()
+	s := f.smallifier.(*smallifier)
+
+	shortPath := shorten(t, f.server.URL, f.server.URL+"/_stub")[len(f.base):]
+	ts := clock.Now().Unix()
+	at := func(after int64, userAgent string) follow {
+		return follow{shortPath: shortPath, timestamp: ts + after, ip: "127.0.0.1", userAgent: userAgent}
+	}
+	// Repeats are counted both of follows earlier in the batch, and of follows in earlier batches.
+	for _, tc := range []struct {
+		batch []follow
+		want  []bool
+	}{
+		{[]follow{at(0, "Lemur/1.0"), at(1, "Lemur/1.0"), at(1, "Sifaka/2.0"), at(30, "Lemur/1.0")}, []bool{true, false, true, true}},
+		{[]follow{at(31, "Lemur/1.0"), at(40, "Sifaka/2.0")}, []bool{false, true}},
+	} {
+		got, err := s.recordFollowBatch(tc.batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("want %v recorded got %v", tc.want, got)
+		}
+	}
+
+	resp := statsRequest(t, f, shortPath, testSecret)
+	defer resp.Body.Close()
+	var stats LinkStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Follows != 4 || stats.Repeats != 2 {
+		t.Errorf("want 4 follows and 2 repeats got %d and %d", stats.Follows, stats.Repeats)
+	}
+}
+
+func BenchmarkLookup(b *testing.B) {
+	f := serve(b)
+	defer f.Close()
+	shortPath := shorten(b, f.server.URL, f.server.URL+"/_stub")[len(f.base):]
+	req := httptest.NewRequest("GET", "/"+shortPath, nil)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		f.smallifier.LookupHandler(w, req)
+		if w.Code != http.StatusFound {
+			b.Fatalf("want 302 got %d", w.Code)
+		}
+	}
+	b.StopTimer()
+	waitForFollows(f)
+}
+
+func BenchmarkRecordFollows(b *testing.B) {
+	for _, n := range []int{1, followBatchSize} {
+		b.Run(fmt.Sprintf("batch=%d", n), func(b *testing.B) {
+			f := serve(b)
+			defer f.Close()
+			s := f.smallifier.(*smallifier)
+			shortPath := shorten(b, f.server.URL, f.server.URL+"/_stub")[len(f.base):]
+			batch := make([]follow, n)
+			for i := range batch {
+				batch[i] = follow{shortPath: shortPath, timestamp: time.Now().Unix(), ip: "127.0.0.1", userAgent: "Lemur/1.0"}
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i += n {
+				if _, err := s.recordFollowBatch(batch); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package smallifier
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// statsPrefix is the path prefix under which per-link statistics are served.
+const statsPrefix = "/_stats/"
+
+// LinkStats is the JSON-encoded response describing how a link has been followed.
+type LinkStats struct {
+	ShortURL string `json:"short_url"`
+	// Follows is the number of times the link has been followed. A bundle's include those of each of its items.
+	Follows int64 `json:"follows"`
+	// CreatedTS is the unix timestamp at which the link was created.
+	CreatedTS int64 `json:"created_ts"`
+	// Repeats is the number of follows not counted in Follows because they repeated one which was, if WithRepeatWindow was given.
+	Repeats int64 `json:"repeats,omitempty"`
+	// LastFollowedTS is the unix timestamp of the most recent follow of the link, or 0 if it has never been followed.
+	LastFollowedTS int64 `json:"last_followed_ts"`
+	// Deleted is whether the link has been deleted, so is no longer followed.
+	Deleted bool `json:"deleted,omitempty"`
+	// Daily counts the follows on each of the days requested with ?days=..., oldest first, in the time zone TZ,
+	// requested with ?tz=....
+	Daily []DailyFollows `json:"daily,omitempty"`
+	TZ    string         `json:"tz,omitempty"`
+}
+
+// StatsHandler is an http.HandlerFunc which returns the LinkStats of the link at /_stats/<short path>, counting its
+// follows on each of the last ?days=... days in the time zone ?tz=... if given.
+// Requests must carry the secret in an "Authorization: Bearer" header, or be signed by a shared link to the stats.
+// If WithStatsShareKey was given, POSTing a ShareRequest, authorized like changes to the link, makes a shared link.
+func (s *smallifier) StatsHandler(w http.ResponseWriter, req *http.Request) {
+	setHeaders(w)
+
+	ctx, cancel, ok := s.requestContext(w, req)
+	if !ok {
+		return
+	}
+	defer cancel()
+
+	i := strings.Index(req.URL.Path, statsPrefix)
+	if i < 0 || (req.Method != "GET" && req.Method != "POST") {
+		writeError(w, 404, ErrCodeNotFound, "link not found")
+		return
+	}
+	shortPath := req.URL.Path[i+len(statsPrefix):]
+	if req.Method == "POST" {
+		s.shareStats(ctx, w, req, shortPath)
+		return
+	}
+
+	if !s.checkBearer(req) && !s.sharedStats(req, shortPath) {
+		atomic.AddUint64(&s.authErrorCount, 1)
+		log.WithField("path", req.URL.Path).Error("Refusing stats request with wrong secret")
+		writeError(w, 401, ErrCodeUnauthorized, "Must specify correct secret")
+		return
+	}
+
+	days, loc, err := parseDailyQuery(req.URL.Query())
+	if err != nil {
+		writeError(w, 400, ErrCodeInvalidParam, err.Error())
+		return
+	}
+	if days > 0 && s.analytics != AnalyticsDB {
+		writeError(w, 400, ErrCodeInvalidParam, "follows aren't recorded by day")
+		return
+	}
+
+	stats := LinkStats{ShortURL: s.base.String() + shortPath}
+	var lastFollowed sql.NullInt64
+	err = s.db.QueryRowContext(ctx, `SELECT links.create_ts, links.deleted, COUNT(follows.id), COALESCE(SUM(follows.repeat_count), 0), MAX(follows.ts) FROM links
+		LEFT JOIN follows ON links.short_path = follows.short_path
+		WHERE links.short_path = $1 GROUP BY links.short_path`, shortPath).Scan(&stats.CreatedTS, &stats.Deleted, &stats.Follows, &stats.Repeats, &lastFollowed)
+	if err != nil {
+		writeLookupError(w, err)
+		return
+	}
+	stats.LastFollowedTS = lastFollowed.Int64
+	if s.analytics == AnalyticsMemory {
+		stats.Follows, stats.LastFollowedTS = s.memoryFollows.get(shortPath)
+	}
+	if days > 0 {
+		if stats.Daily, err = s.dailyFollows(ctx, shortPath, days, loc); err != nil {
+			writeLookupError(w, err)
+			return
+		}
+		stats.TZ = loc.String()
+	}
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,79 @@
+package smallifier
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func statsRequest(t *testing.T, f fixture, shortPath, secret string) *http.Response {
+	req, err := http.NewRequest("GET", f.server.URL+"/_stats/"+shortPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+secret)
+	resp, err := insecureClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestLinkStats(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	before := time.Now().Unix()
+	shortened := shorten(t, f.server.URL, f.server.URL+"/_stub")
+	shortPath := shortened[len(f.base):]
+
+	var stats LinkStats
+	resp := statsRequest(t, f, shortPath, testSecret)
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if stats.ShortURL != shortened || stats.Follows != 0 || stats.LastFollowedTS != 0 || stats.CreatedTS < before {
+		t.Errorf("before following: got %+v", stats)
+	}
+
+	for i := 0; i < 2; i++ {
+		resp, err := insecureClient().Get(shortened)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	waitForFollows(f)
+
+	resp = statsRequest(t, f, shortPath, testSecret)
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if stats.Follows != 2 || stats.LastFollowedTS < stats.CreatedTS {
+		t.Errorf("after following twice: got %+v", stats)
+	}
+}
+
+func TestLinkStatsErrors(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	shortened := shorten(t, f.server.URL, f.server.URL+"/_stub")
+	for _, tc := range []struct {
+		shortPath string
+		secret    string
+		want      int
+	}{
+		{shortened[len(f.base):], "wrong" + testSecret, 401},
+		{"boohoohoo", testSecret, 404},
+	} {
+		resp := statsRequest(t, f, tc.shortPath, tc.secret)
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("stats of %q: want status code %d got %d", tc.shortPath, tc.want, resp.StatusCode)
+		}
+	}
+}
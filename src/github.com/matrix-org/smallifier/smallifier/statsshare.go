@@ -0,0 +1,92 @@
+package smallifier
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// WithStatsShareKey lets whoever may change a link share its stats with outsiders, using links to its stats which are
+// signed with key and expire, rather than the secret. Such links are made by POSTing a ShareRequest to /_stats/<short path>,
+// or by SignStatsShare.
+func WithStatsShareKey(key []byte) Option {
+	return func(s *smallifier) {
+		s.statsShareKey = key
+	}
+}
+
+// ShareRequest is the JSON-encoded body of a request to share the stats of a link.
+type ShareRequest struct {
+	// ExpiresTS is the unix timestamp after which the shared link stops working. It must be in the future.
+	ExpiresTS int64 `json:"expires_ts"`
+}
+
+// ShareResponse is the JSON-encoded response to a ShareRequest.
+type ShareResponse struct {
+	// StatsURL is the URL at which the link's stats can be read, without the secret, until ExpiresTS.
+	StatsURL  string `json:"stats_url"`
+	ExpiresTS int64  `json:"expires_ts"`
+}
+
+// SignStatsShare returns the query string granting access to the stats of the link at shortPath until expires, signed with key.
+func SignStatsShare(key []byte, shortPath string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return url.Values{
+		"exp": {exp},
+		"sig": {statsShareSignature(key, shortPath, exp)},
+	}.Encode()
+}
+
+func statsShareSignature(key []byte, shortPath, exp string) string {
+	mac := hmac.New(sha256.New, key)
+	// The purpose is signed too, so that the key can't be used to forge anything else should it be shared.
+	io.WriteString(mac, "stats\n"+shortPath+"\n"+exp)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sharedStats reports whether req carries an unexpired signature granting access to the stats of the link at shortPath.
+func (s *smallifier) sharedStats(req *http.Request, shortPath string) bool {
+	if s.statsShareKey == nil {
+		return false
+	}
+	q := req.URL.Query()
+	exp, sig := q.Get("exp"), q.Get("sig")
+	if sig == "" || !hmac.Equal([]byte(sig), []byte(statsShareSignature(s.statsShareKey, shortPath, exp))) {
+		return false
+	}
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	return err == nil && s.clock.Now().Unix() <= expires
+}
+
+// shareStats responds to a request to share the stats of the link at shortPath with a ShareResponse.
+func (s *smallifier) shareStats(ctx context.Context, w http.ResponseWriter, req *http.Request, shortPath string) {
+	if s.statsShareKey == nil {
+		writeError(w, 404, ErrCodeNotFound, "sharing stats is not enabled")
+		return
+	}
+	token := bearerToken(req)
+	if !s.authorizeChange(ctx, w, shortPath, token, token) {
+		return
+	}
+	defer req.Body.Close()
+	var r ShareRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		writeError(w, 400, ErrCodeNotJSON, "error decoding json")
+		return
+	}
+	if r.ExpiresTS <= s.clock.Now().Unix() {
+		writeError(w, 400, ErrCodeInvalidParam, "expires_ts must be in the future")
+		return
+	}
+	json.NewEncoder(w).Encode(ShareResponse{
+		StatsURL:  s.base.String() + statsPrefix[1:] + shortPath + "?" + SignStatsShare(s.statsShareKey, shortPath, time.Unix(r.ExpiresTS, 0)),
+		ExpiresTS: r.ExpiresTS,
+	})
+}
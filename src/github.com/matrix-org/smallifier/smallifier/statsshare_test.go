@@ -0,0 +1,75 @@
+package smallifier
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSharedStats(t *testing.T) {
+	clock := newFakeClock()
+	f := serve(t, WithClock(clock), WithStatsShareKey([]byte("sharing")))
+	defer f.Close()
+
+	r := create(t, f, `{"long_url": "`+f.server.URL+`/_stub", "secret": "`+testSecret+`"}`)
+	other := create(t, f, `{"long_url": "`+f.server.URL+`/_stub", "secret": "`+testSecret+`"}`)
+	expires := clock.Now().Add(time.Hour).Unix()
+	req, err := http.NewRequest("POST", f.server.URL+"/_stats/"+r.ShortPath, strings.NewReader(`{"expires_ts": `+strconv.FormatInt(expires, 10)+`}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+r.EditToken)
+	resp, err := insecureClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var share ShareResponse
+	err = json.NewDecoder(resp.Body).Decode(&share)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if share.ExpiresTS != expires || !strings.HasPrefix(share.StatsURL, f.base+"_stats/"+r.ShortPath+"?") {
+		t.Fatalf("want a stats URL for %s expiring at %d got %+v", r.ShortPath, expires, share)
+	}
+	query := share.StatsURL[strings.Index(share.StatsURL, "?"):]
+
+	for _, tc := range []struct {
+		name string
+		url  string
+		at   time.Duration
+		want int
+	}{
+		{"shared", share.StatsURL, 0, 200},
+		{"other link", f.base + "_stats/" + other.ShortPath + query, 0, 401},
+		{"expired", share.StatsURL, time.Hour + time.Second, 401},
+	} {
+		clock.advance(tc.at)
+		resp, err := insecureClient().Get(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s: want status code %d got %d", tc.name, tc.want, resp.StatusCode)
+		}
+	}
+}
+
+func TestSharingStatsNeedsEditToken(t *testing.T) {
+	f := serve(t, WithStatsShareKey([]byte("sharing")))
+	defer f.Close()
+
+	r := create(t, f, `{"long_url": "`+f.server.URL+`/_stub", "secret": "`+testSecret+`"}`)
+	resp, err := insecureClient().Post(f.server.URL+"/_stats/"+r.ShortPath, "application/json", strings.NewReader(`{"expires_ts": 9999999999}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 401 {
+		t.Errorf("want status code 401 got %d", resp.StatusCode)
+	}
+}
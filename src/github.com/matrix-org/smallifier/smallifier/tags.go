@@ -0,0 +1,36 @@
+package smallifier
+
+import (
+	"context"
+	"fmt"
+)
+
+const (
+	// maxTags is the most tags a single link may have.
+	maxTags = 10
+	// maxTagLength is the longest a tag may be, in bytes.
+	maxTagLength = 64
+)
+
+// checkTags returns an error describing why tags cannot be attached to a link, or nil if they can.
+func checkTags(tags []string) error {
+	if len(tags) > maxTags {
+		return fmt.Errorf("Links may have at most %d tags", maxTags)
+	}
+	for _, tag := range tags {
+		if tag == "" || len(tag) > maxTagLength {
+			return fmt.Errorf("Tags must be between 1 and %d bytes long", maxTagLength)
+		}
+	}
+	return nil
+}
+
+// addTags attaches tags to the link at shortPath.
+func (s *smallifier) addTags(ctx context.Context, shortPath string, tags []string) error {
+	for _, tag := range tags {
+		if _, err := s.db.ExecContext(ctx, `INSERT OR IGNORE INTO link_tags (short_path, tag) VALUES ($1, $2)`, shortPath, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
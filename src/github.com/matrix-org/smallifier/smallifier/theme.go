@@ -0,0 +1,158 @@
+package smallifier
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// themeTemplates define every HTML page served. Pages are wrapped with "head" and "foot", which include
+// the "style", "header" and "footer" templates; themes will usually only redefine those three,
+// e.g. to add a stylesheet, a logo and contact details, but may redefine any template.
+const themeTemplates = `{{define "style"}}{{end}}
+{{define "header"}}{{end}}
+{{define "footer"}}{{end}}
+
+{{define "head"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.}}</title>
+{{template "style"}}</head>
+<body>
+{{template "header"}}{{end}}
+
+{{define "foot"}}{{template "footer"}}</body>
+</html>
+{{end}}
+
+{{define "bundle"}}{{template "head" .Title}}<h1>{{.Title}}</h1>
+<ul>
+{{range .Items}}<li><a href="{{.URL}}">{{.Title}}</a></li>
+{{end}}</ul>
+{{template "foot"}}{{end}}
+
+{{define "matrixto"}}{{template "head" (printf "%s %s" .Kind .Identifier)}}<h1>{{.Kind}} {{.Identifier}}</h1>
+{{if .EventID}}<p>Message {{.EventID}}</p>
+{{end}}{{if .Via}}<p>Via {{range $i, $v := .Via}}{{if $i}}, {{end}}{{$v}}{{end}}</p>
+{{end}}<p><a href="{{.URL}}">Open in Matrix</a></p>
+{{template "foot"}}{{end}}
+
+{{define "preview"}}{{template "head" "Link preview"}}<h1>This link goes to {{.Host}}</h1>
+<p>{{.ShortURL}} leads to:</p>
+<p><code>{{.URL}}</code></p>
+<p><a href="{{.URL}}">Continue to {{.Host}}</a></p>
+{{template "foot"}}{{end}}
+
+{{define "destinationblocked"}}{{template "head" "Link disabled"}}<h1>Link disabled</h1>
+<p>Links to {{.Host}} have been disabled for your safety.</p>
+{{if .Reason}}<p>{{.Reason}}</p>
+{{end}}{{template "foot"}}{{end}}
+
+{{define "maintenance"}}{{template "head" "Down for maintenance"}}<h1>Down for maintenance</h1>
+<p>This site is down for maintenance, and will be back soon.</p>
+{{if .Message}}<p>{{.Message}}</p>
+{{end}}{{template "foot"}}{{end}}
+
+{{define "geoblocked"}}{{template "head" "Unavailable in your location"}}<h1>Unavailable in your location</h1>
+<p>This link can't be followed from your location.</p>
+{{template "foot"}}{{end}}
+
+{{define "referrerrefused"}}{{template "head" "Follow this link from its site"}}<h1>Follow this link from its site</h1>
+<p>This link is meant to be followed from {{range $i, $h := .Hosts}}{{if $i}}, {{end}}{{$h}}{{end}}.</p>
+{{if .URL}}<p><a href="{{.URL}}">Continue anyway</a></p>
+{{end}}{{template "foot"}}{{end}}
+`
+
+// themeBase holds the default templates, which themes are cloned from.
+// It must never be executed, as executed templates can't be cloned.
+var themeBase = template.Must(template.New("theme").Parse(themeTemplates))
+
+// defaultTheme is used until a theme is set.
+var defaultTheme = &Theme{template.Must(themeBase.Clone())}
+
+// Theme is the set of templates HTML pages are rendered with.
+type Theme struct {
+	t *template.Template
+}
+
+// LoadTheme loads the templates in the *.html files in dir, which redefine the default ones by name.
+// For example, a file containing {{define "footer"}}<p>Run by Example Org</p>{{end}} adds a footer to every page.
+// Images and stylesheets should be referenced by absolute URL, as they are not served from dir.
+func LoadTheme(dir string) (*Theme, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	t, err := themeBase.Clone()
+	if err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) > 0 {
+		if t, err = t.ParseFiles(files...); err != nil {
+			return nil, err
+		}
+	}
+	// Render every page now, so that mistakes are reported when the theme is loaded rather than when pages are served.
+	for _, page := range []string{"bundle", "matrixto", "preview", "destinationblocked", "geoblocked", "referrerrefused"} {
+		if err := t.ExecuteTemplate(ioutil.Discard, page, themeSample[page]); err != nil {
+			return nil, fmt.Errorf("theme %s: %v", dir, err)
+		}
+	}
+	return &Theme{t}, nil
+}
+
+// themeSample holds data which each page is rendered with to check a theme.
+var themeSample = map[string]interface{}{
+	"bundle": bundlePage{Title: "Bundle", Items: []BundleItem{{Title: "Item", URL: "https://example.com/"}}},
+	"matrixto": matrixToPage{
+		matrixToLink: matrixToLink{Kind: "Room", Identifier: "#room:example.com", EventID: "$event", Via: []string{"example.com"}},
+		URL:          "https://matrix.to/#/#room:example.com",
+	},
+	"preview":            previewPage{ShortURL: "https://example.com/tj2TEXT7", Host: "example.org", URL: "https://example.org/"},
+	"destinationblocked": blockedDestinationPage{Host: "example.org", Reason: "example.org has been compromised."},
+	"geoblocked":         nil,
+	"referrerrefused":    referrerRefusedPage{Hosts: []string{"example.org"}, URL: "https://example.com/"},
+}
+
+// WithTheme sets the theme HTML pages are rendered with.
+func WithTheme(t *Theme) Option {
+	return func(s *smallifier) {
+		s.SetTheme(t)
+	}
+}
+
+func (s *smallifier) SetTheme(t *Theme) {
+	s.theme.Store(t)
+}
+
+// render writes the page with the given name, rendered with data, with the given status code.
+// Pages are rendered in full before anything is written, so that a broken theme causes a 500 rather than half a page.
+func (s *smallifier) render(w http.ResponseWriter, status int, page string, data interface{}) error {
+	t, _ := s.theme.Load().(*Theme)
+	if t == nil {
+		t = defaultTheme
+	}
+	var b bytes.Buffer
+	if err := t.t.ExecuteTemplate(&b, page, data); err != nil {
+		log.WithFields(log.Fields{
+			"err":  err,
+			"page": page,
+		}).Error("Error rendering page")
+		writeError(w, 500, ErrCodeUnknown, "internal server error")
+		return err
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(b.Bytes())
+	return nil
+}
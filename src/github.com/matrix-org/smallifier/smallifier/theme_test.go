@@ -0,0 +1,80 @@
+package smallifier
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTheme(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smallifier-theme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "footer.html"), []byte(`{{define "footer"}}<footer>Shortened by lemurs</footer>
+{{end}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	theme, err := LoadTheme(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := serve(t)
+	defer f.Close()
+	resp, err := insecureClient().Post(f.server.URL+"/_bundle", "application/json", strings.NewReader(`{
+		"title": "Lemurs",
+		"items": [{"url": "https://lemurs.win"}],
+		"secret": "`+testSecret+`"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created Response
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	page := func() string {
+		resp, err := insecureClient().Get(created.ShortURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	if got := page(); !strings.Contains(got, "<h1>Lemurs</h1>") || strings.Contains(got, "<footer>") {
+		t.Errorf("default theme: got %s", got)
+	}
+	f.smallifier.SetTheme(theme)
+	if got := page(); !strings.Contains(got, "<h1>Lemurs</h1>") || !strings.Contains(got, "<footer>Shortened by lemurs</footer>") {
+		t.Errorf("after setting theme: got %s", got)
+	}
+}
+
+func TestLoadBadTheme(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smallifier-theme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := LoadTheme(filepath.Join(dir, "missing")); err == nil {
+		t.Error("missing theme directory: want error")
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "header.html"), []byte(`{{define "header"}}{{template "logo"}}{{end}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadTheme(dir); err == nil {
+		t.Error("theme using undefined template: want error")
+	}
+}
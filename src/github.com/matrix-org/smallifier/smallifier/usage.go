@@ -0,0 +1,160 @@
+package smallifier
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// usagePingDelay is how long after the Smallifier is made the first usage ping is sent, so that a server which
+	// keeps restarting doesn't send many.
+	usagePingDelay = time.Hour
+	// usagePingInterval is how often usage pings are sent after the first.
+	usagePingInterval = 24 * time.Hour
+)
+
+// UsagePing is what WithUsagePing reports about a Smallifier, to help its maintainers prioritize the backends and
+// features they work on. It identifies neither the installation nor its users, and counts links only roughly.
+type UsagePing struct {
+	// Version is the version of smallifier given to WithUsagePing.
+	Version   string `json:"version"`
+	GoVersion string `json:"go_version"`
+	OS        string `json:"os"`
+	Arch      string `json:"arch"`
+	// Backend is the sqlite implementation the database is backed by, "go-sqlite3" or "modernc".
+	Backend string `json:"backend"`
+	// Links is the number of links stored, rounded down to a power of 10.
+	Links int64 `json:"links"`
+	// Features lists the optional features in use, e.g. "feeds", in alphabetical order.
+	Features []string `json:"features"`
+}
+
+// UsageReporter sends UsagePings to wherever they are collected.
+type UsageReporter interface {
+	ReportUsage(ctx context.Context, ping UsagePing) error
+}
+
+// NopUsageReporter is a UsageReporter which sends nothing. It is the default, so that no usage pings are sent unless
+// WithUsagePing is given another.
+type NopUsageReporter struct{}
+
+// ReportUsage does nothing.
+func (NopUsageReporter) ReportUsage(context.Context, UsagePing) error {
+	return nil
+}
+
+// HTTPUsageReporter POSTs each UsagePing as JSON to URL.
+type HTTPUsageReporter struct {
+	URL string
+	// Client makes the requests, or a client with a 10 second timeout if it is nil.
+	Client *http.Client
+}
+
+// ReportUsage POSTs ping to r.URL.
+func (r HTTPUsageReporter) ReportUsage(ctx context.Context, ping UsagePing) error {
+	b, err := json.Marshal(ping)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", r.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := r.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("usage ping responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// WithUsagePing sends a UsagePing about the Smallifier, running version, to r an hour after it is made and daily
+// after that. Usage pings are only sent if this is given, and each is logged, so that operators can see what is sent.
+func WithUsagePing(r UsageReporter, version string) Option {
+	return func(s *smallifier) {
+		s.usageReporter = r
+		s.version = version
+	}
+}
+
+// usagePing describes the Smallifier for its usage pings.
+func (s *smallifier) usagePing(ctx context.Context) (UsagePing, error) {
+	var links int64
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM links WHERE deleted = 0`).Scan(&links); err != nil {
+		return UsagePing{}, err
+	}
+	rounded := int64(0)
+	for p := int64(1); p <= links; p *= 10 {
+		rounded = p
+	}
+	var features []string
+	for _, f := range []struct {
+		name  string
+		inUse bool
+	}{
+		{"analytics_memory", s.analytics == AnalyticsMemory},
+		{"analytics_off", s.analytics == AnalyticsOff},
+		{"event_webhooks", len(s.eventHooks) > 0},
+		{"feeds", len(s.feeds) > 0},
+		{"follow_archive", s.followArchiveDir != ""},
+		{"geoip", s.geoIP != nil},
+		{"link_limits", s.linkLimits != nil},
+		{"load_shedding", s.loadThresholds != nil},
+		{"lookup_cache", s.lookupCache != nil},
+		{"matrix_bot", s.matrixBot != nil},
+		{"namespaces", s.namespaces != nil},
+	} {
+		if f.inUse {
+			features = append(features, f.name)
+		}
+	}
+	return UsagePing{
+		Version:   s.version,
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		Backend:   sqliteBackend,
+		Links:     rounded,
+		Features:  features,
+	}, nil
+}
+
+// pingUsage sends usage pings to s.usageReporter, after usagePingDelay then every usagePingInterval, until s.stop is
+// closed. Pings which fail aren't retried.
+func (s *smallifier) pingUsage() {
+	defer s.background.Done()
+	delay := usagePingDelay
+	for {
+		select {
+		case <-s.clock.After(delay):
+		case <-s.stop:
+			return
+		}
+		delay = usagePingInterval
+		ctx, cancel := context.WithTimeout(s.ctx, time.Minute)
+		ping, err := s.usagePing(ctx)
+		if err == nil {
+			log.WithField("ping", ping).Info("Sending usage ping")
+			err = s.usageReporter.ReportUsage(ctx, ping)
+		}
+		cancel()
+		if err != nil {
+			log.WithField("err", err).Warn("Error sending usage ping")
+		}
+	}
+}
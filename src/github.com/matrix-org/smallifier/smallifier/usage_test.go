@@ -0,0 +1,78 @@
+package smallifier
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// usageRecorder is a UsageReporter which sends each ping on a channel.
+type usageRecorder chan UsagePing
+
+func (r usageRecorder) ReportUsage(ctx context.Context, ping UsagePing) error {
+	r <- ping
+	return nil
+}
+
+func TestUsagePing(t *testing.T) {
+	clock := newFakeClock()
+	pings := make(usageRecorder, 1)
+	f := serve(t, WithClock(clock), WithUsagePing(pings, "1.2.3"), WithNamespaces(Namespaces{"local": {"127.0.0.1"}}))
+	defer f.Close()
+
+	for i := 0; i < 12; i++ {
+		shorten(t, f.server.URL, f.server.URL+"/_stub")
+	}
+	// Both the scheduled update and usage ping loops wait on the clock.
+	clock.waitForWaiters(2)
+	clock.advance(usagePingDelay)
+
+	want := UsagePing{
+		Version:   "1.2.3",
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		Backend:   sqliteBackend,
+		Links:     10,
+		Features:  []string{"namespaces"},
+	}
+	select {
+	case got := <-pings:
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("want %+v got %+v", want, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("want a usage ping an hour after starting")
+	}
+}
+
+func TestHTTPUsageReporter(t *testing.T) {
+	var got UsagePing
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" || req.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("want a JSON POST got %s %s", req.Method, req.Header.Get("Content-Type"))
+		}
+		if req.URL.Path == "/broken" {
+			w.WriteHeader(500)
+			return
+		}
+		json.NewDecoder(req.Body).Decode(&got)
+	}))
+	defer server.Close()
+
+	ping := UsagePing{Version: "1.2.3", Backend: "modernc", Links: 100, Features: []string{"feeds"}}
+	if err := (HTTPUsageReporter{URL: server.URL}).ReportUsage(context.Background(), ping); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, ping) {
+		t.Errorf("want %+v got %+v", ping, got)
+	}
+	if err := (HTTPUsageReporter{URL: server.URL + "/broken"}).ReportUsage(context.Background(), ping); err == nil {
+		t.Error("want an error from a 500 response")
+	}
+}
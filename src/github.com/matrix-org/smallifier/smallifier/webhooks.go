@@ -0,0 +1,188 @@
+package smallifier
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// SignatureHeader is the HTTP header carrying the HMAC-SHA256 signature of a webhook body,
+// formatted as "sha256=" followed by the hex-encoded MAC.
+const SignatureHeader = "X-Smallifier-Signature"
+
+// maxClicksPerWebhook is the most clicks sent in a single webhook request.
+const maxClicksPerWebhook = 100
+
+// Click describes a single follow of a short link, as delivered to click webhooks.
+type Click struct {
+	ShortURL string `json:"short_url"`
+	TS       int64  `json:"ts"`
+}
+
+// ClickBatch is the JSON-encoded body POSTed to a link's click webhook.
+type ClickBatch struct {
+	Clicks []Click `json:"clicks"`
+}
+
+// WithWebhookInterval sets how often batches of clicks are delivered to click webhooks.
+func WithWebhookInterval(interval time.Duration) Option {
+	return func(s *smallifier) {
+		s.webhookInterval = interval
+	}
+}
+
+// WithWebhookClient sets the HTTP client used to deliver webhooks.
+func WithWebhookClient(client *http.Client) Option {
+	return func(s *smallifier) {
+		s.webhookClient = client
+	}
+}
+
+// clickWebhook identifies a webhook endpoint and the key its requests are signed with.
+type clickWebhook struct {
+	url    string
+	secret string
+}
+
+// clickBatcher accumulates clicks for each webhook until they are next delivered.
+type clickBatcher struct {
+	mu      sync.Mutex
+	pending map[clickWebhook][]Click
+}
+
+func (b *clickBatcher) add(hook clickWebhook, c Click) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.pending == nil {
+		b.pending = make(map[clickWebhook][]Click)
+	}
+	b.pending[hook] = append(b.pending[hook], c)
+}
+
+func (b *clickBatcher) take() map[clickWebhook][]Click {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p := b.pending
+	b.pending = nil
+	return p
+}
+
+// queueClick adds f to the pending batch for its link's click webhook, if it has one.
+func (s *smallifier) queueClick(f follow) {
+	var hook clickWebhook
+	err := s.db.QueryRowContext(s.ctx, `SELECT url, secret FROM click_webhooks WHERE short_path = $1`, f.shortPath).Scan(&hook.url, &hook.secret)
+	if err == sql.ErrNoRows {
+		return
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":        err,
+			"short_path": f.shortPath,
+		}).Error("Error looking up click webhook")
+		return
+	}
+	s.clicks.add(hook, Click{
+		ShortURL: s.base.String() + f.shortPath,
+		TS:       f.timestamp,
+	})
+}
+
+// deliverClicks sends pending click batches to their webhooks every s.webhookInterval, until s.stop is closed.
+func (s *smallifier) deliverClicks() {
+	defer close(s.clicksDone)
+	ticker := time.NewTicker(s.webhookInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.deliverPendingClicks()
+		case <-s.stop:
+			s.deliverPendingClicks()
+			return
+		}
+	}
+}
+
+func (s *smallifier) deliverPendingClicks() {
+	for hook, clicks := range s.clicks.take() {
+		for len(clicks) > 0 {
+			n := len(clicks)
+			if n > maxClicksPerWebhook {
+				n = maxClicksPerWebhook
+			}
+			if err := s.postWebhook(context.Background(), hook.url, hook.secret, ClickBatch{clicks[:n]}); err != nil {
+				log.WithFields(log.Fields{
+					"err": err,
+					"url": hook.url,
+				}).Error("Error delivering click webhook")
+				atomic.AddUint64(&s.webhookErrorCount, 1)
+			}
+			clicks = clicks[n:]
+		}
+	}
+}
+
+// postWebhook POSTs the JSON encoding of body to url, signed with secret.
+func (s *smallifier) postWebhook(ctx context.Context, url, secret string, body interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, Sign(secret, b))
+	resp, err := s.webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Sign computes the value of SignatureHeader for a webhook body signed with secret.
+// Receivers should compare it to the header using hmac.Equal.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// addClickWebhook registers url as the click webhook for shortPath, returning the key with which its requests will be signed.
+func (s *smallifier) addClickWebhook(ctx context.Context, shortPath, url string) (string, error) {
+	secret, err := s.generateSecret()
+	if err != nil {
+		return "", err
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT INTO click_webhooks (short_path, url, secret) VALUES ($1, $2, $3)`, shortPath, url, secret)
+	return secret, err
+}
+
+// generateSecret returns a random URL-safe string for use as a signing key.
+func (s *smallifier) generateSecret() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		atomic.AddUint64(&s.randomErrorCount, 1)
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
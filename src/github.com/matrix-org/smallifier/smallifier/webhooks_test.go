@@ -0,0 +1,85 @@
+package smallifier
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClickWebhook(t *testing.T) {
+	type delivery struct {
+		signature string
+		body      []byte
+	}
+	deliveries := make(chan delivery, 1)
+	hook := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		deliveries <- delivery{req.Header.Get(SignatureHeader), b}
+	}))
+	defer hook.Close()
+
+	f := serve(t, WithWebhookInterval(10*time.Millisecond), WithWebhookClient(insecureClient()))
+	defer f.Close()
+
+	resp, err := insecureClient().Post(f.server.URL+"/_create", "application/json", strings.NewReader(`{
+		"long_url": "`+f.server.URL+`/_stub",
+		"secret": "`+testSecret+`",
+		"click_webhook_url": "`+hook.URL+`"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var created Response
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if created.ClickWebhookSecret == "" {
+		t.Fatal("want click webhook secret got none")
+	}
+
+	followResp, err := insecureClient().Get(created.ShortURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	followResp.Body.Close()
+
+	select {
+	case d := <-deliveries:
+		if want := Sign(created.ClickWebhookSecret, d.body); !hmac.Equal([]byte(want), []byte(d.signature)) {
+			t.Errorf("signature: want %q got %q", want, d.signature)
+		}
+		var batch ClickBatch
+		if err := json.Unmarshal(d.body, &batch); err != nil {
+			t.Fatal(err)
+		}
+		if len(batch.Clicks) != 1 || batch.Clicks[0].ShortURL != created.ShortURL {
+			t.Errorf("clicks: want one click on %s got %+v", created.ShortURL, batch.Clicks)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for click webhook")
+	}
+}
+
+func TestNonHTTPSClickWebhook(t *testing.T) {
+	f := serve(t)
+	defer f.Close()
+
+	resp, err := insecureClient().Post(f.server.URL+"/_create", "application/json", strings.NewReader(`{
+		"long_url": "https://lemurs.win",
+		"secret": "`+testSecret+`",
+		"click_webhook_url": "http://lemurs.win/clicks"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Error("non-https click webhook: want status code 400 got", resp.StatusCode)
+	}
+}
@@ -0,0 +1,59 @@
+package smallifier
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// wellKnownMatrixPrefix is the path under which Matrix clients and servers discover a domain's homeserver.
+const wellKnownMatrixPrefix = "/.well-known/matrix/"
+
+// ParseWellKnownMatrix reads the documents to serve under /.well-known/matrix/ from a JSON object mapping their names to
+// their contents, e.g.
+//
+//	{"server": {"m.server": "matrix.example.org:443"}, "client": {"m.homeserver": {"base_url": "https://matrix.example.org"}}}
+func ParseWellKnownMatrix(r io.Reader) (map[string]json.RawMessage, error) {
+	var docs map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&docs); err != nil {
+		return nil, err
+	}
+	for name, doc := range docs {
+		if name == "" || strings.ContainsAny(name, "/?#") {
+			return nil, fmt.Errorf("%q: names of well-known documents must not be empty or contain '/', '?' or '#'", name)
+		}
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, doc); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		if buf.Bytes()[0] != '{' {
+			return nil, fmt.Errorf("%s: well-known documents must be JSON objects", name)
+		}
+		docs[name] = buf.Bytes()
+	}
+	return docs, nil
+}
+
+// WithWellKnownMatrix serves each of docs at /.well-known/matrix/<name> at the root of the host, outside the path of
+// the base URL, so that the short domain can also delegate to a Matrix homeserver without another proxy in front.
+func WithWellKnownMatrix(docs map[string]json.RawMessage) Option {
+	return func(s *smallifier) {
+		s.wellKnownMatrix = docs
+	}
+}
+
+// serveWellKnownMatrix writes the well-known Matrix document named by the path of req, or 404s.
+// Matrix clients fetch these from web pages, so they may be read cross-origin.
+func (s *smallifier) serveWellKnownMatrix(w http.ResponseWriter, req *http.Request) {
+	setHeaders(w)
+
+	doc, ok := s.wellKnownMatrix[strings.TrimPrefix(req.URL.Path, wellKnownMatrixPrefix)]
+	if !ok || (req.Method != "GET" && req.Method != "HEAD") {
+		writeError(w, 404, ErrCodeNotFound, "not found")
+		return
+	}
+	w.Write(doc)
+}
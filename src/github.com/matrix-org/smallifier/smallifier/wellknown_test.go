@@ -0,0 +1,77 @@
+package smallifier
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseWellKnownMatrix(t *testing.T) {
+	for _, tc := range []struct {
+		config string
+		ok     bool
+	}{
+		{`{"server": {"m.server": "matrix.example.org:443"}, "client": {"m.homeserver": {"base_url": "https://matrix.example.org"}}}`, true},
+		{`{"server": "matrix.example.org:443"}`, false},
+		{`{"../server": {}}`, false},
+		{`{"": {}}`, false},
+	} {
+		if _, err := ParseWellKnownMatrix(strings.NewReader(tc.config)); (err == nil) != tc.ok {
+			t.Errorf("%s: want ok %v got error %v", tc.config, tc.ok, err)
+		}
+	}
+}
+
+func TestWellKnownMatrix(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+	if err := CreateTables(db); err != nil {
+		t.Fatal(err)
+	}
+	docs, err := ParseWellKnownMatrix(strings.NewReader(`{"server": {
+		"m.server": "matrix.example.org:443"
+	}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var h http.Handler
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		h.ServeHTTP(w, req)
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL + "/s/")
+	s, err := New(context.Background(), *u, db, testSecret, 256, WithWellKnownMatrix(docs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	h = s.Handler()
+
+	for _, tc := range []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/.well-known/matrix/server", 200, `{"m.server":"matrix.example.org:443"}`},
+		{"/.well-known/matrix/client", 404, ""},
+		{"/s/.well-known/matrix/server", 404, ""},
+	} {
+		resp, err := insecureClient().Get(server.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status || (tc.body != "" && string(b) != tc.body) {
+			t.Errorf("GET %s: want %d %s got %d %s", tc.path, tc.status, tc.body, resp.StatusCode, b)
+		}
+		if tc.status == 200 && resp.Header.Get("Access-Control-Allow-Origin") != "*" {
+			t.Errorf("GET %s: want CORS headers", tc.path)
+		}
+	}
+}
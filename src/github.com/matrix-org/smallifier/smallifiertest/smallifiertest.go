@@ -0,0 +1,397 @@
+// Package smallifiertest provides an in-memory smallifier, for testing services which integrate with one
+// without a database.
+//
+// It supports creating, following, updating and deleting links, authenticated with Secret, and creating, resolving
+// and deleting them in-process with Shorten, Resolve and Delete.
+// The other endpoints respond 501 Not Implemented.
+package smallifiertest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/smallifier/smallifier"
+)
+
+// Secret is the secret the fake accepts.
+const Secret = "smallifiertest-secret"
+
+// Smallifier is an in-memory smallifier.Smallifier, which keeps its links and their follows in maps.
+type Smallifier struct {
+	base url.URL
+
+	mu      sync.Mutex
+	links   map[string]*link
+	follows map[string]int
+	created int
+}
+
+type link struct {
+	longURL   string
+	createdTS int64
+	deleted   bool
+}
+
+var _ smallifier.Smallifier = (*Smallifier)(nil)
+
+// New makes a Smallifier serving links under base, which already has links, mapping short paths to long URLs.
+func New(base url.URL, links map[string]string) *Smallifier {
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+		base.RawPath = ""
+	}
+	s := &Smallifier{
+		base:    base,
+		links:   make(map[string]*link),
+		follows: make(map[string]int),
+	}
+	for shortPath, longURL := range links {
+		s.Add(shortPath, longURL)
+	}
+	return s
+}
+
+// Server is a Smallifier served by an httptest.Server.
+type Server struct {
+	*Smallifier
+	*httptest.Server
+	// Base is the URL links are served under, e.g. http://127.0.0.1:1234/, for passing to client.New.
+	Base string
+}
+
+// NewServer starts serving a Smallifier which already has links, mapping short paths to long URLs.
+// The caller should Close it when finished.
+func NewServer(links map[string]string) *Server {
+	srv := httptest.NewUnstartedServer(nil)
+	base, _ := url.Parse("http://" + srv.Listener.Addr().String() + "/")
+	s := New(*base, links)
+	srv.Config.Handler = s.Handler()
+	srv.Start()
+	return &Server{Smallifier: s, Server: srv, Base: base.String()}
+}
+
+// Close shuts down the server.
+func (s *Server) Close() {
+	s.Server.Close()
+}
+
+// Add adds a link from shortPath to longURL, replacing any already there.
+func (s *Smallifier) Add(shortPath, longURL string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.links[shortPath] = &link{longURL: longURL, createdTS: time.Now().Unix()}
+}
+
+// Links returns the long URL of every link which hasn't been deleted, by short path.
+func (s *Smallifier) Links() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	links := make(map[string]string)
+	for shortPath, l := range s.links {
+		if !l.deleted {
+			links[shortPath] = l.longURL
+		}
+	}
+	return links
+}
+
+// ShortPaths returns the short paths of every link which hasn't been deleted, in order.
+func (s *Smallifier) ShortPaths() []string {
+	var paths []string
+	for shortPath := range s.Links() {
+		paths = append(paths, shortPath)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Follows returns how many times the link at shortPath has been followed.
+func (s *Smallifier) Follows(shortPath string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.follows[shortPath]
+}
+
+// AssertFollows fails t unless the link at shortPath has been followed want times.
+func (s *Smallifier) AssertFollows(t testing.TB, shortPath string, want int) {
+	if got := s.Follows(shortPath); got != want {
+		t.Errorf("%s: want %d follows got %d", shortPath, want, got)
+	}
+}
+
+// AssertLink fails t unless there is a link at shortPath to longURL.
+func (s *Smallifier) AssertLink(t testing.TB, shortPath, longURL string) {
+	got, ok := s.Links()[shortPath]
+	if !ok {
+		t.Errorf("%s: want a link to %s got none", shortPath, longURL)
+	} else if got != longURL {
+		t.Errorf("%s: want a link to %s got %s", shortPath, longURL, got)
+	}
+}
+
+func (s *Smallifier) CreateHandler(w http.ResponseWriter, req *http.Request) {
+	if !checkPost(w, req) {
+		return
+	}
+	var r smallifier.CreateRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		writeError(w, 400, smallifier.ErrCodeNotJSON, "error decoding json")
+		return
+	}
+	if r.Secret != Secret {
+		writeError(w, 401, smallifier.ErrCodeUnauthorized, "Bad secret")
+		return
+	}
+	resp, err := s.Shorten(req.Context(), r)
+	if err != nil {
+		writeErrorResponse(w, err.(*smallifier.ErrorResponse))
+		return
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Shorten creates a link as CreateHandler does, without requiring the secret.
+func (s *Smallifier) Shorten(ctx context.Context, r smallifier.CreateRequest) (smallifier.Response, error) {
+	if u, err := url.Parse(r.LongURL); err != nil || !u.IsAbs() {
+		return smallifier.Response{}, newError(400, smallifier.ErrCodeInvalidParam, "Links must be absolute URLs")
+	}
+
+	s.mu.Lock()
+	shortPath := r.ShortPath
+	if shortPath == "" {
+		for {
+			s.created++
+			shortPath = fmt.Sprintf("test%04d", s.created)
+			if _, ok := s.links[shortPath]; !ok {
+				break
+			}
+		}
+	} else if _, ok := s.links[shortPath]; ok {
+		s.mu.Unlock()
+		return smallifier.Response{}, newError(409, smallifier.ErrCodeInUse, "short path is already in use")
+	}
+	l := &link{longURL: r.LongURL, createdTS: time.Now().Unix()}
+	s.links[shortPath] = l
+	s.mu.Unlock()
+
+	return smallifier.Response{
+		ShortURL:  s.base.String() + shortPath,
+		ShortPath: shortPath,
+		CreatedTS: l.createdTS,
+	}, nil
+}
+
+// Resolve returns the link at shortPath, without counting a follow.
+func (s *Smallifier) Resolve(ctx context.Context, shortPath string) (smallifier.Link, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.links[shortPath]
+	switch {
+	case !ok:
+		return smallifier.Link{}, newError(404, smallifier.ErrCodeNotFound, "link not found")
+	case l.deleted:
+		return smallifier.Link{}, newError(410, smallifier.ErrCodeGone, "link deleted")
+	}
+	return smallifier.Link{
+		ShortURL:  s.base.String() + shortPath,
+		ShortPath: shortPath,
+		LongURL:   l.longURL,
+		CreatedTS: l.createdTS,
+	}, nil
+}
+
+// Delete marks the link at shortPath deleted.
+func (s *Smallifier) Delete(ctx context.Context, shortPath string) error {
+	return s.change(shortPath, func(l *link) { l.deleted = true })
+}
+
+func (s *Smallifier) LookupHandler(w http.ResponseWriter, req *http.Request) {
+	shortPath := strings.TrimPrefix(req.URL.Path, s.base.Path)
+	s.mu.Lock()
+	l, ok := s.links[shortPath]
+	if ok && !l.deleted {
+		s.follows[shortPath]++
+	}
+	s.mu.Unlock()
+	switch {
+	case !ok:
+		writeError(w, 404, smallifier.ErrCodeNotFound, "link not found")
+	case l.deleted:
+		writeError(w, 410, smallifier.ErrCodeGone, "link deleted")
+	default:
+		w.Header().Set("Location", l.longURL)
+		w.WriteHeader(302)
+	}
+}
+
+func (s *Smallifier) DeleteHandler(w http.ResponseWriter, req *http.Request) {
+	if !checkPost(w, req) {
+		return
+	}
+	var r smallifier.DeleteRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		writeError(w, 400, smallifier.ErrCodeNotJSON, "error decoding json")
+		return
+	}
+	if r.Secret != Secret {
+		writeError(w, 401, smallifier.ErrCodeUnauthorized, "Bad secret")
+		return
+	}
+	shortPath := r.ShortPath
+	if shortPath == "" {
+		shortPath = strings.TrimPrefix(r.ShortURL, s.base.String())
+	}
+	s.respondToChange(w, s.change(shortPath, func(l *link) { l.deleted = true }))
+}
+
+func (s *Smallifier) LinkHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("Authorization") != "Bearer "+Secret {
+		writeError(w, 401, smallifier.ErrCodeUnauthorized, "Bad secret")
+		return
+	}
+	shortPath := strings.TrimPrefix(req.URL.Path, s.base.Path+"_links/")
+	switch req.Method {
+	case "PUT":
+		var r smallifier.UpdateRequest
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			writeError(w, 400, smallifier.ErrCodeNotJSON, "error decoding json")
+			return
+		}
+		if r.ApplyTS != 0 {
+			// Scheduled updates aren't faked.
+			notImplemented(w)
+			return
+		}
+		s.respondToChange(w, s.change(shortPath, func(l *link) { l.longURL = r.LongURL }))
+	case "DELETE":
+		s.respondToChange(w, s.change(shortPath, func(l *link) { l.deleted = true }))
+	default:
+		writeError(w, 405, smallifier.ErrCodeUnrecognized, "method not allowed")
+	}
+}
+
+// checkPost reports whether req is a POST, and otherwise responds 405 Method Not Allowed.
+// Unlike the real Smallifier, CORS preflight requests aren't answered.
+func checkPost(w http.ResponseWriter, req *http.Request) bool {
+	if req.Method == "POST" {
+		return true
+	}
+	w.Header().Set("Allow", "POST, OPTIONS")
+	writeError(w, 405, smallifier.ErrCodeUnrecognized, "Must POST")
+	return false
+}
+
+// change applies f to the link at shortPath, if there is one which hasn't been deleted.
+func (s *Smallifier) change(shortPath string, f func(*link)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.links[shortPath]
+	if !ok || l.deleted {
+		return newError(404, smallifier.ErrCodeNotFound, "link not found")
+	}
+	f(l)
+	return nil
+}
+
+// respondToChange responds to a request to change a link with err, the result of changing it.
+func (s *Smallifier) respondToChange(w http.ResponseWriter, err error) {
+	if err != nil {
+		writeErrorResponse(w, err.(*smallifier.ErrorResponse))
+		return
+	}
+	io.WriteString(w, `{}`)
+}
+
+func (s *Smallifier) CreateBundleHandler(w http.ResponseWriter, req *http.Request) { notImplemented(w) }
+func (s *Smallifier) NonceHandler(w http.ResponseWriter, req *http.Request)        { notImplemented(w) }
+func (s *Smallifier) AdminHandler(w http.ResponseWriter, req *http.Request)        { notImplemented(w) }
+func (s *Smallifier) ReadHandler(w http.ResponseWriter, req *http.Request)         { notImplemented(w) }
+func (s *Smallifier) StatsHandler(w http.ResponseWriter, req *http.Request)        { notImplemented(w) }
+func (s *Smallifier) LinksHandler(w http.ResponseWriter, req *http.Request)        { notImplemented(w) }
+func (s *Smallifier) IntentHandler(w http.ResponseWriter, req *http.Request)       { notImplemented(w) }
+func (s *Smallifier) AuditHandler(w http.ResponseWriter, req *http.Request)        { notImplemented(w) }
+func (s *Smallifier) QRHandler(w http.ResponseWriter, req *http.Request)           { notImplemented(w) }
+
+// Handler serves the endpoints under the path of the base URL, as smallifier.Smallifier's does.
+func (s *Smallifier) Handler() http.Handler {
+	p := s.base.Path
+	mux := http.NewServeMux()
+	mux.HandleFunc(p+"_create", s.CreateHandler)
+	mux.HandleFunc(p+"_bundle", s.CreateBundleHandler)
+	mux.HandleFunc(p+"_delete", s.DeleteHandler)
+	mux.HandleFunc(p+"_nonce", s.NonceHandler)
+	mux.HandleFunc(p+"_links", s.LinksHandler)
+	mux.HandleFunc(p+"_links/", s.LinkHandler)
+	mux.HandleFunc(p+"_admin/", s.AdminHandler)
+	mux.HandleFunc(p+"_read/", s.ReadHandler)
+	mux.HandleFunc(p+"_stats/", s.StatsHandler)
+	mux.HandleFunc(p+"_intent", s.IntentHandler)
+	mux.HandleFunc(p+"_audit/", s.AuditHandler)
+	mux.HandleFunc(p+"_qr/", s.QRHandler)
+	mux.HandleFunc(p, s.LookupHandler)
+	return mux
+}
+
+func (s *Smallifier) RandomErrors() float64                        { return 0 }
+func (s *Smallifier) RandomFallbacks() float64                     { return 0 }
+func (s *Smallifier) RandomBreakerOpen() float64                   { return 0 }
+func (s *Smallifier) ReadOnly() float64                            { return 0 }
+func (s *Smallifier) Maintenance() float64                         { return 0 }
+func (s *Smallifier) AuthErrors() float64                          { return 0 }
+func (s *Smallifier) DBUpdateErrors() float64                      { return 0 }
+func (s *Smallifier) WebhookErrors() float64                       { return 0 }
+func (s *Smallifier) LookupMisses() float64                        { return 0 }
+func (s *Smallifier) RateLimitedLookups() float64                  { return 0 }
+func (s *Smallifier) LoadShedding() float64                        { return 0 }
+func (s *Smallifier) LoadSheddingTransitions() float64             { return 0 }
+func (s *Smallifier) ShedRequests() float64                        { return 0 }
+func (s *Smallifier) NamespaceCounts() []smallifier.NamespaceCount { return nil }
+func (s *Smallifier) LinkLimitUsage() []smallifier.LinkLimitUsage  { return nil }
+func (s *Smallifier) LinkLimitRefusals() float64                   { return 0 }
+func (s *Smallifier) LookupCacheHits() float64                     { return 0 }
+func (s *Smallifier) LookupCacheMisses() float64                   { return 0 }
+func (s *Smallifier) FollowQueueDepth() float64                    { return 0 }
+func (s *Smallifier) DroppedFollows() float64                      { return 0 }
+func (s *Smallifier) PathCollisions() float64                      { return 0 }
+func (s *Smallifier) PathCollisionRate() float64                   { return 0 }
+func (s *Smallifier) PathSpaceFill() float64                       { return 0 }
+func (s *Smallifier) PathBytes() float64                           { return 6 }
+
+func (s *Smallifier) SetRewriteRules(rules []smallifier.RewriteRule)     {}
+func (s *Smallifier) SetTheme(t *smallifier.Theme)                       {}
+func (s *Smallifier) SetDestinationHosts(h *smallifier.DestinationHosts) {}
+func (s *Smallifier) SetSecrets(secrets []string)                        {}
+func (s *Smallifier) Close()                                             {}
+func (s *Smallifier) Shutdown(ctx context.Context) error                 { return nil }
+
+func (s *Smallifier) SetMaintenance(r smallifier.MaintenanceRequest) smallifier.MaintenanceStatus {
+	return smallifier.MaintenanceStatus{}
+}
+
+func newError(status int, code smallifier.ErrCode, msg string) *smallifier.ErrorResponse {
+	return &smallifier.ErrorResponse{ErrCode: code, Message: msg, Status: status}
+}
+
+func writeError(w http.ResponseWriter, status int, code smallifier.ErrCode, msg string) {
+	writeErrorResponse(w, newError(status, code, msg))
+}
+
+func writeErrorResponse(w http.ResponseWriter, e *smallifier.ErrorResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(e)
+}
+
+func notImplemented(w http.ResponseWriter) {
+	writeError(w, 501, smallifier.ErrCodeUnrecognized, "not implemented by smallifiertest")
+}
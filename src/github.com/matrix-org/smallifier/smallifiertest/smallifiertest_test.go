@@ -0,0 +1,84 @@
+package smallifiertest
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/matrix-org/smallifier/client"
+	"github.com/matrix-org/smallifier/smallifier"
+)
+
+func TestServer(t *testing.T) {
+	s := NewServer(map[string]string{"fosdem2024": "https://fosdem.org/2024/"})
+	defer s.Close()
+
+	resp, err := client.New(s.Base, Secret).Create(context.Background(), smallifier.CreateRequest{LongURL: "https://matrix.org/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := s.Base + resp.ShortPath; resp.ShortURL != want {
+		t.Errorf("want short URL %s got %s", want, resp.ShortURL)
+	}
+	s.AssertLink(t, resp.ShortPath, "https://matrix.org/")
+
+	httpClient := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	for _, tc := range []struct {
+		shortPath string
+		want      int
+		location  string
+	}{
+		{"fosdem2024", 302, "https://fosdem.org/2024/"},
+		{resp.ShortPath, 302, "https://matrix.org/"},
+		{resp.ShortPath, 302, "https://matrix.org/"},
+		{"missing", 404, ""},
+	} {
+		r, err := httpClient.Get(s.Base + tc.shortPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+		if r.StatusCode != tc.want || r.Header.Get("Location") != tc.location {
+			t.Errorf("%s: want %d to %q got %d to %q", tc.shortPath, tc.want, tc.location, r.StatusCode, r.Header.Get("Location"))
+		}
+	}
+	s.AssertFollows(t, "fosdem2024", 1)
+	s.AssertFollows(t, resp.ShortPath, 2)
+}
+
+func TestCreateNeedsSecret(t *testing.T) {
+	s := NewServer(nil)
+	defer s.Close()
+
+	c := client.New(s.Base, "wrong")
+	_, err := c.Create(context.Background(), smallifier.CreateRequest{LongURL: "https://matrix.org/"})
+	if e, ok := err.(*client.Error); !ok || e.StatusCode != 401 {
+		t.Errorf("want a 401 error got %v", err)
+	}
+	if len(s.Links()) != 0 {
+		t.Errorf("want no links got %v", s.Links())
+	}
+}
+
+func TestInProcess(t *testing.T) {
+	ctx := context.Background()
+	s := New(url.URL{Scheme: "https", Host: "example.com"}, nil)
+	resp, err := s.Shorten(ctx, smallifier.CreateRequest{LongURL: "https://matrix.org/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := s.Resolve(ctx, resp.ShortPath)
+	if err != nil || l.LongURL != "https://matrix.org/" || l.ShortURL != resp.ShortURL {
+		t.Errorf("resolving: want link to https://matrix.org/ at %s got %+v, %v", resp.ShortURL, l, err)
+	}
+	if err := s.Delete(ctx, resp.ShortPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Resolve(ctx, resp.ShortPath); err == nil || err.(*smallifier.ErrorResponse).ErrCode != smallifier.ErrCodeGone {
+		t.Errorf("resolving deleted link: want %s got %v", smallifier.ErrCodeGone, err)
+	}
+	if err := s.Delete(ctx, "missing"); err == nil || err.(*smallifier.ErrorResponse).ErrCode != smallifier.ErrCodeNotFound {
+		t.Errorf("deleting missing link: want %s got %v", smallifier.ErrCodeNotFound, err)
+	}
+}